@@ -20,6 +20,7 @@ import (
 	"golang.org/x/net/context"
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/schema"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -45,6 +46,11 @@ func (_ *AllocBackend) Run(ctx context.Context) {
 }
 
 func (be *AllocBackend) RegisterNetwork(ctx context.Context, network string, config *subnet.Config) (backend.Network, error) {
+	// alloc has no options
+	if err := schema.Decode(config.Backend, &struct{}{}, "Type"); err != nil {
+		return nil, fmt.Errorf("error decoding alloc backend config: %v", err)
+	}
+
 	attrs := subnet.LeaseAttrs{
 		PublicIP: ip.FromIP(be.extIface.ExtAddr),
 	}
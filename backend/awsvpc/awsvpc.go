@@ -15,18 +15,18 @@
 package awsvpc
 
 import (
-	"encoding/json"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/schema"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -57,10 +57,8 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, network string, co
 		RouteTableID string
 	}{}
 
-	if len(config.Backend) > 0 {
-		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
-			return nil, fmt.Errorf("error decoding VPC backend config: %v", err)
-		}
+	if err := schema.Decode(config.Backend, &cfg, "Type"); err != nil {
+		return nil, fmt.Errorf("error decoding VPC backend config: %v", err)
 	}
 
 	// Acquire the lease form subnet manager
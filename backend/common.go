@@ -15,17 +15,50 @@
 package backend
 
 import (
+	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
 
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/logging"
 	"github.com/coreos/flannel/subnet"
 )
 
+// ExternalInterface is the interface the traffic to the other hosts goes
+// out of.
 type ExternalInterface struct {
-	Iface     *net.Interface
+	Iface *net.Interface
+	// IfaceAddr is the address of Iface the traffic is sent from
 	IfaceAddr net.IP
-	ExtAddr   net.IP
+	// ExtAddr is the address the other hosts reach us at, the public IP of
+	// the lease, usually IfaceAddr
+	ExtAddr net.IP
+
+	// the MTU of Iface once it changed, see SetMTU
+	mtuMux sync.Mutex
+	mtu    int
+}
+
+// MTU returns the MTU of the interface, which may have changed since it was
+// looked up.
+func (ei *ExternalInterface) MTU() int {
+	ei.mtuMux.Lock()
+	defer ei.mtuMux.Unlock()
+	if ei.mtu > 0 {
+		return ei.mtu
+	}
+	return ei.Iface.MTU
+}
+
+// SetMTU records that the MTU of the interface changed to mtu.
+func (ei *ExternalInterface) SetMTU(mtu int) {
+	ei.mtuMux.Lock()
+	defer ei.mtuMux.Unlock()
+	ei.mtu = mtu
 }
 
 // Besides the entry points in the Backend interface, the backend's New()
@@ -46,12 +79,156 @@ type Backend interface {
 	RegisterNetwork(ctx context.Context, network string, config *subnet.Config) (Network, error)
 }
 
+// Network is a network registered with a backend.
 type Network interface {
+	// Lease is the lease of the host, which the caller renews
 	Lease() *subnet.Lease
+	// MTU is the MTU for the containers
 	MTU() int
+	// Run follows the leases of the other hosts until ctx is done
 	Run(ctx context.Context)
 }
 
+// StateDumper is implemented by networks which can report their dataplane
+// state (peer subnets, routes, FDB entries, ...) for support bundles.
+type StateDumper interface {
+	DumpState(w io.Writer)
+}
+
+// PortUser is implemented by networks which receive traffic from other
+// hosts on ports that a host firewall has to let through.
+type PortUser interface {
+	// Ports returns the ports as "port/protocol", e.g. "8472/udp".
+	Ports() []string
+}
+
+// Planner is implemented by backends which can describe the dataplane
+// changes (devices, routes, ...) they would make for a network given our
+// lease and those of the peers, without making them. Used by --dry-run.
+type Planner interface {
+	Plan(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) ([]string, error)
+}
+
+// StateReader is implemented by Planners which can describe the dataplane
+// of a network as it currently is, in the form of the steps of Plan, so
+// that --plan can show what applying the plan would change.
+type StateReader interface {
+	CurrentState(config *subnet.Config, lease *subnet.Lease) ([]string, error)
+}
+
+// DiffSteps compares the steps of a plan with those describing the current
+// state. Steps that would be run are marked with "+", those already in
+// place with "=" and entries of the current state that are not part of the
+// plan with "-". Comments are kept as they are.
+func DiffSteps(planned, current []string) []string {
+	have := map[string]bool{}
+	for _, s := range current {
+		have[s] = true
+	}
+
+	diff := []string{}
+	for _, s := range planned {
+		switch {
+		case strings.HasPrefix(s, "#"):
+			diff = append(diff, s)
+		case have[s]:
+			diff = append(diff, "= "+s)
+			delete(have, s)
+		default:
+			diff = append(diff, "+ "+s)
+		}
+	}
+	for _, s := range current {
+		switch {
+		case strings.HasPrefix(s, "#"):
+			diff = append(diff, s)
+		case have[s]:
+			diff = append(diff, "- "+s)
+		}
+	}
+	return diff
+}
+
+// CheckResult is the outcome of one check of `flanneld check`.
+type CheckResult struct {
+	Name string
+	// Err is nil if the check passed
+	Err error
+	// Hint tells how to fix a failed check
+	Hint string
+}
+
+// Checker is implemented by backends which can verify that the dataplane
+// of a network (devices, routes, FDB entries, ...) matches our lease and
+// those of the peers. Used by `flanneld check`.
+type Checker interface {
+	Check(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) []CheckResult
+}
+
+// Reconciler is implemented by networks which can bring their dataplane
+// back in line with the leases on demand, e.g. after another agent removed
+// routes. Used by the admin API.
+type Reconciler interface {
+	Reconcile(ctx context.Context) error
+}
+
+// DriftDetector is implemented by networks which can compare their
+// dataplane with the leases of the peers without changing it, to tell
+// when another agent fights over the routes or FDB entries.
+type DriftDetector interface {
+	// Drift describes each entry that is missing, differs from the lease
+	// or belongs to a subnet without a lease.
+	Drift(peers []subnet.Lease) ([]string, error)
+}
+
+// Retirer is implemented by networks which leave devices behind when they
+// stop, to remove them once the network migrated to another backend.
+type Retirer interface {
+	Retire()
+}
+
+// PortPlanner is implemented by backends whose networks are PortUsers, to
+// tell the ports without registering a network.
+type PortPlanner interface {
+	PlanPorts(config *subnet.Config) ([]string, error)
+}
+
+// DeviceUser is implemented by networks which send the traffic to the other
+// subnets through a device of their own rather than the external interface.
+type DeviceUser interface {
+	Device() string
+}
+
+// MTUAdjuster is implemented by networks whose device MTU can follow the
+// path MTU to the peers, see --mtu-discovery-interval.
+type MTUAdjuster interface {
+	// Overhead is what the encapsulation adds to every packet.
+	Overhead() int
+	// SetMTU sets the MTU of the device, and so what MTU returns. It is
+	// capped at the MTU of the external interface less the overhead.
+	SetMTU(mtu int) error
+}
+
+// FIPSChecker is implemented by backends which use crypto of their own, to
+// tell whether the network config restricts it to FIPS approved algorithms.
+// The other backends comply as far as they use crypto through Go's.
+type FIPSChecker interface {
+	CheckFIPS(config *subnet.Config) error
+}
+
+// CheckFIPS fails if FIPS mode is on and be cannot comply with config.
+func CheckFIPS(be Backend, config *subnet.Config) error {
+	if !fips.Enabled() {
+		return nil
+	}
+	if fc, ok := be.(FIPSChecker); ok {
+		if err := fc.CheckFIPS(config); err != nil {
+			return fmt.Errorf("the %v backend does not comply with FIPS mode: %v", config.BackendType, err)
+		}
+	}
+	return nil
+}
+
 type BackendCtor func(sm subnet.Manager, ei *ExternalInterface) (Backend, error)
 
 type SimpleNetwork struct {
@@ -64,9 +241,25 @@ func (n *SimpleNetwork) Lease() *subnet.Lease {
 }
 
 func (n *SimpleNetwork) MTU() int {
-	return n.ExtIface.Iface.MTU
+	return n.ExtIface.MTU()
 }
 
 func (_ *SimpleNetwork) Run(ctx context.Context) {
 	<-ctx.Done()
 }
+
+// EventFields returns the structured logging fields describing a subnet
+// event handled by the given backend, for log.InfoKV.
+func EventFields(backendType string, evt subnet.Event) []interface{} {
+	name := "subnet-added"
+	if evt.Type == subnet.EventRemoved {
+		name = "subnet-removed"
+	}
+
+	return []interface{}{
+		logging.FieldEvent, name,
+		logging.FieldSubnet, evt.Lease.Subnet,
+		logging.FieldBackend, backendType,
+		logging.FieldNode, evt.Lease.Attrs.PublicIP,
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conformance is the behavior every backend must have, checked on a
+// simulated cluster (see package e2e) so that the backends do not drift
+// apart. The tests of a backend run it with
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, conformance.Backend{Type: "vxlan", Overhead: 50})
+//	}
+//
+// which is skipped unless go test is given -conformance, as it requires
+// root and a flanneld binary, given by -conformance.flanneld or
+// $FLANNEL_E2E_FLANNELD. Backends kept out of tree run it the same way
+// against a flanneld built with them.
+package conformance
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/e2e"
+	"github.com/coreos/flannel/pkg/subnetenv"
+)
+
+var (
+	enabled  bool
+	flanneld string
+)
+
+func init() {
+	flag.BoolVar(&enabled, "conformance", false, "run the backend conformance suite, which requires root")
+	flag.StringVar(&flanneld, "conformance.flanneld", os.Getenv("FLANNEL_E2E_FLANNELD"), "flanneld binary run by the conformance suite")
+}
+
+// underlayMTU is not the usual 1500 so that a backend assuming it fails.
+const underlayMTU = 1400
+
+// timeout is how long the nodes get to converge after each change.
+const timeout = 30 * time.Second
+
+// Backend describes the backend under test.
+type Backend struct {
+	// Type is the backend type of the network config
+	Type string
+	// Config holds more options of the backend as JSON object members
+	Config string
+	// Overhead is how many bytes the backend adds to each packet, by which
+	// the MTU of the flannel network is below that of the underlay
+	Overhead int
+	// Args are additional flanneld options
+	Args []string
+}
+
+// Run checks that a cluster of three nodes using the backend reaches full
+// connectivity, then that it converges again after each of:
+//
+//	MTU          (nothing, the MTU is that of the underlay less Overhead)
+//	LeaseAdd     a node joins
+//	LeaseRemove  the lease of a node which is down is revoked, then it
+//	             comes back with another one
+//	LeaseUpdate  the lease of a node is renewed
+//	Restart      flanneld restarts, keeping its lease
+//	IPChange     the address of a node changes
+//
+// They run in this order on the same cluster, so a failure stops the rest,
+// and the log tells which one failed.
+func Run(t *testing.T, b Backend) {
+	if !enabled {
+		t.Skip("the conformance suite only runs with -conformance")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("the conformance suite requires root")
+	}
+	if flanneld == "" {
+		t.Fatal("no flanneld binary, see -conformance.flanneld")
+	}
+
+	c, err := e2e.Start(e2e.Config{
+		Flanneld:      flanneld,
+		Nodes:         3,
+		Backend:       b.Type,
+		BackendConfig: b.Config,
+		MTU:           underlayMTU,
+		Prefix:        "flconf",
+		Args:          b.Args,
+	})
+	if err != nil {
+		t.Fatalf("failed to start the cluster: %v", err)
+	}
+	defer c.Close()
+	converge(t, c)
+
+	for _, tc := range []struct {
+		name string
+		f    func(*testing.T, *e2e.Cluster, Backend)
+	}{
+		{"MTU", testMTU},
+		{"LeaseAdd", testLeaseAdd},
+		{"LeaseRemove", testLeaseRemove},
+		{"LeaseUpdate", testLeaseUpdate},
+		{"Restart", testRestart},
+		{"IPChange", testIPChange},
+	} {
+		t.Logf("checking %v", tc.name)
+		if tc.f(t, c, b); t.Failed() {
+			break
+		}
+	}
+}
+
+// converge waits for the leases of every node and for full connectivity.
+func converge(t *testing.T, c *e2e.Cluster) {
+	if err := c.WaitForLeases(timeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckConnectivity(timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMTU(t *testing.T, c *e2e.Cluster, b Backend) {
+	want := underlayMTU - b.Overhead
+	for _, n := range c.Nodes {
+		env, err := subnetenv.ReadFile(filepath.Join(n.Dir, "subnet.env"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtu, err := strconv.Atoi(env["FLANNEL_MTU"]); err != nil || mtu != want {
+			t.Errorf("%v: FLANNEL_MTU is %q, want %d", n.Name, env["FLANNEL_MTU"], want)
+		}
+	}
+}
+
+func testLeaseAdd(t *testing.T, c *e2e.Cluster, b Backend) {
+	if _, err := c.AddNode(); err != nil {
+		t.Fatalf("failed to add a node: %v", err)
+	}
+	converge(t, c)
+}
+
+func testLeaseRemove(t *testing.T, c *e2e.Cluster, b Backend) {
+	// killed, flanneld neither revokes its lease nor tears down the
+	// dataplane, so the node would still answer if the others kept it
+	n := c.Nodes[len(c.Nodes)-1]
+	if err := c.StopFlanneld(n, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	l, err := c.Lease(n)
+	if err != nil || l == nil {
+		t.Fatalf("no lease for %v: %v", n.Name, err)
+	}
+	if err := c.Registry().RevokeLease(context.Background(), "", l.Subnet); err != nil {
+		t.Fatalf("failed to revoke the lease of %v: %v", n.Name, err)
+	}
+
+	for _, from := range c.Nodes {
+		if from == n {
+			continue
+		}
+		if err := waitUnreachable(c, from, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.StartFlanneld(n); err != nil {
+		t.Fatal(err)
+	}
+	converge(t, c)
+}
+
+// waitUnreachable waits for to to stop answering from.
+func waitUnreachable(c *e2e.Cluster, from, to *e2e.Node) error {
+	deadline := time.Now().Add(timeout)
+	for c.Probe(from, to) == nil {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v still reaches %v once its lease is gone", from.Name, to.Name)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil
+}
+
+func testLeaseUpdate(t *testing.T, c *e2e.Cluster, b Backend) {
+	n := c.Nodes[0]
+	l, err := c.Lease(n)
+	if err != nil || l == nil {
+		t.Fatalf("no lease for %v: %v", n.Name, err)
+	}
+	// the others see the renewal like any change of the lease
+	if err := c.Registry().RenewLease(context.Background(), "", l); err != nil {
+		t.Fatalf("failed to renew the lease of %v: %v", n.Name, err)
+	}
+	converge(t, c)
+}
+
+func testRestart(t *testing.T, c *e2e.Cluster, b Backend) {
+	n := c.Nodes[0]
+	before, err := c.Lease(n)
+	if err != nil || before == nil {
+		t.Fatalf("no lease for %v: %v", n.Name, err)
+	}
+	if err := c.StopFlanneld(n, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartFlanneld(n); err != nil {
+		t.Fatal(err)
+	}
+	converge(t, c)
+
+	after, err := c.Lease(n)
+	if err != nil || after == nil {
+		t.Fatalf("no lease for %v: %v", n.Name, err)
+	}
+	if !after.Subnet.Equal(before.Subnet) {
+		t.Errorf("%v has subnet %v after restarting, want %v", n.Name, after.Subnet, before.Subnet)
+	}
+}
+
+func testIPChange(t *testing.T, c *e2e.Cluster, b Backend) {
+	n := c.Nodes[1]
+	// well above the addresses of the nodes, well below that of the bridge
+	addr := n.PublicIP + 100
+	if err := c.SetPublicIP(n, addr); err != nil {
+		t.Fatalf("failed to change the address of %v: %v", n.Name, err)
+	}
+	converge(t, c)
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The switches below are flipped at runtime through the admin API, to debug
+// an incident without restarting flanneld.
+
+var (
+	debugMux sync.Mutex
+	tracing  bool
+	// resumed is closed while route programming is not paused
+	resumed = closedChan()
+)
+
+func closedChan() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// SetTracing enables or disables the logging of every dataplane decision
+// (routes, FDB and neighbor entries added or removed, misses resolved) by
+// the backends.
+func SetTracing(enabled bool) {
+	debugMux.Lock()
+	defer debugMux.Unlock()
+	tracing = enabled
+}
+
+// Tracing returns whether tracing is enabled.
+func Tracing() bool {
+	debugMux.Lock()
+	defer debugMux.Unlock()
+	return tracing
+}
+
+// Tracef logs a dataplane decision if tracing is enabled.
+func Tracef(format string, args ...interface{}) {
+	if Tracing() {
+		log.Info("trace: " + fmt.Sprintf(format, args...))
+	}
+}
+
+// PauseRouting holds back the lease changes from the backends until
+// ResumeRouting, so that they stop programming routes. It returns false if
+// route programming was already paused.
+func PauseRouting() bool {
+	debugMux.Lock()
+	defer debugMux.Unlock()
+
+	select {
+	case <-resumed:
+		resumed = make(chan struct{})
+		return true
+	default:
+		return false
+	}
+}
+
+// ResumeRouting passes the lease changes held back since PauseRouting on to
+// the backends. It returns false if route programming was not paused.
+func ResumeRouting() bool {
+	debugMux.Lock()
+	defer debugMux.Unlock()
+
+	select {
+	case <-resumed:
+		return false
+	default:
+		close(resumed)
+		return true
+	}
+}
+
+// RoutingPaused returns whether route programming is paused. Backends which
+// restore their routes periodically skip that while it is.
+func RoutingPaused() bool {
+	select {
+	case <-routingResumed():
+		return false
+	default:
+		return true
+	}
+}
+
+func routingResumed() <-chan struct{} {
+	debugMux.Lock()
+	defer debugMux.Unlock()
+	return resumed
+}
+
+// pausingManager is the subnet.Manager of the backends, whose lease watches
+// do not return while route programming is paused.
+type pausingManager struct {
+	subnet.Manager
+}
+
+func waitRouting(ctx context.Context) error {
+	select {
+	case <-routingResumed():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m pausingManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	res, err := m.Manager.WatchLease(ctx, network, sn, cursor)
+	if err == nil {
+		err = waitRouting(ctx)
+	}
+	return res, err
+}
+
+func (m pausingManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	res, err := m.Manager.WatchLeases(ctx, network, cursor)
+	if err == nil {
+		err = waitRouting(ctx)
+	}
+	return res, err
+}
+
+// Packet is a packet to trace, by its inner (container to container)
+// headers.
+type Packet struct {
+	// Proto is tcp, udp, icmp or empty for any protocol
+	Proto            string
+	Src, Dst         ip.IP4
+	SrcPort, DstPort uint16
+}
+
+func (p *Packet) String() string {
+	if p.SrcPort == 0 && p.DstPort == 0 {
+		return fmt.Sprintf("%v %v -> %v", p.Proto, p.Src, p.Dst)
+	}
+	return fmt.Sprintf("%v %v:%v -> %v:%v", p.Proto, p.Src, p.SrcPort, p.Dst, p.DstPort)
+}
+
+// PacketTracer is implemented by networks which can tell how a packet to
+// another host would be forwarded: the route and FDB or neighbor entries it
+// matches, the peer it goes to and its outer header. The steps are taken
+// from the current kernel state, without sending anything.
+type PacketTracer interface {
+	TracePacket(p *Packet) ([]string, error)
+}
+
+// TraceRoute returns the kernel route p takes and describes it.
+func TraceRoute(p *Packet) (*netlink.Route, string, error) {
+	rts, err := netlink.RouteGet(p.Dst.ToIP())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up the route to %v: %v", p.Dst, err)
+	}
+	if len(rts) == 0 {
+		return nil, "", fmt.Errorf("no route to %v", p.Dst)
+	}
+
+	r := &rts[0]
+	dev := fmt.Sprint(r.LinkIndex)
+	if l, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+		dev = l.Attrs().Name
+	}
+
+	desc := fmt.Sprintf("route: %v dev %v", p.Dst, dev)
+	if r.Gw != nil {
+		desc += fmt.Sprintf(" via %v", r.Gw)
+	}
+	if r.Src != nil {
+		desc += fmt.Sprintf(" src %v", r.Src)
+	}
+	return r, desc, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backend defines the backends, which forward the traffic of a
+// flannel network between the hosts (and program their dataplane) from the
+// leases of the subnet package, and runs them.
+//
+// A program embedding flannel imports the backends it supports for their
+// registration, e.g. github.com/coreos/flannel/backend/vxlan, and gets them
+// with NewBackend, or through a Manager which runs each backend once:
+//
+//	bm := backend.NewManager(ctx, sm, &backend.ExternalInterface{
+//		Iface:     iface,
+//		IfaceAddr: addr,
+//		ExtAddr:   addr,
+//	})
+//	be, err := bm.GetBackend(config.BackendType)
+//	...
+//	bn, err := be.RegisterNetwork(ctx, "", config)
+//	...
+//	go bn.Run(ctx)
+//
+// RegisterNetwork acquires the lease of the host and sets up its side of the
+// dataplane, Run then follows the leases of the other hosts until ctx is
+// done. The optional interfaces, like Reconciler or MTUAdjuster, tell what
+// else a network supports. Like subnet, the package registers no flags and
+// logs through pkg/log.
+package backend
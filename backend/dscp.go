@@ -0,0 +1,55 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DSCPInherit is the DSCP of the DSCP option "inherit", by which the outer
+// header of an encapsulated packet gets the DSCP of the inner one.
+const DSCPInherit = -1
+
+var dscpNames = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+// ParseDSCP parses the DSCP option of the encapsulating backends: a number
+// from 0 to 63, a class name such as EF or AF41, or "inherit". It returns 0
+// for "", which leaves the outer headers best-effort.
+func ParseDSCP(s string) (int, error) {
+	ls := strings.ToLower(strings.TrimSpace(s))
+	switch ls {
+	case "":
+		return 0, nil
+	case "inherit":
+		return DSCPInherit, nil
+	}
+	if v, ok := dscpNames[ls]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(ls)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q, expected 0 to 63, a class such as EF or AF41, or inherit", s)
+	}
+	return v, nil
+}
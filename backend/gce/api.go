@@ -18,11 +18,11 @@ import (
 	"fmt"
 	"time"
 
-	log "github.com/golang/glog"
-
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
+
+	"github.com/coreos/flannel/pkg/log"
 )
 
 type gceAPI struct {
@@ -42,12 +42,13 @@ import (
 	"strings"
 	"sync"
 
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/api/googleapi"
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/schema"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -87,6 +88,11 @@ func (g *GCEBackend) Run(ctx context.Context) {
 }
 
 func (g *GCEBackend) RegisterNetwork(ctx context.Context, network string, config *subnet.Config) (backend.Network, error) {
+	// gce has no options
+	if err := schema.Decode(config.Backend, &struct{}{}, "Type"); err != nil {
+		return nil, fmt.Errorf("error decoding GCE backend config: %v", err)
+	}
+
 	attrs := subnet.LeaseAttrs{
 		PublicIP: ip.FromIP(g.extIface.ExtAddr),
 	}
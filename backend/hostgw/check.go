@@ -0,0 +1,67 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// Check implements backend.Checker.
+func (be *HostgwBackend) Check(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) []backend.CheckResult {
+	return []backend.CheckResult{{
+		Name: "routes to peers",
+		Err:  checkRoutes(peers),
+		Hint: "restart flanneld to reprogram the routes, and make sure the peers are on the same L2 network",
+	}}
+}
+
+// checkRoutes verifies that there is a route to the subnet of every host-gw
+// peer via its public IP.
+func checkRoutes(peers []subnet.Lease) error {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	missing := []string{}
+	for _, l := range peers {
+		if l.Attrs.BackendType != "host-gw" {
+			continue
+		}
+
+		found := false
+		for _, r := range routes {
+			if r.Dst != nil && ip.FromIPNet(r.Dst).Equal(l.Subnet) && l.Attrs.PublicIP.ToIP().Equal(r.Gw) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%v via %v", l.Subnet, l.Attrs.PublicIP))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// Drift implements backend.DriftDetector, comparing the routes to the
+// subnets of the network with those of the host-gw peers.
+func (n *network) Drift(peers []subnet.Lease) ([]string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	// the gateway of each subnet's route
+	gws := map[ip.IP4Net]ip.IP4{}
+	for _, r := range routes {
+		if r.Dst == nil || r.Gw == nil || r.Gw.To4() == nil {
+			continue
+		}
+		sn := ip.FromIPNet(r.Dst)
+		if sn.PrefixLen == n.subnetLen && n.network.Contains(sn.IP) && !sn.Equal(n.lease.Subnet) {
+			gws[sn] = ip.FromIP(r.Gw)
+		}
+	}
+
+	drift := []string{}
+	for _, l := range peers {
+		if l.Attrs.BackendType != "host-gw" {
+			continue
+		}
+		gw, ok := gws[l.Subnet]
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("missing route to %v via %v", l.Subnet, l.Attrs.PublicIP))
+		case gw != l.Attrs.PublicIP:
+			drift = append(drift, fmt.Sprintf("route to %v via %v instead of %v", l.Subnet, gw, l.Attrs.PublicIP))
+		}
+		delete(gws, l.Subnet)
+	}
+
+	for sn, gw := range gws {
+		drift = append(drift, fmt.Sprintf("route to %v via %v without a lease", sn, gw))
+	}
+	return drift, nil
+}
@@ -20,6 +20,7 @@ import (
 	"golang.org/x/net/context"
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/schema"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -56,10 +57,23 @@ func (_ *HostgwBackend) Run(ctx context.Context) {
 }
 
 func (be *HostgwBackend) RegisterNetwork(ctx context.Context, netname string, config *subnet.Config) (backend.Network, error) {
+	cfg := struct {
+		// AdvMSS sets the advmss of the route to each peer subnet to fit
+		// the MTU the peer advertises
+		AdvMSS bool
+	}{}
+	if err := schema.Decode(config.Backend, &cfg, "Type"); err != nil {
+		return nil, fmt.Errorf("error decoding host-gw backend config: %v", err)
+	}
+
 	n := &network{
-		name:     netname,
-		extIface: be.extIface,
-		sm:       be.sm,
+		name:      netname,
+		extIface:  be.extIface,
+		sm:        be.sm,
+		network:   config.Network,
+		subnetLen: config.SubnetLen,
+		advMSS:    cfg.AdvMSS,
+		mss:       make(map[ip.IP4Net]int),
 	}
 
 	attrs := subnet.LeaseAttrs{
@@ -85,3 +99,16 @@ func (be *HostgwBackend) RegisterNetwork(ctx context.Context, netname string, co
 
 	return n, nil
 }
+
+// Plan implements backend.Planner.
+func (be *HostgwBackend) Plan(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) ([]string, error) {
+	var steps []string
+	for _, l := range peers {
+		if l.Attrs.BackendType != "host-gw" {
+			steps = append(steps, fmt.Sprintf("# ignoring non-host-gw subnet %v: type=%v", l.Subnet, l.Attrs.BackendType))
+			continue
+		}
+		steps = append(steps, fmt.Sprintf("ip route add %v via %v dev %v", l.Subnet, l.Attrs.PublicIP, be.extIface.Iface.Name))
+	}
+	return steps, nil
+}
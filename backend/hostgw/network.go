@@ -16,25 +16,43 @@ package hostgw
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"net"
+	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	log "github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/tracing"
 	"github.com/coreos/flannel/subnet"
 )
 
+// routeProtocol is the protocol (see ip-route(8)) of the routes we add, by
+// which pruneStaleRoutes tells them from routes others added within the
+// network.
+const routeProtocol = 87
+
 type network struct {
 	name      string
 	extIface  *backend.ExternalInterface
 	linkIndex int
+	rlMux     sync.Mutex
 	rl        []netlink.Route
 	lease     *subnet.Lease
 	sm        subnet.Manager
+	network   ip.IP4Net
+	subnetLen uint
+	advMSS    bool
+	// mss is the advmss set on the route to each peer subnet, under rlMux
+	mss map[ip.IP4Net]int
 }
 
 func (n *network) Lease() *subnet.Lease {
@@ -42,12 +60,14 @@ func (n *network) Lease() *subnet.Lease {
 }
 
 func (n *network) MTU() int {
-	return n.extIface.Iface.MTU
+	return n.extIface.MTU()
 }
 
 func (n *network) Run(ctx context.Context) {
 	wg := sync.WaitGroup{}
 
+	n.pruneStaleRoutes(ctx)
+
 	log.Info("Watching for new subnet leases")
 	evts := make(chan []subnet.Event)
 	wg.Add(1)
@@ -68,7 +88,9 @@ func (n *network) Run(ctx context.Context) {
 	for {
 		select {
 		case evtBatch := <-evts:
+			_, span := tracing.Start(ctx, "hostgw.handleSubnetEvents", tracing.KV("network", n.name), tracing.KV("events", len(evtBatch)))
 			n.handleSubnetEvents(evtBatch)
+			span.End(nil)
 
 		case <-ctx.Done():
 			return
@@ -76,11 +98,61 @@ func (n *network) Run(ctx context.Context) {
 	}
 }
 
+// pruneStaleRoutes removes routes to subnets of the flannel network that
+// are left over from a previous run but no longer have a lease. Routes
+// which are still valid are kept so a restart does not disrupt traffic.
+func (n *network) pruneStaleRoutes(ctx context.Context) {
+	wr, err := n.sm.WatchLeases(ctx, n.name, nil)
+	if err != nil {
+		log.Warningf("Unable to get lease snapshot, not checking for stale routes: %v", err)
+		return
+	}
+
+	leased := make(map[ip.IP4Net]bool)
+	for _, l := range wr.Snapshot {
+		leased[l.Subnet] = true
+	}
+
+	routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		log.Warningf("Unable to list routes: %v", err)
+		return
+	}
+
+	for _, r := range n.staleRoutes(routeList, leased) {
+		log.Infof("Removing stale route to %v via %v", r.Dst, r.Gw)
+		if err := netlink.RouteDel(&r); err != nil {
+			log.Errorf("Error deleting stale route to %v: %v", r.Dst, err)
+		} else {
+			backend.Tracef("deleted stale route to %v via %v", r.Dst, r.Gw)
+		}
+	}
+}
+
+// staleRoutes returns the routes of routeList we added to subnets of the
+// network other than ours that are not leased. Routes added by others, or
+// by flanneld versions which did not tag them with routeProtocol, are left
+// alone.
+func (n *network) staleRoutes(routeList []netlink.Route, leased map[ip.IP4Net]bool) []netlink.Route {
+	var stale []netlink.Route
+	for _, r := range routeList {
+		if r.Protocol != routeProtocol || r.Dst == nil || r.Gw == nil {
+			continue
+		}
+		sn := ip.FromIPNet(r.Dst)
+		if sn.PrefixLen != n.subnetLen || !n.network.Contains(sn.IP) || sn.Equal(n.lease.Subnet) || leased[sn] {
+			continue
+		}
+		stale = append(stale, r)
+	}
+	return stale
+}
+
 func (n *network) handleSubnetEvents(batch []subnet.Event) {
 	for _, evt := range batch {
 		switch evt.Type {
 		case subnet.EventAdded:
-			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
+			log.InfoKV(fmt.Sprintf("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP), backend.EventFields("host-gw", evt)...)
 
 			if evt.Lease.Attrs.BackendType != "host-gw" {
 				log.Warningf("Ignoring non-host-gw subnet: type=%v", evt.Lease.Attrs.BackendType)
@@ -91,6 +163,7 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				Dst:       evt.Lease.Subnet.ToIPNet(),
 				Gw:        evt.Lease.Attrs.PublicIP.ToIP(),
 				LinkIndex: n.linkIndex,
+				Protocol:  routeProtocol,
 			}
 
 			// Check if route exists before attempting to add it
@@ -115,11 +188,16 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 			} else if err := netlink.RouteAdd(&route); err != nil {
 				log.Errorf("Error adding route to %v via %v: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, err)
 				continue
+			} else {
+				backend.Tracef("added route to %v via %v dev index %v", route.Dst, route.Gw, route.LinkIndex)
 			}
 			n.addToRouteList(route)
+			if n.advMSS {
+				n.setPeerMSS(route, peerMSS(n.extIface.MTU(), &evt.Lease))
+			}
 
 		case subnet.EventRemoved:
-			log.Info("Subnet removed: ", evt.Lease.Subnet)
+			log.InfoKV(fmt.Sprint("Subnet removed: ", evt.Lease.Subnet), backend.EventFields("host-gw", evt)...)
 
 			if evt.Lease.Attrs.BackendType != "host-gw" {
 				log.Warningf("Ignoring non-host-gw subnet: type=%v", evt.Lease.Attrs.BackendType)
@@ -135,7 +213,11 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
 				continue
 			}
+			backend.Tracef("deleted route to %v via %v", route.Dst, route.Gw)
 			n.removeFromRouteList(route)
+			n.rlMux.Lock()
+			delete(n.mss, evt.Lease.Subnet)
+			n.rlMux.Unlock()
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -143,11 +225,72 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 	}
 }
 
+// peerMSS returns the advmss for the route to the subnet of l: the MSS of
+// TCP segments fitting both our MTU and the one the peer advertises, which
+// older flanneld versions do not.
+func peerMSS(mtu int, l *subnet.Lease) int {
+	if l.Attrs.MTU > 0 && l.Attrs.MTU < mtu {
+		mtu = l.Attrs.MTU
+	}
+	// less the IPv4 and TCP headers
+	return mtu - 40
+}
+
+// setAdvMSS sets the advmss of route with ip(8), as netlink does not let us
+// set route metrics.
+func (n *network) setAdvMSS(route netlink.Route, mss int) error {
+	args := []string{"route", "change", route.Dst.String(), "via", route.Gw.String(), "dev", n.extIface.Iface.Name, "proto", strconv.Itoa(routeProtocol), "advmss", strconv.Itoa(mss)}
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip %v: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// setPeerMSS sets the advmss of the route to a peer subnet unless it already
+// has it.
+func (n *network) setPeerMSS(route netlink.Route, mss int) {
+	sn := ip.FromIPNet(route.Dst)
+	n.rlMux.Lock()
+	old := n.mss[sn]
+	n.rlMux.Unlock()
+	if old == mss {
+		return
+	}
+
+	if err := n.setAdvMSS(route, mss); err != nil {
+		log.Errorf("Error setting the advmss of the route to %v: %v", sn, err)
+		return
+	}
+	log.Infof("Set the advmss of the route to %v to %v", sn, mss)
+
+	n.rlMux.Lock()
+	n.mss[sn] = mss
+	n.rlMux.Unlock()
+}
+
+// restorePeerMSS sets the advmss of a recovered route again.
+func (n *network) restorePeerMSS(route netlink.Route) {
+	n.rlMux.Lock()
+	mss, ok := n.mss[ip.FromIPNet(route.Dst)]
+	n.rlMux.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := n.setAdvMSS(route, mss); err != nil {
+		log.Errorf("Error setting the advmss of the route to %v: %v", route.Dst, err)
+	}
+}
+
 func (n *network) addToRouteList(route netlink.Route) {
+	n.rlMux.Lock()
+	defer n.rlMux.Unlock()
 	n.rl = append(n.rl, route)
 }
 
 func (n *network) removeFromRouteList(route netlink.Route) {
+	n.rlMux.Lock()
+	defer n.rlMux.Unlock()
 	for index, r := range n.rl {
 		if routeEqual(r, route) {
 			n.rl = append(n.rl[:index], n.rl[index+1:]...)
@@ -162,15 +305,55 @@ func (n *network) routeCheck(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-time.After(routeCheckRetries * time.Second):
-			n.checkSubnetExistInRoutes()
+			if !backend.RoutingPaused() {
+				n.checkSubnetExistInRoutes()
+			}
 		}
 	}
 }
 
+// Reconcile removes the routes of subnets without a lease and restores the
+// missing routes of those with one.
+func (n *network) Reconcile(ctx context.Context) error {
+	n.pruneStaleRoutes(ctx)
+	n.checkSubnetExistInRoutes()
+	return nil
+}
+
+func (n *network) routeList() []netlink.Route {
+	n.rlMux.Lock()
+	defer n.rlMux.Unlock()
+	return append([]netlink.Route(nil), n.rl...)
+}
+
+func (n *network) DumpState(w io.Writer) {
+	routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		fmt.Fprintf(w, "failed to list kernel routes: %v\n", err)
+	}
+
+	fmt.Fprintln(w, "routes to peer subnets:")
+	for _, route := range n.routeList() {
+		status := "MISSING"
+		for _, r := range routeList {
+			if r.Dst != nil && routeEqual(r, route) {
+				status = "present"
+				break
+			}
+		}
+		fmt.Fprintf(w, "  %v via %v [%v]\n", route.Dst, route.Gw, status)
+	}
+}
+
 func (n *network) checkSubnetExistInRoutes() {
+	pass := backend.StartLoopPass(n.name, "routes")
+	defer pass.Done()
+
 	routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
 	if err == nil {
-		for _, route := range n.rl {
+		rl := n.routeList()
+		pass.Items(len(rl))
+		for _, route := range rl {
 			exist := false
 			for _, r := range routeList {
 				if r.Dst == nil {
@@ -183,6 +366,7 @@ func (n *network) checkSubnetExistInRoutes() {
 			}
 			if !exist {
 				if err := netlink.RouteAdd(&route); err != nil {
+					pass.Error()
 					if nerr, ok := err.(net.Error); !ok {
 						log.Errorf("Error recovering route to %v: %v, %v", route.Dst, route.Gw, nerr)
 					}
@@ -190,8 +374,11 @@ func (n *network) checkSubnetExistInRoutes() {
 				} else {
 					log.Infof("Route recovered %v : %v", route.Dst, route.Gw)
 				}
+				n.restorePeerMSS(route)
 			}
 		}
+	} else {
+		pass.Error()
 	}
 }
 
@@ -0,0 +1,65 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestStaleRoutes(t *testing.T) {
+	n := &network{
+		network:   ip.IP4Net{IP: ip.MustParseIP4("10.5.0.0"), PrefixLen: 16},
+		subnetLen: 24,
+		lease:     &subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.5.1.0"), PrefixLen: 24}},
+	}
+	route := func(dst string, protocol int) netlink.Route {
+		_, ipn, err := net.ParseCIDR(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return netlink.Route{Dst: ipn, Gw: net.ParseIP("192.168.0.9"), Protocol: protocol}
+	}
+
+	routes := []netlink.Route{
+		// ours, the peer is gone
+		route("10.5.2.0/24", routeProtocol),
+		// ours, still leased
+		route("10.5.3.0/24", routeProtocol),
+		// a static route within the network
+		route("10.5.4.0/24", 4),
+		// added by a flanneld not tagging its routes
+		route("10.5.5.0/24", 3),
+		// our own subnet, other prefix lengths and outside the network
+		route("10.5.1.0/24", routeProtocol),
+		route("10.5.6.0/25", routeProtocol),
+		route("10.6.2.0/24", routeProtocol),
+		// no gateway
+		{Dst: route("10.5.7.0/24", routeProtocol).Dst, Protocol: routeProtocol},
+	}
+	leased := map[ip.IP4Net]bool{
+		{IP: ip.MustParseIP4("10.5.3.0"), PrefixLen: 24}: true,
+	}
+
+	stale := n.staleRoutes(routes, leased)
+	if len(stale) != 1 || stale[0].Dst.String() != "10.5.2.0/24" {
+		t.Errorf("expected only the route to 10.5.2.0/24 to be stale, got %v", stale)
+	}
+}
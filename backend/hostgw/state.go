@@ -0,0 +1,51 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// CurrentState implements backend.StateReader, listing the routes to the
+// other subnets of the network.
+func (be *HostgwBackend) CurrentState(config *subnet.Config, lease *subnet.Lease) ([]string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	steps := []string{}
+	for _, r := range routes {
+		if r.Dst == nil || r.Gw == nil || r.Gw.To4() == nil {
+			continue
+		}
+		sn := ip.FromIPNet(r.Dst)
+		if sn.PrefixLen != config.SubnetLen || !config.Network.Contains(sn.IP) || sn.Equal(lease.Subnet) {
+			continue
+		}
+
+		dev := fmt.Sprint(r.LinkIndex)
+		if link, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+			dev = link.Attrs().Name
+		}
+		steps = append(steps, fmt.Sprintf("ip route add %v via %v dev %v", sn, r.Gw, dev))
+	}
+	return steps, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostgw
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+)
+
+func (n *network) TracePacket(p *backend.Packet) ([]string, error) {
+	r, desc, err := backend.TraceRoute(p)
+	if err != nil {
+		return nil, err
+	}
+	steps := []string{desc}
+
+	if !n.network.Contains(p.Dst) {
+		return append(steps, fmt.Sprintf("not forwarded by flannel: %v is outside the flannel network", p.Dst)), nil
+	}
+	if r.Gw == nil {
+		return append(steps, fmt.Sprintf("not forwarded to another host: %v is on a local link", p.Dst)), nil
+	}
+
+	peer := ""
+	for _, rt := range n.routeList() {
+		if rt.Dst.Contains(p.Dst.ToIP()) && rt.Gw.Equal(r.Gw) {
+			peer = rt.Dst.String()
+		}
+	}
+	if peer == "" {
+		steps = append(steps, fmt.Sprintf("the route via %v was not installed by flannel, or its lease is gone", r.Gw))
+	} else {
+		steps = append(steps, fmt.Sprintf("peer: subnet %v at %v", peer, r.Gw))
+	}
+
+	neighs, err := netlink.NeighList(r.LinkIndex, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list neighbors: %v", err)
+	}
+	found := false
+	for _, ne := range neighs {
+		if ne.IP.Equal(r.Gw) && len(ne.HardwareAddr) > 0 {
+			steps = append(steps, fmt.Sprintf("neighbor entry: %v lladdr %v", ne.IP, ne.HardwareAddr))
+			found = true
+		}
+	}
+	if !found {
+		steps = append(steps, fmt.Sprintf("no neighbor entry for %v yet, the kernel resolves it with ARP", r.Gw))
+	}
+
+	return append(steps, fmt.Sprintf("outer header: none, the packet is forwarded as is to %v", r.Gw)), nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"time"
+
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+var (
+	loopDuration = metrics.NewHistogram("flannel_reconcile_duration_seconds",
+		"Duration of the passes of each reconciliation loop.", metrics.DefBuckets, "network", "loop")
+	loopItems = metrics.NewCounter("flannel_reconcile_items_total",
+		"Number of items (routes, FDB entries, rules, leases) the passes of each reconciliation loop went through.", "network", "loop")
+	loopErrors = metrics.NewCounter("flannel_reconcile_errors_total",
+		"Number of errors in the passes of each reconciliation loop.", "network", "loop")
+	loopLastSuccess = metrics.NewGauge("flannel_reconcile_last_success_timestamp_seconds",
+		"Unix time of the last pass of each reconciliation loop without errors.", "network", "loop")
+)
+
+// LoopPass records one pass of a reconciliation loop, e.g. a check of the
+// routes, in the reconcile metrics.
+type LoopPass struct {
+	network string
+	loop    string
+	start   time.Time
+	items   int
+	errors  int
+}
+
+// StartLoopPass starts a pass of the named loop of the network.
+func StartLoopPass(network, loop string) *LoopPass {
+	return &LoopPass{network: network, loop: loop, start: time.Now()}
+}
+
+// Items adds to the items the pass went through.
+func (p *LoopPass) Items(n int) {
+	p.items += n
+}
+
+// Error counts an error of the pass, which is then not a successful one.
+func (p *LoopPass) Error() {
+	p.errors++
+}
+
+// Done ends the pass.
+func (p *LoopPass) Done() {
+	loopDuration.Observe(time.Since(p.start).Seconds(), p.network, p.loop)
+	loopItems.Add(float64(p.items), p.network, p.loop)
+	loopErrors.Add(float64(p.errors), p.network, p.loop)
+	if p.errors == 0 {
+		loopLastSuccess.Set(float64(time.Now().Unix()), p.network, p.loop)
+	}
+}
@@ -19,9 +19,9 @@ import (
 	"strings"
 	"sync"
 
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/log"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -44,7 +44,7 @@ type manager struct {
 func NewManager(ctx context.Context, sm subnet.Manager, extIface *ExternalInterface) Manager {
 	return &manager{
 		ctx:      ctx,
-		sm:       sm,
+		sm:       pausingManager{sm},
 		extIface: extIface,
 		active:   make(map[string]Backend),
 	}
@@ -61,12 +61,7 @@ func (bm *manager) GetBackend(backendType string) (Backend, error) {
 	}
 
 	// first request, need to create and run it
-	befunc, ok := backendCtors[betype]
-	if !ok {
-		return nil, fmt.Errorf("unknown backend type: %v", betype)
-	}
-
-	be, err := befunc(bm.sm, bm.extIface)
+	be, err := NewBackend(betype, newLeaseView(bm.sm, betype), bm.extIface)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +90,16 @@ func (bm *manager) Wait() {
 	bm.wg.Wait()
 }
 
+// NewBackend creates a backend of the given type without running it.
+func NewBackend(backendType string, sm subnet.Manager, extIface *ExternalInterface) (Backend, error) {
+	befunc, ok := backendCtors[strings.ToLower(backendType)]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend type: %v", backendType)
+	}
+
+	return befunc(sm, extIface)
+}
+
 func Register(name string, ctor BackendCtor) {
 	log.Infof("Register: %v", name)
 	backendCtors[name] = ctor
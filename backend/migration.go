@@ -0,0 +1,212 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// A network migrating to another backend runs both the backend it migrates
+// from and the one it migrates to, and advertises the former as the
+// PreviousBackend of its lease. Each peer is handled by the backend of its
+// lease if we run it, and by its previous backend otherwise, so that the
+// peers move over one by one as they migrate.
+type migration struct {
+	from, to string
+	// the attributes of our lease for the backend we migrate from
+	fromAttrs subnet.BackendAttrs
+}
+
+var (
+	migrationMux sync.Mutex
+	migrations   = map[string]*migration{}
+	// closed when a migration starts or ends, for the lease watches of the
+	// backends to start over
+	migrationChanged = make(chan struct{})
+)
+
+// StartMigration records that network migrates from the backend of lease to
+// the backend type to. The backend to registers the network after, and so
+// acquires the lease with the previous backend in its attributes.
+func StartMigration(network string, lease *subnet.Lease, to string) {
+	migrationMux.Lock()
+	defer migrationMux.Unlock()
+
+	migrations[network] = &migration{
+		from: strings.ToLower(lease.Attrs.BackendType),
+		to:   strings.ToLower(to),
+		fromAttrs: subnet.BackendAttrs{
+			BackendType: lease.Attrs.BackendType,
+			BackendData: lease.Attrs.BackendData,
+		},
+	}
+	close(migrationChanged)
+	migrationChanged = make(chan struct{})
+}
+
+// EndMigration records that network no longer runs the backend it migrated
+// from.
+func EndMigration(network string) {
+	migrationMux.Lock()
+	defer migrationMux.Unlock()
+
+	if _, ok := migrations[network]; !ok {
+		return
+	}
+	delete(migrations, network)
+	close(migrationChanged)
+	migrationChanged = make(chan struct{})
+}
+
+func migrationOf(network string) (*migration, <-chan struct{}) {
+	migrationMux.Lock()
+	defer migrationMux.Unlock()
+	return migrations[network], migrationChanged
+}
+
+// leaseView is the subnet.Manager of a backend, which presents it the leases
+// it is to handle during migrations: those of the peers handled by the other
+// backend we run are left out, and those handled by their previous backend
+// appear with its attributes.
+type leaseView struct {
+	subnet.Manager
+	backendType string
+
+	mux sync.Mutex
+	// the subnets of the leases handed to the backend, by network
+	handed map[string]map[ip.IP4Net]bool
+}
+
+func newLeaseView(sm subnet.Manager, backendType string) *leaseView {
+	return &leaseView{
+		Manager:     sm,
+		backendType: strings.ToLower(backendType),
+		handed:      map[string]map[ip.IP4Net]bool{},
+	}
+}
+
+func (v *leaseView) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if mig, _ := migrationOf(network); mig != nil && mig.to == v.backendType {
+		a := *attrs
+		a.PreviousBackend = &mig.fromAttrs
+		attrs = &a
+	}
+	return v.Manager.AcquireLease(ctx, network, attrs)
+}
+
+func (v *leaseView) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	for {
+		mig, changed := migrationOf(network)
+
+		wctx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-changed:
+				cancel()
+			case <-wctx.Done():
+			}
+		}()
+		wr, err := v.Manager.WatchLeases(wctx, network, cursor)
+		restart := wctx.Err() != nil && ctx.Err() == nil
+		cancel()
+
+		switch {
+		case restart:
+			// a migration started or ended: hand over the peers anew
+			cursor = nil
+			continue
+		case err != nil:
+			return wr, err
+		}
+
+		if wr = v.present(network, mig, wr); len(wr.Events) > 0 || wr.Snapshot != nil {
+			return wr, nil
+		}
+		// none of the events is for the backend; an empty result would
+		// read as an empty snapshot
+		cursor = wr.Cursor
+	}
+}
+
+// present filters and rewrites the leases of wr for the backend.
+func (v *leaseView) present(network string, mig *migration, wr subnet.LeaseWatchResult) subnet.LeaseWatchResult {
+	running := map[string]bool{v.backendType: true}
+	if mig != nil {
+		running[mig.from] = true
+		running[mig.to] = true
+	}
+
+	// present returns the lease as the backend is to see it and whether
+	// it is for the backend at all
+	present := func(l subnet.Lease) (subnet.Lease, bool) {
+		handler := strings.ToLower(l.Attrs.BackendType)
+		if p := l.Attrs.PreviousBackend; !running[handler] && p != nil && running[strings.ToLower(p.BackendType)] {
+			handler = strings.ToLower(p.BackendType)
+			l.Attrs.BackendType, l.Attrs.BackendData = p.BackendType, p.BackendData
+		}
+		// leases of backends we do not run are the backend's to ignore
+		return l, handler == v.backendType || !running[handler]
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	out := subnet.LeaseWatchResult{Cursor: wr.Cursor}
+	if len(wr.Events) == 0 {
+		handed := map[ip.IP4Net]bool{}
+		out.Snapshot = []subnet.Lease{}
+		for _, l := range wr.Snapshot {
+			if l, ok := present(l); ok {
+				out.Snapshot = append(out.Snapshot, l)
+				handed[l.Subnet] = true
+			}
+		}
+		v.handed[network] = handed
+		return out
+	}
+
+	handed := v.handed[network]
+	if handed == nil {
+		handed = map[ip.IP4Net]bool{}
+		v.handed[network] = handed
+	}
+	for _, e := range wr.Events {
+		if e.Type == subnet.EventRemoved {
+			if handed[e.Lease.Subnet] {
+				delete(handed, e.Lease.Subnet)
+				out.Events = append(out.Events, e)
+			}
+			continue
+		}
+
+		l, ok := present(e.Lease)
+		switch {
+		case ok:
+			handed[l.Subnet] = true
+			out.Events = append(out.Events, subnet.Event{Type: subnet.EventAdded, Lease: l, Network: e.Network})
+		case handed[l.Subnet]:
+			// the peer moved over to the other backend we run
+			delete(handed, l.Subnet)
+			out.Events = append(out.Events, subnet.Event{Type: subnet.EventRemoved, Lease: l, Network: e.Network})
+		}
+	}
+	return out
+}
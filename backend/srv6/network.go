@@ -0,0 +1,272 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package srv6
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/tracing"
+	"github.com/coreos/flannel/subnet"
+)
+
+type network struct {
+	name     string
+	extIface *backend.ExternalInterface
+	lease    *subnet.Lease
+	sm       subnet.Manager
+	network  ip.IP4Net
+	// sid is the End.DX4 SID of our subnet
+	sid net.IP
+	mux sync.Mutex
+	// routes is the SID of each peer subnet we have an encap route to
+	routes map[ip.IP4Net]net.IP
+}
+
+func (n *network) Lease() *subnet.Lease {
+	return n.lease
+}
+
+func (n *network) MTU() int {
+	return n.extIface.MTU() - encapOverhead
+}
+
+func (n *network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	n.pruneStaleRoutes(ctx)
+
+	log.Info("Watching for new subnet leases")
+	evts := make(chan []subnet.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.sm, n.name, n.lease, evts)
+		wg.Done()
+	}()
+
+	defer wg.Wait()
+
+	for {
+		select {
+		case evtBatch := <-evts:
+			_, span := tracing.Start(ctx, "srv6.handleSubnetEvents", tracing.KV("network", n.name), tracing.KV("events", len(evtBatch)))
+			n.handleSubnetEvents(evtBatch)
+			span.End(nil)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *network) handleSubnetEvents(batch []subnet.Event) {
+	for _, evt := range batch {
+		switch evt.Type {
+		case subnet.EventAdded:
+			log.InfoKV(fmt.Sprint("Subnet added: ", evt.Lease.Subnet), backend.EventFields("srv6", evt)...)
+
+			if evt.Lease.Attrs.BackendType != "srv6" {
+				log.Warningf("Ignoring non-srv6 subnet: type=%v", evt.Lease.Attrs.BackendType)
+				continue
+			}
+
+			var attrs srv6LeaseAttrs
+			if len(evt.Lease.Attrs.BackendData) > 0 {
+				if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &attrs); err != nil {
+					log.Error("Error decoding subnet lease JSON: ", err)
+					continue
+				}
+			}
+			if attrs.SID == nil {
+				log.Infof("Subnet %v has no SID yet, skipping", evt.Lease.Subnet)
+				continue
+			}
+
+			if err := n.addRoute(evt.Lease.Subnet, attrs.SID); err != nil {
+				log.Errorf("Error adding route to %v: %v", evt.Lease.Subnet, err)
+				continue
+			}
+			backend.Tracef("added route to %v encap seg6 segs %v", evt.Lease.Subnet, attrs.SID)
+
+			n.mux.Lock()
+			n.routes[evt.Lease.Subnet] = attrs.SID
+			n.mux.Unlock()
+
+		case subnet.EventRemoved:
+			log.InfoKV(fmt.Sprint("Subnet removed: ", evt.Lease.Subnet), backend.EventFields("srv6", evt)...)
+
+			if evt.Lease.Attrs.BackendType != "srv6" {
+				log.Warningf("Ignoring non-srv6 subnet: type=%v", evt.Lease.Attrs.BackendType)
+				continue
+			}
+
+			n.mux.Lock()
+			delete(n.routes, evt.Lease.Subnet)
+			n.mux.Unlock()
+
+			if err := n.delRoute(evt.Lease.Subnet); err != nil {
+				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
+				continue
+			}
+			backend.Tracef("deleted route to %v", evt.Lease.Subnet)
+
+		default:
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+		}
+	}
+}
+
+// pruneStaleRoutes removes the encap routes to subnets of the flannel
+// network that are left over from a previous run but no longer have a lease.
+func (n *network) pruneStaleRoutes(ctx context.Context) {
+	wr, err := n.sm.WatchLeases(ctx, n.name, nil)
+	if err != nil {
+		log.Warningf("Unable to get lease snapshot, not checking for stale routes: %v", err)
+		return
+	}
+
+	leased := make(map[ip.IP4Net]bool)
+	for _, l := range wr.Snapshot {
+		leased[l.Subnet] = true
+	}
+
+	subnets, err := n.encapRoutes()
+	if err != nil {
+		log.Warningf("Unable to list routes: %v", err)
+		return
+	}
+
+	for _, sn := range subnets {
+		if !n.network.Contains(sn.IP) || sn.Equal(n.lease.Subnet) || leased[sn] {
+			continue
+		}
+
+		log.Infof("Removing stale route to %v", sn)
+		if err := n.delRoute(sn); err != nil {
+			log.Errorf("Error deleting stale route to %v: %v", sn, err)
+		} else {
+			backend.Tracef("deleted stale route to %v", sn)
+		}
+	}
+}
+
+// Reconcile removes the routes of subnets without a lease and installs the
+// local SID and the routes of those with one again.
+func (n *network) Reconcile(ctx context.Context) error {
+	n.pruneStaleRoutes(ctx)
+
+	if err := n.addLocalSID(); err != nil {
+		return err
+	}
+
+	n.mux.Lock()
+	routes := make(map[ip.IP4Net]net.IP, len(n.routes))
+	for sn, sid := range n.routes {
+		routes[sn] = sid
+	}
+	n.mux.Unlock()
+
+	for sn, sid := range routes {
+		if err := n.addRoute(sn, sid); err != nil {
+			return fmt.Errorf("failed to restore the route to %v: %v", sn, err)
+		}
+	}
+	return nil
+}
+
+// runIP runs ip(8), as the netlink package has no support for seg6
+// encapsulations.
+func runIP(args ...string) (string, error) {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ip %v: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+// addLocalSID installs the SID of our subnet, decapsulating the traffic
+// of the peers and forwarding it by the inner IPv4 destination.
+func (n *network) addLocalSID() error {
+	_, err := runIP("-6", "route", "replace", n.sid.String()+"/128", "encap", "seg6local", "action", "End.DX4", "nh4", "0.0.0.0", "dev", n.extIface.Iface.Name)
+	if err != nil {
+		return fmt.Errorf("failed to add the local SID %v: %v", n.sid, err)
+	}
+	log.Infof("Added the local SID %v for %v", n.sid, n.lease.Subnet)
+	return nil
+}
+
+// Retire removes the local SID once the network migrated to another
+// backend. The routes to the peers are gone by then.
+func (n *network) Retire() {
+	if _, err := runIP("-6", "route", "del", n.sid.String()+"/128", "dev", n.extIface.Iface.Name); err != nil {
+		log.Warningf("Failed to remove the local SID %v: %v", n.sid, err)
+	}
+}
+
+func (n *network) addRoute(sn ip.IP4Net, sid net.IP) error {
+	_, err := runIP("route", "replace", sn.String(), "encap", "seg6", "mode", "encap", "segs", sid.String(), "dev", n.extIface.Iface.Name)
+	return err
+}
+
+func (n *network) delRoute(sn ip.IP4Net) error {
+	_, err := runIP("route", "del", sn.String(), "dev", n.extIface.Iface.Name)
+	return err
+}
+
+// encapRoutes returns the destinations of the seg6 encap routes through the
+// external interface.
+func (n *network) encapRoutes() ([]ip.IP4Net, error) {
+	out, err := runIP("-4", "-o", "route", "show", "dev", n.extIface.Iface.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []ip.IP4Net
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.Contains(line, "encap seg6 ") {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			continue
+		}
+		subnets = append(subnets, ip.FromIPNet(dst))
+	}
+	return subnets, nil
+}
+
+// enableSRv6 turns on IPv6 forwarding and the processing of segment routing
+// headers on dev.
+func enableSRv6(dev string) error {
+	for _, name := range []string{"all/forwarding", "all/seg6_enabled", dev + "/seg6_enabled"} {
+		path := "/proc/sys/net/ipv6/conf/" + name
+		if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to set %v: %v", path, err)
+		}
+	}
+	return nil
+}
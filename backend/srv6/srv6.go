@@ -0,0 +1,188 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package srv6
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/schema"
+	"github.com/coreos/flannel/subnet"
+)
+
+func init() {
+	backend.Register("srv6", New)
+}
+
+// encapOverhead is the outer IPv6 header and a segment routing header with
+// a single segment.
+const encapOverhead = 40 + 8 + 16
+
+type SRv6Backend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	be := &SRv6Backend{
+		sm:       sm,
+		extIface: extIface,
+	}
+
+	return be, nil
+}
+
+type srv6Config struct {
+	// Locator is the IPv6 prefix the underlay routes to this host, the
+	// subnet address of the lease makes the last 32 bits of the SID
+	Locator string
+}
+
+type srv6LeaseAttrs struct {
+	SID net.IP
+}
+
+func (be *SRv6Backend) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func decodeConfig(config *subnet.Config) (*net.IPNet, error) {
+	var cfg srv6Config
+	if err := schema.Decode(config.Backend, &cfg, "Type"); err != nil {
+		return nil, fmt.Errorf("error decoding srv6 backend config: %v", err)
+	}
+	if cfg.Locator == "" {
+		return nil, fmt.Errorf("srv6 backend config has no Locator")
+	}
+	return parseLocator(cfg.Locator)
+}
+
+func parseLocator(s string) (*net.IPNet, error) {
+	ipa, locator, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Locator %q: %v", s, err)
+	}
+	if ipa.To4() != nil {
+		return nil, fmt.Errorf("invalid Locator %q: not an IPv6 prefix", s)
+	}
+	if ones, _ := locator.Mask.Size(); ones > 96 {
+		return nil, fmt.Errorf("invalid Locator %q: the prefix length is above 96, leaving no room for the subnet", s)
+	}
+	return locator, nil
+}
+
+// sidFor returns the End.DX4 SID decapsulating the traffic to sn.
+func sidFor(locator *net.IPNet, sn ip.IP4Net) net.IP {
+	sid := make(net.IP, net.IPv6len)
+	copy(sid, locator.IP.To16())
+	binary.BigEndian.PutUint32(sid[12:], uint32(sn.IP))
+	return sid
+}
+
+func (be *SRv6Backend) RegisterNetwork(ctx context.Context, netname string, config *subnet.Config) (backend.Network, error) {
+	locator, err := decodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := enableSRv6(be.extIface.Iface.Name); err != nil {
+		return nil, err
+	}
+
+	n := &network{
+		name:     netname,
+		extIface: be.extIface,
+		sm:       be.sm,
+		network:  config.Network,
+		routes:   make(map[ip.IP4Net]net.IP),
+	}
+
+	// The SID embeds the subnet, so the lease is acquired first and
+	// updated with the SID once the subnet is known. Peers ignore the
+	// lease until then.
+	attrs := subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		BackendType: "srv6",
+	}
+
+	l, err := be.sm.AcquireLease(ctx, netname, &attrs)
+	switch err {
+	case nil:
+		n.lease = l
+
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	n.sid = sidFor(locator, l.Subnet)
+	data, err := json.Marshal(&srv6LeaseAttrs{n.sid})
+	if err != nil {
+		return nil, err
+	}
+	attrs.BackendData = json.RawMessage(data)
+
+	l, err = be.sm.AcquireLease(ctx, netname, &attrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish the SID %v of %v: %v", n.sid, n.lease.Subnet, err)
+	}
+	n.lease = l
+
+	if err := n.addLocalSID(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Plan implements backend.Planner.
+func (be *SRv6Backend) Plan(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) ([]string, error) {
+	locator, err := decodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dev := be.extIface.Iface.Name
+	steps := []string{
+		"sysctl -w net.ipv6.conf.all.forwarding=1",
+		"sysctl -w net.ipv6.conf.all.seg6_enabled=1",
+		fmt.Sprintf("sysctl -w net.ipv6.conf.%v.seg6_enabled=1", dev),
+		fmt.Sprintf("ip -6 route replace %v/128 encap seg6local action End.DX4 nh4 0.0.0.0 dev %v", sidFor(locator, lease.Subnet), dev),
+	}
+
+	for _, l := range peers {
+		if l.Attrs.BackendType != "srv6" {
+			steps = append(steps, fmt.Sprintf("# ignoring non-srv6 subnet %v: type=%v", l.Subnet, l.Attrs.BackendType))
+			continue
+		}
+
+		var attrs srv6LeaseAttrs
+		if err := json.Unmarshal(l.Attrs.BackendData, &attrs); err != nil {
+			steps = append(steps, fmt.Sprintf("# ignoring subnet %v: error decoding lease JSON: %v", l.Subnet, err))
+			continue
+		}
+		steps = append(steps, fmt.Sprintf("ip route replace %v encap seg6 mode encap segs %v dev %v", l.Subnet, attrs.SID, dev))
+	}
+
+	return steps, nil
+}
@@ -21,14 +21,54 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"runtime"
+	"syscall"
 	"unsafe"
 
-	log "github.com/golang/glog"
-
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const (
+	macKeyLen  = C.MAC_KEY_LEN
+	macMaxKeys = C.MAC_MAX_KEYS
+	tosInherit = C.TOS_INHERIT
+
+	// soBusyPoll is SO_BUSY_POLL, which package syscall lacks
+	soBusyPoll = 46
 )
 
-func runCProxy(tun *os.File, conn *net.UDPConn, ctl *os.File, tunIP ip.IP4, tunMTU int) {
+// macAlgs are the MAC algorithms of the MAC config option, with the length
+// of their tags.
+var macAlgs = map[string]struct {
+	alg    C.int
+	tagLen int
+}{
+	"siphash":     {C.MAC_SIPHASH, 8},
+	"hmac-sha256": {C.MAC_HMAC_SHA256, 16},
+}
+
+// macCompute returns the tag of data with key, as computed by the proxy.
+func macCompute(mac string, key, data []byte) []byte {
+	if len(key) != macKeyLen {
+		panic("bad MAC key length")
+	}
+	a := macAlgs[mac]
+	tag := make([]byte, a.tagLen)
+	var p *C.uint8_t
+	if len(data) > 0 {
+		p = (*C.uint8_t)(unsafe.Pointer(&data[0]))
+	}
+	C.mac_compute(a.alg, (*C.uint8_t)(unsafe.Pointer(&key[0])), p, C.size_t(len(data)), (*C.uint8_t)(unsafe.Pointer(&tag[0])))
+	return tag
+}
+
+// runCProxy runs the proxy, sending keepalives to the peers every keepalive
+// seconds and following them wherever their packets come from, if not 0.
+// The packets it sends get the TOS tos, or that of the packet they carry
+// for tosInherit. With busyPoll microseconds the proxy busy polls the socket
+// and never sleeps, and it runs pinned to cpu unless it is negative.
+func runCProxy(tun *os.File, conn *net.UDPConn, ctl *os.File, tunIP ip.IP4, tunMTU int, mac string, keepalive int, tos int, busyPoll int, cpu int) {
 	var log_errors int
 	if log.V(1) {
 		log_errors = 1
@@ -41,6 +81,29 @@ func runCProxy(tun *os.File, conn *net.UDPConn, ctl *os.File, tunIP ip.IP4, tunM
 	}
 	defer c.Close()
 
+	var spin int
+	if busyPoll > 0 {
+		spin = 1
+		if err := syscall.SetsockoptInt(int(c.Fd()), syscall.SOL_SOCKET, soBusyPoll, busyPoll); err != nil {
+			log.Errorf("Failed to set SO_BUSY_POLL on the UDP socket: %v", err)
+		}
+	}
+
+	if cpu >= 0 {
+		// the thread is not unlocked and so exits with the proxy
+		runtime.LockOSThread()
+		if err := pinThread(cpu); err != nil {
+			log.Errorf("Failed to pin the proxy to CPU %v: %v", cpu, err)
+		} else {
+			log.Infof("Proxy pinned to CPU %v", cpu)
+		}
+	}
+
+	alg := C.int(C.MAC_NONE)
+	if mac != "" {
+		alg = macAlgs[mac].alg
+	}
+
 	C.run_proxy(
 		C.int(tun.Fd()),
 		C.int(c.Fd()),
@@ -48,9 +111,24 @@ func runCProxy(tun *os.File, conn *net.UDPConn, ctl *os.File, tunIP ip.IP4, tunM
 		C.in_addr_t(tunIP.NetworkOrder()),
 		C.size_t(tunMTU),
 		C.int(log_errors),
+		alg,
+		C.int(keepalive),
+		C.int(tos),
+		C.int(spin),
 	)
 }
 
+// pinThread sets the CPU affinity of the calling thread to cpu alone.
+func pinThread(cpu int) error {
+	var mask [1024 / 64]uint64
+	mask[cpu/64] = 1 << uint(cpu%64)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 func writeCommand(f *os.File, cmd *C.command) {
 	hdr := reflect.SliceHeader{
 		Data: uintptr(unsafe.Pointer(cmd)),
@@ -62,13 +140,28 @@ func writeCommand(f *os.File, cmd *C.command) {
 	f.Write(buf)
 }
 
-func setRoute(ctl *os.File, dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int) {
+// setRoute sets the route to dst, sending with the key of keyEpoch if the
+// packets are authenticated.
+func setRoute(ctl *os.File, dst ip.IP4Net, nextHopIP ip.IP4, nextHopPort int, keyEpoch uint32) {
 	cmd := C.command{
 		cmd:           C.CMD_SET_ROUTE,
 		dest_net:      C.in_addr_t(dst.IP.NetworkOrder()),
 		dest_net_len:  C.int(dst.PrefixLen),
 		next_hop_ip:   C.in_addr_t(nextHopIP.NetworkOrder()),
 		next_hop_port: C.short(nextHopPort),
+		key_epoch:     C.uint32_t(keyEpoch),
+	}
+
+	writeCommand(ctl, &cmd)
+}
+
+func setKey(ctl *os.File, epoch uint32, key []byte) {
+	cmd := C.command{
+		cmd:       C.CMD_SET_KEY,
+		key_epoch: C.uint32_t(epoch),
+	}
+	for i := range cmd.key {
+		cmd.key[i] = C.uint8_t(key[i])
 	}
 
 	writeCommand(ctl, &cmd)
@@ -0,0 +1,230 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <string.h>
+
+#include "mac.h"
+
+/* SipHash-2-4 with a 64 bit tag, see https://131002.net/siphash/ */
+
+#define ROTL64(x, b) (uint64_t)(((x) << (b)) | ((x) >> (64 - (b))))
+
+#define SIPROUND do { \
+	v0 += v1; v1 = ROTL64(v1, 13); v1 ^= v0; v0 = ROTL64(v0, 32); \
+	v2 += v3; v3 = ROTL64(v3, 16); v3 ^= v2; \
+	v0 += v3; v3 = ROTL64(v3, 21); v3 ^= v0; \
+	v2 += v1; v1 = ROTL64(v1, 17); v1 ^= v2; v2 = ROTL64(v2, 32); \
+} while( 0 )
+
+static uint64_t load64_le(const uint8_t *p) {
+	uint64_t v = 0;
+	int i;
+
+	for( i = 7; i >= 0; i-- )
+		v = (v << 8) | p[i];
+	return v;
+}
+
+static void store64_le(uint8_t *p, uint64_t v) {
+	int i;
+
+	for( i = 0; i < 8; i++ )
+		p[i] = v >> (8 * i);
+}
+
+/* uses the first 16 bytes of the key */
+static void siphash(const uint8_t *key, const uint8_t *data, size_t len, uint8_t *tag) {
+	uint64_t k0 = load64_le(key), k1 = load64_le(key + 8);
+	uint64_t v0 = k0 ^ 0x736f6d6570736575ULL;
+	uint64_t v1 = k1 ^ 0x646f72616e646f6dULL;
+	uint64_t v2 = k0 ^ 0x6c7967656e657261ULL;
+	uint64_t v3 = k1 ^ 0x7465646279746573ULL;
+	uint64_t b = ((uint64_t)len) << 56, m;
+	const uint8_t *end = data + len - (len % 8);
+	int i;
+
+	for( ; data != end; data += 8 ) {
+		m = load64_le(data);
+		v3 ^= m;
+		SIPROUND;
+		SIPROUND;
+		v0 ^= m;
+	}
+
+	for( i = len % 8 - 1; i >= 0; i-- )
+		b |= ((uint64_t)data[i]) << (8 * i);
+
+	v3 ^= b;
+	SIPROUND;
+	SIPROUND;
+	v0 ^= b;
+
+	v2 ^= 0xff;
+	SIPROUND;
+	SIPROUND;
+	SIPROUND;
+	SIPROUND;
+
+	store64_le(tag, v0 ^ v1 ^ v2 ^ v3);
+}
+
+/* SHA-256 (FIPS 180-4) and HMAC (FIPS 198-1), truncated to 128 bits */
+
+typedef struct sha256_ctx {
+	uint32_t state[8];
+	uint64_t len;
+	uint8_t  buf[64];
+	size_t   buflen;
+} sha256_ctx;
+
+static const uint32_t sha256_k[64] = {
+	0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+	0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+	0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+	0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+	0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+	0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+	0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+	0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+};
+
+#define ROTR32(x, n) (((x) >> (n)) | ((x) << (32 - (n))))
+
+static void sha256_block(sha256_ctx *c, const uint8_t *p) {
+	uint32_t w[64], a, b, d, e, f, g, h, cc, t1, t2;
+	int i;
+
+	for( i = 0; i < 16; i++ )
+		w[i] = (uint32_t)p[4*i] << 24 | (uint32_t)p[4*i+1] << 16 | (uint32_t)p[4*i+2] << 8 | p[4*i+3];
+	for( ; i < 64; i++ ) {
+		uint32_t s0 = ROTR32(w[i-15], 7) ^ ROTR32(w[i-15], 18) ^ (w[i-15] >> 3);
+		uint32_t s1 = ROTR32(w[i-2], 17) ^ ROTR32(w[i-2], 19) ^ (w[i-2] >> 10);
+		w[i] = w[i-16] + s0 + w[i-7] + s1;
+	}
+
+	a = c->state[0]; b = c->state[1]; cc = c->state[2]; d = c->state[3];
+	e = c->state[4]; f = c->state[5]; g = c->state[6]; h = c->state[7];
+
+	for( i = 0; i < 64; i++ ) {
+		t1 = h + (ROTR32(e, 6) ^ ROTR32(e, 11) ^ ROTR32(e, 25)) + ((e & f) ^ (~e & g)) + sha256_k[i] + w[i];
+		t2 = (ROTR32(a, 2) ^ ROTR32(a, 13) ^ ROTR32(a, 22)) + ((a & b) ^ (a & cc) ^ (b & cc));
+		h = g; g = f; f = e; e = d + t1;
+		d = cc; cc = b; b = a; a = t1 + t2;
+	}
+
+	c->state[0] += a; c->state[1] += b; c->state[2] += cc; c->state[3] += d;
+	c->state[4] += e; c->state[5] += f; c->state[6] += g; c->state[7] += h;
+}
+
+static void sha256_init(sha256_ctx *c) {
+	static const uint32_t iv[8] = {
+		0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+	};
+
+	memcpy(c->state, iv, sizeof(iv));
+	c->len = 0;
+	c->buflen = 0;
+}
+
+static void sha256_update(sha256_ctx *c, const uint8_t *p, size_t len) {
+	c->len += len;
+
+	while( len > 0 ) {
+		size_t n = 64 - c->buflen;
+		if( n > len )
+			n = len;
+
+		memcpy(c->buf + c->buflen, p, n);
+		c->buflen += n;
+		p += n;
+		len -= n;
+
+		if( c->buflen == 64 ) {
+			sha256_block(c, c->buf);
+			c->buflen = 0;
+		}
+	}
+}
+
+static void sha256_final(sha256_ctx *c, uint8_t out[32]) {
+	uint64_t bits = c->len * 8;
+	uint8_t pad[72] = { 0x80 };
+	size_t padlen = (c->buflen < 56 ? 56 : 120) - c->buflen;
+	int i;
+
+	for( i = 0; i < 8; i++ )
+		pad[padlen + i] = bits >> (56 - 8 * i);
+	sha256_update(c, pad, padlen + 8);
+
+	for( i = 0; i < 8; i++ ) {
+		out[4*i]   = c->state[i] >> 24;
+		out[4*i+1] = c->state[i] >> 16;
+		out[4*i+2] = c->state[i] >> 8;
+		out[4*i+3] = c->state[i];
+	}
+}
+
+static void hmac_sha256(const uint8_t key[MAC_KEY_LEN], const uint8_t *data, size_t len, uint8_t *tag) {
+	uint8_t pad[64], inner[32], outer[32];
+	sha256_ctx c;
+	int i;
+
+	memset(pad, 0x36, sizeof(pad));
+	for( i = 0; i < MAC_KEY_LEN; i++ )
+		pad[i] ^= key[i];
+	sha256_init(&c);
+	sha256_update(&c, pad, sizeof(pad));
+	sha256_update(&c, data, len);
+	sha256_final(&c, inner);
+
+	memset(pad, 0x5c, sizeof(pad));
+	for( i = 0; i < MAC_KEY_LEN; i++ )
+		pad[i] ^= key[i];
+	sha256_init(&c);
+	sha256_update(&c, pad, sizeof(pad));
+	sha256_update(&c, inner, sizeof(inner));
+	sha256_final(&c, outer);
+
+	memcpy(tag, outer, 16);
+}
+
+size_t mac_len(int alg) {
+	switch( alg ) {
+	case MAC_SIPHASH:
+		return 8;
+	case MAC_HMAC_SHA256:
+		return 16;
+	}
+	return 0;
+}
+
+void mac_compute(int alg, const uint8_t key[MAC_KEY_LEN], const uint8_t *data, size_t len, uint8_t *tag) {
+	switch( alg ) {
+	case MAC_SIPHASH:
+		siphash(key, data, len, tag);
+		break;
+	case MAC_HMAC_SHA256:
+		hmac_sha256(key, data, len, tag);
+		break;
+	}
+}
+
+int mac_equal(const uint8_t *a, const uint8_t *b, size_t len) {
+	uint8_t diff = 0;
+	size_t i;
+
+	for( i = 0; i < len; i++ )
+		diff |= a[i] ^ b[i];
+	return diff == 0;
+}
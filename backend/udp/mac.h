@@ -0,0 +1,39 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#ifndef MAC_H
+#define MAC_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+#define MAC_NONE        0
+#define MAC_SIPHASH     1
+#define MAC_HMAC_SHA256 2
+
+#define MAC_KEY_LEN 32
+#define MAC_MAX_LEN 16
+/* number of key epochs the proxy holds at once */
+#define MAC_MAX_KEYS 16
+
+/* length of the tag of alg */
+size_t mac_len(int alg);
+
+/* computes the tag of data with key into tag, of mac_len(alg) bytes */
+void mac_compute(int alg, const uint8_t key[MAC_KEY_LEN], const uint8_t *data, size_t len, uint8_t *tag);
+
+/* compares the tags in constant time, returns 1 if equal */
+int mac_equal(const uint8_t *a, const uint8_t *b, size_t len);
+
+#endif
@@ -0,0 +1,119 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// macKey pads k with zeros to the length of a MAC key, which HMAC does too.
+func macKey(k []byte) []byte {
+	key := make([]byte, macKeyLen)
+	copy(key, k)
+	return key
+}
+
+func seq(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// Test vectors of the SipHash-2-4 reference implementation, with the key
+// 00 01 02 ... 0f and the message 00 01 02 ... of the given length.
+func TestSipHash(t *testing.T) {
+	for _, tc := range []struct {
+		len int
+		tag string
+	}{
+		{0, "310e0edd47db6f72"},
+		{1, "fd67dc93c539f874"},
+		{2, "5a4fa9d909806c0d"},
+		{3, "2d7efbd796666785"},
+		{4, "b7877127e09427cf"},
+		{5, "8da699cd64557618"},
+		{6, "cee3fe586e46c9cb"},
+		{7, "37d1018bf50002ab"},
+		{8, "6224939a79f5f593"},
+		{9, "b0e4a90bdf82009e"},
+		{10, "f3b9dd94c5bb5d7a"},
+		{11, "a7ad6b22462fb3f4"},
+		{12, "fbe50e86bc8f1e75"},
+		{13, "903d84c02756ea14"},
+		{14, "eef27a8e90ca23f7"},
+		{15, "e545be4961ca29a1"},
+		{63, "724506eb4c328a95"},
+	} {
+		tag := macCompute("siphash", macKey(seq(16)), seq(tc.len))
+		if !bytes.Equal(tag, unhex(tc.tag)) {
+			t.Errorf("length %v: got tag %x, want %v", tc.len, tag, tc.tag)
+		}
+	}
+}
+
+// Test cases 1 to 5 of RFC 4231, whose keys fit a MAC key, truncated to the
+// 16 bytes of the tag.
+func TestHMACSHA256(t *testing.T) {
+	for i, tc := range []struct {
+		key  []byte
+		data []byte
+		tag  string
+	}{
+		{bytes.Repeat([]byte{0x0b}, 20), []byte("Hi There"), "b0344c61d8db38535ca8afceaf0bf12b"},
+		{[]byte("Jefe"), []byte("what do ya want for nothing?"), "5bdcc146bf60754e6a042426089575c7"},
+		{bytes.Repeat([]byte{0xaa}, 20), bytes.Repeat([]byte{0xdd}, 50), "773ea91e36800e46854db8ebd09181a7"},
+		{seq(26)[1:], bytes.Repeat([]byte{0xcd}, 50), "82558a389a443c0ea4cc819899f2083a"},
+		{bytes.Repeat([]byte{0x0c}, 20), []byte("Test With Truncation"), "a3b6167473100ee06e0c796c2955552b"},
+	} {
+		tag := macCompute("hmac-sha256", macKey(tc.key), tc.data)
+		if !bytes.Equal(tag, unhex(tc.tag)) {
+			t.Errorf("test case %v: got tag %x, want %v", i+1, tag, tc.tag)
+		}
+	}
+}
+
+// The HMAC of the proxy matches that of crypto/hmac for the lengths around
+// the SHA-256 block boundaries.
+func TestHMACSHA256Lengths(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	key := make([]byte, macKeyLen)
+	data := make([]byte, 300)
+	r.Read(key)
+	r.Read(data)
+
+	for n := 0; n <= len(data); n++ {
+		h := hmac.New(sha256.New, key)
+		h.Write(data[:n])
+		want := h.Sum(nil)[:16]
+		if tag := macCompute("hmac-sha256", key, data[:n]); !bytes.Equal(tag, want) {
+			t.Errorf("length %v: got tag %x, want %x", n, tag, want)
+		}
+	}
+}
@@ -15,23 +15,30 @@
 package udp
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"sync"
 	"syscall"
 
-	log "github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/keys"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/tracing"
 	"github.com/coreos/flannel/subnet"
 )
 
 const (
 	encapOverhead = 28 // 20 bytes IP hdr + 8 bytes UDP hdr
+	// the MAC header has the sender's subnet, the key epoch and the
+	// sequence number
+	macHdrLen = 16
 )
 
 type network struct {
@@ -44,33 +51,73 @@ type network struct {
 	conn   *net.UDPConn
 	tunNet ip.IP4Net
 	sm     subnet.Manager
+
+	// peer routes handed to the proxy, kept for DumpState
+	peersMux sync.Mutex
+	peers    map[ip.IP4Net]*net.UDPAddr
+
+	// name of the TUN device, for TracePacket
+	tunName string
+
+	// current MTU of the TUN device, see SetMTU, and the one the buffers
+	// of the proxy fit
+	mtuMux sync.Mutex
+	mtu    int
+	bufMTU int
+
+	// MAC algorithm and keys, if enabled, and the key epoch used for
+	// each peer
+	mac    string
+	keys   *keys.Set
+	epochs map[ip.IP4Net]uint32
+
+	// TOS of the packets sent to the peers, see runCProxy
+	tos int
+	// busy polling and CPU pinning of the proxy, see runCProxy
+	busyPoll int
+	cpu      int
+
+	// with NAT traversal, our endpoints as advertised in the lease and the
+	// seconds between keepalives
+	own       *leaseAttrs
+	keepalive int
 }
 
-func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterface, port int, nw ip.IP4Net, l *subnet.Lease) (*network, error) {
+func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterface, cfg *udpConfig, ks *keys.Set, conn *net.UDPConn, own *leaseAttrs, nw ip.IP4Net, l *subnet.Lease) (*network, error) {
 	n := &network{
 		SimpleNetwork: backend.SimpleNetwork{
 			SubnetLease: l,
 			ExtIface:    extIface,
 		},
-		name: name,
-		port: port,
-		sm:   sm,
+		name:     name,
+		port:     cfg.Port,
+		sm:       sm,
+		conn:     conn,
+		peers:    make(map[ip.IP4Net]*net.UDPAddr),
+		mac:      cfg.MAC,
+		tos:      cfg.tos(),
+		busyPoll: cfg.BusyPoll,
+		cpu:      cfg.CPU,
+		keys:     ks,
+		epochs:   make(map[ip.IP4Net]uint32),
+		own:      own,
+	}
+	if own != nil {
+		n.keepalive = cfg.NATKeepalive
 	}
 
 	n.tunNet = nw
+	n.mtu = n.maxMTU()
+	n.bufMTU = n.mtu
 
 	if err := n.initTun(); err != nil {
 		return nil, err
 	}
 
 	var err error
-	n.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: extIface.IfaceAddr, Port: port})
-	if err != nil {
-		return nil, fmt.Errorf("failed to start listening on UDP socket: %v", err)
-	}
-
 	n.ctl, n.ctl2, err = newCtlSockets()
 	if err != nil {
+		n.tun.Close()
 		return nil, fmt.Errorf("failed to create control socket: %v", err)
 	}
 
@@ -91,10 +138,16 @@ func (n *network) Run(ctx context.Context) {
 
 	wg.Add(1)
 	go func() {
-		runCProxy(n.tun, n.conn, n.ctl2, n.tunNet.IP, n.MTU())
+		runCProxy(n.tun, n.conn, n.ctl2, n.tunNet.IP, n.bufMTU, n.mac, n.keepalive, n.tos, n.busyPoll, n.cpu)
 		wg.Done()
 	}()
 
+	if n.mac != "" {
+		for _, e := range n.keys.Epochs() {
+			setKey(n.ctl, e, n.keys.Key(e))
+		}
+	}
+
 	log.Info("Watching for new subnet leases")
 
 	evts := make(chan []subnet.Event)
@@ -108,7 +161,9 @@ func (n *network) Run(ctx context.Context) {
 	for {
 		select {
 		case evtBatch := <-evts:
+			_, span := tracing.Start(ctx, "udp.processSubnetEvents", tracing.KV("network", n.name), tracing.KV("events", len(evtBatch)))
 			n.processSubnetEvents(evtBatch)
+			span.End(nil)
 
 		case <-ctx.Done():
 			stopProxy(n.ctl)
@@ -118,7 +173,54 @@ func (n *network) Run(ctx context.Context) {
 }
 
 func (n *network) MTU() int {
-	return n.ExtIface.Iface.MTU - encapOverhead
+	n.mtuMux.Lock()
+	defer n.mtuMux.Unlock()
+	return n.mtu
+}
+
+// Device implements backend.DeviceUser.
+func (n *network) Device() string {
+	return n.tunName
+}
+
+// Overhead implements backend.MTUAdjuster.
+func (n *network) Overhead() int {
+	overhead := encapOverhead
+	if n.mac != "" {
+		overhead += macHdrLen + macAlgs[n.mac].tagLen
+	}
+	return overhead
+}
+
+func (n *network) maxMTU() int {
+	return n.ExtIface.MTU() - n.Overhead()
+}
+
+// SetMTU implements backend.MTUAdjuster. The MTU cannot grow beyond the one
+// the network started with, which the buffers of the proxy are sized for.
+func (n *network) SetMTU(mtu int) error {
+	if max := n.maxMTU(); mtu > max {
+		mtu = max
+	}
+
+	n.mtuMux.Lock()
+	defer n.mtuMux.Unlock()
+	if mtu > n.bufMTU {
+		mtu = n.bufMTU
+	}
+	if mtu == n.mtu {
+		return nil
+	}
+
+	iface, err := netlink.LinkByName(n.tunName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup interface %v", n.tunName)
+	}
+	if err := netlink.LinkSetMTU(iface, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU for %v: %v", n.tunName, err)
+	}
+	n.mtu = mtu
+	return nil
 }
 
 func newCtlSockets() (*os.File, *os.File, error) {
@@ -133,15 +235,14 @@ func newCtlSockets() (*os.File, *os.File, error) {
 }
 
 func (n *network) initTun() error {
-	var tunName string
 	var err error
 
-	n.tun, tunName, err = ip.OpenTun("flannel%d")
+	n.tun, n.tunName, err = ip.OpenTun("flannel%d")
 	if err != nil {
 		return fmt.Errorf("failed to open TUN device: %v", err)
 	}
 
-	err = configureIface(tunName, n.tunNet, n.MTU())
+	err = configureIface(n.tunName, n.tunNet, n.MTU())
 	if err != nil {
 		return err
 	}
@@ -188,17 +289,113 @@ func (n *network) processSubnetEvents(batch []subnet.Event) {
 	for _, evt := range batch {
 		switch evt.Type {
 		case subnet.EventAdded:
-			log.Info("Subnet added: ", evt.Lease.Subnet)
-
-			setRoute(n.ctl, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, n.port)
+			log.InfoKV(fmt.Sprint("Subnet added: ", evt.Lease.Subnet), backend.EventFields("udp", evt)...)
+
+			var epoch uint32
+			if n.mac != "" {
+				var ok bool
+				if epoch, ok = n.keys.Common(evt.Lease.Attrs.KeyEpochs); !ok {
+					log.Errorf("No key shared with %v, which has key epochs %v and we %v; not routing to it", evt.Lease.Subnet, evt.Lease.Attrs.KeyEpochs, n.keys.Epochs())
+					n.removePeer(evt.Lease.Subnet)
+					continue
+				}
+			}
+
+			addr := n.peerEndpoint(&evt.Lease)
+			setRoute(n.ctl, evt.Lease.Subnet, ip.FromIP(addr.IP), addr.Port, epoch)
+			backend.Tracef("proxy route to %v via %v", evt.Lease.Subnet, addr)
+			n.peersMux.Lock()
+			n.peers[evt.Lease.Subnet] = addr
+			n.epochs[evt.Lease.Subnet] = epoch
+			n.peersMux.Unlock()
 
 		case subnet.EventRemoved:
-			log.Info("Subnet removed: ", evt.Lease.Subnet)
-
-			removeRoute(n.ctl, evt.Lease.Subnet)
+			log.InfoKV(fmt.Sprint("Subnet removed: ", evt.Lease.Subnet), backend.EventFields("udp", evt)...)
+			n.removePeer(evt.Lease.Subnet)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
 		}
 	}
 }
+
+// peerEndpoint returns where to send to the peer of l: with NAT traversal,
+// to the mapping of its NAT, or to its socket directly if it is behind the
+// same NAT as we are. Peers which did not discover their mapping, and all
+// peers without NAT traversal, are sent to at their public IP.
+func (n *network) peerEndpoint(l *subnet.Lease) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: l.Attrs.PublicIP.ToIP(), Port: n.port}
+	if n.own == nil || len(l.Attrs.BackendData) == 0 {
+		return addr
+	}
+
+	var attrs leaseAttrs
+	if err := json.Unmarshal(l.Attrs.BackendData, &attrs); err != nil {
+		log.Warningf("Failed to decode the backend data of %v: %v", l.Subnet, err)
+		return addr
+	}
+
+	ep := attrs.ObservedEndpoint
+	if ep == "" {
+		return addr
+	}
+	if sameHost(ep, n.own.ObservedEndpoint) {
+		ep = attrs.Endpoint
+	}
+
+	a, err := net.ResolveUDPAddr("udp4", ep)
+	if err != nil {
+		log.Warningf("Invalid endpoint %q of %v: %v", ep, l.Subnet, err)
+		return addr
+	}
+	return a
+}
+
+func sameHost(a, b string) bool {
+	ha, _, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hb, _, err := net.SplitHostPort(b)
+	return err == nil && ha == hb
+}
+
+func (n *network) removePeer(sn ip.IP4Net) {
+	removeRoute(n.ctl, sn)
+	backend.Tracef("removed proxy route to %v", sn)
+	n.peersMux.Lock()
+	delete(n.peers, sn)
+	delete(n.epochs, sn)
+	n.peersMux.Unlock()
+}
+
+func (n *network) DumpState(w io.Writer) {
+	fmt.Fprintf(w, "tunnel network %v, UDP port %v, MTU %v\n", n.tunNet, n.port, n.MTU())
+	if n.mac != "" {
+		fmt.Fprintf(w, "packets authenticated with %v, key epochs %v\n", n.mac, n.keys.Epochs())
+	}
+	if n.own != nil {
+		observed := n.own.ObservedEndpoint
+		if observed == "" {
+			observed = "unknown"
+		}
+		fmt.Fprintf(w, "NAT traversal: endpoint %v, observed at %v, keepalives every %vs\n", n.own.Endpoint, observed, n.keepalive)
+		fmt.Fprintln(w, "(the proxy sends to peers at the address their packets last came from, which may differ from below)")
+	}
+
+	n.peersMux.Lock()
+	defer n.peersMux.Unlock()
+
+	fmt.Fprintln(w, "proxy routes:")
+	for sn, addr := range n.peers {
+		if n.mac != "" {
+			fmt.Fprintf(w, "  %v via %v, key epoch %v\n", sn, addr, n.epochs[sn])
+		} else {
+			fmt.Fprintf(w, "  %v via %v\n", sn, addr)
+		}
+	}
+}
+
+func (n *network) Ports() []string {
+	return []string{fmt.Sprintf("%v/udp", n.port)}
+}
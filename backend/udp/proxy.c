@@ -27,9 +27,11 @@
 #include <linux/ip.h>
 #include <linux/icmp.h>
 #include <fcntl.h>
+#include <time.h>
 
 #define CMD_DEFINE
 #include "proxy.h"
+#include "mac.h"
 
 struct ip_net {
 	in_addr_t ip;
@@ -39,6 +41,10 @@ struct ip_net {
 struct route_entry {
 	struct ip_net      dst;
 	struct sockaddr_in next_hop;
+	/* the next hop set by CMD_SET_ROUTE, which differs from next_hop once
+	 * the peer was found behind another address with NAT traversal */
+	struct sockaddr_in advertised;
+	uint32_t           key_epoch;
 };
 
 typedef struct icmp_pkt {
@@ -49,6 +55,30 @@ typedef struct icmp_pkt {
 	char    data[sizeof(struct iphdr) + MAX_IPOPTLEN + 8];
 } __attribute__ ((aligned (4))) icmp_pkt;
 
+/* With a MAC, the packets between the proxies are prefixed with this header
+ * and followed by the tag of the header and the packet. */
+typedef struct mac_hdr {
+	/* subnet of the sender, whose sequence seq belongs to */
+	in_addr_t src_net;
+	/* epoch of the key of the tag, big endian */
+	uint8_t   epoch[4];
+	/* big endian */
+	uint8_t   seq[8];
+} __attribute__ ((packed)) mac_hdr;
+
+struct mac_key {
+	uint32_t epoch;
+	uint8_t  key[MAC_KEY_LEN];
+};
+
+/* the replay window of the packets received from a peer */
+struct peer_seq {
+	in_addr_t net;
+	uint64_t  max_seq;
+	/* bit i is set if max_seq - i has been received */
+	uint64_t  window;
+};
+
 /* we calc hdr checksums using 32bit uints that can alias other types */
 typedef uint32_t __attribute__((__may_alias__)) aliasing_uint32_t;
 
@@ -58,6 +88,26 @@ size_t routes_cnt;
 
 in_addr_t tun_addr;
 
+int mac_alg;
+struct mac_key mac_keys[MAC_MAX_KEYS];
+size_t mac_keys_cnt;
+size_t mac_tag_len;
+uint64_t send_seq;
+
+/* kept when routes are removed, so that re-added peers cannot be replayed */
+struct peer_seq *peer_seqs;
+size_t peer_seqs_alloc;
+size_t peer_seqs_cnt;
+
+/* seconds between the keepalives sent to every peer, 0 without NAT
+ * traversal */
+int keepalive_secs;
+
+/* whether the DSCP of each packet is copied to the UDP one, and the TOS
+ * the socket currently sends with */
+int tos_inherit;
+int sock_tos;
+
 int log_enabled;
 int exit_flag;
 
@@ -69,6 +119,10 @@ static inline int contains(struct ip_net net, in_addr_t ip) {
 	return net.ip == (ip & net.mask);
 }
 
+static inline int same_addr(struct sockaddr_in *a, struct sockaddr_in *b) {
+	return a->sin_addr.s_addr == b->sin_addr.s_addr && a->sin_port == b->sin_port;
+}
+
 static void log_error(const char *fmt, ...) {
 	va_list ap;
 
@@ -160,12 +214,18 @@ static void send_net_unreachable(int tun, char *offender) {
 	}
 }
 
-static int set_route(struct ip_net dst, struct sockaddr_in *next_hop) {
+static int set_route(struct ip_net dst, struct sockaddr_in *next_hop, uint32_t key_epoch) {
 	size_t i;
 
 	for( i = 0; i < routes_cnt; i++ ) {
 		if( dst.ip == routes[i].dst.ip && dst.mask == routes[i].dst.mask ) {
-			routes[i].next_hop = *next_hop;
+			/* keep the address the peer was found at unless it
+			 * advertises another one */
+			if( !same_addr(&routes[i].advertised, next_hop) ) {
+				routes[i].next_hop = *next_hop;
+				routes[i].advertised = *next_hop;
+			}
+			routes[i].key_epoch = key_epoch;
 			return 0;
 		}
 	}
@@ -182,6 +242,8 @@ static int set_route(struct ip_net dst, struct sockaddr_in *next_hop) {
 
 	routes[routes_cnt].dst = dst;
 	routes[routes_cnt].next_hop = *next_hop;
+	routes[routes_cnt].advertised = *next_hop;
+	routes[routes_cnt].key_epoch = key_epoch;
 	routes_cnt++;
 
 	return 0;
@@ -201,7 +263,7 @@ static int del_route(struct ip_net dst) {
 	return ENOENT;
 }
 
-static struct sockaddr_in *find_route(in_addr_t dst) {
+static struct route_entry *find_route(in_addr_t dst) {
 	size_t i;
 
 	for( i = 0; i < routes_cnt; i++ ) {
@@ -213,13 +275,97 @@ static struct sockaddr_in *find_route(in_addr_t dst) {
 				routes[0] = tmp;
 			}
 
-			return &routes[0].next_hop;
+			return &routes[0];
 		}
 	}
 
 	return NULL;
 }
 
+static struct route_entry *find_route_to(in_addr_t net) {
+	size_t i;
+
+	for( i = 0; i < routes_cnt; i++ ) {
+		if( routes[i].dst.ip == net )
+			return &routes[i];
+	}
+
+	return NULL;
+}
+
+static const uint8_t *find_key(uint32_t epoch) {
+	size_t i;
+
+	for( i = 0; i < mac_keys_cnt; i++ ) {
+		if( mac_keys[i].epoch == epoch )
+			return mac_keys[i].key;
+	}
+
+	return NULL;
+}
+
+static int set_key(uint32_t epoch, const uint8_t *key) {
+	size_t i;
+
+	for( i = 0; i < mac_keys_cnt; i++ ) {
+		if( mac_keys[i].epoch == epoch )
+			break;
+	}
+
+	if( i == MAC_MAX_KEYS )
+		return ENOMEM;
+
+	mac_keys[i].epoch = epoch;
+	memcpy(mac_keys[i].key, key, MAC_KEY_LEN);
+	if( i == mac_keys_cnt )
+		mac_keys_cnt++;
+
+	return 0;
+}
+
+static struct peer_seq *find_peer_seq(in_addr_t net) {
+	size_t i;
+
+	for( i = 0; i < peer_seqs_cnt; i++ ) {
+		if( peer_seqs[i].net == net )
+			return &peer_seqs[i];
+	}
+
+	if( peer_seqs_alloc == peer_seqs_cnt ) {
+		int new_alloc = (peer_seqs_alloc ? 2*peer_seqs_alloc : 8);
+		struct peer_seq *new_seqs = (struct peer_seq *) realloc(peer_seqs, new_alloc*sizeof(struct peer_seq));
+		if( !new_seqs )
+			return NULL;
+
+		peer_seqs = new_seqs;
+		peer_seqs_alloc = new_alloc;
+	}
+
+	memset(&peer_seqs[peer_seqs_cnt], 0, sizeof(struct peer_seq));
+	peer_seqs[peer_seqs_cnt].net = net;
+	return &peer_seqs[peer_seqs_cnt++];
+}
+
+/* returns 1 and records seq if it has not been received before and is not
+ * too old to tell */
+static int check_replay(struct peer_seq *ps, uint64_t seq) {
+	uint64_t off;
+
+	if( seq > ps->max_seq ) {
+		off = seq - ps->max_seq;
+		ps->window = (off >= 64 ? 0 : ps->window << off) | 1;
+		ps->max_seq = seq;
+		return 1;
+	}
+
+	off = ps->max_seq - seq;
+	if( off >= 64 || (ps->window & ((uint64_t)1 << off)) )
+		return 0;
+
+	ps->window |= (uint64_t)1 << off;
+	return 1;
+}
+
 static char *inaddr_str(in_addr_t a, char *buf, size_t len) {
 	struct in_addr addr;
 	addr.s_addr = a;
@@ -246,8 +392,9 @@ static ssize_t tun_recv_packet(int tun, char *buf, size_t buflen) {
 	return nread;
 }
 
-static ssize_t sock_recv_packet(int sock, char *buf, size_t buflen) {
-	ssize_t nread = recv(sock, buf, buflen, MSG_DONTWAIT);
+static ssize_t sock_recv_packet(int sock, char *buf, size_t buflen, struct sockaddr_in *from) {
+	socklen_t fromlen = sizeof(*from);
+	ssize_t nread = recvfrom(sock, buf, buflen, MSG_DONTWAIT, (struct sockaddr *)from, &fromlen);
 
 	if( nread < sizeof(struct iphdr) ) {
 		if( nread < 0 ) {
@@ -262,6 +409,16 @@ static ssize_t sock_recv_packet(int sock, char *buf, size_t buflen) {
 	return nread;
 }
 
+static void set_sock_tos(int sock, int tos) {
+	if( tos == sock_tos )
+		return;
+	if( setsockopt(sock, IPPROTO_IP, IP_TOS, &tos, sizeof(tos)) < 0 ) {
+		log_error("Failed to set the TOS of the UDP socket to %#x: %s\n", tos, strerror(errno));
+		return;
+	}
+	sock_tos = tos;
+}
+
 static void sock_send_packet(int sock, char *pkt, size_t pktlen, struct sockaddr_in *dst) {
 	ssize_t nsent = sendto(sock, pkt, pktlen, 0, (struct sockaddr *)dst, sizeof(struct sockaddr_in));
 
@@ -312,19 +469,51 @@ inline static int decrement_ttl(struct iphdr *iph) {
 	return 1;
 }
 
+/* fills in the MAC header in front of the pktlen bytes following it in buf
+ * and appends the tag, returning the length of the whole or -1 to drop it */
+static ssize_t seal(char *buf, ssize_t pktlen, struct route_entry *route) {
+	mac_hdr *hdr = (mac_hdr *)buf;
+	const uint8_t *key;
+	int i;
+
+	key = find_key(route->key_epoch);
+	if( !key ) {
+		log_error("Discarding packet, no key of epoch %u\n", route->key_epoch);
+		return -1;
+	}
+
+	hdr->src_net = tun_addr;
+	for( i = 0; i < 4; i++ )
+		hdr->epoch[i] = route->key_epoch >> (24 - 8 * i);
+	for( i = 0; i < 8; i++ )
+		hdr->seq[i] = send_seq >> (56 - 8 * i);
+	send_seq++;
+
+	pktlen += sizeof(mac_hdr);
+	mac_compute(mac_alg, key, (uint8_t *)buf, pktlen, (uint8_t *)buf + pktlen);
+	return pktlen + mac_tag_len;
+}
+
 static int tun_to_udp(int tun, int sock, char *buf, size_t buflen) {
 	struct iphdr *iph;
-	struct sockaddr_in *next_hop;
+	struct route_entry *route;
+	char *pkt = buf;
+
+	/* leave room for the MAC header and tag */
+	if( mac_alg != MAC_NONE ) {
+		pkt += sizeof(mac_hdr);
+		buflen -= sizeof(mac_hdr) + MAC_MAX_LEN;
+	}
 
-	ssize_t pktlen = tun_recv_packet(tun, buf, buflen);
+	ssize_t pktlen = tun_recv_packet(tun, pkt, buflen);
 	if( pktlen < 0 )
 		return 0;
-	
-	iph = (struct iphdr *)buf;
 
-	next_hop = find_route((in_addr_t) iph->daddr);
-	if( !next_hop ) {
-		send_net_unreachable(tun, buf);
+	iph = (struct iphdr *)pkt;
+
+	route = find_route((in_addr_t) iph->daddr);
+	if( !route ) {
+		send_net_unreachable(tun, pkt);
 		goto _active;
 	}
 
@@ -335,19 +524,118 @@ static int tun_to_udp(int tun, int sock, char *buf, size_t buflen) {
 		goto _active;
 	}
 
-	sock_send_packet(sock, buf, pktlen, next_hop);
+	/* the ECN bits are left to the kernel */
+	if( tos_inherit )
+		set_sock_tos(sock, iph->tos & 0xfc);
+
+	if( mac_alg != MAC_NONE ) {
+		pktlen = seal(buf, pktlen, route);
+		if( pktlen < 0 )
+			goto _active;
+	}
+
+	sock_send_packet(sock, buf, pktlen, &route->next_hop);
 _active:
 	return 1;
 }
 
+/* sends a keepalive, a MAC header without a packet, to every peer, which
+ * keeps the mappings of the NATs in between open */
+static void send_keepalives(int sock, char *buf) {
+	ssize_t pktlen;
+	size_t i;
+
+	for( i = 0; i < routes_cnt; i++ ) {
+		pktlen = seal(buf, 0, &routes[i]);
+		if( pktlen > 0 )
+			sock_send_packet(sock, buf, pktlen, &routes[i].next_hop);
+	}
+}
+
+/* verifies the MAC header and tag of the packet in buf, received from
+ * from, returning the length of the IP packet following the header, 0 for
+ * a keepalive, or -1 to drop it */
+static ssize_t check_mac(char *buf, ssize_t pktlen, struct sockaddr_in *from) {
+	mac_hdr *hdr = (mac_hdr *)buf;
+	uint8_t tag[MAC_MAX_LEN];
+	struct route_entry *route;
+	struct peer_seq *ps;
+	const uint8_t *key;
+	uint32_t epoch = 0;
+	uint64_t seq = 0;
+	char net[32], addr[32];
+	int i;
+
+	if( pktlen < (ssize_t)(sizeof(mac_hdr) + mac_tag_len) ) {
+		log_error("UDP recv packet too small for a MAC: %d bytes\n", (int)pktlen);
+		return -1;
+	}
+	pktlen -= mac_tag_len;
+
+	if( pktlen > (ssize_t)sizeof(mac_hdr) && pktlen < (ssize_t)(sizeof(mac_hdr) + sizeof(struct iphdr)) ) {
+		log_error("UDP recv packet too small: %d bytes\n", (int)(pktlen - sizeof(mac_hdr)));
+		return -1;
+	}
+
+	for( i = 0; i < 4; i++ )
+		epoch = (epoch << 8) | hdr->epoch[i];
+
+	key = find_key(epoch);
+	if( !key ) {
+		log_error("Discarding UDP packet with a MAC of unknown key epoch %u\n", epoch);
+		return -1;
+	}
+
+	mac_compute(mac_alg, key, (uint8_t *)buf, pktlen, tag);
+	if( !mac_equal(tag, (uint8_t *)buf + pktlen, mac_tag_len) ) {
+		log_error("Discarding UDP packet with a bad MAC\n");
+		return -1;
+	}
+
+	route = find_route_to(hdr->src_net);
+	if( !route ) {
+		log_error("Discarding UDP packet from unknown subnet %s\n", inaddr_str(hdr->src_net, net, sizeof(net)));
+		return -1;
+	}
+
+	for( i = 0; i < 8; i++ )
+		seq = (seq << 8) | hdr->seq[i];
+
+	ps = find_peer_seq(hdr->src_net);
+	if( !ps || !check_replay(ps, seq) ) {
+		log_error("Discarding replayed UDP packet from subnet %s\n", inaddr_str(hdr->src_net, net, sizeof(net)));
+		return -1;
+	}
+
+	/* behind NAT, the peer is where its authenticated packets come from */
+	if( keepalive_secs && !same_addr(&route->next_hop, from) ) {
+		log_error("Subnet %s moved to %s:%hu\n", inaddr_str(hdr->src_net, net, sizeof(net)),
+				inaddr_str(from->sin_addr.s_addr, addr, sizeof(addr)), ntohs(from->sin_port));
+		route->next_hop.sin_addr = from->sin_addr;
+		route->next_hop.sin_port = from->sin_port;
+	}
+
+	return pktlen - sizeof(mac_hdr);
+}
+
 static int udp_to_tun(int sock, int tun, char *buf, size_t buflen) {
 	struct iphdr *iph;
+	struct sockaddr_in from;
 
-	ssize_t pktlen = sock_recv_packet(sock, buf, buflen);
+	char *pkt = buf;
+
+	ssize_t pktlen = sock_recv_packet(sock, buf, buflen, &from);
 	if( pktlen < 0 )
 		return 0;
 
-	iph = (struct iphdr *)buf;
+	if( mac_alg != MAC_NONE ) {
+		pktlen = check_mac(buf, pktlen, &from);
+		if( pktlen <= 0 )
+			goto _active;
+		pkt += sizeof(mac_hdr);
+	}
+
+	iph = (struct iphdr *)pkt;
 
 	if( !decrement_ttl(iph) ) {
 		/* TTL went to 0, discard.
@@ -356,7 +644,7 @@ static int udp_to_tun(int sock, int tun, char *buf, size_t buflen) {
 		goto _active;
 	}
 
-	tun_send_packet(tun, buf, pktlen);
+	tun_send_packet(tun, pkt, pktlen);
 _active:
 	return 1;
 }
@@ -381,7 +669,7 @@ static void process_cmd(int ctl) {
 		sa.sin_addr.s_addr = cmd.next_hop_ip;
 		sa.sin_port = htons(cmd.next_hop_port);
 
-		set_route(ipn, &sa);
+		set_route(ipn, &sa, cmd.key_epoch);
 
 	} else if( cmd.cmd == CMD_DEL_ROUTE ) {
 		ipn.mask = netmask(cmd.dest_net_len);
@@ -389,6 +677,10 @@ static void process_cmd(int ctl) {
 
 		del_route(ipn);
 
+	} else if( cmd.cmd == CMD_SET_KEY ) {
+		if( set_key(cmd.key_epoch, cmd.key) )
+			log_error("Failed to set the key of epoch %u, too many keys\n", cmd.key_epoch);
+
 	} else if( cmd.cmd == CMD_STOP ) {
 		exit_flag = 1;
 	}
@@ -401,8 +693,26 @@ enum PFD {
 	PFD_CNT
 };
 
-void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int log_errors) {
+/* milliseconds until the next keepalives are due, sending them if they are */
+static int keepalive_timeout(int sock, char *buf, struct timespec *next) {
+	struct timespec now;
+	long ms;
+
+	clock_gettime(CLOCK_MONOTONIC, &now);
+	if( now.tv_sec > next->tv_sec || (now.tv_sec == next->tv_sec && now.tv_nsec >= next->tv_nsec) ) {
+		send_keepalives(sock, buf);
+		next->tv_sec = now.tv_sec + keepalive_secs;
+		next->tv_nsec = now.tv_nsec;
+	}
+
+	ms = (next->tv_sec - now.tv_sec) * 1000 + (next->tv_nsec - now.tv_nsec) / 1000000;
+	return ms > 0 ? (int)ms : 0;
+}
+
+void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int log_errors, int mac, int keepalive, int tos, int spin) {
 	char *buf;
+	size_t buflen = tun_mtu;
+	struct timespec now, next_keepalive = { 0, 0 };
 	struct pollfd fds[PFD_CNT] = {
 		{
 			.fd = tun,
@@ -421,17 +731,41 @@ void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int
 	exit_flag = 0;
 	tun_addr = tun_ip;
 	log_enabled = log_errors;
+	keepalive_secs = keepalive;
+
+	tos_inherit = tos == TOS_INHERIT;
+	sock_tos = 0;
+	if( !tos_inherit )
+		set_sock_tos(sock, tos);
+
+	mac_alg = mac;
+	mac_tag_len = mac_len(mac);
+	mac_keys_cnt = 0;
+	if( mac_alg != MAC_NONE ) {
+		buflen += sizeof(mac_hdr) + MAC_MAX_LEN;
+
+		/* start the sequence at the time so that it keeps increasing
+		 * across restarts */
+		clock_gettime(CLOCK_REALTIME, &now);
+		send_seq = (uint64_t)now.tv_sec * 1000000000 + now.tv_nsec;
+	}
 
-	buf = (char *) malloc(tun_mtu);
+	buf = (char *) malloc(buflen);
 	if( !buf ) {
-		log_error("Failed to allocate %d byte buffer\n", tun_mtu);
+		log_error("Failed to allocate %d byte buffer\n", buflen);
 		exit(1);
 	}
 
 	fcntl(tun, F_SETFL, O_NONBLOCK);
 
 	while( !exit_flag ) {
-		int nfds = poll(fds, PFD_CNT, -1), activity;
+		int timeout = keepalive_secs ? keepalive_timeout(sock, buf, &next_keepalive) : -1;
+		/* spinning never sleeps in poll() for the lowest latency, at the
+		 * cost of a core */
+		if( spin )
+			timeout = 0;
+
+		int nfds = poll(fds, PFD_CNT, timeout), activity;
 		if( nfds < 0 ) {
 			if( errno == EINTR )
 				continue;
@@ -446,8 +780,8 @@ void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int
 		if( fds[PFD_TUN].revents & POLLIN || fds[PFD_SOCK].revents & POLLIN )
 			do {
 				activity = 0;
-				activity += tun_to_udp(tun, sock, buf, tun_mtu);
-				activity += udp_to_tun(sock, tun, buf, tun_mtu);
+				activity += tun_to_udp(tun, sock, buf, buflen);
+				activity += udp_to_tun(sock, tun, buf, buflen);
 
 				/* As long as tun or udp is readable bypass poll().
 				 * We'll just occasionally get EAGAIN on an unreadable fd which
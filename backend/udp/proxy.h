@@ -16,6 +16,9 @@
 #define PROXY_H
 
 #include <netinet/in.h>
+#include <stdint.h>
+
+#include "mac.h"
 
 #ifdef CMD_DEFINE
 #	define cmdexport
@@ -26,6 +29,7 @@
 cmdexport const int CMD_SET_ROUTE = 1;
 cmdexport const int CMD_DEL_ROUTE = 2;
 cmdexport const int CMD_STOP      = 3;
+cmdexport const int CMD_SET_KEY   = 4;
 
 typedef struct command {
 	int       cmd;
@@ -33,8 +37,20 @@ typedef struct command {
 	int       dest_net_len;
 	in_addr_t next_hop_ip;
 	short     next_hop_port;
+	/* with a MAC, the key epoch to send with to the route and the epoch and
+	 * key of CMD_SET_KEY */
+	uint32_t  key_epoch;
+	uint8_t   key[MAC_KEY_LEN];
 } command;
 
-void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int log_errors);
+/* the TOS of run_proxy copying the DSCP of each packet to the UDP one */
+#define TOS_INHERIT -1
+
+/* mac is one of the MAC_ algorithms of mac.h, whose keys are set with
+ * CMD_SET_KEY. With keepalive seconds, which require a MAC, a keepalive is
+ * sent to every peer that often and the peers are sent to wherever their
+ * packets come from, for NAT traversal. The UDP packets get the TOS tos,
+ * unless TOS_INHERIT. */
+void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int log_errors, int mac, int keepalive, int tos, int spin);
 
 #endif
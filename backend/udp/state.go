@@ -0,0 +1,68 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// CurrentState implements backend.StateReader, describing flannel0 with
+// its addresses and routes.
+func (be *UdpBackend) CurrentState(config *subnet.Config, lease *subnet.Lease) ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	var link netlink.Link
+	for _, l := range links {
+		if l.Attrs().Name == "flannel0" {
+			link = l
+		}
+	}
+	if link == nil {
+		return nil, nil
+	}
+	if _, ok := link.(*netlink.Tuntap); !ok && link.Type() != "tun" {
+		return []string{fmt.Sprintf("# flannel0 is a %v device and would be replaced", link.Type())}, nil
+	}
+	steps := []string{"ip tuntap add flannel0 mode tun"}
+
+	addrs, err := netlink.AddrList(link, syscall.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses: %v", err)
+	}
+	for _, a := range addrs {
+		steps = append(steps, fmt.Sprintf("ip addr add %v dev flannel0", ip.FromIPNet(a.IPNet)))
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, r := range routes {
+		// usually the route the kernel adds for the address, which makes
+		// the one of flanneld redundant
+		if r.Dst != nil && r.Gw == nil {
+			steps = append(steps, fmt.Sprintf("ip route add %v dev flannel0", ip.FromIPNet(r.Dst)))
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"fmt"
+
+	"github.com/coreos/flannel/backend"
+)
+
+func (n *network) TracePacket(p *backend.Packet) ([]string, error) {
+	_, desc, err := backend.TraceRoute(p)
+	if err != nil {
+		return nil, err
+	}
+	steps := []string{desc}
+
+	if !n.tunNet.Contains(p.Dst) {
+		return append(steps, fmt.Sprintf("not encapsulated: %v is outside the flannel network", p.Dst)), nil
+	}
+
+	n.peersMux.Lock()
+	defer n.peersMux.Unlock()
+	for sn, addr := range n.peers {
+		if sn.Contains(p.Dst) {
+			return append(steps,
+				fmt.Sprintf("peer: subnet %v at %v", sn, addr.IP),
+				fmt.Sprintf("outer header: %v -> %v UDP dport %v, sent by the proxy through %v", n.ExtIface.IfaceAddr, addr.IP, addr.Port, n.tunName),
+			), nil
+		}
+	}
+	return append(steps, fmt.Sprintf("no lease contains %v: the proxy drops the packet", p.Dst)), nil
+}
@@ -17,11 +17,17 @@ package udp
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"runtime"
 
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/keys"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/publicip"
+	"github.com/coreos/flannel/pkg/schema"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -30,7 +36,9 @@ func init() {
 }
 
 const (
-	defaultPort = 8285
+	defaultPort         = 8285
+	defaultNATKeepalive = 25
+	defaultSTUNServer   = "stun.l.google.com:19302"
 )
 
 type UdpBackend struct {
@@ -46,33 +54,162 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return &be, nil
 }
 
-func (be *UdpBackend) RegisterNetwork(ctx context.Context, netname string, config *subnet.Config) (backend.Network, error) {
-	cfg := struct {
-		Port int
-	}{
-		Port: defaultPort,
+type udpConfig struct {
+	Port int
+	// MAC, siphash or hmac-sha256, authenticates the packets between the
+	// hosts with the keys in MACKeyFile, which is usually set per host in
+	// the [backend] section of the config file
+	MAC        string
+	MACKeyFile string
+	// NATTraversal has the hosts advertise the endpoint the STUN server
+	// sees them at, i.e. the mapping of the NAT in front of them, and keep
+	// the mappings to the peers open with keepalives every NATKeepalive
+	// seconds. It requires a MAC, as the peers are followed to wherever
+	// their authenticated packets come from.
+	NATTraversal bool
+	NATKeepalive int
+	STUNServer   string
+	// DSCP of the outer headers, see backend.ParseDSCP
+	DSCP string
+	// BusyPoll is the SO_BUSY_POLL of the socket in microseconds; the
+	// proxy then spins rather than sleeps, taking a full core
+	BusyPoll int
+	// CPU the proxy is pinned to, -1 for none
+	CPU int
+}
+
+// tos returns the TOS the proxy sends with for the DSCP of cfg.
+func (cfg *udpConfig) tos() int {
+	dscp, _ := backend.ParseDSCP(cfg.DSCP)
+	if dscp == backend.DSCPInherit {
+		return tosInherit
+	}
+	return dscp << 2
+}
+
+// leaseAttrs is the backend data of the leases with NAT traversal.
+type leaseAttrs struct {
+	// Endpoint is the address and port of the socket of the proxy
+	Endpoint string
+	// ObservedEndpoint is the one the STUN server saw the socket at, if it
+	// answered
+	ObservedEndpoint string `json:",omitempty"`
+}
+
+func parseConfig(config *subnet.Config) (*udpConfig, error) {
+	cfg := &udpConfig{
+		Port:         defaultPort,
+		NATKeepalive: defaultNATKeepalive,
+		STUNServer:   defaultSTUNServer,
+		CPU:          -1,
 	}
 
 	// Parse our configuration
-	if len(config.Backend) > 0 {
-		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
-			return nil, fmt.Errorf("error decoding UDP backend config: %v", err)
+	if err := schema.Decode(config.Backend, cfg, "Type"); err != nil {
+		return nil, fmt.Errorf("error decoding UDP backend config: %v", err)
+	}
+
+	if cfg.MAC != "" {
+		if _, ok := macAlgs[cfg.MAC]; !ok {
+			return nil, fmt.Errorf("unknown MAC %q, expected siphash or hmac-sha256", cfg.MAC)
+		}
+		if cfg.MACKeyFile == "" {
+			return nil, fmt.Errorf("MAC requires MACKeyFile")
 		}
 	}
 
+	if _, err := backend.ParseDSCP(cfg.DSCP); err != nil {
+		return nil, err
+	}
+
+	if cfg.BusyPoll < 0 {
+		return nil, fmt.Errorf("invalid BusyPoll %v, expected a number of microseconds", cfg.BusyPoll)
+	}
+	if cfg.CPU < -1 || cfg.CPU >= runtime.NumCPU() {
+		return nil, fmt.Errorf("invalid CPU %v, expected one of 0-%v or -1", cfg.CPU, runtime.NumCPU()-1)
+	}
+
+	if cfg.NATTraversal {
+		if cfg.MAC == "" {
+			return nil, fmt.Errorf("NATTraversal requires MAC")
+		}
+		if cfg.NATKeepalive <= 0 {
+			return nil, fmt.Errorf("invalid NATKeepalive %v, expected a number of seconds", cfg.NATKeepalive)
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadMACKeys loads the MAC keys, with their epochs, from path.
+func loadMACKeys(path string) (*keys.Set, error) {
+	ks, err := keys.Load(path, macKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load MAC keys: %v", err)
+	}
+	if n := len(ks.Epochs()); n > macMaxKeys {
+		return nil, fmt.Errorf("%v: %v MAC keys, at most %v are supported", path, n, macMaxKeys)
+	}
+	return ks, nil
+}
+
+// CheckFIPS implements backend.FIPSChecker.
+func (be *UdpBackend) CheckFIPS(config *subnet.Config) error {
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return err
+	}
+	// the proxy computes the MAC in C of its own, not in a validated module
+	if cfg.MAC != "" {
+		return fmt.Errorf("the %v MAC of the udp backend is not implemented by a validated crypto module", cfg.MAC)
+	}
+	return nil
+}
+
+func (be *UdpBackend) RegisterNetwork(ctx context.Context, netname string, config *subnet.Config) (backend.Network, error) {
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
 	// Acquire the lease form subnet manager
 	attrs := subnet.LeaseAttrs{
 		PublicIP: ip.FromIP(be.extIface.ExtAddr),
 	}
 
+	var ks *keys.Set
+	if cfg.MAC != "" {
+		if ks, err = loadMACKeys(cfg.MACKeyFile); err != nil {
+			return nil, err
+		}
+		// the peers pick the newest key we share from these
+		attrs.KeyEpochs = ks.Epochs()
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: be.extIface.IfaceAddr, Port: cfg.Port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start listening on UDP socket: %v", err)
+	}
+
+	var own *leaseAttrs
+	if cfg.NATTraversal {
+		own = discoverEndpoint(conn, cfg.STUNServer)
+		if attrs.BackendData, err = json.Marshal(own); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
 	l, err := be.sm.AcquireLease(ctx, netname, &attrs)
 	switch err {
 	case nil:
 
 	case context.Canceled, context.DeadlineExceeded:
+		conn.Close()
 		return nil, err
 
 	default:
+		conn.Close()
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
@@ -83,9 +220,64 @@ func (be *UdpBackend) RegisterNetwork(ctx context.Context, netname string, confi
 		PrefixLen: config.Network.PrefixLen,
 	}
 
-	return newNetwork(netname, be.sm, be.extIface, cfg.Port, tunNet, l)
+	n, err := newNetwork(netname, be.sm, be.extIface, cfg, ks, conn, own, tunNet, l)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// discoverEndpoint asks the STUN server where it sees conn at, before the
+// proxy takes it over. Without an answer, the peers can still find us from
+// our keepalives.
+func discoverEndpoint(conn *net.UDPConn, stunServer string) *leaseAttrs {
+	own := &leaseAttrs{Endpoint: conn.LocalAddr().String()}
+
+	d := &publicip.Discoverer{STUNServer: stunServer}
+	addr, err := d.MappedAddr(conn)
+	if err != nil {
+		log.Warningf("Failed to discover the NAT mapping of %v from STUN server %v, advertising the public IP: %v", own.Endpoint, stunServer, err)
+		return own
+	}
+
+	own.ObservedEndpoint = addr.String()
+	log.Infof("STUN server %v sees %v at %v", stunServer, own.Endpoint, own.ObservedEndpoint)
+	return own
 }
 
 func (_ *UdpBackend) Run(ctx context.Context) {
 	<-ctx.Done()
 }
+
+// Plan implements backend.Planner.
+func (be *UdpBackend) Plan(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) ([]string, error) {
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tunNet := ip.IP4Net{
+		IP:        lease.Subnet.IP,
+		PrefixLen: config.Network.PrefixLen,
+	}
+
+	steps := []string{
+		"ip tuntap add flannel0 mode tun",
+		fmt.Sprintf("ip addr add %v dev flannel0", tunNet),
+		fmt.Sprintf("ip route add %v dev flannel0", tunNet.Network()),
+		fmt.Sprintf("# listen on UDP port %v", cfg.Port),
+	}
+	if cfg.MAC != "" {
+		steps = append(steps, fmt.Sprintf("# authenticate packets with %v", cfg.MAC))
+	}
+	if cfg.NATTraversal {
+		steps = append(steps, fmt.Sprintf("# discover the NAT mapping of the socket from %v and send keepalives every %vs", cfg.STUNServer, cfg.NATKeepalive))
+	}
+
+	for _, l := range peers {
+		steps = append(steps, fmt.Sprintf("# proxy %v to %v:%v", l.Subnet, l.Attrs.PublicIP, cfg.Port))
+	}
+
+	return steps, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// encapOverhead is what VXLAN adds to each packet: the outer IP, UDP and
+// VXLAN headers and the inner ethernet header.
+const encapOverhead = 50
+
+// Check implements backend.Checker.
+func (be *VXLANBackend) Check(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) []backend.CheckResult {
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return []backend.CheckResult{{Name: "backend config", Err: err, Hint: "fix the Backend section of the network config"}}
+	}
+
+	name := fmt.Sprintf("flannel.%v", cfg.VNI)
+	restart := "restart flanneld to recreate the device"
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return []backend.CheckResult{{Name: "device " + name, Err: err, Hint: restart}}
+	}
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return []backend.CheckResult{{Name: "device " + name, Err: fmt.Errorf("is a %v device, not vxlan", link.Type()), Hint: "delete the device and restart flanneld"}}
+	}
+
+	res := []backend.CheckResult{{Name: "device " + name, Err: checkDevice(vxlan, cfg, lease, config.Network), Hint: restart}}
+
+	maxMTU := be.extIface.MTU() - encapOverhead
+	res = append(res, backend.CheckResult{
+		Name: "device MTU",
+		Err:  checkMTU(vxlan.MTU, maxMTU),
+		Hint: fmt.Sprintf("set the MTU with 'ip link set %v mtu %v' and update the MTU of the containers", name, maxMTU),
+	})
+
+	res = append(res, backend.CheckResult{
+		Name: "FDB entries",
+		Err:  checkFDB(vxlan, peers),
+		Hint: "restart flanneld to resynchronize the FDB with the leases",
+	})
+
+	return res
+}
+
+// checkDevice verifies that the device is up with the VNI and address
+// flanneld gives it.
+func checkDevice(link *netlink.Vxlan, cfg *vxlanConfig, lease *subnet.Lease, network ip.IP4Net) error {
+	if link.VxlanId != cfg.VNI {
+		return fmt.Errorf("has VNI %v instead of %v", link.VxlanId, cfg.VNI)
+	}
+	if link.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("is down")
+	}
+
+	want := ip.IP4Net{IP: lease.Subnet.IP, PrefixLen: network.PrefixLen}
+	addrs, err := netlink.AddrList(link, syscall.AF_INET)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses: %v", err)
+	}
+	for _, a := range addrs {
+		if ip.FromIPNet(a.IPNet).Equal(want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("does not have address %v", want)
+}
+
+func checkMTU(mtu, maxMTU int) error {
+	if mtu > maxMTU {
+		return fmt.Errorf("%v exceeds %v, encapsulated packets will be fragmented or dropped", mtu, maxMTU)
+	}
+	return nil
+}
+
+// checkFDB verifies that there is an FDB entry for the VTEP of every vxlan
+// peer.
+func checkFDB(link *netlink.Vxlan, peers []subnet.Lease) error {
+	fdb, err := netlink.NeighList(link.Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list FDB entries: %v", err)
+	}
+
+	missing := []string{}
+	for _, l := range peers {
+		if l.Attrs.BackendType != "vxlan" {
+			continue
+		}
+
+		var attrs vxlanLeaseAttrs
+		if err := json.Unmarshal(l.Attrs.BackendData, &attrs); err != nil {
+			continue
+		}
+
+		found := false
+		for _, e := range fdb {
+			if l.Attrs.PublicIP.ToIP().Equal(e.IP) && bytes.Equal(attrs.VtepMAC, e.HardwareAddr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%v dst %v (%v)", net.HardwareAddr(attrs.VtepMAC), l.Attrs.PublicIP, l.Subnet))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// PlanPorts implements backend.PortPlanner.
+func (be *VXLANBackend) PlanPorts(config *subnet.Config) ([]string, error) {
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		// the kernel's default
+		port = 8472
+	}
+	return []string{fmt.Sprintf("%v/udp", port)}, nil
+}
@@ -15,17 +15,18 @@
 package vxlan
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"os"
 	"syscall"
 	"time"
 
-	log "github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
 
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
 )
 
 type vxlanDeviceAttrs struct {
@@ -35,6 +36,7 @@ type vxlanDeviceAttrs struct {
 	vtepAddr  net.IP
 	vtepPort  int
 	gbp       bool
+	tos       int
 }
 
 type vxlanDevice struct {
@@ -63,6 +65,7 @@ func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
 		Port:         devAttrs.vtepPort,
 		Learning:     false,
 		GBP:          devAttrs.gbp,
+		TOS:          devAttrs.tos,
 	}
 
 	link, err := ensureLink(link)
@@ -91,6 +94,7 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 
 		incompat := vxlanLinksIncompat(vxlan, existing)
 		if incompat == "" {
+			log.Infof("Attaching to existing %q device", vxlan.Name)
 			return existing.(*netlink.Vxlan), nil
 		}
 
@@ -122,7 +126,9 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 }
 
 func (dev *vxlanDevice) Configure(ipn ip.IP4Net) error {
-	setAddr4(dev.link, ipn.ToIPNet())
+	if err := setAddr4(dev.link, ipn.ToIPNet()); err != nil {
+		return err
+	}
 
 	if err := netlink.LinkSetUp(dev.link); err != nil {
 		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.link.Attrs().Name, err)
@@ -154,6 +160,14 @@ func (dev *vxlanDevice) MTU() int {
 	return dev.link.MTU
 }
 
+func (dev *vxlanDevice) SetMTU(mtu int) error {
+	if err := netlink.LinkSetMTU(dev.link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU of %v: %v", dev.link.Attrs().Name, err)
+	}
+	dev.link.MTU = mtu
+	return nil
+}
+
 type neigh struct {
 	MAC net.HardwareAddr
 	IP  ip.IP4
@@ -238,7 +252,7 @@ func isNeighResolving(state int) bool {
 func (dev *vxlanDevice) processNeighMsg(msg syscall.NetlinkMessage, misses chan *netlink.Neigh) {
 	neigh, err := netlink.NeighDeserialize(msg.Data)
 	if err != nil {
-		log.Error("Failed to deserialize netlink ndmsg: %v", err)
+		log.Errorf("Failed to deserialize netlink ndmsg: %v", err)
 		return
 	}
 
@@ -290,16 +304,27 @@ func vxlanLinksIncompat(l1, l2 netlink.Link) string {
 		return fmt.Sprintf("port: %v vs %v", v1.Port, v2.Port)
 	}
 
+	if v1.TOS != v2.TOS {
+		return fmt.Sprintf("tos: %v vs %v", v1.TOS, v2.TOS)
+	}
+
 	return ""
 }
 
-// sets IP4 addr on link removing any existing ones first
+// sets IP4 addr on link removing any existing ones first. If the link
+// already has exactly that address (e.g. after a restart) it is left alone
+// so that traffic keeps flowing.
 func setAddr4(link *netlink.Vxlan, ipn *net.IPNet) error {
 	addrs, err := netlink.AddrList(link, syscall.AF_INET)
 	if err != nil {
 		return err
 	}
 
+	if len(addrs) == 1 && addrs[0].IP.Equal(ipn.IP) && bytes.Equal(addrs[0].Mask, ipn.Mask) {
+		log.Infof("%v already has address %v, keeping it", link.Attrs().Name, ipn)
+		return nil
+	}
+
 	for _, addr := range addrs {
 		if err = netlink.AddrDel(link, &addr); err != nil {
 			return fmt.Errorf("failed to delete IPv4 addr %s from %s", addr.String(), link.Attrs().Name)
@@ -0,0 +1,67 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// Drift implements backend.DriftDetector, comparing the FDB entries of the
+// device with the VTEPs of the vxlan peers.
+func (n *network) Drift(peers []subnet.Lease) ([]string, error) {
+	fdb, err := n.dev.GetL2List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list FDB entries: %v", err)
+	}
+
+	// the destination of each MAC's entry; entries without one are not
+	// ours
+	dsts := map[string]net.IP{}
+	for _, e := range fdb {
+		if e.IP != nil {
+			dsts[e.HardwareAddr.String()] = e.IP
+		}
+	}
+
+	drift := []string{}
+	for _, l := range peers {
+		if l.Attrs.BackendType != "vxlan" {
+			continue
+		}
+		var attrs vxlanLeaseAttrs
+		if err := json.Unmarshal(l.Attrs.BackendData, &attrs); err != nil {
+			continue
+		}
+
+		mac := net.HardwareAddr(attrs.VtepMAC).String()
+		dst, ok := dsts[mac]
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("missing FDB entry %v dst %v (%v)", mac, l.Attrs.PublicIP, l.Subnet))
+		case !dst.Equal(l.Attrs.PublicIP.ToIP()):
+			drift = append(drift, fmt.Sprintf("FDB entry %v dst %v instead of %v (%v)", mac, dst, l.Attrs.PublicIP, l.Subnet))
+		}
+		delete(dsts, mac)
+	}
+
+	for mac, dst := range dsts {
+		drift = append(drift, fmt.Sprintf("FDB entry %v dst %v without a lease", mac, dst))
+	}
+	return drift, nil
+}
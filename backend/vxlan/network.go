@@ -18,16 +18,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
 
-	log "github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/tracing"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -36,8 +38,15 @@ type network struct {
 	name     string
 	extIface *backend.ExternalInterface
 	dev      *vxlanDevice
+	rtsMux   sync.Mutex
 	rts      routes
 	sm       subnet.Manager
+	// reconcile passes Reconcile requests to the event loop
+	reconcile chan chan error
+	// guards the MTU of dev, which SetMTU changes
+	mtuMux sync.Mutex
+	// reports the offload status of the entries of dev
+	hwOffload bool
 }
 
 func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, nw ip.IP4Net, l *subnet.Lease) (*network, error) {
@@ -46,9 +55,10 @@ func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterf
 			SubnetLease: l,
 			ExtIface:    extIface,
 		},
-		name: name,
-		sm:   sm,
-		dev:  dev,
+		name:      name,
+		sm:        sm,
+		dev:       dev,
+		reconcile: make(chan chan error),
 	}
 
 	return n, nil
@@ -73,14 +83,32 @@ func (n *network) Run(ctx context.Context) {
 	}()
 
 	defer wg.Wait()
-	initialEvtsBatch := <-evts
+	var initialEvtsBatch []subnet.Event
+	select {
+	case initialEvtsBatch = <-evts:
+	case <-ctx.Done():
+		return
+	}
 	for {
 		err := n.handleInitialSubnetEvents(initialEvtsBatch)
 		if err == nil {
 			break
 		}
 		log.Error(err, " About to retry")
-		time.Sleep(time.Second)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	// the entries of the initial leases are in place
+	if n.hwOffload {
+		wg.Add(1)
+		go func() {
+			n.watchOffload(ctx)
+			wg.Done()
+		}()
 	}
 
 	for {
@@ -89,7 +117,12 @@ func (n *network) Run(ctx context.Context) {
 			n.handleMiss(miss)
 
 		case evtBatch := <-evts:
+			_, span := tracing.Start(ctx, "vxlan.handleSubnetEvents", tracing.KV("network", n.name), tracing.KV("events", len(evtBatch)))
 			n.handleSubnetEvents(evtBatch)
+			span.End(nil)
+
+		case c := <-n.reconcile:
+			c <- n.reconcileFDB(ctx)
 
 		case <-ctx.Done():
 			return
@@ -98,9 +131,35 @@ func (n *network) Run(ctx context.Context) {
 }
 
 func (n *network) MTU() int {
+	n.mtuMux.Lock()
+	defer n.mtuMux.Unlock()
 	return n.dev.MTU()
 }
 
+// Device implements backend.DeviceUser.
+func (n *network) Device() string {
+	return n.dev.link.Name
+}
+
+// Overhead implements backend.MTUAdjuster.
+func (n *network) Overhead() int {
+	return encapOverhead
+}
+
+// SetMTU implements backend.MTUAdjuster.
+func (n *network) SetMTU(mtu int) error {
+	if max := n.ExtIface.MTU() - encapOverhead; mtu > max {
+		mtu = max
+	}
+
+	n.mtuMux.Lock()
+	defer n.mtuMux.Unlock()
+	if mtu == n.dev.MTU() {
+		return nil
+	}
+	return n.dev.SetMTU(mtu)
+}
+
 type vxlanLeaseAttrs struct {
 	VtepMAC hardwareAddr
 }
@@ -109,7 +168,7 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 	for _, evt := range batch {
 		switch evt.Type {
 		case subnet.EventAdded:
-			log.Info("Subnet added: ", evt.Lease.Subnet)
+			log.InfoKV(fmt.Sprint("Subnet added: ", evt.Lease.Subnet), backend.EventFields("vxlan", evt)...)
 
 			if evt.Lease.Attrs.BackendType != "vxlan" {
 				log.Warningf("Ignoring non-vxlan subnet: type=%v", evt.Lease.Attrs.BackendType)
@@ -121,11 +180,12 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				log.Error("Error decoding subnet lease JSON: ", err)
 				continue
 			}
-			n.rts.set(evt.Lease.Subnet, net.HardwareAddr(attrs.VtepMAC))
+			n.setRoute(evt.Lease.Subnet, net.HardwareAddr(attrs.VtepMAC))
 			n.dev.AddL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
+			backend.Tracef("subnet %v via VTEP %v at %v", evt.Lease.Subnet, net.HardwareAddr(attrs.VtepMAC), evt.Lease.Attrs.PublicIP)
 
 		case subnet.EventRemoved:
-			log.Info("Subnet removed: ", evt.Lease.Subnet)
+			log.InfoKV(fmt.Sprint("Subnet removed: ", evt.Lease.Subnet), backend.EventFields("vxlan", evt)...)
 
 			if evt.Lease.Attrs.BackendType != "vxlan" {
 				log.Warningf("Ignoring non-vxlan subnet: type=%v", evt.Lease.Attrs.BackendType)
@@ -141,7 +201,8 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 			if len(attrs.VtepMAC) > 0 {
 				n.dev.DelL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
 			}
-			n.rts.remove(evt.Lease.Subnet)
+			n.removeRoute(evt.Lease.Subnet)
+			backend.Tracef("removed subnet %v via VTEP %v at %v", evt.Lease.Subnet, net.HardwareAddr(attrs.VtepMAC), evt.Lease.Attrs.PublicIP)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -151,10 +212,15 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 
 func (n *network) handleInitialSubnetEvents(batch []subnet.Event) error {
 	log.Infof("Handling initial subnet events")
+	pass := backend.StartLoopPass(n.name, "fdb")
+	defer pass.Done()
+
 	fdbTable, err := n.dev.GetL2List()
 	if err != nil {
+		pass.Error()
 		return fmt.Errorf("error fetching L2 table: %v", err)
 	}
+	pass.Items(len(batch))
 
 	for _, fdbEntry := range fdbTable {
 		log.Infof("fdb already populated with: %s %s ", fdbEntry.IP, fdbEntry.HardwareAddr)
@@ -184,13 +250,14 @@ func (n *network) handleInitialSubnetEvents(batch []subnet.Event) error {
 				break
 			}
 		}
-		n.rts.set(evt.Lease.Subnet, net.HardwareAddr(leaseAttrsList[i].VtepMAC))
+		n.setRoute(evt.Lease.Subnet, net.HardwareAddr(leaseAttrsList[i].VtepMAC))
 	}
 
 	for j, marker := range fdbEntryMarker {
 		if !marker && fdbTable[j].IP != nil {
 			err := n.dev.DelL2(neigh{IP: ip.FromIP(fdbTable[j].IP), MAC: fdbTable[j].HardwareAddr})
 			if err != nil {
+				pass.Error()
 				log.Error("Delete L2 failed: ", err)
 			}
 		}
@@ -200,6 +267,7 @@ func (n *network) handleInitialSubnetEvents(batch []subnet.Event) error {
 		if !marker {
 			err := n.dev.AddL2(neigh{IP: batch[i].Lease.Attrs.PublicIP, MAC: net.HardwareAddr(leaseAttrsList[i].VtepMAC)})
 			if err != nil {
+				pass.Error()
 				log.Error("Add L2 failed: ", err)
 			}
 
@@ -208,6 +276,33 @@ func (n *network) handleInitialSubnetEvents(batch []subnet.Event) error {
 	return nil
 }
 
+// Reconcile brings the FDB in line with the leases, adding missing entries
+// and removing those of hosts without a lease.
+func (n *network) Reconcile(ctx context.Context) error {
+	c := make(chan error, 1)
+	select {
+	case n.reconcile <- c:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-c
+}
+
+func (n *network) reconcileFDB(ctx context.Context) error {
+	wr, err := n.sm.WatchLeases(ctx, n.name, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get the leases: %v", err)
+	}
+
+	batch := []subnet.Event{}
+	for _, l := range wr.Snapshot {
+		if !l.Subnet.Equal(n.SubnetLease.Subnet) {
+			batch = append(batch, subnet.Event{Type: subnet.EventAdded, Lease: l})
+		}
+	}
+	return n.handleInitialSubnetEvents(batch)
+}
+
 func (n *network) handleMiss(miss *netlink.Neigh) {
 	switch {
 	case len(miss.IP) == 0 && len(miss.HardwareAddr) == 0:
@@ -224,7 +319,7 @@ func (n *network) handleMiss(miss *netlink.Neigh) {
 func (n *network) handleL3Miss(miss *netlink.Neigh) {
 	log.Infof("L3 miss: %v", miss.IP)
 
-	rt := n.rts.findByNetwork(ip.FromIP(miss.IP))
+	rt := n.findRoute(ip.FromIP(miss.IP))
 	if rt == nil {
 		log.Infof("Route for %v not found", miss.IP)
 		return
@@ -234,5 +329,66 @@ func (n *network) handleL3Miss(miss *netlink.Neigh) {
 		log.Errorf("AddL3 failed: %v", err)
 	} else {
 		log.Info("AddL3 succeeded")
+		backend.Tracef("L3 miss for %v resolved to VTEP %v of subnet %v", miss.IP, rt.vtepMAC, rt.network)
+	}
+}
+
+func (n *network) setRoute(sn ip.IP4Net, vtepMAC net.HardwareAddr) {
+	n.rtsMux.Lock()
+	defer n.rtsMux.Unlock()
+	n.rts.set(sn, vtepMAC)
+}
+
+func (n *network) removeRoute(sn ip.IP4Net) {
+	n.rtsMux.Lock()
+	defer n.rtsMux.Unlock()
+	n.rts.remove(sn)
+}
+
+func (n *network) findRoute(addr ip.IP4) *route {
+	n.rtsMux.Lock()
+	defer n.rtsMux.Unlock()
+	if rt := n.rts.findByNetwork(addr); rt != nil {
+		found := *rt
+		return &found
+	}
+	return nil
+}
+
+func (n *network) DumpState(w io.Writer) {
+	fmt.Fprintf(w, "device %v, VTEP MAC %v, MTU %v\n", n.dev.link.Attrs().Name, n.dev.MACAddr(), n.dev.MTU())
+
+	n.rtsMux.Lock()
+	rts := append(routes(nil), n.rts...)
+	n.rtsMux.Unlock()
+
+	fmt.Fprintln(w, "peer subnets:")
+	for _, rt := range rts {
+		fmt.Fprintf(w, "  %v -> VTEP %v\n", rt.network, rt.vtepMAC)
+	}
+
+	fdb, err := n.dev.GetL2List()
+	if err != nil {
+		fmt.Fprintf(w, "failed to list FDB entries: %v\n", err)
+		return
 	}
+	fmt.Fprintln(w, "FDB entries:")
+	for _, e := range fdb {
+		fmt.Fprintf(w, "  %v dst %v\n", e.HardwareAddr, e.IP)
+	}
+}
+
+func (n *network) Ports() []string {
+	port := n.dev.link.Port
+	if port == 0 {
+		// the kernel's default
+		port = 8472
+	}
+	return []string{fmt.Sprintf("%v/udp", port)}
+}
+
+// Retire removes the VXLAN device, and with it its FDB entries and routes,
+// once the network migrated to another backend.
+func (n *network) Retire() {
+	n.dev.Destroy()
 }
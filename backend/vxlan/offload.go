@@ -0,0 +1,141 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+// With HWOffload, the encapsulation is left to the NIC where its driver
+// offloads the FDB entries and routes of the device, as switchdev NICs such
+// as Mellanox ConnectX in switchdev mode do once TC offload is enabled on
+// them. Whether they do is up to the driver, which flags the entries it took
+// as offloaded.
+
+const (
+	// set by the driver on the FDB entries in hardware, from
+	// linux/neighbour.h
+	ntfOffloaded = 0x20
+	// set on the routes in hardware, from linux/rtnetlink.h: the next hop
+	// flag older kernels report and the route flag of newer ones
+	rtnhFOffload = 0x08
+	rtmFOffload  = 0x4000
+
+	offloadCheckInterval = 30 * time.Second
+)
+
+var (
+	fdbOffloaded = metrics.NewGauge("flannel_vxlan_fdb_offloaded",
+		"1 if the FDB entry of the peer VTEP is offloaded to the NIC, 0 if not, with the HWOffload option.", "network", "vtep")
+	routeOffloaded = metrics.NewGauge("flannel_vxlan_route_offloaded",
+		"1 if the route through the vxlan device is offloaded to the NIC, 0 if not, with the HWOffload option.", "network", "dst")
+)
+
+// enableTCOffload turns on the TC offload of the NIC, which switchdev drivers
+// require to take the entries of the device.
+func enableTCOffload(iface string) error {
+	out, err := exec.Command("ethtool", "-K", iface, "hw-tc-offload", "on").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ethtool -K %v hw-tc-offload on: %v: %s", iface, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func offloaded(set bool) float64 {
+	if set {
+		return 1
+	}
+	return 0
+}
+
+// reportOffload exports whether each FDB entry and route of the device is
+// offloaded, returning the labels now exported.
+func (n *network) reportOffload(fdbs, routes map[string]bool) (map[string]bool, map[string]bool) {
+	nextFDBs, nextRoutes := map[string]bool{}, map[string]bool{}
+
+	entries, err := netlink.NeighList(n.dev.link.Index, syscall.AF_BRIDGE)
+	if err != nil {
+		log.Warningf("Failed to list the FDB entries of %v: %v", n.dev.link.Name, err)
+		nextFDBs = fdbs
+	}
+	for _, e := range entries {
+		if e.IP == nil || e.IP.To4() == nil {
+			continue
+		}
+		vtep := e.IP.String()
+		fdbOffloaded.Set(offloaded(e.Flags&ntfOffloaded != 0), n.name, vtep)
+		nextFDBs[vtep] = true
+	}
+
+	rs, err := netlink.RouteList(n.dev.link, netlink.FAMILY_V4)
+	if err != nil {
+		log.Warningf("Failed to list the routes through %v: %v", n.dev.link.Name, err)
+		nextRoutes = routes
+	}
+	for _, r := range rs {
+		if r.Dst == nil {
+			continue
+		}
+		dst := r.Dst.String()
+		routeOffloaded.Set(offloaded(r.Flags&(rtnhFOffload|rtmFOffload) != 0), n.name, dst)
+		nextRoutes[dst] = true
+	}
+
+	for vtep := range fdbs {
+		if !nextFDBs[vtep] {
+			fdbOffloaded.Delete(n.name, vtep)
+		}
+	}
+	for dst := range routes {
+		if !nextRoutes[dst] {
+			routeOffloaded.Delete(n.name, dst)
+		}
+	}
+	return nextFDBs, nextRoutes
+}
+
+// watchOffload reports the offload status of the entries of the device
+// every offloadCheckInterval, until ctx is done.
+func (n *network) watchOffload(ctx context.Context) {
+	fdbs, routes := map[string]bool{}, map[string]bool{}
+	defer func() {
+		for vtep := range fdbs {
+			fdbOffloaded.Delete(n.name, vtep)
+		}
+		for dst := range routes {
+			routeOffloaded.Delete(n.name, dst)
+		}
+	}()
+
+	for {
+		fdbs, routes = n.reportOffload(fdbs, routes)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(offloadCheckInterval):
+		}
+	}
+}
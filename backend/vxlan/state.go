@@ -0,0 +1,92 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// defaultPort is the destination port of the kernel for VXLAN devices
+// created without one.
+const defaultPort = 8472
+
+// CurrentState implements backend.StateReader, describing the device of
+// the network, its addresses and its FDB entries.
+func (be *VXLANBackend) CurrentState(config *subnet.Config, lease *subnet.Lease) ([]string, error) {
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("flannel.%v", cfg.VNI)
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	var link netlink.Link
+	for _, l := range links {
+		if l.Attrs().Name == name {
+			link = l
+		}
+	}
+	if link == nil {
+		return nil, nil
+	}
+	vx, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return []string{fmt.Sprintf("# %v is a %v device and would be replaced", name, link.Type())}, nil
+	}
+
+	parent := fmt.Sprint(vx.VtepDevIndex)
+	if l, err := netlink.LinkByIndex(vx.VtepDevIndex); err == nil {
+		parent = l.Attrs().Name
+	}
+	desc := fmt.Sprintf("ip link add %v type vxlan id %v local %v dev %v", name, vx.VxlanId, vx.SrcAddr, parent)
+	if cfg.Port != 0 || (vx.Port != 0 && vx.Port != defaultPort) {
+		desc += fmt.Sprintf(" dstport %v", vx.Port)
+	}
+	if vx.GBP {
+		desc += " gbp"
+	}
+	if vx.TOS != 0 {
+		desc += tosArg(vx.TOS)
+	}
+	steps := []string{desc}
+
+	addrs, err := netlink.AddrList(vx, syscall.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses: %v", err)
+	}
+	for _, a := range addrs {
+		steps = append(steps, fmt.Sprintf("ip addr add %v dev %v", ip.FromIPNet(a.IPNet), name))
+	}
+
+	fdb, err := netlink.NeighList(vx.Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list FDB entries: %v", err)
+	}
+	for _, e := range fdb {
+		if e.IP != nil {
+			steps = append(steps, fmt.Sprintf("bridge fdb add %v dev %v dst %v", e.HardwareAddr, name, e.IP))
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+)
+
+func (n *network) TracePacket(p *backend.Packet) ([]string, error) {
+	r, desc, err := backend.TraceRoute(p)
+	if err != nil {
+		return nil, err
+	}
+	steps := []string{desc}
+
+	if r.LinkIndex != n.dev.link.Index {
+		return append(steps, fmt.Sprintf("not encapsulated: the route does not go through %v", n.dev.link.Name)), nil
+	}
+
+	rt := n.findRoute(p.Dst)
+	if rt == nil {
+		return append(steps, fmt.Sprintf("no lease contains %v: its L3 misses go unanswered and the packet is dropped", p.Dst)), nil
+	}
+	steps = append(steps, fmt.Sprintf("peer: subnet %v, VTEP MAC %v", rt.network, rt.vtepMAC))
+
+	nextHop := p.Dst.ToIP()
+	if r.Gw != nil {
+		nextHop = r.Gw
+	}
+	var mac net.HardwareAddr
+	neighs, err := netlink.NeighList(n.dev.link.Index, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list neighbors: %v", err)
+	}
+	for _, ne := range neighs {
+		if ne.IP.Equal(nextHop) && len(ne.HardwareAddr) > 0 {
+			mac = ne.HardwareAddr
+		}
+	}
+	switch {
+	case mac == nil:
+		steps = append(steps, fmt.Sprintf("no neighbor entry for %v: the L3 miss is answered with VTEP MAC %v", nextHop, rt.vtepMAC))
+		mac = rt.vtepMAC
+	case !bytes.Equal(mac, rt.vtepMAC):
+		steps = append(steps, fmt.Sprintf("neighbor entry: %v lladdr %v, which is NOT the VTEP MAC of the lease", nextHop, mac))
+	default:
+		steps = append(steps, fmt.Sprintf("neighbor entry: %v lladdr %v", nextHop, mac))
+	}
+
+	fdb, err := n.dev.GetL2List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list FDB entries: %v", err)
+	}
+	var vtep net.IP
+	for _, e := range fdb {
+		if bytes.Equal(e.HardwareAddr, mac) && e.IP != nil {
+			vtep = e.IP
+		}
+	}
+	if vtep == nil {
+		return append(steps, fmt.Sprintf("no FDB entry for %v: the packet is dropped", mac)), nil
+	}
+	steps = append(steps, fmt.Sprintf("FDB entry: %v dst %v", mac, vtep))
+
+	src := n.dev.link.SrcAddr
+	if src == nil {
+		src = n.ExtIface.IfaceAddr
+	}
+	port := n.dev.link.Port
+	if port == 0 {
+		port = 8472
+	}
+	return append(steps, fmt.Sprintf("outer header: %v -> %v UDP dport %v, VNI %v; the source port is hashed from the inner headers", src, vtep, port, n.dev.link.VxlanId)), nil
+}
@@ -23,6 +23,8 @@ import (
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/schema"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -65,20 +67,55 @@ func (be *VXLANBackend) Run(ctx context.Context) {
 	<-ctx.Done()
 }
 
-func (be *VXLANBackend) RegisterNetwork(ctx context.Context, network string, config *subnet.Config) (backend.Network, error) {
-	// Parse our configuration
-	cfg := struct {
-		VNI  int
-		Port int
-		GBP  bool
-	}{
+type vxlanConfig struct {
+	VNI  int
+	Port int
+	GBP  bool
+	// DSCP of the outer headers, see backend.ParseDSCP
+	DSCP string
+	// HWOffload leaves the encapsulation to a switchdev NIC, see
+	// offload.go
+	HWOffload bool
+}
+
+// tos returns the TOS option of the device for the DSCP of cfg, 1 standing
+// for inherit.
+func (cfg *vxlanConfig) tos() int {
+	dscp, _ := backend.ParseDSCP(cfg.DSCP)
+	if dscp == backend.DSCPInherit {
+		return 1
+	}
+	return dscp << 2
+}
+
+// tosArg describes the TOS option as ip link does.
+func tosArg(tos int) string {
+	if tos == 1 {
+		return " tos inherit"
+	}
+	return fmt.Sprintf(" tos %#x", tos)
+}
+
+func parseConfig(config *subnet.Config) (*vxlanConfig, error) {
+	cfg := &vxlanConfig{
 		VNI: defaultVNI,
 	}
 
-	if len(config.Backend) > 0 {
-		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
-			return nil, fmt.Errorf("error decoding VXLAN backend config: %v", err)
-		}
+	if err := schema.Decode(config.Backend, cfg, "Type"); err != nil {
+		return nil, fmt.Errorf("error decoding VXLAN backend config: %v", err)
+	}
+	if _, err := backend.ParseDSCP(cfg.DSCP); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (be *VXLANBackend) RegisterNetwork(ctx context.Context, network string, config *subnet.Config) (backend.Network, error) {
+	// Parse our configuration
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return nil, err
 	}
 
 	devAttrs := vxlanDeviceAttrs{
@@ -88,6 +125,7 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, network string, con
 		vtepAddr:  be.extIface.IfaceAddr,
 		vtepPort:  cfg.Port,
 		gbp:       cfg.GBP,
+		tos:       cfg.tos(),
 	}
 
 	dev, err := newVXLANDevice(&devAttrs)
@@ -121,7 +159,68 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, network string, con
 		return nil, err
 	}
 
-	return newNetwork(network, be.sm, be.extIface, dev, vxlanNet, l)
+	if cfg.HWOffload {
+		if err := enableTCOffload(be.extIface.Iface.Name); err != nil {
+			log.Warningf("Failed to enable TC offload, the NIC may not offload the vxlan device: %v", err)
+		}
+	}
+
+	n, err := newNetwork(network, be.sm, be.extIface, dev, vxlanNet, l)
+	if err != nil {
+		return nil, err
+	}
+	n.hwOffload = cfg.HWOffload
+	return n, nil
+}
+
+// Plan implements backend.Planner.
+func (be *VXLANBackend) Plan(config *subnet.Config, lease *subnet.Lease, peers []subnet.Lease) ([]string, error) {
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("flannel.%v", cfg.VNI)
+	link := fmt.Sprintf("ip link add %v type vxlan id %v local %v dev %v", name, cfg.VNI, be.extIface.IfaceAddr, be.extIface.Iface.Name)
+	if cfg.Port != 0 {
+		link += fmt.Sprintf(" dstport %v", cfg.Port)
+	}
+	if cfg.GBP {
+		link += " gbp"
+	}
+	if tos := cfg.tos(); tos != 0 {
+		link += tosArg(tos)
+	}
+
+	vxlanNet := ip.IP4Net{
+		IP:        lease.Subnet.IP,
+		PrefixLen: config.Network.PrefixLen,
+	}
+
+	steps := []string{
+		link,
+		fmt.Sprintf("ip addr add %v dev %v", vxlanNet, name),
+	}
+
+	for _, l := range peers {
+		if l.Attrs.BackendType != "vxlan" {
+			steps = append(steps, fmt.Sprintf("# ignoring non-vxlan subnet %v: type=%v", l.Subnet, l.Attrs.BackendType))
+			continue
+		}
+
+		var attrs vxlanLeaseAttrs
+		if err := json.Unmarshal(l.Attrs.BackendData, &attrs); err != nil {
+			steps = append(steps, fmt.Sprintf("# ignoring subnet %v: error decoding lease JSON: %v", l.Subnet, err))
+			continue
+		}
+
+		mac := net.HardwareAddr(attrs.VtepMAC)
+		steps = append(steps,
+			fmt.Sprintf("bridge fdb add %v dev %v dst %v", mac, name, l.Attrs.PublicIP),
+			fmt.Sprintf("# on L3 miss, resolve %v to %v", l.Subnet, mac))
+	}
+
+	return steps, nil
 }
 
 // So we can make it JSON (un)marshalable
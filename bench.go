@@ -0,0 +1,171 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/flannel/pkg/bench"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// apiGet decodes into v the response of the control API of the local
+// flanneld at socketPath to a GET of path.
+func apiGet(socketPath, path string, v interface{}) error {
+	c := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	resp, err := c.Get("http://flannel" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// overlayAddr returns the first address of the subnet of the peer with
+// public IP peer, as known to the local flanneld, and the MTU of the
+// network.
+func overlayAddr(socketPath, network string, peer ip.IP4) (ip.IP4, int, error) {
+	if network == "" {
+		network = "_"
+	}
+
+	var leases []subnet.Lease
+	if err := apiGet(socketPath, "/v1/networks/"+network+"/peers", &leases); err != nil {
+		return 0, 0, fmt.Errorf("failed to get the leases of the peers: %v", err)
+	}
+	var n struct {
+		MTU int
+	}
+	if err := apiGet(socketPath, "/v1/networks/"+network, &n); err != nil {
+		return 0, 0, fmt.Errorf("failed to get the network: %v", err)
+	}
+
+	for _, l := range leases {
+		if l.Attrs.PublicIP == peer {
+			return l.Subnet.IP + 1, n.MTU, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("no lease of %v, give its address in the flannel network with -overlay", peer)
+}
+
+// runBench implements the bench subcommand, which measures the throughput
+// and latency to another node running flanneld bench -listen, over the
+// flannel network and the network underneath it.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	listen := fs.Bool("listen", false, "answer the tests of other nodes until interrupted")
+	peer := fs.String("peer", "", "public IP of the node to test against")
+	overlay := fs.String("overlay", "", "address of the peer in the flannel network (default the first address of its subnet, from the control API)")
+	apiSocket := fs.String("api-socket", "/run/flannel/flannel.sock", "control API socket of the local flanneld, to look up the subnet of the peer")
+	network := fs.String("network", "", "network name in multi-network mode")
+	port := fs.Int("port", 8215, "TCP port of the tests")
+	duration := fs.Duration("duration", 10*time.Second, "duration of each throughput test")
+	count := fs.Int("count", 100, "number of messages of each latency test")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench -listen [OPTION]...\n       %s bench -peer=IP [OPTION]...\n\nMeasure the throughput and latency to another node through the flannel network, compared with those of the network underneath\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() > 0 || *listen == (*peer != "") {
+		fs.Usage()
+		return 1
+	}
+
+	if *listen {
+		// the peer connects to both our public and our overlay address
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(*port))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Listening on %v\n", l.Addr())
+		if err := bench.Serve(l); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	peerIP, err := ip.ParseIP4(*peer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -peer %q\n", *peer)
+		return 1
+	}
+	var overlayIP ip.IP4
+	mtu := 0
+	if *overlay != "" {
+		if overlayIP, err = ip.ParseIP4(*overlay); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -overlay %q\n", *overlay)
+			return 1
+		}
+	} else if overlayIP, mtu, err = overlayAddr(*apiSocket, *network, peerIP); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	type result struct {
+		throughput bench.Throughput
+		latency    bench.Latency
+	}
+	results := make([]result, 2)
+	for i, addr := range []ip.IP4{peerIP, overlayIP} {
+		hostport := net.JoinHostPort(addr.String(), strconv.Itoa(*port))
+		if results[i].latency, err = bench.MeasureLatency(hostport, *count); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to measure the latency to %v: %v\n", hostport, err)
+			return 1
+		}
+		if results[i].throughput, err = bench.MeasureThroughput(hostport, *duration); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to measure the throughput to %v: %v\n", hostport, err)
+			return 1
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tADDRESS\tTHROUGHPUT\tLATENCY")
+	fmt.Fprintf(w, "underlay\t%v\t%v\t%v\n", peerIP, results[0].throughput, results[0].latency)
+	fmt.Fprintf(w, "overlay\t%v\t%v\t%v\n", overlayIP, results[1].throughput, results[1].latency)
+	w.Flush()
+
+	fmt.Printf("\nEncapsulation overhead: %.1f%% of the throughput, %v of average latency\n",
+		bench.Overhead(results[1].throughput, results[0].throughput)*100,
+		results[1].latency.Avg-results[0].latency.Avg)
+	if mtu != 0 {
+		fmt.Printf("MTU of the flannel network: %d\n", mtu)
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build chaos
+// +build chaos
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/chaos"
+	"github.com/coreos/flannel/subnet"
+)
+
+var chaosSpec string
+
+func init() {
+	flag.StringVar(&chaosSpec, "chaos", "", "inject faults for resilience tests, e.g. drop-writes=0.1,delay-watches=5s,remove-routes=1m")
+
+	withChaos = func(sm subnet.Manager) (subnet.Manager, error) {
+		if chaosSpec == "" {
+			return sm, nil
+		}
+		cfg, err := chaos.ParseConfig(chaosSpec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --chaos: %v", err)
+		}
+
+		cm := chaos.NewManager(sm, cfg)
+		runChaos = func(ctx context.Context) {
+			cm.Run(ctx)
+		}
+		return cm, nil
+	}
+}
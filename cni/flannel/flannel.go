@@ -0,0 +1,337 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is the flannel CNI plugin. It reads the subnet file written by
+// flanneld and delegates the actual work to another plugin (bridge by
+// default) configured with the host's subnet and MTU.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/subnetenv"
+	"github.com/coreos/flannel/version"
+)
+
+const (
+	defaultSubnetFile = "/run/flannel/subnet.env"
+	defaultDataDir    = "/var/lib/cni/flannel"
+)
+
+var supportedVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0"}
+
+type netConf struct {
+	CNIVersion    string                 `json:"cniVersion,omitempty"`
+	Name          string                 `json:"name"`
+	Type          string                 `json:"type"`
+	SubnetFile    string                 `json:"subnetFile"`
+	DataDir       string                 `json:"dataDir"`
+	Delegate      map[string]interface{} `json:"delegate"`
+	RuntimeConfig map[string]interface{} `json:"runtimeConfig,omitempty"`
+	// the result of ADD, which the runtime passes to CHECK and DEL
+	PrevResult json.RawMessage `json:"prevResult,omitempty"`
+}
+
+// cniError is the error format of the CNI spec.
+type cniError struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+func (e *cniError) Error() string {
+	return e.Msg
+}
+
+func loadConf(data []byte) (*netConf, error) {
+	conf := &netConf{
+		SubnetFile: defaultSubnetFile,
+		DataDir:    defaultDataDir,
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	return conf, nil
+}
+
+func hasKey(m map[string]interface{}, k string) bool {
+	_, ok := m[k]
+	return ok
+}
+
+// checkIPRanges makes sure per-pod ipRanges stay within the host's subnet.
+func checkIPRanges(runtimeConfig map[string]interface{}, sn ip.IP4Net) error {
+	raw, ok := runtimeConfig["ipRanges"]
+	if !ok {
+		return nil
+	}
+
+	var ranges [][]struct {
+		Subnet string `json:"subnet"`
+	}
+	data, _ := json.Marshal(raw)
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return fmt.Errorf("invalid ipRanges: %v", err)
+	}
+
+	for _, set := range ranges {
+		for _, r := range set {
+			_, ipn, err := net.ParseCIDR(r.Subnet)
+			if err != nil {
+				return fmt.Errorf("invalid ipRanges subnet %q", r.Subnet)
+			}
+			n := ip.FromIPNet(ipn)
+			if n.PrefixLen < sn.PrefixLen || !sn.Contains(n.IP) {
+				return fmt.Errorf("ipRanges subnet %v is outside of the flannel subnet %v", n, sn)
+			}
+		}
+	}
+	return nil
+}
+
+// delegateConf builds the config of the delegated plugin from the subnet
+// env, filling in whatever the user did not set explicitly.
+func delegateConf(conf *netConf, env *subnetenv.Env) (map[string]interface{}, error) {
+	sn := env.Subnet.Network()
+
+	if err := checkIPRanges(conf.RuntimeConfig, sn); err != nil {
+		return nil, err
+	}
+
+	d := map[string]interface{}{}
+	for k, v := range conf.Delegate {
+		d[k] = v
+	}
+
+	if !hasKey(d, "type") {
+		d["type"] = "bridge"
+	}
+	d["name"] = conf.Name
+	if conf.CNIVersion != "" {
+		d["cniVersion"] = conf.CNIVersion
+	}
+
+	if !hasKey(d, "ipMasq") {
+		// if flannel is not doing ipmasq, we should
+		d["ipMasq"] = !env.IPMasq
+	}
+	if !hasKey(d, "mtu") && env.MTU != 0 {
+		d["mtu"] = env.MTU
+	}
+	if d["type"] == "bridge" && !hasKey(d, "isGateway") {
+		d["isGateway"] = true
+	}
+
+	d["ipam"] = map[string]interface{}{
+		"type":   "host-local",
+		"ranges": [][]map[string]string{{{"subnet": sn.String()}}},
+		"routes": []map[string]string{{"dst": env.Network.String()}},
+	}
+
+	// per-pod settings from the runtime (bandwidth, ipRanges, ...) are
+	// honoured by the delegate and its IPAM plugin
+	if len(conf.RuntimeConfig) > 0 {
+		d["runtimeConfig"] = conf.RuntimeConfig
+	}
+
+	return d, nil
+}
+
+func delegatePath(d map[string]interface{}) (string, error) {
+	t, ok := d["type"].(string)
+	if !ok || t == "" {
+		return "", fmt.Errorf("delegate has no type")
+	}
+
+	for _, dir := range filepath.SplitList(os.Getenv("CNI_PATH")) {
+		p := filepath.Join(dir, t)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find plugin %q in path %v", t, os.Getenv("CNI_PATH"))
+}
+
+// execDelegate runs the delegate with the current CNI environment, copying
+// its result to stdout.
+func execDelegate(d map[string]interface{}, stdout io.Writer) error {
+	path, err := delegatePath(d)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("delegate %v failed: %v", path, err)
+	}
+	return nil
+}
+
+func savedConfPath(conf *netConf) string {
+	return filepath.Join(conf.DataDir, os.Getenv("CNI_CONTAINERID"))
+}
+
+func loadSavedConf(conf *netConf) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(savedConfPath(conf))
+	if err != nil {
+		return nil, err
+	}
+
+	d := map[string]interface{}{}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("failed to parse saved delegate config: %v", err)
+	}
+	return d, nil
+}
+
+func cmdAdd(conf *netConf) error {
+	env, err := subnetenv.Load(conf.SubnetFile)
+	if err != nil {
+		return fmt.Errorf("failed to load flannel subnet file (is flanneld running?): %v", err)
+	}
+
+	d, err := delegateConf(conf, env)
+	if err != nil {
+		return err
+	}
+
+	// keep the delegate config around so DEL works even if the subnet
+	// file changes or disappears in the meantime
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if _, err := fileutil.WriteFileAtomic(savedConfPath(conf), data, 0600); err != nil {
+		return fmt.Errorf("failed to save delegate config: %v", err)
+	}
+
+	// buffer the result so that nothing is written on failure
+	out := &bytes.Buffer{}
+	if err := execDelegate(d, out); err != nil {
+		os.Remove(savedConfPath(conf))
+		return err
+	}
+	_, err = io.Copy(os.Stdout, out)
+	return err
+}
+
+// withRuntimeConf adds what the runtime passes to CHECK and DEL, the CNI
+// version and the result of ADD, to the saved delegate config d.
+func withRuntimeConf(conf *netConf, d map[string]interface{}) {
+	if conf.CNIVersion != "" {
+		d["cniVersion"] = conf.CNIVersion
+	}
+	delete(d, "prevResult")
+	if len(conf.PrevResult) > 0 {
+		d["prevResult"] = conf.PrevResult
+	}
+}
+
+func cmdDel(conf *netConf) error {
+	d, err := loadSavedConf(conf)
+	switch {
+	case os.IsNotExist(err):
+		// nothing was set up, or it was already deleted
+		return nil
+	case err != nil:
+		return err
+	}
+	withRuntimeConf(conf, d)
+
+	if err := execDelegate(d, ioutil.Discard); err != nil {
+		return err
+	}
+	return os.Remove(savedConfPath(conf))
+}
+
+func cmdCheck(conf *netConf) error {
+	d, err := loadSavedConf(conf)
+	if err != nil {
+		return err
+	}
+	withRuntimeConf(conf, d)
+	return execDelegate(d, ioutil.Discard)
+}
+
+func run() error {
+	switch cmd := os.Getenv("CNI_COMMAND"); cmd {
+	case "VERSION":
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"cniVersion":        supportedVersions[len(supportedVersions)-1],
+			"supportedVersions": supportedVersions,
+		})
+
+	case "ADD", "DEL", "CHECK":
+		if os.Getenv("CNI_CONTAINERID") == "" {
+			return fmt.Errorf("CNI_CONTAINERID is not set")
+		}
+
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read netconf: %v", err)
+		}
+		conf, err := loadConf(data)
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case "ADD":
+			return cmdAdd(conf)
+		case "DEL":
+			return cmdDel(conf)
+		default:
+			return cmdCheck(conf)
+		}
+
+	case "":
+		fmt.Fprintf(os.Stderr, "flannel CNI plugin %v, supported CNI versions: %v\n", version.Version, strings.Join(supportedVersions, ", "))
+		os.Exit(1)
+
+	default:
+		return fmt.Errorf("unknown CNI_COMMAND %q", cmd)
+	}
+
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		e, ok := err.(*cniError)
+		if !ok {
+			e = &cniError{Code: 100, Msg: err.Error()}
+		}
+		json.NewEncoder(os.Stdout).Encode(e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/subnetenv"
+)
+
+func testEnv(t *testing.T) *subnetenv.Env {
+	env, err := subnetenv.Parse(map[string]string{
+		"FLANNEL_NETWORK": "10.1.0.0/16",
+		"FLANNEL_SUBNET":  "10.1.5.1/24",
+		"FLANNEL_MTU":     "1450",
+		"FLANNEL_IPMASQ":  "true",
+	})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return env
+}
+
+// roundtrip normalizes d to what the delegate sees on stdin.
+func roundtrip(t *testing.T, d interface{}) map[string]interface{} {
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDelegateConfDefaults(t *testing.T) {
+	conf, err := loadConf([]byte(`{"cniVersion": "0.3.1", "name": "cbr0", "type": "flannel"}`))
+	if err != nil {
+		t.Fatalf("loadConf failed: %v", err)
+	}
+	if conf.SubnetFile != defaultSubnetFile || conf.DataDir != defaultDataDir {
+		t.Errorf("defaults not applied: %+v", conf)
+	}
+
+	d, err := delegateConf(conf, testEnv(t))
+	if err != nil {
+		t.Fatalf("delegateConf failed: %v", err)
+	}
+
+	expected := roundtrip(t, map[string]interface{}{
+		"cniVersion": "0.3.1",
+		"name":       "cbr0",
+		"type":       "bridge",
+		"ipMasq":     false,
+		"mtu":        1450,
+		"isGateway":  true,
+		"ipam": map[string]interface{}{
+			"type":   "host-local",
+			"ranges": [][]map[string]string{{{"subnet": "10.1.5.0/24"}}},
+			"routes": []map[string]string{{"dst": "10.1.0.0/16"}},
+		},
+	})
+	if got := roundtrip(t, d); !reflect.DeepEqual(got, expected) {
+		t.Errorf("delegate mismatch:\nexpected %v\ngot      %v", expected, got)
+	}
+}
+
+func TestDelegateConfOverrides(t *testing.T) {
+	conf, err := loadConf([]byte(`{
+		"name": "cbr0",
+		"delegate": {"type": "ipvlan", "mtu": 1400, "ipMasq": true},
+		"runtimeConfig": {
+			"bandwidth": {"ingressRate": 1000},
+			"ipRanges": [[{"subnet": "10.1.5.128/25"}]]
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("loadConf failed: %v", err)
+	}
+
+	d, err := delegateConf(conf, testEnv(t))
+	if err != nil {
+		t.Fatalf("delegateConf failed: %v", err)
+	}
+	got := roundtrip(t, d)
+
+	if got["type"] != "ipvlan" || got["mtu"] != 1400.0 || got["ipMasq"] != true {
+		t.Errorf("delegate settings were overridden: %v", got)
+	}
+	if _, ok := got["isGateway"]; ok {
+		t.Errorf("isGateway set for non-bridge delegate")
+	}
+	if !reflect.DeepEqual(got["runtimeConfig"], roundtrip(t, conf.RuntimeConfig)) {
+		t.Errorf("runtimeConfig not passed through: %v", got["runtimeConfig"])
+	}
+}
+
+func TestDelegateConfBadIPRanges(t *testing.T) {
+	for _, rc := range []string{
+		`{"ipRanges": [[{"subnet": "10.2.0.0/24"}]]}`,
+		`{"ipRanges": [[{"subnet": "10.1.0.0/16"}]]}`,
+		`{"ipRanges": [[{"subnet": "bogus"}]]}`,
+	} {
+		conf, err := loadConf([]byte(`{"name": "cbr0", "runtimeConfig": ` + rc + `}`))
+		if err != nil {
+			t.Fatalf("loadConf failed: %v", err)
+		}
+		if _, err := delegateConf(conf, testEnv(t)); err == nil {
+			t.Errorf("delegateConf accepted %s", rc)
+		}
+	}
+}
+
+func TestCheckPrevResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a delegate which insists on prevResult like bridge does, and keeps
+	// the config it was given
+	got := filepath.Join(dir, "got.json")
+	script := "#!/bin/sh\ncat > " + got + "\ngrep -q prevResult " + got + " || { echo '{\"code\": 7, \"msg\": \"Required prevResult missing\"}'; exit 1; }\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "fake"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CNI_PATH", dir)
+	os.Setenv("CNI_CONTAINERID", "c1")
+	defer os.Unsetenv("CNI_PATH")
+	defer os.Unsetenv("CNI_CONTAINERID")
+
+	conf, err := loadConf([]byte(`{
+		"cniVersion": "0.4.0",
+		"name": "cbr0",
+		"type": "flannel",
+		"dataDir": "` + dir + `",
+		"prevResult": {"cniVersion": "0.4.0", "ips": [{"version": "4", "address": "10.1.5.2/24"}]}
+	}`))
+	if err != nil {
+		t.Fatalf("loadConf failed: %v", err)
+	}
+	// as saved by ADD with an older version and no prevResult
+	saved := `{"cniVersion": "0.3.1", "name": "cbr0", "type": "fake"}`
+	if err := ioutil.WriteFile(savedConfPath(conf), []byte(saved), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmdCheck(conf); err != nil {
+		t.Fatalf("CHECK failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := map[string]interface{}{}
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d["cniVersion"] != "0.4.0" {
+		t.Errorf("delegate got cniVersion %v, expected 0.4.0", d["cniVersion"])
+	}
+	if !reflect.DeepEqual(d["prevResult"], roundtrip(t, conf.PrevResult)) {
+		t.Errorf("delegate got prevResult %v, expected %s", d["prevResult"], conf.PrevResult)
+	}
+
+	if err := cmdDel(conf); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	if _, err := os.Stat(savedConfPath(conf)); !os.IsNotExist(err) {
+		t.Errorf("DEL kept the saved delegate config")
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/pkg/config"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/vault"
+	"github.com/coreos/flannel/subnet"
+)
+
+var (
+	// flags set on the command line, as opposed to environment variables
+	argFlags = map[string]bool{}
+	// flags set on the command line or via environment variables
+	cmdlineFlags = map[string]bool{}
+	// flags whose value came from the config file
+	fileFlags = map[string]bool{}
+	// the [backend] section of the config file
+	fileBackend map[string]interface{}
+
+	// options which take effect on SIGHUP without a restart
+	reloadableFlags = map[string]bool{
+		"v":          true,
+		"vmodule":    true,
+		"log-levels": true,
+		"ip-masq":    true,
+	}
+
+	// options whose values are secrets themselves rather than files
+	// holding them
+	secretFlags = map[string]bool{
+		"etcd-password": true,
+	}
+)
+
+func loadConfigFile(path string) error {
+	secs, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	for name := range secs {
+		if name != "" && name != "backend" {
+			return fmt.Errorf("%v: unknown section [%v]", path, name)
+		}
+	}
+
+	if err := config.SetFlags(flag.CommandLine, secs[""]); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	for k := range secs[""] {
+		fileFlags[flagName(k)] = true
+	}
+	fileBackend = secs["backend"]
+
+	return network.SetBackendOverrides(fileBackend)
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// reloadConfigFile re-reads the config file and applies the options that
+// can be changed at runtime. Changes to any other option are logged as
+// requiring a restart. Options removed from the file revert to their
+// defaults; options given on the command line are never touched.
+func reloadConfigFile(path string) {
+	secs, err := config.Load(path)
+	if err != nil {
+		log.Errorf("Reload: failed to load config file, keeping current settings: %v", err)
+		return
+	}
+
+	values := map[string]string{}
+	for k, v := range secs[""] {
+		name := flagName(k)
+		if flag.Lookup(name) == nil {
+			log.Warningf("Reload: ignoring unknown option %q", k)
+			continue
+		}
+		values[name] = config.ToString(v)
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if cmdlineFlags[f.Name] {
+			return
+		}
+
+		want, ok := values[f.Name]
+		if !ok {
+			if !fileFlags[f.Name] {
+				return
+			}
+			want = f.DefValue
+		}
+
+		if want == f.Value.String() || want == secretRefs[f.Name] {
+			return
+		}
+
+		if !reloadableFlags[f.Name] {
+			log.Warningf("Reload: %v changed to %q; restart flanneld for it to take effect", f.Name, want)
+			return
+		}
+
+		if err := f.Value.Set(want); err != nil {
+			log.Errorf("Reload: invalid value %q for %v: %v", want, f.Name, err)
+			return
+		}
+		log.Infof("Reload: %v set to %q", f.Name, want)
+	})
+
+	fileFlags = map[string]bool{}
+	for name := range values {
+		fileFlags[name] = true
+	}
+
+	if !reflect.DeepEqual(secs["backend"], fileBackend) {
+		log.Warning("Reload: [backend] options changed; restart flanneld for them to take effect")
+	}
+}
+
+// flagSource tells where the value of a flag came from, from the highest
+// precedence down.
+func flagSource(name string) string {
+	switch {
+	case argFlags[name]:
+		return "command line"
+	case cmdlineFlags[name]:
+		return "environment FLANNELD_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	case fileFlags[name]:
+		return "config file"
+	case footprintFlags[name]:
+		return "--low-footprint"
+	}
+	return "default"
+}
+
+// redact hides the secrets in the value of a flag: the values of
+// secretFlags and the passwords of URLs. Vault references are shown as
+// given instead of the file written for them.
+func redact(name, value string) string {
+	if ref, ok := secretRefs[name]; ok {
+		return ref
+	}
+	if vault.IsRef(value) {
+		return value
+	}
+	if secretFlags[name] && value != "" {
+		return "REDACTED"
+	}
+
+	parts := strings.Split(value, ",")
+	for i, p := range parts {
+		if u, err := url.Parse(p); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				redacted := *u
+				redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+				parts[i] = redacted.String()
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// printConfig prints what `flanneld config` shows: every option with its
+// value and where it came from, the [backend] options of the config file
+// and the config of each network as flanneld would use it.
+func printConfig(w io.Writer, sm subnet.Manager) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPTION\tVALUE\tSOURCE")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", f.Name, redact(f.Name, f.Value.String()), flagSource(f.Name))
+	})
+
+	keys := []string{}
+	for k := range fileBackend {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(tw, "[backend] %v\t%v\tconfig file\n", k, config.ToString(fileBackend[k]))
+	}
+	tw.Flush()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dryRunTimeout)
+	defer cancel()
+
+	configs, err := network.NetworkConfigs(ctx, sm)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data, err := json.MarshalIndent(configs[name], "", "  ")
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			fmt.Fprintf(w, "\nNetwork config (registry, with the [backend] options):\n%s\n", data)
+		} else {
+			fmt.Fprintf(w, "\nConfig of network %v (registry, with the [backend] options):\n%s\n", name, data)
+		}
+	}
+	return nil
+}
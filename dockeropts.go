@@ -0,0 +1,123 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/subnetenv"
+)
+
+// dockerOpts returns the docker daemon options, keyed by their individual
+// variable name, derived from the flannel subnet env.
+func dockerOpts(env map[string]string, ipMasq bool) (map[string]string, error) {
+	dopts := make(map[string]string)
+
+	if sn := env["FLANNEL_SUBNET"]; sn != "" {
+		dopts["DOCKER_OPT_BIP"] = "--bip=" + sn
+	}
+
+	if mtu := env["FLANNEL_MTU"]; mtu != "" {
+		dopts["DOCKER_OPT_MTU"] = "--mtu=" + mtu
+	}
+
+	if masq := env["FLANNEL_IPMASQ"]; masq != "" && ipMasq {
+		// docker must not masquerade if flannel does
+		switch masq {
+		case "true":
+			dopts["DOCKER_OPT_IPMASQ"] = "--ip-masq=false"
+		case "false":
+			dopts["DOCKER_OPT_IPMASQ"] = "--ip-masq=true"
+		default:
+			return nil, fmt.Errorf("invalid value of FLANNEL_IPMASQ: %v", masq)
+		}
+	}
+
+	return dopts, nil
+}
+
+// runDockerOpts implements the docker-opts subcommand, a replacement for
+// dist/mk-docker-opts.sh accepting the same options.
+func runDockerOpts(args []string) int {
+	fs := flag.NewFlagSet("docker-opts", flag.ContinueOnError)
+	flannelEnv := fs.String("f", "/run/flannel/subnet.env", "path to flannel env file")
+	dockerEnv := fs.String("d", "/run/docker_opts.env", "path to Docker env file to write to")
+	indiv := fs.Bool("i", false, "output each Docker option as individual var, e.g. DOCKER_OPT_MTU=1500")
+	combined := fs.Bool("c", false, "output combined Docker options into DOCKER_OPTS var")
+	key := fs.String("k", "DOCKER_OPTS", "set the combined options key to this value")
+	noIPMasq := fs.Bool("m", false, "do not output --ip-masq (useful for older Docker version)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s docker-opts [OPTION]...\n\nGenerate Docker daemon options based on flannel env file\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 1
+	}
+
+	if !*indiv && !*combined {
+		*indiv = true
+		*combined = true
+	}
+
+	env, err := subnetenv.ReadFile(*flannelEnv)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	dopts, err := dockerOpts(env, !*noIPMasq)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// options already set in our environment are kept in the combined var
+	all := []string{}
+	if existing := os.Getenv(*key); existing != "" {
+		all = append(all, existing)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, name := range []string{"DOCKER_OPT_BIP", "DOCKER_OPT_IPMASQ", "DOCKER_OPT_MTU"} {
+		v, ok := dopts[name]
+		if !ok {
+			continue
+		}
+		if *indiv {
+			fmt.Fprintf(buf, "%v=%q\n", name, v)
+		}
+		all = append(all, v)
+	}
+	if *combined {
+		fmt.Fprintf(buf, "%v=%q\n", *key, strings.Join(all, " "))
+	}
+
+	if _, err := fileutil.WriteFileAtomic(*dockerEnv, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write %v: %v\n", *dockerEnv, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,631 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package e2e simulates a flannel cluster on a single host to test the
+// dataplane end to end: each node is a network namespace running flanneld
+// against an in-memory registry served by a flannel server, the namespaces
+// are connected by a bridge as if they were hosts on a LAN, and the nodes
+// connect to the gateway addresses of each other's subnets through the
+// overlay.
+//
+// It requires root and ip(8) from iproute2. The namespaces, the bridge and
+// the veth devices are named after Config.Prefix and removed by Close, and
+// also by the next Start with the same prefix should a run not get to it.
+package e2e
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/subnetenv"
+	"github.com/coreos/flannel/remote"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/subnet/subnettest"
+)
+
+// Backends are the backends which can be simulated, those not requiring a
+// cloud provider.
+var Backends = []string{"udp", "vxlan", "host-gw"}
+
+// probePort is the port on the gateway address of each node which answers
+// connections with the name of the node.
+const probePort = 8214
+
+// Config describes a simulated cluster.
+type Config struct {
+	// Flanneld is the path of the flanneld binary run on the nodes
+	Flanneld string
+	// Nodes is the number of nodes
+	Nodes int
+	// Backend is the backend type of the network
+	Backend string
+	// BackendConfig holds more options of the backend as JSON object
+	// members, as in `"Port": 8285`
+	BackendConfig string
+	// NetworkConfig holds more options of the network config, as
+	// BackendConfig
+	NetworkConfig string
+	// Network is the flannel network, 10.42.0.0/16 by default
+	Network string
+	// Underlay is the network of the bridge connecting the nodes,
+	// 192.168.213.0/24 by default. The bridge gets its last address and
+	// the nodes the ones from the first.
+	Underlay string
+	// MTU is that of the devices of the nodes on the bridge, 1500 by
+	// default
+	MTU int
+	// ServerPort is the port of the flannel server on the bridge, 8213 by
+	// default
+	ServerPort int
+	// Prefix names the namespaces and devices, "flsim" by default
+	Prefix string
+	// Dir holds the subnet files and logs of the nodes, a temporary
+	// directory removed by Close by default
+	Dir string
+	// Args are additional flanneld options
+	Args []string
+}
+
+// Node is a simulated node.
+type Node struct {
+	// Name is also the name of its network namespace
+	Name string
+	// PublicIP is its address on the bridge
+	PublicIP ip.IP4
+	// Dir holds its subnet file and log
+	Dir string
+
+	index int
+	cmd   *exec.Cmd
+	done  chan error
+	gw    ip.IP4
+	probe net.Listener
+}
+
+// LogFile returns the path of the log of the flanneld of the node.
+func (n *Node) LogFile() string {
+	return filepath.Join(n.Dir, "flanneld.log")
+}
+
+// Gateway returns the gateway address of the node's subnet, the first one
+// of the lease, which the node has on its loopback device to stand for its
+// pods.
+func (n *Node) Gateway() (ip.IP4, error) {
+	env, err := subnetenv.ReadFile(filepath.Join(n.Dir, "subnet.env"))
+	if err != nil {
+		return 0, err
+	}
+	gw, _, err := net.ParseCIDR(env["FLANNEL_SUBNET"])
+	if err != nil || gw.To4() == nil {
+		return 0, fmt.Errorf("invalid FLANNEL_SUBNET %q", env["FLANNEL_SUBNET"])
+	}
+	return ip.FromIP(gw), nil
+}
+
+// inNetns runs f in the network namespace of n. The sockets f creates stay
+// in it.
+func (n *Node) inNetns(f func() error) error {
+	runtime.LockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get the current network namespace: %v", err)
+	}
+	defer orig.Close()
+
+	ns, err := netns.GetFromName(n.Name)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open the network namespace of %v: %v", n.Name, err)
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter the network namespace of %v: %v", n.Name, err)
+	}
+	err = f()
+	// a thread which cannot return stays locked, and so is never reused
+	if netns.Set(orig) == nil {
+		runtime.UnlockOSThread()
+	}
+	return err
+}
+
+// listenProbe answers the connections to the gateway address of n with its
+// name.
+func (n *Node) listenProbe(gw ip.IP4) error {
+	err := n.inNetns(func() error {
+		var err error
+		n.probe, err = net.Listen("tcp", fmt.Sprintf("%v:%d", gw, probePort))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", n.Name, err)
+	}
+
+	go func() {
+		for {
+			conn, err := n.probe.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, n.Name)
+			conn.Close()
+		}
+	}()
+	return nil
+}
+
+// Cluster is a running simulated cluster.
+type Cluster struct {
+	Nodes []*Node
+
+	cfg        Config
+	sm         *subnettest.Manager
+	cancel     context.CancelFunc
+	server     chan struct{}
+	serverAddr string
+	bridge     string
+	prefixLen  int
+	ownedDir   bool
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Network == "" {
+		cfg.Network = "10.42.0.0/16"
+	}
+	if cfg.Underlay == "" {
+		cfg.Underlay = "192.168.213.0/24"
+	}
+	if cfg.MTU == 0 {
+		cfg.MTU = 1500
+	}
+	if cfg.ServerPort == 0 {
+		cfg.ServerPort = 8213
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "flsim"
+	}
+}
+
+// underlayAddrs returns the address of the bridge and those of the nodes
+// with the prefix length of the underlay network.
+func underlayAddrs(underlay string, nodes int) (ip.IP4, []ip.IP4, int, error) {
+	_, n, err := net.ParseCIDR(underlay)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("invalid underlay network %q: %v", underlay, err)
+	}
+	pn := ip.FromIPNet(n)
+	// the network and broadcast addresses are not usable
+	if uint32(nodes)+3 > 1<<(32-pn.PrefixLen) {
+		return 0, nil, 0, fmt.Errorf("underlay network %v is too small for %d nodes", pn, nodes)
+	}
+
+	addrs := make([]ip.IP4, nodes)
+	for i := range addrs {
+		addrs[i] = pn.IP + ip.IP4(i+1)
+	}
+	return pn.Next().IP - 2, addrs, int(pn.PrefixLen), nil
+}
+
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run ip %v: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// cleanup removes the veth devices, the namespaces and the bridge of prefix
+// left behind.
+func cleanup(prefix string) {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, prefix+"-v") {
+			runIP("link", "delete", iface.Name)
+		}
+	}
+
+	out, _ := exec.Command("ip", "netns", "list").Output()
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) > 0 && strings.HasPrefix(f[0], prefix+"-") {
+			runIP("netns", "delete", f[0])
+		}
+	}
+	if _, err := net.InterfaceByName(prefix + "-br"); err == nil {
+		runIP("link", "delete", prefix+"-br")
+	}
+}
+
+// Start sets up the namespaces and the bridge, starts the flannel server
+// and runs flanneld on every node. It does not wait for the nodes to get
+// their leases, see WaitForLeases.
+func Start(cfg Config) (*Cluster, error) {
+	cfg.setDefaults()
+	if cfg.Nodes < 2 {
+		return nil, fmt.Errorf("a cluster needs at least 2 nodes")
+	}
+	if cfg.Flanneld == "" {
+		return nil, fmt.Errorf("no flanneld binary given")
+	}
+	brAddr, addrs, prefixLen, err := underlayAddrs(cfg.Underlay, cfg.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		cfg:        cfg,
+		bridge:     cfg.Prefix + "-br",
+		prefixLen:  prefixLen,
+		server:     make(chan struct{}),
+		serverAddr: fmt.Sprintf("%v:%d", brAddr, cfg.ServerPort),
+	}
+	if c.cfg.Dir == "" {
+		if c.cfg.Dir, err = ioutil.TempDir("", cfg.Prefix); err != nil {
+			return nil, err
+		}
+		c.ownedDir = true
+	}
+
+	cleanup(cfg.Prefix)
+	if err := c.setupBridge(brAddr, prefixLen); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	be := fmt.Sprintf(`"Type": %q`, cfg.Backend)
+	if cfg.BackendConfig != "" {
+		be += ", " + cfg.BackendConfig
+	}
+	config := fmt.Sprintf(`{ "Network": %q, "Backend": { %v } }`, cfg.Network, be)
+	if cfg.NetworkConfig != "" {
+		config = fmt.Sprintf(`{ "Network": %q, %v, "Backend": { %v } }`, cfg.Network, cfg.NetworkConfig, be)
+	}
+	c.sm = subnettest.NewManager("", config)
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go func() {
+		remote.RunServer(ctx, c.sm, c.serverAddr, remote.ServerConfig{})
+		close(c.server)
+	}()
+	if err := waitForServer(c.serverAddr, c.server); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if _, err := c.addNode(addr); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// AddNode adds a node with the next address of the underlay network to the
+// running cluster and starts its flanneld, see WaitForLeases.
+func (c *Cluster) AddNode() (*Node, error) {
+	_, addrs, _, err := underlayAddrs(c.cfg.Underlay, len(c.Nodes)+1)
+	if err != nil {
+		return nil, err
+	}
+	return c.addNode(addrs[len(addrs)-1])
+}
+
+func (c *Cluster) addNode(addr ip.IP4) (*Node, error) {
+	i := len(c.Nodes) + 1
+	n := &Node{
+		Name:     fmt.Sprintf("%v-node%d", c.cfg.Prefix, i),
+		PublicIP: addr,
+		Dir:      filepath.Join(c.cfg.Dir, fmt.Sprintf("node%d", i)),
+		index:    i,
+	}
+	c.Nodes = append(c.Nodes, n)
+
+	if err := c.setupNode(n); err != nil {
+		return nil, err
+	}
+	if err := c.StartFlanneld(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Registry returns the registry served to the nodes, to change the leases
+// behind their backs.
+func (c *Cluster) Registry() *subnettest.Manager {
+	return c.sm
+}
+
+// Lease returns the lease of n in the registry, nil if it has none.
+func (c *Cluster) Lease(n *Node) (*subnet.Lease, error) {
+	res, err := c.sm.WatchLeases(context.Background(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range res.Snapshot {
+		if l.Attrs.PublicIP == n.PublicIP {
+			return &l, nil
+		}
+	}
+	return nil, nil
+}
+
+// SetPublicIP replaces the address of n on the bridge, as if the host had
+// been given another one.
+func (c *Cluster) SetPublicIP(n *Node, addr ip.IP4) error {
+	// removing the primary address would also remove one added next to it
+	if err := runIP("-n", n.Name, "addr", "del", fmt.Sprintf("%v/%d", n.PublicIP, c.prefixLen), "dev", "eth0"); err != nil {
+		return err
+	}
+	if err := runIP("-n", n.Name, "addr", "add", fmt.Sprintf("%v/%d", addr, c.prefixLen), "dev", "eth0"); err != nil {
+		return err
+	}
+	n.PublicIP = addr
+	return nil
+}
+
+func (c *Cluster) setupBridge(addr ip.IP4, prefixLen int) error {
+	for _, args := range [][]string{
+		{"link", "add", c.bridge, "type", "bridge"},
+		{"addr", "add", fmt.Sprintf("%v/%d", addr, prefixLen), "dev", c.bridge},
+		{"link", "set", c.bridge, "up"},
+	} {
+		if err := runIP(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupNode creates the namespace of n connected to the bridge by a veth
+// pair, whose end in the namespace is eth0.
+func (c *Cluster) setupNode(n *Node) error {
+	if err := os.MkdirAll(n.Dir, 0755); err != nil {
+		return err
+	}
+
+	veth := fmt.Sprintf("%v-v%d", c.cfg.Prefix, n.index)
+	for _, args := range [][]string{
+		{"netns", "add", n.Name},
+		{"link", "add", veth, "type", "veth", "peer", "name", veth + "p"},
+		{"link", "set", veth, "master", c.bridge, "up"},
+		{"link", "set", veth + "p", "netns", n.Name},
+		{"-n", n.Name, "link", "set", veth + "p", "name", "eth0"},
+		{"-n", n.Name, "addr", "add", fmt.Sprintf("%v/%d", n.PublicIP, c.prefixLen), "dev", "eth0"},
+		{"-n", n.Name, "link", "set", "eth0", "mtu", strconv.Itoa(c.cfg.MTU), "up"},
+		{"-n", n.Name, "link", "set", "lo", "up"},
+	} {
+		if err := runIP(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartFlanneld starts the flanneld of n, which must not be running. Its
+// subnet file is removed first so that WaitForLeases waits for the new one.
+func (c *Cluster) StartFlanneld(n *Node) error {
+	logf, err := os.OpenFile(n.LogFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logf.Close()
+	os.Remove(filepath.Join(n.Dir, "subnet.env"))
+
+	args := append([]string{
+		"--netns=/var/run/netns/" + n.Name,
+		"--remote=" + c.serverAddr,
+		"--iface=eth0",
+		"--subnet-file=" + filepath.Join(n.Dir, "subnet.env"),
+		"--subnet-dir=" + filepath.Join(n.Dir, "networks"),
+		"--lock-file=" + filepath.Join(n.Dir, "flanneld.lock"),
+		"--checkpoint-dir=" + n.Dir,
+	}, c.cfg.Args...)
+	n.cmd = exec.Command(c.cfg.Flanneld, args...)
+	n.cmd.Stdout = logf
+	n.cmd.Stderr = logf
+	if err := n.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start flanneld on %v: %v", n.Name, err)
+	}
+
+	n.done = make(chan error, 1)
+	go func() {
+		n.done <- n.cmd.Wait()
+	}()
+	return nil
+}
+
+// StopFlanneld sends sig to the flanneld of n and waits for it to exit,
+// killing it after 10s. SIGKILL leaves the dataplane in place.
+func (c *Cluster) StopFlanneld(n *Node, sig os.Signal) error {
+	if n.cmd == nil || n.cmd.Process == nil {
+		return nil
+	}
+	// --netns re-executes flanneld in its place
+	n.cmd.Process.Signal(sig)
+	select {
+	case <-n.done:
+	case <-time.After(10 * time.Second):
+		n.cmd.Process.Kill()
+		<-n.done
+	}
+	n.cmd = nil
+	return nil
+}
+
+func waitForServer(addr string, done chan struct{}) error {
+	for i := 0; i < 50; i++ {
+		select {
+		case <-done:
+			return fmt.Errorf("the flannel server on %v exited", addr)
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for the flannel server on %v", addr)
+}
+
+// WaitForLeases waits for every node to have a lease and to have written
+// its subnet file for it, then puts the gateway address of its subnet on
+// its loopback device to stand for its pods. It can be called again once
+// the leases change.
+func (c *Cluster) WaitForLeases(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, n := range c.Nodes {
+		var gw ip.IP4
+		for {
+			select {
+			case err := <-n.done:
+				n.done <- err
+				return fmt.Errorf("flanneld on %v exited: %v, see %v", n.Name, err, n.LogFile())
+			default:
+			}
+
+			// the subnet file may still be that of a previous lease
+			l, err := c.Lease(n)
+			if err != nil {
+				return err
+			}
+			if gw, err = n.Gateway(); err == nil && l != nil && gw == l.Subnet.IP+1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for the lease of %v, see %v", n.Name, n.LogFile())
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		if gw == n.gw {
+			continue
+		}
+
+		if n.probe != nil {
+			n.probe.Close()
+			runIP("-n", n.Name, "addr", "del", n.gw.String()+"/32", "dev", "lo")
+		}
+		if err := runIP("-n", n.Name, "addr", "add", gw.String()+"/32", "dev", "lo"); err != nil {
+			return err
+		}
+		if err := n.listenProbe(gw); err != nil {
+			return err
+		}
+		n.gw = gw
+	}
+	return nil
+}
+
+// Probe connects from the gateway address of the subnet of from to that of
+// to and checks that to answers.
+func (c *Cluster) Probe(from, to *Node) error {
+	src, err := from.Gateway()
+	if err != nil {
+		return err
+	}
+	dst, err := to.Gateway()
+	if err != nil {
+		return err
+	}
+
+	var conn net.Conn
+	err = from.inNetns(func() error {
+		d := net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: src.ToIP()},
+			Timeout:   time.Second,
+		}
+		var err error
+		conn, err = d.Dial("tcp", fmt.Sprintf("%v:%d", dst, probePort))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%v (%v) cannot reach %v (%v): %v", from.Name, src, to.Name, dst, err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("%v (%v) got no answer from %v (%v): %v", from.Name, src, to.Name, dst, err)
+	}
+	if name := strings.TrimSpace(string(answer)); name != to.Name {
+		return fmt.Errorf("%v (%v) reached %q instead of %v (%v)", from.Name, src, name, to.Name, dst)
+	}
+	return nil
+}
+
+// CheckConnectivity checks that every node reaches every other one through
+// the overlay, retrying each pair until timeout as the routes of the peers
+// appear once flanneld has seen their leases.
+func (c *Cluster) CheckConnectivity(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, from := range c.Nodes {
+		for _, to := range c.Nodes {
+			if from == to {
+				continue
+			}
+			for {
+				err := c.Probe(from, to)
+				if err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					return err
+				}
+				time.Sleep(500 * time.Millisecond)
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the flanneld of the nodes and the server and removes the
+// namespaces, the bridge and the directory of the nodes unless it was given.
+func (c *Cluster) Close() error {
+	for _, n := range c.Nodes {
+		if n.probe != nil {
+			n.probe.Close()
+		}
+		c.StopFlanneld(n, syscall.SIGTERM)
+	}
+
+	if c.cancel != nil {
+		c.cancel()
+		<-c.server
+	}
+
+	cleanup(c.cfg.Prefix)
+	if c.ownedDir {
+		return os.RemoveAll(c.cfg.Dir)
+	}
+	return nil
+}
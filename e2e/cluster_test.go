@@ -0,0 +1,126 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+func TestUnderlayAddrs(t *testing.T) {
+	br, addrs, prefixLen, err := underlayAddrs("192.168.213.0/24", 3)
+	if err != nil {
+		t.Fatalf("underlayAddrs failed: %v", err)
+	}
+	if br != ip.MustParseIP4("192.168.213.254") || prefixLen != 24 {
+		t.Errorf("expected the bridge at 192.168.213.254/24, got %v/%d", br, prefixLen)
+	}
+	for i, a := range []string{"192.168.213.1", "192.168.213.2", "192.168.213.3"} {
+		if addrs[i] != ip.MustParseIP4(a) {
+			t.Errorf("expected node %d at %v, got %v", i+1, a, addrs[i])
+		}
+	}
+
+	if _, _, _, err := underlayAddrs("192.168.213.0/30", 2); err == nil {
+		t.Error("underlayAddrs did not fail for a network too small")
+	}
+}
+
+// testCluster runs a cluster of cfg and checks it with check, showing the
+// logs of the nodes on failure.
+func testCluster(t *testing.T, cfg Config, check func(c *Cluster) error) {
+	c, err := Start(cfg)
+	if err != nil {
+		t.Errorf("%v: failed to start the cluster: %v", cfg.Backend, err)
+		return
+	}
+	defer c.Close()
+
+	if err := check(c); err != nil {
+		for _, n := range c.Nodes {
+			if l, err := ioutil.ReadFile(n.LogFile()); err == nil {
+				t.Logf("%v: flanneld on %v:\n%s", cfg.Backend, n.Name, l)
+			}
+		}
+		t.Errorf("%v: %v", cfg.Backend, err)
+	}
+}
+
+// TestBackends runs a cluster of every backend which can be simulated and
+// checks that the nodes reach each other. It requires root and the flanneld
+// binary to test, e.g.:
+//
+//	make dist/flanneld
+//	sudo FLANNEL_E2E_FLANNELD=$PWD/dist/flanneld go test ./e2e
+func TestBackends(t *testing.T) {
+	flanneld := os.Getenv("FLANNEL_E2E_FLANNELD")
+	if flanneld == "" || os.Geteuid() != 0 {
+		t.Skip("requires root and FLANNEL_E2E_FLANNELD set to the flanneld binary")
+	}
+	// the logs of the nodes are shown on failure, those of the server
+	// only hide them
+	log.SetLogger(log.NewTextLogger(ioutil.Discard, nil))
+
+	for _, be := range Backends {
+		testCluster(t, Config{Flanneld: flanneld, Nodes: 3, Backend: be}, func(c *Cluster) error {
+			err := c.WaitForLeases(30 * time.Second)
+			if err == nil {
+				err = c.CheckConnectivity(30 * time.Second)
+			}
+			return err
+		})
+	}
+}
+
+// TestResilience runs a cluster of every backend with faults injected into
+// the registry and the dataplane, and checks that the nodes keep reaching
+// each other, or do again soon. It requires root and flanneld built with
+// the chaos tag, e.g.:
+//
+//	make dist/flanneld-chaos
+//	sudo FLANNEL_E2E_CHAOS_FLANNELD=$PWD/dist/flanneld-chaos go test -run Resilience ./e2e
+func TestResilience(t *testing.T) {
+	flanneld := os.Getenv("FLANNEL_E2E_CHAOS_FLANNELD")
+	if flanneld == "" || os.Geteuid() != 0 {
+		t.Skip("requires root and FLANNEL_E2E_CHAOS_FLANNELD set to a flanneld built with the chaos tag")
+	}
+	log.SetLogger(log.NewTextLogger(ioutil.Discard, nil))
+
+	args := []string{
+		// the entries of a peer are removed less often than it takes
+		// to notice that it is unreachable
+		"--chaos=drop-writes=0.3,delay-watches=1s,remove-routes=10s",
+		// restore the dataplane of the peers which stop answering
+		"--peer-probe-interval=1s",
+		"--peer-probe-repair",
+	}
+	for _, be := range Backends {
+		testCluster(t, Config{Flanneld: flanneld, Nodes: 3, Backend: be, Args: args}, func(c *Cluster) error {
+			err := c.WaitForLeases(time.Minute)
+			// the faults keep coming, check a few times that the
+			// cluster recovers from them
+			for end := time.Now().Add(30 * time.Second); err == nil && time.Now().Before(end); {
+				err = c.CheckConnectivity(30 * time.Second)
+				time.Sleep(time.Second)
+			}
+			return err
+		})
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// ctl is what the commands operate on.
+type ctl struct {
+	ctx     context.Context
+	sm      subnet.Manager
+	network string
+	json    bool
+	out     io.Writer
+}
+
+type command struct {
+	name    string
+	args    string
+	help    string
+	minArgs int
+	maxArgs int
+	run     func(c *ctl, args []string) error
+}
+
+var commands = []command{
+	{"networks", "", "list the networks (multi-network mode)", 0, 0, (*ctl).networks},
+	{"config", "", "print the network config", 0, 0, (*ctl).config},
+	{"leases", "", "list the leases", 0, 0, (*ctl).leases},
+	{"owner", "SUBNET|IP", "show the lease containing a subnet or address", 1, 1, (*ctl).owner},
+	{"revoke", "SUBNET", "revoke the lease of a subnet", 1, 1, (*ctl).revoke},
+	{"reservations", "", "list the reservations", 0, 0, (*ctl).reservations},
+	{"reserve", "SUBNET PUBLIC-IP", "reserve a subnet for the host with the public IP", 2, 2, (*ctl).reserve},
+	{"unreserve", "SUBNET", "remove the reservation of a subnet", 1, 1, (*ctl).unreserve},
+	{"export", "[FILE]", "save the configs and leases of all networks", 0, 1, (*ctl).export},
+	{"import", "FILE", "restore an export into an empty registry", 1, 1, (*ctl).importState},
+	{"capacity", "[KEY=VALUE]...", "simulate the allocation of subnets to tell when the pool runs out", 0, 9, (*ctl).capacity},
+}
+
+func findCommand(name string, args []string) (*command, error) {
+	for i := range commands {
+		c := &commands[i]
+		if c.name != name {
+			continue
+		}
+		if len(args) < c.minArgs || len(args) > c.maxArgs {
+			return nil, fmt.Errorf("usage: %v %v", c.name, c.args)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", name)
+}
+
+// parseSubnet accepts CIDR notation as well as the form of the registry
+// keys, e.g. 10.1.74.0-24.
+func parseSubnet(s string) (ip.IP4Net, error) {
+	if sn := subnet.ParseSubnetKey(s); sn != nil {
+		return *sn, nil
+	}
+	_, ipn, err := net.ParseCIDR(s)
+	if err != nil || ipn.IP.To4() == nil {
+		return ip.IP4Net{}, fmt.Errorf("invalid subnet %q", s)
+	}
+	return ip.FromIPNet(ipn), nil
+}
+
+func (c *ctl) printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%s\n", data)
+	return err
+}
+
+func (c *ctl) table(header string, rows [][]string) error {
+	tw := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (c *ctl) networks(args []string) error {
+	res, err := c.sm.WatchNetworks(c.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	sort.Strings(res.Snapshot)
+	if c.json {
+		return c.printJSON(res.Snapshot)
+	}
+	for _, n := range res.Snapshot {
+		fmt.Fprintln(c.out, n)
+	}
+	return nil
+}
+
+func (c *ctl) config(args []string) error {
+	cfg, err := c.sm.GetNetworkConfig(c.ctx, c.network)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve network config: %v", err)
+	}
+	return c.printJSON(cfg)
+}
+
+func (c *ctl) listLeases() ([]subnet.Lease, error) {
+	res, err := c.sm.WatchLeases(c.ctx, c.network, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leases: %v", err)
+	}
+
+	leases := res.Snapshot
+	sort.Sort(byNetwork(leases))
+	return leases, nil
+}
+
+type byNetwork []subnet.Lease
+
+func (l byNetwork) Len() int           { return len(l) }
+func (l byNetwork) Less(i, j int) bool { return l[i].Subnet.IP < l[j].Subnet.IP }
+func (l byNetwork) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func expiration(l *subnet.Lease) string {
+	if l.Expiration.IsZero() {
+		return "never"
+	}
+	return l.Expiration.Format(time.RFC3339)
+}
+
+// flanneldVersion tells the version of the flanneld holding the lease, which
+// older ones do not record.
+func flanneldVersion(l *subnet.Lease) string {
+	if l.Attrs.Build == nil {
+		return "unknown"
+	}
+	if l.Attrs.Build.GitSHA != "" {
+		return fmt.Sprintf("%v (%v)", l.Attrs.Build.Version, l.Attrs.Build.GitSHA)
+	}
+	return l.Attrs.Build.Version
+}
+
+func (c *ctl) printLeases(leases []subnet.Lease) error {
+	if c.json {
+		return c.printJSON(leases)
+	}
+
+	rows := [][]string{}
+	for i := range leases {
+		l := &leases[i]
+		rows = append(rows, []string{l.Subnet.String(), l.Attrs.PublicIP.String(), l.Attrs.BackendType, expiration(l), flanneldVersion(l)})
+	}
+	return c.table("SUBNET\tPUBLIC IP\tBACKEND\tEXPIRES\tVERSION", rows)
+}
+
+func (c *ctl) leases(args []string) error {
+	leases, err := c.listLeases()
+	if err != nil {
+		return err
+	}
+	return c.printLeases(leases)
+}
+
+// findOwner returns the lease containing the subnet or address in arg.
+func findOwner(leases []subnet.Lease, arg string) (*subnet.Lease, error) {
+	var contains func(l *subnet.Lease) bool
+	if addr := net.ParseIP(arg); addr != nil && addr.To4() != nil {
+		contains = func(l *subnet.Lease) bool { return l.Subnet.Contains(ip.FromIP(addr)) }
+	} else {
+		sn, err := parseSubnet(arg)
+		if err != nil {
+			return nil, err
+		}
+		contains = func(l *subnet.Lease) bool {
+			return l.Subnet.Contains(sn.IP) && l.Subnet.PrefixLen <= sn.PrefixLen
+		}
+	}
+
+	for i := range leases {
+		if contains(&leases[i]) {
+			return &leases[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no lease contains %v", arg)
+}
+
+func (c *ctl) owner(args []string) error {
+	leases, err := c.listLeases()
+	if err != nil {
+		return err
+	}
+
+	l, err := findOwner(leases, args[0])
+	if err != nil {
+		return err
+	}
+	return c.printLeases([]subnet.Lease{*l})
+}
+
+func (c *ctl) revoke(args []string) error {
+	sn, err := parseSubnet(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.sm.RevokeLease(c.ctx, c.network, sn); err != nil {
+		return fmt.Errorf("failed to revoke lease %v: %v", sn, err)
+	}
+	fmt.Fprintf(c.out, "Revoked lease %v\n", sn)
+	return nil
+}
+
+func (c *ctl) reservations(args []string) error {
+	rs, err := c.sm.ListReservations(c.ctx, c.network)
+	if err != nil {
+		return fmt.Errorf("failed to list reservations: %v", err)
+	}
+
+	if c.json {
+		return c.printJSON(rs)
+	}
+	rows := [][]string{}
+	for _, r := range rs {
+		rows = append(rows, []string{r.Subnet.String(), r.PublicIP.String()})
+	}
+	return c.table("SUBNET\tPUBLIC IP", rows)
+}
+
+func (c *ctl) reserve(args []string) error {
+	sn, err := parseSubnet(args[0])
+	if err != nil {
+		return err
+	}
+
+	addr := net.ParseIP(args[1])
+	if addr == nil || addr.To4() == nil {
+		return fmt.Errorf("invalid public IP %q", args[1])
+	}
+
+	r := &subnet.Reservation{Subnet: sn, PublicIP: ip.FromIP(addr)}
+	if err := c.sm.AddReservation(c.ctx, c.network, r); err != nil {
+		return fmt.Errorf("failed to reserve %v: %v", sn, err)
+	}
+	fmt.Fprintf(c.out, "Reserved %v for %v\n", sn, r.PublicIP)
+	return nil
+}
+
+func (c *ctl) unreserve(args []string) error {
+	sn, err := parseSubnet(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.sm.RemoveReservation(c.ctx, c.network, sn); err != nil {
+		return fmt.Errorf("failed to remove reservation %v: %v", sn, err)
+	}
+	fmt.Fprintf(c.out, "Removed reservation %v\n", sn)
+	return nil
+}
+
+func (c *ctl) export(args []string) error {
+	s, err := subnet.ExportState(c.ctx, c.sm)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if len(args) == 0 {
+		_, err = c.out.Write(data)
+		return err
+	}
+	// the leases include the backend data
+	if err := ioutil.WriteFile(args[0], data, 0600); err != nil {
+		return fmt.Errorf("failed to write %v: %v", args[0], err)
+	}
+	fmt.Fprintf(c.out, "Exported %v to %v\n", countState(s), args[0])
+	return nil
+}
+
+// importState is not named import, which is a keyword.
+func (c *ctl) importState(args []string) error {
+	si, ok := c.sm.(subnet.StateImporter)
+	if !ok {
+		return fmt.Errorf("importing requires access to etcd, not a flannel server")
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", args[0], err)
+	}
+	s := &subnet.State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return fmt.Errorf("failed to parse %v: %v", args[0], err)
+	}
+
+	if err := si.ImportState(c.ctx, s); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Imported %v from %v\n", countState(s), args[0])
+	return nil
+}
+
+func countState(s *subnet.State) string {
+	leases := 0
+	for _, n := range s.Networks {
+		leases += len(n.Leases)
+	}
+	return fmt.Sprintf("%v networks and %v leases", len(s.Networks), leases)
+}
+
+// capacity simulates the allocator over the leases of the network, or an
+// empty network with config=FILE. The arguments are the fields of
+// subnet.CapacityParams, e.g. nodes=200 growth=5 churn=20, and subnet-len
+// to try another SubnetLen, with the default SubnetMin and SubnetMax.
+func (c *ctl) capacity(args []string) error {
+	p := subnet.CapacityParams{Days: 365, Seed: time.Now().UnixNano()}
+	every := 30
+	var configFile string
+	var subnetLen uint
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid argument %q, expected KEY=VALUE", arg)
+		}
+		var err error
+		switch kv[0] {
+		case "nodes":
+			p.Nodes, err = strconv.Atoi(kv[1])
+		case "growth":
+			p.Growth, err = strconv.ParseFloat(kv[1], 64)
+		case "churn":
+			p.Churn, err = strconv.ParseFloat(kv[1], 64)
+		case "release":
+			p.Release, err = strconv.ParseBool(kv[1])
+		case "days":
+			p.Days, err = strconv.Atoi(kv[1])
+		case "ttl":
+			p.TTL, err = time.ParseDuration(kv[1])
+		case "seed":
+			p.Seed, err = strconv.ParseInt(kv[1], 10, 64)
+		case "every":
+			every, err = strconv.Atoi(kv[1])
+		case "config":
+			configFile = kv[1]
+		case "subnet-len":
+			var v uint64
+			v, err = strconv.ParseUint(kv[1], 10, 8)
+			subnetLen = uint(v)
+		default:
+			return fmt.Errorf("unknown key %q, expected nodes, growth, churn, release, days, ttl, seed, every, config or subnet-len", kv[0])
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %v %q", kv[0], kv[1])
+		}
+	}
+	if every < 1 {
+		every = 1
+	}
+
+	var config *subnet.Config
+	var leases []subnet.Lease
+	var err error
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %v", configFile, err)
+		}
+		if config, err = subnet.ParseConfig(string(data)); err != nil {
+			return fmt.Errorf("invalid network config in %v: %v", configFile, err)
+		}
+	} else {
+		if config, err = c.sm.GetNetworkConfig(c.ctx, c.network); err != nil {
+			return fmt.Errorf("failed to retrieve network config: %v", err)
+		}
+		if leases, err = c.listLeases(); err != nil {
+			return err
+		}
+	}
+
+	if subnetLen != 0 {
+		data, err := json.Marshal(&subnet.Config{Network: config.Network, SubnetLen: subnetLen})
+		if err != nil {
+			return err
+		}
+		if config, err = subnet.ParseConfig(string(data)); err != nil {
+			return fmt.Errorf("invalid subnet-len %v: %v", subnetLen, err)
+		}
+	}
+
+	r := subnet.SimulateCapacity(config, leases, p)
+	if c.json {
+		return c.printJSON(r)
+	}
+
+	fmt.Fprintf(c.out, "%v subnets of /%v from %v to %v, %v leases at the start\n\n", r.Capacity, config.SubnetLen, config.SubnetMin, config.SubnetMax, len(leases))
+	rows := [][]string{}
+	for _, d := range r.Days {
+		if d.Day%every != 0 && d.Day != r.Exhausted && d.Day != len(r.Days) {
+			continue
+		}
+		rows = append(rows, []string{strconv.Itoa(d.Day), strconv.Itoa(d.Nodes), strconv.Itoa(d.Leases), strconv.Itoa(d.Free), strconv.Itoa(d.FreeRuns), strconv.Itoa(d.LargestRun), strconv.Itoa(d.Waiting)})
+	}
+	if err := c.table("DAY\tNODES\tLEASES\tFREE\tFREE RUNS\tLARGEST RUN\tWAITING", rows); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.out)
+	if r.Exhausted < 0 {
+		fmt.Fprintf(c.out, "The pool lasts the %v days\n", p.Days)
+	} else {
+		fmt.Fprintf(c.out, "The pool runs out on day %v\n", r.Exhausted)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func newTestCtl(t *testing.T) (*ctl, *bytes.Buffer) {
+	attrs := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1"), BackendType: "vxlan"}
+	// the lease of 10.3.1.0/24 is a reservation as it never expires
+	leases := []subnet.Lease{
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.2.0"), PrefixLen: 24}, Attrs: attrs, Expiration: time.Now().Add(time.Hour)},
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}, Attrs: attrs},
+	}
+	config := `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan" } }`
+	sm := subnet.NewMockManager(subnet.NewMockRegistry("_", config, leases))
+
+	out := &bytes.Buffer{}
+	return &ctl{ctx: context.Background(), sm: sm, network: "_", out: out}, out
+}
+
+func TestParseSubnet(t *testing.T) {
+	for _, s := range []string{"10.3.1.0/24", "10.3.1.0-24"} {
+		sn, err := parseSubnet(s)
+		if err != nil {
+			t.Errorf("parseSubnet(%q) failed: %v", s, err)
+		} else if sn.String() != "10.3.1.0/24" {
+			t.Errorf("parseSubnet(%q) returned %v", s, sn)
+		}
+	}
+
+	for _, s := range []string{"10.3.1.0", "fd00::/64", "bogus"} {
+		if _, err := parseSubnet(s); err == nil {
+			t.Errorf("parseSubnet(%q) did not fail", s)
+		}
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	if _, err := findCommand("owner", []string{"10.3.1.5"}); err != nil {
+		t.Errorf("findCommand failed: %v", err)
+	}
+	if _, err := findCommand("owner", nil); err == nil {
+		t.Errorf("findCommand accepted missing arguments")
+	}
+	if _, err := findCommand("bogus", nil); err == nil {
+		t.Errorf("findCommand accepted an unknown command")
+	}
+}
+
+func TestLeases(t *testing.T) {
+	c, out := newTestCtl(t)
+	if err := c.leases(nil); err != nil {
+		t.Fatalf("leases failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 leases, got %q", out.String())
+	}
+	if !strings.HasPrefix(lines[1], "10.3.1.0/24") || !strings.HasPrefix(lines[2], "10.3.2.0/24") {
+		t.Errorf("leases are not sorted: %q", out.String())
+	}
+	if !strings.Contains(lines[1], "never") {
+		t.Errorf("lease without expiration not shown as such: %q", lines[1])
+	}
+}
+
+func TestOwner(t *testing.T) {
+	c, _ := newTestCtl(t)
+	leases, err := c.listLeases()
+	if err != nil {
+		t.Fatalf("listLeases failed: %v", err)
+	}
+
+	for arg, expected := range map[string]string{
+		"10.3.2.17":     "10.3.2.0/24",
+		"10.3.1.0/24":   "10.3.1.0/24",
+		"10.3.1.128-25": "10.3.1.0/24",
+	} {
+		l, err := findOwner(leases, arg)
+		if err != nil {
+			t.Errorf("findOwner(%q) failed: %v", arg, err)
+		} else if l.Subnet.String() != expected {
+			t.Errorf("findOwner(%q): expected %v, got %v", arg, expected, l.Subnet)
+		}
+	}
+
+	for _, arg := range []string{"10.3.9.1", "10.3.0.0/16"} {
+		if _, err := findOwner(leases, arg); err == nil {
+			t.Errorf("findOwner(%q) did not fail", arg)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	c, _ := newTestCtl(t)
+	if err := c.revoke([]string{"10.3.2.0/24"}); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+
+	leases, err := c.listLeases()
+	if err != nil {
+		t.Fatalf("listLeases failed: %v", err)
+	}
+	if len(leases) != 1 || leases[0].Subnet.String() != "10.3.1.0/24" {
+		t.Errorf("lease was not revoked: %v", leases)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	c, out := newTestCtl(t)
+	if err := c.reserve([]string{"10.3.9.0/24", "1.2.3.4"}); err != nil {
+		t.Fatalf("reserve failed: %v", err)
+	}
+	if err := c.reserve([]string{"10.3.10.0/24", "bogus"}); err == nil {
+		t.Errorf("reserve accepted an invalid public IP")
+	}
+
+	out.Reset()
+	if err := c.reservations(nil); err != nil {
+		t.Fatalf("reservations failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "10.3.9.0/24") {
+		t.Errorf("reservation not listed: %q", out.String())
+	}
+
+	if err := c.unreserve([]string{"10.3.9.0/24"}); err != nil {
+		t.Fatalf("unreserve failed: %v", err)
+	}
+	rs, err := c.sm.ListReservations(c.ctx, c.network)
+	if err != nil {
+		t.Fatalf("ListReservations failed: %v", err)
+	}
+	if len(rs) != 1 || rs[0].Subnet.String() != "10.3.1.0/24" {
+		t.Errorf("reservation was not removed: %v", rs)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannelctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	c, out := newTestCtl(t)
+	if err := c.export([]string{path}); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "1 networks and 2 leases") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+
+	out.Reset()
+	c.sm = subnet.NewMockManager(subnet.NewMockRegistry("other", "", nil))
+	if err := c.importState([]string{path}); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	out.Reset()
+	if err := c.leases(nil); err != nil {
+		t.Fatalf("leases failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "10.3.1.0/24") || !strings.Contains(out.String(), "10.3.2.0/24") {
+		t.Errorf("leases were not imported: %q", out.String())
+	}
+
+	if err := c.importState([]string{path}); err == nil {
+		t.Errorf("import overwrote an existing network")
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	c, out := newTestCtl(t)
+	if err := c.capacity([]string{"nodes=3", "growth=1", "days=10"}); err != nil {
+		t.Fatalf("capacity failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "2 leases at the start") || !strings.Contains(out.String(), "The pool lasts the 10 days") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+
+	for _, args := range [][]string{{"nodes"}, {"bogus=1"}, {"churn=x"}} {
+		if err := c.capacity(args); err == nil {
+			t.Errorf("capacity accepted %q", args)
+		}
+	}
+}
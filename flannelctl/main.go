@@ -0,0 +1,164 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// flannelctl inspects and manages the leases of a flannel network, either
+// directly in etcd or through a flannel server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/coreos/pkg/flagutil"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/remote"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/version"
+)
+
+type CmdLineOpts struct {
+	etcdEndpoints  string
+	etcdPrefix     string
+	etcdKeyfile    string
+	etcdCertfile   string
+	etcdCAFile     string
+	etcdUsername   string
+	etcdPassword   string
+	remote         string
+	remoteKeyfile  string
+	remoteCertfile string
+	remoteCAFile   string
+	remoteToken    string
+	network        string
+	json           bool
+	timeout        time.Duration
+	auditLog       string
+	version        bool
+}
+
+var opts CmdLineOpts
+
+func init() {
+	flag.StringVar(&opts.etcdEndpoints, "etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
+	flag.StringVar(&opts.etcdPrefix, "etcd-prefix", "/coreos.com/network", "etcd prefix")
+	flag.StringVar(&opts.etcdKeyfile, "etcd-keyfile", "", "SSL key file used to secure etcd communication")
+	flag.StringVar(&opts.etcdCertfile, "etcd-certfile", "", "SSL certification file used to secure etcd communication")
+	flag.StringVar(&opts.etcdCAFile, "etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
+	flag.StringVar(&opts.etcdUsername, "etcd-username", "", "Username for BasicAuth to etcd")
+	flag.StringVar(&opts.etcdPassword, "etcd-password", "", "Password for BasicAuth to etcd")
+	flag.StringVar(&opts.remote, "remote", "", "talk to the flannel server at this address (e.g. '10.1.2.3:8080') instead of etcd")
+	flag.StringVar(&opts.remoteKeyfile, "remote-keyfile", "", "SSL key file used to secure client/server communication")
+	flag.StringVar(&opts.remoteCertfile, "remote-certfile", "", "SSL certification file used to secure client/server communication")
+	flag.StringVar(&opts.remoteCAFile, "remote-cafile", "", "SSL Certificate Authority file used to secure client/server communication")
+	flag.StringVar(&opts.remoteToken, "remote-token-file", "", "file with the bearer token to send to the flannel server")
+	flag.StringVar(&opts.network, "network", "", "network to operate on in multi-network mode")
+	flag.BoolVar(&opts.json, "json", false, "print JSON instead of tables")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "give up on the registry after this long")
+	flag.StringVar(&opts.auditLog, "audit-log", "", "append a JSON record of the changes made to this file, like flanneld --audit-log")
+	flag.BoolVar(&opts.version, "version", false, "print version and exit")
+}
+
+func newSubnetManager() (subnet.Manager, error) {
+	if opts.remote != "" {
+		return remote.NewRemoteManager(opts.remote, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile, opts.remoteToken)
+	}
+
+	cfg := &subnet.EtcdConfig{
+		Endpoints: strings.Split(opts.etcdEndpoints, ","),
+		Keyfile:   opts.etcdKeyfile,
+		Certfile:  opts.etcdCertfile,
+		CAFile:    opts.etcdCAFile,
+		Prefix:    opts.etcdPrefix,
+		Username:  opts.etcdUsername,
+		Password:  opts.etcdPassword,
+	}
+
+	return subnet.NewLocalManager(cfg)
+}
+
+// actor names the user for the audit log.
+func actor() string {
+	if u, err := user.Current(); err == nil {
+		return "flannelctl:" + u.Username
+	}
+	return "flannelctl"
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]... COMMAND [ARG]...\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-32s %v\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if opts.version {
+		fmt.Fprintln(os.Stderr, version.Version)
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	// share the environment variables of flanneld
+	flagutil.SetFlagsFromEnv(flag.CommandLine, "FLANNELD")
+
+	cmd, err := findCommand(flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	sm, err := newSubnetManager()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect to the registry:", err)
+		os.Exit(1)
+	}
+
+	if opts.auditLog != "" {
+		auditor, err := subnet.NewFileAuditor(opts.auditLog)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open audit log:", err)
+			os.Exit(1)
+		}
+		sm = subnet.NewAuditManager(sm, auditor)
+	}
+
+	ctx, cancel := context.WithTimeout(subnet.WithActor(context.Background(), actor()), opts.timeout)
+	defer cancel()
+
+	c := &ctl{
+		ctx:     ctx,
+		sm:      sm,
+		network: opts.network,
+		json:    opts.json,
+		out:     os.Stdout,
+	}
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
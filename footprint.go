@@ -0,0 +1,75 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime/debug"
+	"sort"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+// lowFootprintGCPercent is the GOGC of --low-footprint, trading some CPU for
+// a smaller heap.
+const lowFootprintGCPercent = 50
+
+var (
+	// the defaults --low-footprint changes, for edge nodes with little
+	// memory and CPU to spare
+	lowFootprintFlags = map[string]string{
+		"drift-check-interval":   "5m",
+		"ip-masq-check-interval": "5m",
+		"etcd-health-interval":   "2m",
+		"remote-cache-events":    "100",
+	}
+	// flags whose value came from --low-footprint
+	footprintFlags = map[string]bool{}
+)
+
+// applyLowFootprint applies the --low-footprint profile: the defaults of
+// lowFootprintFlags for the flags not set otherwise, no metrics unless they
+// are served and a lower GOGC unless set in the environment.
+func applyLowFootprint() {
+	names := make([]string, 0, len(lowFootprintFlags))
+	for name := range lowFootprintFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if cmdlineFlags[name] || fileFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, lowFootprintFlags[name]); err != nil {
+			log.Errorf("Low footprint: failed to set %v: %v", name, err)
+			continue
+		}
+		footprintFlags[name] = true
+		log.Infof("Low footprint: %v set to %v", name, lowFootprintFlags[name])
+	}
+
+	if opts.metricsListen == "" {
+		metrics.Disable()
+		log.Info("Low footprint: metrics disabled")
+	}
+
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(lowFootprintGCPercent)
+		log.Infof("Low footprint: GOGC set to %v", lowFootprintGCPercent)
+	}
+}
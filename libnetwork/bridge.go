@@ -0,0 +1,138 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libnetwork
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const bridgeName = "flannelbr0"
+
+// ensureBridge creates the bridge the containers are attached to, with gw
+// as its address, or adopts an existing one.
+func ensureBridge(gw ip.IP4Net, mtu int) (*netlink.Bridge, error) {
+	br := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: bridgeName,
+			MTU:  mtu,
+		},
+	}
+
+	if err := netlink.LinkAdd(br); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to create bridge %v: %v", bridgeName, err)
+	}
+
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up bridge %v: %v", bridgeName, err)
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%v already exists and is not a bridge", bridgeName)
+	}
+
+	if br.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(br, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set MTU of %v: %v", bridgeName, err)
+		}
+	}
+
+	addr := &netlink.Addr{IPNet: gw.ToIPNet()}
+	if err := netlink.AddrAdd(br, addr); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to add %v to %v: %v", gw, bridgeName, err)
+	}
+
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, fmt.Errorf("failed to set %v up: %v", bridgeName, err)
+	}
+
+	return br, nil
+}
+
+func deleteBridge() {
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		log.Warningf("Failed to delete bridge %v: %v", bridgeName, err)
+	}
+}
+
+// vethNames returns the names of the host and container ends of an
+// endpoint's veth pair, which must fit into IFNAMSIZ.
+func vethNames(endpointID string) (string, string) {
+	if len(endpointID) > 7 {
+		endpointID = endpointID[:7]
+	}
+	return "vethfl" + endpointID, "vethfl" + endpointID + "c"
+}
+
+// createVeth creates the veth pair of an endpoint and attaches its host end
+// to the bridge. The container end is moved into the sandbox by docker.
+func createVeth(endpointID string, mtu int) (string, error) {
+	host, peer := vethNames(endpointID)
+
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up bridge %v: %v", bridgeName, err)
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return "", fmt.Errorf("%v is not a bridge", bridgeName)
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: host,
+			MTU:  mtu,
+		},
+		PeerName: peer,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return "", fmt.Errorf("failed to create veth pair %v: %v", host, err)
+	}
+
+	if err := netlink.LinkSetMaster(veth, br); err != nil {
+		netlink.LinkDel(veth)
+		return "", fmt.Errorf("failed to attach %v to %v: %v", host, bridgeName, err)
+	}
+
+	if err := netlink.LinkSetUp(veth); err != nil {
+		netlink.LinkDel(veth)
+		return "", fmt.Errorf("failed to set %v up: %v", host, err)
+	}
+
+	return peer, nil
+}
+
+// deleteVeth removes an endpoint's veth pair; deleting the host end takes
+// the container end with it.
+func deleteVeth(endpointID string) error {
+	host, _ := vethNames(endpointID)
+
+	link, err := netlink.LinkByName(host)
+	if err != nil {
+		// already gone
+		return nil
+	}
+	return netlink.LinkDel(link)
+}
@@ -0,0 +1,512 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package libnetwork implements a Docker remote network and IPAM driver
+// (https://github.com/docker/libnetwork/blob/master/docs/remote.md) which
+// attaches containers to a bridge numbered from the host's flannel lease.
+package libnetwork
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const (
+	addressSpace       = "flannel"
+	gatewayRequestType = "com.docker.network.gateway"
+)
+
+var errNoLease = errors.New("flannel has not acquired a lease yet")
+
+// NetworkFunc returns the flannel network whose lease the driver hands
+// out, or nil if there is no lease at the moment.
+type NetworkFunc func() backend.Network
+
+// state is persisted so that the addresses of running containers are not
+// handed out again after a restart.
+type state struct {
+	NetworkID string `json:",omitempty"`
+	Pool      *ip.IP4Net
+	Addresses []ip.IP4
+}
+
+type Driver struct {
+	network   NetworkFunc
+	stateFile string
+
+	mux       sync.Mutex
+	networkID string
+	pool      *pool
+}
+
+func NewDriver(network NetworkFunc, stateFile string) (*Driver, error) {
+	d := &Driver{
+		network:   network,
+		stateFile: stateFile,
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Driver) load() error {
+	data, err := ioutil.ReadFile(d.stateFile)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	st := state{}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("failed to parse %v: %v", d.stateFile, err)
+	}
+
+	d.networkID = st.NetworkID
+	if st.Pool != nil {
+		d.pool = newPool(*st.Pool)
+		for _, a := range st.Addresses {
+			d.pool.Allocated[a] = true
+		}
+	}
+	return nil
+}
+
+// save must be called with mux held.
+func (d *Driver) save() {
+	st := state{NetworkID: d.networkID}
+	if d.pool != nil {
+		st.Pool = &d.pool.Subnet
+		for a := range d.pool.Allocated {
+			st.Addresses = append(st.Addresses, a)
+		}
+	}
+
+	data, err := json.Marshal(st)
+	if err == nil {
+		_, err = fileutil.WriteFileAtomic(d.stateFile, data, 0600)
+	}
+	if err != nil {
+		log.Errorf("Failed to save docker plugin state: %v", err)
+	}
+}
+
+// lease returns the host subnet and MTU of the flannel network.
+func (d *Driver) lease() (ip.IP4Net, int, error) {
+	bn := d.network()
+	if bn == nil {
+		return ip.IP4Net{}, 0, errNoLease
+	}
+	return bn.Lease().Subnet, bn.MTU(), nil
+}
+
+type errorResponse struct {
+	Err string
+}
+
+func jsonResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/vnd.docker.plugins.v1+json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error JSON encoding response: %v", err)
+	}
+}
+
+// handle calls f and writes its result or error in the format expected
+// by docker.
+func handle(f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := f(r)
+		if err != nil {
+			log.Warningf("Docker plugin: %v: %v", r.URL.Path, err)
+			jsonResponse(w, http.StatusInternalServerError, errorResponse{err.Error()})
+			return
+		}
+		if resp == nil {
+			resp = struct{}{}
+		}
+		jsonResponse(w, http.StatusOK, resp)
+	}
+}
+
+func decode(r *http.Request, req interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return fmt.Errorf("JSON decoding error: %v", err)
+	}
+	return nil
+}
+
+// reply returns a handler which always responds with resp.
+func reply(resp interface{}) http.HandlerFunc {
+	return handle(func(r *http.Request) (interface{}, error) {
+		return resp, nil
+	})
+}
+
+func (d *Driver) handler() http.Handler {
+	m := http.NewServeMux()
+
+	m.HandleFunc("/Plugin.Activate", reply(map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}}))
+
+	// network driver
+	m.HandleFunc("/NetworkDriver.GetCapabilities", reply(map[string]string{"Scope": "local", "ConnectivityScope": "local"}))
+
+	m.HandleFunc("/NetworkDriver.CreateNetwork", handle(func(r *http.Request) (interface{}, error) {
+		req := &createNetworkRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		return nil, d.createNetwork(req)
+	}))
+
+	m.HandleFunc("/NetworkDriver.DeleteNetwork", handle(func(r *http.Request) (interface{}, error) {
+		req := &networkRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		return nil, d.deleteNetwork(req)
+	}))
+
+	m.HandleFunc("/NetworkDriver.CreateEndpoint", handle(func(r *http.Request) (interface{}, error) {
+		req := &endpointRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		// the address comes from our IPAM driver, nothing to add
+		return map[string]interface{}{"Interface": nil}, d.checkNetwork(req.NetworkID)
+	}))
+
+	m.HandleFunc("/NetworkDriver.Join", handle(func(r *http.Request) (interface{}, error) {
+		req := &endpointRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		return d.join(req)
+	}))
+
+	leave := handle(func(r *http.Request) (interface{}, error) {
+		req := &endpointRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		return nil, deleteVeth(req.EndpointID)
+	})
+	m.HandleFunc("/NetworkDriver.Leave", leave)
+	m.HandleFunc("/NetworkDriver.DeleteEndpoint", leave)
+
+	m.HandleFunc("/NetworkDriver.EndpointOperInfo", reply(map[string]interface{}{"Value": map[string]string{}}))
+
+	for _, noop := range []string{"DiscoverNew", "DiscoverDelete", "ProgramExternalConnectivity", "RevokeExternalConnectivity"} {
+		m.HandleFunc("/NetworkDriver."+noop, reply(nil))
+	}
+
+	// IPAM driver
+	m.HandleFunc("/IpamDriver.GetCapabilities", reply(map[string]bool{"RequiresMACAddress": false}))
+	m.HandleFunc("/IpamDriver.GetDefaultAddressSpaces", reply(map[string]string{"LocalDefaultAddressSpace": addressSpace, "GlobalDefaultAddressSpace": addressSpace}))
+
+	m.HandleFunc("/IpamDriver.RequestPool", handle(func(r *http.Request) (interface{}, error) {
+		req := &requestPoolRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		return d.requestPool(req)
+	}))
+
+	m.HandleFunc("/IpamDriver.ReleasePool", reply(nil))
+
+	m.HandleFunc("/IpamDriver.RequestAddress", handle(func(r *http.Request) (interface{}, error) {
+		req := &addressRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		return d.requestAddress(req)
+	}))
+
+	m.HandleFunc("/IpamDriver.ReleaseAddress", handle(func(r *http.Request) (interface{}, error) {
+		req := &addressRequest{}
+		if err := decode(r, req); err != nil {
+			return nil, err
+		}
+		return nil, d.releaseAddress(req)
+	}))
+
+	return m
+}
+
+type networkRequest struct {
+	NetworkID string
+}
+
+type ipamData struct {
+	AddressSpace string
+	Pool         string
+	Gateway      string
+}
+
+type createNetworkRequest struct {
+	NetworkID string
+	IPv4Data  []ipamData
+	IPv6Data  []ipamData
+}
+
+type endpointRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+type requestPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	V6           bool
+}
+
+type addressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+func (d *Driver) createNetwork(req *createNetworkRequest) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.networkID != "" && d.networkID != req.NetworkID {
+		return fmt.Errorf("only one flannel network per host is supported, %v already exists", d.networkID)
+	}
+	if len(req.IPv6Data) > 0 {
+		return fmt.Errorf("IPv6 is not supported")
+	}
+	if len(req.IPv4Data) != 1 || req.IPv4Data[0].AddressSpace != addressSpace {
+		return fmt.Errorf("the network must use the flannel IPAM driver (--ipam-driver)")
+	}
+
+	gwAddr, gwNet, err := net.ParseCIDR(req.IPv4Data[0].Gateway)
+	if err != nil {
+		return fmt.Errorf("invalid gateway %q: %v", req.IPv4Data[0].Gateway, err)
+	}
+	gw := ip.FromIPNet(gwNet)
+	gw.IP = ip.FromIP(gwAddr)
+
+	_, mtu, err := d.lease()
+	if err != nil {
+		return err
+	}
+
+	if _, err := ensureBridge(gw, mtu); err != nil {
+		return err
+	}
+
+	d.networkID = req.NetworkID
+	d.save()
+
+	log.Infof("Docker network %v created on %v", req.NetworkID, bridgeName)
+	return nil
+}
+
+func (d *Driver) checkNetwork(networkID string) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if networkID != d.networkID {
+		return fmt.Errorf("unknown network %v", networkID)
+	}
+	return nil
+}
+
+func (d *Driver) deleteNetwork(req *networkRequest) error {
+	if err := d.checkNetwork(req.NetworkID); err != nil {
+		return err
+	}
+
+	deleteBridge()
+
+	d.mux.Lock()
+	d.networkID = ""
+	d.save()
+	d.mux.Unlock()
+
+	log.Infof("Docker network %v deleted", req.NetworkID)
+	return nil
+}
+
+func (d *Driver) join(req *endpointRequest) (interface{}, error) {
+	if err := d.checkNetwork(req.NetworkID); err != nil {
+		return nil, err
+	}
+
+	sn, mtu, err := d.lease()
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := createVeth(req.EndpointID, mtu)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"InterfaceName": map[string]string{
+			"SrcName":   peer,
+			"DstPrefix": "eth",
+		},
+		"Gateway": (sn.IP + 1).String(),
+	}, nil
+}
+
+// requestPool returns the host's flannel subnet as the one and only pool.
+func (d *Driver) requestPool(req *requestPoolRequest) (interface{}, error) {
+	if req.V6 {
+		return nil, fmt.Errorf("IPv6 is not supported")
+	}
+	if req.SubPool != "" {
+		return nil, fmt.Errorf("sub pools are not supported")
+	}
+
+	sn, _, err := d.lease()
+	if err != nil {
+		return nil, err
+	}
+	if req.Pool != "" && req.Pool != sn.String() {
+		return nil, fmt.Errorf("requested pool %v differs from the flannel subnet %v", req.Pool, sn)
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.pool == nil || !d.pool.Subnet.Equal(sn) {
+		if d.pool != nil {
+			log.Warningf("Flannel subnet changed from %v to %v, forgetting address allocations", d.pool.Subnet, sn)
+		}
+		d.pool = newPool(sn)
+		d.save()
+	}
+
+	return map[string]interface{}{
+		"PoolID": sn.String(),
+		"Pool":   sn.String(),
+		"Data":   map[string]string{},
+	}, nil
+}
+
+// getPool must be called with mux held.
+func (d *Driver) getPool(poolID string) (*pool, error) {
+	if d.pool == nil || d.pool.Subnet.String() != poolID {
+		return nil, fmt.Errorf("unknown pool %v", poolID)
+	}
+	return d.pool, nil
+}
+
+func (d *Driver) requestAddress(req *addressRequest) (interface{}, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	p, err := d.getPool(req.PoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	var want ip.IP4
+	switch {
+	case req.Address != "":
+		if want, err = ip.ParseIP4(req.Address); err != nil {
+			return nil, fmt.Errorf("invalid address %q", req.Address)
+		}
+	case req.Options["RequestAddressType"] == gatewayRequestType:
+		want = p.gateway()
+	}
+
+	// the gateway may already be recorded from before a restart
+	if want == p.gateway() && p.Allocated[want] {
+		p.release(want)
+	}
+
+	a, err := p.allocate(want)
+	if err != nil {
+		return nil, err
+	}
+	d.save()
+
+	return map[string]interface{}{
+		"Address": fmt.Sprintf("%v/%v", a, p.Subnet.PrefixLen),
+		"Data":    map[string]string{},
+	}, nil
+}
+
+func (d *Driver) releaseAddress(req *addressRequest) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	p, err := d.getPool(req.PoolID)
+	if err != nil {
+		return err
+	}
+
+	a, err := ip.ParseIP4(strings.Split(req.Address, "/")[0])
+	if err != nil {
+		return fmt.Errorf("invalid address %q", req.Address)
+	}
+
+	p.release(a)
+	d.save()
+	return nil
+}
+
+// Run serves the plugin API on the unix socket at socketPath, typically
+// /run/docker/plugins/flannel.sock, until ctx is done.
+func (d *Driver) Run(ctx context.Context, socketPath string) {
+	os.MkdirAll(filepath.Dir(socketPath), 0755)
+	os.Remove(socketPath)
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Errorf("Error listening on %v: %v", socketPath, err)
+		return
+	}
+	defer os.Remove(socketPath)
+
+	c := make(chan error, 1)
+	go func() {
+		c <- http.Serve(l, d.handler())
+	}()
+
+	log.Infof("Docker network plugin listening on %v", socketPath)
+
+	select {
+	case <-ctx.Done():
+		l.Close()
+		<-c
+
+	case err := <-c:
+		log.Errorf("Error serving on %v: %v", socketPath, err)
+	}
+}
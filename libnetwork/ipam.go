@@ -0,0 +1,74 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libnetwork
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+var errPoolExhausted = errors.New("no free addresses left in the flannel subnet")
+
+// pool hands out the addresses of the host's flannel subnet.
+type pool struct {
+	Subnet    ip.IP4Net
+	Allocated map[ip.IP4]bool
+}
+
+func newPool(sn ip.IP4Net) *pool {
+	return &pool{
+		Subnet:    sn,
+		Allocated: make(map[ip.IP4]bool),
+	}
+}
+
+// gateway is the first usable address, the same one flannel puts into
+// FLANNEL_SUBNET for docker's --bip.
+func (p *pool) gateway() ip.IP4 {
+	return p.Subnet.IP + 1
+}
+
+func (p *pool) broadcast() ip.IP4 {
+	return p.Subnet.IP | ip.IP4(^p.Subnet.Mask())
+}
+
+// allocate reserves addr, or the lowest free address if addr is 0.
+func (p *pool) allocate(addr ip.IP4) (ip.IP4, error) {
+	if addr != 0 {
+		if !p.Subnet.Contains(addr) || addr == p.Subnet.IP || addr == p.broadcast() {
+			return 0, fmt.Errorf("%v is not a usable address of %v", addr, p.Subnet)
+		}
+		if p.Allocated[addr] {
+			return 0, fmt.Errorf("%v is already allocated", addr)
+		}
+		p.Allocated[addr] = true
+		return addr, nil
+	}
+
+	for a := p.Subnet.IP + 1; a < p.broadcast(); a++ {
+		if !p.Allocated[a] {
+			p.Allocated[a] = true
+			return a, nil
+		}
+	}
+
+	return 0, errPoolExhausted
+}
+
+func (p *pool) release(addr ip.IP4) {
+	delete(p.Allocated, addr)
+}
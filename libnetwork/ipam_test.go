@@ -0,0 +1,50 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libnetwork
+
+import (
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func TestPool(t *testing.T) {
+	p := newPool(ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 30})
+
+	gw, err := p.allocate(p.gateway())
+	if err != nil || gw.String() != "10.1.5.1" {
+		t.Fatalf("gateway allocation failed: %v %v", gw, err)
+	}
+
+	a, err := p.allocate(0)
+	if err != nil || a.String() != "10.1.5.2" {
+		t.Fatalf("expected 10.1.5.2, got %v %v", a, err)
+	}
+
+	if _, err := p.allocate(0); err != errPoolExhausted {
+		t.Errorf("expected pool to be exhausted, got %v", err)
+	}
+
+	for _, bad := range []string{"10.1.5.0", "10.1.5.3", "10.1.6.1", "10.1.5.2"} {
+		if _, err := p.allocate(ip.MustParseIP4(bad)); err == nil {
+			t.Errorf("allocation of %v succeeded", bad)
+		}
+	}
+
+	p.release(a)
+	if a2, err := p.allocate(0); err != nil || a2 != a {
+		t.Errorf("released address was not reused: %v %v", a2, err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// the lock file while we hold it; closing it, also by the garbage
+// collector, releases the lock
+var instanceLock *os.File
+
+// tryLock tries to take the exclusive lock on f without waiting.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	switch err {
+	case nil:
+		return true, nil
+	case syscall.EWOULDBLOCK:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// lockPid returns the pid of the flanneld holding the lock file, 0 if the
+// file does not have it.
+func lockPid(f *os.File) int {
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// lockInstance makes sure no other flanneld programs the dataplane of this
+// node by holding an flock on path for as long as we run. If another
+// flanneld holds it, lockInstance fails, or with takeover asks it to hand
+// off with SIGUSR2, leaving the dataplane in place for us, and waits up to
+// timeout for it to exit. The lock file has the pid of the holder.
+func lockInstance(path string, takeover bool, timeout time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create the directory of %v: %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	locked, err := tryLock(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to lock %v: %v", path, err)
+	}
+
+	if !locked {
+		pid := lockPid(f)
+		switch {
+		case !takeover:
+			f.Close()
+			return fmt.Errorf("another flanneld (pid %v) holds %v; stop it first or start with --takeover", pid, path)
+		case pid == 0:
+			f.Close()
+			return fmt.Errorf("%v is locked by a process whose pid it does not record, cannot take over", path)
+		}
+
+		log.Infof("Asking flanneld (pid %v) to hand off", pid)
+		if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil && err != syscall.ESRCH {
+			f.Close()
+			return fmt.Errorf("failed to signal flanneld (pid %v): %v", pid, err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		for !locked {
+			if time.Now().After(deadline) {
+				f.Close()
+				return fmt.Errorf("flanneld (pid %v) did not hand off within %v", pid, timeout)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if locked, err = tryLock(f); err != nil {
+				f.Close()
+				return fmt.Errorf("failed to lock %v: %v", path, err)
+			}
+		}
+		log.Infof("Took over from flanneld (pid %v)", pid)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+
+	instanceLock = f
+	return nil
+}
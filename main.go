@@ -15,21 +15,37 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/coreos/pkg/flagutil"
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/libnetwork"
 	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/logging"
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/pkg/netns"
+	"github.com/coreos/flannel/pkg/qos"
+	"github.com/coreos/flannel/pkg/tracing"
 	"github.com/coreos/flannel/remote"
 	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/subnet/driver"
 	"github.com/coreos/flannel/version"
 
 	// Backends need to be imported for their init() to get executed and them to register
@@ -37,52 +53,163 @@ import (
 	_ "github.com/coreos/flannel/backend/awsvpc"
 	_ "github.com/coreos/flannel/backend/gce"
 	_ "github.com/coreos/flannel/backend/hostgw"
+	_ "github.com/coreos/flannel/backend/srv6"
 	_ "github.com/coreos/flannel/backend/udp"
 	_ "github.com/coreos/flannel/backend/vxlan"
 )
 
 type CmdLineOpts struct {
-	etcdEndpoints  string
-	etcdPrefix     string
-	etcdKeyfile    string
-	etcdCertfile   string
-	etcdCAFile     string
-	etcdUsername   string
-	etcdPassword   string
-	help           bool
-	version        bool
-	listen         string
-	remote         string
-	remoteKeyfile  string
-	remoteCertfile string
-	remoteCAFile   string
+	etcdEndpoints   string
+	etcdSRV         string
+	etcdSRVInterval time.Duration
+	etcdPrefix      string
+	etcdKeyfile     string
+	etcdCertfile    string
+	etcdCAFile      string
+	etcdUsername    string
+	etcdPassword    string
+	help            bool
+	version         bool
+	listen          string
+	remote          string
+	remoteKeyfile   string
+	remoteCertfile  string
+	remoteCAFile    string
+	remoteToken     string
+	remoteAllowed   string
+	remoteCache     bool
+	remoteCacheSize int
+	remoteRateLimit float64
+	remoteRateBurst int
+	remoteAdvertise string
+	remoteLeaderKey string
+	remoteLeaderTTL time.Duration
+	remoteNetwork   string
+	privsepUser     string
+	privsepDir      string
+	driver          string
+	driverKeyfile   string
+	driverCertfile  string
+	driverCAFile    string
+	verbosity       logging.Verbosity
+	logFormat       string
+	logFile         string
+	logMaxSize      int
+	logMaxAge       time.Duration
+	logMaxBackups   int
+	logSyslog       bool
+	configFile      string
+	stateDumpFile   string
+	dryRun          bool
+	plan            bool
+	dockerPlugin    string
+	dockerState     string
+	metricsListen   string
+	apiSocket       string
+	auditLog        string
+	auditEtcdPrefix string
+	auditEtcdTTL    time.Duration
+	otlpEndpoint    string
+	etcdHealth      time.Duration
+	vaultAddr       string
+	vaultTokenFile  string
+	vaultCAFile     string
+	secretsDir      string
+	backendKEK      string
+	fips            bool
+	controlDSCP     string
+	controlPrio     int
+	oidcIssuer      string
+	oidcAudience    string
+	oidcAdmins      string
+	lockFile        string
+	takeover        bool
+	takeoverTimeout time.Duration
+	shutdownTimeout time.Duration
+	lowFootprint    bool
+	netns           string
 }
 
 var opts CmdLineOpts
 
+const dryRunTimeout = 30 * time.Second
+
 func init() {
 	flag.StringVar(&opts.etcdEndpoints, "etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
+	flag.StringVar(&opts.etcdSRV, "etcd-discovery-srv", "", "domain (e.g. 'example.com') whose _etcd-client-ssl._tcp and _etcd-client._tcp SRV records give the etcd endpoints, instead of --etcd-endpoints")
+	flag.DurationVar(&opts.etcdSRVInterval, "etcd-discovery-srv-interval", subnet.DefaultDiscoveryInterval, "how often to resolve the SRV records of --etcd-discovery-srv again, following changes of the etcd cluster")
 	flag.StringVar(&opts.etcdPrefix, "etcd-prefix", "/coreos.com/network", "etcd prefix")
 	flag.StringVar(&opts.etcdKeyfile, "etcd-keyfile", "", "SSL key file used to secure etcd communication")
 	flag.StringVar(&opts.etcdCertfile, "etcd-certfile", "", "SSL certification file used to secure etcd communication")
 	flag.StringVar(&opts.etcdCAFile, "etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
 	flag.StringVar(&opts.etcdUsername, "etcd-username", "", "Username for BasicAuth to etcd")
 	flag.StringVar(&opts.etcdPassword, "etcd-password", "", "Password for BasicAuth to etcd")
-	flag.StringVar(&opts.listen, "listen", "", "run as server and listen on specified address (e.g. ':8080')")
-	flag.StringVar(&opts.remote, "remote", "", "run as client and connect to server on specified address (e.g. '10.1.2.3:8080')")
+	flag.DurationVar(&opts.etcdHealth, "etcd-health-interval", 30*time.Second, "how often to check the health of each etcd endpoint and of the cluster, exported as metrics and at /readyz of --metrics-listen (0 to disable)")
+	flag.StringVar(&opts.listen, "listen", "", "run as server and listen on specified address (e.g. ':8080', or 'unix:///run/flannel/control.sock')")
+	flag.StringVar(&opts.remote, "remote", "", "run as client and connect to server on specified address (e.g. '10.1.2.3:8080'), or a comma separated list of servers to fail over between")
+	flag.StringVar(&opts.privsepUser, "privsep-user", "", "run the control plane, which holds the registry credentials, as this user in a second flanneld process without capabilities; this one programs the dataplane as its client")
+	flag.StringVar(&opts.privsepDir, "privsep-dir", "/run/flannel", "directory of the unix socket between the two processes of --privsep-user")
+	flag.StringVar(&opts.remoteNetwork, "remote-network", "", "client only: CIDR (e.g. '10.42.0.0/16') the network and the subnets handed out by the server must lie within; others are refused")
+	flag.StringVar(&opts.driver, "registry-driver", "", "use the registry driver at this address (e.g. 'unix:///run/flannel/registry.sock' or 'https://10.1.2.3:8443') instead of etcd")
+	flag.StringVar(&opts.driverKeyfile, "registry-driver-keyfile", "", "SSL key file used to secure the registry driver communication")
+	flag.StringVar(&opts.driverCertfile, "registry-driver-certfile", "", "SSL certification file used to secure the registry driver communication")
+	flag.StringVar(&opts.driverCAFile, "registry-driver-cafile", "", "SSL Certificate Authority file used to secure the registry driver communication")
 	flag.StringVar(&opts.remoteKeyfile, "remote-keyfile", "", "SSL key file used to secure client/server communication")
 	flag.StringVar(&opts.remoteCertfile, "remote-certfile", "", "SSL certification file used to secure client/server communication")
 	flag.StringVar(&opts.remoteCAFile, "remote-cafile", "", "SSL Certificate Authority file used to secure client/server communication")
+	flag.StringVar(&opts.remoteToken, "remote-token-file", "", "file with the bearer token to send (client), or the accepted tokens one per line (server); requires TLS")
+	flag.StringVar(&opts.remoteAllowed, "remote-allowed-clients", "", "server only: comma separated patterns (e.g. 'node-*.example.com') of which the CN or a DNS SAN of client certificates must match one; requires --remote-cafile")
+	flag.StringVar(&opts.oidcIssuer, "remote-oidc-issuer", "", "server only: also accept the ID tokens of this OpenID Connect provider (e.g. 'https://accounts.example.com') as bearer tokens; requires TLS")
+	flag.StringVar(&opts.oidcAudience, "remote-oidc-audience", "flannel", "server only: audience the ID tokens must be issued for, usually the client ID")
+	flag.StringVar(&opts.oidcAdmins, "remote-oidc-admin-groups", "", "server only: comma separated groups, in the groups claim of the ID tokens, whose members may change leases and reservations; everybody else may only read")
+	flag.BoolVar(&opts.remoteCache, "remote-cache", true, "server only: cache network configs and serve all lease watches of a network from a single etcd watch")
+	flag.IntVar(&opts.remoteCacheSize, "remote-cache-events", 1000, "server only: number of lease events --remote-cache keeps per network for the watches of the clients to resume from")
+	flag.Float64Var(&opts.remoteRateLimit, "remote-rate-limit", 0, "server only: requests per second allowed per client, by certificate name or IP address (0 for no limit)")
+	flag.IntVar(&opts.remoteRateBurst, "remote-rate-burst", 20, "server only: requests a client may make in a burst above --remote-rate-limit")
+	flag.StringVar(&opts.remoteAdvertise, "remote-advertise", "", "server only: URL other servers reach this one at (e.g. 'https://10.1.2.3:8080'); elects a leader among the servers sharing --remote-leader-key, to which the others proxy")
+	flag.StringVar(&opts.remoteLeaderKey, "remote-leader-key", "/coreos.com/flannel-server/leader", "server only: etcd key used to elect the leader with --remote-advertise")
+	flag.DurationVar(&opts.remoteLeaderTTL, "remote-leader-ttl", 15*time.Second, "server only: time after which a failed leader is replaced")
+	flag.Var(&opts.verbosity, "v", "log level for V logs")
+	flag.Var(logging.VModuleFlag{}, "vmodule", "comma-separated list of pattern=N settings for file-filtered logging")
+	flag.Var(logging.SubsystemLevelsFlag{}, "log-levels", "comma-separated list of subsystem=N settings raising the log level of subsystems, e.g. subnet=2,backend/vxlan=3")
+	flag.StringVar(&opts.logFormat, "log-format", "text", "log output format: text or json")
+	flag.StringVar(&opts.logFile, "log-file", "", "write the log to this file instead of stderr")
+	flag.IntVar(&opts.logMaxSize, "log-file-max-size", 100, "rotate --log-file once it reaches this many megabytes (0 to disable)")
+	flag.DurationVar(&opts.logMaxAge, "log-file-max-age", 0, "rotate --log-file once it is this old, e.g. 24h (0 to disable)")
+	flag.IntVar(&opts.logMaxBackups, "log-file-max-backups", 5, "number of rotated log files to keep")
+	flag.BoolVar(&opts.logSyslog, "log-syslog", false, "send the log to syslog (or journald) with priorities matching the log level")
+	flag.StringVar(&opts.configFile, "config", "", "config file with option values; command line flags and environment variables take precedence")
+	flag.StringVar(&opts.stateDumpFile, "state-dump-file", "", "file to write the state dump to on SIGUSR1 (default: the log)")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "check the config and registry connectivity, print the subnet, routes and iptables rules that would be set up, and exit")
+	flag.BoolVar(&opts.plan, "plan", false, "like --dry-run, but print the routes and iptables rules as a diff against the current state of the host")
+	flag.StringVar(&opts.dockerPlugin, "docker-plugin", "", "serve the Docker network and IPAM driver API on this unix socket (e.g. /run/docker/plugins/flannel.sock)")
+	flag.StringVar(&opts.dockerState, "docker-plugin-state-file", "/run/flannel/docker-plugin.json", "file where the Docker driver keeps its address allocations")
+	flag.StringVar(&opts.metricsListen, "metrics-listen", "", "serve Prometheus metrics on this address (e.g. ':9127') at /metrics")
+	flag.StringVar(&opts.apiSocket, "api-socket", "", "serve the control API (networks, leases, peers, backend state and lease events, and the admin endpoints) on this unix socket (e.g. /run/flannel/flannel.sock)")
+	flag.StringVar(&opts.auditLog, "audit-log", "", "append a JSON record of every lease acquisition, renewal and revocation, reservation change and network config change to this file")
+	flag.StringVar(&opts.auditEtcdPrefix, "audit-etcd-prefix", "", "store the audit records in etcd as in-order keys below this prefix (e.g. /coreos.com/network-audit), instead of --audit-log")
+	flag.DurationVar(&opts.auditEtcdTTL, "audit-etcd-ttl", 30*24*time.Hour, "expire the audit records in etcd after this long (0 to keep them)")
+	flag.StringVar(&opts.otlpEndpoint, "otlp-endpoint", "", "export spans of lease acquisition, registry calls and backend programming to this OpenTelemetry collector with OTLP over HTTP (e.g. 'http://127.0.0.1:4318')")
+	flag.StringVar(&opts.vaultAddr, "vault-addr", "", "address of the Vault server (e.g. 'https://10.1.2.3:8200') to read the options given as vault:<path>#<field> references from (default: $VAULT_ADDR)")
+	flag.StringVar(&opts.vaultTokenFile, "vault-token-file", "", "file with the Vault token (default: $VAULT_TOKEN)")
+	flag.StringVar(&opts.vaultCAFile, "vault-cafile", "", "SSL Certificate Authority file used to secure Vault communication (default: $VAULT_CACERT)")
+	flag.StringVar(&opts.secretsDir, "secrets-dir", "/run/flannel/secrets", "directory to write the key, certificate and token files read from Vault to")
+	flag.StringVar(&opts.backendKEK, "backend-data-kek-file", "", "comma separated files with 32 byte keys to encrypt the backend data of the leases in the registry with; the first one encrypts, all decrypt")
+	flag.BoolVar(&opts.fips, "fips", false, "restrict all crypto to FIPS 140 approved algorithms and fail if flanneld does not use a validated crypto module or the backend cannot comply")
+	flag.StringVar(&opts.controlDSCP, "control-dscp", "", "DSCP of the connections to the registry, the flannel server and the Kubernetes API server, a number or a class such as CS6, for the network to prioritize them over the pod traffic")
+	flag.IntVar(&opts.controlPrio, "control-priority", -1, "socket priority of the connections to the registry, the flannel server and the Kubernetes API server, which e.g. an HTB qdisc maps to the class with that major:minor (-1 to leave alone)")
+	flag.StringVar(&opts.lockFile, "lock-file", "/run/flannel/flanneld.lock", "file locked for as long as flanneld runs, so that a second instance refuses to start (\"\" to disable)")
+	flag.BoolVar(&opts.takeover, "takeover", false, "if another flanneld holds --lock-file, ask it to exit leaving the dataplane in place and take over from it")
+	flag.DurationVar(&opts.takeoverTimeout, "takeover-timeout", 30*time.Second, "how long to wait for the other flanneld to exit with --takeover")
+	flag.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for the networks to shut down on SIGTERM before exiting anyway (0 to wait forever)")
+	flag.StringVar(&opts.netns, "netns", "", "run in the network namespace at this path (e.g. /var/run/netns/blue), programming the devices, routes and firewall rules there instead of in the one flanneld was started in")
+	flag.BoolVar(&opts.lowFootprint, "low-footprint", false, "use less memory and CPU, for small edge devices: longer check intervals, smaller caches, no metrics without --metrics-listen and a GOGC of 50")
 	flag.BoolVar(&opts.help, "help", false, "print this message")
 	flag.BoolVar(&opts.version, "version", false, "print version and exit")
 }
 
-func newSubnetManager() (subnet.Manager, error) {
-	if opts.remote != "" {
-		return remote.NewRemoteManager(opts.remote, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile)
-	}
-
-	cfg := &subnet.EtcdConfig{
+func etcdConfig() *subnet.EtcdConfig {
+	return &subnet.EtcdConfig{
 		Endpoints: strings.Split(opts.etcdEndpoints, ","),
 		Keyfile:   opts.etcdKeyfile,
 		Certfile:  opts.etcdCertfile,
@@ -90,57 +217,478 @@ func newSubnetManager() (subnet.Manager, error) {
 		Prefix:    opts.etcdPrefix,
 		Username:  opts.etcdUsername,
 		Password:  opts.etcdPassword,
+		Auth:      etcdAuth,
+
+		DiscoverySRV:      opts.etcdSRV,
+		DiscoveryInterval: opts.etcdSRVInterval,
+	}
+}
+
+// leaderElection returns the leader election settings of server mode, nil
+// without --remote-advertise.
+func leaderElection() *remote.LeaderElection {
+	if opts.remoteAdvertise == "" {
+		return nil
 	}
+	return &remote.LeaderElection{
+		Etcd:      etcdConfig(),
+		Key:       opts.remoteLeaderKey,
+		Advertise: opts.remoteAdvertise,
+		TTL:       opts.remoteLeaderTTL,
+	}
+}
 
-	return subnet.NewLocalManager(cfg)
+// oidcConfig returns the OIDC settings of server mode, nil without
+// --remote-oidc-issuer.
+func oidcConfig() *remote.OIDCConfig {
+	if opts.oidcIssuer == "" {
+		return nil
+	}
+	return &remote.OIDCConfig{
+		Issuer:      opts.oidcIssuer,
+		Audience:    opts.oidcAudience,
+		AdminGroups: splitList(opts.oidcAdmins),
+	}
+}
+
+// withChaos and runChaos are only set in flanneld built with the chaos tag,
+// see chaos.go. withChaos wraps the subnet manager to inject faults into
+// the registry calls, runChaos injects those of the dataplane.
+var (
+	withChaos func(sm subnet.Manager) (subnet.Manager, error)
+	runChaos  func(ctx context.Context)
+)
+
+func newSubnetManager() (subnet.Manager, error) {
+	var sm subnet.Manager
+	var err error
+	if opts.remote != "" && opts.driver != "" {
+		return nil, fmt.Errorf("--remote and --registry-driver are mutually exclusive")
+	}
+	if opts.remote != "" {
+		sm, err = remote.NewRemoteManager(opts.remote, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile, opts.remoteToken)
+		if err == nil && opts.remoteNetwork != "" {
+			_, n, perr := net.ParseCIDR(opts.remoteNetwork)
+			if perr != nil {
+				return nil, fmt.Errorf("failed to parse --remote-network: %v", perr)
+			}
+			sm = subnet.NewConfiningManager(sm, ip.FromIPNet(n))
+		}
+	} else if opts.driver != "" {
+		var d driver.Driver
+		if d, err = driver.NewClient(opts.driver, opts.driverCAFile, opts.driverCertfile, opts.driverKeyfile); err == nil {
+			sm = driver.NewManager(d)
+		}
+	} else {
+		sm, err = subnet.NewLocalManager(etcdConfig())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if withChaos != nil {
+		if sm, err = withChaos(sm); err != nil {
+			return nil, err
+		}
+	}
+	sm = subnet.NewMetricsManager(sm)
+
+	if opts.backendKEK != "" {
+		sealer, err := newSealer()
+		if err != nil {
+			return nil, err
+		}
+		sm = subnet.NewSealingManager(sm, sealer)
+	}
+
+	auditor, err := newAuditor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	if auditor != nil {
+		sm = subnet.NewAuditManager(sm, auditor)
+	}
+	if opts.otlpEndpoint != "" {
+		sm = subnet.NewTracingManager(sm)
+	}
+	return sm, nil
+}
+
+// newSealer returns the sealer of the backend data with the KEKs in
+// --backend-data-kek-file.
+func newSealer() (*subnet.Sealer, error) {
+	var keks [][]byte
+	for _, path := range strings.Split(opts.backendKEK, ",") {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KEK: %v", err)
+		}
+		kek, err := subnet.ParseKEK(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		keks = append(keks, kek)
+	}
+	return subnet.NewSealer(keks...)
+}
+
+// newAuditor returns the auditor for --audit-log or --audit-etcd-prefix, or
+// nil if neither is set.
+func newAuditor() (subnet.Auditor, error) {
+	switch {
+	case opts.auditLog != "" && opts.auditEtcdPrefix != "":
+		return nil, fmt.Errorf("--audit-log and --audit-etcd-prefix are mutually exclusive")
+
+	case opts.auditLog != "":
+		return subnet.NewFileAuditor(opts.auditLog)
+
+	case opts.auditEtcdPrefix != "":
+		if opts.remote != "" || opts.driver != "" {
+			return nil, fmt.Errorf("--audit-etcd-prefix needs etcd, use --audit-log with --remote or --registry-driver")
+		}
+		return subnet.NewEtcdAuditor(etcdConfig(), opts.auditEtcdPrefix, opts.auditEtcdTTL)
+	}
+	return nil, nil
+}
+
+// enableControlQoS marks the connections to the control plane with
+// --control-dscp and --control-priority.
+func enableControlQoS() error {
+	dscp := -1
+	if opts.controlDSCP != "" {
+		d, err := backend.ParseDSCP(opts.controlDSCP)
+		if err != nil || d == backend.DSCPInherit {
+			return fmt.Errorf("invalid --control-dscp %q, expected 0 to 63 or a class such as CS6", opts.controlDSCP)
+		}
+		dscp = d
+	}
+	if opts.controlPrio < -1 {
+		return fmt.Errorf("invalid --control-priority %v", opts.controlPrio)
+	}
+
+	qos.Enable(dscp, opts.controlPrio)
+	if qos.Enabled() {
+		log.Infof("Marking the control plane connections with DSCP %v and priority %v", dscp, opts.controlPrio)
+	} else if dscp >= 0 || opts.controlPrio >= 0 {
+		return fmt.Errorf("--control-dscp and --control-priority need flanneld built with Go 1.11 or later")
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag value, skipping empty elements.
+func splitList(s string) []string {
+	l := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// dumpState writes the state dump to --state-dump-file, or to the log if
+// no file was given.
+func dumpState(dump func(w io.Writer)) {
+	buf := &bytes.Buffer{}
+	dump(buf)
+
+	if opts.stateDumpFile == "" {
+		for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+			log.Info(line)
+		}
+		return
+	}
+
+	if err := ioutil.WriteFile(opts.stateDumpFile, buf.Bytes(), 0600); err != nil {
+		log.Errorf("Failed to write state dump: %v", err)
+		return
+	}
+	log.Infof("State dumped to %v", opts.stateDumpFile)
+}
+
+// dryRun prints what flanneld would do without touching the system, as a
+// diff against the current state with --plan, and exits non-zero if the
+// config or the registry is unusable.
+func dryRun(sm subnet.Manager) {
+	ctx, cancel := context.WithTimeout(context.Background(), dryRunTimeout)
+	defer cancel()
+
+	nm, err := network.NewNetworkManager(ctx, sm)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create NetworkManager:", err)
+		os.Exit(1)
+	}
+
+	run := nm.DryRun
+	if opts.plan {
+		run = nm.Plan
+	}
+	if err := run(ctx, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Dry run failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runCheck prints the report of `flanneld check` and returns the exit
+// status, which is non-zero if any check failed.
+func runCheck(sm subnet.Manager, hc *subnet.EtcdHealthChecker) int {
+	ctx, cancel := context.WithTimeout(context.Background(), dryRunTimeout)
+	defer cancel()
+
+	failed := 0
+	if hc != nil {
+		h := hc.Check(ctx)
+		if err := h.Err(); err != nil {
+			fmt.Printf("  FAIL  etcd cluster health: %v\n", err)
+			failed++
+		} else {
+			fmt.Println("  PASS  etcd cluster health")
+			for _, p := range h.Problems {
+				fmt.Printf("        warning: %v\n", p)
+			}
+		}
+	}
+
+	nm, err := network.NewNetworkManager(ctx, sm)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create NetworkManager:", err)
+		return 1
+	}
+
+	if failed += nm.Check(ctx, os.Stdout); failed > 0 {
+		fmt.Printf("%v check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("All checks passed")
+	return 0
+}
+
+// withDockerPlugin wraps run to also serve the Docker driver API for the
+// lease of the (single) flannel network.
+func withDockerPlugin(nm *network.Manager, run func(ctx context.Context)) func(ctx context.Context) {
+	if flag.Lookup("networks").Value.String() != "" || flag.Lookup("watch-networks").Value.String() == "true" {
+		log.Error("--docker-plugin is not supported in multi-network mode")
+		os.Exit(1)
+	}
+
+	d, err := libnetwork.NewDriver(func() backend.Network { return nm.BackendNetwork("") }, opts.dockerState)
+	if err != nil {
+		log.Error("Failed to create Docker network driver: ", err)
+		os.Exit(1)
+	}
+
+	return func(ctx context.Context) {
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			d.Run(ctx, opts.dockerPlugin)
+			wg.Done()
+		}()
+
+		run(ctx)
+		wg.Wait()
+	}
 }
 
 func main() {
-	// glog will log to tmp files by default. override so all entries
-	// can flow into journald (if running under systemd)
-	flag.Set("logtostderr", "true")
+	log.SetLogger(log.NewTextLogger(nil, logVerbosity))
 
-	// now parse command line args
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "docker-opts" {
+		os.Exit(runDockerOpts(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate-cluster" {
+		os.Exit(runSimulateCluster(os.Args[2:]))
+	}
+
+	// now parse command line args; check takes the same options as
+	// flanneld itself
+	check := len(os.Args) > 1 && os.Args[1] == "check"
+	showConfig := len(os.Args) > 1 && os.Args[1] == "config"
+	if check || showConfig {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	if flag.NArg() > 0 || opts.help {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]...\n       %s check [OPTION]...\n       %s config [OPTION]...\n       %s docker-opts [OPTION]...\n       %s bench [OPTION]...\n       %s simulate-cluster [OPTION]...\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
 
 	if opts.version {
-		fmt.Fprintln(os.Stderr, version.Version)
+		if version.GitSHA != "" {
+			fmt.Fprintf(os.Stderr, "%v (%v)\n", version.Version, version.GitSHA)
+		} else {
+			fmt.Fprintln(os.Stderr, version.Version)
+		}
 		os.Exit(0)
 	}
 
+	flag.Visit(func(f *flag.Flag) {
+		argFlags[f.Name] = true
+	})
 	flagutil.SetFlagsFromEnv(flag.CommandLine, "FLANNELD")
 
+	// remember what the config file may not override, also on reload
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = true
+	})
+
+	if opts.configFile != "" {
+		if err := loadConfigFile(opts.configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.netns != "" {
+		// re-executes flanneld unless already in the namespace
+		if err := netns.Enter(opts.netns); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	logOutput := logging.Output{
+		File:       opts.logFile,
+		MaxSize:    int64(opts.logMaxSize) * 1024 * 1024,
+		MaxAge:     opts.logMaxAge,
+		MaxBackups: opts.logMaxBackups,
+		Syslog:     opts.logSyslog,
+	}
+	logger, err := logging.Setup(opts.logFormat, logOutput, logVerbosity)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	log.SetLogger(logger)
+
+	if opts.fips {
+		if err := fips.Enable(); err != nil {
+			log.Error("Failed to enable FIPS mode: ", err)
+			os.Exit(1)
+		}
+		log.Infof("FIPS mode enabled, crypto module: %v", fips.Module())
+	}
+
+	if err := enableControlQoS(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if opts.lowFootprint {
+		applyLowFootprint()
+	}
+
+	if opts.privsepUser != "" && !check && !showConfig && !opts.dryRun && !opts.plan {
+		if err := startController(); err != nil {
+			log.Error("Failed to separate privileges: ", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := resolveSecrets(); err != nil {
+		log.Error("Failed to read secrets from Vault: ", err)
+		os.Exit(1)
+	}
+
+	var spanExporter *tracing.Exporter
+	if opts.otlpEndpoint != "" {
+		host, _ := os.Hostname()
+		spanExporter = tracing.NewExporter(opts.otlpEndpoint,
+			tracing.KV("service.name", "flanneld"),
+			tracing.KV("service.version", version.Version),
+			tracing.KV("host.name", host))
+		tracing.SetExporter(spanExporter)
+	}
+
 	sm, err := newSubnetManager()
 	if err != nil {
 		log.Error("Failed to create SubnetManager: ", err)
 		os.Exit(1)
 	}
 
+	if showConfig {
+		if err := printConfig(os.Stdout, sm); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to retrieve the network config:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.dryRun || opts.plan {
+		if opts.listen != "" {
+			fmt.Fprintln(os.Stderr, "--dry-run and --plan are mutually exclusive with --listen")
+			os.Exit(1)
+		}
+		dryRun(sm)
+		os.Exit(0)
+	}
+
+	etcdHealth, err := newEtcdHealthChecker()
+	if err != nil {
+		log.Error("Failed to create etcd health checker: ", err)
+		os.Exit(1)
+	}
+
+	if check {
+		os.Exit(runCheck(sm, etcdHealth))
+	}
+
 	// Register for SIGINT and SIGTERM
 	log.Info("Installing signal handlers")
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	var runFunc func(ctx context.Context)
+	var healthCheck func() error
+	var reloadFunc func()
+	var dumpFunc func(w io.Writer)
+	var handOffFunc func()
 
 	if opts.listen != "" {
 		if opts.remote != "" {
 			log.Error("--listen and --remote are mutually exclusive")
 			os.Exit(1)
 		}
+		if opts.driver != "" && opts.remoteAdvertise != "" {
+			log.Error("--remote-advertise elects the leader in etcd and cannot be used with --registry-driver")
+			os.Exit(1)
+		}
 		log.Info("running as server")
 		runFunc = func(ctx context.Context) {
-			remote.RunServer(ctx, sm, opts.listen, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile)
+			remote.RunServer(ctx, sm, opts.listen, remote.ServerConfig{
+				CAFile:         opts.remoteCAFile,
+				CertFile:       opts.remoteCertfile,
+				KeyFile:        opts.remoteKeyfile,
+				TokenFile:      opts.remoteToken,
+				OIDC:           oidcConfig(),
+				AllowedClients: splitList(opts.remoteAllowed),
+				Cache:          opts.remoteCache,
+				CacheEvents:    opts.remoteCacheSize,
+				RateLimit:      opts.remoteRateLimit,
+				RateBurst:      opts.remoteRateBurst,
+				Election:       leaderElection(),
+			})
 		}
 	} else {
+		if err := checkPrivileges(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		if opts.lockFile != "" {
+			if err := lockInstance(opts.lockFile, opts.takeover, opts.takeoverTimeout); err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+		}
+
 		nm, err := network.NewNetworkManager(ctx, sm)
 		if err != nil {
 			log.Error("Failed to create NetworkManager: ", err)
@@ -150,21 +698,173 @@ func main() {
 		runFunc = func(ctx context.Context) {
 			nm.Run(ctx)
 		}
+
+		if opts.dockerPlugin != "" {
+			runFunc = withDockerPlugin(nm, runFunc)
+		}
+		if opts.apiSocket != "" {
+			go nm.ServeAPI(ctx, opts.apiSocket)
+		}
+		if runChaos != nil {
+			go runChaos(ctx)
+		}
+		healthCheck = nm.HealthCheck
+		reloadFunc = nm.Reload
+		dumpFunc = nm.DumpState
+		handOffFunc = nm.HandOff
+	}
+
+	ctlSigs := make(chan os.Signal, 1)
+	signal.Notify(ctlSigs, syscall.SIGHUP, syscall.SIGUSR1)
+	go func() {
+		for sig := range ctlSigs {
+			switch sig {
+			case syscall.SIGHUP:
+				log.Info("Received SIGHUP, reloading")
+				if opts.configFile != "" {
+					reloadConfigFile(opts.configFile)
+				}
+				if reloadFunc != nil {
+					reloadFunc()
+				}
+
+			case syscall.SIGUSR1:
+				log.Info("Received SIGUSR1, dumping state")
+				if dumpFunc != nil {
+					dumpState(dumpFunc)
+				}
+			}
+		}
+	}()
+
+	if etcdHealth != nil {
+		startupHealthCheck(ctx, etcdHealth)
+		if opts.etcdHealth > 0 {
+			go etcdHealth.Run(ctx, opts.etcdHealth)
+		}
+	}
+
+	if opts.metricsListen != "" {
+		go serveMetrics(opts.metricsListen, readyCheck(etcdHealth, healthCheck))
 	}
 
 	wg := sync.WaitGroup{}
-	wg.Add(1)
+	wg.Add(2)
 	go func() {
 		runFunc(ctx)
 		wg.Done()
 	}()
 
-	<-sigs
+	go func() {
+		runWatchdog(ctx, healthCheck)
+		wg.Done()
+	}()
+
+	if spanExporter != nil {
+		wg.Add(1)
+		go func() {
+			spanExporter.Run(ctx)
+			wg.Done()
+		}()
+	}
+
+	sig := <-sigs
 	// unregister to get default OS nuke behaviour in case we don't exit cleanly
 	signal.Stop(sigs)
 
+	if sig == syscall.SIGUSR2 {
+		// a new instance started with --takeover
+		log.Info("Received SIGUSR2, handing off to a new instance")
+		if handOffFunc != nil {
+			handOffFunc()
+		}
+	}
+
 	log.Info("Exiting...")
 	cancel()
 
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if opts.shutdownTimeout > 0 {
+		timeout = time.After(opts.shutdownTimeout)
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		log.Errorf("Shutdown did not complete within %v, exiting anyway", opts.shutdownTimeout)
+		os.Exit(1)
+	}
+}
+
+// logVerbosity returns the current value of -v, which the admin API
+// changes at runtime.
+func logVerbosity() int {
+	return opts.verbosity.Level()
+}
+
+// newEtcdHealthChecker returns the etcd health checker, nil in client mode
+// or with a registry driver, where flanneld does not talk to etcd.
+func newEtcdHealthChecker() (*subnet.EtcdHealthChecker, error) {
+	if opts.remote != "" || opts.driver != "" {
+		return nil, nil
+	}
+	return subnet.NewEtcdHealthChecker(etcdConfig())
+}
+
+// startupHealthCheck logs what is wrong with the etcd cluster before we
+// start using it, which tells more than the connection errors of the
+// registry calls.
+func startupHealthCheck(ctx context.Context, hc *subnet.EtcdHealthChecker) {
+	h := hc.Check(ctx)
+	for _, m := range h.Members {
+		if m.Error != "" {
+			log.Warningf("etcd endpoint %v: %v", m.Endpoint, m.Error)
+		}
+	}
+	if err := h.Err(); err != nil {
+		log.Error(err)
+	} else if len(h.Problems) > 0 {
+		log.Warningf("etcd cluster is degraded but usable: %v", strings.Join(h.Problems, "; "))
+	}
+}
+
+// readyCheck returns the check behind /readyz: the etcd cluster is healthy,
+// as of its last check, and so is flanneld.
+func readyCheck(hc *subnet.EtcdHealthChecker, healthCheck func() error) func() error {
+	return func() error {
+		if hc != nil {
+			if h := hc.Last(); h != nil {
+				if err := h.Err(); err != nil {
+					return err
+				}
+			}
+		}
+		if healthCheck != nil {
+			return healthCheck()
+		}
+		return nil
+	}
+}
+
+func serveMetrics(addr string, ready func() error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	log.Infof("Serving metrics on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Failed to serve metrics: %v", err)
+	}
 }
@@ -0,0 +1,390 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The traffic to and from each peer is counted by a rule per peer subnet,
+// matching the packets between it and our subnet before they are
+// encapsulated and after they are decapsulated, so that it works the same
+// for all backends.
+
+var errAccountingUnsupported = errors.New("per-peer traffic accounting is only supported with --firewall=iptables or nftables")
+
+// peerTraffic is the traffic counted between our subnet and a peer's.
+type peerTraffic struct {
+	TxBytes, TxPackets uint64
+	RxBytes, RxPackets uint64
+}
+
+func accountingChains(own ip.IP4Net) (string, string) {
+	return iptablesChain("ACCTTX", own), iptablesChain("ACCTRX", own)
+}
+
+func accountingRules(own ip.IP4Net, peers []ip.IP4Net) ([][]string, [][]string) {
+	tx, rx := [][]string{}, [][]string{}
+	for _, p := range peers {
+		tx = append(tx, []string{"-s", own.String(), "-d", p.String()})
+		rx = append(rx, []string{"-s", p.String(), "-d", own.String()})
+	}
+	return tx, rx
+}
+
+// SyncAccounting replaces the counting rules, which resets the counters.
+func (f *iptablesFirewall) SyncAccounting(own ip.IP4Net, peers []ip.IP4Net) error {
+	txChain, rxChain := accountingChains(own)
+	tx, rx := accountingRules(own, peers)
+	if err := ip4tables.setupChain("mangle", "POSTROUTING", txChain, tx, nil); err != nil {
+		return fmt.Errorf("failed to set up traffic accounting: %v", err)
+	}
+	if err := ip4tables.setupChain("mangle", "PREROUTING", rxChain, rx, nil); err != nil {
+		return fmt.Errorf("failed to set up traffic accounting: %v", err)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) TeardownAccounting(own ip.IP4Net) error {
+	txChain, rxChain := accountingChains(own)
+	if err := ip4tables.teardownChain("mangle", "POSTROUTING", txChain); err != nil {
+		return fmt.Errorf("failed to tear down traffic accounting: %v", err)
+	}
+	if err := ip4tables.teardownChain("mangle", "PREROUTING", rxChain); err != nil {
+		return fmt.Errorf("failed to tear down traffic accounting: %v", err)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) ReadAccounting(own ip.IP4Net) (map[ip.IP4Net]*peerTraffic, error) {
+	out, err := exec.Command("iptables-save", "-c", "-t", "mangle").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("iptables-save: %v: %s", err, bytes.TrimSpace(out))
+	}
+	txChain, rxChain := accountingChains(own)
+	return parseIptablesCounters(string(out), txChain, rxChain), nil
+}
+
+// parseIptablesCounters parses the rules of the accounting chains in the
+// output of iptables-save -c, e.g. "[12:1008] -A chain -s a -d b".
+func parseIptablesCounters(save, txChain, rxChain string) map[ip.IP4Net]*peerTraffic {
+	res := map[ip.IP4Net]*peerTraffic{}
+	for _, line := range strings.Split(save, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 7 || fields[1] != "-A" || (fields[2] != txChain && fields[2] != rxChain) {
+			continue
+		}
+
+		var packets, octets uint64
+		if _, err := fmt.Sscanf(fields[0], "[%d:%d]", &packets, &octets); err != nil {
+			continue
+		}
+
+		peerArg := "-d"
+		if fields[2] == rxChain {
+			peerArg = "-s"
+		}
+		peer, ok := argSubnet(fields[3:], peerArg)
+		if !ok {
+			continue
+		}
+
+		t := trafficOf(res, peer)
+		if fields[2] == txChain {
+			t.TxPackets, t.TxBytes = packets, octets
+		} else {
+			t.RxPackets, t.RxBytes = packets, octets
+		}
+	}
+	return res
+}
+
+// argSubnet returns the subnet following arg, e.g. "-d 10.1.5.0/24".
+func argSubnet(args []string, arg string) (ip.IP4Net, bool) {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == arg {
+			_, sn, err := net.ParseCIDR(args[i+1])
+			if err != nil || sn.IP.To4() == nil {
+				return ip.IP4Net{}, false
+			}
+			return ip.FromIPNet(sn), true
+		}
+	}
+	return ip.IP4Net{}, false
+}
+
+func trafficOf(res map[ip.IP4Net]*peerTraffic, peer ip.IP4Net) *peerTraffic {
+	t, ok := res[peer]
+	if !ok {
+		t = &peerTraffic{}
+		res[peer] = t
+	}
+	return t
+}
+
+func nftAccountingTable(own ip.IP4Net) string {
+	return "flannel_acct_" + own.StringSep("_", "_")
+}
+
+func nftAccountingScript(own ip.IP4Net, peers []ip.IP4Net, withRules bool) string {
+	t := nftAccountingTable(own)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "table ip %v\n", t)
+	fmt.Fprintf(buf, "delete table ip %v\n", t)
+	if !withRules {
+		return buf.String()
+	}
+
+	fmt.Fprintf(buf, "table ip %v {\n", t)
+	for _, c := range []struct{ name, hook, peer, us string }{
+		{"tx", "postrouting", "daddr", "saddr"},
+		{"rx", "prerouting", "saddr", "daddr"},
+	} {
+		fmt.Fprintf(buf, "\tchain %v {\n", c.name)
+		fmt.Fprintf(buf, "\t\ttype filter hook %v priority -150; policy accept;\n", c.hook)
+		for _, p := range peers {
+			fmt.Fprintf(buf, "\t\tip %v %v ip %v %v counter\n", c.us, own, c.peer, p)
+		}
+		fmt.Fprintln(buf, "\t}")
+	}
+	fmt.Fprintln(buf, "}")
+	return buf.String()
+}
+
+func (f *nftFirewall) SyncAccounting(own ip.IP4Net, peers []ip.IP4Net) error {
+	if err := runNft(nftAccountingScript(own, peers, true)); err != nil {
+		return fmt.Errorf("failed to set up traffic accounting: %v", err)
+	}
+	return nil
+}
+
+func (f *nftFirewall) TeardownAccounting(own ip.IP4Net) error {
+	if err := runNft(nftAccountingScript(own, nil, false)); err != nil {
+		return fmt.Errorf("failed to tear down traffic accounting: %v", err)
+	}
+	return nil
+}
+
+func (f *nftFirewall) ReadAccounting(own ip.IP4Net) (map[ip.IP4Net]*peerTraffic, error) {
+	out, err := exec.Command("nft", "list", "table", "ip", nftAccountingTable(own)).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nft list table: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return parseNftCounters(string(out)), nil
+}
+
+// parseNftCounters parses the rules of the accounting table as listed by
+// nft, e.g. "ip saddr a ip daddr b counter packets 12 bytes 1008".
+func parseNftCounters(table string) map[ip.IP4Net]*peerTraffic {
+	res := map[ip.IP4Net]*peerTraffic{}
+	chain := ""
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "chain":
+			chain = fields[1]
+			continue
+		case len(fields) < 11 || fields[0] != "ip":
+			continue
+		}
+
+		peerArg := "daddr"
+		if chain == "rx" {
+			peerArg = "saddr"
+		}
+		peer, ok := argSubnet(fields, peerArg)
+		if !ok {
+			continue
+		}
+
+		var packets, octets uint64
+		for i := 0; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "packets":
+				packets, _ = strconv.ParseUint(fields[i+1], 10, 64)
+			case "bytes":
+				octets, _ = strconv.ParseUint(fields[i+1], 10, 64)
+			}
+		}
+
+		t := trafficOf(res, peer)
+		switch chain {
+		case "tx":
+			t.TxPackets, t.TxBytes = packets, octets
+		case "rx":
+			t.RxPackets, t.RxBytes = packets, octets
+		}
+	}
+	return res
+}
+
+// firewalld and the external firewall leave no room for rules of our own
+// to count with.
+
+func (f *firewalldFirewall) SyncAccounting(own ip.IP4Net, peers []ip.IP4Net) error {
+	return errAccountingUnsupported
+}
+
+func (f *firewalldFirewall) TeardownAccounting(own ip.IP4Net) error {
+	return nil
+}
+
+func (f *firewalldFirewall) ReadAccounting(own ip.IP4Net) (map[ip.IP4Net]*peerTraffic, error) {
+	return nil, errAccountingUnsupported
+}
+
+func (f *externalFirewall) SyncAccounting(own ip.IP4Net, peers []ip.IP4Net) error {
+	return errAccountingUnsupported
+}
+
+func (f *externalFirewall) TeardownAccounting(own ip.IP4Net) error {
+	return nil
+}
+
+func (f *externalFirewall) ReadAccounting(own ip.IP4Net) (map[ip.IP4Net]*peerTraffic, error) {
+	return nil, errAccountingUnsupported
+}
+
+var (
+	peerTxBytes = metrics.NewCounter("flannel_peer_transmit_bytes_total",
+		"Bytes sent from our subnet to the peer's.", "network", "subnet", "node")
+	peerTxPackets = metrics.NewCounter("flannel_peer_transmit_packets_total",
+		"Packets sent from our subnet to the peer's.", "network", "subnet", "node")
+	peerRxBytes = metrics.NewCounter("flannel_peer_receive_bytes_total",
+		"Bytes received by our subnet from the peer's.", "network", "subnet", "node")
+	peerRxPackets = metrics.NewCounter("flannel_peer_receive_packets_total",
+		"Packets received by our subnet from the peer's.", "network", "subnet", "node")
+)
+
+// counterDelta returns how much a rule counter grew since it was last read,
+// all of it if the rule was replaced in between.
+func counterDelta(cur, last uint64) float64 {
+	if cur < last {
+		return float64(cur)
+	}
+	return float64(cur - last)
+}
+
+// countPeerTraffic keeps a counting rule for each peer of the network and
+// exports the counters every interval. Replacing the rules as peers come
+// and go resets the counters, so they are read right before.
+func (n *Network) countPeerTraffic(ctx context.Context, ownLease *subnet.Lease, interval time.Duration) {
+	own := ownLease.Subnet
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, ownLease, evts)
+
+	defer func() {
+		if err := n.fw.TeardownAccounting(own); err != nil {
+			log.Errorf("Failed to tear down traffic accounting for network %v: %v", n.Name, err)
+		}
+	}()
+
+	// the public IP of each peer subnet
+	peers := map[ip.IP4Net]string{}
+	last := map[ip.IP4Net]peerTraffic{}
+
+	export := func() {
+		cur, err := n.fw.ReadAccounting(own)
+		if err != nil {
+			log.Warningf("Failed to read the traffic counters of network %v: %v", n.Name, err)
+			return
+		}
+		for sn, t := range cur {
+			node, ok := peers[sn]
+			if !ok {
+				continue
+			}
+			l := last[sn]
+			lvs := []string{n.Name, sn.String(), node}
+			peerTxBytes.Add(counterDelta(t.TxBytes, l.TxBytes), lvs...)
+			peerTxPackets.Add(counterDelta(t.TxPackets, l.TxPackets), lvs...)
+			peerRxBytes.Add(counterDelta(t.RxBytes, l.RxBytes), lvs...)
+			peerRxPackets.Add(counterDelta(t.RxPackets, l.RxPackets), lvs...)
+			last[sn] = *t
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(interval):
+			export()
+
+		case batch := <-evts:
+			export()
+
+			changed := false
+			for _, evt := range batch {
+				sn, node := evt.Lease.Subnet, evt.Lease.Attrs.PublicIP.String()
+				switch {
+				case evt.Type == subnet.EventRemoved:
+					if old, ok := peers[sn]; ok {
+						for _, c := range []*metrics.Counter{peerTxBytes, peerTxPackets, peerRxBytes, peerRxPackets} {
+							c.Delete(n.Name, sn.String(), old)
+						}
+						delete(peers, sn)
+						changed = true
+					}
+				case peers[sn] != node:
+					peers[sn] = node
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+
+			list := make([]ip.IP4Net, 0, len(peers))
+			for sn := range peers {
+				list = append(list, sn)
+			}
+			sort.Sort(bySubnet(list))
+
+			if err := n.fw.SyncAccounting(own, list); err != nil {
+				if err == errAccountingUnsupported {
+					log.Warningf("Not counting the traffic of network %v: %v", n.Name, err)
+					return
+				}
+				log.Errorf("Failed to update the traffic accounting for network %v: %v", n.Name, err)
+				continue
+			}
+			last = map[ip.IP4Net]peerTraffic{}
+		}
+	}
+}
+
+type bySubnet []ip.IP4Net
+
+func (l bySubnet) Len() int           { return len(l) }
+func (l bySubnet) Less(i, j int) bool { return l[i].IP < l[j].IP }
+func (l bySubnet) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,184 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// adminState is what the admin API reports and changes.
+type adminState struct {
+	LogLevel      string
+	RoutingPaused bool
+	Tracing       bool
+}
+
+func currentAdminState() *adminState {
+	return &adminState{
+		LogLevel:      flag.Lookup("v").Value.String(),
+		RoutingPaused: backend.RoutingPaused(),
+		Tracing:       backend.Tracing(),
+	}
+}
+
+// Reconcile brings the dataplane of all networks in line with their leases
+// right away instead of at the next periodic check: it restores the IP
+// masquerade rules, has the backend restore its routes or FDB entries and
+// rewrites the subnet files.
+func (m *Manager) Reconcile(ctx context.Context) error {
+	errs := []string{}
+	m.forEachNetwork(func(n *Network) {
+		if err := m.reconcileNetwork(ctx, n); err != nil {
+			errs = append(errs, fmt.Sprintf("network %q: %v", n.Name, err))
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m *Manager) reconcileNetwork(ctx context.Context, n *Network) error {
+	n.mux.Lock()
+	bn := n.bn
+	if bn != nil && n.ipMasq {
+		n.checkIPMasqOnce("")
+	}
+	n.mux.Unlock()
+
+	if bn == nil {
+		// not initialized yet
+		return nil
+	}
+
+	if r, ok := bn.(backend.Reconciler); ok {
+		if err := r.Reconcile(ctx); err != nil {
+			return err
+		}
+	}
+	return m.writeSubnetFile(n, bn)
+}
+
+// adminOnly restricts h to clients running as root or as our user, as
+// opposed to the read-only API which the group of the socket may use.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "the admin API is restricted to root and the user of flanneld")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func adminClient(r *http.Request) string {
+	if cred := peerCred(r); cred != nil {
+		return fmt.Sprintf("uid %v, pid %v", cred.Uid, cred.Pid)
+	}
+	return "unknown client"
+}
+
+// GET /v1/admin
+func (m *Manager) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, currentAdminState())
+}
+
+// POST /v1/admin/log-level?v=<level> sets the log verbosity.
+func (m *Manager) handleAdminLogLevel(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("v")
+	if level, err := strconv.Atoi(v); err != nil || level < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid log level %q", v)
+		return
+	}
+
+	if err := flag.Set("v", v); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	log.Infof("Admin API: log level set to %v (%v)", v, adminClient(r))
+	apiJSON(w, http.StatusOK, currentAdminState())
+}
+
+// POST /v1/admin/reconcile
+func (m *Manager) handleAdminReconcile(w http.ResponseWriter, r *http.Request) {
+	if backend.RoutingPaused() {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "route programming is paused")
+		return
+	}
+
+	log.Infof("Admin API: reconciling (%v)", adminClient(r))
+	if err := m.Reconcile(m.ctx); err != nil {
+		log.Errorf("Admin API: reconciliation failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, currentAdminState())
+}
+
+// POST /v1/admin/routing/{action} with pause or resume.
+func (m *Manager) handleAdminRouting(w http.ResponseWriter, r *http.Request) {
+	switch action := mux.Vars(r)["action"]; action {
+	case "pause":
+		if backend.PauseRouting() {
+			log.Warningf("Admin API: route programming paused, lease changes are held back until resumed (%v)", adminClient(r))
+		}
+	case "resume":
+		if backend.ResumeRouting() {
+			log.Infof("Admin API: route programming resumed (%v)", adminClient(r))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "unknown action %q, expected pause or resume", action)
+		return
+	}
+	apiJSON(w, http.StatusOK, currentAdminState())
+}
+
+// POST /v1/admin/tracing?enabled=<bool>
+func (m *Manager) handleAdminTracing(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid value for enabled: %v", err)
+		return
+	}
+
+	backend.SetTracing(enabled)
+	log.Infof("Admin API: tracing set to %v (%v)", enabled, adminClient(r))
+	apiJSON(w, http.StatusOK, currentAdminState())
+}
+
+func (m *Manager) adminRoutes(r *mux.Router) {
+	r.HandleFunc("/v1/admin", m.handleAdmin).Methods("GET")
+	r.HandleFunc("/v1/admin/log-level", adminOnly(m.handleAdminLogLevel)).Methods("POST")
+	r.HandleFunc("/v1/admin/reconcile", adminOnly(m.handleAdminReconcile)).Methods("POST")
+	r.HandleFunc("/v1/admin/routing/{action}", adminOnly(m.handleAdminRouting)).Methods("POST")
+	r.HandleFunc("/v1/admin/tracing", adminOnly(m.handleAdminTracing)).Methods("POST")
+}
@@ -0,0 +1,352 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// apiNetwork is a network as returned by the control API.
+type apiNetwork struct {
+	// Name is only set in multi-network mode
+	Name        string `json:",omitempty"`
+	Network     ip.IP4Net
+	BackendType string
+	// Lease and MTU are missing while the network has no lease
+	Lease  *subnet.Lease `json:",omitempty"`
+	MTU    int           `json:",omitempty"`
+	IPMasq bool
+}
+
+func newAPINetwork(n *Network) *apiNetwork {
+	an := &apiNetwork{
+		Name:        n.Name,
+		Network:     n.Config.Network,
+		BackendType: n.Config.BackendType,
+		IPMasq:      n.IPMasq(),
+	}
+	if bn := n.backendNetwork(); bn != nil {
+		an.Lease = bn.Lease()
+		an.MTU = bn.MTU()
+	}
+	return an
+}
+
+func apiJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error JSON encoding response: %v", err)
+	}
+}
+
+// apiNetworkHandler passes the network named by the {network} path variable
+// to h, with "_" standing for the network of single network mode like in
+// the remote API.
+func (m *Manager) apiNetworkHandler(h func(n *Network, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		netname := mux.Vars(r)["network"]
+		if netname == "_" {
+			netname = ""
+		}
+
+		n, ok := m.getNetwork(netname)
+		if !ok || n.Config == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "unknown network %q", netname)
+			return
+		}
+		h(n, w, r)
+	}
+}
+
+// GET /v1/networks
+func (m *Manager) handleAPINetworks(w http.ResponseWriter, r *http.Request) {
+	nets := []*apiNetwork{}
+	m.forEachNetwork(func(n *Network) {
+		if n.Config != nil {
+			nets = append(nets, newAPINetwork(n))
+		}
+	})
+	apiJSON(w, http.StatusOK, nets)
+}
+
+// GET /v1/networks/{network}
+func (m *Manager) handleAPINetwork(n *Network, w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, newAPINetwork(n))
+}
+
+// GET /v1/networks/{network}/peers returns the leases of the other hosts.
+func (m *Manager) handleAPIPeers(n *Network, w http.ResponseWriter, r *http.Request) {
+	res, err := m.sm.WatchLeases(m.ctx, n.Name, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	var own ip.IP4Net
+	if bn := n.backendNetwork(); bn != nil {
+		own = bn.Lease().Subnet
+	}
+
+	peers := []subnet.Lease{}
+	for _, l := range res.Snapshot {
+		if !l.Subnet.Equal(own) {
+			peers = append(peers, l)
+		}
+	}
+	apiJSON(w, http.StatusOK, peers)
+}
+
+// GET /v1/networks/{network}/backend returns the state dump of the backend
+// as text, as its format differs between backends.
+func (m *Manager) handleAPIBackend(n *Network, w http.ResponseWriter, r *http.Request) {
+	bn := n.backendNetwork()
+	if bn == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "network has no lease")
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if d, ok := bn.(backend.StateDumper); ok {
+		d.DumpState(buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// parsePacket parses the packet to trace from the query parameters src,
+// dst, proto, sport and dport, of which only dst is required. The source
+// defaults to the first address of our lease.
+func parsePacket(q url.Values, own *subnet.Lease) (*backend.Packet, error) {
+	p := &backend.Packet{Proto: q.Get("proto")}
+	switch p.Proto {
+	case "", "tcp", "udp", "icmp":
+	default:
+		return nil, fmt.Errorf("invalid proto %q, expected tcp, udp or icmp", p.Proto)
+	}
+
+	for _, a := range []struct {
+		name string
+		ip   *ip.IP4
+	}{{"src", &p.Src}, {"dst", &p.Dst}} {
+		s := q.Get(a.name)
+		if s == "" {
+			continue
+		}
+		addr := net.ParseIP(s)
+		if addr == nil || addr.To4() == nil {
+			return nil, fmt.Errorf("invalid %v %q", a.name, s)
+		}
+		*a.ip = ip.FromIP(addr)
+	}
+	if p.Dst == 0 {
+		return nil, fmt.Errorf("dst is required")
+	}
+	if p.Src == 0 && own != nil {
+		p.Src = own.Subnet.IP + 1
+	}
+
+	for _, port := range []struct {
+		name string
+		port *uint16
+	}{{"sport", &p.SrcPort}, {"dport", &p.DstPort}} {
+		s := q.Get(port.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q", port.name, s)
+		}
+		*port.port = uint16(v)
+	}
+	return p, nil
+}
+
+// GET /v1/networks/{network}/trace?dst=<ip>[&src=<ip>&proto=<proto>&sport=<port>&dport=<port>]
+// tells, as text, how the backend forwards the packet to another host. The
+// steps are logged as well.
+func (m *Manager) handleAPITrace(n *Network, w http.ResponseWriter, r *http.Request) {
+	bn := n.backendNetwork()
+	if bn == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "network has no lease")
+		return
+	}
+	pt, ok := bn.(backend.PacketTracer)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "the %v backend does not support tracing", n.Config.BackendType)
+		return
+	}
+
+	p, err := parsePacket(r.URL.Query(), bn.Lease())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	steps, err := pt.TracePacket(p)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%v\n", p)
+	log.Infof("trace: %v", p)
+	for _, s := range steps {
+		fmt.Fprintf(w, "  %v\n", s)
+		log.Infof("trace:   %v", s)
+	}
+}
+
+// GET /v1/networks/{network}/events streams the lease events of the other
+// hosts as one JSON object per line until the client goes away, starting
+// with an added event for each existing lease.
+func (m *Manager) handleAPIEvents(n *Network, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "streaming is not supported")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	var own *subnet.Lease
+	if bn := n.backendNetwork(); bn != nil {
+		own = bn.Lease()
+	}
+
+	events := make(chan []subnet.Event)
+	go func() {
+		subnet.WatchLeases(ctx, m.sm, n.Name, own, events)
+		close(events)
+	}()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			// let WatchLeases return
+			for range events {
+			}
+			return
+
+		case batch, ok := <-events:
+			if !ok {
+				return
+			}
+			for _, evt := range batch {
+				if err := enc.Encode(evt); err != nil {
+					cancel()
+					break
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (m *Manager) apiHandler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/info", m.handleAPIInfo).Methods("GET")
+	r.HandleFunc("/v1/networks", m.handleAPINetworks).Methods("GET")
+	r.HandleFunc("/v1/networks/{network}", m.apiNetworkHandler(m.handleAPINetwork)).Methods("GET")
+	r.HandleFunc("/v1/networks/{network}/peers", m.apiNetworkHandler(m.handleAPIPeers)).Methods("GET")
+	r.HandleFunc("/v1/networks/{network}/backend", m.apiNetworkHandler(m.handleAPIBackend)).Methods("GET")
+	r.HandleFunc("/v1/networks/{network}/events", m.apiNetworkHandler(m.handleAPIEvents)).Methods("GET")
+	r.HandleFunc("/v1/networks/{network}/trace", m.apiNetworkHandler(m.handleAPITrace)).Methods("GET")
+	m.adminRoutes(r)
+	return r
+}
+
+// ServeAPI serves the control API on the unix socket at socketPath until
+// ctx is done. The socket is only accessible to the owner and group as the
+// leases include the backend data; the admin endpoints, which change the
+// behavior of flanneld, are further restricted to root and our user.
+func (m *Manager) ServeAPI(ctx context.Context, socketPath string) {
+	os.MkdirAll(filepath.Dir(socketPath), 0755)
+	os.Remove(socketPath)
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Errorf("Error listening on %v: %v", socketPath, err)
+		return
+	}
+	defer os.Remove(socketPath)
+
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		log.Errorf("Failed to restrict access to %v: %v", socketPath, err)
+		l.Close()
+		return
+	}
+
+	c := make(chan error, 1)
+	srv := &http.Server{
+		Handler: m.apiHandler(),
+	}
+	go func() {
+		c <- srv.Serve(peerCredListener{l})
+	}()
+
+	log.Infof("Control API listening on %v", socketPath)
+
+	select {
+	case <-ctx.Done():
+		l.Close()
+		<-c
+
+	case err := <-c:
+		log.Errorf("Error serving on %v: %v", socketPath, err)
+	}
+}
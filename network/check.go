@@ -0,0 +1,214 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/subnetenv"
+	"github.com/coreos/flannel/subnet"
+)
+
+// checkReport prints the results of `flanneld check` as they come in.
+type checkReport struct {
+	w      io.Writer
+	failed int
+}
+
+func (r *checkReport) add(res backend.CheckResult) {
+	if res.Err == nil {
+		fmt.Fprintf(r.w, "  PASS  %v\n", res.Name)
+		return
+	}
+
+	r.failed++
+	fmt.Fprintf(r.w, "  FAIL  %v: %v\n", res.Name, res.Err)
+	if res.Hint != "" {
+		fmt.Fprintf(r.w, "        hint: %v\n", res.Hint)
+	}
+}
+
+// Check verifies the state of the local node for each network Run would
+// service: that the registry is reachable, we hold a valid lease, the
+// dataplane matches the leases of the peers, the masquerade rules are in
+// place and the backend's ports are not blocked. It prints a report to w
+// and returns the number of failed checks.
+func (m *Manager) Check(ctx context.Context, w io.Writer) int {
+	r := &checkReport{w: w}
+	names := []string{""}
+
+	if m.isMultiNetwork() {
+		result, err := m.sm.WatchNetworks(ctx, nil)
+		r.add(backend.CheckResult{Name: "registry reachable", Err: err, Hint: registryHint})
+		if err != nil {
+			return r.failed
+		}
+
+		names = nil
+		for _, n := range result.Snapshot {
+			if m.isNetAllowed(n) {
+				names = append(names, n)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if name != "" {
+			fmt.Fprintf(w, "network %v:\n", name)
+		}
+		m.checkNetwork(ctx, r, name)
+	}
+
+	return r.failed
+}
+
+const registryHint = "check --etcd-endpoints (or --remote) and the credentials, and that etcd is healthy"
+
+func (m *Manager) checkNetwork(ctx context.Context, r *checkReport, name string) {
+	config, err := m.sm.GetNetworkConfig(ctx, name)
+	r.add(backend.CheckResult{Name: "network config", Err: err, Hint: registryHint})
+	if err != nil {
+		return
+	}
+
+	res, err := m.sm.WatchLeases(ctx, name, nil)
+	r.add(backend.CheckResult{Name: "leases readable", Err: err, Hint: registryHint})
+	if err != nil {
+		return
+	}
+
+	publicIP := ip.FromIP(m.extIface.ExtAddr)
+	var lease *subnet.Lease
+	peers := []subnet.Lease{}
+	for i := range res.Snapshot {
+		if res.Snapshot[i].Attrs.PublicIP == publicIP && lease == nil {
+			lease = &res.Snapshot[i]
+		} else {
+			peers = append(peers, res.Snapshot[i])
+		}
+	}
+
+	r.add(backend.CheckResult{
+		Name: "lease",
+		Err:  checkLease(lease, config, publicIP),
+		Hint: "start flanneld, which acquires a lease, and check --public-ip and --iface",
+	})
+	if lease == nil {
+		return
+	}
+
+	r.add(backend.CheckResult{
+		Name: "subnet file",
+		Err:  checkSubnetFile(m.subnetFilePath(name), lease),
+		Hint: "restart flanneld to rewrite the subnet file, then restart the containers using it",
+	})
+
+	be, err := backend.NewBackend(config.BackendType, m.sm, m.extIface)
+	r.add(backend.CheckResult{Name: "backend " + config.BackendType, Err: err})
+	if err != nil {
+		return
+	}
+
+	if fips.Enabled() {
+		r.add(backend.CheckResult{
+			Name: "FIPS mode",
+			Err:  backend.CheckFIPS(be, config),
+			Hint: "change the backend settings of the network config to FIPS approved algorithms",
+		})
+	}
+
+	if c, ok := be.(backend.Checker); ok {
+		for _, res := range c.Check(config, lease, peers) {
+			r.add(res)
+		}
+	}
+
+	if m.ipMasq {
+		r.add(backend.CheckResult{
+			Name: "IP masquerade rules",
+			Err:  m.checkMasqRules(newMasqConfig(config, m.noMasq)),
+			Hint: "restart flanneld to restore the rules and check for other agents flushing them",
+		})
+	}
+
+	if p, ok := be.(backend.PortPlanner); ok {
+		ports, err := p.PlanPorts(config)
+		if err == nil {
+			var blocked []string
+			if blocked, err = m.fw.BlockedPorts(ports); err == nil && len(blocked) > 0 {
+				err = fmt.Errorf("%v blocked by the host firewall", strings.Join(blocked, ", "))
+			}
+		}
+		r.add(backend.CheckResult{
+			Name: "backend ports " + strings.Join(ports, ", "),
+			Err:  err,
+			Hint: "let the traffic of the other hosts in, e.g. with --firewall=firewalld",
+		})
+	}
+}
+
+func checkLease(lease *subnet.Lease, config *subnet.Config, publicIP ip.IP4) error {
+	switch {
+	case lease == nil:
+		return fmt.Errorf("no lease for %v", publicIP)
+	case !lease.Expiration.IsZero() && lease.Expiration.Before(time.Now()):
+		return fmt.Errorf("lease %v expired at %v", lease.Subnet, lease.Expiration)
+	case !config.Network.Contains(lease.Subnet.IP) || lease.Subnet.PrefixLen != config.SubnetLen:
+		return fmt.Errorf("lease %v does not fit network %v with subnet length %v", lease.Subnet, config.Network, config.SubnetLen)
+	case lease.Attrs.BackendType != config.BackendType:
+		return fmt.Errorf("lease %v is for backend %v instead of %v", lease.Subnet, lease.Attrs.BackendType, config.BackendType)
+	}
+	return nil
+}
+
+func checkSubnetFile(path string, lease *subnet.Lease) error {
+	env, err := subnetenv.Load(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%v does not exist", path)
+		}
+		return err
+	}
+
+	// the subnet file has the first usable IP
+	sn := lease.Subnet
+	sn.IP += 1
+	if !env.Subnet.Equal(sn) {
+		return fmt.Errorf("%v has subnet %v instead of %v", path, env.Subnet, sn)
+	}
+	return nil
+}
+
+func (m *Manager) checkMasqRules(mc *masqConfig) error {
+	d, err := m.fw.CheckMasq(mc)
+	switch {
+	case err != nil:
+		return err
+	case len(d.Missing) > 0:
+		return fmt.Errorf("missing %v", strings.Join(d.Missing, "; "))
+	case d.Misordered:
+		return fmt.Errorf("rules are out of order")
+	}
+	return nil
+}
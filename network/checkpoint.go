@@ -0,0 +1,181 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// checkpoint records what the dataplane of a network was last programmed
+// for. Unlike the subnet file in /run, it survives reboots.
+type checkpoint struct {
+	Network     ip.IP4Net
+	BackendType string
+	Lease       subnet.Lease
+	MTU         int
+}
+
+func checkpointPath(netname string) string {
+	if netname == "" {
+		return filepath.Join(opts.checkpointDir, "checkpoint.json")
+	}
+	return filepath.Join(opts.checkpointDir, netname+".checkpoint.json")
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+	return cp, nil
+}
+
+// writeCheckpoint records the lease and MTU of the network, with
+// --checkpoint-dir.
+func (n *Network) writeCheckpoint(bn backend.Network) {
+	if opts.checkpointDir == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(&checkpoint{
+		Network:     n.Config.Network,
+		BackendType: n.Config.BackendType,
+		Lease:       *bn.Lease(),
+		MTU:         bn.MTU(),
+	}, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(opts.checkpointDir, 0700); err == nil {
+			_, err = fileutil.WriteFileAtomic(checkpointPath(n.Name), append(data, '\n'), 0600)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to write the checkpoint of network %v: %v", n.Name, err)
+	}
+}
+
+// checkDataplane returns the checks of the backend the dataplane of bn
+// fails against its lease and those of the peers.
+func (n *Network) checkDataplane(ctx context.Context, c backend.Checker, bn backend.Network) ([]string, error) {
+	res, err := n.sm.WatchLeases(ctx, n.Name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the leases: %v", err)
+	}
+
+	l := bn.Lease()
+	peers := []subnet.Lease{}
+	for _, p := range res.Snapshot {
+		if !p.Subnet.Equal(l.Subnet) {
+			peers = append(peers, p)
+		}
+	}
+
+	failed := []string{}
+	for _, r := range c.Check(n.Config, l, peers) {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", r.Name, r.Err))
+		}
+	}
+	return failed, nil
+}
+
+// validateDataplane runs when the network got a lease, before it is
+// declared ready. If the checkpoint shows that the dataplane was programmed
+// for the same, still valid, lease before, e.g. before a reboot or a crash,
+// it verifies the kernel state (devices, addresses, MTU, routes or FDB
+// entries) against the leases and has the backend repair the differences,
+// rather than trusting what it found.
+func (n *Network) validateDataplane(ctx context.Context, bn backend.Network) {
+	if opts.checkpointDir == "" {
+		return
+	}
+
+	cp, err := readCheckpoint(checkpointPath(n.Name))
+	switch {
+	case os.IsNotExist(err):
+		return
+	case err != nil:
+		log.Warningf("Not validating the dataplane of network %v: %v", n.Name, err)
+		return
+	}
+
+	l := bn.Lease()
+	if !cp.Lease.Subnet.Equal(l.Subnet) || cp.BackendType != n.Config.BackendType || !cp.Network.Equal(n.Config.Network) || time.Now().After(cp.Lease.Expiration) {
+		log.Infof("Checkpoint of network %v is for lease %v (%v backend) expiring at %v, not validating the dataplane", n.Name, cp.Lease.Subnet, cp.BackendType, cp.Lease.Expiration)
+		return
+	}
+
+	be, err := n.bm.GetBackend(n.Config.BackendType)
+	if err != nil {
+		return
+	}
+	c, ok := be.(backend.Checker)
+	if !ok {
+		log.V(1).Infof("Not validating the dataplane of network %v: the %v backend does not support it", n.Name, n.Config.BackendType)
+		return
+	}
+
+	failed, err := n.checkDataplane(ctx, c, bn)
+	if err != nil {
+		log.Warningf("Failed to validate the dataplane of network %v: %v", n.Name, err)
+		return
+	}
+	if cp.MTU != 0 && cp.MTU != bn.MTU() {
+		log.Warningf("MTU of network %v is %v, the checkpoint has %v; containers which were not restarted keep the old one", n.Name, bn.MTU(), cp.MTU)
+	}
+	if len(failed) == 0 {
+		log.Infof("Dataplane of network %v matches lease %v", n.Name, l.Subnet)
+		return
+	}
+
+	for _, f := range failed {
+		log.Infof("Dataplane of network %v differs from lease %v: %v", n.Name, l.Subnet, f)
+	}
+	r, ok := bn.(backend.Reconciler)
+	if !ok {
+		return
+	}
+	if err := r.Reconcile(ctx); err != nil {
+		log.Errorf("Failed to repair the dataplane of network %v: %v", n.Name, err)
+		return
+	}
+
+	if failed, err = n.checkDataplane(ctx, c, bn); err != nil {
+		log.Warningf("Failed to validate the dataplane of network %v: %v", n.Name, err)
+		return
+	}
+	for _, f := range failed {
+		log.Warningf("Dataplane of network %v still differs from lease %v after repair: %v", n.Name, l.Subnet, f)
+	}
+	if len(failed) == 0 {
+		log.Infof("Dataplane of network %v repaired", n.Name)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const defaultCNIConfTemplate = `{
+  "name": "cbr0",
+  "cniVersion": "0.3.1",
+  "plugins": [
+    {
+      "type": "flannel",
+      "subnetFile": {{json .SubnetFile}},
+      "delegate": {
+        "type": {{json .Delegate}},{{if eq .Delegate "bridge"}}
+        "hairpinMode": true,
+        "isDefaultGateway": true,{{end}}
+        "mtu": {{.MTU}}
+      }
+    }{{range .Plugins}},
+    {
+      "type": {{json .Type}}{{if .Capability}},
+      "capabilities": {"{{.Capability}}": true}{{end}}
+    }{{end}}
+  ]
+}
+`
+
+// cniConfCheckInterval is how often the CNI config is checked against the
+// one rendered last.
+const cniConfCheckInterval = 10 * time.Second
+
+var (
+	cniConfMux sync.Mutex
+	// cniConfInstalled is the CNI config rendered last
+	cniConfInstalled []byte
+)
+
+// capabilities of the plugins commonly chained after flannel
+var cniCapabilities = map[string]string{
+	"portmap":   "portMappings",
+	"bandwidth": "bandwidth",
+}
+
+type cniPlugin struct {
+	Type       string
+	Capability string
+}
+
+// cniConfData is what the CNI config template is executed with.
+type cniConfData struct {
+	*subnetInfo
+	SubnetFile string
+	// Delegate is the plugin of --cni-delegate
+	Delegate string
+	Plugins  []cniPlugin
+}
+
+func cniPlugins(list string) []cniPlugin {
+	plugins := []cniPlugin{}
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			plugins = append(plugins, cniPlugin{t, cniCapabilities[t]})
+		}
+	}
+	return plugins
+}
+
+func loadCNIConfTemplate(path string) (*template.Template, error) {
+	text := defaultCNIConfTemplate
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CNI config template: %v", err)
+		}
+		text = string(data)
+	}
+
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+	return template.New("cni").Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+// writeCNIConf renders --cni-conf-template and installs the result as
+// --cni-conf. The rendered config must be valid JSON, a broken one is
+// never installed.
+func writeCNIConf(si *subnetInfo, subnetFile string) error {
+	tmpl, err := loadCNIConfTemplate(opts.cniConfTemplate)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	data := cniConfData{si, subnetFile, opts.cniDelegate, cniPlugins(opts.cniPlugins)}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return fmt.Errorf("failed to render CNI config: %v", err)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		return fmt.Errorf("rendered CNI config is not valid JSON: %v", err)
+	}
+
+	changed, err := fileutil.WriteFileAtomic(opts.cniConf, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write CNI config: %v", err)
+	}
+	if changed {
+		log.Infof("Installed CNI config %v", opts.cniConf)
+	}
+
+	cniConfMux.Lock()
+	cniConfInstalled = buf.Bytes()
+	cniConfMux.Unlock()
+	return nil
+}
+
+// keepCNIConf restores the CNI config whenever something else, e.g. an init
+// container copying a static conflist, changed or removed it, until ctx is
+// done.
+func keepCNIConf(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cniConfCheckInterval):
+		}
+
+		cniConfMux.Lock()
+		want := cniConfInstalled
+		cniConfMux.Unlock()
+		if want == nil {
+			// not rendered yet
+			continue
+		}
+
+		changed, err := fileutil.WriteFileAtomic(opts.cniConf, want, 0644)
+		if err != nil {
+			log.Errorf("Failed to restore CNI config: %v", err)
+			continue
+		}
+		if changed {
+			log.Warningf("Restored CNI config %v, which was changed or removed", opts.cniConf)
+		}
+	}
+}
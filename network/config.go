@@ -0,0 +1,69 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// NetworkConfigs returns the registry config of each network flanneld
+// would service, as selected by --networks and --watch-networks, with the
+// local backend options applied. Unlike DryRun it needs no Manager, so it
+// also works without an external interface.
+func NetworkConfigs(ctx context.Context, sm subnet.Manager) (map[string]*subnet.Config, error) {
+	names := []string{""}
+	if opts.networks != "" || opts.watchNetworks {
+		result, err := sm.WatchNetworks(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve networks: %v", err)
+		}
+
+		allowed := map[string]bool{}
+		for _, name := range strings.Split(opts.networks, ",") {
+			if name != "" {
+				allowed[name] = true
+			}
+		}
+		names = nil
+		for _, n := range result.Snapshot {
+			if len(allowed) == 0 || allowed[n] {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	configs := map[string]*subnet.Config{}
+	for _, name := range names {
+		config, err := sm.GetNetworkConfig(ctx, name)
+		if err != nil {
+			return nil, wrapError(fmt.Sprintf("retrieve config of network %q", name), err)
+		}
+		if len(opts.backendOverrides) > 0 {
+			config.Backend, err = overlayBackendConfig(config.Backend, opts.backendOverrides)
+			if err != nil {
+				return nil, wrapError("apply local backend options", err)
+			}
+		}
+		configs[name] = config
+	}
+	return configs, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The conntrack entries which would keep flows on a path that changed are
+// deleted with conntrack(8), so that their next packet is routed, and NATed,
+// again.
+
+var (
+	conntrackMissing sync.Once
+	conntrackDeleted = regexp.MustCompile(`(\d+) flow entries have been deleted`)
+)
+
+// flushConntrack deletes the conntrack entries matching the conntrack(8)
+// filter args. desc tells what the entries are in the log.
+func flushConntrack(desc string, args ...string) {
+	out, err := exec.Command("conntrack", append([]string{"-D"}, args...)...).CombinedOutput()
+	m := conntrackDeleted.FindSubmatch(out)
+	switch {
+	case err == nil || m != nil && string(m[1]) == "0":
+		// conntrack fails when nothing matched
+		if m != nil && string(m[1]) != "0" {
+			log.Infof("Deleted %s conntrack entries of %v", m[1], desc)
+		}
+
+	case isNotFound(err):
+		conntrackMissing.Do(func() {
+			log.Warningf("conntrack is not installed, the conntrack entries of changed peers and masquerade rules are not deleted")
+		})
+
+	default:
+		log.Warningf("Failed to delete the conntrack entries of %v: %v: %s", desc, err, bytes.TrimSpace(out))
+	}
+}
+
+func isNotFound(err error) bool {
+	ee, ok := err.(*exec.Error)
+	return ok && ee.Err == exec.ErrNotFound
+}
+
+func maskString(sn ip.IP4Net) string {
+	return ip.IP4(sn.Mask()).String()
+}
+
+// flushPeerConntrack deletes the entries of the flows with the containers of
+// the peer of l, along with its encapsulated traffic, which was sent to
+// publicIP.
+func flushPeerConntrack(l *subnet.Lease, publicIP ip.IP4) {
+	flushConntrack(fmt.Sprintf("flows to %v", l.Subnet), "-d", l.Subnet.IP.String(), "--mask-dst", maskString(l.Subnet))
+	flushConntrack(fmt.Sprintf("flows from %v", l.Subnet), "-s", l.Subnet.IP.String(), "--mask-src", maskString(l.Subnet))
+	flushConntrack(fmt.Sprintf("UDP flows to %v", publicIP), "-d", publicIP.String(), "-p", "udp")
+}
+
+// flushMasqConntrack deletes the entries of the UDP flows from the
+// containers of sn once masquerading was turned on or off. TCP connections
+// cannot survive a change of their source address either way.
+func flushMasqConntrack(sn ip.IP4Net) {
+	flushConntrack(fmt.Sprintf("UDP flows from %v", sn), "-s", sn.IP.String(), "--mask-src", maskString(sn), "-p", "udp")
+}
+
+// flushChangedPeers watches the leases of the other hosts and deletes the
+// conntrack entries of a peer once its lease is gone or its public IP, and
+// so the route to it, changed.
+func (n *Network) flushChangedPeers(ctx context.Context, ownLease *subnet.Lease) {
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, ownLease, evts)
+
+	known := make(map[ip.IP4Net]ip.IP4)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case batch := <-evts:
+			for _, evt := range batch {
+				sn := evt.Lease.Subnet
+
+				switch evt.Type {
+				case subnet.EventAdded:
+					old, ok := known[sn]
+					known[sn] = evt.Lease.Attrs.PublicIP
+					if ok && old != evt.Lease.Attrs.PublicIP {
+						log.Infof("Public IP of %v changed from %v to %v", sn, old, evt.Lease.Attrs.PublicIP)
+						flushPeerConntrack(&evt.Lease, old)
+					}
+
+				case subnet.EventRemoved:
+					delete(known, sn)
+					flushPeerConntrack(&evt.Lease, evt.Lease.Attrs.PublicIP)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/subnet"
+)
+
+var dataplaneDrift = metrics.NewGauge("flannel_dataplane_drift",
+	"Routes or FDB entries which differ from the leases, as of the last check.", "network")
+
+// detectDrift compares the backend's dataplane with the leases of the peers
+// every interval, exporting the number of entries that differ and logging
+// them as they appear and disappear. It does not repair anything, which is
+// up to the backend's own checks, --peer-probe-repair or the admin API.
+func (n *Network) detectDrift(ctx context.Context, bn backend.Network, interval time.Duration) {
+	dd, ok := bn.(backend.DriftDetector)
+	if !ok {
+		log.Infof("Not checking the dataplane of network %v for drift: unsupported by the %v backend", n.Name, n.Config.BackendType)
+		return
+	}
+	defer dataplaneDrift.Delete(n.Name)
+
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, bn.Lease(), evts)
+
+	peers := map[ip.IP4Net]subnet.Lease{}
+	// watched tells whether peers holds the initial snapshot yet, as all
+	// routes would look stale without it
+	watched := false
+	known := map[string]bool{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case batch := <-evts:
+			for _, evt := range batch {
+				if evt.Type == subnet.EventAdded {
+					peers[evt.Lease.Subnet] = evt.Lease
+				} else {
+					delete(peers, evt.Lease.Subnet)
+				}
+			}
+			watched = true
+
+		case <-time.After(interval):
+			if !watched {
+				continue
+			}
+
+			ls := make([]subnet.Lease, 0, len(peers))
+			for _, l := range peers {
+				ls = append(ls, l)
+			}
+			pass := backend.StartLoopPass(n.Name, "drift")
+			pass.Items(len(ls))
+			drift, err := dd.Drift(ls)
+			if err != nil {
+				pass.Error()
+			}
+			pass.Done()
+			if err != nil {
+				log.Warningf("Failed to check the dataplane of network %v for drift: %v", n.Name, err)
+				continue
+			}
+			sort.Strings(drift)
+			dataplaneDrift.Set(float64(len(drift)), n.Name)
+
+			cur := map[string]bool{}
+			for _, d := range drift {
+				cur[d] = true
+				if !known[d] {
+					log.Warningf("Dataplane of network %v drifted from the leases: %v", n.Name, d)
+				}
+			}
+			for d := range known {
+				if !cur[d] {
+					log.Infof("Dataplane of network %v no longer drifted: %v", n.Name, d)
+				}
+			}
+			known = cur
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// DryRun retrieves the config of each network that Run would service,
+// computes the subnet it would acquire and prints the dataplane changes
+// and IP masquerade rules it would make, without touching the system or the
+// registry.
+func (m *Manager) DryRun(ctx context.Context, w io.Writer) error {
+	return m.dryRun(ctx, w, false)
+}
+
+// Plan is DryRun showing the dataplane changes and IP masquerade rules as a
+// diff against the current state of the host, for the backends which can
+// read it: "+" marks what would be added, "=" what is already in place and
+// "-" the entries of the network which are not part of the plan.
+func (m *Manager) Plan(ctx context.Context, w io.Writer) error {
+	return m.dryRun(ctx, w, true)
+}
+
+func (m *Manager) dryRun(ctx context.Context, w io.Writer, diff bool) error {
+	names := []string{""}
+
+	if m.isMultiNetwork() {
+		result, err := m.sm.WatchNetworks(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve networks: %v", err)
+		}
+
+		names = nil
+		for _, n := range result.Snapshot {
+			if m.isNetAllowed(n) {
+				names = append(names, n)
+			}
+		}
+		if len(names) == 0 {
+			fmt.Fprintln(w, "no networks to service")
+		}
+	}
+
+	for _, name := range names {
+		if err := m.dryRunNetwork(ctx, w, name, diff); err != nil {
+			if name != "" {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) dryRunNetwork(ctx context.Context, w io.Writer, name string, diff bool) error {
+	config, err := m.sm.GetNetworkConfig(ctx, name)
+	if err != nil {
+		return wrapError("retrieve network config", err)
+	}
+
+	if len(opts.backendOverrides) > 0 {
+		config.Backend, err = overlayBackendConfig(config.Backend, opts.backendOverrides)
+		if err != nil {
+			return wrapError("apply local backend options", err)
+		}
+	}
+
+	be, err := backend.NewBackend(config.BackendType, m.sm, m.extIface)
+	if err != nil {
+		return wrapError("create backend", err)
+	}
+	if err := backend.CheckFIPS(be, config); err != nil {
+		return err
+	}
+
+	attrs := subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(m.extIface.ExtAddr),
+		BackendType: config.BackendType,
+	}
+
+	plan, err := subnet.PlanLease(ctx, m.sm, name, config, &attrs)
+	if err != nil {
+		return wrapError("plan lease", err)
+	}
+
+	if name != "" {
+		fmt.Fprintf(w, "network %v:\n", name)
+	}
+	fmt.Fprintf(w, "  config: network=%v subnet-len=%v backend=%v\n", config.Network, config.SubnetLen, config.BackendType)
+	if plan.Reused {
+		fmt.Fprintf(w, "  lease: %v (existing lease for %v)\n", plan.Lease.Subnet, attrs.PublicIP)
+	} else {
+		fmt.Fprintf(w, "  lease: %v (new, any free subnet may be picked)\n", plan.Lease.Subnet)
+	}
+	fmt.Fprintf(w, "  peers: %v\n", len(plan.Peers))
+
+	fmt.Fprintln(w, "  dataplane:")
+	if p, ok := be.(backend.Planner); ok {
+		steps, err := p.Plan(config, &plan.Lease, plan.Peers)
+		if err != nil {
+			return wrapError("plan dataplane", err)
+		}
+		if diff {
+			if steps, err = diffDataplane(be, config, &plan.Lease, steps); err != nil {
+				return err
+			}
+		}
+		for _, s := range steps {
+			fmt.Fprintf(w, "    %v\n", s)
+		}
+	} else {
+		fmt.Fprintf(w, "    (not available for the %v backend)\n", config.BackendType)
+	}
+
+	fmt.Fprintln(w, "  IP masquerade:")
+	switch {
+	case m.ipMasq && diff:
+		if err := m.diffMasq(w, newMasqConfig(config, m.noMasq)); err != nil {
+			return err
+		}
+	case m.ipMasq:
+		for _, cmd := range m.fw.PlanMasq(newMasqConfig(config, m.noMasq)) {
+			fmt.Fprintf(w, "    %v\n", cmd)
+		}
+	default:
+		fmt.Fprintln(w, "    (none, --ip-masq is not set)")
+	}
+
+	if opts.mssClamp {
+		fmt.Fprintln(w, "  MSS clamping:")
+		for _, cmd := range m.fw.PlanMSSClamp(config.Network) {
+			fmt.Fprintf(w, "    %v\n", cmd)
+		}
+	}
+
+	fmt.Fprintf(w, "  subnet file: %v\n", m.subnetFilePath(name))
+
+	return nil
+}
+
+func diffDataplane(be backend.Backend, config *subnet.Config, lease *subnet.Lease, steps []string) ([]string, error) {
+	sr, ok := be.(backend.StateReader)
+	if !ok {
+		return append([]string{fmt.Sprintf("# the current state is not available for the %v backend", config.BackendType)}, steps...), nil
+	}
+	current, err := sr.CurrentState(config, lease)
+	if err != nil {
+		return nil, wrapError("read current dataplane", err)
+	}
+	return backend.DiffSteps(steps, current), nil
+}
+
+func (m *Manager) diffMasq(w io.Writer, mc *masqConfig) error {
+	d, err := m.fw.CheckMasq(mc)
+	if err != nil {
+		return wrapError("read current IP masquerade rules", err)
+	}
+
+	if len(d.Missing) == 0 && !d.Misordered {
+		fmt.Fprintln(w, "    = all rules in place")
+	}
+	for _, r := range d.Missing {
+		fmt.Fprintf(w, "    + %v\n", r)
+	}
+	if d.Misordered {
+		fmt.Fprintln(w, "    # the rules would be rewritten in the expected order")
+	}
+	for _, r := range d.Foreign {
+		fmt.Fprintf(w, "    # left alone: %v\n", r)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/coreos/flannel/backend"
+)
+
+// DumpState writes a human readable description of the state of all
+// networks: their leases, backend state and the masquerade rules flannel owns.
+func (m *Manager) DumpState(w io.Writer) {
+	fmt.Fprintf(w, "flannel state dump at %v\n", time.Now().Format(time.RFC3339))
+	extIface := m.externalInterface()
+	fmt.Fprintf(w, "external interface: %v (%v), public IP %v, MTU %v\n",
+		extIface.Iface.Name, extIface.IfaceAddr, extIface.ExtAddr, extIface.MTU())
+
+	m.forEachNetwork(func(n *Network) {
+		n.DumpState(w)
+	})
+
+	if m.policy != nil {
+		m.policy.DumpState(w)
+	}
+}
+
+// DumpState writes the lease, backend state and masquerade rules of the
+// network.
+func (n *Network) DumpState(w io.Writer) {
+	name := n.Name
+	if name == "" {
+		name = "(default)"
+	}
+	fmt.Fprintf(w, "\nnetwork %v:\n", name)
+
+	bn := n.backendNetwork()
+	if bn == nil {
+		fmt.Fprintln(w, "  no lease")
+		return
+	}
+
+	l := bn.Lease()
+	exp := "never (reservation)"
+	if !l.Expiration.IsZero() {
+		exp = l.Expiration.Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "  config: network %v, backend %v\n", n.Config.Network, n.Config.BackendType)
+	fmt.Fprintf(w, "  lease: %v, public IP %v, expires %v\n", l.Subnet, l.Attrs.PublicIP, exp)
+	fmt.Fprintf(w, "  MTU: %v\n", bn.MTU())
+
+	if d, ok := bn.(backend.StateDumper); ok {
+		fmt.Fprintln(w, "  backend state:")
+		d.DumpState(&indentWriter{w: w, prefix: "    "})
+	}
+
+	if !n.IPMasq() {
+		return
+	}
+
+	n.fw.DumpMasq(&indentWriter{w: w, prefix: "  "}, n.masq)
+}
+
+// indentWriter prefixes every line written through it.
+type indentWriter struct {
+	w       io.Writer
+	prefix  string
+	midLine bool
+}
+
+func (iw *indentWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		if !iw.midLine {
+			io.WriteString(iw.w, iw.prefix)
+		}
+		if _, err := io.WriteString(iw.w, line); err != nil {
+			return 0, err
+		}
+		iw.midLine = !strings.HasSuffix(line, "\n")
+	}
+	return len(p), nil
+}
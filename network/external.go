@@ -0,0 +1,143 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// externalFirewall leaves netfilter to someone else, e.g. a central firewall
+// operator. Nothing is installed; the rules flanneld needs are exported
+// instead, in the subnet files and to the hooks, as iptables commands.
+type externalFirewall struct{}
+
+func externalMasqRules(mc *masqConfig) []string {
+	cmds := []string{}
+	for _, r := range rules(mc) {
+		cmds = append(cmds, "iptables -t nat -A POSTROUTING "+strings.Join(r, " "))
+	}
+	if mc.IPv6Network != nil {
+		for _, r := range rules6(mc) {
+			cmds = append(cmds, "ip6tables -t nat -A POSTROUTING "+strings.Join(r, " "))
+		}
+	}
+	return cmds
+}
+
+func externalMSSRule(ipn ip.IP4Net) string {
+	return "iptables -t mangle -A FORWARD " + strings.Join(mssClampRule(ipn), " ")
+}
+
+// externalPortRules accepts the backend's traffic, for ports as returned by
+// backend.PortUser, e.g. "8472/udp".
+func externalPortRules(ports []string) []string {
+	cmds := []string{}
+	for _, p := range ports {
+		port, proto := p, "udp"
+		if i := strings.Index(p, "/"); i >= 0 {
+			port, proto = p[:i], p[i+1:]
+		}
+		cmds = append(cmds, fmt.Sprintf("iptables -t filter -A INPUT -p %v --dport %v -j ACCEPT", proto, port))
+	}
+	return cmds
+}
+
+func (f *externalFirewall) SetupMasq(mc *masqConfig) error {
+	return nil
+}
+
+func (f *externalFirewall) TeardownMasq(mc *masqConfig) error {
+	return nil
+}
+
+func (f *externalFirewall) PlanMasq(mc *masqConfig) []string {
+	return externalMasqRules(mc)
+}
+
+func (f *externalFirewall) DumpMasq(w io.Writer, mc *masqConfig) {
+	fmt.Fprintln(w, "rules exported for the external firewall (not installed by flanneld):")
+	for _, r := range externalMasqRules(mc) {
+		fmt.Fprintf(w, "  %v\n", r)
+	}
+}
+
+// CheckMasq never finds anything to repair, as the rules are not ours.
+func (f *externalFirewall) CheckMasq(mc *masqConfig) (*masqDiff, error) {
+	return &masqDiff{}, nil
+}
+
+func (f *externalFirewall) RepairMasq(mc *masqConfig) error {
+	return nil
+}
+
+func (f *externalFirewall) OpenPorts(ports []string) error {
+	return nil
+}
+
+func (f *externalFirewall) ClosePorts(ports []string) error {
+	return nil
+}
+
+// BlockedPorts reports nothing, as the rules are not ours.
+func (f *externalFirewall) BlockedPorts(ports []string) ([]string, error) {
+	return nil, nil
+}
+
+func (f *externalFirewall) SetupMSSClamp(ipn ip.IP4Net) error {
+	return nil
+}
+
+func (f *externalFirewall) TeardownMSSClamp(ipn ip.IP4Net) error {
+	return nil
+}
+
+func (f *externalFirewall) PlanMSSClamp(ipn ip.IP4Net) []string {
+	return []string{externalMSSRule(ipn)}
+}
+
+// externalRules returns the rules the network needs from the external
+// firewall, or nil if flanneld installs them itself.
+func externalRules(n *Network, bn backend.Network) []string {
+	if _, ok := n.fw.(*externalFirewall); !ok {
+		return nil
+	}
+
+	cmds := []string{}
+	if pu, ok := bn.(backend.PortUser); ok {
+		cmds = append(cmds, externalPortRules(pu.Ports())...)
+	}
+	if n.IPMasq() {
+		cmds = append(cmds, externalMasqRules(n.masq)...)
+	}
+	if opts.mssClamp {
+		cmds = append(cmds, externalMSSRule(n.Config.Network))
+	}
+	return cmds
+}
+
+func rulesPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".rules"
+}
+
+func rulesFileContents(rules []string) []byte {
+	return []byte("# Firewall rules required by flanneld, which does not install them with --firewall=external\n" +
+		strings.Join(rules, "\n") + "\n")
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/subnet"
+)
+
+// masqConfig is what the masquerade rules of a network are built from.
+type masqConfig struct {
+	Network ip.IP4Net
+	// NoMasq are destinations which are never masqueraded
+	NoMasq []ip.IP4Net
+	// IPv6Network is only set with --ipv6-masq
+	IPv6Network *ip.IP6Net
+	// FWMark is the --masq-fwmark bit, 0 to match on the networks only
+	FWMark uint32
+	// HairpinBridge is the --hairpin-bridge, out of which the traffic
+	// DNATed back to the network is masqueraded
+	HairpinBridge string
+}
+
+func newMasqConfig(config *subnet.Config, noMasq []ip.IP4Net) *masqConfig {
+	mc := &masqConfig{Network: config.Network, FWMark: uint32(opts.masqFWMark), HairpinBridge: opts.hairpinBridge}
+	mc.NoMasq = append(mc.NoMasq, config.NoMasqCIDRs...)
+	mc.NoMasq = append(mc.NoMasq, noMasq...)
+	if opts.ipv6Masq {
+		mc.IPv6Network = config.IPv6Network
+	}
+	return mc
+}
+
+// parseCIDRs parses a comma separated list of CIDRs.
+func parseCIDRs(s string) ([]ip.IP4Net, error) {
+	nets := []ip.IP4Net{}
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		_, ipn, err := net.ParseCIDR(c)
+		if err != nil || ipn.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 CIDR %q", c)
+		}
+		nets = append(nets, ip.FromIPNet(ipn))
+	}
+	return nets, nil
+}
+
+// firewall manages the IP masquerade rules of the networks.
+type firewall interface {
+	// SetupMasq installs the rules for mc. Rules which are already in
+	// place are left alone.
+	SetupMasq(mc *masqConfig) error
+	TeardownMasq(mc *masqConfig) error
+	// PlanMasq returns the commands SetupMasq would run, for --dry-run.
+	PlanMasq(mc *masqConfig) []string
+	// DumpMasq writes the rules for mc and whether they are in place.
+	DumpMasq(w io.Writer, mc *masqConfig)
+	// CheckMasq compares the installed rules for mc with the expected ones.
+	CheckMasq(mc *masqConfig) (*masqDiff, error)
+	// RepairMasq reinstalls all rules for mc in the expected order.
+	RepairMasq(mc *masqConfig) error
+	// OpenPorts lets the backend's traffic from other hosts in, for
+	// firewalls which block it by default.
+	OpenPorts(ports []string) error
+	ClosePorts(ports []string) error
+	// BlockedPorts returns the ports the firewall appears to drop traffic
+	// on, for `flanneld check`.
+	BlockedPorts(ports []string) ([]string, error)
+	// SetupMSSClamp clamps the MSS of TCP connections to ipn, i.e. into the
+	// tunnel, to the path MTU.
+	SetupMSSClamp(ipn ip.IP4Net) error
+	TeardownMSSClamp(ipn ip.IP4Net) error
+	PlanMSSClamp(ipn ip.IP4Net) []string
+	// SyncAccounting replaces the rules counting the traffic between our
+	// subnet own and each of the peer subnets, resetting the counters.
+	SyncAccounting(own ip.IP4Net, peers []ip.IP4Net) error
+	TeardownAccounting(own ip.IP4Net) error
+	// ReadAccounting returns the traffic counted per peer subnet.
+	ReadAccounting(own ip.IP4Net) (map[ip.IP4Net]*peerTraffic, error)
+}
+
+// splitPort splits a "port/protocol" as returned by backend.PortUser.
+func splitPort(p string) (string, string) {
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, "udp"
+}
+
+// masqDiff describes how the installed masquerade rules differ from what
+// flannel expects.
+type masqDiff struct {
+	// Missing lists expected rules which are not installed
+	Missing []string
+	// Misordered is set if all rules exist but not in the expected order
+	Misordered bool
+	// Foreign lists rules flannel did not install, including extra copies
+	// of its own, that match the network; they are left alone
+	Foreign []string
+}
+
+// merge adds the differences in o to d and returns d.
+func (d *masqDiff) merge(o *masqDiff) *masqDiff {
+	d.Missing = append(d.Missing, o.Missing...)
+	d.Misordered = d.Misordered || o.Misordered
+	d.Foreign = append(d.Foreign, o.Foreign...)
+	return d
+}
+
+func (d *masqDiff) needsRepair() bool {
+	return len(d.Missing) > 0 || d.Misordered
+}
+
+// diffRules compares the installed rules with the expected ones. isRelated
+// tells whether an unexpected rule concerns the network.
+func diffRules(expected, installed []string, isRelated func(rule string) bool) *masqDiff {
+	d := &masqDiff{}
+
+	want := map[string]bool{}
+	for _, r := range expected {
+		want[r] = true
+	}
+
+	pos := map[string]int{}
+	for i, r := range installed {
+		switch _, seen := pos[r]; {
+		case want[r] && !seen:
+			pos[r] = i
+		case want[r] || isRelated(r):
+			d.Foreign = append(d.Foreign, r)
+		}
+	}
+
+	last := -1
+	for _, r := range expected {
+		p, ok := pos[r]
+		switch {
+		case !ok:
+			d.Missing = append(d.Missing, r)
+		case p < last:
+			d.Misordered = true
+		default:
+			last = p
+		}
+	}
+
+	return d
+}
+
+var (
+	masqChecks = metrics.NewCounter("flannel_ipmasq_checks_total",
+		"Number of IP masquerade rule checks.", "network")
+	masqCheckErrors = metrics.NewCounter("flannel_ipmasq_check_errors_total",
+		"Number of IP masquerade rule checks or repairs that failed.", "network")
+	masqMissingRules = metrics.NewCounter("flannel_ipmasq_missing_rules_total",
+		"Number of IP masquerade rules found missing.", "network")
+	masqRepairs = metrics.NewCounter("flannel_ipmasq_repairs_total",
+		"Number of times missing or misordered IP masquerade rules were restored.", "network")
+	masqForeignRules = metrics.NewGauge("flannel_ipmasq_foreign_rules",
+		"Number of rules not installed by flannel matching the network, as of the last check.", "network")
+)
+
+// checkIPMasq periodically verifies the masquerade rules of the network,
+// logging every difference and restoring missing rules.
+func (n *Network) checkIPMasq(ctx context.Context, interval time.Duration) {
+	lastForeign := ""
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		n.mux.Lock()
+		if n.ipMasq {
+			lastForeign = n.checkIPMasqOnce(lastForeign)
+		}
+		n.mux.Unlock()
+	}
+}
+
+// checkIPMasqOnce does a single check, n.mux must be held. It returns the
+// foreign rules found, which are only logged when they change.
+func (n *Network) checkIPMasqOnce(lastForeign string) string {
+	ipn := n.masq.Network
+	masqChecks.Inc(n.Name)
+	pass := backend.StartLoopPass(n.Name, "ipmasq")
+	defer pass.Done()
+
+	d, err := n.fw.CheckMasq(n.masq)
+	if err != nil {
+		pass.Error()
+		masqCheckErrors.Inc(n.Name)
+		log.Warningf("Failed to check IP masquerade rules for network %v: %v", ipn, err)
+		return lastForeign
+	}
+
+	masqForeignRules.Set(float64(len(d.Foreign)), n.Name)
+	pass.Items(len(n.fw.PlanMasq(n.masq)))
+	foreign := strings.Join(d.Foreign, "\n")
+	if foreign != lastForeign {
+		for _, r := range d.Foreign {
+			log.Warningf("Foreign rule matching network %v, possibly added by another agent: %v", ipn, r)
+		}
+	}
+
+	if !d.needsRepair() {
+		return foreign
+	}
+
+	for _, r := range d.Missing {
+		log.Warningf("IP masquerade rule for network %v is missing: %v", ipn, r)
+	}
+	if d.Misordered {
+		log.Warningf("IP masquerade rules for network %v are out of order", ipn)
+	}
+	masqMissingRules.Add(float64(len(d.Missing)), n.Name)
+
+	if err := n.fw.RepairMasq(n.masq); err != nil {
+		pass.Error()
+		masqCheckErrors.Inc(n.Name)
+		log.Errorf("Failed to restore IP masquerade rules for network %v: %v", ipn, err)
+		return foreign
+	}
+	masqRepairs.Inc(n.Name)
+	log.Infof("Restored IP masquerade rules for network %v", ipn)
+
+	return foreign
+}
+
+func newFirewall(mode string) (firewall, error) {
+	if mode == "auto" {
+		mode = detectFirewall()
+		log.Infof("Using %v for IP masquerade rules", mode)
+	}
+
+	switch mode {
+	case "iptables":
+		return &iptablesFirewall{}, nil
+	case "nftables":
+		return &nftFirewall{}, nil
+	case "firewalld":
+		return &firewalldFirewall{}, nil
+	case "external":
+		log.Info("Leaving the firewall rules to the external firewall")
+		return &externalFirewall{}, nil
+	default:
+		return nil, fmt.Errorf("unknown firewall %q (expected auto, iptables, nftables, firewalld or external)", mode)
+	}
+}
+
+// detectFirewall picks firewalld when it is running, as it would remove our
+// rules on reload otherwise. Else it picks nftables when there is no
+// iptables, or when iptables is the nf_tables based shim, whose rules would
+// race with ours.
+func detectFirewall() string {
+	if firewalldRunning() {
+		return "firewalld"
+	}
+
+	if _, err := exec.LookPath("nft"); err != nil {
+		return "iptables"
+	}
+
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return "nftables"
+	}
+	out, err := exec.Command("iptables", "--version").Output()
+	if err == nil && strings.Contains(string(out), "nf_tables") {
+		return "nftables"
+	}
+
+	return "iptables"
+}
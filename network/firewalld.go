@@ -0,0 +1,269 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// firewalldFirewall installs the masquerade rules as firewalld direct rules
+// and opens the backend ports in the default zone. firewall-cmd is used to
+// talk to firewalld's D-Bus API. Everything goes into both the runtime and
+// the permanent configuration: a firewalld reload rebuilds the runtime
+// rules from the permanent ones and would otherwise wipe ours.
+type firewalldFirewall struct{}
+
+func firewalldRunning() bool {
+	if _, err := exec.LookPath("firewall-cmd"); err != nil {
+		return false
+	}
+	return exec.Command("firewall-cmd", "--state").Run() == nil
+}
+
+func firewallCmd(args ...string) (string, error) {
+	out, err := exec.Command("firewall-cmd", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("firewall-cmd %v: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+// firewallCmdBoth applies the change to the runtime and the permanent
+// configuration.
+func firewallCmdBoth(args ...string) error {
+	if _, err := firewallCmd(args...); err != nil {
+		return err
+	}
+	_, err := firewallCmd(append([]string{"--permanent"}, args...)...)
+	return err
+}
+
+// directRules returns the masquerade rules as arguments of --add-rule, with
+// their position as the priority so firewalld keeps them in order.
+func directRules(mc *masqConfig) [][]string {
+	r := [][]string{}
+	for i, rule := range rules(mc) {
+		r = append(r, append([]string{"ipv4", "nat", "POSTROUTING", strconv.Itoa(i)}, rule...))
+	}
+	if mc.IPv6Network != nil {
+		for i, rule := range rules6(mc) {
+			r = append(r, append([]string{"ipv6", "nat", "POSTROUTING", strconv.Itoa(i)}, rule...))
+		}
+	}
+	return r
+}
+
+// directFamilies returns the families directRules has rules for.
+func directFamilies(mc *masqConfig) []string {
+	if mc.IPv6Network != nil {
+		return []string{"ipv4", "ipv6"}
+	}
+	return []string{"ipv4"}
+}
+
+// expectedRules returns the rules of family as --get-rules lists them,
+// without family, table and chain.
+func expectedRules(mc *masqConfig, family string) []string {
+	expected := []string{}
+	for _, rule := range directRules(mc) {
+		if rule[0] == family {
+			expected = append(expected, strings.Join(rule[3:], " "))
+		}
+	}
+	return expected
+}
+
+func (f *firewalldFirewall) SetupMasq(mc *masqConfig) error {
+	for _, rule := range directRules(mc) {
+		log.Info("Adding firewalld direct rule: ", strings.Join(rule, " "))
+		if err := firewallCmdBoth(append([]string{"--direct", "--add-rule"}, rule...)...); err != nil {
+			return fmt.Errorf("failed to insert IP masquerade rule: %v", err)
+		}
+	}
+	return nil
+}
+
+func (f *firewalldFirewall) TeardownMasq(mc *masqConfig) error {
+	for _, rule := range directRules(mc) {
+		log.Info("Deleting firewalld direct rule: ", strings.Join(rule, " "))
+		if err := firewallCmdBoth(append([]string{"--direct", "--remove-rule"}, rule...)...); err != nil {
+			return fmt.Errorf("failed to delete IP masquerade rule: %v", err)
+		}
+	}
+	return nil
+}
+
+func (f *firewalldFirewall) PlanMasq(mc *masqConfig) []string {
+	cmds := []string{}
+	for _, rule := range directRules(mc) {
+		cmds = append(cmds, "firewall-cmd [--permanent] --direct --add-rule "+strings.Join(rule, " "))
+	}
+	return cmds
+}
+
+// installedRules returns the runtime direct rules of family in nat
+// POSTROUTING as "priority args...", ordered by priority.
+func installedRules(family string) ([]string, error) {
+	out, err := firewallCmd("--direct", "--get-rules", family, "nat", "POSTROUTING")
+	if err != nil {
+		return nil, err
+	}
+
+	installed := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			installed = append(installed, line)
+		}
+	}
+
+	sort.Stable(byPriority(installed))
+	return installed, nil
+}
+
+// byPriority orders "priority args..." rules by priority.
+type byPriority []string
+
+func (l byPriority) Len() int           { return len(l) }
+func (l byPriority) Less(i, j int) bool { return rulePriority(l[i]) < rulePriority(l[j]) }
+func (l byPriority) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func rulePriority(rule string) int {
+	p, _ := strconv.Atoi(strings.Fields(rule)[0])
+	return p
+}
+
+func (f *firewalldFirewall) CheckMasq(mc *masqConfig) (*masqDiff, error) {
+	d := &masqDiff{}
+	for _, family := range directFamilies(mc) {
+		installed, err := installedRules(family)
+		if err != nil {
+			return nil, err
+		}
+
+		n := mc.Network.String()
+		if family == "ipv6" {
+			n = mc.IPv6Network.String()
+		}
+		d.merge(diffRules(expectedRules(mc, family), installed, func(rule string) bool {
+			for _, f := range strings.Fields(rule) {
+				if f == n {
+					return true
+				}
+			}
+			return false
+		}))
+	}
+	return d, nil
+}
+
+// RepairMasq re-adds the missing rules. Unlike with plain iptables there is
+// no need to start over as the priorities keep them in order.
+func (f *firewalldFirewall) RepairMasq(mc *masqConfig) error {
+	return f.SetupMasq(mc)
+}
+
+func (f *firewalldFirewall) DumpMasq(w io.Writer, mc *masqConfig) {
+	d, err := f.CheckMasq(mc)
+	if err != nil {
+		fmt.Fprintf(w, "firewalld direct rules:\n  failed to run firewall-cmd: %v\n", err)
+		return
+	}
+
+	missing := map[string]bool{}
+	for _, r := range d.Missing {
+		missing[r] = true
+	}
+	for _, family := range directFamilies(mc) {
+		fmt.Fprintf(w, "firewalld direct rules (%v nat POSTROUTING):\n", family)
+		for _, r := range expectedRules(mc, family) {
+			status := "present"
+			if missing[r] {
+				status = "MISSING"
+			}
+			fmt.Fprintf(w, "  %v [%v]\n", r, status)
+		}
+	}
+}
+
+func (f *firewalldFirewall) OpenPorts(ports []string) error {
+	for _, p := range ports {
+		log.Infof("Opening port %v in the default firewalld zone", p)
+		if err := firewallCmdBoth("--add-port=" + p); err != nil {
+			return fmt.Errorf("failed to open port %v: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (f *firewalldFirewall) ClosePorts(ports []string) error {
+	for _, p := range ports {
+		log.Infof("Closing port %v in the default firewalld zone", p)
+		if err := firewallCmdBoth("--remove-port=" + p); err != nil {
+			return fmt.Errorf("failed to close port %v: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (f *firewalldFirewall) BlockedPorts(ports []string) ([]string, error) {
+	blocked := []string{}
+	for _, p := range ports {
+		// --query-port prints no and exits with 1 for closed ports
+		out, _ := exec.Command("firewall-cmd", "--query-port="+p).CombinedOutput()
+		switch strings.TrimSpace(string(out)) {
+		case "yes":
+		case "no":
+			blocked = append(blocked, p)
+		default:
+			return nil, fmt.Errorf("firewall-cmd --query-port=%v: %s", p, bytes.TrimSpace(out))
+		}
+	}
+	return blocked, nil
+}
+
+func directMSSRule(ipn ip.IP4Net) []string {
+	return append([]string{"ipv4", "mangle", "FORWARD", "0"}, mssClampRule(ipn)...)
+}
+
+func (f *firewalldFirewall) SetupMSSClamp(ipn ip.IP4Net) error {
+	rule := directMSSRule(ipn)
+	log.Info("Adding firewalld direct rule: ", strings.Join(rule, " "))
+	if err := firewallCmdBoth(append([]string{"--direct", "--add-rule"}, rule...)...); err != nil {
+		return fmt.Errorf("failed to insert MSS clamping rule: %v", err)
+	}
+	return nil
+}
+
+func (f *firewalldFirewall) TeardownMSSClamp(ipn ip.IP4Net) error {
+	rule := directMSSRule(ipn)
+	log.Info("Deleting firewalld direct rule: ", strings.Join(rule, " "))
+	if err := firewallCmdBoth(append([]string{"--direct", "--remove-rule"}, rule...)...); err != nil {
+		return fmt.Errorf("failed to delete MSS clamping rule: %v", err)
+	}
+	return nil
+}
+
+func (f *firewalldFirewall) PlanMSSClamp(ipn ip.IP4Net) []string {
+	return []string{"firewall-cmd [--permanent] --direct --add-rule " + strings.Join(directMSSRule(ipn), " ")}
+}
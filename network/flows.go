@@ -0,0 +1,268 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/ipfix"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// Flows are taken from the conntrack table, which needs byte and packet
+// accounting (sysctl net.netfilter.nf_conntrack_acct=1) for the counts.
+
+const conntrackProc = "/proc/net/nf_conntrack"
+
+// conntrackFlow is one direction of a conntrack entry.
+type conntrackFlow struct {
+	proto            uint8
+	src, dst         ip.IP4
+	srcPort, dstPort uint16
+	packets, octets  uint64
+}
+
+// parseConntrack parses the entries in the format of /proc/net/nf_conntrack
+// and `conntrack -L -o extended`, e.g.
+//
+//	ipv4 2 tcp 6 431999 ESTABLISHED src=10.1.5.2 dst=10.1.7.3 sport=40000
+//	dport=80 packets=10 bytes=1000 src=10.1.7.3 dst=10.1.5.2 sport=80
+//	dport=40000 packets=8 bytes=2000 [ASSURED] mark=0 use=1
+//
+// (on one line) into the flows of the original and reply directions.
+func parseConntrack(r io.Reader) [][2]conntrackFlow {
+	entries := [][2]conntrackFlow{}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[0] != "ipv4" {
+			continue
+		}
+		proto, err := strconv.ParseUint(fields[3], 10, 8)
+		if err != nil {
+			continue
+		}
+
+		var e [2]conntrackFlow
+		e[0].proto, e[1].proto = uint8(proto), uint8(proto)
+		// the keys appear once for each direction
+		seen := map[string]int{}
+		ok := true
+		for _, f := range fields[4:] {
+			i := strings.IndexByte(f, '=')
+			if i < 0 {
+				continue
+			}
+			key, val := f[:i], f[i+1:]
+			dir := seen[key]
+			if dir > 1 {
+				continue
+			}
+			seen[key]++
+
+			fl := &e[dir]
+			switch key {
+			case "src", "dst":
+				a := net.ParseIP(val)
+				if a == nil || a.To4() == nil {
+					ok = false
+					continue
+				}
+				if key == "src" {
+					fl.src = ip.FromIP(a)
+				} else {
+					fl.dst = ip.FromIP(a)
+				}
+			case "sport", "dport":
+				p, _ := strconv.ParseUint(val, 10, 16)
+				if key == "sport" {
+					fl.srcPort = uint16(p)
+				} else {
+					fl.dstPort = uint16(p)
+				}
+			case "packets":
+				fl.packets, _ = strconv.ParseUint(val, 10, 64)
+			case "bytes":
+				fl.octets, _ = strconv.ParseUint(val, 10, 64)
+			}
+		}
+		if ok && seen["src"] == 2 && seen["dst"] == 2 {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// readConntrack reads the conntrack table from /proc, or with the conntrack
+// tool on kernels built without it.
+func readConntrack() ([][2]conntrackFlow, error) {
+	if f, err := os.Open(conntrackProc); err == nil {
+		defer f.Close()
+		return parseConntrack(f), nil
+	}
+
+	out, err := exec.Command("conntrack", "-L", "-o", "extended").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the conntrack table: %v", err)
+	}
+	return parseConntrack(bytes.NewReader(out)), nil
+}
+
+// flowKey identifies a flow across reads of the conntrack table.
+type flowKey struct {
+	proto            uint8
+	src, dst         ip.IP4
+	srcPort, dstPort uint16
+}
+
+func (f *conntrackFlow) key() flowKey {
+	return flowKey{f.proto, f.src, f.dst, f.srcPort, f.dstPort}
+}
+
+// sampled picks 1 in rate flows, consistently across reads.
+func (k flowKey) sampled(rate uint) bool {
+	if rate <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%v %v %v %v %v", k.proto, k.src, k.dst, k.srcPort, k.dstPort)
+	return h.Sum32()%uint32(rate) == 0
+}
+
+type flowState struct {
+	packets, octets uint64
+	start           time.Time
+}
+
+// flowTracker turns the counters of the conntrack entries into the traffic
+// of each flow since the previous read.
+type flowTracker struct {
+	network, own ip.IP4Net
+	sampling     uint
+	flows        map[flowKey]*flowState
+}
+
+// isOverlay returns whether the flow is between one of our containers and
+// one of another host, i.e. goes through the flannel interface.
+func (t *flowTracker) isOverlay(f *conntrackFlow) bool {
+	if !t.network.Contains(f.src) || !t.network.Contains(f.dst) {
+		return false
+	}
+	return t.own.Contains(f.src) != t.own.Contains(f.dst)
+}
+
+// update returns the records of the flows that saw traffic since the last
+// update, and forgets the flows which are gone.
+func (t *flowTracker) update(entries [][2]conntrackFlow, now time.Time) []ipfix.Record {
+	records := []ipfix.Record{}
+	seen := map[flowKey]bool{}
+
+	for _, e := range entries {
+		if !t.isOverlay(&e[0]) || !e[0].key().sampled(t.sampling) {
+			continue
+		}
+
+		for i := range e {
+			f := &e[i]
+			k := f.key()
+			seen[k] = true
+
+			st, ok := t.flows[k]
+			if !ok {
+				st = &flowState{start: now}
+				t.flows[k] = st
+			}
+			if f.octets < st.octets || f.packets < st.packets {
+				// a new entry for the same tuple
+				st.octets, st.packets = 0, 0
+			}
+			if f.packets == st.packets {
+				continue
+			}
+
+			records = append(records, ipfix.Record{
+				Src:     f.src.ToIP(),
+				Dst:     f.dst.ToIP(),
+				SrcPort: f.srcPort,
+				DstPort: f.dstPort,
+				Proto:   f.proto,
+				Octets:  f.octets - st.octets,
+				Packets: f.packets - st.packets,
+				Start:   st.start,
+				End:     now,
+			})
+			st.octets, st.packets = f.octets, f.packets
+		}
+	}
+
+	for k := range t.flows {
+		if !seen[k] {
+			delete(t.flows, k)
+		}
+	}
+	return records
+}
+
+// exportFlows reads the conntrack table every interval and exports the
+// traffic of the flows between our containers and those of other hosts to
+// the IPFIX collector at --flow-export.
+func (n *Network) exportFlows(ctx context.Context, own ip.IP4Net, interval time.Duration) {
+	// tell the networks apart by the observation domain
+	e, err := ipfix.NewExporter(opts.flowExport, uint32(own.IP))
+	if err != nil {
+		log.Errorf("Not exporting the flows of network %v: %v", n.Name, err)
+		return
+	}
+	defer e.Close()
+
+	t := &flowTracker{
+		network:  n.Config.Network,
+		own:      own,
+		sampling: opts.flowSampling,
+		flows:    map[flowKey]*flowState{},
+	}
+
+	log.Infof("Exporting the flows of network %v to %v", n.Name, opts.flowExport)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		entries, err := readConntrack()
+		if err != nil {
+			log.Warningf("Failed to export the flows of network %v: %v", n.Name, err)
+			continue
+		}
+		if err := e.Export(t.update(entries, time.Now())); err != nil {
+			log.Warningf("Failed to export the flows of network %v: %v", n.Name, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+)
+
+// Traffic from a pod to a service backed by a pod on the same bridge is
+// DNATed by the host and sent back out of the bridge it came in on. Unless
+// it is masqueraded, the reply goes straight from pod to pod over the
+// bridge, missing the conntrack entry which would undo the DNAT, and a pod
+// reaching itself needs its bridge port to send frames back where they came
+// from. With --hairpin-bridge flanneld handles both.
+
+// hairpinPorts returns the ports of bridge which do not have hairpin mode
+// on. There are none while the bridge does not exist.
+func hairpinPorts(bridge string) ([]string, error) {
+	dir := filepath.Join("/sys/class/net", bridge, "brif")
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []string{}
+	for _, fi := range fis {
+		mode, err := ioutil.ReadFile(filepath.Join(dir, fi.Name(), "hairpin_mode"))
+		if err != nil {
+			// the port went away
+			continue
+		}
+		if strings.TrimSpace(string(mode)) != "1" {
+			ports = append(ports, fi.Name())
+		}
+	}
+	return ports, nil
+}
+
+// syncHairpin turns hairpin mode on for every port of bridge.
+func syncHairpin(bridge string) error {
+	ports, err := hairpinPorts(bridge)
+	if err != nil {
+		return fmt.Errorf("failed to list the ports of %v: %v", bridge, err)
+	}
+
+	for _, p := range ports {
+		path := filepath.Join("/sys/class/net", bridge, "brif", p, "hairpin_mode")
+		if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to turn on hairpin mode on %v: %v", p, err)
+		}
+		log.V(1).Infof("Turned on hairpin mode on port %v of %v", p, bridge)
+	}
+	return nil
+}
+
+// keepHairpin turns hairpin mode on for the ports of bridge as the pods
+// come, until ctx is done.
+func keepHairpin(ctx context.Context, bridge string) {
+	links := make(chan netlink.LinkUpdate, 16)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		// the subscription only notices done once it receives the next
+		// message, which it must not block on sending
+		if links != nil {
+			go func(c chan netlink.LinkUpdate) {
+				for range c {
+				}
+			}(links)
+		}
+	}()
+
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		log.Errorf("Failed to watch the links, hairpin mode will not be turned on for the ports of %v: %v", bridge, err)
+		links = nil
+		return
+	}
+
+	log.Infof("Turning on hairpin mode for the ports of %v", bridge)
+	if err := syncHairpin(bridge); err != nil {
+		log.Error(err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case _, ok := <-links:
+			if !ok {
+				log.Errorf("Link subscription closed, hairpin mode will no longer be turned on for the ports of %v", bridge)
+				links = nil
+				return
+			}
+			if err := syncHairpin(bridge); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"reflect"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// runHook runs command via /bin/sh with env added to our environment and
+// waits for it to finish. Failures are only logged.
+func runHook(desc, command string, env []string) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+
+	log.Infof("Running %v: %q", desc, command)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warningf("%v failed: %v: %s", desc, err, bytes.TrimSpace(out))
+	}
+}
+
+func hookEnv(netname string, env ...string) []string {
+	if netname != "" {
+		env = append(env, "FLANNEL_NETWORK_NAME="+netname)
+	}
+	return env
+}
+
+func leaseEnv(netname string, evt subnet.Event) []string {
+	name := "added"
+	if evt.Type == subnet.EventRemoved {
+		name = "removed"
+	}
+
+	l := evt.Lease
+	return hookEnv(netname,
+		"FLANNEL_EVENT="+name,
+		"FLANNEL_LEASE_SUBNET="+l.Subnet.String(),
+		"FLANNEL_LEASE_PUBLIC_IP="+l.Attrs.PublicIP.String(),
+		"FLANNEL_LEASE_BACKEND_TYPE="+l.Attrs.BackendType,
+		"FLANNEL_LEASE_BACKEND_DATA="+string(l.Attrs.BackendData))
+}
+
+func peerHooksEnabled() bool {
+	return opts.leaseAddedHook != "" || opts.leaseRemovedHook != ""
+}
+
+// runPeerHooks watches the leases of the other hosts in the network and runs
+// --lease-added-hook and --lease-removed-hook as they come and go. Hooks are
+// run one at a time, in the order of the events. Renewals of a lease whose
+// attributes did not change are not reported.
+func (n *Network) runPeerHooks(ctx context.Context, ownLease *subnet.Lease) {
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, ownLease, evts)
+
+	known := make(map[string]subnet.LeaseAttrs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case batch := <-evts:
+			for _, evt := range batch {
+				key := evt.Lease.Key()
+
+				switch evt.Type {
+				case subnet.EventAdded:
+					if attrs, ok := known[key]; ok && reflect.DeepEqual(attrs, evt.Lease.Attrs) {
+						continue
+					}
+					known[key] = evt.Lease.Attrs
+					if opts.leaseAddedHook != "" {
+						runHook("lease added hook", opts.leaseAddedHook, leaseEnv(n.Name, evt))
+					}
+
+				case subnet.EventRemoved:
+					delete(known, key)
+					if opts.leaseRemovedHook != "" {
+						runHook("lease removed hook", opts.leaseRemovedHook, leaseEnv(n.Name, evt))
+					}
+				}
+			}
+		}
+	}
+}
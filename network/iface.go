@@ -0,0 +1,496 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/publicip"
+)
+
+// how long links and addresses must be left alone before the external
+// interface is selected again, so a flapping link or a bond failover
+// results in a single restart
+const ifaceSettle = 3 * time.Second
+
+// ifaceSelector picks the external interface among the --iface candidates,
+// then the --iface-regex ones, in order, never picking an --iface-exclude
+// interface.
+type ifaceSelector struct {
+	candidates []string
+	regexes    []*regexp.Regexp
+	excludes   []*regexp.Regexp
+
+	host ifaceHost
+}
+
+// ifaceHost is what the selection needs to know about the interfaces of the
+// host.
+type ifaceHost interface {
+	Interfaces() ([]net.Interface, error)
+	// IP4Addrs returns the IPv4 addresses of iface
+	IP4Addrs(iface *net.Interface) ([]net.IP, error)
+	DefaultGatewayIface() (*net.Interface, error)
+}
+
+type hostIfaces struct{}
+
+func (hostIfaces) Interfaces() ([]net.Interface, error) {
+	return net.Interfaces()
+}
+
+func (hostIfaces) IP4Addrs(iface *net.Interface) ([]net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			ips = append(ips, ipn.IP.To4())
+		}
+	}
+	return ips, nil
+}
+
+func (hostIfaces) DefaultGatewayIface() (*net.Interface, error) {
+	return ip.GetDefaultGatewayIface()
+}
+
+func compileRegexes(flagName, s string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range strings.Split(s, ",") {
+		if expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %v", flagName, expr, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func newIfaceSelector() (*ifaceSelector, error) {
+	s := &ifaceSelector{host: hostIfaces{}}
+	for _, c := range strings.Split(opts.iface, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			s.candidates = append(s.candidates, c)
+		}
+	}
+
+	var err error
+	if s.regexes, err = compileRegexes("--iface-regex", opts.ifaceRegex); err != nil {
+		return nil, err
+	}
+	if s.excludes, err = compileRegexes("--iface-exclude", opts.ifaceExclude); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ifaceSelector) excluded(iface *net.Interface) bool {
+	for _, re := range s.excludes {
+		if re.MatchString(iface.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// usable returns the IPv4 address to use on the interface, or why it
+// cannot be used. addr, if set, is the address the interface was picked by.
+// Otherwise a global unicast address is preferred over a link-local one.
+func (s *ifaceSelector) usable(iface *net.Interface, addr net.IP) (net.IP, error) {
+	switch {
+	case s.excluded(iface):
+		return nil, fmt.Errorf("excluded by --iface-exclude")
+	case iface.Flags&net.FlagUp == 0:
+		return nil, fmt.Errorf("down")
+	case addr != nil:
+		return addr, nil
+	}
+
+	addrs, err := s.host.IP4Addrs(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses: %v", err)
+	}
+
+	var ll net.IP
+	for _, a := range addrs {
+		if a.IsGlobalUnicast() {
+			return a, nil
+		}
+		if a.IsLinkLocalUnicast() && ll == nil {
+			ll = a
+		}
+	}
+	if ll == nil {
+		return nil, fmt.Errorf("no IPv4 address")
+	}
+	return ll, nil
+}
+
+func (s *ifaceSelector) tryCandidate(c string) (*net.Interface, net.IP, error) {
+	ifaces, err := s.host.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr := net.ParseIP(c)
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if addr == nil {
+			if iface.Name == c {
+				a, err := s.usable(iface, nil)
+				return iface, a, err
+			}
+			continue
+		}
+
+		if s.hasAddr(iface, addr) {
+			a, err := s.usable(iface, addr)
+			return iface, a, err
+		}
+	}
+
+	if addr != nil {
+		return nil, nil, fmt.Errorf("no interface has address %v", addr)
+	}
+	return nil, nil, fmt.Errorf("no such interface")
+}
+
+// matchRegex returns the first usable interface whose name or one of whose
+// IPv4 addresses matches re, with the address. Like the regular expressions
+// of the other flags, re is not anchored.
+func (s *ifaceSelector) matchRegex(re *regexp.Regexp, v int) (*net.Interface, net.IP) {
+	ifaces, err := s.host.Interfaces()
+	if err != nil {
+		log.Warningf("Failed to list the interfaces: %v", err)
+		return nil, nil
+	}
+
+	for i := range ifaces {
+		iface := &ifaces[i]
+
+		var match net.IP
+		if !re.MatchString(iface.Name) {
+			if match = s.matchAddr(iface, re); match == nil {
+				continue
+			}
+		}
+
+		addr, err := s.usable(iface, match)
+		if err != nil {
+			log.V(v).Infof("Interface %v matches --iface-regex %q but is not usable: %v", iface.Name, re, err)
+			continue
+		}
+		return iface, addr
+	}
+	return nil, nil
+}
+
+func (s *ifaceSelector) hasAddr(iface *net.Interface, addr net.IP) bool {
+	addrs, err := s.host.IP4Addrs(iface)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr returns the first IPv4 address of iface matching re.
+func (s *ifaceSelector) matchAddr(iface *net.Interface, re *regexp.Regexp) net.IP {
+	addrs, err := s.host.IP4Addrs(iface)
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if re.MatchString(a.String()) {
+			return a
+		}
+	}
+	return nil
+}
+
+// selectIface logs, at level v, why each candidate was passed over.
+func (s *ifaceSelector) selectIface(v int) (*net.Interface, net.IP, error) {
+	for _, c := range s.candidates {
+		iface, addr, err := s.tryCandidate(c)
+		if err == nil {
+			log.V(v).Infof("Selected interface %v (%v) from --iface %q", iface.Name, addr, c)
+			return iface, addr, nil
+		}
+		log.V(v).Infof("Skipping --iface %q: %v", c, err)
+	}
+
+	for _, re := range s.regexes {
+		if iface, addr := s.matchRegex(re, v); iface != nil {
+			log.V(v).Infof("Selected interface %v (%v) from --iface-regex %q", iface.Name, addr, re)
+			return iface, addr, nil
+		}
+		log.V(v).Infof("No usable interface matches --iface-regex %q", re)
+	}
+
+	if len(s.candidates) > 0 || len(s.regexes) > 0 {
+		return nil, nil, fmt.Errorf("none of the interfaces given by --iface or --iface-regex is usable")
+	}
+
+	log.V(v).Info("Determining IP address of default interface")
+	iface, err := s.host.DefaultGatewayIface()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get default interface: %s", err)
+	}
+	addr, err := s.usable(iface, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("default interface %v is not usable: %v", iface.Name, err)
+	}
+	return iface, addr, nil
+}
+
+// mayPick reports if a change of iface can make the selection differ: if
+// it is the interface in use, or one selectIface may pick. Other links,
+// such as the veths of the pods coming and going, are not worth selecting
+// again for.
+func (s *ifaceSelector) mayPick(iface *net.Interface, cur string) bool {
+	if iface.Name == cur {
+		return true
+	}
+	if s.excluded(iface) {
+		return false
+	}
+
+	if len(s.candidates) == 0 && len(s.regexes) == 0 {
+		def, err := s.host.DefaultGatewayIface()
+		return err != nil || def.Name == iface.Name
+	}
+
+	for _, c := range s.candidates {
+		if addr := net.ParseIP(c); c == iface.Name || addr != nil && s.hasAddr(iface, addr) {
+			return true
+		}
+	}
+	for _, re := range s.regexes {
+		if re.MatchString(iface.Name) || s.matchAddr(iface, re) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupExtIface selects the external interface, logging the selection at
+// level v.
+func lookupExtIface(v int) (*backend.ExternalInterface, error) {
+	s, err := newIfaceSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	iface, iaddr, err := s.selectIface(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if iface.MTU == 0 {
+		return nil, fmt.Errorf("failed to determine MTU for %s interface", iaddr)
+	}
+
+	var eaddr net.IP
+
+	switch {
+	case len(opts.publicIP) > 0 && len(opts.publicIPFrom) > 0:
+		return nil, fmt.Errorf("--public-ip and --public-ip-from are mutually exclusive")
+
+	case len(opts.publicIP) > 0:
+		eaddr = net.ParseIP(opts.publicIP)
+		if eaddr == nil {
+			return nil, fmt.Errorf("invalid public IP address: %s", opts.publicIP)
+		}
+
+	case len(opts.publicIPFrom) > 0:
+		d := &publicip.Discoverer{STUNServer: opts.stunServer}
+		if eaddr, err = d.Discover(opts.publicIPFrom, iaddr); err != nil {
+			return nil, err
+		}
+		log.V(v).Infof("Discovered public IP %v with --public-ip-from=%v", eaddr, opts.publicIPFrom)
+	}
+
+	if eaddr == nil {
+		eaddr = iaddr
+	}
+
+	log.V(v).Infof("Using %s as external interface", iaddr)
+	log.V(v).Infof("Using %s as external endpoint", eaddr)
+
+	return &backend.ExternalInterface{
+		Iface:     iface,
+		IfaceAddr: iaddr,
+		ExtAddr:   eaddr,
+	}, nil
+}
+
+func sameExtIface(a, b *backend.ExternalInterface) bool {
+	return a.Iface.Name == b.Iface.Name && a.IfaceAddr.Equal(b.IfaceAddr) && a.ExtAddr.Equal(b.ExtAddr)
+}
+
+func (m *Manager) externalInterface() *backend.ExternalInterface {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.extIface
+}
+
+// switchExtIface has the networks restarted on extIface.
+func (m *Manager) switchExtIface(extIface *backend.ExternalInterface) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.nextExtIface = extIface
+	if m.restartNetworks != nil {
+		m.restartNetworks()
+	}
+}
+
+// watchExtIface has the networks follow the MTU of the external interface
+// and, with --iface-watch, selects the external interface again whenever
+// links or addresses change, switching to it if it is not the one in use.
+func (m *Manager) watchExtIface(ctx context.Context) {
+	links := make(chan netlink.LinkUpdate, 16)
+	addrs := make(chan netlink.AddrUpdate, 16)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		// the subscriptions only notice done once they receive the next
+		// message, which they must not block on sending
+		if links != nil {
+			go func(c chan netlink.LinkUpdate) {
+				for range c {
+				}
+			}(links)
+		}
+		if addrs != nil {
+			go func(c chan netlink.AddrUpdate) {
+				for range c {
+				}
+			}(addrs)
+		}
+	}()
+
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		log.Errorf("Failed to watch the links, changes of the external interface will not be followed: %v", err)
+		links, addrs = nil, nil
+		return
+	}
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		log.Errorf("Failed to watch the addresses, changes of the external interface will not be followed: %v", err)
+		addrs = nil
+		return
+	}
+
+	s, err := newIfaceSelector()
+	if err != nil {
+		log.Errorf("Invalid interface selection, changes of the external interface will not be followed: %v", err)
+		return
+	}
+
+	settle := time.NewTimer(ifaceSettle)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case upd, ok := <-links:
+			if !ok {
+				log.Error("Link subscription closed, changes of the external interface will no longer be followed")
+				links = nil
+				continue
+			}
+			m.followExtIfaceMTU(upd)
+			if opts.ifaceWatch && upd.Link != nil {
+				attrs := upd.Attrs()
+				if s.mayPick(&net.Interface{Index: attrs.Index, Name: attrs.Name}, m.externalInterface().Iface.Name) {
+					settle.Reset(ifaceSettle)
+				}
+			}
+
+		case upd, ok := <-addrs:
+			if !ok {
+				log.Error("Address subscription closed, the external interface will no longer be re-selected")
+				addrs = nil
+				continue
+			}
+			if opts.ifaceWatch {
+				// the link may be gone already, which is worth a look
+				iface, err := net.InterfaceByIndex(upd.LinkIndex)
+				if err != nil || s.mayPick(iface, m.externalInterface().Iface.Name) {
+					settle.Reset(ifaceSettle)
+				}
+			}
+
+		case <-settle.C:
+			cur := m.externalInterface()
+			extIface, err := lookupExtIface(1)
+			switch {
+			case err != nil:
+				log.Warningf("Failed to re-select the external interface, staying on %v: %v", cur.Iface.Name, err)
+
+			case !sameExtIface(extIface, cur):
+				log.Warningf("External interface changed from %v (%v, public %v) to %v (%v, public %v); restarting the networks",
+					cur.Iface.Name, cur.IfaceAddr, cur.ExtAddr,
+					extIface.Iface.Name, extIface.IfaceAddr, extIface.ExtAddr)
+				m.switchExtIface(extIface)
+				return
+			}
+		}
+	}
+}
+
+// followExtIfaceMTU has the networks follow the MTU of the external
+// interface if upd changed it.
+func (m *Manager) followExtIfaceMTU(upd netlink.LinkUpdate) {
+	if upd.Link == nil || upd.Header.Type == syscall.RTM_DELLINK {
+		return
+	}
+	cur := m.externalInterface()
+	attrs := upd.Attrs()
+	if attrs.Index != cur.Iface.Index || attrs.MTU == 0 || attrs.MTU == cur.MTU() {
+		return
+	}
+
+	log.Infof("MTU of external interface %v changed from %v to %v", cur.Iface.Name, cur.MTU(), attrs.MTU)
+	cur.SetMTU(attrs.MTU)
+	m.forEachNetwork(func(n *Network) {
+		n.notifyUplinkMTU()
+	})
+}
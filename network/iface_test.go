@@ -0,0 +1,220 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+)
+
+type fakeIface struct {
+	name  string
+	up    bool
+	addrs []string
+}
+
+type fakeHost struct {
+	ifaces []fakeIface
+	def    string
+}
+
+func (h *fakeHost) Interfaces() ([]net.Interface, error) {
+	ifaces := []net.Interface{}
+	for i, f := range h.ifaces {
+		iface := net.Interface{Index: i + 1, Name: f.name, MTU: 1500}
+		if f.up {
+			iface.Flags = net.FlagUp
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+func (h *fakeHost) IP4Addrs(iface *net.Interface) ([]net.IP, error) {
+	for _, f := range h.ifaces {
+		if f.name != iface.Name {
+			continue
+		}
+		ips := []net.IP{}
+		for _, a := range f.addrs {
+			ips = append(ips, net.ParseIP(a).To4())
+		}
+		return ips, nil
+	}
+	return nil, fmt.Errorf("no such interface")
+}
+
+func (h *fakeHost) DefaultGatewayIface() (*net.Interface, error) {
+	ifaces, _ := h.Interfaces()
+	for i := range ifaces {
+		if ifaces[i].Name == h.def {
+			return &ifaces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find default route")
+}
+
+func newTestHost() *fakeHost {
+	return &fakeHost{
+		ifaces: []fakeIface{
+			{"lo", true, []string{"127.0.0.1"}},
+			{"bond0", false, []string{"10.0.0.5"}},
+			{"eth0", true, []string{"169.254.1.1", "10.0.0.12"}},
+			{"eth1", true, []string{"192.168.1.7"}},
+			{"docker0", true, []string{"10.0.0.1"}},
+			{"veth1234", true, nil},
+		},
+		def: "eth1",
+	}
+}
+
+func testSelector(t *testing.T, candidates []string, regexes, excludes string) *ifaceSelector {
+	s := &ifaceSelector{candidates: candidates, host: newTestHost()}
+
+	var err error
+	if s.regexes, err = compileRegexes("--iface-regex", regexes); err != nil {
+		t.Fatalf("compileRegexes failed: %v", err)
+	}
+	if s.excludes, err = compileRegexes("--iface-exclude", excludes); err != nil {
+		t.Fatalf("compileRegexes failed: %v", err)
+	}
+	return s
+}
+
+func TestSelectIface(t *testing.T) {
+	for _, tc := range []struct {
+		candidates []string
+		regexes    string
+		excludes   string
+		iface      string
+		addr       string
+	}{
+		// the default route, without --iface or --iface-regex
+		{nil, "", "", "eth1", "192.168.1.7"},
+		// bond0 is down
+		{[]string{"bond0", "eth0"}, "", "", "eth0", "10.0.0.12"},
+		{[]string{"missing", "192.168.1.7"}, "", "", "eth1", "192.168.1.7"},
+		// --iface is tried before --iface-regex
+		{[]string{"eth1"}, "^eth0$", "", "eth1", "192.168.1.7"},
+		{[]string{"bond0"}, "^eth", "", "eth0", "10.0.0.12"},
+		// the regexes in order, the interfaces in the order of their index
+		{nil, `^192\.,^10\.0\.`, "", "eth1", "192.168.1.7"},
+		{nil, `^10\.0\.`, "", "eth0", "10.0.0.12"},
+		// not anchored: 10.0.0.1 matches 10.0.0.12 too
+		{nil, `10\.0\.0\.1`, "", "eth0", "10.0.0.12"},
+		{nil, `^10\.0\.0\.1$`, "", "docker0", "10.0.0.1"},
+		// --iface-exclude wins over both
+		{[]string{"eth0"}, "", "^eth0$", "", ""},
+		{[]string{"docker0", "eth1"}, "", "^(docker|veth)", "eth1", "192.168.1.7"},
+		{nil, `^10\.0\.`, "^eth", "docker0", "10.0.0.1"},
+		// no address
+		{[]string{"veth1234"}, "", "", "", ""},
+	} {
+		s := testSelector(t, tc.candidates, tc.regexes, tc.excludes)
+		iface, addr, err := s.selectIface(1)
+		if tc.iface == "" {
+			if err == nil {
+				t.Errorf("%v %q -%q: expected no interface, got %v", tc.candidates, tc.regexes, tc.excludes, iface.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v %q -%q: selectIface failed: %v", tc.candidates, tc.regexes, tc.excludes, err)
+			continue
+		}
+		if iface.Name != tc.iface || !addr.Equal(net.ParseIP(tc.addr)) {
+			t.Errorf("%v %q -%q: expected %v (%v), got %v (%v)", tc.candidates, tc.regexes, tc.excludes, tc.iface, tc.addr, iface.Name, addr)
+		}
+	}
+}
+
+func TestUsable(t *testing.T) {
+	s := testSelector(t, nil, "", "^docker")
+	ifaces, _ := s.host.Interfaces()
+
+	for _, tc := range []struct {
+		iface int
+		addr  string
+	}{
+		{1, ""},
+		// prefers the global address over the link-local one
+		{2, "10.0.0.12"},
+		{3, "192.168.1.7"},
+		{4, ""},
+		{5, ""},
+	} {
+		addr, err := s.usable(&ifaces[tc.iface], nil)
+		switch {
+		case tc.addr == "" && err == nil:
+			t.Errorf("%v: expected not to be usable, got %v", ifaces[tc.iface].Name, addr)
+		case tc.addr != "" && (err != nil || !addr.Equal(net.ParseIP(tc.addr))):
+			t.Errorf("%v: expected %v, got %v (%v)", ifaces[tc.iface].Name, tc.addr, addr, err)
+		}
+	}
+
+	// the address the interface was picked by is kept
+	if addr, err := s.usable(&ifaces[2], net.ParseIP("169.254.1.1")); err != nil || !addr.Equal(net.ParseIP("169.254.1.1")) {
+		t.Errorf("expected the given address, got %v (%v)", addr, err)
+	}
+}
+
+func TestMatchRegex(t *testing.T) {
+	s := testSelector(t, nil, "", "")
+	iface, addr := s.matchRegex(regexp.MustCompile("^eth"), 1)
+	if iface == nil || iface.Name != "eth0" || !addr.Equal(net.ParseIP("10.0.0.12")) {
+		t.Errorf("expected eth0 (10.0.0.12), got %v (%v)", iface, addr)
+	}
+
+	// the address of an interface matched by name is its preferred one,
+	// that of an interface matched by address the matching one
+	iface, addr = s.matchRegex(regexp.MustCompile(`^169\.254\.`), 1)
+	if iface == nil || iface.Name != "eth0" || !addr.Equal(net.ParseIP("169.254.1.1")) {
+		t.Errorf("expected eth0 (169.254.1.1), got %v (%v)", iface, addr)
+	}
+
+	if iface, _ := s.matchRegex(regexp.MustCompile("^bond"), 1); iface != nil {
+		t.Errorf("expected no interface, got %v", iface.Name)
+	}
+}
+
+func TestMayPick(t *testing.T) {
+	for _, tc := range []struct {
+		candidates []string
+		regexes    string
+		excludes   string
+		iface      string
+		mayPick    bool
+	}{
+		{nil, "", "", "eth1", true},
+		{nil, "", "", "veth1234", false},
+		{[]string{"bond0", "eth0"}, "", "", "bond0", true},
+		{[]string{"bond0", "eth0"}, "", "", "veth1234", false},
+		{[]string{"192.168.1.7"}, "", "", "eth1", true},
+		{[]string{"192.168.1.7"}, "", "", "docker0", false},
+		{nil, `^10\.0\.`, "", "docker0", true},
+		{nil, `^10\.0\.`, "^docker", "docker0", false},
+		{nil, `^10\.0\.`, "", "veth1234", false},
+		{nil, "^veth", "", "veth1234", true},
+		// the interface in use always counts
+		{[]string{"bond0"}, "", "", "eth0", true},
+	} {
+		s := testSelector(t, tc.candidates, tc.regexes, tc.excludes)
+		if got := s.mayPick(&net.Interface{Name: tc.iface}, "eth0"); got != tc.mayPick {
+			t.Errorf("%v %q -%q: expected mayPick(%v)=%v, got %v", tc.candidates, tc.regexes, tc.excludes, tc.iface, tc.mayPick, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"flag"
+	"net/http"
+	"runtime"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/version"
+)
+
+var (
+	buildInfo = metrics.NewGauge("flannel_build_info",
+		"Always 1, with the version, commit and Go version flanneld was built with.", "version", "git_sha", "go_version")
+	featureEnabled = metrics.NewGauge("flannel_feature_enabled",
+		"Always 1, for each option set explicitly on the command line, in the environment or in the config file.", "feature")
+	networkInfo = metrics.NewGauge("flannel_network_info",
+		"Always 1, with the backend of each network.", "network", "backend")
+)
+
+// features returns the names of the options set explicitly, as values may
+// be secrets.
+func features() []string {
+	fs := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		fs = append(fs, f.Name)
+	})
+	sort.Strings(fs)
+	return fs
+}
+
+func currentBuildInfo() *subnet.BuildInfo {
+	return &subnet.BuildInfo{
+		Version:  version.Version,
+		GitSHA:   version.GitSHA,
+		Features: features(),
+	}
+}
+
+// exportBuildInfo sets the build and feature metrics.
+func exportBuildInfo() {
+	buildInfo.Set(1, version.Version, version.GitSHA, runtime.Version())
+	for _, f := range features() {
+		featureEnabled.Set(1, f)
+	}
+}
+
+// leaseAttrsManager records the build info in the attributes of the leases
+// the backends acquire, so that the registry tells which flanneld each host
+// runs, along with the --rate-limit the other hosts are to honour.
+type leaseAttrsManager struct {
+	subnet.Manager
+}
+
+func (m leaseAttrsManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	a := *attrs
+	a.Build = currentBuildInfo()
+	a.RateLimit = opts.rateLimit
+	return m.Manager.AcquireLease(ctx, network, &a)
+}
+
+type apiInfo struct {
+	subnet.BuildInfo
+	GoVersion string
+	// Backends is the backend of each network, by name ("" in
+	// single-network mode)
+	Backends map[string]string
+}
+
+// GET /v1/info
+func (m *Manager) handleAPIInfo(w http.ResponseWriter, r *http.Request) {
+	info := &apiInfo{
+		BuildInfo: *currentBuildInfo(),
+		GoVersion: runtime.Version(),
+		Backends:  map[string]string{},
+	}
+	m.forEachNetwork(func(n *Network) {
+		if n.Config != nil {
+			info.Backends[n.Name] = n.Config.BackendType
+		}
+	})
+	apiJSON(w, http.StatusOK, info)
+}
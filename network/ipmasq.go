@@ -15,58 +15,565 @@
 package network
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
 	"strings"
-
-	"github.com/coreos/go-iptables/iptables"
-	log "github.com/golang/glog"
+	"sync"
 
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
 )
 
-func rules(ipn ip.IP4Net) [][]string {
-	n := ipn.String()
+func rules(mc *masqConfig) [][]string {
+	n := mc.Network.String()
+	r := hairpinRules(mc, n)
 
-	return [][]string{
-		// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
-		{"-s", n, "-d", n, "-j", "RETURN"},
+	// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
+	r = append(r, []string{"-s", n, "-d", n, "-j", "RETURN"})
+	// Nor traffic to destinations excluded with --no-masq-cidrs or NoMasqCIDRs
+	for _, d := range mc.NoMasq {
+		r = append(r, []string{"-s", n, "-d", d.String(), "-j", "RETURN"})
+	}
+
+	r = append(r,
 		// NAT if it's not multicast traffic
-		{"-s", n, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE"},
+		append([]string{"-s", n, "!", "-d", "224.0.0.0/4"}, masqTarget(mc)...),
 		// Masquerade anything headed towards flannel from the host
-		{"!", "-s", n, "-d", n, "-j", "MASQUERADE"},
+		append([]string{"!", "-s", n, "-d", n}, masqTarget(mc)...),
+	)
+	return append(r, markRules(mc)...)
+}
+
+// rules6 are the IPv6 equivalent of rules, for the IPv6 network.
+func rules6(mc *masqConfig) [][]string {
+	n := mc.IPv6Network.String()
+
+	r := append(hairpinRules(mc, n),
+		[]string{"-s", n, "-d", n, "-j", "RETURN"},
+		append([]string{"-s", n, "!", "-d", "ff00::/8"}, masqTarget(mc)...),
+		append([]string{"!", "-s", n, "-d", n}, masqTarget(mc)...),
+	)
+	return append(r, markRules(mc)...)
+}
+
+// hairpinRules masquerade the traffic within network n which was DNATed
+// back out of the --hairpin-bridge, for the replies to come through the
+// host.
+func hairpinRules(mc *masqConfig, n string) [][]string {
+	if mc.HairpinBridge == "" {
+		return nil
 	}
+	return [][]string{
+		append([]string{"-s", n, "-d", n, "-o", mc.HairpinBridge, "-m", "conntrack", "--ctstate", "DNAT"}, masqTarget(mc)...),
+	}
+}
+
+// masqTarget masquerades right away, or with --masq-fwmark only marks the
+// packet for markRules to masquerade.
+func masqTarget(mc *masqConfig) []string {
+	if mc.FWMark == 0 {
+		return []string{"-j", "MASQUERADE"}
+	}
+	return []string{"-j", "MARK", "--set-xmark", fmt.Sprintf("%#x/%#x", mc.FWMark, mc.FWMark)}
+}
+
+// markRules masquerade the marked packets, clearing the mark again so that
+// other users of the packet mark see it as it was.
+func markRules(mc *masqConfig) [][]string {
+	if mc.FWMark == 0 {
+		return nil
+	}
+
+	m := fmt.Sprintf("%#x/%#x", mc.FWMark, mc.FWMark)
+	return [][]string{
+		{"-m", "mark", "!", "--mark", m, "-j", "RETURN"},
+		{"-j", "MARK", "--set-xmark", fmt.Sprintf("0x0/%#x", mc.FWMark)},
+		{"-j", "MASQUERADE"},
+	}
+}
+
+// iptablesFamily runs the iptables tools of one address family.
+type iptablesFamily struct {
+	cmd     string
+	restore string
+
+	waitOnce sync.Once
+	wait     bool
 }
 
-func setupIPMasq(ipn ip.IP4Net) error {
-	ipt, err := iptables.New()
+var (
+	ip4tables = &iptablesFamily{cmd: "iptables", restore: "iptables-restore"}
+	ip6tables = &iptablesFamily{cmd: "ip6tables", restore: "ip6tables-restore"}
+)
+
+// waitArgs returns --wait if the tools support waiting for the xtables
+// lock, which both do from the same version on.
+func (fam *iptablesFamily) waitArgs() []string {
+	fam.waitOnce.Do(func() {
+		out, _ := exec.Command(fam.restore, "--help").CombinedOutput()
+		fam.wait = bytes.Contains(out, []byte("--wait"))
+	})
+
+	if fam.wait {
+		return []string{"--wait"}
+	}
+	return nil
+}
+
+// runRestore feeds payload to iptables-restore, leaving everything it does
+// not mention alone.
+func (fam *iptablesFamily) runRestore(payload string) error {
+	cmd := exec.Command(fam.restore, append([]string{"--noflush"}, fam.waitArgs()...)...)
+	cmd.Stdin = strings.NewReader(payload)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v: %s", fam.restore, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (fam *iptablesFamily) listChain(table, chain string) ([]string, error) {
+	args := append(fam.waitArgs(), "-t", table, "-S", chain)
+	out, err := exec.Command(fam.cmd, args...).CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to set up IP Masquerade. iptables was not found")
+		return nil, fmt.Errorf("%v: %v: %s", fam.cmd, err, bytes.TrimSpace(out))
 	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), nil
+}
 
-	for _, rule := range rules(ipn) {
-		log.Info("Adding iptables rule: ", strings.Join(rule, " "))
-		err = ipt.AppendUnique("nat", "POSTROUTING", rule...)
-		if err != nil {
-			return fmt.Errorf("failed to insert IP masquerade rule: %v", err)
+// iptablesFirewall keeps the masquerade rules of each network in a chain of
+// its own in the nat table, jumped to from POSTROUTING. A chain and its
+// jump are written with a single iptables-restore transaction, rather than
+// one iptables call per rule, so that other agents never see half of the
+// rules and startup stays fast on hosts with many rules.
+type iptablesFirewall struct{}
+
+func iptablesChain(kind string, ipn ip.IP4Net) string {
+	return fmt.Sprintf("FLANNEL-%v-%08X-%d", kind, uint32(ipn.IP), ipn.PrefixLen)
+}
+
+func masqChain(mc *masqConfig) string {
+	return iptablesChain("POSTRTG", mc.Network)
+}
+
+// masqChain6 is named after the IPv4 network too, as IPv6 networks are too
+// long for chain names.
+func masqChain6(mc *masqConfig) string {
+	return iptablesChain("POSTRTG6", mc.Network)
+}
+
+func jumpRule(parent, chain string) string {
+	return fmt.Sprintf("-A %v -j %v", parent, chain)
+}
+
+func chainRule(chain string, rule []string) string {
+	return fmt.Sprintf("-A %v %v", chain, strings.Join(rule, " "))
+}
+
+// setupPayload replaces the contents of chain with rules, adds the jump from
+// parent unless it exists and deletes the given rules from parent, which
+// older versions of flannel installed there directly. Declaring the chain
+// flushes it, or creates it if it does not exist.
+func setupPayload(table, parent, chain string, rules [][]string, addJump bool, legacy [][]string) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%v\n", table)
+	fmt.Fprintf(buf, ":%v - [0:0]\n", chain)
+	for _, r := range rules {
+		fmt.Fprintln(buf, chainRule(chain, r))
+	}
+	if addJump {
+		fmt.Fprintln(buf, jumpRule(parent, chain))
+	}
+	for _, r := range legacy {
+		fmt.Fprintf(buf, "-D %v %v\n", parent, strings.Join(r, " "))
+	}
+	fmt.Fprintln(buf, "COMMIT")
+	return buf.String()
+}
+
+// teardownPayload removes the given number of jumps to chain from parent,
+// then the chain itself.
+func teardownPayload(table, parent, chain string, jumps int) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%v\n", table)
+	for i := 0; i < jumps; i++ {
+		fmt.Fprintf(buf, "-D %v -j %v\n", parent, chain)
+	}
+	fmt.Fprintf(buf, ":%v - [0:0]\n", chain)
+	fmt.Fprintf(buf, "-X %v\n", chain)
+	fmt.Fprintln(buf, "COMMIT")
+	return buf.String()
+}
+
+func countLines(lines []string, line string) int {
+	n := 0
+	for _, l := range lines {
+		if l == line {
+			n++
+		}
+	}
+	return n
+}
+
+func (fam *iptablesFamily) setupChain(table, parent, chain string, rules, legacy [][]string) error {
+	parentRules, err := fam.listChain(table, parent)
+	if err != nil {
+		return fmt.Errorf("failed to list %v %v: %v", table, parent, err)
+	}
+
+	present := [][]string{}
+	for _, r := range legacy {
+		if countLines(parentRules, chainRule(parent, r)) > 0 {
+			log.Infof("Removing rule installed by an older flannel version: %v", chainRule(parent, r))
+			present = append(present, r)
+		}
+	}
+
+	addJump := countLines(parentRules, jumpRule(parent, chain)) == 0
+	return fam.runRestore(setupPayload(table, parent, chain, rules, addJump, present))
+}
+
+func (fam *iptablesFamily) teardownChain(table, parent, chain string) error {
+	parentRules, err := fam.listChain(table, parent)
+	if err != nil {
+		return fmt.Errorf("failed to list %v %v: %v", table, parent, err)
+	}
+
+	return fam.runRestore(teardownPayload(table, parent, chain, countLines(parentRules, jumpRule(parent, chain))))
+}
+
+// checkChain compares chain and the jump to it with the expected rules.
+// Rules in parent mentioning network are reported as foreign.
+func (fam *iptablesFamily) checkChain(table, parent, chain string, rules [][]string, network string) (*masqDiff, error) {
+	parentRules, err := fam.listChain(table, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %v %v: %v", table, parent, err)
+	}
+
+	expected := []string{}
+	for _, rule := range rules {
+		expected = append(expected, chainRule(chain, rule))
+	}
+
+	// the chain is missing altogether if it cannot be listed
+	installed, _ := fam.listChain(table, chain)
+	d := diffRules(expected, installed, func(rule string) bool {
+		// everything else in our chain, except for its declaration
+		return !strings.HasPrefix(rule, "-N ")
+	})
+
+	jump := jumpRule(parent, chain)
+	for _, rule := range parentRules {
+		if rule == jump {
+			continue
+		}
+		for _, f := range strings.Fields(rule) {
+			if f == network {
+				d.Foreign = append(d.Foreign, rule)
+				break
+			}
+		}
+	}
+
+	switch countLines(parentRules, jump) {
+	case 0:
+		d.Missing = append(d.Missing, jump)
+	case 1:
+	default:
+		d.Foreign = append(d.Foreign, jump)
+	}
+
+	return d, nil
+}
+
+func (f *iptablesFirewall) SetupMasq(mc *masqConfig) error {
+	log.Infof("Setting up iptables chain %v", masqChain(mc))
+	// older versions installed the rules without a mark
+	legacy := *mc
+	legacy.FWMark, legacy.HairpinBridge = 0, ""
+	if err := ip4tables.setupChain("nat", "POSTROUTING", masqChain(mc), rules(mc), rules(&legacy)); err != nil {
+		return fmt.Errorf("failed to set up IP masquerade rules: %v", err)
+	}
+
+	if mc.IPv6Network != nil {
+		log.Infof("Setting up ip6tables chain %v", masqChain6(mc))
+		if err := ip6tables.setupChain("nat", "POSTROUTING", masqChain6(mc), rules6(mc), nil); err != nil {
+			return fmt.Errorf("failed to set up IPv6 masquerade rules: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (f *iptablesFirewall) TeardownMasq(mc *masqConfig) error {
+	log.Infof("Deleting iptables chain %v", masqChain(mc))
+	if err := ip4tables.teardownChain("nat", "POSTROUTING", masqChain(mc)); err != nil {
+		return fmt.Errorf("failed to delete IP masquerade rules: %v", err)
+	}
+
+	if mc.IPv6Network != nil {
+		log.Infof("Deleting ip6tables chain %v", masqChain6(mc))
+		if err := ip6tables.teardownChain("nat", "POSTROUTING", masqChain6(mc)); err != nil {
+			return fmt.Errorf("failed to delete IPv6 masquerade rules: %v", err)
 		}
 	}
 
 	return nil
 }
 
-func teardownIPMasq(ipn ip.IP4Net) error {
-	ipt, err := iptables.New()
+func planPayload(fam *iptablesFamily, payload string) []string {
+	lines := []string{fam.restore + " --noflush <<EOF"}
+	lines = append(lines, strings.Split(strings.TrimSuffix(payload, "\n"), "\n")...)
+	return append(lines, "EOF")
+}
+
+func (f *iptablesFirewall) PlanMasq(mc *masqConfig) []string {
+	cmds := planPayload(ip4tables, setupPayload("nat", "POSTROUTING", masqChain(mc), rules(mc), true, nil))
+	if mc.IPv6Network != nil {
+		cmds = append(cmds, planPayload(ip6tables, setupPayload("nat", "POSTROUTING", masqChain6(mc), rules6(mc), true, nil))...)
+	}
+	return cmds
+}
+
+func (f *iptablesFirewall) CheckMasq(mc *masqConfig) (*masqDiff, error) {
+	d, err := ip4tables.checkChain("nat", "POSTROUTING", masqChain(mc), rules(mc), mc.Network.String())
+	if err != nil || mc.IPv6Network == nil {
+		return d, err
+	}
+
+	d6, err := ip6tables.checkChain("nat", "POSTROUTING", masqChain6(mc), rules6(mc), mc.IPv6Network.String())
 	if err != nil {
-		return fmt.Errorf("failed to teardown IP Masquerade. iptables was not found")
+		return nil, err
+	}
+	return d.merge(d6), nil
+}
+
+// RepairMasq rewrites the whole chains, which also restores the order.
+func (f *iptablesFirewall) RepairMasq(mc *masqConfig) error {
+	return f.SetupMasq(mc)
+}
+
+func dumpChain(w io.Writer, parent, chain string, rules [][]string, d *masqDiff) {
+	missing := map[string]bool{}
+	for _, r := range d.Missing {
+		missing[r] = true
+	}
+
+	lines := []string{jumpRule(parent, chain)}
+	for _, rule := range rules {
+		lines = append(lines, chainRule(chain, rule))
+	}
+	for _, l := range lines {
+		status := "present"
+		if missing[l] {
+			status = "MISSING"
+		}
+		fmt.Fprintf(w, "  %v [%v]\n", l, status)
 	}
+}
+
+func (f *iptablesFirewall) DumpMasq(w io.Writer, mc *masqConfig) {
+	fmt.Fprintf(w, "iptables rules (nat %v):\n", masqChain(mc))
+	d, err := f.CheckMasq(mc)
+	if err != nil {
+		fmt.Fprintf(w, "  failed to run iptables: %v\n", err)
+		return
+	}
+
+	dumpChain(w, "POSTROUTING", masqChain(mc), rules(mc), d)
+	if mc.IPv6Network != nil {
+		fmt.Fprintf(w, "ip6tables rules (nat %v):\n", masqChain6(mc))
+		dumpChain(w, "POSTROUTING", masqChain6(mc), rules6(mc), d)
+	}
+	for _, l := range d.Foreign {
+		fmt.Fprintf(w, "  %v [foreign]\n", l)
+	}
+}
+
+// OpenPorts does nothing, as ports blocked by other iptables rules are up
+// to the administrator.
+func (f *iptablesFirewall) OpenPorts(ports []string) error {
+	return nil
+}
+
+func (f *iptablesFirewall) ClosePorts(ports []string) error {
+	return nil
+}
+
+// BlockedPorts looks at the filter INPUT chain for the first rule that
+// accepts or drops traffic to each port, falling back to the policy of the
+// chain. Rules with conditions other than the protocol and port, unless the
+// port is matched, and jumps to other chains, are not followed.
+func (f *iptablesFirewall) BlockedPorts(ports []string) ([]string, error) {
+	rules, err := ip4tables.listChain("filter", "INPUT")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filter INPUT: %v", err)
+	}
+
+	blocked := []string{}
+	for _, p := range ports {
+		if iptablesBlocks(rules, p) {
+			blocked = append(blocked, p)
+		}
+	}
+	return blocked, nil
+}
+
+func iptablesBlocks(rules []string, port string) bool {
+	num, proto := splitPort(port)
+	policy := ""
 
-	for _, rule := range rules(ipn) {
-		log.Info("Deleting iptables rule: ", strings.Join(rule, " "))
-		err = ipt.Delete("nat", "POSTROUTING", rule...)
+	for _, r := range rules {
+		f := strings.Fields(r)
+		if len(f) == 3 && f[0] == "-P" {
+			policy = f[2]
+			continue
+		}
+		if len(f) < 2 || f[0] != "-A" {
+			continue
+		}
+
+		m := parseIptablesRule(f[2:])
+		if m.target != "ACCEPT" && m.target != "DROP" && m.target != "REJECT" {
+			continue
+		}
+		if m.proto != "" && (m.proto == proto || m.proto == "all") == m.notProto {
+			continue
+		}
+		if m.dport != "" {
+			if portListHas(m.dport, num) == m.notDport {
+				continue
+			}
+		} else if m.conditions {
+			// e.g. -i lo, ! -s or -m state, which may or may not apply
+			continue
+		}
+
+		return m.target != "ACCEPT"
+	}
+
+	return policy == "DROP"
+}
+
+// iptablesMatch is the part of a rule listed by iptables -S that
+// iptablesBlocks understands.
+type iptablesMatch struct {
+	proto    string
+	notProto bool
+	dport    string
+	notDport bool
+	// conditions is set if the rule matches on anything else
+	conditions bool
+	target     string
+}
+
+// parseIptablesRule reads the arguments of a rule after "-A CHAIN". Options
+// which follow the target, such as --reject-with or --log-prefix, belong to
+// the target and do not restrict the rule.
+func parseIptablesRule(args []string) iptablesMatch {
+	m := iptablesMatch{}
+	neg := false
+
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		if opt == "!" {
+			neg = true
+			continue
+		}
+
+		// an option takes the arguments up to the next option; quoted
+		// arguments, such as comments, may contain spaces
+		j := i + 1
+		for j < len(args) && args[j] != "!" && !strings.HasPrefix(args[j], "-") {
+			if strings.HasPrefix(args[j], `"`) {
+				for !strings.HasSuffix(args[j], `"`) && j+1 < len(args) {
+					j++
+				}
+			}
+			j++
+		}
+		val := strings.Join(args[i+1:j], " ")
+		i = j - 1
+
+		switch opt {
+		case "-j", "--jump", "-g", "--goto":
+			m.target = val
+			return m
+		case "-p", "--protocol":
+			m.proto, m.notProto = val, neg
+		case "--dport", "--destination-port", "--dports", "--destination-ports":
+			m.dport, m.notDport = val, neg
+		case "-m", "--match", "--comment":
+		default:
+			m.conditions = true
+		}
+		neg = false
+	}
+
+	return m
+}
+
+// portListHas reports if num is in a list of ports and port ranges as
+// accepted by --dport and the multiport --dports.
+func portListHas(list, num string) bool {
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range strings.Split(list, ",") {
+		lo, hi := p, p
+		if i := strings.Index(p, ":"); i >= 0 {
+			lo, hi = p[:i], p[i+1:]
+		}
+		l, err := strconv.Atoi(lo)
+		if lo == "" {
+			l, err = 0, nil
+		}
 		if err != nil {
-			return fmt.Errorf("failed to delete IP masquerade rule: %v", err)
+			continue
 		}
+		h, err := strconv.Atoi(hi)
+		if hi == "" {
+			h, err = 65535, nil
+		}
+		if err != nil {
+			continue
+		}
+		if l <= n && n <= h {
+			return true
+		}
+	}
+	return false
+}
+
+func mssClampRule(ipn ip.IP4Net) []string {
+	return []string{"-d", ipn.String(), "-p", "tcp", "-m", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+}
+
+func mssChain(ipn ip.IP4Net) string {
+	return iptablesChain("MSS", ipn)
+}
+
+func (f *iptablesFirewall) SetupMSSClamp(ipn ip.IP4Net) error {
+	log.Infof("Setting up iptables chain %v", mssChain(ipn))
+	rules := [][]string{mssClampRule(ipn)}
+	if err := ip4tables.setupChain("mangle", "FORWARD", mssChain(ipn), rules, rules); err != nil {
+		return fmt.Errorf("failed to set up MSS clamping: %v", err)
 	}
+	return nil
+}
 
+func (f *iptablesFirewall) TeardownMSSClamp(ipn ip.IP4Net) error {
+	log.Infof("Deleting iptables chain %v", mssChain(ipn))
+	if err := ip4tables.teardownChain("mangle", "FORWARD", mssChain(ipn)); err != nil {
+		return fmt.Errorf("failed to tear down MSS clamping: %v", err)
+	}
 	return nil
 }
+
+func (f *iptablesFirewall) PlanMSSClamp(ipn ip.IP4Net) []string {
+	return planPayload(ip4tables, setupPayload("mangle", "FORWARD", mssChain(ipn), [][]string{mssClampRule(ipn)}, true, nil))
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func testMasqConfig() *masqConfig {
+	_, n, _ := net.ParseCIDR("10.1.0.0/16")
+	_, nm, _ := net.ParseCIDR("192.168.0.0/24")
+	return &masqConfig{Network: ip.FromIPNet(n), NoMasq: []ip.IP4Net{ip.FromIPNet(nm)}}
+}
+
+func TestSetupPayload(t *testing.T) {
+	plain := testMasqConfig()
+
+	fwmark := testMasqConfig()
+	fwmark.FWMark = 0x4000
+
+	hairpin := testMasqConfig()
+	hairpin.HairpinBridge = "cni0"
+
+	for _, tc := range []struct {
+		name     string
+		rules    [][]string
+		addJump  bool
+		legacy   [][]string
+		expected string
+	}{
+		{"plain", rules(plain), true, nil, `*nat
+:FLANNEL-POSTRTG-0A010000-16 - [0:0]
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 10.1.0.0/16 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 192.168.0.0/24 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 ! -d 224.0.0.0/4 -j MASQUERADE
+-A FLANNEL-POSTRTG-0A010000-16 ! -s 10.1.0.0/16 -d 10.1.0.0/16 -j MASQUERADE
+-A POSTROUTING -j FLANNEL-POSTRTG-0A010000-16
+COMMIT
+`},
+		{"fwmark", rules(fwmark), true, nil, `*nat
+:FLANNEL-POSTRTG-0A010000-16 - [0:0]
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 10.1.0.0/16 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 192.168.0.0/24 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 ! -d 224.0.0.0/4 -j MARK --set-xmark 0x4000/0x4000
+-A FLANNEL-POSTRTG-0A010000-16 ! -s 10.1.0.0/16 -d 10.1.0.0/16 -j MARK --set-xmark 0x4000/0x4000
+-A FLANNEL-POSTRTG-0A010000-16 -m mark ! --mark 0x4000/0x4000 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -j MARK --set-xmark 0x0/0x4000
+-A FLANNEL-POSTRTG-0A010000-16 -j MASQUERADE
+-A POSTROUTING -j FLANNEL-POSTRTG-0A010000-16
+COMMIT
+`},
+		{"hairpin", rules(hairpin), true, nil, `*nat
+:FLANNEL-POSTRTG-0A010000-16 - [0:0]
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 10.1.0.0/16 -o cni0 -m conntrack --ctstate DNAT -j MASQUERADE
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 10.1.0.0/16 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 192.168.0.0/24 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 ! -d 224.0.0.0/4 -j MASQUERADE
+-A FLANNEL-POSTRTG-0A010000-16 ! -s 10.1.0.0/16 -d 10.1.0.0/16 -j MASQUERADE
+-A POSTROUTING -j FLANNEL-POSTRTG-0A010000-16
+COMMIT
+`},
+		// the jump exists already and the rules of an older version are
+		// deleted in the same transaction
+		{"legacy", rules(fwmark), false, rules(plain)[2:], `*nat
+:FLANNEL-POSTRTG-0A010000-16 - [0:0]
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 10.1.0.0/16 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 -d 192.168.0.0/24 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -s 10.1.0.0/16 ! -d 224.0.0.0/4 -j MARK --set-xmark 0x4000/0x4000
+-A FLANNEL-POSTRTG-0A010000-16 ! -s 10.1.0.0/16 -d 10.1.0.0/16 -j MARK --set-xmark 0x4000/0x4000
+-A FLANNEL-POSTRTG-0A010000-16 -m mark ! --mark 0x4000/0x4000 -j RETURN
+-A FLANNEL-POSTRTG-0A010000-16 -j MARK --set-xmark 0x0/0x4000
+-A FLANNEL-POSTRTG-0A010000-16 -j MASQUERADE
+-D POSTROUTING -s 10.1.0.0/16 ! -d 224.0.0.0/4 -j MASQUERADE
+-D POSTROUTING ! -s 10.1.0.0/16 -d 10.1.0.0/16 -j MASQUERADE
+COMMIT
+`},
+	} {
+		if got := setupPayload("nat", "POSTROUTING", masqChain(plain), tc.rules, tc.addJump, tc.legacy); got != tc.expected {
+			t.Errorf("%v: unexpected payload:\n%v\nexpected:\n%v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestSetupPayloadIPv6(t *testing.T) {
+	n6, err := ip.ParseIP6Net("fd00:1::/64")
+	if err != nil {
+		t.Fatalf("ParseIP6Net failed: %v", err)
+	}
+
+	mc := testMasqConfig()
+	mc.IPv6Network = &n6
+	mc.FWMark = 0x4000
+
+	expected := `*nat
+:FLANNEL-POSTRTG6-0A010000-16 - [0:0]
+-A FLANNEL-POSTRTG6-0A010000-16 -s fd00:1::/64 -d fd00:1::/64 -j RETURN
+-A FLANNEL-POSTRTG6-0A010000-16 -s fd00:1::/64 ! -d ff00::/8 -j MARK --set-xmark 0x4000/0x4000
+-A FLANNEL-POSTRTG6-0A010000-16 ! -s fd00:1::/64 -d fd00:1::/64 -j MARK --set-xmark 0x4000/0x4000
+-A FLANNEL-POSTRTG6-0A010000-16 -m mark ! --mark 0x4000/0x4000 -j RETURN
+-A FLANNEL-POSTRTG6-0A010000-16 -j MARK --set-xmark 0x0/0x4000
+-A FLANNEL-POSTRTG6-0A010000-16 -j MASQUERADE
+-A POSTROUTING -j FLANNEL-POSTRTG6-0A010000-16
+COMMIT
+`
+	if got := setupPayload("nat", "POSTROUTING", masqChain6(mc), rules6(mc), true, nil); got != expected {
+		t.Errorf("unexpected payload:\n%v\nexpected:\n%v", got, expected)
+	}
+}
+
+func TestTeardownPayload(t *testing.T) {
+	expected := `*nat
+-D POSTROUTING -j FLANNEL-POSTRTG-0A010000-16
+-D POSTROUTING -j FLANNEL-POSTRTG-0A010000-16
+:FLANNEL-POSTRTG-0A010000-16 - [0:0]
+-X FLANNEL-POSTRTG-0A010000-16
+COMMIT
+`
+	if got := teardownPayload("nat", "POSTROUTING", masqChain(testMasqConfig()), 2); got != expected {
+		t.Errorf("unexpected payload:\n%v\nexpected:\n%v", got, expected)
+	}
+}
+
+func TestMarkRules(t *testing.T) {
+	mc := testMasqConfig()
+	if r := markRules(mc); r != nil {
+		t.Errorf("expected no mark rules without a mark, got %v", r)
+	}
+
+	mc.FWMark = 0x80
+	expected := []string{
+		"-m mark ! --mark 0x80/0x80 -j RETURN",
+		"-j MARK --set-xmark 0x0/0x80",
+		"-j MASQUERADE",
+	}
+	r := markRules(mc)
+	if len(r) != len(expected) {
+		t.Fatalf("expected %v mark rules, got %v", len(expected), r)
+	}
+	for i := range r {
+		if got := strings.Join(r[i], " "); got != expected[i] {
+			t.Errorf("mark rule %d: expected %q, got %q", i, expected[i], got)
+		}
+	}
+}
+
+func TestIptablesBlocks(t *testing.T) {
+	rhel := []string{
+		"-P INPUT ACCEPT",
+		"-A INPUT -m state --state RELATED,ESTABLISHED -j ACCEPT",
+		"-A INPUT -p icmp -j ACCEPT",
+		"-A INPUT -i lo -j ACCEPT",
+		"-A INPUT -p tcp -m state --state NEW -m tcp --dport 22 -j ACCEPT",
+		"-A INPUT -j REJECT --reject-with icmp-host-prohibited",
+	}
+
+	for i, tc := range []struct {
+		rules   []string
+		port    string
+		blocked bool
+	}{
+		{rhel, "8285", true},
+		{rhel, "22/tcp", false},
+		{append(rhel[:1:1], append([]string{"-A INPUT -p udp -m udp --dport 8285 -j ACCEPT"}, rhel[1:]...)...), "8285", false},
+		{[]string{"-P INPUT ACCEPT"}, "8285", false},
+		{[]string{"-P INPUT DROP"}, "8285", true},
+		{[]string{"-P INPUT DROP", "-A INPUT -p tcp -m tcp --dport 8285 -j ACCEPT"}, "8285", true},
+		{[]string{"-P INPUT DROP", "-A INPUT -p udp -m multiport --dports 8000:9000,22 -j ACCEPT"}, "8285", false},
+		{[]string{"-P INPUT ACCEPT", "-A INPUT -p udp -m udp ! --dport 22 -j DROP"}, "8285", true},
+		{[]string{"-P INPUT ACCEPT", "-A INPUT -p udp -m udp ! --dport 8285 -j DROP"}, "8285", false},
+		{[]string{"-P INPUT ACCEPT", "-A INPUT ! -s 10.0.0.0/8 -j DROP"}, "8285", false},
+		{[]string{"-P INPUT ACCEPT", "-A INPUT ! -p tcp -j DROP"}, "8285", true},
+		{[]string{"-P INPUT ACCEPT", "-A INPUT -j LOG --log-prefix \"input: \"", "-A INPUT -j DROP"}, "8285", true},
+		{[]string{"-P INPUT ACCEPT", "-A INPUT -m comment --comment \"no - udp\" -j DROP"}, "8285", true},
+		{[]string{"-P INPUT DROP", "-A INPUT -j ACCEPT"}, "8285", false},
+	} {
+		if got := iptablesBlocks(tc.rules, tc.port); got != tc.blocked {
+			t.Errorf("case %d: expected blocked=%v for %v, got %v", i, tc.blocked, tc.port, got)
+		}
+	}
+}
+
+func TestPortListHas(t *testing.T) {
+	for _, tc := range []struct {
+		list string
+		num  string
+		has  bool
+	}{
+		{"8285", "8285", true},
+		{"8285", "8286", false},
+		{"22,8285", "8285", true},
+		{"8000:9000", "8285", true},
+		{"9000:", "8285", false},
+		{":9000", "8285", true},
+	} {
+		if got := portListHas(tc.list, tc.num); got != tc.has {
+			t.Errorf("portListHas(%q, %q): expected %v, got %v", tc.list, tc.num, tc.has, got)
+		}
+	}
+}
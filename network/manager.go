@@ -19,44 +19,156 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"net"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/logging"
 	"github.com/coreos/flannel/subnet"
 )
 
 type CmdLineOpts struct {
-	publicIP      string
-	ipMasq        bool
-	subnetFile    string
-	subnetDir     string
-	iface         string
-	networks      string
-	watchNetworks bool
+	publicIP          string
+	publicIPFrom      string
+	stunServer        string
+	ipMasq            bool
+	subnetFile        string
+	subnetDir         string
+	iface             string
+	ifaceRegex        string
+	ifaceExclude      string
+	ifaceWatch        bool
+	networks          string
+	watchNetworks     bool
+	gracefulRestart   bool
+	subnetFileJSON    bool
+	subnetNotify      string
+	postStartupHook   string
+	leaseAddedHook    string
+	leaseRemovedHook  string
+	notifyWebhook     string
+	notifyNATS        string
+	notifyNATSSubject string
+	cniConf           string
+	cniConfTemplate   string
+	cniPlugins        string
+	cniDelegate       string
+	firewall          string
+	ipMasqCheck       time.Duration
+	noMasqCIDRs       string
+	ipv6Masq          bool
+	masqFWMark        uint
+	mssClamp          bool
+	flushConntrack    bool
+	peerTraffic       time.Duration
+	peerProbe         time.Duration
+	peerProbeTimeout  time.Duration
+	peerProbeFailures int
+	peerProbeRepair   bool
+	flowExport        string
+	flowInterval      time.Duration
+	flowSampling      uint
+	driftCheck        time.Duration
+	backendCheck      time.Duration
+	mtuDiscovery      time.Duration
+	mtuProbe          bool
+	checkpointDir     string
+	releaseLease      bool
+	networkPolicy     bool
+	kubeBandwidth     bool
+	rateLimit         string
+	hairpinBridge     string
+	kubeAPIServer     string
+	kubeTokenFile     string
+	kubeCAFile        string
+	kubeNodeName      string
+	// backend options from the config file, overlaid on the network config
+	backendOverrides map[string]interface{}
 }
 
 var errAlreadyExists = errors.New("already exists")
 
+// readinessRetries is the number of failed attempts to initialize after
+// which readiness no longer waits for a network known at startup.
+const readinessRetries = 10
+
 var opts CmdLineOpts
 
 func init() {
 	flag.StringVar(&opts.publicIP, "public-ip", "", "IP accessible by other nodes for inter-host communication")
+	flag.StringVar(&opts.publicIPFrom, "public-ip-from", "", "discover the public IP of a node behind 1:1 NAT from a STUN server (stun) or the cloud metadata service (ec2, gce or azure), instead of using the IP of the interface")
+	flag.StringVar(&opts.stunServer, "public-ip-stun-server", "stun.l.google.com:19302", "STUN server (host:port) to query with --public-ip-from=stun")
 	flag.StringVar(&opts.subnetFile, "subnet-file", "/run/flannel/subnet.env", "filename where env variables (subnet, MTU, ... ) will be written to")
 	flag.StringVar(&opts.subnetDir, "subnet-dir", "/run/flannel/networks", "directory where files with env variables (subnet, MTU, ...) will be written to")
-	flag.StringVar(&opts.iface, "iface", "", "interface to use (IP or name) for inter-host communication")
+	flag.StringVar(&opts.iface, "iface", "", "comma separated list of interfaces (IP or name) to use for inter-host communication, in order of preference; the first one that is up and has an IPv4 address is used")
+	flag.StringVar(&opts.ifaceRegex, "iface-regex", "", "comma separated list of regular expressions matched against the names and IPv4 addresses of the interfaces, in order of preference, tried after --iface; they are not anchored, so use ^ and $ to match a whole name or address")
+	flag.StringVar(&opts.ifaceExclude, "iface-exclude", "", "comma separated list of regular expressions of the names of interfaces never to use")
+	flag.BoolVar(&opts.ifaceWatch, "iface-watch", true, "select the external interface again when links or addresses change, and restart the networks on it if it changed")
 	flag.StringVar(&opts.networks, "networks", "", "run in multi-network mode and service the specified networks")
 	flag.BoolVar(&opts.watchNetworks, "watch-networks", false, "run in multi-network mode and watch for networks from 'networks' or all networks")
 	flag.BoolVar(&opts.ipMasq, "ip-masq", false, "setup IP masquerade rule for traffic destined outside of overlay network")
+	flag.StringVar(&opts.noMasqCIDRs, "no-masq-cidrs", "", "comma separated list of destination CIDRs never to masquerade traffic to with --ip-masq, in addition to the network config's NoMasqCIDRs")
+	flag.BoolVar(&opts.ipv6Masq, "ipv6-masq", false, "with --ip-masq, also masquerade traffic from the network config's IPv6Network")
+	flag.UintVar(&opts.masqFWMark, "masq-fwmark", 0, "with --ip-masq, mark the traffic to masquerade with these fwmark bits (e.g. 0x4000) and masquerade on the mark, instead of on the addresses alone")
+	flag.BoolVar(&opts.mssClamp, "mss-clamp", false, "clamp the MSS of TCP connections into the flannel network to the path MTU")
+	flag.BoolVar(&opts.flushConntrack, "flush-conntrack", true, "delete the conntrack entries of the flows with a peer once its lease is gone or its public IP changed, and of the UDP flows of the network once IP masquerading is turned on or off, with conntrack(8)")
+	flag.DurationVar(&opts.peerTraffic, "peer-traffic-interval", 0, "count the traffic to and from each peer subnet with firewall rules and export it as metrics this often, e.g. 30s (0 to disable); requires --firewall=iptables or nftables")
+	flag.DurationVar(&opts.peerProbe, "peer-probe-interval", 0, "ping the gateway IP of each peer's subnet through the overlay this often, e.g. 10s, and export whether it answers as metrics (0 to disable)")
+	flag.DurationVar(&opts.peerProbeTimeout, "peer-probe-timeout", time.Second, "how long to wait for the answer to a peer probe")
+	flag.IntVar(&opts.peerProbeFailures, "peer-probe-failures", 3, "number of unanswered probes in a row after which a peer is reported as unreachable")
+	flag.BoolVar(&opts.peerProbeRepair, "peer-probe-repair", false, "have the backend restore its routes or FDB entries when a peer becomes unreachable")
+	flag.StringVar(&opts.flowExport, "flow-export", "", "export the flows between our containers and those of other hosts, from the conntrack table, as IPFIX to the collector at this UDP address (e.g. 10.0.0.9:4739)")
+	flag.DurationVar(&opts.flowInterval, "flow-export-interval", 10*time.Second, "how often to export the traffic of the flows with --flow-export")
+	flag.UintVar(&opts.flowSampling, "flow-export-sampling", 1, "export 1 in this many flows with --flow-export")
+	flag.DurationVar(&opts.driftCheck, "drift-check-interval", time.Minute, "how often to compare the backend's routes or FDB entries with the leases and export the differences as the flannel_dataplane_drift metric, without repairing them (0 to disable)")
+	flag.DurationVar(&opts.backendCheck, "backend-check-interval", 30*time.Second, "how often to check the network config for a change of the backend type, to migrate the network to the new backend without dropping traffic (0 to disable)")
+	flag.DurationVar(&opts.mtuDiscovery, "mtu-discovery-interval", 0, "lower the MTU of the network to the smallest path MTU to the peer nodes, less the backend overhead, checking this often, e.g. 5m (0 to keep the MTU of the external interface); supported by the udp and vxlan backends")
+	flag.BoolVar(&opts.mtuProbe, "mtu-probe", false, "with --mtu-discovery-interval, probe the path MTU with pings with the DF bit set rather than relying on the route MTU and ICMP fragmentation needed messages alone")
+	flag.DurationVar(&opts.ipMasqCheck, "ip-masq-check-interval", time.Minute, "how often to check the IP masquerade rules and restore missing ones (0 to disable)")
+	flag.StringVar(&opts.firewall, "firewall", "auto", "how to install the IP masquerade rules: iptables, nftables, firewalld, external to only export them in the subnet files, or auto to pick firewalld when running, else nftables where iptables is missing or nf_tables based")
+	flag.BoolVar(&opts.subnetFileJSON, "subnet-file-json", false, "also write the subnet file, with the full lease and backend details, as JSON (same name with a .json extension)")
+	flag.StringVar(&opts.subnetNotify, "subnet-file-notify", "", "command to run (via /bin/sh) whenever a subnet file changes")
+	flag.StringVar(&opts.postStartupHook, "post-startup-hook", "", "command to run (via /bin/sh) once a network has acquired its lease and written its subnet file")
+	flag.StringVar(&opts.leaseAddedHook, "lease-added-hook", "", "command to run (via /bin/sh) when another host's lease appears or changes")
+	flag.StringVar(&opts.leaseRemovedHook, "lease-removed-hook", "", "command to run (via /bin/sh) when another host's lease goes away")
+	flag.StringVar(&opts.notifyWebhook, "notify-webhook", "", "URL to POST lease acquired/renewed/revoked events to as JSON")
+	flag.StringVar(&opts.notifyNATS, "notify-nats", "", "NATS server (nats://[user:password@]host:port) to publish lease events to")
+	flag.StringVar(&opts.notifyNATSSubject, "notify-nats-subject", defaultNATSSubj, "NATS subject to publish lease events on")
+	flag.StringVar(&opts.cniConf, "cni-conf", "", "render and install the CNI config at this path, e.g. /etc/cni/net.d/10-flannel.conflist")
+	flag.StringVar(&opts.cniConfTemplate, "cni-conf-template", "", "Go template for --cni-conf (default: a flannel conflist with the plugins from --cni-plugins)")
+	flag.StringVar(&opts.cniDelegate, "cni-delegate", "bridge", "plugin the flannel CNI plugin delegates to in the default --cni-conf template: bridge or ptp")
+	flag.StringVar(&opts.cniPlugins, "cni-plugins", "portmap,bandwidth", "comma separated list of CNI plugins to chain after flannel in the default template, e.g. portmap,bandwidth")
+	flag.BoolVar(&opts.networkPolicy, "kube-network-policy", false, "enforce the Kubernetes NetworkPolicies on the pods of this node with nftables")
+	flag.BoolVar(&opts.kubeBandwidth, "kube-egress-bandwidth", false, "shape the traffic to each other subnet to the bandwidth of the "+egressBandwidthAnnotation+" annotation of this node, e.g. 100mbit, instead of the EgressBandwidth of the network config")
+	flag.StringVar(&opts.hairpinBridge, "hairpin-bridge", "", "turn on hairpin mode for the ports of this bridge of the pods, e.g. cni0, and with --ip-masq masquerade the traffic of its pods to services backed by pods on it, so that pods reach themselves and each other through services")
+	flag.StringVar(&opts.rateLimit, "rate-limit", "", "advertise this bandwidth, e.g. 10mbit, in the leases of this host for the other hosts to shape the traffic they send it to")
+	flag.StringVar(&opts.kubeAPIServer, "kube-api-server", "", "URL of the Kubernetes API server for --kube-network-policy and --kube-egress-bandwidth (default: the in-cluster one)")
+	flag.StringVar(&opts.kubeTokenFile, "kube-token-file", "", "file with the bearer token for the Kubernetes API server (default: the service account token)")
+	flag.StringVar(&opts.kubeCAFile, "kube-cafile", "", "file with the CA certificates of the Kubernetes API server (default: the service account CA)")
+	flag.StringVar(&opts.kubeNodeName, "kube-node-name", "", "name of this node in Kubernetes (default: $NODE_NAME or the hostname)")
+	flag.StringVar(&opts.checkpointDir, "checkpoint-dir", "/var/lib/flannel", "directory to record the lease and MTU of each network in across reboots, to validate and repair the dataplane against on startup (\"\" to disable)")
+	flag.BoolVar(&opts.releaseLease, "release-lease-on-exit", false, "revoke the leases when flanneld exits, unless it leaves the dataplane in place, so that the other hosts drop their routes to this one right away")
+	flag.BoolVar(&opts.gracefulRestart, "graceful-restart", false, "leave the dataplane (devices, routes, iptables rules) in place on exit so a restarted flanneld can take it over without packet loss")
+}
+
+// SetBackendOverrides sets backend options which take precedence over
+// those in the network config retrieved from the registry.
+func SetBackendOverrides(overrides map[string]interface{}) error {
+	for k := range overrides {
+		if strings.ToLower(k) == "type" {
+			return fmt.Errorf("the backend type cannot be overridden locally")
+		}
+	}
+	opts.backendOverrides = overrides
+	return nil
 }
 
 type Manager struct {
@@ -69,6 +181,15 @@ type Manager struct {
 	watch           bool
 	ipMasq          bool
 	extIface        *backend.ExternalInterface
+	// the interface to switch to once the networks have stopped
+	nextExtIface    *backend.ExternalInterface
+	restartNetworks context.CancelFunc
+	// networks which must acquire a lease before we report readiness
+	pending  map[string]bool
+	notifier *notifier
+	fw       firewall
+	noMasq   []ip.IP4Net
+	policy   *policyEnforcer
 }
 
 func (m *Manager) isNetAllowed(name string) bool {
@@ -85,22 +206,50 @@ func (m *Manager) isMultiNetwork() bool {
 }
 
 func NewNetworkManager(ctx context.Context, sm subnet.Manager) (*Manager, error) {
-	extIface, err := lookupExtIface(opts.iface)
+	extIface, err := lookupExtIface(0)
+	if err != nil {
+		return nil, err
+	}
+
+	nf, err := newNotifier()
+	if err != nil {
+		return nil, err
+	}
+
+	fw, err := newFirewall(opts.firewall)
 	if err != nil {
 		return nil, err
 	}
 
-	bm := backend.NewManager(ctx, sm, extIface)
+	if opts.masqFWMark > 0xffffffff {
+		return nil, fmt.Errorf("invalid --masq-fwmark %#x: marks are 32 bit", opts.masqFWMark)
+	}
+
+	if opts.rateLimit != "" {
+		if _, err := subnet.ParseBandwidth(opts.rateLimit); err != nil {
+			return nil, fmt.Errorf("invalid --rate-limit: %v", err)
+		}
+	}
+
+	noMasq, err := parseCIDRs(opts.noMasqCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --no-masq-cidrs: %v", err)
+	}
+
+	exportBuildInfo()
 
 	manager := &Manager{
 		ctx:             ctx,
 		sm:              sm,
-		bm:              bm,
 		allowedNetworks: make(map[string]bool),
 		networks:        make(map[string]*Network),
+		pending:         make(map[string]bool),
 		watch:           opts.watchNetworks,
 		ipMasq:          opts.ipMasq,
 		extIface:        extIface,
+		notifier:        nf,
+		fw:              fw,
+		noMasq:          noMasq,
 	}
 
 	for _, name := range strings.Split(opts.networks, ",") {
@@ -109,94 +258,44 @@ func NewNetworkManager(ctx context.Context, sm subnet.Manager) (*Manager, error)
 		}
 	}
 
-	return manager, nil
-}
-
-func lookupExtIface(ifname string) (*backend.ExternalInterface, error) {
-	var iface *net.Interface
-	var iaddr net.IP
-	var err error
-
-	if len(ifname) > 0 {
-		if iaddr = net.ParseIP(ifname); iaddr != nil {
-			iface, err = ip.GetInterfaceByIP(iaddr)
-			if err != nil {
-				return nil, fmt.Errorf("error looking up interface %s: %s", ifname, err)
-			}
-		} else {
-			iface, err = net.InterfaceByName(ifname)
-			if err != nil {
-				return nil, fmt.Errorf("error looking up interface %s: %s", ifname, err)
-			}
-		}
-	} else {
-		log.Info("Determining IP address of default interface")
-		if iface, err = ip.GetDefaultGatewayIface(); err != nil {
-			return nil, fmt.Errorf("failed to get default interface: %s", err)
+	if opts.networkPolicy {
+		if manager.policy, err = newPolicyEnforcer(); err != nil {
+			return nil, err
 		}
 	}
 
-	if iaddr == nil {
-		iaddr, err = ip.GetIfaceIP4Addr(iface)
-		if err != nil {
-			return nil, fmt.Errorf("failed to find IPv4 address for interface %s", iface.Name)
+	if opts.cniConf != "" {
+		if manager.isMultiNetwork() {
+			return nil, fmt.Errorf("--cni-conf is not supported in multi-network mode")
 		}
-	}
-
-	if iface.MTU == 0 {
-		return nil, fmt.Errorf("failed to determine MTU for %s interface", iaddr)
-	}
-
-	var eaddr net.IP
-
-	if len(opts.publicIP) > 0 {
-		eaddr = net.ParseIP(opts.publicIP)
-		if eaddr == nil {
-			return nil, fmt.Errorf("invalid public IP address: %s", opts.publicIP)
+		if opts.cniDelegate != "bridge" && opts.cniDelegate != "ptp" {
+			return nil, fmt.Errorf("invalid --cni-delegate %q, expected bridge or ptp", opts.cniDelegate)
+		}
+		// catch template errors at startup rather than on the first lease
+		if _, err := loadCNIConfTemplate(opts.cniConfTemplate); err != nil {
+			return nil, err
 		}
 	}
 
-	if eaddr == nil {
-		eaddr = iaddr
-	}
-
-	log.Infof("Using %s as external interface", iaddr)
-	log.Infof("Using %s as external endpoint", eaddr)
-
-	return &backend.ExternalInterface{
-		Iface:     iface,
-		IfaceAddr: iaddr,
-		ExtAddr:   eaddr,
-	}, nil
+	return manager, nil
 }
 
-func writeSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network) error {
-	dir, name := filepath.Split(path)
-	os.MkdirAll(dir, 0755)
-
-	tempFile := filepath.Join(dir, "."+name)
-	f, err := os.Create(tempFile)
-	if err != nil {
-		return err
+func (m *Manager) newNetwork(ctx context.Context, netname string, ipMasq bool) *Network {
+	n := NewNetwork(ctx, m.sm, m.bm, netname, ipMasq)
+	n.notifier = m.notifier
+	n.fw = m.fw
+	n.noMasq = m.noMasq
+	n.subnetFileWriter = func(bn backend.Network) error {
+		n.writeCheckpoint(bn)
+		return m.writeSubnetFile(n, bn)
 	}
-
-	// Write out the first usable IP by incrementing
-	// sn.IP by one
-	sn := bn.Lease().Subnet
-	sn.IP += 1
-
-	fmt.Fprintf(f, "FLANNEL_NETWORK=%s\n", nw)
-	fmt.Fprintf(f, "FLANNEL_SUBNET=%s\n", sn)
-	fmt.Fprintf(f, "FLANNEL_MTU=%d\n", bn.MTU())
-	_, err = fmt.Fprintf(f, "FLANNEL_IPMASQ=%v\n", ipMasq)
-	f.Close()
-	if err != nil {
-		return err
+	n.initFailed = func(failures int) {
+		if failures == readinessRetries {
+			log.Warningf("%v: keeps failing to initialize, reporting readiness without it", netname)
+			m.settle(netname)
+		}
 	}
-
-	// rename(2) the temporary file to the desired location so that it becomes
-	// atomically visible with the contents
-	return os.Rename(tempFile, path)
+	return n
 }
 
 func (m *Manager) addNetwork(n *Network) error {
@@ -214,6 +313,10 @@ func (m *Manager) delNetwork(n *Network) {
 	m.mux.Lock()
 	delete(m.networks, n.Name)
 	m.mux.Unlock()
+
+	if n.Config != nil {
+		networkInfo.Delete(n.Name, n.Config.BackendType)
+	}
 }
 
 func (m *Manager) getNetwork(netname string) (*Network, bool) {
@@ -232,38 +335,100 @@ func (m *Manager) forEachNetwork(f func(n *Network)) {
 	m.mux.Unlock()
 }
 
+func (m *Manager) leaseFields(n *Network, bn backend.Network) []interface{} {
+	return []interface{}{
+		logging.FieldEvent, "lease-acquired",
+		logging.FieldNetwork, n.Name,
+		logging.FieldSubnet, bn.Lease().Subnet,
+		logging.FieldBackend, n.Config.BackendType,
+		logging.FieldNode, m.extIface.ExtAddr,
+	}
+}
+
+func (m *Manager) subnetFilePath(netname string) string {
+	if m.isMultiNetwork() {
+		return filepath.Join(opts.subnetDir, netname) + ".env"
+	}
+	return opts.subnetFile
+}
+
 func (m *Manager) runNetwork(n *Network) {
+	started := false
+
 	n.Run(m.extIface, func(bn backend.Network) {
 		if m.isMultiNetwork() {
-			log.Infof("%v: lease acquired: %v", n.Name, bn.Lease().Subnet)
+			log.InfoKV(fmt.Sprintf("%v: lease acquired: %v", n.Name, bn.Lease().Subnet), m.leaseFields(n, bn)...)
 
-			path := filepath.Join(opts.subnetDir, n.Name) + ".env"
-			if err := writeSubnetFile(path, n.Config.Network, m.ipMasq, bn); err != nil {
+			if err := m.writeSubnetFile(n, bn); err != nil {
 				log.Warningf("%v failed to write subnet file: %s", n.Name, err)
 				return
 			}
+			m.settle(n.Name)
 		} else {
-			log.Infof("Lease acquired: %v", bn.Lease().Subnet)
+			log.InfoKV(fmt.Sprintf("Lease acquired: %v", bn.Lease().Subnet), m.leaseFields(n, bn)...)
 
-			if err := writeSubnetFile(opts.subnetFile, n.Config.Network, m.ipMasq, bn); err != nil {
+			if err := m.writeSubnetFile(n, bn); err != nil {
 				log.Warningf("%v failed to write subnet file: %s", n.Name, err)
 				return
 			}
 			daemon.SdNotify("READY=1")
 		}
+
+		if !started && opts.postStartupHook != "" {
+			go runHook("post startup hook", opts.postStartupHook, hookEnv(n.Name, m.subnetInfo(n, bn).Vars()...))
+		}
+		started = true
 	})
 
 	m.delNetwork(n)
+	m.settle(n.Name)
+}
+
+// settle stops readiness waiting for netname, one of the networks known at
+// startup, because it acquired its lease, went away or keeps failing to
+// initialize. systemd is notified once none is left.
+func (m *Manager) settle(netname string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if !m.pending[netname] {
+		return
+	}
+	delete(m.pending, netname)
+	if len(m.pending) == 0 {
+		daemon.SdNotify("READY=1")
+	}
 }
 
-func (m *Manager) watchNetworks() {
+// BackendNetwork returns the backend network of netname ("" in single
+// network mode), or nil if the network does not currently hold a lease.
+func (m *Manager) BackendNetwork(netname string) backend.Network {
+	n, ok := m.getNetwork(netname)
+	if !ok {
+		return nil
+	}
+	return n.backendNetwork()
+}
+
+// HealthCheck reports the first network which has lost its lease.
+func (m *Manager) HealthCheck() error {
+	var err error
+	m.forEachNetwork(func(n *Network) {
+		if err == nil {
+			err = n.HealthCheck()
+		}
+	})
+	return err
+}
+
+func (m *Manager) watchNetworks(ctx context.Context) {
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
 
 	events := make(chan []subnet.Event)
 	wg.Add(1)
 	go func() {
-		subnet.WatchNetworks(m.ctx, m.sm, events)
+		subnet.WatchNetworks(ctx, m.sm, events)
 		wg.Done()
 	}()
 	// skip over the initial snapshot
@@ -271,7 +436,7 @@ func (m *Manager) watchNetworks() {
 
 	for {
 		select {
-		case <-m.ctx.Done():
+		case <-ctx.Done():
 			return
 
 		case evtBatch := <-events:
@@ -284,7 +449,7 @@ func (m *Manager) watchNetworks() {
 
 				switch e.Type {
 				case subnet.EventAdded:
-					n := NewNetwork(m.ctx, m.sm, m.bm, netname, m.ipMasq)
+					n := m.newNetwork(ctx, netname, m.getIPMasq())
 					if err := m.addNetwork(n); err != nil {
 						log.Infof("Network %q: %v", netname, err)
 						continue
@@ -316,21 +481,98 @@ func (m *Manager) watchNetworks() {
 func (m *Manager) Run(ctx context.Context) {
 	wg := sync.WaitGroup{}
 
+	wg.Add(1)
+	go func() {
+		m.notifier.run(ctx)
+		wg.Done()
+	}()
+
+	if m.policy != nil {
+		wg.Add(1)
+		go func() {
+			m.policy.run(ctx)
+			wg.Done()
+		}()
+	}
+
+	if opts.hairpinBridge != "" {
+		wg.Add(1)
+		go func() {
+			keepHairpin(ctx, opts.hairpinBridge)
+			wg.Done()
+		}()
+	}
+
+	if opts.cniConf != "" {
+		wg.Add(1)
+		go func() {
+			keepCNIConf(ctx)
+			wg.Done()
+		}()
+	}
+
+	for {
+		netCtx, restart := context.WithCancel(ctx)
+		m.mux.Lock()
+		m.restartNetworks = restart
+		m.mux.Unlock()
+
+		watchDone := make(chan struct{})
+		go func() {
+			m.watchExtIface(netCtx)
+			close(watchDone)
+		}()
+
+		m.runNetworks(netCtx)
+		restarted := netCtx.Err() != nil && ctx.Err() == nil
+		restart()
+		<-watchDone
+
+		if !restarted {
+			break
+		}
+
+		m.mux.Lock()
+		if m.nextExtIface != nil {
+			m.extIface, m.nextExtIface = m.nextExtIface, nil
+		}
+		extIface := m.extIface
+		m.mux.Unlock()
+		log.Infof("Restarting the networks on external interface %v (%v, public %v)", extIface.Iface.Name, extIface.IfaceAddr, extIface.ExtAddr)
+	}
+
+	wg.Wait()
+}
+
+// runNetworks runs the networks on the current external interface until ctx
+// is done.
+func (m *Manager) runNetworks(ctx context.Context) {
+	m.bm = backend.NewManager(ctx, leaseAttrsManager{m.sm}, m.extIface)
+
+	wg := sync.WaitGroup{}
+
 	if m.isMultiNetwork() {
 		for {
 			// Try adding initial networks
 			result, err := m.sm.WatchNetworks(ctx, nil)
 			if err == nil {
+				m.mux.Lock()
 				for _, n := range result.Snapshot {
 					if m.isNetAllowed(n) {
-						m.networks[n] = NewNetwork(ctx, m.sm, m.bm, n, m.ipMasq)
+						m.networks[n] = m.newNetwork(ctx, n, m.ipMasq)
+						m.pending[n] = true
 					}
 				}
+				if len(m.pending) == 0 {
+					// nothing to wait for
+					daemon.SdNotify("READY=1")
+				}
+				m.mux.Unlock()
 				break
 			}
 
 			// Otherwise retry in a few seconds
-			log.Warning("Failed to retrieve networks (will retry): %v", err)
+			log.Warningf("Failed to retrieve networks (will retry): %v", err)
 			select {
 			case <-ctx.Done():
 				return
@@ -338,7 +580,9 @@ func (m *Manager) Run(ctx context.Context) {
 			}
 		}
 	} else {
-		m.networks[""] = NewNetwork(ctx, m.sm, m.bm, "", m.ipMasq)
+		m.mux.Lock()
+		m.networks[""] = m.newNetwork(ctx, "", m.ipMasq)
+		m.mux.Unlock()
 	}
 
 	// Run existing networks
@@ -351,9 +595,15 @@ func (m *Manager) Run(ctx context.Context) {
 	})
 
 	if opts.watchNetworks {
-		m.watchNetworks()
+		m.watchNetworks(ctx)
 	}
 
 	wg.Wait()
 	m.bm.Wait()
 }
+
+// HandOff has flanneld leave the dataplane in place when it exits next, as
+// with --graceful-restart, for the instance taking over from us.
+func (m *Manager) HandOff() {
+	atomic.StoreInt32(&handingOff, 1)
+}
@@ -0,0 +1,290 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/logging"
+	"github.com/coreos/flannel/subnet"
+)
+
+// When the backend type of the network config changes, the network
+// migrates to the new backend without dropping traffic: it registers the
+// network with the new backend while the old one keeps running, advertising
+// both in its lease. Each backend handles the peers it is the better match
+// for (see backend.StartMigration), and the old one is retired once no peer
+// is left on it.
+
+// prevNetwork is the backend network a network migrates away from.
+type prevNetwork struct {
+	bn     backend.Network
+	config *subnet.Config
+	// stop its Run
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (n *Network) previous() *prevNetwork {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.prev
+}
+
+func (n *Network) setPrevious(prev *prevNetwork) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.prev = prev
+}
+
+// watchBackend checks the network config every interval and has runOnce
+// migrate the network once its backend type differs from current.
+func (n *Network) watchBackend(ctx context.Context, current string, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		config, err := n.networkConfig(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warningf("Failed to check the backend of network %v: %v", n.Name, err)
+			}
+			continue
+		}
+		if strings.EqualFold(config.BackendType, current) {
+			continue
+		}
+		if prev := n.previous(); prev != nil {
+			log.Infof("Backend of network %v changed to %v, to migrate to once the migration from %v is done", n.Name, config.BackendType, prev.config.BackendType)
+			continue
+		}
+
+		log.Infof("Backend of network %v changed from %v to %v, migrating", n.Name, current, config.BackendType)
+		select {
+		case n.backendChanged <- config:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// migrate registers the network with the backend of config, alongside the
+// current one.
+func (n *Network) migrate(config *subnet.Config) (backend.Network, error) {
+	be, err := n.bm.GetBackend(config.BackendType)
+	if err != nil {
+		return nil, wrapError("create and initialize network", err)
+	}
+	if err := backend.CheckFIPS(be, config); err != nil {
+		return nil, err
+	}
+
+	backend.StartMigration(n.Name, n.bn.Lease(), config.BackendType)
+	bn, err := be.RegisterNetwork(n.ctx, n.Name, config)
+	if err != nil {
+		backend.EndMigration(n.Name)
+		return nil, wrapError("register network", err)
+	}
+	log.InfoKV(fmt.Sprint("Migrating network to the ", config.BackendType, " backend, keeping ", n.Config.BackendType, " for the peers yet to follow"),
+		logging.FieldEvent, "backend-migration-started",
+		logging.FieldNetwork, n.Name,
+		logging.FieldSubnet, bn.Lease().Subnet,
+		logging.FieldBackend, config.BackendType,
+	)
+	return bn, nil
+}
+
+// retirePrevious follows the leases of the peers and retires the backend
+// network migrated away from once none of them is on its backend any more.
+//
+// A backend with a device of its own routes the whole network through it,
+// which the previous backend may hold already, so meanwhile the subnets of
+// the peers on the new backend are routed through its device one by one.
+func (n *Network) retirePrevious(ctx context.Context, prev *prevNetwork) {
+	from := strings.ToLower(prev.config.BackendType)
+	to := strings.ToLower(n.Config.BackendType)
+	own := n.bn.Lease()
+
+	dev := ""
+	if du, ok := n.bn.(backend.DeviceUser); ok {
+		dev = du.Device()
+	}
+	routes := map[ip.IP4Net]bool{}
+	peers := map[ip.IP4Net]string{}
+
+	update := func(e subnet.Event) {
+		sn := e.Lease.Subnet
+		if sn.Equal(own.Subnet) {
+			return
+		}
+		switch {
+		case e.Type == subnet.EventRemoved:
+			delete(peers, sn)
+		default:
+			peers[sn] = strings.ToLower(e.Lease.Attrs.BackendType)
+		}
+
+		onNew := peers[sn] == to
+		switch {
+		case dev == "":
+		case onNew && !routes[sn]:
+			// replaces the route of the previous backend, if any
+			if err := deviceRoute("replace", sn, dev); err != nil {
+				log.Error(err)
+				return
+			}
+			routes[sn] = true
+		case !onNew && routes[sn]:
+			if err := deviceRoute("del", sn, dev); err != nil {
+				log.Warning(err)
+			}
+			delete(routes, sn)
+		}
+	}
+
+	remaining := func() int {
+		count := 0
+		for _, bt := range peers {
+			if bt == from {
+				count++
+			}
+		}
+		return count
+	}
+
+	// the watch ends with the migration, not only with the network
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, own, evts)
+
+	// the watch sends nothing while there are no peers at all
+	if wr, err := n.sm.WatchLeases(ctx, n.Name, nil); err == nil {
+		for _, l := range wr.Snapshot {
+			update(subnet.Event{Type: subnet.EventAdded, Lease: l})
+		}
+	}
+
+	for {
+		switch left := remaining(); {
+		case left == 0:
+			n.retire(ctx, prev, dev, routes)
+			return
+		default:
+			log.V(1).Infof("Network %v: %v peers left on the %v backend", n.Name, left, from)
+		}
+
+		select {
+		case batch := <-evts:
+			for _, e := range batch {
+				update(e)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deviceRoute replaces or deletes the route of sn through dev.
+func deviceRoute(action string, sn ip.IP4Net, dev string) error {
+	out, err := exec.Command("ip", "route", action, sn.String(), "dev", dev).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to %v the route of %v through %v: %v (%s)", action, sn, dev, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// retire stops the backend network migrated away from and removes what it
+// leaves behind, including the previous backend in our lease.
+func (n *Network) retire(ctx context.Context, prev *prevNetwork, dev string, routes map[ip.IP4Net]bool) {
+	n.setPrevious(nil)
+	backend.EndMigration(n.Name)
+	prev.cancel()
+	<-prev.done
+	if r, ok := prev.bn.(backend.Retirer); ok {
+		r.Retire()
+	}
+	networkInfo.Delete(n.Name, prev.config.BackendType)
+
+	if pu, ok := prev.bn.(backend.PortUser); ok {
+		inUse := map[string]bool{}
+		if cur, ok := n.bn.(backend.PortUser); ok {
+			for _, p := range cur.Ports() {
+				inUse[p] = true
+			}
+		}
+		ports := []string{}
+		for _, p := range pu.Ports() {
+			if !inUse[p] {
+				ports = append(ports, p)
+			}
+		}
+		if err := n.fw.ClosePorts(ports); err != nil {
+			log.Errorf("Failed to close the ports of the %v backend for network %v: %v", prev.config.BackendType, n.Name, err)
+		}
+	}
+
+	if dev != "" {
+		// the route of the whole network, which the device of the
+		// previous backend may have held
+		if err := deviceRoute("replace", n.Config.Network, dev); err != nil {
+			log.Error(err)
+		}
+		for sn := range routes {
+			if err := deviceRoute("del", sn, dev); err != nil {
+				log.Warning(err)
+			}
+		}
+	}
+
+	l := n.bn.Lease()
+	l.Attrs.PreviousBackend = nil
+	if err := n.sm.RenewLease(ctx, n.Name, l); err != nil {
+		log.Errorf("Failed to remove the %v backend from the lease of network %v: %v", prev.config.BackendType, n.Name, err)
+	}
+
+	log.InfoKV(fmt.Sprint("Migrated network from the ", prev.config.BackendType, " to the ", n.Config.BackendType, " backend"),
+		logging.FieldEvent, "backend-migrated",
+		logging.FieldNetwork, n.Name,
+		logging.FieldSubnet, l.Subnet,
+		logging.FieldBackend, n.Config.BackendType,
+	)
+}
+
+// stopPrevious stops the backend network migrated away from, if the network
+// stops before it was retired.
+func (n *Network) stopPrevious() {
+	prev := n.previous()
+	if prev == nil {
+		return
+	}
+	n.setPrevious(nil)
+	backend.EndMigration(n.Name)
+	prev.cancel()
+	<-prev.done
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const natsDialTimeout = 5 * time.Second
+
+// natsConn is a minimal publish-only client for the NATS text protocol
+// (http://nats.io/documentation/internals/nats-protocol/). It connects
+// lazily and reconnects on the next Publish after an error.
+type natsConn struct {
+	addr    string
+	connect []byte
+
+	mux  sync.Mutex
+	conn net.Conn
+}
+
+// newNATSConn parses a nats://[user:password@]host:port URL.
+func newNATSConn(rawurl string) (*natsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS URL: %v", err)
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q: expected nats://host:port", rawurl)
+	}
+
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "4222")
+	}
+
+	opts := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "flanneld",
+	}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			opts["pass"] = pass
+		}
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsConn{
+		addr:    addr,
+		connect: []byte("CONNECT " + string(connect) + "\r\n"),
+	}, nil
+}
+
+func (c *natsConn) dial() error {
+	conn, err := net.DialTimeout("tcp", c.addr, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(natsDialTimeout))
+	info, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to read INFO: %v", err)
+	}
+	if !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from server: %q", strings.TrimSpace(info))
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if _, err := conn.Write(c.connect); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn = conn
+	go c.readLoop(conn, r)
+	return nil
+}
+
+// readLoop answers the server's keepalive PINGs and logs errors until the
+// connection fails.
+func (c *natsConn) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.drop(conn)
+			return
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			c.mux.Lock()
+			_, err = conn.Write([]byte("PONG\r\n"))
+			c.mux.Unlock()
+			if err != nil {
+				c.drop(conn)
+				return
+			}
+
+		case strings.HasPrefix(line, "-ERR"):
+			log.Warningf("NATS server error: %v", line)
+		}
+	}
+}
+
+func (c *natsConn) drop(conn net.Conn) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	conn.Close()
+	if c.conn == conn {
+		c.conn = nil
+	}
+}
+
+// Publish sends data to subject.
+func (c *natsConn) Publish(subject string, data []byte) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return err
+		}
+	}
+
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(data), data)
+	c.conn.SetWriteDeadline(time.Now().Add(natsDialTimeout))
+	if _, err := c.conn.Write([]byte(msg)); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (c *natsConn) Close() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
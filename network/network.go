@@ -15,49 +15,92 @@
 package network
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/logging"
+	"github.com/coreos/flannel/pkg/tracing"
 	"github.com/coreos/flannel/subnet"
 )
 
 const (
 	renewMargin = time.Hour
+	// how long a shutdown waits for the registry to release the lease
+	leaseReleaseTimeout = 5 * time.Second
 )
 
 var (
 	errInterrupted = errors.New("interrupted")
 	errCanceled    = errors.New("canceled")
+	errMigrating   = errors.New("migrating")
 )
 
 type Network struct {
 	Name   string
 	Config *subnet.Config
 
+	parentCtx  context.Context
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 	sm         subnet.Manager
 	bm         backend.Manager
-	ipMasq     bool
-	bn         backend.Network
+
+	mux    sync.Mutex
+	ipMasq bool
+	bn     backend.Network
+	leased bool
+
+	notifier *notifier
+	fw       firewall
+	// extra destinations never to masquerade, from the command line
+	noMasq []ip.IP4Net
+	// what the masquerade rules are built from, set once the config is known
+	masq *masqConfig
+	// rewrites the subnet file after the MTU changed
+	subnetFileWriter func(bn backend.Network) error
+	// called with the number of failed attempts to initialize in a row
+	initFailed func(failures int)
+	// signals that the MTU of the external interface or of the peers
+	// changed
+	uplinkMTU chan struct{}
+	// the smallest MTU the peers advertise, under mux, 0 while unknown
+	peersMTU int
+
+	// signals that the backend type of the network config changed
+	backendChanged chan *subnet.Config
+	// the backend network to migrate to and its config, registered by
+	// runOnce for init to pick up
+	next       backend.Network
+	nextConfig *subnet.Config
+	// the backend network migrated away from, under mux, see migrate.go
+	prev *prevNetwork
 }
 
 func NewNetwork(ctx context.Context, sm subnet.Manager, bm backend.Manager, name string, ipMasq bool) *Network {
+	parentCtx := ctx
 	ctx, cf := context.WithCancel(ctx)
 
 	return &Network{
 		Name:       name,
+		parentCtx:  parentCtx,
 		sm:         sm,
 		bm:         bm,
 		ipMasq:     ipMasq,
 		ctx:        ctx,
 		cancelFunc: cf,
+		uplinkMTU:  make(chan struct{}, 1),
+
+		backendChanged: make(chan *subnet.Config, 1),
 	}
 }
 
@@ -68,42 +111,147 @@ func wrapError(desc string, err error) error {
 	return fmt.Errorf("failed to %v: %v", desc, err)
 }
 
-func (n *Network) init() error {
-	var err error
+func (n *Network) init(extIface *backend.ExternalInterface) (err error) {
+	// the span of what it takes for the node to join the network
+	ctx, span := tracing.Start(n.ctx, "network.init", tracing.KV("network", n.Name))
+	defer func() { span.End(err) }()
+
+	bn := n.next
+	if bn != nil {
+		// migrating to another backend, which runOnce registered already
+		n.Config = n.nextConfig
+		n.next, n.nextConfig = nil, nil
+	} else if n.Config, err = n.networkConfig(ctx); err != nil {
+		return err
+	}
+
+	n.masq = newMasqConfig(n.Config, n.noMasq)
 
-	n.Config, err = n.sm.GetNetworkConfig(n.ctx, n.Name)
-	if err != nil {
-		return wrapError("retrieve network config", err)
+	if bn == nil {
+		be, err := n.bm.GetBackend(n.Config.BackendType)
+		if err != nil {
+			return wrapError("create and initialize network", err)
+		}
+		if err := backend.CheckFIPS(be, n.Config); err != nil {
+			return err
+		}
+
+		bn, err = be.RegisterNetwork(ctx, n.Name, n.Config)
+		if err != nil {
+			return wrapError("register network", err)
+		}
 	}
+	span.SetAttr("backend", n.Config.BackendType)
+	networkInfo.Set(1, n.Name, n.Config.BackendType)
+	n.setBackendNetwork(bn)
 
-	be, err := n.bm.GetBackend(n.Config.BackendType)
-	if err != nil {
-		return wrapError("create and initialize network", err)
+	if err := n.applyConfigMTU(bn, extIface); err != nil {
+		return err
 	}
 
-	n.bn, err = be.RegisterNetwork(n.ctx, n.Name, n.Config)
-	if err != nil {
-		return wrapError("register network", err)
+	if pu, ok := bn.(backend.PortUser); ok {
+		if err := n.fw.OpenPorts(pu.Ports()); err != nil {
+			return wrapError("open backend ports", err)
+		}
 	}
 
-	if n.ipMasq {
-		err = setupIPMasq(n.Config.Network)
+	if n.IPMasq() {
+		err = n.fw.SetupMasq(n.masq)
 		if err != nil {
 			return wrapError("set up IP Masquerade", err)
 		}
 	}
 
+	if opts.mssClamp {
+		if err := n.fw.SetupMSSClamp(n.Config.Network); err != nil {
+			return wrapError("set up MSS clamping", err)
+		}
+	}
+
 	return nil
 }
 
-func (n *Network) retryInit() error {
-	for {
-		err := n.init()
+// networkConfig retrieves the config of the network, with the local backend
+// options applied.
+func (n *Network) networkConfig(ctx context.Context) (*subnet.Config, error) {
+	config, err := n.sm.GetNetworkConfig(ctx, n.Name)
+	if err != nil {
+		return nil, wrapError("retrieve network config", err)
+	}
+
+	if len(opts.backendOverrides) > 0 {
+		config.Backend, err = overlayBackendConfig(config.Backend, opts.backendOverrides)
+		if err != nil {
+			return nil, wrapError("apply local backend options", err)
+		}
+	}
+	return config, nil
+}
+
+func overlayBackendConfig(be json.RawMessage, overrides map[string]interface{}) (json.RawMessage, error) {
+	cfg := map[string]interface{}{}
+	if len(be) > 0 {
+		if err := json.Unmarshal(be, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range overrides {
+		// the backends decode their config case-insensitively, so a key of
+		// the registry differing only in case would shadow the override
+		for ck := range cfg {
+			if strings.EqualFold(ck, k) {
+				delete(cfg, ck)
+			}
+		}
+		cfg[k] = v
+	}
+
+	return json.Marshal(cfg)
+}
+
+func (n *Network) setBackendNetwork(bn backend.Network) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.bn = bn
+	if bn != nil {
+		n.leased = true
+	}
+}
+
+// HealthCheck returns an error if the network had acquired a lease
+// but no longer holds a valid one.  A network that is still starting
+// up is considered healthy.
+func (n *Network) HealthCheck() error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	switch {
+	case !n.leased:
+		return nil
+	case n.bn == nil:
+		return fmt.Errorf("network %q: lease lost and not yet reacquired", n.Name)
+	}
+
+	l := n.bn.Lease()
+	if !l.Expiration.IsZero() && time.Now().After(l.Expiration) {
+		return fmt.Errorf("network %q: lease %v expired at %v", n.Name, l.Subnet, l.Expiration)
+	}
+	return nil
+}
+
+func (n *Network) retryInit(extIface *backend.ExternalInterface) error {
+	for failures := 1; ; failures++ {
+		err := n.init(extIface)
 		if err == nil || err == context.Canceled {
 			return err
 		}
 
 		log.Error(err)
+		if n.initFailed != nil {
+			n.initFailed(failures)
+		}
 
 		select {
 		case <-n.ctx.Done():
@@ -114,21 +262,30 @@ func (n *Network) retryInit() error {
 }
 
 func (n *Network) runOnce(extIface *backend.ExternalInterface, inited func(bn backend.Network)) error {
-	if err := n.retryInit(); err != nil {
+	if err := n.retryInit(extIface); err != nil {
 		return errCanceled
 	}
 
-	inited(n.bn)
-
 	ctx, interruptFunc := context.WithCancel(n.ctx)
 
 	wg := sync.WaitGroup{}
 
-	wg.Add(1)
+	// the backend network is handed over rather than stopped when the
+	// network migrates to another backend
+	bnCtx, bnCancel := context.WithCancel(n.ctx)
+	bnDone := make(chan struct{})
 	go func() {
-		n.bn.Run(ctx)
-		wg.Done()
+		n.bn.Run(bnCtx)
+		close(bnDone)
 	}()
+	migrating := false
+
+	// the backend repairs with its event loop running
+	n.validateDataplane(ctx, n.bn)
+	inited(n.bn)
+	n.advertiseMTU(extIface)
+	n.writeCheckpoint(n.bn)
+	n.notifier.send(leaseAcquired, n.Name, n.bn.Lease())
 
 	evts := make(chan subnet.Event)
 
@@ -138,28 +295,177 @@ func (n *Network) runOnce(extIface *backend.ExternalInterface, inited func(bn ba
 		wg.Done()
 	}()
 
+	if opts.ipMasqCheck > 0 {
+		wg.Add(1)
+		go func() {
+			n.checkIPMasq(ctx, opts.ipMasqCheck)
+			wg.Done()
+		}()
+	}
+
+	if opts.peerTraffic > 0 {
+		wg.Add(1)
+		go func() {
+			n.countPeerTraffic(ctx, n.bn.Lease(), opts.peerTraffic)
+			wg.Done()
+		}()
+	}
+
+	// the peers may ask for their traffic to be shaped even when we do not
+	dev := extIface.Iface.Name
+	if du, ok := n.bn.(backend.DeviceUser); ok {
+		dev = du.Device()
+	}
+	wg.Add(1)
+	go func() {
+		n.shapeEgress(ctx, n.bn.Lease(), dev)
+		wg.Done()
+	}()
+
+	if opts.peerProbe > 0 {
+		wg.Add(1)
+		go func() {
+			n.probePeers(ctx, n.bn.Lease(), opts.peerProbe)
+			wg.Done()
+		}()
+	}
+
+	if opts.driftCheck > 0 {
+		wg.Add(1)
+		go func() {
+			n.detectDrift(ctx, n.bn, opts.driftCheck)
+			wg.Done()
+		}()
+	}
+
+	if opts.mtuDiscovery > 0 {
+		wg.Add(1)
+		go func() {
+			n.discoverMTU(ctx, n.bn, extIface, opts.mtuDiscovery)
+			wg.Done()
+		}()
+	} else if _, ok := n.bn.(backend.MTUAdjuster); ok {
+		// path MTU discovery takes the MTU of the peers into account itself
+		wg.Add(1)
+		go func() {
+			n.negotiateMTU(ctx, n.bn.Lease())
+			wg.Done()
+		}()
+	}
+
+	if opts.flowExport != "" {
+		wg.Add(1)
+		go func() {
+			n.exportFlows(ctx, n.bn.Lease().Subnet, opts.flowInterval)
+			wg.Done()
+		}()
+	}
+
+	if opts.flushConntrack {
+		wg.Add(1)
+		go func() {
+			n.flushChangedPeers(ctx, n.bn.Lease())
+			wg.Done()
+		}()
+	}
+
+	if peerHooksEnabled() {
+		wg.Add(1)
+		go func() {
+			n.runPeerHooks(ctx, n.bn.Lease())
+			wg.Done()
+		}()
+	}
+
+	if opts.backendCheck > 0 {
+		wg.Add(1)
+		go func() {
+			n.watchBackend(ctx, n.Config.BackendType, opts.backendCheck)
+			wg.Done()
+		}()
+	}
+
+	if prev := n.previous(); prev != nil {
+		wg.Add(1)
+		go func() {
+			n.retirePrevious(ctx, prev)
+			wg.Done()
+		}()
+	}
+
+	// runs last, once the dataplane is torn down
+	defer func() {
+		if opts.releaseLease && n.parentCtx.Err() != nil && !leaveDataplane() {
+			n.releaseLease()
+		}
+	}()
+
 	defer func() {
-		if n.ipMasq {
-			if err := teardownIPMasq(n.Config.Network); err != nil {
+		if !opts.mssClamp || n.preserveDataplane() || migrating {
+			return
+		}
+		if err := n.fw.TeardownMSSClamp(n.Config.Network); err != nil {
+			log.Errorf("Failed to tear down MSS clamping for network %v: %v", n.Name, err)
+		}
+	}()
+
+	defer func() {
+		pu, ok := n.bn.(backend.PortUser)
+		if !ok || n.preserveDataplane() || migrating {
+			return
+		}
+		if err := n.fw.ClosePorts(pu.Ports()); err != nil {
+			log.Errorf("Failed to close backend ports for network %v: %v", n.Name, err)
+		}
+	}()
+
+	defer func() {
+		switch {
+		case !n.IPMasq(), migrating:
+		case n.preserveDataplane():
+			log.Infof("Graceful restart: leaving IP Masquerade rules for network %v in place", n.Name)
+		default:
+			if err := n.fw.TeardownMasq(n.masq); err != nil {
 				log.Errorf("Failed to tear down IP Masquerade for network %v: %v", n.Name, err)
 			}
 		}
 	}()
 
+	defer func() {
+		if migrating {
+			return
+		}
+		bnCancel()
+		<-bnDone
+		n.stopPrevious()
+	}()
+
 	defer wg.Wait()
 
 	dur := n.bn.Lease().Expiration.Sub(time.Now()) - renewMargin
 	for {
 		select {
 		case <-time.After(dur):
+			pass := backend.StartLoopPass(n.Name, "leases")
+			pass.Items(1)
 			err := n.sm.RenewLease(n.ctx, n.Name, n.bn.Lease())
+			if err != nil {
+				pass.Error()
+			}
+			pass.Done()
 			if err != nil {
 				log.Error("Error renewing lease (trying again in 1 min): ", err)
 				dur = time.Minute
 				continue
 			}
 
-			log.Info("Lease renewed, new expiration: ", n.bn.Lease().Expiration)
+			log.InfoKV(fmt.Sprint("Lease renewed, new expiration: ", n.bn.Lease().Expiration),
+				logging.FieldEvent, "lease-renewed",
+				logging.FieldNetwork, n.Name,
+				logging.FieldSubnet, n.bn.Lease().Subnet,
+			)
+			n.notifier.send(leaseRenewed, n.Name, n.bn.Lease())
+			n.writeCheckpoint(n.bn)
 			dur = n.bn.Lease().Expiration.Sub(time.Now()) - renewMargin
 
 		case e := <-evts:
@@ -169,21 +475,89 @@ func (n *Network) runOnce(extIface *backend.ExternalInterface, inited func(bn ba
 				dur = n.bn.Lease().Expiration.Sub(time.Now()) - renewMargin
 
 			case subnet.EventRemoved:
-				log.Warning("Lease has been revoked")
+				log.WarningKV("Lease has been revoked",
+					logging.FieldEvent, "lease-revoked",
+					logging.FieldNetwork, n.Name,
+					logging.FieldSubnet, n.bn.Lease().Subnet,
+				)
+				n.notifier.send(leaseRevoked, n.Name, n.bn.Lease())
 				interruptFunc()
 				return errInterrupted
 			}
 
+		case <-n.uplinkMTU:
+			n.followUplinkMTU(extIface)
+
+		case config := <-n.backendChanged:
+			bn, err := n.migrate(config)
+			if err != nil {
+				log.Errorf("Failed to migrate network %v to the %v backend, staying on %v: %v", n.Name, config.BackendType, n.Config.BackendType, err)
+				continue
+			}
+			n.setPrevious(&prevNetwork{bn: n.bn, config: n.Config, cancel: bnCancel, done: bnDone})
+			n.next, n.nextConfig = bn, config
+			migrating = true
+			interruptFunc()
+			return errMigrating
+
 		case <-n.ctx.Done():
 			return errCanceled
 		}
 	}
 }
 
+// notifyUplinkMTU has the network follow the new MTU of the external
+// interface, without blocking when it is already due to.
+func (n *Network) notifyUplinkMTU() {
+	select {
+	case n.uplinkMTU <- struct{}{}:
+	default:
+	}
+}
+
+// set by Manager.HandOff
+var handingOff int32
+
+// leaveDataplane returns true if flanneld leaves the dataplane in place when
+// it exits, for the next instance to take over.
+func leaveDataplane() bool {
+	return opts.gracefulRestart || atomic.LoadInt32(&handingOff) != 0
+}
+
+// preserveDataplane returns true if flanneld is shutting down in graceful
+// restart mode, in which case the next instance takes over the rules we
+// installed.  A network that is removed from the registry is always torn
+// down.
+func (n *Network) preserveDataplane() bool {
+	return leaveDataplane() && n.parentCtx.Err() != nil
+}
+
+// releaseLease revokes our lease on shutdown with --release-lease-on-exit,
+// so that the peers drop their routes to us right away rather than when it
+// expires. The registry calls of the network are canceled by then.
+func (n *Network) releaseLease() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+	defer cancel()
+
+	sn := n.bn.Lease().Subnet
+	if err := n.sm.RevokeLease(ctx, n.Name, sn); err != nil {
+		log.Errorf("Failed to release lease %v of network %v: %v", sn, n.Name, err)
+		return
+	}
+	log.InfoKV("Lease released",
+		logging.FieldEvent, "lease-released",
+		logging.FieldNetwork, n.Name,
+		logging.FieldSubnet, sn,
+	)
+}
+
 func (n *Network) Run(extIface *backend.ExternalInterface, inited func(bn backend.Network)) {
 	for {
 		switch n.runOnce(extIface, inited) {
 		case errInterrupted:
+			n.setBackendNetwork(nil)
+
+		case errMigrating:
 
 		case errCanceled:
 			return
@@ -0,0 +1,39 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOverlayBackendConfig(t *testing.T) {
+	be := json.RawMessage(`{"Type":"udp","port":8285,"MTU":1400}`)
+	overlaid, err := overlayBackendConfig(be, map[string]interface{}{"Port": 9000})
+	if err != nil {
+		t.Fatalf("overlayBackendConfig failed: %v", err)
+	}
+
+	cfg := map[string]interface{}{}
+	if err := json.Unmarshal(overlaid, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg["port"]; ok || cfg["Port"] != float64(9000) {
+		t.Errorf("the override was shadowed by the registry: %s", overlaid)
+	}
+	if cfg["Type"] != "udp" || cfg["MTU"] != float64(1400) {
+		t.Errorf("the other options were not kept: %s", overlaid)
+	}
+}
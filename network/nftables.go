@@ -0,0 +1,347 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// nftFirewall keeps the masquerade rules of each network in a table of its
+// own, so they never mix with rules of other agents (or of the iptables-nft
+// shim) and can be replaced and removed atomically with a single nft
+// transaction.
+type nftFirewall struct{}
+
+func nftTable(ipn ip.IP4Net) string {
+	return "flannel_" + ipn.StringSep("_", "_")
+}
+
+// nftTable6 holds the IPv6 rules of the network. It is named after the IPv4
+// network so that it can be deleted along with the IPv4 table even after
+// --ipv6-masq has been turned off.
+func nftTable6(ipn ip.IP4Net) string {
+	return "flannel6_" + ipn.StringSep("_", "_")
+}
+
+func nftMasqRules(mc *masqConfig) []string {
+	n := mc.Network.String()
+	r := nftHairpinRules(mc, "ip", n)
+
+	// don't NAT traffic within the overlay network
+	r = append(r, fmt.Sprintf("ip saddr %v ip daddr %v return", n, n))
+	// nor traffic to the excluded destinations
+	for _, d := range mc.NoMasq {
+		r = append(r, fmt.Sprintf("ip saddr %v ip daddr %v return", n, d))
+	}
+
+	r = append(r,
+		// NAT if it's not multicast traffic
+		fmt.Sprintf("ip saddr %v ip daddr != 224.0.0.0/4 %v", n, nftMasqTarget(mc)),
+		// masquerade anything headed towards flannel from the host
+		fmt.Sprintf("ip saddr != %v ip daddr %v %v", n, n, nftMasqTarget(mc)),
+	)
+	return append(r, nftMarkRules(mc)...)
+}
+
+// nftMasqTarget and nftMarkRules are written the way nft lists them, so
+// that CheckMasq recognizes them.
+func nftMasqTarget(mc *masqConfig) string {
+	if mc.FWMark == 0 {
+		return "masquerade"
+	}
+	return fmt.Sprintf("meta mark set meta mark | 0x%08x", mc.FWMark)
+}
+
+func nftMarkRules(mc *masqConfig) []string {
+	if mc.FWMark == 0 {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("meta mark & 0x%08x != 0x%08x return", mc.FWMark, mc.FWMark),
+		fmt.Sprintf("meta mark set meta mark & 0x%08x", ^mc.FWMark),
+		"masquerade",
+	}
+}
+
+func nftMasqRules6(mc *masqConfig) []string {
+	n := mc.IPv6Network.String()
+
+	r := append(nftHairpinRules(mc, "ip6", n),
+		fmt.Sprintf("ip6 saddr %v ip6 daddr %v return", n, n),
+		fmt.Sprintf("ip6 saddr %v ip6 daddr != ff00::/8 %v", n, nftMasqTarget(mc)),
+		fmt.Sprintf("ip6 saddr != %v ip6 daddr %v %v", n, n, nftMasqTarget(mc)),
+	)
+	return append(r, nftMarkRules(mc)...)
+}
+
+// nftHairpinRules are the equivalent of hairpinRules for the address family
+// fam of network n.
+func nftHairpinRules(mc *masqConfig, fam, n string) []string {
+	if mc.HairpinBridge == "" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("%v saddr %v %v daddr %v oifname \"%v\" ct status dnat %v", fam, n, fam, n, mc.HairpinBridge, nftMasqTarget(mc)),
+	}
+}
+
+func writeNftTable(buf *bytes.Buffer, family, t string, rules []string) {
+	fmt.Fprintf(buf, "table %v %v {\n", family, t)
+	fmt.Fprintln(buf, "\tchain postrouting {")
+	fmt.Fprintln(buf, "\t\ttype nat hook postrouting priority 100; policy accept;")
+	for _, r := range rules {
+		fmt.Fprintf(buf, "\t\t%v\n", r)
+	}
+	fmt.Fprintln(buf, "\t}")
+	fmt.Fprintln(buf, "}")
+}
+
+// nftScript returns a script that replaces the tables of the network with
+// ones containing the masquerade rules. Declaring a table before deleting it
+// makes the deletion succeed when it does not exist yet.
+func nftScript(mc *masqConfig, withRules bool) string {
+	t, t6 := nftTable(mc.Network), nftTable6(mc.Network)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "table ip %v\n", t)
+	fmt.Fprintf(buf, "delete table ip %v\n", t)
+	fmt.Fprintf(buf, "table ip6 %v\n", t6)
+	fmt.Fprintf(buf, "delete table ip6 %v\n", t6)
+	if withRules {
+		writeNftTable(buf, "ip", t, nftMasqRules(mc))
+		if mc.IPv6Network != nil {
+			writeNftTable(buf, "ip6", t6, nftMasqRules6(mc))
+		}
+	}
+	return buf.String()
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (f *nftFirewall) SetupMasq(mc *masqConfig) error {
+	log.Infof("Adding nftables table %v", nftTable(mc.Network))
+	if err := runNft(nftScript(mc, true)); err != nil {
+		return fmt.Errorf("failed to set up IP masquerade table: %v", err)
+	}
+	return nil
+}
+
+func (f *nftFirewall) TeardownMasq(mc *masqConfig) error {
+	log.Infof("Deleting nftables table %v", nftTable(mc.Network))
+	if err := runNft(nftScript(mc, false)); err != nil {
+		return fmt.Errorf("failed to delete IP masquerade table: %v", err)
+	}
+	return nil
+}
+
+func (f *nftFirewall) PlanMasq(mc *masqConfig) []string {
+	cmds := []string{}
+	for _, r := range nftMasqRules(mc) {
+		cmds = append(cmds, fmt.Sprintf("nft add rule ip %v postrouting %v", nftTable(mc.Network), r))
+	}
+	if mc.IPv6Network != nil {
+		for _, r := range nftMasqRules6(mc) {
+			cmds = append(cmds, fmt.Sprintf("nft add rule ip6 %v postrouting %v", nftTable6(mc.Network), r))
+		}
+	}
+	return cmds
+}
+
+func (f *nftFirewall) CheckMasq(mc *masqConfig) (*masqDiff, error) {
+	d := checkNftChain("ip", nftTable(mc.Network), nftMasqRules(mc))
+	if mc.IPv6Network != nil {
+		d.merge(checkNftChain("ip6", nftTable6(mc.Network), nftMasqRules6(mc)))
+	}
+	return d, nil
+}
+
+func checkNftChain(family, table string, rules []string) *masqDiff {
+	out, err := exec.Command("nft", "list", "chain", family, table, "postrouting").CombinedOutput()
+	if err != nil {
+		// the table or chain is gone altogether
+		return &masqDiff{Missing: rules}
+	}
+
+	installed := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", line == "}":
+		case strings.HasPrefix(line, "table "), strings.HasPrefix(line, "chain "), strings.HasPrefix(line, "type "):
+		default:
+			installed = append(installed, line)
+		}
+	}
+
+	// everything in our own table concerns the network
+	return diffRules(rules, installed, func(string) bool { return true })
+}
+
+func (f *nftFirewall) RepairMasq(mc *masqConfig) error {
+	return f.SetupMasq(mc)
+}
+
+func (f *nftFirewall) DumpMasq(w io.Writer, mc *masqConfig) {
+	dumpNftTable(w, "ip", nftTable(mc.Network))
+	if mc.IPv6Network != nil {
+		dumpNftTable(w, "ip6", nftTable6(mc.Network))
+	}
+}
+
+func dumpNftTable(w io.Writer, family, table string) {
+	fmt.Fprintf(w, "nftables table %v %v:\n", family, table)
+	out, err := exec.Command("nft", "list", "table", family, table).CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(w, "  MISSING (%s)\n", bytes.TrimSpace(out))
+		return
+	}
+	iw := &indentWriter{w: w, prefix: "  "}
+	iw.Write(out)
+}
+
+// OpenPorts does nothing, as ports blocked by other nftables rules are up
+// to the administrator.
+func (f *nftFirewall) OpenPorts(ports []string) error {
+	return nil
+}
+
+func (f *nftFirewall) ClosePorts(ports []string) error {
+	return nil
+}
+
+// BlockedPorts looks at every chain hooked into input for the first rule
+// matching only the protocol and port, or no condition at all, falling back
+// to the policy of the chain. A port is blocked if any of the chains drops
+// it, as they all have to accept it.
+func (f *nftFirewall) BlockedPorts(ports []string) ([]string, error) {
+	out, err := exec.Command("nft", "list", "ruleset").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nft list ruleset: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	blocked := []string{}
+	for _, p := range ports {
+		if nftBlocks(string(out), p) {
+			blocked = append(blocked, p)
+		}
+	}
+	return blocked, nil
+}
+
+func nftVerdict(fields []string) string {
+	for _, f := range fields {
+		switch f {
+		case "accept", "drop", "reject":
+			return f
+		}
+	}
+	return ""
+}
+
+func nftBlocks(ruleset, port string) bool {
+	num, proto := splitPort(port)
+	match := proto + " dport " + num + " "
+
+	blocked := false
+	input, decided, policy := false, false, ""
+	for _, line := range strings.Split(ruleset, "\n") {
+		l := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(l, "chain "):
+			input, decided, policy = false, false, ""
+
+		case strings.Contains(l, "hook input"):
+			input = true
+			if strings.Contains(l, "policy drop") {
+				policy = "drop"
+			}
+
+		case l == "}":
+			if input && !decided && policy == "drop" {
+				blocked = true
+			}
+			input = false
+
+		case input && !decided:
+			v := nftVerdict(strings.Fields(l))
+			if v != "" && (strings.HasPrefix(l, v) || strings.HasPrefix(l, match)) {
+				decided = true
+				blocked = blocked || v != "accept"
+			}
+		}
+	}
+
+	return blocked
+}
+
+func nftMSSTable(ipn ip.IP4Net) string {
+	return "flannel_mss_" + ipn.StringSep("_", "_")
+}
+
+func nftMSSScript(ipn ip.IP4Net, withRule bool) string {
+	t := nftMSSTable(ipn)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "table ip %v\n", t)
+	fmt.Fprintf(buf, "delete table ip %v\n", t)
+	if withRule {
+		fmt.Fprintf(buf, "table ip %v {\n", t)
+		fmt.Fprintln(buf, "\tchain forward {")
+		fmt.Fprintln(buf, "\t\ttype filter hook forward priority -150; policy accept;")
+		fmt.Fprintf(buf, "\t\t%v\n", nftMSSRule(ipn))
+		fmt.Fprintln(buf, "\t}")
+		fmt.Fprintln(buf, "}")
+	}
+	return buf.String()
+}
+
+func nftMSSRule(ipn ip.IP4Net) string {
+	return fmt.Sprintf("ip daddr %v tcp flags & (syn|rst) == syn tcp option maxseg size set rt mtu", ipn)
+}
+
+func (f *nftFirewall) SetupMSSClamp(ipn ip.IP4Net) error {
+	log.Infof("Adding nftables table %v", nftMSSTable(ipn))
+	if err := runNft(nftMSSScript(ipn, true)); err != nil {
+		return fmt.Errorf("failed to set up MSS clamping table: %v", err)
+	}
+	return nil
+}
+
+func (f *nftFirewall) TeardownMSSClamp(ipn ip.IP4Net) error {
+	log.Infof("Deleting nftables table %v", nftMSSTable(ipn))
+	if err := runNft(nftMSSScript(ipn, false)); err != nil {
+		return fmt.Errorf("failed to delete MSS clamping table: %v", err)
+	}
+	return nil
+}
+
+func (f *nftFirewall) PlanMSSClamp(ipn ip.IP4Net) []string {
+	return []string{fmt.Sprintf("nft add rule ip %v forward %v", nftMSSTable(ipn), nftMSSRule(ipn))}
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	notifyQueueLen  = 100
+	notifyRetries   = 3
+	notifyTimeout   = 10 * time.Second
+	leaseAcquired   = "acquired"
+	leaseRenewed    = "renewed"
+	leaseUpdated    = "updated"
+	leaseRevoked    = "revoked"
+	defaultNATSSubj = "flannel.leases"
+)
+
+// leaseEvent is what gets posted to the webhook and published to NATS
+// for each change of one of our leases.
+type leaseEvent struct {
+	Event string
+	// Network is only set in multi-network mode
+	Network string `json:",omitempty"`
+	Lease   subnet.Lease
+	Time    time.Time
+}
+
+// notifier delivers lease events to --notify-webhook and --notify-nats in
+// the order they occurred, without blocking the caller.
+type notifier struct {
+	webhook string
+	nats    *natsConn
+	subject string
+	client  *http.Client
+	events  chan *leaseEvent
+}
+
+// newNotifier returns nil when no notification target is configured.
+func newNotifier() (*notifier, error) {
+	if opts.notifyWebhook == "" && opts.notifyNATS == "" {
+		return nil, nil
+	}
+
+	nf := &notifier{
+		webhook: opts.notifyWebhook,
+		subject: opts.notifyNATSSubject,
+		client:  &http.Client{Timeout: notifyTimeout},
+		events:  make(chan *leaseEvent, notifyQueueLen),
+	}
+
+	if opts.notifyNATS != "" {
+		var err error
+		if nf.nats, err = newNATSConn(opts.notifyNATS); err != nil {
+			return nil, err
+		}
+	}
+
+	return nf, nil
+}
+
+func (nf *notifier) send(event string, netname string, l *subnet.Lease) {
+	if nf == nil {
+		return
+	}
+
+	evt := &leaseEvent{
+		Event:   event,
+		Network: netname,
+		Lease:   *l,
+		Time:    time.Now(),
+	}
+
+	select {
+	case nf.events <- evt:
+	default:
+		log.Warningf("Notification queue full, dropping lease %v event for %v", event, l.Subnet)
+	}
+}
+
+func (nf *notifier) run(ctx context.Context) {
+	if nf == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if nf.nats != nil {
+				nf.nats.Close()
+			}
+			return
+
+		case evt := <-nf.events:
+			data, err := json.Marshal(evt)
+			if err != nil {
+				log.Errorf("Failed to encode lease event: %v", err)
+				continue
+			}
+
+			if nf.webhook != "" {
+				nf.retry(ctx, "post lease event to webhook", func() error {
+					return nf.post(data)
+				})
+			}
+			if nf.nats != nil {
+				nf.retry(ctx, "publish lease event to NATS", func() error {
+					return nf.nats.Publish(nf.subject, data)
+				})
+			}
+		}
+	}
+}
+
+func (nf *notifier) retry(ctx context.Context, desc string, f func() error) {
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil {
+			return
+		}
+
+		if i == notifyRetries {
+			log.Errorf("Failed to %v, giving up: %v", desc, err)
+			return
+		}
+		log.Warningf("Failed to %v (will retry): %v", desc, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(i) * time.Second):
+		}
+	}
+}
+
+func (nf *notifier) post(data []byte) error {
+	resp, err := nf.client.Post(nf.webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
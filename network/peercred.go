@@ -0,0 +1,102 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// peerCreds are the credentials of the processes at the other end of the
+// connections accepted by a peerCredListener, by the remote address it
+// gives these connections.
+var peerCreds = struct {
+	sync.Mutex
+	next  int
+	creds map[string]*syscall.Ucred
+}{creds: map[string]*syscall.Ucred{}}
+
+// peerCredListener records the credentials of the process at the other end
+// of each unix socket connection it accepts, for peerCred to find them by
+// the remote address of the requests.
+type peerCredListener struct {
+	net.Listener
+}
+
+func (l peerCredListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return c, nil
+	}
+	cred, err := readPeerCred(uc)
+	if err != nil {
+		return c, nil
+	}
+
+	peerCreds.Lock()
+	defer peerCreds.Unlock()
+	peerCreds.next++
+	addr := &net.UnixAddr{Name: fmt.Sprintf("@%v", peerCreds.next), Net: "unix"}
+	peerCreds.creds[addr.String()] = cred
+	return &peerCredConn{uc, addr}, nil
+}
+
+func readPeerCred(uc *net.UnixConn) (*syscall.Ucred, error) {
+	f, err := uc.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return syscall.GetsockoptUcred(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+}
+
+// peerCredConn is a connection whose peer credentials are recorded under
+// addr until it is closed.
+type peerCredConn struct {
+	*net.UnixConn
+	addr *net.UnixAddr
+}
+
+func (c *peerCredConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *peerCredConn) Close() error {
+	peerCreds.Lock()
+	delete(peerCreds.creds, c.addr.String())
+	peerCreds.Unlock()
+	return c.UnixConn.Close()
+}
+
+// peerCred returns the credentials of the client of r, nil if unknown.
+func peerCred(r *http.Request) *syscall.Ucred {
+	peerCreds.Lock()
+	defer peerCreds.Unlock()
+	return peerCreds.creds[r.RemoteAddr]
+}
+
+// isAdmin returns whether the client of r runs as root or as our user.
+func isAdmin(r *http.Request) bool {
+	cred := peerCred(r)
+	return cred != nil && (cred.Uid == 0 || int(cred.Uid) == os.Getuid())
+}
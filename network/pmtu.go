@@ -0,0 +1,455 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/subnet"
+)
+
+var peerPathMTU = metrics.NewGauge("flannel_peer_path_mtu",
+	"Path MTU of the underlay to the peer node, as found by --mtu-discovery-interval.", "network", "node")
+
+// minPathMTU is the smallest MTU every IPv4 path has to support.
+const minPathMTU = 576
+
+// routeMTU returns the MTU of the route to dst: the smallest of the MTU of
+// the route, the path MTU the kernel learnt from ICMP fragmentation needed
+// messages and the MTU of the outgoing interface, e.g. a GRE or IPsec
+// tunnel rather than the external interface.
+func routeMTU(dst ip.IP4) (int, error) {
+	out, err := exec.Command("ip", "-o", "-4", "route", "get", dst.String()).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("ip route get %v: %v: %s", dst, err, strings.TrimSpace(string(out)))
+	}
+
+	mtu := 0
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "dev":
+			iface, err := net.InterfaceByName(fields[i+1])
+			if err != nil {
+				return 0, err
+			}
+			if mtu == 0 || iface.MTU < mtu {
+				mtu = iface.MTU
+			}
+		case "mtu":
+			v := fields[i+1]
+			if v == "lock" && i+2 < len(fields) {
+				v = fields[i+2]
+			}
+			if m, err := strconv.Atoi(v); err == nil && (mtu == 0 || m < mtu) {
+				mtu = m
+			}
+		}
+	}
+	if mtu == 0 {
+		return 0, fmt.Errorf("no route to %v", dst)
+	}
+	return mtu, nil
+}
+
+// listenDontFragment opens an ICMP socket whose packets carry the DF bit,
+// without the kernel holding them back to the path MTU it knows of, so that
+// they probe the path. The socket option is set before net takes the socket
+// over, as there is no way to reach the socket of an IPConn before Go 1.9.
+func listenDontFragment() (*net.IPConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set the DF bit: %v", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	return c.(*net.IPConn), nil
+}
+
+// sizedEchoRequest is an echo request making an IP packet of size bytes.
+func sizedEchoRequest(id, seq uint16, size int) []byte {
+	b := make([]byte, size-20)
+	b[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], seq)
+	binary.BigEndian.PutUint16(b[2:], icmpChecksum(b))
+	return b
+}
+
+// mtuProber finds path MTUs by sending echo requests of different sizes
+// with the DF bit set.
+type mtuProber struct {
+	conn    *net.IPConn
+	id      uint16
+	seq     uint16
+	replies chan echoReply
+	timeout time.Duration
+}
+
+func newMTUProber(timeout time.Duration) (*mtuProber, error) {
+	conn, err := listenDontFragment()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &mtuProber{
+		conn: conn,
+		// apart from the peer probes
+		id:      uint16(os.Getpid()) ^ 0x8000,
+		replies: make(chan echoReply, 16),
+		timeout: timeout,
+	}
+	go readEchoReplies(conn, p.id, p.replies)
+	return p, nil
+}
+
+func (p *mtuProber) Close() {
+	p.conn.Close()
+}
+
+// fits tells whether a packet of size bytes makes it to dst and back.
+func (p *mtuProber) fits(ctx context.Context, dst ip.IP4, size int) bool {
+	p.seq++
+	seq := p.seq
+	if _, err := p.conn.WriteTo(sizedEchoRequest(p.id, seq, size), &net.IPAddr{IP: dst.ToIP()}); err != nil {
+		// EMSGSIZE beyond the MTU of the interface
+		return false
+	}
+
+	deadline := time.After(p.timeout)
+	for {
+		select {
+		case r := <-p.replies:
+			if r.seq == seq && r.from == dst {
+				return true
+			}
+		case <-deadline:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// pathMTU returns the largest packet size up to max that reaches dst, by
+// binary search, or 0 if dst does not answer even the smallest packets.
+func (p *mtuProber) pathMTU(ctx context.Context, dst ip.IP4, max int) int {
+	if p.fits(ctx, dst, max) {
+		return max
+	}
+	if !p.fits(ctx, dst, minPathMTU) {
+		return 0
+	}
+
+	lo, hi := minPathMTU, max
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if p.fits(ctx, dst, mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// discoverMTU keeps the MTU of the backend network at the smallest path MTU
+// to the peer nodes, less the overhead of the encapsulation, checking every
+// interval. The subnet file and CNI config are rewritten when it changes,
+// which affects new containers only.
+func (n *Network) discoverMTU(ctx context.Context, bn backend.Network, extIface *backend.ExternalInterface, interval time.Duration) {
+	ma, ok := bn.(backend.MTUAdjuster)
+	if !ok {
+		log.Infof("Not discovering the path MTU of network %v: the %v backend does not support it", n.Name, n.Config.BackendType)
+		return
+	}
+
+	var prober *mtuProber
+	if opts.mtuProbe {
+		var err error
+		if prober, err = newMTUProber(opts.peerProbeTimeout); err != nil {
+			log.Errorf("Not probing the path MTU of network %v: %v", n.Name, err)
+		} else {
+			defer prober.Close()
+		}
+	}
+
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, bn.Lease(), evts)
+
+	// the nodes of the peer subnets
+	peers := map[ip.IP4Net]ip.IP4{}
+	// the MTU the peers advertise, if they do
+	advertised := map[ip.IP4Net]int{}
+	// the nodes with a path MTU gauge
+	gauged := map[ip.IP4]bool{}
+	// the first check follows the initial leases
+	check := time.After(time.Second)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case batch := <-evts:
+			for _, evt := range batch {
+				if evt.Type == subnet.EventAdded {
+					peers[evt.Lease.Subnet] = evt.Lease.Attrs.PublicIP
+					advertised[evt.Lease.Subnet] = evt.Lease.Attrs.MTU
+				} else {
+					delete(peers, evt.Lease.Subnet)
+					delete(advertised, evt.Lease.Subnet)
+				}
+			}
+			continue
+
+		case <-check:
+			check = time.After(interval)
+		}
+
+		mtu := extIface.MTU()
+		nodes := map[ip.IP4]bool{}
+		for _, node := range peers {
+			if nodes[node] {
+				continue
+			}
+			nodes[node] = true
+
+			pmtu, err := routeMTU(node)
+			if err != nil {
+				log.Warningf("Failed to find the path MTU to %v: %v", node, err)
+				continue
+			}
+			if prober != nil {
+				if probed := prober.pathMTU(ctx, node, pmtu); probed > 0 {
+					pmtu = probed
+				} else {
+					log.V(1).Infof("Path MTU probes of %v unanswered, using the route MTU %v", node, pmtu)
+				}
+			}
+
+			peerPathMTU.Set(float64(pmtu), n.Name, node.String())
+			gauged[node] = true
+			if pmtu < mtu {
+				mtu = pmtu
+			}
+		}
+		for node := range gauged {
+			if !nodes[node] {
+				peerPathMTU.Delete(n.Name, node.String())
+				delete(gauged, node)
+			}
+		}
+
+		mtu -= ma.Overhead()
+		if m := n.Config.MTU; m > 0 && m < mtu {
+			mtu = m
+		}
+		// a peer behind a smaller external interface takes no larger
+		// packets, whatever the path to it
+		for _, m := range advertised {
+			if m > 0 && m < mtu {
+				mtu = m
+			}
+		}
+		if mtu == bn.MTU() {
+			continue
+		}
+
+		old := bn.MTU()
+		if err := ma.SetMTU(mtu); err != nil {
+			log.Errorf("Failed to change the MTU of network %v: %v", n.Name, err)
+			continue
+		}
+		if bn.MTU() == old {
+			continue
+		}
+		log.Infof("MTU of network %v changed from %v to %v following the path MTU of the peers", n.Name, old, bn.MTU())
+
+		if n.subnetFileWriter != nil {
+			if err := n.subnetFileWriter(bn); err != nil {
+				log.Errorf("Failed to write the subnet file of network %v: %v", n.Name, err)
+			}
+		}
+	}
+}
+
+// advertisedMTU is the largest MTU of the network the host takes, that of
+// the external interface less the overhead of the backend, unless the
+// network config sets a lower one.
+func advertisedMTU(config *subnet.Config, bn backend.Network, extIface *backend.ExternalInterface) int {
+	if ma, ok := bn.(backend.MTUAdjuster); ok {
+		return maxMTU(config, ma, extIface)
+	}
+	return bn.MTU()
+}
+
+// maxMTU returns the MTU of the external interface less the overhead of the
+// backend, or the MTU of the network config if lower.
+func maxMTU(config *subnet.Config, ma backend.MTUAdjuster, extIface *backend.ExternalInterface) int {
+	mtu := extIface.MTU() - ma.Overhead()
+	if config.MTU > 0 && config.MTU < mtu {
+		return config.MTU
+	}
+	return mtu
+}
+
+// applyConfigMTU sets the MTU of the network config on the backend network,
+// which must leave room for the overhead of the encapsulation.
+func (n *Network) applyConfigMTU(bn backend.Network, extIface *backend.ExternalInterface) error {
+	mtu := n.Config.MTU
+	if mtu == 0 {
+		return nil
+	}
+
+	ma, ok := bn.(backend.MTUAdjuster)
+	if !ok {
+		return fmt.Errorf("the %v backend does not support the MTU of the network config", n.Config.BackendType)
+	}
+	if max := extIface.MTU() - ma.Overhead(); mtu > max {
+		return fmt.Errorf("MTU %v of the network config is too large: the MTU %v of %v leaves %v bytes with the %v bytes of overhead of the %v backend",
+			mtu, extIface.MTU(), extIface.Iface.Name, max, ma.Overhead(), n.Config.BackendType)
+	}
+
+	if mtu == bn.MTU() {
+		return nil
+	}
+	if err := ma.SetMTU(mtu); err != nil {
+		return fmt.Errorf("failed to set the MTU %v of the network config: %v", mtu, err)
+	}
+	log.Infof("MTU of network %v set to %v by the network config", n.Name, mtu)
+	return nil
+}
+
+// advertiseMTU records the MTU the host takes in its lease, renewing the
+// lease when it changed so that the peers learn of it.
+func (n *Network) advertiseMTU(extIface *backend.ExternalInterface) {
+	l := n.bn.Lease()
+	mtu := advertisedMTU(n.Config, n.bn, extIface)
+	if l.Attrs.MTU == mtu {
+		return
+	}
+
+	old := l.Attrs.MTU
+	l.Attrs.MTU = mtu
+	if err := n.sm.RenewLease(n.ctx, n.Name, l); err != nil {
+		// the next renewal advertises it
+		log.Errorf("Failed to advertise the MTU %v of network %v: %v", mtu, n.Name, err)
+		return
+	}
+	if old != 0 {
+		n.notifier.send(leaseUpdated, n.Name, l)
+	}
+}
+
+// negotiateMTU keeps track of the smallest MTU the peers advertise, for the
+// network to never take a larger one, so that a host with jumbo frames does
+// not send packets a peer on a smaller MTU drops, and to go up again as soon
+// as all peers take larger ones.
+func (n *Network) negotiateMTU(ctx context.Context, lease *subnet.Lease) {
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, lease, evts)
+
+	advertised := map[ip.IP4Net]int{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case batch := <-evts:
+			for _, evt := range batch {
+				if evt.Type == subnet.EventAdded {
+					advertised[evt.Lease.Subnet] = evt.Lease.Attrs.MTU
+				} else {
+					delete(advertised, evt.Lease.Subnet)
+				}
+			}
+		}
+
+		min := 0
+		for _, m := range advertised {
+			if m > 0 && (min == 0 || m < min) {
+				min = m
+			}
+		}
+
+		n.mux.Lock()
+		changed := min != n.peersMTU
+		n.peersMTU = min
+		n.mux.Unlock()
+		if changed {
+			log.V(1).Infof("Smallest MTU advertised by the peers of network %v is now %v", n.Name, min)
+			n.notifyUplinkMTU()
+		}
+	}
+}
+
+// followUplinkMTU fits the network to the new MTU of the external interface
+// and that of the peers: the device MTU, the MTU advertised in the lease and
+// the subnet file and CNI config, which affect new containers only.
+func (n *Network) followUplinkMTU(extIface *backend.ExternalInterface) {
+	bn := n.bn
+	old := bn.MTU()
+	if ma, ok := bn.(backend.MTUAdjuster); ok {
+		mtu := maxMTU(n.Config, ma, extIface)
+		n.mux.Lock()
+		if n.peersMTU > 0 && n.peersMTU < mtu {
+			mtu = n.peersMTU
+		}
+		n.mux.Unlock()
+		// path MTU discovery raises the MTU itself once the paths allow
+		if opts.mtuDiscovery == 0 || mtu < old {
+			if err := ma.SetMTU(mtu); err != nil {
+				log.Errorf("Failed to change the MTU of network %v: %v", n.Name, err)
+			}
+		}
+	}
+
+	n.advertiseMTU(extIface)
+
+	if bn.MTU() == old {
+		return
+	}
+	log.Infof("MTU of network %v changed from %v to %v following external interface %v and the peers", n.Name, old, bn.MTU(), extIface.Iface.Name)
+
+	if n.subnetFileWriter != nil {
+		if err := n.subnetFileWriter(bn); err != nil {
+			log.Errorf("Failed to write the subnet file of network %v: %v", n.Name, err)
+		}
+	}
+}
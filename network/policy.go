@@ -0,0 +1,221 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/kube"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/policy"
+)
+
+// policySettle is how long to wait for more changes before recomputing the
+// rules, so that a burst of pod events results in a single nft run.
+const policySettle = 500 * time.Millisecond
+
+const policyRetry = 5 * time.Second
+
+// policyEnforcer enforces the Kubernetes NetworkPolicies on the pods of
+// this node with nftables.
+type policyEnforcer struct {
+	node    string
+	pods    *kube.Cache
+	nss     *kube.Cache
+	pols    *kube.Cache
+	changed chan struct{}
+
+	mux    sync.Mutex
+	script string
+}
+
+// newKubeClient returns a client of the API server given by the --kube-*
+// options.
+func newKubeClient() (*kube.Client, error) {
+	cfg := kube.InClusterConfig()
+	if opts.kubeAPIServer != "" {
+		cfg.Server = opts.kubeAPIServer
+	}
+	if opts.kubeTokenFile != "" {
+		cfg.TokenFile = opts.kubeTokenFile
+	}
+	if opts.kubeCAFile != "" {
+		cfg.CAFile = opts.kubeCAFile
+	}
+	c, err := kube.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
+	}
+	return c, nil
+}
+
+// kubeNodeName returns the name of this node in Kubernetes.
+func kubeNodeName() (string, error) {
+	node := opts.kubeNodeName
+	if node == "" {
+		node = os.Getenv("NODE_NAME")
+	}
+	if node == "" {
+		var err error
+		if node, err = os.Hostname(); err != nil {
+			return "", fmt.Errorf("failed to determine the node name: %v", err)
+		}
+	}
+	return node, nil
+}
+
+func newPolicyEnforcer() (*policyEnforcer, error) {
+	c, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	node, err := kubeNodeName()
+	if err != nil {
+		return nil, err
+	}
+
+	pe := &policyEnforcer{
+		node:    node,
+		changed: make(chan struct{}, 1),
+	}
+	pe.pods = kube.NewCache(c, "/api/v1/pods", pe.notify)
+	pe.nss = kube.NewCache(c, "/api/v1/namespaces", pe.notify)
+	pe.pols = kube.NewCache(c, "/apis/networking.k8s.io/v1/networkpolicies", pe.notify)
+	return pe, nil
+}
+
+func (pe *policyEnforcer) notify() {
+	select {
+	case pe.changed <- struct{}{}:
+	default:
+	}
+}
+
+func decodeItems(items []json.RawMessage, into interface{}) error {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, into)
+}
+
+func (pe *policyEnforcer) state() (*policy.State, error) {
+	st := &policy.State{}
+	if err := decodeItems(pe.pods.Items(), &st.Pods); err != nil {
+		return nil, fmt.Errorf("failed to decode pods: %v", err)
+	}
+	if err := decodeItems(pe.nss.Items(), &st.Namespaces); err != nil {
+		return nil, fmt.Errorf("failed to decode namespaces: %v", err)
+	}
+	if err := decodeItems(pe.pols.Items(), &st.Policies); err != nil {
+		return nil, fmt.Errorf("failed to decode network policies: %v", err)
+	}
+	return st, nil
+}
+
+// apply replaces the rules if the policies, pods or namespaces have
+// changed them.
+func (pe *policyEnforcer) apply() error {
+	st, err := pe.state()
+	if err != nil {
+		return err
+	}
+
+	rs := policy.Compute(st, func(p *kube.Pod) bool {
+		return p.Spec.NodeName == pe.node
+	})
+	script := policy.Script(rs)
+
+	pe.mux.Lock()
+	defer pe.mux.Unlock()
+	if script == pe.script {
+		return nil
+	}
+
+	if err := runNft(script); err != nil {
+		return fmt.Errorf("failed to install network policy rules: %v", err)
+	}
+	pe.script = script
+	log.Infof("Enforcing %v network policies: %v pods of node %v isolated for ingress, %v for egress",
+		len(st.Policies), rs.IngressIsolated, pe.node, rs.EgressIsolated)
+	return nil
+}
+
+// run enforces the policies until ctx is done. Nothing is enforced before
+// the pods, namespaces and policies have all been listed, as rules computed
+// from part of them would drop allowed traffic.
+func (pe *policyEnforcer) run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, c := range []*kube.Cache{pe.pods, pe.nss, pe.pols} {
+		wg.Add(1)
+		go func(c *kube.Cache) {
+			c.Run(ctx)
+			wg.Done()
+		}(c)
+	}
+	defer wg.Wait()
+
+	log.Infof("Enforcing the network policies of the pods of node %v", pe.node)
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			if !leaveDataplane() {
+				pe.teardown()
+			}
+			return
+
+		case <-pe.changed:
+			// let the changes settle
+			select {
+			case <-time.After(policySettle):
+			case <-ctx.Done():
+				continue
+			}
+
+		case <-retry:
+		}
+		retry = nil
+
+		if !pe.pods.Synced() || !pe.nss.Synced() || !pe.pols.Synced() {
+			continue
+		}
+		if err := pe.apply(); err != nil {
+			log.Errorf("%v (will retry)", err)
+			retry = time.After(policyRetry)
+		}
+	}
+}
+
+func (pe *policyEnforcer) teardown() {
+	log.Infof("Deleting nftables table %v", policy.Table)
+	if err := runNft(policy.Script(nil)); err != nil {
+		log.Errorf("Failed to delete the network policy rules: %v", err)
+	}
+}
+
+// DumpState writes the rules enforcing the policies.
+func (pe *policyEnforcer) DumpState(w io.Writer) {
+	fmt.Fprintf(w, "\nnetwork policies of node %v:\n", pe.node)
+	dumpNftTable(&indentWriter{w: w, prefix: "  "}, "ip", policy.Table)
+}
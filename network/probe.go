@@ -0,0 +1,255 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/subnet"
+)
+
+var (
+	peerReachable = metrics.NewGauge("flannel_peer_reachable",
+		"Whether the gateway IP of the peer's subnet answered the last probes (1) or not (0).", "network", "subnet", "node")
+	peerProbeRTT = metrics.NewGauge("flannel_peer_probe_rtt_seconds",
+		"Round trip time of the last answered probe of the peer.", "network", "subnet", "node")
+	peerProbeFailures = metrics.NewCounter("flannel_peer_probe_failures_total",
+		"Number of probes of the peer which were not answered in time.", "network", "subnet", "node")
+)
+
+const (
+	icmpEchoRequest = 8
+	icmpEchoReply   = 0
+)
+
+// probeTarget is the address probed for a lease: the first usable IP of
+// the subnet, which is the one written to the subnet file and usually
+// assigned to the container bridge of the peer.
+func probeTarget(l *subnet.Lease) ip.IP4 {
+	return l.Subnet.IP + 1
+}
+
+type peerProbe struct {
+	node   string
+	target ip.IP4
+	// consecutive unanswered probes
+	failures  int
+	reachable bool
+}
+
+func (p *peerProbe) labels(netname string, sn ip.IP4Net) []string {
+	return []string{netname, sn.String(), p.node}
+}
+
+type echoReply struct {
+	from ip.IP4
+	seq  uint16
+	at   time.Time
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func echoRequest(id, seq uint16) []byte {
+	b := make([]byte, 16)
+	b[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint16(b[2:], icmpChecksum(b))
+	return b
+}
+
+// readEchoReplies passes the echo replies with our id received on conn to
+// replies until conn is closed. The raw socket gets all ICMP messages of
+// the host, the rest is ignored.
+func readEchoReplies(conn net.PacketConn, id uint16, replies chan<- echoReply) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			close(replies)
+			return
+		}
+		if n < 8 || buf[0] != icmpEchoReply || binary.BigEndian.Uint16(buf[4:]) != id {
+			continue
+		}
+		ipa, ok := addr.(*net.IPAddr)
+		if !ok || ipa.IP.To4() == nil {
+			continue
+		}
+		select {
+		case replies <- echoReply{from: ip.FromIP(ipa.IP), seq: binary.BigEndian.Uint16(buf[6:]), at: time.Now()}:
+		default:
+			// too late for its round
+		}
+	}
+}
+
+// probePeers pings the gateway IP of each peer's subnet through the overlay
+// every interval and exports whether it answers. A peer which misses
+// --peer-probe-failures probes in a row is reported as unreachable, and with
+// --peer-probe-repair has the backend restore its dataplane state.
+func (n *Network) probePeers(ctx context.Context, ownLease *subnet.Lease, interval time.Duration) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		log.Errorf("Not probing the peers of network %v: failed to open ICMP socket: %v", n.Name, err)
+		return
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	replies := make(chan echoReply, 64)
+	go readEchoReplies(conn, id, replies)
+
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, ownLease, evts)
+
+	timeout := opts.peerProbeTimeout
+	if timeout > interval {
+		timeout = interval
+	}
+
+	peers := map[ip.IP4Net]*peerProbe{}
+	var seq uint16
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case batch := <-evts:
+			for _, evt := range batch {
+				sn := evt.Lease.Subnet
+				old, known := peers[sn]
+				node := evt.Lease.Attrs.PublicIP.String()
+				if known && (evt.Type == subnet.EventRemoved || old.node != node) {
+					peerReachable.Delete(old.labels(n.Name, sn)...)
+					peerProbeRTT.Delete(old.labels(n.Name, sn)...)
+					peerProbeFailures.Delete(old.labels(n.Name, sn)...)
+					delete(peers, sn)
+				}
+				if evt.Type == subnet.EventAdded && (!known || old.node != node) {
+					// assumed reachable until probed
+					peers[sn] = &peerProbe{node: node, target: probeTarget(&evt.Lease), reachable: true}
+				}
+			}
+
+		case <-time.After(interval):
+			if len(peers) == 0 {
+				continue
+			}
+
+			// seq of each probe, to match the replies with
+			pending := map[uint16]ip.IP4Net{}
+			sent := time.Now()
+			for sn, p := range peers {
+				seq++
+				pending[seq] = sn
+				if _, err := conn.WriteTo(echoRequest(id, seq), &net.IPAddr{IP: p.target.ToIP()}); err != nil {
+					log.V(1).Infof("Failed to probe %v (%v): %v", p.target, sn, err)
+				}
+			}
+
+			answered := map[ip.IP4Net]bool{}
+			deadline := time.After(timeout)
+		wait:
+			for len(answered) < len(pending) {
+				select {
+				case r, ok := <-replies:
+					if !ok {
+						log.Errorf("Stopped probing the peers of network %v: ICMP socket closed", n.Name)
+						return
+					}
+					sn, ok := pending[r.seq]
+					if p := peers[sn]; ok && p != nil && p.target == r.from {
+						answered[sn] = true
+						peerProbeRTT.Set(r.at.Sub(sent).Seconds(), p.labels(n.Name, sn)...)
+					}
+				case <-deadline:
+					break wait
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			for sn, p := range peers {
+				n.updateProbe(ctx, sn, p, answered[sn])
+			}
+		}
+	}
+}
+
+func (n *Network) updateProbe(ctx context.Context, sn ip.IP4Net, p *peerProbe, answered bool) {
+	lvs := p.labels(n.Name, sn)
+	if answered {
+		if !p.reachable {
+			log.Infof("Peer %v (%v) of network %v is reachable again", sn, p.node, n.Name)
+		}
+		p.failures = 0
+		p.reachable = true
+		peerReachable.Set(1, lvs...)
+		return
+	}
+
+	peerProbeFailures.Inc(lvs...)
+	p.failures++
+	if !p.reachable || p.failures < opts.peerProbeFailures {
+		return
+	}
+
+	p.reachable = false
+	peerReachable.Set(0, lvs...)
+	log.Warningf("Peer %v (%v) of network %v is unreachable: %v probes of %v unanswered", sn, p.node, n.Name, p.failures, p.target)
+
+	if opts.peerProbeRepair {
+		n.repairDataplane(ctx, fmt.Sprintf("peer %v is unreachable", sn))
+	}
+}
+
+// repairDataplane has the backend restore its routes or FDB entries, unless
+// route programming is paused.
+func (n *Network) repairDataplane(ctx context.Context, reason string) {
+	r, ok := n.backendNetwork().(backend.Reconciler)
+	if !ok || backend.RoutingPaused() {
+		return
+	}
+
+	log.Infof("Restoring the dataplane of network %v as %v", n.Name, reason)
+	if err := r.Reconcile(ctx); err != nil {
+		log.Errorf("Failed to restore the dataplane of network %v: %v", n.Name, err)
+	}
+}
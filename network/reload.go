@@ -0,0 +1,116 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// Reload re-selects the external interface, restarting the networks on it
+// if it changed, and re-applies the settings which can change without a
+// restart (currently --ip-masq). The caller is expected to have updated the
+// flag values beforehand.
+func (m *Manager) Reload() {
+	cur := m.externalInterface()
+	extIface, err := lookupExtIface(0)
+	switch {
+	case err != nil:
+		log.Warningf("Reload: failed to re-resolve external interface: %v", err)
+
+	case !sameExtIface(extIface, cur):
+		log.Warningf("Reload: external interface changed from %v (%v, public %v) to %v (%v, public %v); restarting the networks",
+			cur.Iface.Name, cur.IfaceAddr, cur.ExtAddr,
+			extIface.Iface.Name, extIface.IfaceAddr, extIface.ExtAddr)
+		m.switchExtIface(extIface)
+
+	default:
+		log.Infof("Reload: external interface %v (%v, public %v) unchanged", extIface.Iface.Name, extIface.IfaceAddr, extIface.ExtAddr)
+	}
+
+	m.mux.Lock()
+	m.ipMasq = opts.ipMasq
+	m.mux.Unlock()
+
+	m.forEachNetwork(func(n *Network) {
+		if err := n.SetIPMasq(opts.ipMasq); err != nil {
+			log.Errorf("Reload: network %q: %v", n.Name, err)
+		}
+
+		if bn := n.backendNetwork(); bn != nil {
+			if err := m.writeSubnetFile(n, bn); err != nil {
+				log.Warningf("Reload: %v failed to write subnet file: %s", n.Name, err)
+			}
+		}
+	})
+}
+
+func (m *Manager) getIPMasq() bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.ipMasq
+}
+
+// IPMasq returns whether IP masquerading is enabled for the network.
+func (n *Network) IPMasq() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.ipMasq
+}
+
+// SetIPMasq enables or disables IP masquerading for the network. When it
+// is already enabled the rules are re-applied, restoring any that were
+// removed behind our back.
+func (n *Network) SetIPMasq(enabled bool) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.bn == nil {
+		// not initialized yet; init() will pick up the new setting
+		n.ipMasq = enabled
+		return nil
+	}
+
+	switch {
+	case enabled:
+		if err := n.fw.SetupMasq(n.masq); err != nil {
+			return wrapError("set up IP Masquerade", err)
+		}
+		if !n.ipMasq {
+			log.Infof("Reload: enabled IP masquerade for network %q", n.Name)
+			if opts.flushConntrack {
+				flushMasqConntrack(n.Config.Network)
+			}
+		}
+
+	case n.ipMasq:
+		if err := n.fw.TeardownMasq(n.masq); err != nil {
+			return wrapError("tear down IP Masquerade", err)
+		}
+		log.Infof("Reload: disabled IP masquerade for network %q", n.Name)
+		if opts.flushConntrack {
+			flushMasqConntrack(n.Config.Network)
+		}
+	}
+
+	n.ipMasq = enabled
+	return nil
+}
+
+func (n *Network) backendNetwork() backend.Network {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.bn
+}
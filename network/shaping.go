@@ -0,0 +1,310 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/kube"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The traffic to each peer subnet is shaped on the device it leaves
+// through, that of the backend (backend.DeviceUser) or else the external
+// interface, by an HTB class per peer matching its subnet, with fq as the
+// leaf qdisc. Traffic to anything else matches no class, which HTB sends
+// unshaped.
+//
+// A peer is shaped to the EgressBandwidth of this host, or to the RateLimit
+// of its lease if lower, so that it can have the whole cluster throttle
+// what it is sent.
+
+// egressBandwidthAnnotation on the Kubernetes node overrides the
+// EgressBandwidth of the network config with --kube-egress-bandwidth.
+const egressBandwidthAnnotation = "flannel.alpha.coreos.com/egress-bandwidth"
+
+// shapingHandle is the handle of our root qdisc, whose classes are numbered
+// from 1 in the order of the peer subnets.
+const shapingHandle = "f1:"
+
+// shapedPeer is a peer subnet and the bits per second its traffic is
+// shaped to.
+type shapedPeer struct {
+	Subnet ip.IP4Net
+	Rate   uint64
+}
+
+type byPeerSubnet []shapedPeer
+
+func (l byPeerSubnet) Len() int           { return len(l) }
+func (l byPeerSubnet) Less(i, j int) bool { return l[i].Subnet.IP < l[j].Subnet.IP }
+func (l byPeerSubnet) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// shapingScript returns the tc batch commands shaping the traffic to each
+// of peers, and those adding the fq leaves, which the kernel may lack.
+func shapingScript(dev string, peers []shapedPeer) (string, string) {
+	classes, leaves := &bytes.Buffer{}, &bytes.Buffer{}
+	fmt.Fprintf(classes, "qdisc add dev %v root handle %v htb\n", dev, shapingHandle)
+	for i, p := range peers {
+		class := fmt.Sprintf("%v%x", shapingHandle, i+1)
+		fmt.Fprintf(classes, "class add dev %v parent %v classid %v htb rate %dbit ceil %dbit\n", dev, shapingHandle, class, p.Rate, p.Rate)
+		fmt.Fprintf(classes, "filter add dev %v parent %v protocol ip prio 1 u32 match ip dst %v flowid %v\n", dev, shapingHandle, p.Subnet, class)
+		fmt.Fprintf(leaves, "qdisc add dev %v parent %v fq\n", dev, class)
+	}
+	return classes.String(), leaves.String()
+}
+
+func runTc(script string) error {
+	cmd := exec.Command("tc", "-batch", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// shapingInstalled tells whether dev has our root qdisc.
+func shapingInstalled(dev string) bool {
+	out, err := exec.Command("tc", "qdisc", "show", "dev", dev, "root").CombinedOutput()
+	return err == nil && strings.Contains(string(out), "htb "+shapingHandle)
+}
+
+// syncShaping replaces the classes on dev, which briefly drops the packets
+// they have queued.
+func syncShaping(dev string, peers []shapedPeer) error {
+	if err := teardownShaping(dev); err != nil {
+		return err
+	}
+	classes, leaves := shapingScript(dev, peers)
+	if err := runTc(classes); err != nil {
+		return fmt.Errorf("failed to set up traffic shaping on %v: %v", dev, err)
+	}
+	if err := runTc(leaves); err != nil {
+		log.Warningf("Failed to add the fq qdiscs on %v, the classes keep their default qdisc: %v", dev, err)
+	}
+	return nil
+}
+
+func teardownShaping(dev string) error {
+	if !shapingInstalled(dev) {
+		return nil
+	}
+	if out, err := exec.Command("tc", "qdisc", "del", "dev", dev, "root").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to tear down traffic shaping on %v: %v: %s", dev, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// nodeEgressBandwidth watches the egress bandwidth annotation of this node.
+type nodeEgressBandwidth struct {
+	node  string
+	nodes *kube.Cache
+}
+
+func newNodeEgressBandwidth(changed func()) (*nodeEgressBandwidth, error) {
+	c, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	node, err := kubeNodeName()
+	if err != nil {
+		return nil, err
+	}
+	return &nodeEgressBandwidth{
+		node:  node,
+		nodes: kube.NewCache(c, "/api/v1/nodes", changed),
+	}, nil
+}
+
+// rate returns the bandwidth of the annotation, 0 if the node has none or
+// it is invalid.
+func (nb *nodeEgressBandwidth) rate() uint64 {
+	for _, item := range nb.nodes.Items() {
+		var node kube.Node
+		if err := json.Unmarshal(item, &node); err != nil || node.Metadata.Name != nb.node {
+			continue
+		}
+		s, ok := node.Metadata.Annotations[egressBandwidthAnnotation]
+		if !ok {
+			return 0
+		}
+		rate, err := subnet.ParseBandwidth(s)
+		if err != nil {
+			log.Warningf("Ignoring the %v annotation of node %v: %v", egressBandwidthAnnotation, nb.node, err)
+		}
+		return rate
+	}
+	return 0
+}
+
+// peerRateLimit returns the RateLimit of the lease of a peer, 0 if it has
+// none or it is invalid.
+func peerRateLimit(l *subnet.Lease) uint64 {
+	if l.Attrs.RateLimit == "" {
+		return 0
+	}
+	rate, err := subnet.ParseBandwidth(l.Attrs.RateLimit)
+	if err != nil {
+		log.Warningf("Ignoring the rate limit of subnet %v: %v", l.Subnet, err)
+	}
+	return rate
+}
+
+// minRate returns the lower of two rates, 0 standing for no limit.
+func minRate(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// shapeEgress keeps a class for each peer of the network on dev, limiting
+// the traffic to it to the rate of the annotation of this node with
+// --kube-egress-bandwidth, else to the EgressBandwidth of the network
+// config, and to the RateLimit of its lease. There is no shaping while none
+// is set.
+func (n *Network) shapeEgress(ctx context.Context, ownLease *subnet.Lease, dev string) {
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.Name, ownLease, evts)
+
+	nodeChanged := make(chan struct{}, 1)
+	var nb *nodeEgressBandwidth
+	if opts.kubeBandwidth {
+		var err error
+		nb, err = newNodeEgressBandwidth(func() {
+			select {
+			case nodeChanged <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			log.Errorf("Not following the %v annotation for network %v: %v", egressBandwidthAnnotation, n.Name, err)
+		} else {
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				nb.nodes.Run(ctx)
+				wg.Done()
+			}()
+			defer wg.Wait()
+		}
+	}
+
+	var configRate uint64
+	if n.Config.EgressBandwidth != "" {
+		configRate, _ = subnet.ParseBandwidth(n.Config.EgressBandwidth)
+	}
+	rate := func() uint64 {
+		if nb != nil {
+			if r := nb.rate(); r > 0 {
+				return r
+			}
+		}
+		return configRate
+	}
+
+	// a previous flanneld may have left its classes for us to replace
+	installed := shapingInstalled(dev)
+	defer func() {
+		if !installed || n.preserveDataplane() {
+			return
+		}
+		if err := teardownShaping(dev); err != nil {
+			log.Errorf("Failed to tear down traffic shaping for network %v: %v", n.Name, err)
+		}
+	}()
+
+	// the rate limit of each peer's lease, 0 for none
+	peers := map[ip.IP4Net]uint64{}
+	var cur uint64
+	var applied []shapedPeer
+	apply := func() {
+		r := rate()
+		list := []shapedPeer{}
+		for sn, limit := range peers {
+			if pr := minRate(r, limit); pr > 0 {
+				list = append(list, shapedPeer{sn, pr})
+			}
+		}
+		sort.Sort(byPeerSubnet(list))
+		if installed && reflect.DeepEqual(list, applied) {
+			return
+		}
+
+		if len(list) == 0 {
+			if installed {
+				log.Infof("No longer shaping the traffic of network %v to the other subnets", n.Name)
+				if err := teardownShaping(dev); err != nil {
+					log.Error(err)
+					return
+				}
+			}
+			installed, applied, cur = false, nil, r
+			return
+		}
+
+		if err := syncShaping(dev, list); err != nil {
+			log.Error(err)
+			return
+		}
+		if r != cur || !installed {
+			if r > 0 {
+				log.Infof("Shaping the traffic of network %v to each other subnet to %dbit/s on %v", n.Name, r, dev)
+			} else {
+				log.Infof("Shaping the traffic of network %v to the subnets with a rate limit on %v", n.Name, dev)
+			}
+		}
+		installed, applied, cur = true, list, r
+	}
+	apply()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-nodeChanged:
+			if nb.nodes.Synced() && rate() != cur {
+				apply()
+			}
+
+		case batch := <-evts:
+			for _, evt := range batch {
+				sn := evt.Lease.Subnet
+				if evt.Type == subnet.EventRemoved {
+					delete(peers, sn)
+					continue
+				}
+				limit := peerRateLimit(&evt.Lease)
+				if old, ok := peers[sn]; limit != 0 && (!ok || old != limit) {
+					log.Infof("Subnet %v of network %v asks to be sent at most %dbit/s", sn, n.Name, limit)
+				}
+				peers[sn] = limit
+			}
+			apply()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/subnetenv"
+	"github.com/coreos/flannel/subnet"
+)
+
+// subnetInfo is the JSON variant of the subnet file.
+type subnetInfo struct {
+	// Name is only set in multi-network mode
+	Name string `json:",omitempty"`
+	subnetenv.Env
+	BackendType string
+	Lease       *subnet.Lease
+	// FirewallRules are only set with --firewall=external
+	FirewallRules     []string `json:",omitempty"`
+	FirewallRulesFile string   `json:",omitempty"`
+}
+
+func newSubnetInfo(n *Network, bn backend.Network) *subnetInfo {
+	// Write out the first usable IP by incrementing
+	// sn.IP by one
+	sn := bn.Lease().Subnet
+	sn.IP += 1
+
+	return &subnetInfo{
+		Name: n.Name,
+		Env: subnetenv.Env{
+			Network: n.Config.Network,
+			Subnet:  sn,
+			MTU:     bn.MTU(),
+			IPMasq:  n.IPMasq(),
+		},
+		BackendType:   n.Config.BackendType,
+		Lease:         bn.Lease(),
+		FirewallRules: externalRules(n, bn),
+	}
+}
+
+// subnetInfo returns the subnetInfo of the network as written to its subnet
+// file.
+func (m *Manager) subnetInfo(n *Network, bn backend.Network) *subnetInfo {
+	si := newSubnetInfo(n, bn)
+	if si.FirewallRules != nil {
+		si.FirewallRulesFile = rulesPath(m.subnetFilePath(n.Name))
+	}
+	return si
+}
+
+// Vars returns the subnet file variables, including the path of the
+// firewall rules file with --firewall=external.
+func (si *subnetInfo) Vars() []string {
+	vars := si.Env.Vars()
+	if si.FirewallRulesFile != "" {
+		vars = append(vars, "FLANNEL_FIREWALL_RULES="+si.FirewallRulesFile)
+	}
+	return vars
+}
+
+func jsonPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+}
+
+// writeSubnetFile writes the subnet file of the network (and its JSON
+// variant with --subnet-file-json, the CNI config with --cni-conf and the
+// firewall rules with --firewall=external) and runs --subnet-file-notify if
+// the contents changed.
+func (m *Manager) writeSubnetFile(n *Network, bn backend.Network) error {
+	path := m.subnetFilePath(n.Name)
+	si := m.subnetInfo(n, bn)
+
+	rulesChanged := false
+	if si.FirewallRules != nil {
+		var err error
+		rulesChanged, err = fileutil.WriteFileAtomic(si.FirewallRulesFile, rulesFileContents(si.FirewallRules), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	changed, err := fileutil.WriteFileAtomic(path, []byte(strings.Join(si.Vars(), "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	changed = changed || rulesChanged
+
+	if opts.subnetFileJSON {
+		data, err := json.MarshalIndent(si, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		jsonChanged, err := fileutil.WriteFileAtomic(jsonPath(path), append(data, '\n'), 0644)
+		if err != nil {
+			return err
+		}
+		changed = changed || jsonChanged
+	}
+
+	if opts.cniConf != "" {
+		if err := writeCNIConf(si, path); err != nil {
+			return err
+		}
+	}
+
+	if changed && opts.subnetNotify != "" {
+		go runSubnetNotify(path, si)
+	}
+
+	return nil
+}
+
+func runSubnetNotify(path string, si *subnetInfo) {
+	env := hookEnv(si.Name, append(si.Vars(), "FLANNEL_SUBNET_FILE="+path)...)
+	runHook("subnet file notify command", opts.subnetNotify, env)
+}
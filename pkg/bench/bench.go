@@ -0,0 +1,196 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench measures the TCP throughput and round trip time to a bench
+// server, over the flannel network or the network underneath it.
+//
+// The client opens a connection per test and sends its type: 'T' is
+// followed by data until the client closes its side, after which the server
+// replies with the number of bytes it received; after 'L' the server echoes
+// everything back.
+package bench
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	testThroughput = 'T'
+	testLatency    = 'L'
+
+	bufSize = 128 * 1024
+)
+
+// Serve answers the tests of the clients connecting to l until it fails.
+func Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serve(conn)
+	}
+}
+
+func serve(conn net.Conn) {
+	defer conn.Close()
+
+	t := make([]byte, 1)
+	if _, err := io.ReadFull(conn, t); err != nil {
+		return
+	}
+
+	switch t[0] {
+	case testThroughput:
+		n, err := io.Copy(ioutil.Discard, conn)
+		if err != nil {
+			return
+		}
+		binary.Write(conn, binary.BigEndian, uint64(n))
+
+	case testLatency:
+		io.Copy(conn, conn)
+	}
+}
+
+// Throughput is the result of a throughput test.
+type Throughput struct {
+	Bytes    int64
+	Duration time.Duration
+}
+
+// BitsPerSecond returns the throughput in bits per second.
+func (t Throughput) BitsPerSecond() float64 {
+	if t.Duration <= 0 {
+		return 0
+	}
+	return float64(t.Bytes) * 8 / t.Duration.Seconds()
+}
+
+func (t Throughput) String() string {
+	return fmt.Sprintf("%.1f Mbit/s", t.BitsPerSecond()/1e6)
+}
+
+// MeasureThroughput sends data to the server at addr for d and returns how
+// much of it the server received, until it confirmed receiving it all.
+func MeasureThroughput(addr string, d time.Duration) (Throughput, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return Throughput{}, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{testThroughput}); err != nil {
+		return Throughput{}, err
+	}
+
+	buf := make([]byte, bufSize)
+	start := time.Now()
+	conn.SetWriteDeadline(start.Add(d))
+	for {
+		if _, err := conn.Write(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return Throughput{}, fmt.Errorf("failed to send: %v", err)
+		}
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var n uint64
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return Throughput{}, fmt.Errorf("failed to read the amount received: %v", err)
+	}
+	return Throughput{Bytes: int64(n), Duration: time.Since(start)}, nil
+}
+
+// Latency is the result of a latency test.
+type Latency struct {
+	Min, Avg, Max time.Duration
+	Samples       int
+}
+
+func (l Latency) String() string {
+	return fmt.Sprintf("min/avg/max %v/%v/%v", l.Min, l.Avg, l.Max)
+}
+
+// MeasureLatency measures the round trip time of count small messages to the
+// server at addr, sent one after the other.
+func MeasureLatency(addr string, count int) (Latency, error) {
+	if count < 1 {
+		return Latency{}, fmt.Errorf("at least one message is needed")
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return Latency{}, err
+	}
+	defer conn.Close()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(true)
+	}
+
+	if _, err := conn.Write([]byte{testLatency}); err != nil {
+		return Latency{}, err
+	}
+
+	l := Latency{Samples: count}
+	var total time.Duration
+	msg := make([]byte, 8)
+	reply := make([]byte, 8)
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint64(msg, uint64(i))
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		start := time.Now()
+		if _, err := conn.Write(msg); err != nil {
+			return Latency{}, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return Latency{}, err
+		}
+		rtt := time.Since(start)
+
+		if binary.BigEndian.Uint64(reply) != uint64(i) {
+			return Latency{}, fmt.Errorf("got the reply to another message")
+		}
+		if i == 0 || rtt < l.Min {
+			l.Min = rtt
+		}
+		if rtt > l.Max {
+			l.Max = rtt
+		}
+		total += rtt
+	}
+	l.Avg = total / time.Duration(count)
+	return l, nil
+}
+
+// Overhead returns the share of the throughput of the underlay which is
+// lost over the overlay, e.g. 0.05 for 5%.
+func Overhead(overlay, underlay Throughput) float64 {
+	u := underlay.BitsPerSecond()
+	if u == 0 {
+		return 0
+	}
+	return 1 - overlay.BitsPerSecond()/u
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go Serve(l)
+	return l.Addr().String()
+}
+
+func TestMeasureThroughput(t *testing.T) {
+	addr := startServer(t)
+
+	res, err := MeasureThroughput(addr, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("MeasureThroughput failed: %v", err)
+	}
+	if res.Bytes == 0 || res.Duration < 100*time.Millisecond {
+		t.Errorf("expected data to be received for at least 100ms, got %v bytes in %v", res.Bytes, res.Duration)
+	}
+}
+
+func TestMeasureLatency(t *testing.T) {
+	addr := startServer(t)
+
+	res, err := MeasureLatency(addr, 10)
+	if err != nil {
+		t.Fatalf("MeasureLatency failed: %v", err)
+	}
+	if res.Samples != 10 || res.Min <= 0 || res.Min > res.Avg || res.Avg > res.Max {
+		t.Errorf("inconsistent result: %+v", res)
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	overlay := Throughput{Bytes: 95, Duration: time.Second}
+	underlay := Throughput{Bytes: 100, Duration: time.Second}
+	if o := Overhead(overlay, underlay); o < 0.049 || o > 0.051 {
+		t.Errorf("expected an overhead of 5%%, got %v", o)
+	}
+	if o := Overhead(overlay, Throughput{}); o != 0 {
+		t.Errorf("expected no overhead without an underlay throughput, got %v", o)
+	}
+}
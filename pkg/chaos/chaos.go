@@ -0,0 +1,280 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chaos injects the faults flannel meets in production, to test
+// that it converges after them: failing registry writes, slow watches and
+// routes removed behind its back. It is only linked into flanneld built
+// with the chaos tag.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// ErrDropped is returned by the registry writes dropped by the Manager.
+var ErrDropped = errors.New("chaos: registry write dropped")
+
+// Config tells which faults to inject.
+type Config struct {
+	// DropWrites is the probability, from 0 to 1, with which a registry
+	// write (acquiring, renewing or revoking a lease, adding or removing
+	// a reservation) fails
+	DropWrites float64
+	// DelayWatches delays the result of each watch by a random time up to
+	// it
+	DelayWatches time.Duration
+	// RemoveRoutes is how often to remove the routes, ARP and FDB entries
+	// of a random peer
+	RemoveRoutes time.Duration
+	// Seed seeds the random choices, the current time if 0
+	Seed int64
+}
+
+// ParseConfig parses a comma separated list of faults such as
+// "drop-writes=0.1,delay-watches=5s,remove-routes=1m,seed=42".
+func ParseConfig(spec string) (Config, error) {
+	cfg := Config{}
+	for _, kv := range strings.Split(spec, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return Config{}, fmt.Errorf("invalid fault %q, expected name=value", kv)
+		}
+
+		var err error
+		switch parts[0] {
+		case "drop-writes":
+			cfg.DropWrites, err = strconv.ParseFloat(parts[1], 64)
+			if err == nil && (cfg.DropWrites < 0 || cfg.DropWrites > 1) {
+				err = fmt.Errorf("not between 0 and 1")
+			}
+		case "delay-watches":
+			cfg.DelayWatches, err = time.ParseDuration(parts[1])
+		case "remove-routes":
+			cfg.RemoveRoutes, err = time.ParseDuration(parts[1])
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(parts[1], 10, 64)
+		default:
+			return Config{}, fmt.Errorf("unknown fault %q, expected drop-writes, delay-watches, remove-routes or seed", parts[0])
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %v %q: %v", parts[0], parts[1], err)
+		}
+	}
+	return cfg, nil
+}
+
+// Manager is a subnet.Manager injecting the registry faults of its config
+// into the calls made through it. It also tracks the leases of the peers
+// seen by the watches, whose dataplane Run removes.
+type Manager struct {
+	subnet.Manager
+	cfg Config
+
+	mux   sync.Mutex
+	rnd   *rand.Rand
+	own   map[ip.IP4Net]bool
+	peers map[ip.IP4Net]subnet.Lease
+}
+
+// NewManager wraps sm to inject the faults of cfg.
+func NewManager(sm subnet.Manager, cfg Config) *Manager {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Warningf("chaos: injecting faults %+v", cfg)
+
+	return &Manager{
+		Manager: sm,
+		cfg:     cfg,
+		rnd:     rand.New(rand.NewSource(seed)),
+		own:     make(map[ip.IP4Net]bool),
+		peers:   make(map[ip.IP4Net]subnet.Lease),
+	}
+}
+
+// drop tells whether to fail the write op.
+func (m *Manager) drop(op string) bool {
+	m.mux.Lock()
+	drop := m.rnd.Float64() < m.cfg.DropWrites
+	m.mux.Unlock()
+
+	if drop {
+		log.Warningf("chaos: dropping %v", op)
+	}
+	return drop
+}
+
+// delay waits for a random time up to DelayWatches, or until ctx is done.
+func (m *Manager) delay(ctx context.Context) error {
+	if m.cfg.DelayWatches <= 0 {
+		return nil
+	}
+	m.mux.Lock()
+	d := time.Duration(m.rnd.Int63n(int64(m.cfg.DelayWatches)))
+	m.mux.Unlock()
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track records the peer leases of the result of a lease watch.
+func (m *Manager) track(res subnet.LeaseWatchResult) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for _, l := range res.Snapshot {
+		if !m.own[l.Subnet] {
+			m.peers[l.Subnet] = l
+		}
+	}
+	for _, evt := range res.Events {
+		switch {
+		case m.own[evt.Lease.Subnet]:
+		case evt.Type == subnet.EventAdded:
+			m.peers[evt.Lease.Subnet] = evt.Lease
+		case evt.Type == subnet.EventRemoved:
+			delete(m.peers, evt.Lease.Subnet)
+		}
+	}
+}
+
+func (m *Manager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if m.drop("AcquireLease") {
+		return nil, ErrDropped
+	}
+	l, err := m.Manager.AcquireLease(ctx, network, attrs)
+	if err == nil {
+		m.mux.Lock()
+		m.own[l.Subnet] = true
+		delete(m.peers, l.Subnet)
+		m.mux.Unlock()
+	}
+	return l, err
+}
+
+func (m *Manager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	if m.drop("RenewLease") {
+		return ErrDropped
+	}
+	return m.Manager.RenewLease(ctx, network, lease)
+}
+
+func (m *Manager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	if m.drop("RevokeLease") {
+		return ErrDropped
+	}
+	return m.Manager.RevokeLease(ctx, network, sn)
+}
+
+func (m *Manager) AddReservation(ctx context.Context, network string, r *subnet.Reservation) error {
+	if m.drop("AddReservation") {
+		return ErrDropped
+	}
+	return m.Manager.AddReservation(ctx, network, r)
+}
+
+func (m *Manager) RemoveReservation(ctx context.Context, network string, sn ip.IP4Net) error {
+	if m.drop("RemoveReservation") {
+		return ErrDropped
+	}
+	return m.Manager.RemoveReservation(ctx, network, sn)
+}
+
+func (m *Manager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	res, err := m.Manager.WatchLease(ctx, network, sn, cursor)
+	if err == nil {
+		err = m.delay(ctx)
+	}
+	return res, err
+}
+
+func (m *Manager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	res, err := m.Manager.WatchLeases(ctx, network, cursor)
+	if err == nil {
+		m.track(res)
+		err = m.delay(ctx)
+	}
+	return res, err
+}
+
+func (m *Manager) WatchNetworks(ctx context.Context, cursor interface{}) (subnet.NetworkWatchResult, error) {
+	res, err := m.Manager.WatchNetworks(ctx, cursor)
+	if err == nil {
+		err = m.delay(ctx)
+	}
+	return res, err
+}
+
+// randomPeer returns the lease of a random peer, or false if none is known.
+func (m *Manager) randomPeer() (subnet.Lease, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if len(m.peers) == 0 {
+		return subnet.Lease{}, false
+	}
+	// map order is not random enough to rely on
+	sns := make([]ip.IP4Net, 0, len(m.peers))
+	for sn := range m.peers {
+		sns = append(sns, sn)
+	}
+	return m.peers[sns[m.rnd.Intn(len(sns))]], true
+}
+
+// Run removes the dataplane of a random peer every RemoveRoutes until ctx
+// is done.
+func (m *Manager) Run(ctx context.Context) {
+	if m.cfg.RemoveRoutes <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-time.After(m.cfg.RemoveRoutes):
+		case <-ctx.Done():
+			return
+		}
+
+		l, ok := m.randomPeer()
+		if !ok {
+			continue
+		}
+		n, err := removeDataplane(l)
+		if err != nil {
+			log.Errorf("chaos: failed to remove the dataplane of peer %v: %v", l.Subnet, err)
+			continue
+		}
+		log.Warningf("chaos: removed %d routes, ARP and FDB entries of peer %v (%v)", n, l.Subnet, l.Attrs.PublicIP)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaos
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/subnet/subnettest"
+)
+
+const config = `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan" } }`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("drop-writes=0.25, delay-watches=2s,remove-routes=1m,seed=7")
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	expected := Config{DropWrites: 0.25, DelayWatches: 2 * time.Second, RemoveRoutes: time.Minute, Seed: 7}
+	if cfg != expected {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+
+	for _, spec := range []string{"drop-writes", "drop-writes=2", "delay-watches=soon", "flood=1"} {
+		if _, err := ParseConfig(spec); err == nil {
+			t.Errorf("ParseConfig(%q) did not fail", spec)
+		}
+	}
+}
+
+func attrs(pubIP string) *subnet.LeaseAttrs {
+	return &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4(pubIP), BackendType: "vxlan"}
+}
+
+func TestDropWrites(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewManager(subnettest.NewManager("", config), Config{DropWrites: 1, Seed: 1})
+	if _, err := m.AcquireLease(ctx, "", attrs("1.1.1.1")); err != ErrDropped {
+		t.Errorf("expected AcquireLease to be dropped, got %v", err)
+	}
+	if _, err := m.GetNetworkConfig(ctx, ""); err != nil {
+		t.Errorf("GetNetworkConfig failed: %v", err)
+	}
+
+	m = NewManager(subnettest.NewManager("", config), Config{DropWrites: 0, Seed: 1})
+	if _, err := m.AcquireLease(ctx, "", attrs("1.1.1.1")); err != nil {
+		t.Errorf("AcquireLease failed: %v", err)
+	}
+}
+
+func TestDelayWatches(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager(subnettest.NewManager("", config), Config{DelayWatches: time.Hour, Seed: 1})
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.WatchLeases(ctx, "", nil); err != context.DeadlineExceeded {
+		t.Errorf("expected the watch to be delayed past the deadline, got %v", err)
+	}
+}
+
+func TestTrackPeers(t *testing.T) {
+	ctx := context.Background()
+	sm := subnettest.NewManager("", config)
+	m := NewManager(sm, Config{Seed: 1})
+
+	if _, ok := m.randomPeer(); ok {
+		t.Fatal("a peer is known before any watch")
+	}
+
+	own, err := m.AcquireLease(ctx, "", attrs("1.1.1.1"))
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	peer, err := sm.AcquireLease(ctx, "", attrs("2.2.2.2"))
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	if _, err := m.WatchLeases(ctx, "", nil); err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		l, ok := m.randomPeer()
+		if !ok || !l.Subnet.Equal(peer.Subnet) {
+			t.Fatalf("expected only the peer %v, got %v (own lease %v)", peer.Subnet, l.Subnet, own.Subnet)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaos
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// removeDataplane deletes, as another program could, the routes to the
+// subnet of l, the ARP entries of its addresses and the FDB entries of its
+// public IP, whichever the backend programmed, and returns how many it
+// deleted.
+func removeDataplane(l subnet.Lease) (int, error) {
+	n := 0
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return n, fmt.Errorf("failed to list the routes: %v", err)
+	}
+	for _, r := range routes {
+		if r.Dst == nil || !ip.FromIPNet(r.Dst).Equal(l.Subnet) {
+			continue
+		}
+		if err := netlink.RouteDel(&r); err != nil {
+			return n, fmt.Errorf("failed to delete the route to %v: %v", r.Dst, err)
+		}
+		n++
+	}
+
+	neighs, err := netlink.NeighList(0, netlink.FAMILY_V4)
+	if err != nil {
+		return n, fmt.Errorf("failed to list the ARP entries: %v", err)
+	}
+	for _, nb := range neighs {
+		if nb.IP.To4() == nil || !l.Subnet.Contains(ip.FromIP(nb.IP)) {
+			continue
+		}
+		if err := netlink.NeighDel(&nb); err != nil {
+			return n, fmt.Errorf("failed to delete the ARP entry of %v: %v", nb.IP, err)
+		}
+		n++
+	}
+
+	fdb, err := netlink.NeighList(0, syscall.AF_BRIDGE)
+	if err != nil {
+		return n, fmt.Errorf("failed to list the FDB entries: %v", err)
+	}
+	for _, nb := range fdb {
+		if nb.IP.To4() == nil || ip.FromIP(nb.IP) != l.Attrs.PublicIP {
+			continue
+		}
+		if err := netlink.NeighDel(&nb); err != nil {
+			return n, fmt.Errorf("failed to delete the FDB entry of %v: %v", nb.HardwareAddr, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
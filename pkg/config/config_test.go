@@ -0,0 +1,104 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sample = `
+# flanneld settings
+etcd-endpoints = ["http://10.0.0.1:2379", "http://10.0.0.2:2379"]
+etcd_prefix = "/coreos.com/network" # trailing comment
+ip-masq = true
+iface = 'eth1#2'
+
+[backend]
+Port = 8472
+GBP = false
+`
+
+func TestParse(t *testing.T) {
+	secs, err := Parse(strings.NewReader(sample))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	expected := Sections{
+		"": {
+			"etcd-endpoints": []interface{}{"http://10.0.0.1:2379", "http://10.0.0.2:2379"},
+			"etcd_prefix":    "/coreos.com/network",
+			"ip-masq":        true,
+			"iface":          "eth1#2",
+		},
+		"backend": {
+			"Port": int64(8472),
+			"GBP":  false,
+		},
+	}
+
+	if !reflect.DeepEqual(secs, expected) {
+		t.Errorf("Parse mismatch: expected %v, got %v", expected, secs)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"[backend",
+		"novalue",
+		"a = 1\na = 2",
+		`a = "unterminated`,
+		"a = bareword",
+	} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("Parse(%q) did not fail", s)
+		}
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	endpoints := fs.String("etcd-endpoints", "", "")
+	prefix := fs.String("etcd-prefix", "", "")
+	masq := fs.Bool("ip-masq", false, "")
+	fs.Parse([]string{"--etcd-prefix=/from/cmdline"})
+
+	secs, err := Parse(strings.NewReader(sample))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	delete(secs[""], "iface")
+
+	if err := SetFlags(fs, secs[""]); err != nil {
+		t.Fatalf("SetFlags failed: %v", err)
+	}
+
+	if *endpoints != "http://10.0.0.1:2379,http://10.0.0.2:2379" {
+		t.Errorf("etcd-endpoints mismatch: got %q", *endpoints)
+	}
+	if *prefix != "/from/cmdline" {
+		t.Errorf("command line did not take precedence: got %q", *prefix)
+	}
+	if !*masq {
+		t.Errorf("ip-masq was not set")
+	}
+
+	if err := SetFlags(fs, map[string]interface{}{"bogus": 1}); err == nil {
+		t.Errorf("SetFlags accepted an unknown option")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Load parses the config file at path.
+func Load(path string) (Sections, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secs, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return secs, nil
+}
+
+// SetFlags sets the flags in fs from vals, whose keys are flag names (with
+// either dashes or underscores). Flags which have already been set, on the
+// command line or from the environment, are left alone so that they take
+// precedence over the file. Unknown keys are an error.
+func SetFlags(fs *flag.FlagSet, vals map[string]interface{}) error {
+	alreadySet := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		alreadySet[f.Name] = true
+	})
+
+	for key, v := range vals {
+		name := strings.Replace(key, "_", "-", -1)
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if alreadySet[name] {
+			continue
+		}
+
+		if err := fs.Set(name, ToString(v)); err != nil {
+			return fmt.Errorf("invalid value for %q: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// ToString converts a parsed value into its flag representation. Arrays
+// become comma-delimited lists.
+func ToString(v interface{}) string {
+	if arr, ok := v.([]interface{}); ok {
+		s := make([]string, len(arr))
+		for i, elem := range arr {
+			s[i] = fmt.Sprint(elem)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Sections maps a section name ("" for top level keys) to its key/value
+// pairs. Values are string, int64, float64, bool or []interface{}.
+type Sections map[string]map[string]interface{}
+
+// Parse reads the subset of TOML used by flanneld config files: comments,
+// [section] headers and key = value pairs where the value is a string,
+// integer, float, boolean or a single-line array of those.
+func Parse(r io.Reader) (Sections, error) {
+	secs := Sections{"": {}}
+	cur := ""
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed section header", lineno)
+			}
+			cur = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := secs[cur]; !ok {
+				secs[cur] = map[string]interface{}{}
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		if uq, err := strconv.Unquote(key); err == nil {
+			key = uq
+		}
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", lineno)
+		}
+		if _, ok := secs[cur][key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", lineno, key)
+		}
+
+		v, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		secs[cur][key] = v
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return secs, nil
+}
+
+// stripComment removes a trailing # comment that is not inside a string.
+func stripComment(s string) string {
+	if i := indexUnquoted(s, '#'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// indexUnquoted returns the index of the first sep in s that is outside
+// of a quoted string, or -1.
+func indexUnquoted(s string, sep byte) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == sep:
+			return i
+		}
+	}
+	return -1
+}
+
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+
+	case s == "true":
+		return true, nil
+
+	case s == "false":
+		return false, nil
+
+	case s[0] == '"':
+		return strconv.Unquote(s)
+
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+
+	case s[0] == '[':
+		return parseArray(s)
+	}
+
+	if i, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("invalid value %s", s)
+}
+
+func parseArray(s string) ([]interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated array %s", s)
+	}
+
+	arr := []interface{}{}
+	for _, elem := range splitArray(s[1 : len(s)-1]) {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		v, err := parseValue(elem)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+// splitArray splits on commas that are not inside strings.
+func splitArray(s string) []string {
+	var parts []string
+	for {
+		i := indexUnquoted(s, ',')
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic replaces the file at path with data so that readers see
+// either the old or the new contents in full. Missing parent directories
+// are created. It returns false, without touching the file, if the
+// contents would not change.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (bool, error) {
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return false, nil
+	}
+
+	dir, name := filepath.Split(path)
+	if dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return false, err
+	}
+	tempFile := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return false, err
+	}
+
+	// rename(2) the temporary file to the desired location so that it becomes
+	// atomically visible with the contents
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return false, err
+	}
+
+	return true, nil
+}
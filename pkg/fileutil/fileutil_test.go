@@ -0,0 +1,65 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sub", "subnet.env")
+
+	for i, tc := range []struct {
+		data    string
+		changed bool
+	}{
+		{"FLANNEL_MTU=1450\n", true},
+		{"FLANNEL_MTU=1450\n", false},
+		{"FLANNEL_MTU=1500\n", true},
+	} {
+		changed, err := WriteFileAtomic(path, []byte(tc.data), 0644)
+		if err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+		if changed != tc.changed {
+			t.Errorf("write %d: expected changed=%v, got %v", i, tc.changed, changed)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.data {
+			t.Errorf("write %d: expected %q, got %q", i, tc.data, data)
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("temporary files left behind: %v", files)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fips restricts the crypto of flanneld to the algorithms approved
+// by FIPS 140, as implemented by a validated crypto module.
+package fips
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// module is the validated crypto module flanneld uses, set by the files
+// specific to the build.
+var module string
+
+var enabled bool
+
+// cipherSuites are the approved TLS 1.2 cipher suites. Those of TLS 1.3
+// are approved as well.
+var cipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// Enable turns on FIPS mode, which fails if flanneld does not use a
+// validated crypto module.
+func Enable() error {
+	if module == "" {
+		return fmt.Errorf("flanneld does not use a FIPS 140 validated crypto module; build it with GOEXPERIMENT=boringcrypto or run it with GODEBUG=fips140=on")
+	}
+	enabled = true
+	return nil
+}
+
+// Enabled tells whether FIPS mode is on.
+func Enabled() bool {
+	return enabled
+}
+
+// Module returns the name of the validated crypto module, if any.
+func Module() string {
+	return module
+}
+
+// ConfigureTLS restricts cfg to approved protocol versions, cipher suites
+// and curves in FIPS mode.
+func ConfigureTLS(cfg *tls.Config) {
+	if !enabled || cfg == nil {
+		return
+	}
+	if cfg.MinVersion < tls.VersionTLS12 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	cfg.CipherSuites = cipherSuites
+	cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fips
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestConfigureTLS(t *testing.T) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS10}
+	ConfigureTLS(cfg)
+	if cfg.MinVersion != tls.VersionTLS10 || cfg.CipherSuites != nil {
+		t.Fatalf("config changed without FIPS mode")
+	}
+
+	saved := module
+	defer func() { module, enabled = saved, false }()
+
+	module = ""
+	if err := Enable(); err == nil || Enabled() {
+		t.Fatalf("Enable succeeded without a validated module")
+	}
+
+	module = "test"
+	if err := Enable(); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	ConfigureTLS(cfg)
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 at least, got %x", cfg.MinVersion)
+	}
+	if len(cfg.CipherSuites) != len(cipherSuites) || len(cfg.CurvePreferences) != 2 {
+		t.Errorf("cipher suites and curves were not restricted: %v %v", cfg.CipherSuites, cfg.CurvePreferences)
+	}
+	ConfigureTLS(nil)
+}
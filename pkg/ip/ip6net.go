@@ -0,0 +1,59 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// IP6Net is an IPv6 network. Unlike IP4Net it is a plain wrapper around
+// net.IPNet as flannel does no arithmetic on IPv6 addresses (yet).
+type IP6Net struct {
+	net.IPNet
+}
+
+// ParseIP6Net parses an IPv6 network in CIDR notation, masking off any host
+// bits.
+func ParseIP6Net(s string) (IP6Net, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return IP6Net{}, err
+	}
+	if n.IP.To4() != nil {
+		return IP6Net{}, fmt.Errorf("%q is not an IPv6 network", s)
+	}
+	return IP6Net{*n}, nil
+}
+
+func (n IP6Net) String() string {
+	return n.IPNet.String()
+}
+
+// json.Marshaler impl
+func (n IP6Net) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, n)), nil
+}
+
+// json.Unmarshaler impl
+func (n *IP6Net) UnmarshalJSON(j []byte) error {
+	val, err := ParseIP6Net(string(bytes.Trim(j, "\"")))
+	if err != nil {
+		return err
+	}
+	*n = val
+	return nil
+}
@@ -119,3 +119,29 @@ func TestIP4Net(t *testing.T) {
 		t.Error("Marshal of IP4Net failed with unexpected value: ", j)
 	}
 }
+
+func TestIP6Net(t *testing.T) {
+	n, err := ParseIP6Net("fd00:10:1::5/48")
+	if err != nil {
+		t.Fatalf("ParseIP6Net failed: %v", err)
+	}
+	if n.String() != "fd00:10:1::/48" {
+		t.Errorf("host bits not masked: %v", n)
+	}
+
+	if _, err := ParseIP6Net("10.1.0.0/16"); err == nil {
+		t.Errorf("ParseIP6Net accepted an IPv4 network")
+	}
+
+	j, err := json.Marshal(n)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var n2 IP6Net
+	if err := json.Unmarshal(j, &n2); err != nil {
+		t.Fatalf("Unmarshal of %s failed: %v", j, err)
+	}
+	if n2.String() != n.String() {
+		t.Errorf("JSON round trip mismatch: %v vs %v", n2, n)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipfix exports flow records to an IPFIX collector (RFC 7011) over
+// UDP, with a single fixed template for IPv4 flows.
+package ipfix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	version    = 10
+	headerLen  = 16
+	setHdrLen  = 4
+	templateID = 256
+
+	// keep messages within the usual MTU, as they are sent over UDP
+	maxMessageLen = 1400
+
+	// collectors forget templates received over UDP, so they are resent
+	templateRefresh = time.Minute
+)
+
+// the information elements of the template, with their IANA ids and sizes
+var fields = []struct{ id, size uint16 }{
+	{8, 4},   // sourceIPv4Address
+	{12, 4},  // destinationIPv4Address
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{1, 8},   // octetDeltaCount
+	{2, 8},   // packetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+}
+
+const recordLen = 4 + 4 + 2 + 2 + 1 + 8 + 8 + 8 + 8
+
+// Record is a unidirectional IPv4 flow, with the traffic since the last
+// record of the same flow.
+type Record struct {
+	Src, Dst         net.IP
+	SrcPort, DstPort uint16
+	Proto            uint8
+	Octets, Packets  uint64
+	Start, End       time.Time
+}
+
+// Exporter sends records to a collector.
+type Exporter struct {
+	conn   net.Conn
+	domain uint32
+
+	mux          sync.Mutex
+	seq          uint32
+	lastTemplate time.Time
+}
+
+// NewExporter returns an exporter sending to the collector at addr
+// (host:port) with the given observation domain id.
+func NewExporter(addr string, domain uint32) (*Exporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{conn: conn, domain: domain}, nil
+}
+
+func (e *Exporter) Close() error {
+	return e.conn.Close()
+}
+
+// Export sends the records, in as many messages as needed.
+func (e *Exporter) Export(records []Record) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	now := time.Now()
+	withTemplate := now.Sub(e.lastTemplate) >= templateRefresh
+	for len(records) > 0 || withTemplate {
+		msg, n := e.message(now, withTemplate, records)
+		if _, err := e.conn.Write(msg); err != nil {
+			return err
+		}
+		if withTemplate {
+			e.lastTemplate = now
+			withTemplate = false
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// message encodes as many of records as fit and returns how many it took.
+func (e *Exporter) message(now time.Time, withTemplate bool, records []Record) ([]byte, int) {
+	buf := &bytes.Buffer{}
+	// the header is filled in at the end
+	buf.Write(make([]byte, headerLen))
+
+	if withTemplate {
+		writeTemplateSet(buf)
+	}
+
+	n := (maxMessageLen - buf.Len() - setHdrLen) / recordLen
+	if n > len(records) {
+		n = len(records)
+	}
+	if n > 0 {
+		writeUint16(buf, templateID)
+		writeUint16(buf, uint16(setHdrLen+n*recordLen))
+		for _, r := range records[:n] {
+			writeRecord(buf, &r)
+		}
+	}
+
+	msg := buf.Bytes()
+	binary.BigEndian.PutUint16(msg[0:], version)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:], e.seq)
+	binary.BigEndian.PutUint32(msg[12:], e.domain)
+
+	// the sequence number counts data records
+	e.seq += uint32(n)
+	return msg, n
+}
+
+func writeTemplateSet(buf *bytes.Buffer) {
+	// set id 2 is for templates
+	writeUint16(buf, 2)
+	writeUint16(buf, uint16(setHdrLen+4+4*len(fields)))
+	writeUint16(buf, templateID)
+	writeUint16(buf, uint16(len(fields)))
+	for _, f := range fields {
+		writeUint16(buf, f.id)
+		writeUint16(buf, f.size)
+	}
+}
+
+func writeRecord(buf *bytes.Buffer, r *Record) {
+	buf.Write(ip4(r.Src))
+	buf.Write(ip4(r.Dst))
+	writeUint16(buf, r.SrcPort)
+	writeUint16(buf, r.DstPort)
+	buf.WriteByte(r.Proto)
+	writeUint64(buf, r.Octets)
+	writeUint64(buf, r.Packets)
+	writeUint64(buf, uint64(r.Start.UnixNano()/int64(time.Millisecond)))
+	writeUint64(buf, uint64(r.End.UnixNano()/int64(time.Millisecond)))
+}
+
+func ip4(a net.IP) []byte {
+	if a4 := a.To4(); a4 != nil {
+		return a4
+	}
+	return make([]byte, 4)
+}
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	e, err := NewExporter(l.LocalAddr().String(), 7)
+	if err != nil {
+		t.Fatalf("NewExporter failed: %v", err)
+	}
+	defer e.Close()
+
+	now := time.Now()
+	records := make([]Record, 40)
+	for i := range records {
+		records[i] = Record{
+			Src: net.ParseIP("10.1.5.2"), Dst: net.ParseIP("10.1.7.3"),
+			SrcPort: uint16(40000 + i), DstPort: 80, Proto: 6,
+			Octets: 1000, Packets: 10, Start: now, End: now,
+		}
+	}
+	if err := e.Export(records); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	total := 0
+	buf := make([]byte, 2000)
+	for total < len(records) {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed after %d records: %v", total, err)
+		}
+		msg := buf[:n]
+
+		if v := binary.BigEndian.Uint16(msg); v != version {
+			t.Errorf("bad version %v", v)
+		}
+		if int(binary.BigEndian.Uint16(msg[2:])) != n || n > maxMessageLen {
+			t.Errorf("bad message length %v for %v bytes", binary.BigEndian.Uint16(msg[2:]), n)
+		}
+		if seq := binary.BigEndian.Uint32(msg[8:]); int(seq) != total {
+			t.Errorf("expected sequence number %v, got %v", total, seq)
+		}
+		if d := binary.BigEndian.Uint32(msg[12:]); d != 7 {
+			t.Errorf("expected observation domain 7, got %v", d)
+		}
+
+		// walk the sets
+		for off := headerLen; off < n; {
+			id := binary.BigEndian.Uint16(msg[off:])
+			setLen := int(binary.BigEndian.Uint16(msg[off+2:]))
+			switch id {
+			case 2:
+				if total != 0 {
+					t.Errorf("template resent before the refresh interval")
+				}
+			case templateID:
+				total += (setLen - setHdrLen) / recordLen
+			default:
+				t.Fatalf("unexpected set id %v", id)
+			}
+			off += setLen
+		}
+	}
+
+	if total != len(records) {
+		t.Errorf("expected %v records, got %v", len(records), total)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keys has the key epochs and the replay protection shared by the
+// backends which authenticate or encrypt the packets between hosts.
+//
+// Every key has an epoch. A host publishes the epochs it has keys for in
+// its lease (LeaseAttrs.KeyEpochs) and sends to each peer with the newest
+// epoch both have. A key is thus rotated by adding it with a new epoch to
+// the key file of every host, one after the other, and removing the old
+// one once all hosts have the new one, without a flag day.
+package keys
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Set is the keys of a host by epoch.
+type Set struct {
+	keys map[uint32][]byte
+}
+
+// Load reads the key set of keys of keyLen bytes from the file at path,
+// see Parse.
+func Load(path string, keyLen int) (*Set, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %v", err)
+	}
+	s, err := Parse(data, keyLen)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return s, nil
+}
+
+// Parse parses a key set. It is either a single key, as is or hex or base64
+// encoded, which has epoch 0, or lines of an epoch and a hex or base64
+// encoded key. Empty lines and lines starting with # are ignored.
+func Parse(data []byte, keyLen int) (*Set, error) {
+	if len(data) == keyLen {
+		return &Set{map[uint32][]byte{0: data}}, nil
+	}
+	if k, err := decodeKey(strings.TrimSpace(string(data)), keyLen); err == nil {
+		return &Set{map[uint32][]byte{0: k}}, nil
+	}
+
+	s := &Set{make(map[uint32][]byte)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: expected an epoch and a key", i+1)
+		}
+		epoch, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid epoch %q", i+1, fields[0])
+		}
+		if _, ok := s.keys[uint32(epoch)]; ok {
+			return nil, fmt.Errorf("line %v: duplicate epoch %v", i+1, epoch)
+		}
+		k, err := decodeKey(fields[1], keyLen)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", i+1, err)
+		}
+		s.keys[uint32(epoch)] = k
+	}
+
+	if len(s.keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return s, nil
+}
+
+func decodeKey(s string, keyLen int) ([]byte, error) {
+	if k, err := hex.DecodeString(s); err == nil && len(k) == keyLen {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err == nil && len(k) == keyLen {
+		return k, nil
+	}
+	return nil, fmt.Errorf("a key must be %v bytes, hex or base64 encoded", keyLen)
+}
+
+// Epochs returns the epochs of the keys in ascending order.
+func (s *Set) Epochs() []uint32 {
+	epochs := make([]uint32, 0, len(s.keys))
+	for e := range s.keys {
+		epochs = append(epochs, e)
+	}
+	sort.Sort(byEpoch(epochs))
+	return epochs
+}
+
+type byEpoch []uint32
+
+func (l byEpoch) Len() int           { return len(l) }
+func (l byEpoch) Less(i, j int) bool { return l[i] < l[j] }
+func (l byEpoch) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Key returns the key of epoch, or nil if there is none.
+func (s *Set) Key(epoch uint32) []byte {
+	return s.keys[epoch]
+}
+
+// Newest returns the highest epoch.
+func (s *Set) Newest() uint32 {
+	epochs := s.Epochs()
+	return epochs[len(epochs)-1]
+}
+
+// Common returns the newest epoch shared with a peer having the keys of
+// peerEpochs. A peer publishing no epochs has a single key of epoch 0.
+func (s *Set) Common(peerEpochs []uint32) (uint32, bool) {
+	if len(peerEpochs) == 0 {
+		peerEpochs = []uint32{0}
+	}
+
+	found := false
+	var common uint32
+	for _, e := range peerEpochs {
+		if _, ok := s.keys[e]; ok && (!found || e > common) {
+			common = e
+			found = true
+		}
+	}
+	return common, found
+}
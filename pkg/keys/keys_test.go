@@ -0,0 +1,103 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseSingleKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, data := range [][]byte{
+		key,
+		[]byte(hex.EncodeToString(key) + "\n"),
+		[]byte(base64.StdEncoding.EncodeToString(key)),
+	} {
+		s, err := Parse(data, 32)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", data, err)
+		}
+		if !reflect.DeepEqual(s.Epochs(), []uint32{0}) || !bytes.Equal(s.Key(0), key) {
+			t.Errorf("Parse(%q): expected the key as epoch 0, got epochs %v", data, s.Epochs())
+		}
+	}
+}
+
+func TestParseEpochs(t *testing.T) {
+	k1 := bytes.Repeat([]byte{1}, 32)
+	k2 := bytes.Repeat([]byte{2}, 32)
+	data := "# rotated 2016-06-01\n" +
+		"2 " + base64.StdEncoding.EncodeToString(k2) + "\n" +
+		"\n" +
+		"1 " + hex.EncodeToString(k1) + "\n"
+
+	s, err := Parse([]byte(data), 32)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !reflect.DeepEqual(s.Epochs(), []uint32{1, 2}) {
+		t.Errorf("expected epochs [1 2], got %v", s.Epochs())
+	}
+	if !bytes.Equal(s.Key(1), k1) || !bytes.Equal(s.Key(2), k2) {
+		t.Errorf("keys mismatch")
+	}
+	if s.Newest() != 2 {
+		t.Errorf("expected newest epoch 2, got %v", s.Newest())
+	}
+
+	for _, bad := range []string{
+		"",
+		"# only a comment\n",
+		"1\n",
+		"x " + hex.EncodeToString(k1),
+		"1 " + hex.EncodeToString(k1[:16]),
+		"1 " + hex.EncodeToString(k1) + "\n1 " + hex.EncodeToString(k2),
+	} {
+		if _, err := Parse([]byte(bad), 32); err == nil {
+			t.Errorf("Parse(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestCommon(t *testing.T) {
+	k := bytes.Repeat([]byte{1}, 32)
+	s := &Set{map[uint32][]byte{1: k, 2: k, 3: k}}
+
+	for _, tc := range []struct {
+		peer   []uint32
+		epoch  uint32
+		common bool
+	}{
+		{[]uint32{1, 2}, 2, true},
+		{[]uint32{3, 4}, 3, true},
+		{[]uint32{4}, 0, false},
+		// a peer without epochs has epoch 0
+		{nil, 0, false},
+	} {
+		epoch, ok := s.Common(tc.peer)
+		if ok != tc.common || epoch != tc.epoch {
+			t.Errorf("Common(%v): expected %v, %v, got %v, %v", tc.peer, tc.epoch, tc.common, epoch, ok)
+		}
+	}
+
+	s.keys[0] = k
+	if epoch, ok := s.Common(nil); !ok || epoch != 0 {
+		t.Errorf("Common(nil): expected epoch 0, got %v, %v", epoch, ok)
+	}
+}
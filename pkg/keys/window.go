@@ -0,0 +1,54 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+// WindowSize is the number of sequence numbers a Window remembers.
+const WindowSize = 64
+
+// Window is the anti-replay window of the sequence numbers received from a
+// peer. The sender must increase the sequence number with every packet and
+// keep it increasing across restarts, e.g. by starting from the time in
+// nanoseconds. Packets more than WindowSize behind the highest sequence
+// number received are rejected as their sequence number can no longer be
+// told apart from a replay.
+//
+// The udp backend implements the same window in its C proxy.
+type Window struct {
+	max uint64
+	// bit i is set if max - i has been received
+	bits uint64
+}
+
+// Check returns whether seq has not been received before and records it.
+func (w *Window) Check(seq uint64) bool {
+	if seq > w.max {
+		off := seq - w.max
+		if off >= WindowSize {
+			w.bits = 0
+		} else {
+			w.bits <<= off
+		}
+		w.bits |= 1
+		w.max = seq
+		return true
+	}
+
+	off := w.max - seq
+	if off >= WindowSize || w.bits&(1<<off) != 0 {
+		return false
+	}
+	w.bits |= 1 << off
+	return true
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"testing"
+)
+
+func TestWindow(t *testing.T) {
+	w := Window{}
+	for _, tc := range []struct {
+		seq uint64
+		ok  bool
+	}{
+		{100, true},
+		{100, false},
+		{102, true},
+		{101, true},
+		{101, false},
+		{102 - WindowSize + 1, true},
+		{102 - WindowSize, false},
+		{500, true},
+		{102, false},
+		{499, true},
+		{500 + 2*WindowSize, true},
+		{498, false},
+	} {
+		if ok := w.Check(tc.seq); ok != tc.ok {
+			t.Errorf("Check(%v): expected %v, got %v", tc.seq, tc.ok, ok)
+		}
+	}
+}
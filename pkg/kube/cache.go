@@ -0,0 +1,157 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+	"golang.org/x/net/context"
+)
+
+const retryInterval = 5 * time.Second
+
+// Cache keeps the objects at a path in sync by listing them and watching
+// for changes, listing them again whenever the watch fails.
+type Cache struct {
+	c       *Client
+	path    string
+	changed func()
+
+	mux    sync.Mutex
+	objs   map[string]json.RawMessage
+	synced bool
+}
+
+// NewCache returns a cache of the objects at path, calling changed from
+// Run after they have been listed and after every change.
+func NewCache(c *Client, path string, changed func()) *Cache {
+	return &Cache{
+		c:       c,
+		path:    path,
+		changed: changed,
+		objs:    make(map[string]json.RawMessage),
+	}
+}
+
+// Synced tells whether the objects have been listed.
+func (ca *Cache) Synced() bool {
+	ca.mux.Lock()
+	defer ca.mux.Unlock()
+	return ca.synced
+}
+
+// Items returns the objects, ordered by key.
+func (ca *Cache) Items() []json.RawMessage {
+	ca.mux.Lock()
+	defer ca.mux.Unlock()
+
+	keys := make([]string, 0, len(ca.objs))
+	for k := range ca.objs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	items := make([]json.RawMessage, len(keys))
+	for i, k := range keys {
+		items[i] = ca.objs[k]
+	}
+	return items
+}
+
+func objectMeta(obj json.RawMessage) (*ObjectMeta, error) {
+	var o struct {
+		Metadata ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(obj, &o); err != nil {
+		return nil, err
+	}
+	return &o.Metadata, nil
+}
+
+// Run keeps the cache in sync until ctx is done.
+func (ca *Cache) Run(ctx context.Context) {
+	for {
+		if err := ca.listAndWatch(ctx); err != nil && ctx.Err() == nil {
+			log.Warningf("Failed to list and watch %v (will retry): %v", ca.path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (ca *Cache) listAndWatch(ctx context.Context) error {
+	l, err := ca.c.List(ctx, ca.path)
+	if err != nil {
+		return err
+	}
+
+	objs := make(map[string]json.RawMessage, len(l.Items))
+	for _, item := range l.Items {
+		m, err := objectMeta(item)
+		if err != nil {
+			return fmt.Errorf("failed to decode %v: %v", ca.path, err)
+		}
+		objs[m.Key()] = item
+	}
+
+	ca.mux.Lock()
+	ca.objs = objs
+	ca.synced = true
+	ca.mux.Unlock()
+	ca.changed()
+
+	rv := l.Metadata.ResourceVersion
+	for {
+		err := ca.c.Watch(ctx, ca.path, rv, func(e Event) error {
+			if e.Type == "ERROR" {
+				// usually 410 Gone, the resource version being too old
+				return fmt.Errorf("watch failed: %s", e.Object)
+			}
+
+			m, err := objectMeta(e.Object)
+			if err != nil {
+				return fmt.Errorf("failed to decode watch event: %v", err)
+			}
+			rv = m.ResourceVersion
+
+			ca.mux.Lock()
+			switch e.Type {
+			case "ADDED", "MODIFIED":
+				ca.objs[m.Key()] = e.Object
+			case "DELETED":
+				delete(ca.objs, m.Key())
+			default:
+				// BOOKMARK
+				ca.mux.Unlock()
+				return nil
+			}
+			ca.mux.Unlock()
+			ca.changed()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestCache(t *testing.T) {
+	const token = "s3cret"
+	watches := 0
+	// closed at the end of the test, to end the watches held open
+	stopped := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"metadata": {"name": "default", "resourceVersion": "5"}},
+				{"metadata": {"name": "kube-system", "resourceVersion": "6"}}]}`)
+			return
+		}
+
+		watches++
+		if watches > 1 {
+			// block until the test is over
+			<-stopped
+			return
+		}
+		if rv := r.URL.Query().Get("resourceVersion"); rv != "10" {
+			t.Errorf("expected to watch from resource version 10, got %v", rv)
+		}
+		fmt.Fprintln(w, `{"type": "ADDED", "object": {"metadata": {"name": "web", "resourceVersion": "11"}}}`)
+		fmt.Fprintln(w, `{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "12"}}}`)
+		fmt.Fprintln(w, `{"type": "DELETED", "object": {"metadata": {"name": "default", "resourceVersion": "13"}}}`)
+	}))
+	defer ts.Close()
+	defer close(stopped)
+
+	f, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, token)
+	f.Close()
+
+	c, err := NewClient(Config{Server: ts.URL, TokenFile: f.Name()})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	changed := make(chan struct{}, 10)
+	ca := NewCache(c, "/api/v1/namespaces", func() { changed <- struct{}{} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ca.Run(ctx)
+		close(done)
+	}()
+
+	// the list, ADDED and DELETED
+	for i := 0; i < 3; i++ {
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change %v", i+1)
+		}
+	}
+
+	if !ca.Synced() {
+		t.Errorf("cache is not synced")
+	}
+	names := []string{}
+	for _, item := range ca.Items() {
+		m, err := objectMeta(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, m.Name)
+	}
+	if strings.Join(names, ",") != "kube-system,web" {
+		t.Errorf("expected namespaces kube-system,web, got %v", names)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+}
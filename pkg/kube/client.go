@@ -0,0 +1,206 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kube is a minimal client of the Kubernetes API, which lists and
+// watches the few resources flanneld needs without pulling in the official
+// client.
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/qos"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// watchTimeout is how long the API server keeps a watch open, after which
+// it is renewed from the last resource version.
+const watchTimeout = 5 * time.Minute
+
+// Config tells how to reach the API server.
+type Config struct {
+	// Server is the URL of the API server, e.g. https://10.0.0.1:443
+	Server string
+	// TokenFile has the bearer token. It is read again for every request
+	// as service account tokens are rotated.
+	TokenFile string
+	// CAFile has the CA certificates of the API server, if not the system
+	// ones
+	CAFile string
+}
+
+// InClusterConfig returns the config of a pod with a service account, as
+// given to it by the kubelet.
+func InClusterConfig() Config {
+	cfg := Config{
+		TokenFile: serviceAccountDir + "/token",
+		CAFile:    serviceAccountDir + "/ca.crt",
+	}
+	if host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"); host != "" && port != "" {
+		cfg.Server = "https://" + net.JoinHostPort(host, port)
+	}
+	return cfg
+}
+
+type Client struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewClient returns a client of the API server of cfg.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Server == "" {
+		return nil, fmt.Errorf("no Kubernetes API server, and not running in a pod")
+	}
+
+	t := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{},
+	}
+	fips.ConfigureTLS(t.TLSClientConfig)
+	qos.ConfigureTransport(t)
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", cfg.CAFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+
+	return &Client{
+		server:    strings.TrimSuffix(cfg.Server, "/"),
+		tokenFile: cfg.TokenFile,
+		// no timeout, as it would cut the watches short
+		client: &http.Client{Transport: t},
+	}, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+
+	resp, err := ctxhttp.Do(ctx, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %v: %v: %s", path, resp.Status, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+// List is a list of objects, with the resource version to watch it from.
+type List struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []json.RawMessage `json:"items"`
+}
+
+// List lists the objects at path, e.g. /api/v1/pods.
+func (c *Client) List(ctx context.Context, path string) (*List, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	resp, err := c.get(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	l := &List{}
+	if err := json.NewDecoder(resp.Body).Decode(l); err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %v", path, err)
+	}
+	return l, nil
+}
+
+// Event is a change of an object. Type is ADDED, MODIFIED, DELETED,
+// BOOKMARK, for the resource version only, or ERROR, whose object is the
+// status of the failed watch.
+type Event struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Watch calls f with the changes of the objects at path after
+// resourceVersion until the API server ends the watch, ctx is done or f
+// returns an error.
+func (c *Client) Watch(ctx context.Context, path, resourceVersion string, f func(Event) error) error {
+	resp, err := c.get(ctx, path, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(watchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to decode watch event of %v: %v", path, err)
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+}
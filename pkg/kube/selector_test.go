@@ -0,0 +1,82 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "frontend"}
+
+	for _, tc := range []struct {
+		sel   string
+		match bool
+	}{
+		{`{}`, true},
+		{`{"matchLabels": {"app": "web"}}`, true},
+		{`{"matchLabels": {"app": "db"}}`, false},
+		{`{"matchLabels": {"role": "web"}}`, false},
+		{`{"matchExpressions": [{"key": "tier", "operator": "In", "values": ["frontend", "backend"]}]}`, true},
+		{`{"matchExpressions": [{"key": "tier", "operator": "NotIn", "values": ["frontend"]}]}`, false},
+		{`{"matchExpressions": [{"key": "env", "operator": "NotIn", "values": ["prod"]}]}`, true},
+		{`{"matchExpressions": [{"key": "app", "operator": "Exists"}]}`, true},
+		{`{"matchExpressions": [{"key": "app", "operator": "DoesNotExist"}]}`, false},
+		{`{"matchExpressions": [{"key": "app", "operator": "Gt", "values": ["1"]}]}`, false},
+		{`{"matchLabels": {"app": "web"}, "matchExpressions": [{"key": "env", "operator": "Exists"}]}`, false},
+	} {
+		var sel LabelSelector
+		if err := json.Unmarshal([]byte(tc.sel), &sel); err != nil {
+			t.Fatalf("invalid selector %v: %v", tc.sel, err)
+		}
+		if m := sel.Matches(labels); m != tc.match {
+			t.Errorf("%v: expected match %v, got %v", tc.sel, tc.match, m)
+		}
+	}
+}
+
+func TestPolicyTypes(t *testing.T) {
+	for _, tc := range []struct {
+		spec            string
+		ingress, egress bool
+	}{
+		{`{"podSelector": {}}`, true, false},
+		{`{"podSelector": {}, "egress": [{}]}`, true, true},
+		{`{"podSelector": {}, "policyTypes": ["Egress"]}`, false, true},
+		{`{"podSelector": {}, "policyTypes": ["Ingress", "Egress"]}`, true, true},
+	} {
+		var spec NetworkPolicySpec
+		if err := json.Unmarshal([]byte(tc.spec), &spec); err != nil {
+			t.Fatalf("invalid spec %v: %v", tc.spec, err)
+		}
+		if spec.AffectsIngress() != tc.ingress || spec.AffectsEgress() != tc.egress {
+			t.Errorf("%v: expected ingress %v and egress %v, got %v and %v", tc.spec, tc.ingress, tc.egress, spec.AffectsIngress(), spec.AffectsEgress())
+		}
+	}
+}
+
+func TestIntOrString(t *testing.T) {
+	var ports []NetworkPolicyPort
+	if err := json.Unmarshal([]byte(`[{"port": 80}, {"protocol": "UDP", "port": "dns"}]`), &ports); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if ports[0].Port.IntVal != 80 || ports[0].Port.StrVal != "" {
+		t.Errorf("expected port 80, got %+v", ports[0].Port)
+	}
+	if ports[1].Port.StrVal != "dns" || ports[1].Protocol != "UDP" {
+		t.Errorf("expected UDP port dns, got %+v", ports[1])
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// The types below only have the fields flanneld uses of the Kubernetes
+// objects of the same name.
+
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+// Key identifies an object, as <namespace>/<name> or <name>.
+func (m *ObjectMeta) Key() string {
+	if m.Namespace == "" {
+		return m.Name
+	}
+	return m.Namespace + "/" + m.Name
+}
+
+type Namespace struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     PodSpec    `json:"spec"`
+	Status   PodStatus  `json:"status"`
+}
+
+type PodSpec struct {
+	NodeName    string      `json:"nodeName,omitempty"`
+	HostNetwork bool        `json:"hostNetwork,omitempty"`
+	Containers  []Container `json:"containers,omitempty"`
+}
+
+type Container struct {
+	Name  string          `json:"name"`
+	Ports []ContainerPort `json:"ports,omitempty"`
+}
+
+type ContainerPort struct {
+	Name          string `json:"name,omitempty"`
+	ContainerPort int32  `json:"containerPort"`
+	// Protocol defaults to TCP
+	Protocol string `json:"protocol,omitempty"`
+}
+
+type PodStatus struct {
+	Phase string `json:"phase,omitempty"`
+	PodIP string `json:"podIP,omitempty"`
+}
+
+type NetworkPolicy struct {
+	Metadata ObjectMeta        `json:"metadata"`
+	Spec     NetworkPolicySpec `json:"spec"`
+}
+
+type NetworkPolicySpec struct {
+	PodSelector LabelSelector              `json:"podSelector"`
+	Ingress     []NetworkPolicyIngressRule `json:"ingress,omitempty"`
+	Egress      []NetworkPolicyEgressRule  `json:"egress,omitempty"`
+	PolicyTypes []string                   `json:"policyTypes,omitempty"`
+}
+
+// AffectsIngress tells whether the policy isolates the selected pods for
+// ingress, which is the case unless its types leave Ingress out.
+func (s *NetworkPolicySpec) AffectsIngress() bool {
+	return len(s.PolicyTypes) == 0 || hasString(s.PolicyTypes, "Ingress")
+}
+
+// AffectsEgress tells whether the policy isolates the selected pods for
+// egress, which without types is the case if it has egress rules.
+func (s *NetworkPolicySpec) AffectsEgress() bool {
+	if len(s.PolicyTypes) == 0 {
+		return len(s.Egress) > 0
+	}
+	return hasString(s.PolicyTypes, "Egress")
+}
+
+func hasString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+type NetworkPolicyIngressRule struct {
+	Ports []NetworkPolicyPort `json:"ports,omitempty"`
+	From  []NetworkPolicyPeer `json:"from,omitempty"`
+}
+
+type NetworkPolicyEgressRule struct {
+	Ports []NetworkPolicyPort `json:"ports,omitempty"`
+	To    []NetworkPolicyPeer `json:"to,omitempty"`
+}
+
+type NetworkPolicyPeer struct {
+	PodSelector       *LabelSelector `json:"podSelector,omitempty"`
+	NamespaceSelector *LabelSelector `json:"namespaceSelector,omitempty"`
+	IPBlock           *IPBlock       `json:"ipBlock,omitempty"`
+}
+
+type IPBlock struct {
+	CIDR   string   `json:"cidr"`
+	Except []string `json:"except,omitempty"`
+}
+
+type NetworkPolicyPort struct {
+	// Protocol defaults to TCP
+	Protocol string `json:"protocol,omitempty"`
+	// Port is a port number or the name of a container port, and all
+	// ports if nil
+	Port    *IntOrString `json:"port,omitempty"`
+	EndPort *int32       `json:"endPort,omitempty"`
+}
+
+// IntOrString is a number, or a name if StrVal is set.
+type IntOrString struct {
+	IntVal int32
+	StrVal string
+}
+
+func (v *IntOrString) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &v.StrVal)
+	}
+	return json.Unmarshal(data, &v.IntVal)
+}
+
+func (v IntOrString) MarshalJSON() ([]byte, error) {
+	if v.StrVal != "" {
+		return json.Marshal(v.StrVal)
+	}
+	return json.Marshal(v.IntVal)
+}
+
+func (v IntOrString) String() string {
+	if v.StrVal != "" {
+		return v.StrVal
+	}
+	return strconv.Itoa(int(v.IntVal))
+}
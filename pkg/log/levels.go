@@ -0,0 +1,175 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// levelFilter raises the verbosity of V for the call sites it matches.
+type levelFilter struct {
+	pattern string
+	level   int
+}
+
+var levels struct {
+	sync.RWMutex
+	// vmodule matches the source file names, subsystems the packages
+	vmodule, subsystems     []levelFilter
+	vmoduleSpec, subsysSpec string
+	// the level of each call site of V, -1 if no filter matches it
+	pcs map[uintptr]int
+}
+
+// parseLevels parses a list of pattern=N settings.
+func parseLevels(spec string) ([]levelFilter, error) {
+	var filters []levelFilter
+	for _, s := range strings.Split(spec, ",") {
+		if s == "" {
+			continue
+		}
+		i := strings.LastIndex(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid setting %q, expected pattern=N", s)
+		}
+		level, err := strconv.Atoi(s[i+1:])
+		if err != nil || level < 0 {
+			return nil, fmt.Errorf("invalid level in %q", s)
+		}
+		filters = append(filters, levelFilter{s[:i], level})
+	}
+	return filters, nil
+}
+
+// SetVModule raises the verbosity of V for the call sites in some source
+// files, with the syntax of the -vmodule flag of glog: a list of
+// pattern=N where pattern is a file name without ".go", or a glob of it,
+// e.g. "device=2,network*=1".
+func SetVModule(spec string) error {
+	filters, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if _, err := filepath.Match(f.pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", f.pattern, err)
+		}
+	}
+	levels.Lock()
+	defer levels.Unlock()
+	levels.vmodule, levels.vmoduleSpec = filters, spec
+	levels.pcs = nil
+	return nil
+}
+
+// VModule returns what SetVModule was last given.
+func VModule() string {
+	levels.RLock()
+	defer levels.RUnlock()
+	return levels.vmoduleSpec
+}
+
+// SetSubsystemLevels raises the verbosity of V for the call sites in some
+// subsystems, given as a list of subsystem=N. A subsystem is a package path
+// below github.com/coreos/flannel, e.g. subnet or backend/vxlan, or main for
+// the program itself, and covers the packages below it, so that backend=2
+// applies to every backend. A file set with SetVModule takes precedence.
+func SetSubsystemLevels(spec string) error {
+	filters, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	levels.Lock()
+	defer levels.Unlock()
+	levels.subsystems, levels.subsysSpec = filters, spec
+	levels.pcs = nil
+	return nil
+}
+
+// SubsystemLevels returns what SetSubsystemLevels was last given.
+func SubsystemLevels() string {
+	levels.RLock()
+	defer levels.RUnlock()
+	return levels.subsysSpec
+}
+
+// callerLevel returns the level of the filters for the caller of V.
+func callerLevel() (int, bool) {
+	levels.RLock()
+	if len(levels.vmodule) == 0 && len(levels.subsystems) == 0 {
+		levels.RUnlock()
+		return 0, false
+	}
+	// callerLevel <- V <- call site
+	pc, file, _, ok := runtime.Caller(2)
+	level, cached := levels.pcs[pc]
+	levels.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	if !cached {
+		levels.Lock()
+		level = matchLevel(pc, file)
+		if levels.pcs == nil {
+			levels.pcs = map[uintptr]int{}
+		}
+		levels.pcs[pc] = level
+		levels.Unlock()
+	}
+	return level, level >= 0
+}
+
+func matchLevel(pc uintptr, file string) int {
+	name := strings.TrimSuffix(filepath.Base(file), ".go")
+	for _, f := range levels.vmodule {
+		if ok, _ := filepath.Match(f.pattern, name); ok {
+			return f.level
+		}
+	}
+
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return -1
+	}
+	sub := subsystem(fn.Name())
+	level, longest := -1, -1
+	for _, f := range levels.subsystems {
+		if (sub == f.pattern || strings.HasPrefix(sub, f.pattern+"/")) && len(f.pattern) > longest {
+			level, longest = f.level, len(f.pattern)
+		}
+	}
+	return level
+}
+
+// subsystem returns the subsystem of the function named fn, e.g.
+// backend/vxlan for github.com/coreos/flannel/backend/vxlan.(*network).Run.
+func subsystem(fn string) string {
+	pkg := fn
+	i := strings.LastIndex(fn, "/")
+	if j := strings.Index(fn[i+1:], "."); j >= 0 {
+		pkg = fn[:i+1+j]
+	}
+	const root = "github.com/coreos/flannel/"
+	if i := strings.LastIndex(pkg, root); i >= 0 {
+		pkg = pkg[i+len(root):]
+	}
+	return pkg
+}
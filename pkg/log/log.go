@@ -0,0 +1,265 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package log is what flannel logs through, flanneld as well as the library
+// packages (subnet, backend, the backends and pkg/tracing). It has the part
+// of the glog API they use, so their call sites read the same, but a
+// program embedding the library packages does not get glog, and the flags
+// it registers, with them: messages go to the Logger given to SetLogger, by
+// default a TextLogger writing lines in the format of glog to stderr.
+//
+// Messages may carry key/value pairs describing them, logged with InfoKV,
+// WarningKV and ErrorKV, which a FieldLogger receives as they are for
+// structured output.
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity is the severity of a message.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "WARNING"
+	case SeverityError:
+		return "ERROR"
+	default:
+		return "INFO"
+	}
+}
+
+// Logger receives the messages of the library packages.
+type Logger interface {
+	// Log logs msg with severity s. calldepth is the number of frames from
+	// Log to the call site, as with the Output method of the standard
+	// library's log.Logger: runtime.Caller(calldepth) in Log returns the
+	// position of the call site.
+	Log(calldepth int, s Severity, msg string)
+	// V tells whether messages of the verbosity level, as with glog's -v,
+	// are logged.
+	V(level int) bool
+}
+
+// FieldLogger is a Logger which also receives the key/value pairs of the
+// messages logged with InfoKV, WarningKV and ErrorKV. Other Loggers get them
+// appended to the message, formatted with KV.
+type FieldLogger interface {
+	Logger
+	// LogKV logs msg with severity s and the pairs kv, with calldepth as
+	// for Log.
+	LogKV(calldepth int, s Severity, msg string, kv []interface{})
+}
+
+var (
+	mux     sync.RWMutex
+	current Logger = NewTextLogger(nil, nil)
+)
+
+// SetLogger has the library packages log to l.
+func SetLogger(l Logger) {
+	mux.Lock()
+	current = l
+	mux.Unlock()
+}
+
+func logger() Logger {
+	mux.RLock()
+	defer mux.RUnlock()
+	return current
+}
+
+// the call sites are two frames up from Log: Log <- Info <- call site
+
+func Info(args ...interface{}) {
+	logger().Log(2, SeverityInfo, fmt.Sprint(args...))
+}
+
+func Infof(format string, args ...interface{}) {
+	logger().Log(2, SeverityInfo, fmt.Sprintf(format, args...))
+}
+
+func Warning(args ...interface{}) {
+	logger().Log(2, SeverityWarning, fmt.Sprint(args...))
+}
+
+func Warningf(format string, args ...interface{}) {
+	logger().Log(2, SeverityWarning, fmt.Sprintf(format, args...))
+}
+
+func Error(args ...interface{}) {
+	logger().Log(2, SeverityError, fmt.Sprint(args...))
+}
+
+func Errorf(format string, args ...interface{}) {
+	logger().Log(2, SeverityError, fmt.Sprintf(format, args...))
+}
+
+// the call sites are three frames up from LogKV: LogKV <- logKV <- InfoKV <-
+// call site
+
+func InfoKV(msg string, kv ...interface{}) {
+	logKV(3, SeverityInfo, msg, kv)
+}
+
+func WarningKV(msg string, kv ...interface{}) {
+	logKV(3, SeverityWarning, msg, kv)
+}
+
+func ErrorKV(msg string, kv ...interface{}) {
+	logKV(3, SeverityError, msg, kv)
+}
+
+func logKV(calldepth int, s Severity, msg string, kv []interface{}) {
+	l := logger()
+	if fl, ok := l.(FieldLogger); ok {
+		fl.LogKV(calldepth, s, msg, kv)
+		return
+	}
+	l.Log(calldepth, s, withKV(msg, kv))
+}
+
+// KV formats key/value pairs as "key=value key2=value2". Values that are
+// empty or contain spaces or quotes are quoted, a key without a value is
+// left out.
+func KV(kv ...interface{}) string {
+	buf := bytes.Buffer{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\"") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&buf, "%v=%s", kv[i], v)
+	}
+	return buf.String()
+}
+
+// withKV returns msg followed by the pairs kv, formatted with KV.
+func withKV(msg string, kv []interface{}) string {
+	if len(kv) < 2 {
+		return msg
+	}
+	return msg + " " + KV(kv...)
+}
+
+// Verbose logs info messages only if it is true, see V.
+type Verbose bool
+
+// V returns whether messages of the verbosity level are logged, which the
+// Info methods of the result tell by logging or not. SetVModule and
+// SetSubsystemLevels raise the level for some of the call sites.
+func V(level int) Verbose {
+	if l, ok := callerLevel(); ok && level <= l {
+		return true
+	}
+	return Verbose(logger().V(level))
+}
+
+func (v Verbose) Info(args ...interface{}) {
+	if v {
+		logger().Log(2, SeverityInfo, fmt.Sprint(args...))
+	}
+}
+
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v {
+		logger().Log(2, SeverityInfo, fmt.Sprintf(format, args...))
+	}
+}
+
+// TextLogger writes the messages as lines in the format of glog:
+//
+//	Lmmdd hh:mm:ss.uuuuuu pid file:line] msg
+//
+// where L is the first letter of the severity.
+type TextLogger struct {
+	mux       sync.Mutex
+	w         io.Writer
+	verbosity func() int
+	pid       int
+}
+
+// NewTextLogger returns a TextLogger writing to w, or to os.Stderr as of the
+// time of each message if w is nil. verbosity returns the highest level V
+// is true for; if nil, V is only true for level 0.
+func NewTextLogger(w io.Writer, verbosity func() int) *TextLogger {
+	return &TextLogger{
+		w:         w,
+		verbosity: verbosity,
+		pid:       os.Getpid(),
+	}
+}
+
+// Log implements Logger.
+func (l *TextLogger) Log(calldepth int, s Severity, msg string) {
+	l.output(calldepth+1, s, msg)
+}
+
+// LogKV implements FieldLogger, writing kv after the message.
+func (l *TextLogger) LogKV(calldepth int, s Severity, msg string, kv []interface{}) {
+	l.output(calldepth+1, s, withKV(msg, kv))
+}
+
+func (l *TextLogger) output(calldepth int, s Severity, msg string) {
+	_, file, line, ok := runtime.Caller(calldepth)
+	if ok {
+		file = filepath.Base(file)
+	} else {
+		file, line = "???", 1
+	}
+
+	now := time.Now()
+	_, month, day := now.Date()
+	hour, minute, second := now.Clock()
+	out := fmt.Sprintf("%c%02d%02d %02d:%02d:%02d.%06d %05d %s:%d] %s",
+		s.String()[0], int(month), day, hour, minute, second, now.Nanosecond()/1000, l.pid, file, line, msg)
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	w := l.w
+	if w == nil {
+		w = os.Stderr
+	}
+	io.WriteString(w, out)
+}
+
+// V implements Logger.
+func (l *TextLogger) V(level int) bool {
+	if l.verbosity == nil {
+		return level <= 0
+	}
+	return level <= l.verbosity()
+}
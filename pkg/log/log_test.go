@@ -0,0 +1,149 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+type recordingLogger struct {
+	lines []string
+	level int
+}
+
+func (l *recordingLogger) Log(calldepth int, s Severity, msg string) {
+	l.lines = append(l.lines, s.String()+" "+msg)
+}
+
+func (l *recordingLogger) V(level int) bool {
+	return level <= l.level
+}
+
+func TestSetLogger(t *testing.T) {
+	defer SetLogger(logger())
+
+	l := &recordingLogger{level: 1}
+	SetLogger(l)
+
+	Info("a", 1)
+	Warningf("b %v", 2)
+	Error("c")
+	V(1).Infof("d %v", 3)
+	V(2).Info("e")
+	// a Logger without LogKV gets the pairs in the message
+	WarningKV("f", "subnet", "10.1.2.0/24")
+
+	expected := []string{"INFO a1", "WARNING b 2", "ERROR c", "INFO d 3", "WARNING f subnet=10.1.2.0/24"}
+	if len(l.lines) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, l.lines)
+	}
+	for i := range expected {
+		if l.lines[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], l.lines[i])
+		}
+	}
+}
+
+func TestKV(t *testing.T) {
+	s := KV("subnet", "10.1.2.0/24", "event", "lease acquired", "dangling")
+	expected := `subnet=10.1.2.0/24 event="lease acquired"`
+	if s != expected {
+		t.Errorf("KV mismatch: expected %q, got %q", expected, s)
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	defer SetLogger(logger())
+
+	buf := &bytes.Buffer{}
+	SetLogger(NewTextLogger(buf, func() int { return 0 }))
+	Warningf("lease %v lost", "10.1.2.0/24")
+	V(1).Info("not logged")
+
+	// the position is that of the call site
+	re := regexp.MustCompile(`^W\d{4} \d{2}:\d{2}:\d{2}\.\d{6} \d{5,} log_test\.go:\d+\] lease 10\.1\.2\.0/24 lost\n$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	buf.Reset()
+	InfoKV("lease acquired", "subnet", "10.1.2.0/24")
+	re = regexp.MustCompile(`^I.* log_test\.go:\d+\] lease acquired subnet=10\.1\.2\.0/24\n$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
+
+func TestLevels(t *testing.T) {
+	defer SetLogger(logger())
+	defer SetVModule("")
+	defer SetSubsystemLevels("")
+
+	l := &recordingLogger{level: 0}
+	SetLogger(l)
+
+	for _, c := range []struct {
+		vmodule, subsystems string
+		logged              bool
+	}{
+		{"", "", false},
+		{"log_test=2", "", true},
+		{"log_*=2", "", true},
+		{"log_test=1", "", false},
+		{"other=2", "", false},
+		{"", "pkg/log=2", true},
+		{"", "pkg=2", true},
+		{"", "pkg/lo=2", false},
+		{"", "pkg=2,pkg/log=1", false},
+		{"log_test=1", "pkg/log=2", false},
+	} {
+		if err := SetVModule(c.vmodule); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetSubsystemLevels(c.subsystems); err != nil {
+			t.Fatal(err)
+		}
+		l.lines = nil
+		V(2).Info("x")
+		if logged := len(l.lines) > 0; logged != c.logged {
+			t.Errorf("vmodule %q, subsystems %q: expected logged to be %v", c.vmodule, c.subsystems, c.logged)
+		}
+	}
+
+	for _, s := range []string{"pkg/log", "=1", "pkg/log=-1", "pkg/log=x"} {
+		if err := SetSubsystemLevels(s); err == nil {
+			t.Errorf("SetSubsystemLevels accepted %q", s)
+		}
+	}
+	if err := SetVModule("[=1"); err == nil {
+		t.Errorf("SetVModule accepted an invalid pattern")
+	}
+}
+
+func TestSubsystem(t *testing.T) {
+	for fn, sub := range map[string]string{
+		"github.com/coreos/flannel/backend/vxlan.(*network).Run": "backend/vxlan",
+		"github.com/coreos/flannel/subnet.WatchLeases.func1":     "subnet",
+		"main.main": "main",
+		"example.com/x/vendor/github.com/coreos/flannel/network.(*Manager).Run": "network",
+		"example.com/x.f": "example.com/x",
+	} {
+		if s := subsystem(fn); s != sub {
+			t.Errorf("subsystem(%q) = %q, expected %q", fn, s, sub)
+		}
+	}
+}
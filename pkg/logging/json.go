@@ -0,0 +1,88 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// JSONLogger writes every message as a JSON object on a line of its own,
+// with the keys ts, level, caller and msg and the key/value pairs of the
+// message.
+type JSONLogger struct {
+	mux       sync.Mutex
+	w         io.Writer
+	verbosity func() int
+	now       func() time.Time
+}
+
+// NewJSONLogger returns a JSONLogger writing to w, or to os.Stderr as of the
+// time of each message if w is nil. verbosity is as for log.NewTextLogger.
+func NewJSONLogger(w io.Writer, verbosity func() int) *JSONLogger {
+	return &JSONLogger{
+		w:         w,
+		verbosity: verbosity,
+		now:       time.Now,
+	}
+}
+
+// Log implements log.Logger.
+func (l *JSONLogger) Log(calldepth int, s log.Severity, msg string) {
+	l.LogKV(calldepth+1, s, msg, nil)
+}
+
+// LogKV implements log.FieldLogger.
+func (l *JSONLogger) LogKV(calldepth int, s log.Severity, msg string, kv []interface{}) {
+	data, err := json.Marshal(entry(l.now(), caller(calldepth), s, msg, kv))
+	if err != nil {
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	w := l.w
+	if w == nil {
+		w = os.Stderr
+	}
+	w.Write(append(data, '\n'))
+}
+
+// V implements log.Logger.
+func (l *JSONLogger) V(level int) bool {
+	return verbose(l.verbosity, level)
+}
+
+// entry returns the JSON object of a message. The pairs of kv do not
+// replace the keys of the message itself.
+func entry(ts time.Time, caller string, s log.Severity, msg string, kv []interface{}) map[string]interface{} {
+	e := map[string]interface{}{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		e[fmt.Sprint(kv[i])] = fmt.Sprint(kv[i+1])
+	}
+
+	e["ts"] = ts.Format(time.RFC3339Nano)
+	e["level"] = strings.ToLower(s.String())
+	e["caller"] = caller
+	e["msg"] = msg
+	return e
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+func TestJSONLogger(t *testing.T) {
+	defer log.SetLogger(log.NewTextLogger(nil, nil))
+
+	out := &bytes.Buffer{}
+	l := NewJSONLogger(out, nil)
+	l.now = func() time.Time {
+		return time.Date(2016, 3, 22, 10, 11, 12, 123000, time.Local)
+	}
+	log.SetLogger(l)
+
+	// text in the message is not taken for fields
+	log.InfoKV("Lease acquired from node=elsewhere", FieldSubnet, "10.1.2.0/24", FieldEvent, "lease acquired", "msg", "x")
+	log.Warning("no fields")
+
+	dec := json.NewDecoder(out)
+
+	entry := map[string]string{}
+	if err := dec.Decode(&entry); err != nil {
+		t.Fatalf("failed to decode first entry: %v", err)
+	}
+
+	expected := map[string]string{
+		"ts":     time.Date(2016, 3, 22, 10, 11, 12, 123000, time.Local).Format(time.RFC3339Nano),
+		"level":  "info",
+		"msg":    "Lease acquired from node=elsewhere",
+		"subnet": "10.1.2.0/24",
+		"event":  "lease acquired",
+	}
+	if len(entry) != len(expected)+1 {
+		t.Errorf("unexpected fields: %v", entry)
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("field %q mismatch: expected %q, got %q", k, v, entry[k])
+		}
+	}
+	// the position is that of the call site
+	if !regexp.MustCompile(`^json_test\.go:\d+$`).MatchString(entry["caller"]) {
+		t.Errorf("unexpected caller %q", entry["caller"])
+	}
+
+	entry = map[string]string{}
+	if err := dec.Decode(&entry); err != nil {
+		t.Fatalf("failed to decode second entry: %v", err)
+	}
+	if entry["level"] != "warning" || entry["msg"] != "no fields" || len(entry) != 4 {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// Verbosity is the value of the -v flag, the highest level V logs at
+// unless -vmodule or -log-levels raise it. It may be set at runtime.
+type Verbosity struct {
+	level int32
+}
+
+// Level returns the verbosity.
+func (v *Verbosity) Level() int {
+	return int(atomic.LoadInt32(&v.level))
+}
+
+func (v *Verbosity) String() string {
+	return strconv.Itoa(v.Level())
+}
+
+func (v *Verbosity) Set(s string) error {
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 {
+		return fmt.Errorf("invalid log level %q", s)
+	}
+	atomic.StoreInt32(&v.level, int32(level))
+	return nil
+}
+
+// VModuleFlag is the -vmodule flag, the levels of some source files, see
+// log.SetVModule.
+type VModuleFlag struct{}
+
+func (VModuleFlag) String() string     { return log.VModule() }
+func (VModuleFlag) Set(s string) error { return log.SetVModule(s) }
+
+// SubsystemLevelsFlag is the -log-levels flag, the levels of some
+// subsystems, see log.SetSubsystemLevels.
+type SubsystemLevelsFlag struct{}
+
+func (SubsystemLevelsFlag) String() string     { return log.SubsystemLevels() }
+func (SubsystemLevelsFlag) Set(s string) error { return log.SetSubsystemLevels(s) }
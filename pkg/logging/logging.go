@@ -0,0 +1,135 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging adds structured output to the log of flanneld, which
+// every package writes through pkg/log. Call sites attach well-known fields
+// to their messages with the KV variants of the log functions. When JSON
+// output is enabled, every message is written as a JSON object and those
+// fields are top-level keys. The output can also be sent to a rotated log
+// file or to syslog instead of stderr.
+package logging
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// Stable field names. Log pipelines index on these so they must not change.
+const (
+	FieldNode    = "node"
+	FieldSubnet  = "subnet"
+	FieldBackend = "backend"
+	FieldEvent   = "event"
+	FieldNetwork = "network"
+)
+
+// Output selects where log lines go. The zero value means stderr.
+type Output struct {
+	// File is a log file to write to instead of stderr
+	File string
+	// MaxSize and MaxAge trigger rotation of File, MaxBackups rotated
+	// files are kept
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	// Syslog sends the log to the local syslog daemon (or journald)
+	Syslog bool
+}
+
+// Setup returns the Logger for the output format, "text" or "json", and
+// out. verbosity is as for log.NewTextLogger. The messages are written as
+// they are logged, so none are lost when flanneld exits right after.
+func Setup(format string, out Output, verbosity func() int) (log.Logger, error) {
+	asJSON := false
+	switch format {
+	case "", "text":
+	case "json":
+		asJSON = true
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+
+	var loggers multiLogger
+	if out.File != "" {
+		rf, err := NewRotatingFile(out.File, out.MaxSize, out.MaxAge, out.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %v", err)
+		}
+		if asJSON {
+			loggers = append(loggers, NewJSONLogger(rf, verbosity))
+		} else {
+			loggers = append(loggers, log.NewTextLogger(rf, verbosity))
+		}
+	}
+	if out.Syslog {
+		sl, err := NewSyslogLogger("flanneld", asJSON, verbosity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		loggers = append(loggers, sl)
+	}
+
+	switch {
+	case len(loggers) == 1:
+		return loggers[0], nil
+	case len(loggers) > 1:
+		return loggers, nil
+	case asJSON:
+		return NewJSONLogger(nil, verbosity), nil
+	default:
+		return log.NewTextLogger(nil, verbosity), nil
+	}
+}
+
+// multiLogger logs every message to each of its Loggers.
+type multiLogger []log.FieldLogger
+
+func (m multiLogger) Log(calldepth int, s log.Severity, msg string) {
+	for _, l := range m {
+		l.Log(calldepth+1, s, msg)
+	}
+}
+
+func (m multiLogger) LogKV(calldepth int, s log.Severity, msg string, kv []interface{}) {
+	for _, l := range m {
+		l.LogKV(calldepth+1, s, msg, kv)
+	}
+}
+
+func (m multiLogger) V(level int) bool {
+	return m[0].V(level)
+}
+
+// verbose implements log.Logger's V for verbosity as with log.TextLogger.
+func verbose(verbosity func() int, level int) bool {
+	if verbosity == nil {
+		return level <= 0
+	}
+	return level <= verbosity()
+}
+
+// caller returns the file:line of the call site calldepth frames up from
+// the caller of caller.
+func caller(calldepth int) string {
+	_, file, line, ok := runtime.Caller(calldepth + 1)
+	if !ok {
+		return "???:1"
+	}
+	return filepath.Base(file) + ":" + strconv.Itoa(line)
+}
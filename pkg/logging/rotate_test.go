@@ -0,0 +1,93 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "flanneld.log")
+	rf, err := NewRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("NewRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	for p, expected := range map[string]string{
+		path:        "line4\n",
+		path + ".1": "line3\n",
+		path + ".2": "line2\n",
+	} {
+		if got := readFile(t, p); got != expected {
+			t.Errorf("%v: expected %q, got %q", p, expected, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than MaxBackups files were kept")
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(dir, "flanneld.log")
+	rf := &RotatingFile{
+		path:   path,
+		maxAge: time.Hour,
+		now:    func() time.Time { return now },
+	}
+	defer rf.Close()
+
+	rf.Write([]byte("old\n"))
+	now = now.Add(30 * time.Minute)
+	rf.Write([]byte("still old\n"))
+	now = now.Add(30 * time.Minute)
+	rf.Write([]byte("new\n"))
+
+	// without backups the old file is simply dropped
+	if got := readFile(t, path); got != "new\n" {
+		t.Errorf("expected a fresh file, got %q", got)
+	}
+}
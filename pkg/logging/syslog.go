@@ -0,0 +1,79 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// SyslogLogger sends the messages to the local syslog daemon (or journald)
+// with the priority matching their severity.
+type SyslogLogger struct {
+	w         *syslog.Writer
+	json      bool
+	verbosity func() int
+}
+
+// NewSyslogLogger returns a SyslogLogger sending messages with tag. With
+// asJSON the messages are JSON objects like those of JSONLogger.
+// verbosity is as for log.NewTextLogger.
+func NewSyslogLogger(tag string, asJSON bool, verbosity func() int) (*SyslogLogger, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogLogger{w: w, json: asJSON, verbosity: verbosity}, nil
+}
+
+// Log implements log.Logger.
+func (l *SyslogLogger) Log(calldepth int, s log.Severity, msg string) {
+	l.LogKV(calldepth+1, s, msg, nil)
+}
+
+// LogKV implements log.FieldLogger.
+func (l *SyslogLogger) LogKV(calldepth int, s log.Severity, msg string, kv []interface{}) {
+	m := syslogMessage(caller(calldepth), s, msg, kv, l.json)
+	switch s {
+	case log.SeverityWarning:
+		l.w.Warning(m)
+	case log.SeverityError:
+		l.w.Err(m)
+	default:
+		l.w.Info(m)
+	}
+}
+
+// V implements log.Logger.
+func (l *SyslogLogger) V(level int) bool {
+	return verbose(l.verbosity, level)
+}
+
+// syslogMessage returns the message to send. Unlike the lines of
+// log.TextLogger it has no timestamp and pid, as syslog records its own.
+func syslogMessage(caller string, s log.Severity, msg string, kv []interface{}, asJSON bool) string {
+	if asJSON {
+		if data, err := json.Marshal(entry(time.Now(), caller, s, msg, kv)); err == nil {
+			return string(data)
+		}
+	}
+	if len(kv) > 1 {
+		msg += " " + log.KV(kv...)
+	}
+	return caller + "] " + msg
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+func TestSyslogMessage(t *testing.T) {
+	msg := syslogMessage("manager.go:42", log.SeverityWarning, "lease expired", nil, false)
+	if msg != "manager.go:42] lease expired" {
+		t.Errorf("unexpected message %q", msg)
+	}
+
+	msg = syslogMessage("manager.go:42", log.SeverityWarning, "lease expired", []interface{}{FieldSubnet, "10.1.2.0/24"}, false)
+	if msg != "manager.go:42] lease expired subnet=10.1.2.0/24" {
+		t.Errorf("unexpected message %q", msg)
+	}
+
+	msg = syslogMessage("manager.go:42", log.SeverityError, "failed", []interface{}{FieldSubnet, "10.1.2.0/24"}, true)
+	entry := map[string]string{}
+	if err := json.Unmarshal([]byte(msg), &entry); err != nil {
+		t.Fatalf("message is not JSON: %v", err)
+	}
+	if entry["level"] != "error" || entry["msg"] != "failed" || entry["subnet"] != "10.1.2.0/24" || entry["caller"] != "manager.go:42" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics implements the few metric types flanneld exports and
+// serves them in the Prometheus text exposition format. Metrics are
+// declared as package level variables of the instrumented package and
+// register themselves with the default registry.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+	reset()
+}
+
+var (
+	regMux   sync.Mutex
+	registry = map[string]metric{}
+	// disabled is set to 1 by Disable
+	disabled int32
+)
+
+func register(m metric) {
+	regMux.Lock()
+	defer regMux.Unlock()
+
+	if _, ok := registry[m.name()]; ok {
+		panic(fmt.Sprintf("metric %v registered twice", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// Disable drops the samples of all metrics and stops recording new ones,
+// for hosts which do not export them. The metrics stay registered but
+// WriteTo writes nothing.
+func Disable() {
+	atomic.StoreInt32(&disabled, 1)
+
+	regMux.Lock()
+	defer regMux.Unlock()
+	for _, m := range registry {
+		m.reset()
+	}
+}
+
+func isDisabled() bool {
+	return atomic.LoadInt32(&disabled) == 1
+}
+
+// WriteTo writes all registered metrics, sorted by name.
+func WriteTo(w io.Writer) {
+	if isDisabled() {
+		return
+	}
+
+	regMux.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	regMux.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		regMux.Lock()
+		m := registry[name]
+		regMux.Unlock()
+		m.write(w)
+	}
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		WriteTo(bw)
+		bw.Flush()
+	})
+}
+
+// desc is what all metric types have in common: a name, help text and the
+// names of their labels. Samples are keyed by their label values.
+type desc struct {
+	fqName string
+	help   string
+	labels []string
+	typ    string
+
+	mux     sync.Mutex
+	samples map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+	// counts of a histogram sample, whose value is the sum
+	counts []uint64
+	count  uint64
+}
+
+func newDesc(name, help, typ string, labels []string) desc {
+	return desc{
+		fqName:  name,
+		help:    help,
+		labels:  labels,
+		typ:     typ,
+		samples: map[string]*sample{},
+	}
+}
+
+func (d *desc) name() string {
+	return d.fqName
+}
+
+// get returns the sample for the label values, creating it if needed.
+// d.mux must be held.
+func (d *desc) get(lvs []string) *sample {
+	if len(lvs) != len(d.labels) {
+		panic(fmt.Sprintf("metric %v: expected %d label values, got %d", d.fqName, len(d.labels), len(lvs)))
+	}
+
+	key := strings.Join(lvs, "\xff")
+	s, ok := d.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), lvs...)}
+		d.samples[key] = s
+	}
+	return s
+}
+
+func (d *desc) update(lvs []string, f func(s *sample)) {
+	if isDisabled() {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	f(d.get(lvs))
+}
+
+// Delete removes the sample with the given label values, e.g. once the
+// peer it describes is gone.
+func (d *desc) Delete(lvs ...string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.samples, strings.Join(lvs, "\xff"))
+}
+
+func (d *desc) reset() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.samples = map[string]*sample{}
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", d.fqName, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", d.fqName, d.typ)
+}
+
+func (d *desc) write(w io.Writer) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.writeHeader(w)
+
+	if len(d.labels) == 0 && len(d.samples) == 0 {
+		fmt.Fprintf(w, "%v 0\n", d.fqName)
+		return
+	}
+
+	keys := make([]string, 0, len(d.samples))
+	for k := range d.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := d.samples[k]
+		fmt.Fprintf(w, "%v%v %v\n", d.fqName, formatLabels(d.labels, s.labelValues), formatValue(s.value))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = fmt.Sprintf("%v=\"%v\"", n, escapeLabel(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// Counter is a value that only goes up, e.g. the number of repairs.
+type Counter struct {
+	desc
+}
+
+// NewCounter creates and registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newDesc(name, help, "counter", labels)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for the label values by one.
+func (c *Counter) Inc(lvs ...string) {
+	c.Add(1, lvs...)
+}
+
+// Add increments the counter for the label values by v, which must not be
+// negative.
+func (c *Counter) Add(v float64, lvs ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %v cannot decrease", c.fqName))
+	}
+	c.update(lvs, func(s *sample) { s.value += v })
+}
+
+// Gauge is a value that can go up and down, e.g. the number of peers.
+type Gauge struct {
+	desc
+}
+
+// NewGauge creates and registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newDesc(name, help, "gauge", labels)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for the label values to v.
+func (g *Gauge) Set(v float64, lvs ...string) {
+	g.update(lvs, func(s *sample) { s.value = v })
+}
+
+// Add adds v, which may be negative, to the gauge for the label values.
+func (g *Gauge) Add(v float64, lvs ...string) {
+	g.update(lvs, func(s *sample) { s.value += v })
+}
+
+// DefBuckets are the default histogram buckets, suited to latencies in
+// seconds from a millisecond to 10s.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations, e.g. request latencies, in buckets by
+// their upper bounds and tracks their sum.
+type Histogram struct {
+	desc
+	buckets []float64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket
+// upper bounds, in increasing order, and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newDesc(name, help, "histogram", labels), buckets}
+	register(h)
+	return h
+}
+
+// Observe adds the observation v for the label values.
+func (h *Histogram) Observe(v float64, lvs ...string) {
+	h.update(lvs, func(s *sample) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.buckets))
+		}
+		for i, b := range h.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += v
+	})
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.writeHeader(w)
+
+	keys := make([]string, 0, len(h.samples))
+	for k := range h.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	names := append(append([]string(nil), h.labels...), "le")
+	for _, k := range keys {
+		s := h.samples[k]
+		values := append(append([]string(nil), s.labelValues...), "")
+		for i, b := range h.buckets {
+			values[len(values)-1] = formatValue(b)
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.fqName, formatLabels(names, values), s.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.fqName, formatLabels(names, values), s.count)
+
+		labels := formatLabels(h.labels, s.labelValues)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.fqName, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.fqName, labels, s.count)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var (
+	testCounter = NewCounter("test_repairs_total", "Number of repairs.", "network")
+	testGauge   = NewGauge("test_peers", "Number of peers.\nSecond line.")
+	testEscaped = NewGauge("test_escaped", "Escaped labels.", "value")
+)
+
+func TestWriteTo(t *testing.T) {
+	testCounter.Inc("")
+	testCounter.Add(2, "blue")
+	testCounter.Inc("blue")
+	testGauge.Set(5)
+	testGauge.Add(-2)
+	testEscaped.Set(1.5, "a\"b\\c\nd")
+
+	buf := &bytes.Buffer{}
+	WriteTo(buf)
+
+	expected := `# HELP test_escaped Escaped labels.
+# TYPE test_escaped gauge
+test_escaped{value="a\"b\\c\nd"} 1.5
+# HELP test_peers Number of peers.\nSecond line.
+# TYPE test_peers gauge
+test_peers 3
+# HELP test_repairs_total Number of repairs.
+# TYPE test_repairs_total counter
+test_repairs_total{network=""} 1
+test_repairs_total{network="blue"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("output mismatch:\nexpected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	testCounter.Delete("blue")
+	req, err := http.NewRequest("GET", "http://example.com/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, req)
+	if strings.Contains(rr.Body.String(), `network="blue"`) {
+		t.Errorf("deleted sample is still exported")
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(2, "get")
+
+	buf := &bytes.Buffer{}
+	h.write(buf)
+
+	expected := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="get",le="0.1"} 1
+test_duration_seconds_bucket{op="get",le="1"} 2
+test_duration_seconds_bucket{op="get",le="+Inf"} 3
+test_duration_seconds_sum{op="get"} 2.55
+test_duration_seconds_count{op="get"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("output mismatch:\nexpected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("wrong number of label values did not panic")
+		}
+	}()
+	testCounter.Inc()
+}
+
+func TestDisable(t *testing.T) {
+	g := NewGauge("test_disabled", "Disabled gauge.", "peer")
+	g.Set(1, "a")
+
+	Disable()
+	defer atomic.StoreInt32(&disabled, 0)
+
+	g.Set(2, "b")
+	if len(g.samples) != 0 {
+		t.Errorf("expected no samples once disabled, got %v", len(g.samples))
+	}
+
+	buf := &bytes.Buffer{}
+	WriteTo(buf)
+	if buf.Len() != 0 {
+		t.Errorf("expected no output once disabled, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netns runs the program in another network namespace. A Go
+// program cannot move itself once running, as each of its threads has its
+// own namespace; so Enter re-executes the program, and a constructor in C
+// enters the namespace before the Go runtime starts. Importing the package
+// links the constructor in.
+package netns
+
+//#include "nsenter.h"
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// envVar passes the namespace to enter to the constructor
+const envVar = C.FLANNEL_NETNS_ENV
+
+// Current returns the network namespace the process entered at startup, or
+// "" if it runs in the one it was started in.
+func Current() string {
+	return C.GoString(C.flannel_netns)
+}
+
+// Enter runs the process in the network namespace at path, e.g.
+// /var/run/netns/blue or /proc/1234/ns/net, with a private mount of /sys
+// showing its devices as ip netns exec does. Unless it already runs there,
+// the process is executed again with the same arguments, so Enter must be
+// called before anything the program should not do twice.
+func Enter(path string) error {
+	switch cur := Current(); cur {
+	case path:
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("already in network namespace %v", cur)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to enter network namespace: %v", err)
+	}
+
+	// the executable by its name, for the process to keep it
+	exe, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return fmt.Errorf("failed to re-execute in network namespace %v: %v", path, err)
+	}
+
+	env := append(os.Environ(), envVar+"="+path)
+	if err := syscall.Exec(exe, os.Args, env); err != nil {
+		return fmt.Errorf("failed to re-execute in network namespace %v: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netns
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCurrent(t *testing.T) {
+	if os.Getenv("NETNS_TEST_HELPER") != "" {
+		os.Stdout.WriteString(Current())
+		os.Exit(0)
+	}
+
+	if cur := Current(); cur != "" {
+		t.Fatalf("expected no namespace, got %q", cur)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("entering a network namespace requires root")
+	}
+
+	// our own namespace works without creating one
+	path := "/proc/self/ns/net"
+	cmd := exec.Command(os.Args[0], "-test.run=TestCurrent")
+	cmd.Env = append(os.Environ(), "NETNS_TEST_HELPER=1", envVar+"="+path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper failed: %v: %s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != path {
+		t.Errorf("expected the helper in %q, got %q", path, got)
+	}
+}
+
+func TestEnterMissing(t *testing.T) {
+	if err := Enter("/nonexistent/netns"); err == nil {
+		t.Errorf("entering a missing namespace did not fail")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <sched.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <sys/mount.h>
+
+#include "nsenter.h"
+
+/* the network namespace entered at startup, or "" */
+const char *flannel_netns = "";
+
+static void die(const char *path, const char *what)
+{
+	fprintf(stderr, "flanneld: failed to enter network namespace %s: %s: %s\n", path, what, strerror(errno));
+	exit(1);
+}
+
+/*
+ * Runs before the Go runtime starts any thread, as setns(CLONE_NEWNET)
+ * only moves the calling thread and unshare(CLONE_NEWNS) fails in a
+ * multithreaded process.
+ */
+__attribute__((constructor)) static void flannel_nsenter(void)
+{
+	const char *path = getenv(FLANNEL_NETNS_ENV);
+	int fd;
+
+	if (!path || !*path)
+		return;
+
+	fd = open(path, O_RDONLY | O_CLOEXEC);
+	if (fd < 0)
+		die(path, "open");
+	if (setns(fd, CLONE_NEWNET) < 0)
+		die(path, "setns");
+	close(fd);
+
+	/* remount /sys for it to show the devices of the namespace, as ip netns exec does */
+	if (unshare(CLONE_NEWNS) < 0)
+		die(path, "unshare");
+	if (mount("", "/", NULL, MS_SLAVE | MS_REC, NULL) < 0)
+		die(path, "mount /");
+	umount2("/sys", MNT_DETACH);
+	if (mount("sysfs", "/sys", "sysfs", 0, NULL) < 0)
+		die(path, "mount /sys");
+
+	flannel_netns = strdup(path);
+	unsetenv(FLANNEL_NETNS_ENV);
+}
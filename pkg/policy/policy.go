@@ -0,0 +1,372 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy computes the nftables rules enforcing the Kubernetes
+// NetworkPolicies on the pods of a node.
+//
+// The traffic forwarded from and to the pods isolated by a policy goes
+// through a chain of the pod, which returns for the allowed packets and
+// drops the others. Egress is checked before ingress so that traffic
+// between two isolated pods of the node has to be allowed by both. The
+// replies of allowed connections are accepted by conntrack.
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/kube"
+)
+
+// Table is the nftables table, of the ip family, holding the rules.
+const Table = "flannel_policy"
+
+// State is what the rules are computed from.
+type State struct {
+	Pods       []kube.Pod
+	Namespaces []kube.Namespace
+	Policies   []kube.NetworkPolicy
+}
+
+type pod struct {
+	*kube.Pod
+	ip string
+}
+
+type computer struct {
+	pods     []*pod
+	nsLabels map[string]map[string]string
+}
+
+func newComputer(st *State) *computer {
+	c := &computer{nsLabels: make(map[string]map[string]string)}
+	for i := range st.Pods {
+		p := &st.Pods[i]
+		if p.Spec.HostNetwork || p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+			continue
+		}
+		if a := net.ParseIP(p.Status.PodIP); a != nil && a.To4() != nil {
+			c.pods = append(c.pods, &pod{p, a.String()})
+		}
+	}
+	for _, ns := range st.Namespaces {
+		c.nsLabels[ns.Metadata.Name] = ns.Metadata.Labels
+	}
+	return c
+}
+
+// Chains are the chains of the pods isolated by the policies, by name.
+type Chains map[string][]string
+
+// Ruleset is the rules enforcing the policies.
+type Ruleset struct {
+	// Forward are the rules of the forward chain, jumping to Chains
+	Forward []string
+	Chains  Chains
+	// IngressIsolated and EgressIsolated count the isolated pods
+	IngressIsolated, EgressIsolated int
+}
+
+// Compute computes the rules enforcing the policies on the pods for which
+// local returns true.
+func Compute(st *State, local func(*kube.Pod) bool) *Ruleset {
+	c := newComputer(st)
+	rs := &Ruleset{Chains: make(Chains)}
+
+	var ingress, egress []string
+	for _, p := range c.pods {
+		if !local(p.Pod) {
+			continue
+		}
+
+		var in, out []string
+		isolatedIn, isolatedOut := false, false
+		for i := range st.Policies {
+			pol := &st.Policies[i]
+			if pol.Metadata.Namespace != p.Metadata.Namespace || !pol.Spec.PodSelector.Matches(p.Metadata.Labels) {
+				continue
+			}
+			ns := pol.Metadata.Namespace
+
+			if pol.Spec.AffectsIngress() {
+				isolatedIn = true
+				for _, r := range pol.Spec.Ingress {
+					in = append(in, c.rules(r.From, r.Ports, ns, p, true)...)
+				}
+			}
+			if pol.Spec.AffectsEgress() {
+				isolatedOut = true
+				for _, r := range pol.Spec.Egress {
+					out = append(out, c.rules(r.To, r.Ports, ns, p, false)...)
+				}
+			}
+		}
+
+		if isolatedOut {
+			name := chainName("out", p.ip)
+			rs.Chains[name] = append(dedupe(out), "drop")
+			egress = append(egress, fmt.Sprintf("ip saddr %v jump %v", p.ip, name))
+			rs.EgressIsolated++
+		}
+		if isolatedIn {
+			name := chainName("in", p.ip)
+			rs.Chains[name] = append(dedupe(in), "drop")
+			ingress = append(ingress, fmt.Sprintf("ip daddr %v jump %v", p.ip, name))
+			rs.IngressIsolated++
+		}
+	}
+
+	rs.Forward = append([]string{"ct state established,related accept"}, append(egress, ingress...)...)
+	return rs
+}
+
+func chainName(dir, ip string) string {
+	return dir + "_" + strings.Replace(ip, ".", "_", -1)
+}
+
+// rules returns the rules allowing the traffic from (for ingress) or to
+// the peers on the ports, for the local pod p. Named ports are those of p
+// for ingress and of the peer pods for egress, which then get a rule each.
+func (c *computer) rules(peers []kube.NetworkPolicyPeer, ports []kube.NetworkPolicyPort, ns string, p *pod, ingress bool) []string {
+	dir := "daddr"
+	if ingress {
+		dir = "saddr"
+	}
+	// the pod whose named ports are used, for ingress and for peers
+	// without pods
+	var target *pod
+	if ingress {
+		target = p
+	}
+	split := !ingress && hasNamedPort(ports)
+
+	var lines []string
+	emit := func(addr string, target *pod) {
+		pms := portMatches(ports, target)
+		if pms == nil {
+			lines = append(lines, join(addr, "return"))
+			return
+		}
+		for _, pm := range pms {
+			lines = append(lines, join(addr, pm, "return"))
+		}
+	}
+
+	if len(peers) == 0 {
+		if split {
+			for _, peer := range c.pods {
+				emit("ip daddr "+peer.ip, peer)
+			}
+			return lines
+		}
+		emit("", target)
+		return lines
+	}
+
+	ips := []string{}
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			if m := ipBlockMatch(peer.IPBlock, dir); m != "" {
+				emit(m, target)
+			}
+			continue
+		}
+		for _, pp := range c.selectPods(&peer, ns) {
+			if split {
+				emit("ip daddr "+pp.ip, pp)
+			} else {
+				ips = append(ips, pp.ip)
+			}
+		}
+	}
+	if len(ips) > 0 {
+		emit(fmt.Sprintf("ip %v %v", dir, nftSet(dedupe(ips))), target)
+	}
+	return lines
+}
+
+// selectPods returns the pods selected by a peer of a policy of ns.
+func (c *computer) selectPods(peer *kube.NetworkPolicyPeer, ns string) []*pod {
+	sel := []*pod{}
+	for _, p := range c.pods {
+		switch {
+		case peer.NamespaceSelector != nil:
+			labels, ok := c.nsLabels[p.Metadata.Namespace]
+			if !ok || !peer.NamespaceSelector.Matches(labels) {
+				continue
+			}
+		case peer.PodSelector != nil:
+			if p.Metadata.Namespace != ns {
+				continue
+			}
+		default:
+			continue
+		}
+		if peer.PodSelector != nil && !peer.PodSelector.Matches(p.Metadata.Labels) {
+			continue
+		}
+		sel = append(sel, p)
+	}
+	return sel
+}
+
+// ipBlockMatch returns the match of an IPv4 block, or "" for an IPv6 or
+// invalid one.
+func ipBlockMatch(b *kube.IPBlock, dir string) string {
+	if !isIPv4CIDR(b.CIDR) {
+		return ""
+	}
+	m := fmt.Sprintf("ip %v %v", dir, b.CIDR)
+
+	except := []string{}
+	for _, e := range b.Except {
+		if isIPv4CIDR(e) {
+			except = append(except, e)
+		}
+	}
+	if len(except) > 0 {
+		m += fmt.Sprintf(" ip %v != %v", dir, nftSet(except))
+	}
+	return m
+}
+
+func isIPv4CIDR(s string) bool {
+	a, _, err := net.ParseCIDR(s)
+	return err == nil && a.To4() != nil
+}
+
+func hasNamedPort(ports []kube.NetworkPolicyPort) bool {
+	for _, p := range ports {
+		if p.Port != nil && p.Port.StrVal != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func protocol(p string) string {
+	if p == "" {
+		return "tcp"
+	}
+	return strings.ToLower(p)
+}
+
+// portMatches returns the matches of the ports, or nil for all ports.
+// Named ports are looked up in the containers of target, and left out if
+// it has none of that name.
+func portMatches(ports []kube.NetworkPolicyPort, target *pod) []string {
+	if len(ports) == 0 {
+		return nil
+	}
+
+	ms := []string{}
+	for _, p := range ports {
+		proto := protocol(p.Protocol)
+		switch {
+		case p.Port == nil:
+			ms = append(ms, "meta l4proto "+proto)
+		case p.Port.StrVal != "":
+			if n, ok := namedPort(target, p.Port.StrVal, proto); ok {
+				ms = append(ms, fmt.Sprintf("%v dport %v", proto, n))
+			}
+		case p.EndPort != nil && *p.EndPort > p.Port.IntVal:
+			ms = append(ms, fmt.Sprintf("%v dport %v-%v", proto, p.Port.IntVal, *p.EndPort))
+		default:
+			ms = append(ms, fmt.Sprintf("%v dport %v", proto, p.Port.IntVal))
+		}
+	}
+	return ms
+}
+
+func namedPort(p *pod, name, proto string) (int32, bool) {
+	if p == nil {
+		return 0, false
+	}
+	for _, c := range p.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.Name == name && protocol(cp.Protocol) == proto {
+				return cp.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func nftSet(elems []string) string {
+	if len(elems) == 1 {
+		return elems[0]
+	}
+	return "{ " + strings.Join(elems, ", ") + " }"
+}
+
+func join(parts ...string) string {
+	nonEmpty := []string{}
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+// dedupe removes the duplicates of ss, keeping the first of each.
+func dedupe(ss []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Script returns an nft script replacing the table with the rules, or
+// only deleting it if rs is nil. Declaring the table before deleting it
+// makes the deletion succeed when it does not exist yet.
+func Script(rs *Ruleset) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "table ip %v\n", Table)
+	fmt.Fprintf(buf, "delete table ip %v\n", Table)
+	if rs == nil {
+		return buf.String()
+	}
+
+	fmt.Fprintf(buf, "table ip %v {\n", Table)
+	fmt.Fprintln(buf, "\tchain forward {")
+	fmt.Fprintln(buf, "\t\ttype filter hook forward priority 0; policy accept;")
+	for _, r := range rs.Forward {
+		fmt.Fprintf(buf, "\t\t%v\n", r)
+	}
+	fmt.Fprintln(buf, "\t}")
+
+	names := make([]string, 0, len(rs.Chains))
+	for name := range rs.Chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(buf, "\tchain %v {\n", name)
+		for _, r := range rs.Chains[name] {
+			fmt.Fprintf(buf, "\t\t%v\n", r)
+		}
+		fmt.Fprintln(buf, "\t}")
+	}
+	fmt.Fprintln(buf, "}")
+	return buf.String()
+}
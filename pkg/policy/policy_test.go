@@ -0,0 +1,142 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/kube"
+)
+
+const state = `{
+	"Namespaces": [
+		{"metadata": {"name": "default", "labels": {"team": "web"}}},
+		{"metadata": {"name": "monitoring", "labels": {"team": "ops"}}}
+	],
+	"Pods": [
+		{"metadata": {"name": "web", "namespace": "default", "labels": {"app": "web"}},
+		 "spec": {"nodeName": "node1", "containers": [{"name": "web", "ports": [{"name": "http", "containerPort": 8080}]}]},
+		 "status": {"podIP": "10.1.1.2"}},
+		{"metadata": {"name": "client", "namespace": "default", "labels": {"app": "client"}},
+		 "spec": {"nodeName": "node2"},
+		 "status": {"podIP": "10.1.2.2"}},
+		{"metadata": {"name": "db", "namespace": "default", "labels": {"app": "db"}},
+		 "spec": {"nodeName": "node1", "containers": [{"name": "db", "ports": [{"name": "pg", "containerPort": 5432}]}]},
+		 "status": {"podIP": "10.1.1.3"}},
+		{"metadata": {"name": "prometheus", "namespace": "monitoring", "labels": {"app": "prometheus"}},
+		 "spec": {"nodeName": "node2"},
+		 "status": {"podIP": "10.1.2.3"}},
+		{"metadata": {"name": "pending", "namespace": "default", "labels": {"app": "client"}},
+		 "spec": {"nodeName": "node2"}},
+		{"metadata": {"name": "agent", "namespace": "default", "labels": {"app": "client"}},
+		 "spec": {"nodeName": "node1", "hostNetwork": true},
+		 "status": {"podIP": "192.168.0.1"}}
+	],
+	"Policies": [
+		{"metadata": {"name": "web", "namespace": "default"},
+		 "spec": {"podSelector": {"matchLabels": {"app": "web"}},
+			"ingress": [
+				{"from": [{"podSelector": {"matchLabels": {"app": "client"}}}], "ports": [{"port": "http"}]},
+				{"from": [{"namespaceSelector": {"matchLabels": {"team": "ops"}}}, {"ipBlock": {"cidr": "192.168.0.0/16", "except": ["192.168.9.0/24"]}}]}
+			]}},
+		{"metadata": {"name": "db", "namespace": "default"},
+		 "spec": {"podSelector": {"matchLabels": {"app": "db"}}, "policyTypes": ["Ingress", "Egress"],
+			"ingress": [{"from": [{"podSelector": {"matchLabels": {"app": "web"}}}], "ports": [{"protocol": "TCP", "port": 5432}]}],
+			"egress": [{"ports": [{"protocol": "UDP", "port": 53}, {"port": 30000, "endPort": 32767}]}]}},
+		{"metadata": {"name": "web-egress", "namespace": "default"},
+		 "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "policyTypes": ["Egress"],
+			"egress": [{"to": [{"podSelector": {"matchLabels": {"app": "db"}}}], "ports": [{"port": "pg"}]}]}},
+		{"metadata": {"name": "other-namespace", "namespace": "monitoring"},
+		 "spec": {"podSelector": {}}}
+	]
+}`
+
+func TestCompute(t *testing.T) {
+	st := &State{}
+	if err := json.Unmarshal([]byte(state), st); err != nil {
+		t.Fatalf("invalid state: %v", err)
+	}
+
+	rs := Compute(st, func(p *kube.Pod) bool { return p.Spec.NodeName == "node1" })
+
+	expectedForward := []string{
+		"ct state established,related accept",
+		"ip saddr 10.1.1.2 jump out_10_1_1_2",
+		"ip saddr 10.1.1.3 jump out_10_1_1_3",
+		"ip daddr 10.1.1.2 jump in_10_1_1_2",
+		"ip daddr 10.1.1.3 jump in_10_1_1_3",
+	}
+	if !reflect.DeepEqual(rs.Forward, expectedForward) {
+		t.Errorf("forward chain mismatch:\nexpected %q\ngot      %q", expectedForward, rs.Forward)
+	}
+
+	expectedChains := Chains{
+		"in_10_1_1_2": {
+			"ip saddr 10.1.2.2 tcp dport 8080 return",
+			"ip saddr 192.168.0.0/16 ip saddr != 192.168.9.0/24 return",
+			"ip saddr 10.1.2.3 return",
+			"drop",
+		},
+		"out_10_1_1_2": {
+			"ip daddr 10.1.1.3 tcp dport 5432 return",
+			"drop",
+		},
+		"in_10_1_1_3": {
+			"ip saddr 10.1.1.2 tcp dport 5432 return",
+			"drop",
+		},
+		"out_10_1_1_3": {
+			"udp dport 53 return",
+			"tcp dport 30000-32767 return",
+			"drop",
+		},
+	}
+	if !reflect.DeepEqual(rs.Chains, expectedChains) {
+		t.Errorf("chains mismatch:\nexpected %q\ngot      %q", expectedChains, rs.Chains)
+	}
+	if rs.IngressIsolated != 2 || rs.EgressIsolated != 2 {
+		t.Errorf("expected 2 pods isolated both ways, got %v and %v", rs.IngressIsolated, rs.EgressIsolated)
+	}
+
+	// the isolation of the prometheus pod is up to node2
+	rs = Compute(st, func(p *kube.Pod) bool { return p.Spec.NodeName == "node2" })
+	if !reflect.DeepEqual(rs.Chains, Chains{"in_10_1_2_3": {"drop"}}) {
+		t.Errorf("node2 chains mismatch: got %q", rs.Chains)
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := Script(&Ruleset{
+		Forward: []string{"ct state established,related accept", "ip daddr 10.1.1.2 jump in_10_1_1_2"},
+		Chains:  Chains{"in_10_1_1_2": {"drop"}},
+	})
+	for _, expected := range []string{
+		"delete table ip flannel_policy\n",
+		"type filter hook forward priority 0; policy accept;",
+		"\t\tip daddr 10.1.1.2 jump in_10_1_1_2\n",
+		"\tchain in_10_1_1_2 {\n\t\tdrop\n\t}\n",
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("script lacks %q:\n%v", expected, s)
+		}
+	}
+
+	if s := Script(nil); strings.Contains(s, "chain") {
+		t.Errorf("deletion script has chains:\n%v", s)
+	}
+}
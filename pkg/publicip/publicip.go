@@ -0,0 +1,137 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package publicip discovers the public IPv4 address of a node behind 1:1
+// NAT, from a STUN server or from the metadata service of its cloud.
+package publicip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Methods are the ways the address can be discovered.
+var Methods = []string{"stun", "ec2", "gce", "azure"}
+
+// the link-local address all three clouds serve their metadata at
+const defaultMetadataURL = "http://169.254.169.254"
+
+// Discoverer discovers the public IP address.
+type Discoverer struct {
+	// STUNServer is the host:port of the STUN server
+	STUNServer string
+	// MetadataURL is the base URL of the metadata service, the one of the
+	// clouds by default
+	MetadataURL string
+	// Timeout bounds each discovery
+	Timeout time.Duration
+}
+
+// Discover returns the public IP address found by method, sending the STUN
+// queries from localAddr.
+func (d *Discoverer) Discover(method string, localAddr net.IP) (net.IP, error) {
+	var s string
+	var err error
+
+	switch method {
+	case "stun":
+		var ip net.IP
+		if ip, err = d.stun(localAddr); err != nil {
+			return nil, fmt.Errorf("failed to query STUN server %v: %v", d.STUNServer, err)
+		}
+		return ip, nil
+
+	case "ec2":
+		s, err = d.ec2()
+	case "gce":
+		s, err = d.get("/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip", "Metadata-Flavor", "Google")
+	case "azure":
+		s, err = d.get("/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress?api-version=2021-02-01&format=text", "Metadata", "true")
+	default:
+		return nil, fmt.Errorf("unknown public IP discovery method %q, expected one of %v", method, strings.Join(Methods, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the %v metadata service: %v", method, err)
+	}
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("the %v metadata service reports no public IP address", method)
+	}
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("the %v metadata service returned an invalid public IPv4 address %q", method, s)
+	}
+	return ip, nil
+}
+
+func (d *Discoverer) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (d *Discoverer) request(method, path string, header ...string) (string, error) {
+	base := d.MetadataURL
+	if base == "" {
+		base = defaultMetadataURL
+	}
+
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	// the metadata service must never be reached through a proxy
+	c := &http.Client{
+		Transport: &http.Transport{},
+		Timeout:   d.timeout(),
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%v %v: %v", method, path, resp.Status)
+	}
+	return string(body), nil
+}
+
+func (d *Discoverer) get(path string, header ...string) (string, error) {
+	return d.request("GET", path, header...)
+}
+
+// ec2 uses a IMDSv2 session token, falling back to IMDSv1 where tokens are
+// not supported.
+func (d *Discoverer) ec2() (string, error) {
+	var header []string
+	if token, err := d.request("PUT", "/latest/api/token", "X-aws-ec2-metadata-token-ttl-seconds", "60"); err == nil {
+		header = []string{"X-aws-ec2-metadata-token", token}
+	}
+	return d.get("/latest/meta-data/public-ipv4", header...)
+}
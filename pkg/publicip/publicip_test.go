@@ -0,0 +1,141 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publicip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	imdsv2 := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token" && imdsv2:
+			fmt.Fprint(w, "tok")
+		case r.URL.Path == "/latest/meta-data/public-ipv4" && (!imdsv2 || r.Header.Get("X-aws-ec2-metadata-token") == "tok"):
+			fmt.Fprint(w, "203.0.113.1")
+		case r.URL.Path == "/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip" && r.Header.Get("Metadata-Flavor") == "Google":
+			fmt.Fprint(w, "203.0.113.2\n")
+		case r.URL.Path == "/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress" && r.Header.Get("Metadata") == "true":
+			// no public IP
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	d := &Discoverer{MetadataURL: srv.URL}
+	for _, c := range []struct {
+		method string
+		ip     string
+	}{{"ec2", "203.0.113.1"}, {"gce", "203.0.113.2"}, {"azure", ""}, {"openstack", ""}} {
+		ip, err := d.Discover(c.method, nil)
+		switch {
+		case c.ip == "" && err == nil:
+			t.Errorf("%v: expected an error, got %v", c.method, ip)
+		case c.ip != "" && (err != nil || ip.String() != c.ip):
+			t.Errorf("%v: expected %v, got %v (%v)", c.method, c.ip, ip, err)
+		}
+	}
+
+	imdsv2 = false
+	if ip, err := d.Discover("ec2", nil); err != nil || ip.String() != "203.0.113.1" {
+		t.Errorf("ec2 without tokens: got %v (%v)", ip, err)
+	}
+}
+
+// xorMapped returns a Binding response carrying addr as XOR-MAPPED-ADDRESS,
+// after an unknown attribute with padding.
+func xorMapped(txid []byte, addr net.IP, port int) []byte {
+	b := make([]byte, stunHeaderLen, stunHeaderLen+20)
+	binary.BigEndian.PutUint16(b[0:], stunBindingResponse)
+	binary.BigEndian.PutUint16(b[2:], 8+12)
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], txid)
+
+	b = append(b, 0x80, 0x22, 0, 3, 'f', 'o', 'o', 0)
+	b = append(b, 0, attrXORMappedAddress, 0, 8, 0, familyIPv4, byte(port>>8)^0x21, byte(port)^0x12)
+	for i, x := range addr.To4() {
+		b = append(b, x^b[4+i])
+	}
+	return b
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	txid := []byte("0123456789ab")
+	resp := xorMapped(txid, net.ParseIP("198.51.100.7"), 40123)
+
+	addr, err := parseSTUNResponse(resp, txid)
+	if err != nil || addr.String() != "198.51.100.7:40123" {
+		t.Errorf("expected 198.51.100.7:40123, got %v (%v)", addr, err)
+	}
+
+	if _, err := parseSTUNResponse(resp, []byte("ba9876543210")); err == nil {
+		t.Error("accepted the response to another transaction")
+	}
+	if _, err := parseSTUNResponse(resp[:len(resp)-4], txid); err == nil {
+		t.Error("accepted a truncated response")
+	}
+}
+
+func TestSTUN(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+		first := true
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// lose the first request
+			if first || n != stunHeaderLen {
+				first = false
+				continue
+			}
+			conn.WriteToUDP(xorMapped(buf[8:20], net.ParseIP("198.51.100.8"), from.Port), from)
+		}
+	}()
+
+	d := &Discoverer{STUNServer: conn.LocalAddr().String(), Timeout: 300 * time.Millisecond}
+	ip, err := d.Discover("stun", net.IPv4(127, 0, 0, 1))
+	if err != nil || ip.String() != "198.51.100.8" {
+		t.Errorf("expected 198.51.100.8, got %v (%v)", ip, err)
+	}
+
+	own, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer own.Close()
+	// a packet from elsewhere is not taken for the response
+	own.WriteToUDP([]byte("stray"), own.LocalAddr().(*net.UDPAddr))
+
+	addr, err := d.MappedAddr(own)
+	if err != nil || addr.IP.String() != "198.51.100.8" || addr.Port != own.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("expected 198.51.100.8:%v, got %v (%v)", own.LocalAddr().(*net.UDPAddr).Port, addr, err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publicip
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A STUN Binding request, see RFC 5389.
+const (
+	stunMagicCookie     = 0x2112a442
+	stunHeaderLen       = 20
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrXORMappedAddress = 0x0020
+
+	familyIPv4  = 0x01
+	stunRetries = 3
+)
+
+func stunRequest(txid []byte) []byte {
+	b := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(b[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], txid)
+	return b
+}
+
+// parseSTUNResponse returns the address and port in the Binding response to
+// the request with txid.
+func parseSTUNResponse(b, txid []byte) (*net.UDPAddr, error) {
+	if len(b) < stunHeaderLen {
+		return nil, fmt.Errorf("short response")
+	}
+	if binary.BigEndian.Uint16(b[0:]) != stunBindingResponse {
+		return nil, fmt.Errorf("not a Binding success response (type %#04x)", binary.BigEndian.Uint16(b[0:]))
+	}
+	if binary.BigEndian.Uint32(b[4:]) != stunMagicCookie || string(b[8:20]) != string(txid) {
+		return nil, fmt.Errorf("response to another request")
+	}
+
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if stunHeaderLen+n > len(b) {
+		return nil, fmt.Errorf("truncated response")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := b[stunHeaderLen : stunHeaderLen+n]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		alen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+alen > len(attrs) {
+			return nil, fmt.Errorf("truncated attribute %#04x", typ)
+		}
+		val := attrs[4 : 4+alen]
+
+		// both carry: reserved, family, port, address
+		if (typ == attrXORMappedAddress || typ == attrMappedAddress) && alen >= 8 && val[1] == familyIPv4 {
+			addr := &net.UDPAddr{
+				IP:   net.IP(append([]byte{}, val[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(val[2:])),
+			}
+			if typ == attrXORMappedAddress {
+				for i := range addr.IP {
+					addr.IP[i] ^= b[4+i]
+				}
+				addr.Port ^= stunMagicCookie >> 16
+				return addr, nil
+			}
+			mapped = addr
+		}
+
+		// attributes are padded to 4 bytes
+		next := 4 + (alen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	if mapped == nil {
+		return nil, fmt.Errorf("no IPv4 mapped address in response")
+	}
+	return mapped, nil
+}
+
+func (d *Discoverer) stun(localAddr net.IP) (net.IP, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localAddr})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	addr, err := d.MappedAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+// MappedAddr returns the address and port the STUN server sees the queries
+// sent from conn come from, i.e. the mapping of the NAT for conn. Other
+// packets received in the meantime are dropped.
+func (d *Discoverer) MappedAddr(conn *net.UDPConn) (*net.UDPAddr, error) {
+	if d.STUNServer == "" {
+		return nil, fmt.Errorf("no STUN server")
+	}
+	raddr, err := net.ResolveUDPAddr("udp4", d.STUNServer)
+	if err != nil {
+		return nil, err
+	}
+
+	txid := make([]byte, 12)
+	if _, err := rand.Read(txid); err != nil {
+		return nil, err
+	}
+	req := stunRequest(txid)
+	defer conn.SetReadDeadline(time.Time{})
+
+	// the request is retransmitted as UDP may lose it
+	buf := make([]byte, 1500)
+	for i := 0; i < stunRetries; i++ {
+		if _, err := conn.WriteToUDP(req, raddr); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(d.timeout() / stunRetries))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+				continue
+			}
+			if addr, err := parseSTUNResponse(buf[:n], txid); err == nil {
+				return addr, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no response")
+}
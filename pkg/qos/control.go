@@ -0,0 +1,58 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.11
+// +build go1.11
+
+package qos
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const supported = true
+
+func mark(d *net.Dialer) {
+	d.Control = Control
+}
+
+// Control marks a socket of a control plane connection, as net.Dialer's
+// Control.
+func Control(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if dscp >= 0 {
+			level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+			if network == "tcp6" || network == "udp6" {
+				level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+			}
+			// the DSCP is the upper six bits of the TOS and traffic class
+			if err := syscall.SetsockoptInt(int(fd), level, opt, dscp<<2); err != nil {
+				serr = fmt.Errorf("failed to set the DSCP of the connection to %v: %v", address, err)
+				return
+			}
+		}
+		if priority >= 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PRIORITY, priority); err != nil {
+				serr = fmt.Errorf("failed to set the priority of the connection to %v: %v", address, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package qos marks the connections of flanneld to its control plane, the
+// registry, the flannel server and the Kubernetes API server, for the network
+// to give them precedence over the pod traffic, so that lease renewals get
+// through a saturated uplink.
+package qos
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	enabled bool
+	// the DSCP and socket priority to set, -1 to leave alone
+	dscp     = -1
+	priority = -1
+)
+
+// Enable has the control plane connections dialed from now on carry the
+// DSCP d and the socket priority prio, each unless negative. It does nothing
+// if flanneld is built with a Go older than 1.11, which cannot mark them.
+func Enable(d, prio int) {
+	enabled = supported && (d >= 0 || prio >= 0)
+	dscp, priority = d, prio
+}
+
+// Enabled tells whether the control plane connections are marked.
+func Enabled() bool {
+	return enabled
+}
+
+// Dialer returns a dialer of control plane connections, with the timeouts
+// of http.DefaultTransport.
+func Dialer() *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if enabled {
+		mark(d)
+	}
+	return d
+}
+
+// ConfigureTransport has t dial marked connections, if enabled.
+func ConfigureTransport(t *http.Transport) {
+	if !enabled {
+		return
+	}
+	t.Dial = Dialer().Dial
+}
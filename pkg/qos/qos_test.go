@@ -0,0 +1,72 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.11
+// +build go1.11
+
+package qos
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func sockopt(t *testing.T, c net.Conn, level, opt int) int {
+	rc, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var gerr error
+	rc.Control(func(fd uintptr) {
+		v, gerr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	return v
+}
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if Dialer().Control != nil {
+		t.Fatalf("connections are marked without Enable")
+	}
+
+	defer Enable(-1, -1)
+	Enable(46, 3)
+	c, err := Dialer().Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if tos := sockopt(t, c, syscall.IPPROTO_IP, syscall.IP_TOS); tos != 46<<2 {
+		t.Errorf("expected TOS %#x, got %#x", 46<<2, tos)
+	}
+	if prio := sockopt(t, c, syscall.SOL_SOCKET, syscall.SO_PRIORITY); prio != 3 {
+		t.Errorf("expected priority 3, got %v", prio)
+	}
+
+	Enable(-1, -1)
+	if Enabled() || Dialer().Control != nil {
+		t.Errorf("connections are still marked")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema decodes JSON objects, like the backend section of the
+// network config, into structs strictly: unknown fields, values of the
+// wrong type and values a field does not allow are rejected with errors
+// naming the field, rather than silently ignored.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// field is a field of the struct decoded into.
+type field struct {
+	name   string
+	index  int
+	values []string
+}
+
+func fieldsOf(t reflect.Type) []field {
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		fl := field{name: name, index: i}
+		if v := f.Tag.Get("values"); v != "" {
+			fl.values = strings.Split(v, ",")
+		}
+		fields = append(fields, fl)
+	}
+	return fields
+}
+
+// describe tells what JSON values decode into t.
+func describe(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "a list of " + strings.TrimPrefix(strings.TrimPrefix(describe(t.Elem()), "a "), "an ") + "s"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Ptr:
+		return describe(t.Elem())
+	}
+	return t.String()
+}
+
+// distance is the Levenshtein distance between a and b, ignoring case.
+func distance(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func unknownField(key string, fields []field) error {
+	best, bestDist := "", 3
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		names = append(names, f.name)
+		if d := distance(key, f.name); d < bestDist {
+			best, bestDist = f.name, d
+		}
+	}
+
+	switch {
+	case best != "":
+		return fmt.Errorf("unknown field %q, did you mean %q?", key, best)
+	case len(names) == 0:
+		return fmt.Errorf("unknown field %q, none are supported", key)
+	default:
+		return fmt.Errorf("unknown field %q, expected one of %v", key, strings.Join(names, ", "))
+	}
+}
+
+// Decode decodes the JSON object data, if not empty, into the struct v
+// points to. As with encoding/json, keys match the field names, or the
+// names given by json tags, regardless of case. The keys in ignore are
+// allowed but not decoded. A string field tagged `values:"a,b"` takes only
+// those values, or the empty string.
+//
+// All problems are reported in one error, in the order of the keys.
+func Decode(data []byte, v interface{}, ignore ...string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		panic("schema: Decode needs a pointer to a struct")
+	}
+	rv = rv.Elem()
+	if len(data) == 0 {
+		return nil
+	}
+
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("expected a JSON object: %v", err)
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := fieldsOf(rv.Type())
+	errs := []string{}
+next:
+	for _, k := range keys {
+		for _, i := range ignore {
+			if strings.EqualFold(k, i) {
+				continue next
+			}
+		}
+
+		var f *field
+		for i := range fields {
+			if strings.EqualFold(k, fields[i].name) {
+				f = &fields[i]
+				break
+			}
+		}
+		if f == nil {
+			errs = append(errs, unknownField(k, fields).Error())
+			continue
+		}
+
+		fv := rv.Field(f.index)
+		if err := json.Unmarshal(obj[k], fv.Addr().Interface()); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: expected %v, got %s", f.name, describe(fv.Type()), obj[k]))
+			continue
+		}
+
+		if f.values != nil && fv.Kind() == reflect.String && fv.String() != "" {
+			ok := false
+			for _, a := range f.values {
+				ok = ok || fv.String() == a
+			}
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%v: invalid value %q, expected one of %v", f.name, fv.String(), strings.Join(f.values, ", ")))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	VNI  int
+	Port int
+	GBP  bool
+	MAC  string `values:"siphash,hmac-sha256"`
+	Keys []string
+	Name string `json:"name"`
+}
+
+func TestDecode(t *testing.T) {
+	cfg := testConfig{VNI: 1}
+	err := Decode([]byte(`{"Type": "vxlan", "port": 8472, "GBP": true, "MAC": "siphash", "Keys": ["a"], "Name": "x"}`), &cfg, "Type")
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if cfg.VNI != 1 || cfg.Port != 8472 || !cfg.GBP || cfg.MAC != "siphash" || len(cfg.Keys) != 1 || cfg.Name != "x" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	if err := Decode(nil, &cfg); err != nil {
+		t.Errorf("Decode of an empty config failed: %v", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		err  string
+	}{
+		{`{"Porrt": 8472}`, `unknown field "Porrt", did you mean "Port"?`},
+		{`{"Foo": 1}`, `unknown field "Foo", expected one of VNI, Port, GBP, MAC, Keys, name`},
+		{`{"Port": "8472"}`, `Port: expected an integer, got "8472"`},
+		{`{"GBP": 1}`, `GBP: expected true or false, got 1`},
+		{`{"Keys": "a"}`, `Keys: expected a list of strings, got "a"`},
+		{`{"MAC": "sip"}`, `MAC: invalid value "sip", expected one of siphash, hmac-sha256`},
+		{`{"VNI": 1.5, "Vni2": 2}`, `VNI: expected an integer, got 1.5; unknown field "Vni2", did you mean "VNI"?`},
+		{`[1]`, `expected a JSON object`},
+	} {
+		err := Decode([]byte(c.data), &testConfig{})
+		if err == nil {
+			t.Errorf("%v: expected an error", c.data)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("%v: expected error %q, got %q", c.data, c.err, err)
+		}
+	}
+
+	if err := Decode([]byte(`{"Port": 1}`), &struct{}{}); err == nil || err.Error() != `unknown field "Port", none are supported` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
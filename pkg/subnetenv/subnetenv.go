@@ -0,0 +1,138 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subnetenv reads and writes the subnet file (subnet.env) through
+// which flanneld hands its lease to docker, the CNI plugin and others.
+package subnetenv
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// Env holds the values of a subnet file.
+type Env struct {
+	// Network is the whole flannel network, e.g. 10.1.0.0/16
+	Network ip.IP4Net
+	// Subnet is the first usable address of the lease with the lease's
+	// prefix length, e.g. 10.1.74.1/24, as expected by docker's --bip
+	Subnet ip.IP4Net
+	MTU    int
+	IPMasq bool
+}
+
+// Vars returns the contents of the subnet file as KEY=VALUE strings.
+func (e *Env) Vars() []string {
+	return []string{
+		fmt.Sprintf("FLANNEL_NETWORK=%s", e.Network),
+		fmt.Sprintf("FLANNEL_SUBNET=%s", e.Subnet),
+		fmt.Sprintf("FLANNEL_MTU=%d", e.MTU),
+		fmt.Sprintf("FLANNEL_IPMASQ=%v", e.IPMasq),
+	}
+}
+
+// ReadFile parses a file of KEY=VALUE lines such as subnet.env without
+// interpreting the values.
+func ReadFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%v: malformed line %q", path, line)
+		}
+
+		if v, err := strconv.Unquote(kv[1]); err == nil {
+			kv[1] = v
+		}
+		vars[kv[0]] = kv[1]
+	}
+
+	return vars, scanner.Err()
+}
+
+// Load reads the subnet file at path.
+func Load(path string) (*Env, error) {
+	vars, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := Parse(vars)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return env, nil
+}
+
+// Parse interprets the variables of a subnet file. FLANNEL_NETWORK and
+// FLANNEL_SUBNET are required.
+func Parse(vars map[string]string) (*Env, error) {
+	env := &Env{}
+	var err error
+
+	if env.Network, err = parseIP4Net(vars, "FLANNEL_NETWORK"); err != nil {
+		return nil, err
+	}
+	if env.Subnet, err = parseIP4Net(vars, "FLANNEL_SUBNET"); err != nil {
+		return nil, err
+	}
+
+	if v, ok := vars["FLANNEL_MTU"]; ok {
+		if env.MTU, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid FLANNEL_MTU %q", v)
+		}
+	}
+
+	if v, ok := vars["FLANNEL_IPMASQ"]; ok {
+		if env.IPMasq, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid FLANNEL_IPMASQ %q", v)
+		}
+	}
+
+	return env, nil
+}
+
+func parseIP4Net(vars map[string]string, key string) (ip.IP4Net, error) {
+	v, ok := vars[key]
+	if !ok {
+		return ip.IP4Net{}, fmt.Errorf("%v is missing", key)
+	}
+
+	addr, ipn, err := net.ParseCIDR(v)
+	if err != nil || addr.To4() == nil {
+		return ip.IP4Net{}, fmt.Errorf("invalid %v %q", key, v)
+	}
+
+	n := ip.FromIPNet(ipn)
+	n.IP = ip.FromIP(addr)
+	return n, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnetenv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	vars := map[string]string{
+		"FLANNEL_NETWORK": "10.1.0.0/16",
+		"FLANNEL_SUBNET":  "10.1.74.1/24",
+		"FLANNEL_MTU":     "1472",
+		"FLANNEL_IPMASQ":  "true",
+	}
+
+	env, err := Parse(vars)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if env.Network.String() != "10.1.0.0/16" || env.Subnet.String() != "10.1.74.1/24" || env.MTU != 1472 || !env.IPMasq {
+		t.Errorf("unexpected env: %+v", env)
+	}
+
+	// round trip
+	parsed := map[string]string{}
+	for _, v := range env.Vars() {
+		kv := strings.SplitN(v, "=", 2)
+		parsed[kv[0]] = kv[1]
+	}
+	if !reflect.DeepEqual(parsed, vars) {
+		t.Errorf("Vars mismatch: expected %v, got %v", vars, parsed)
+	}
+
+	delete(vars, "FLANNEL_SUBNET")
+	if _, err := Parse(vars); err == nil {
+		t.Error("Parse accepted a file without FLANNEL_SUBNET")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const (
+	exportInterval = 5 * time.Second
+	// spans are sent early once this many are queued
+	batchSize = 512
+	// and dropped beyond this many, e.g. while the collector is down
+	maxQueued = 4096
+)
+
+// Exporter sends the ended spans in batches to an OTLP/HTTP endpoint.
+type Exporter struct {
+	url      string
+	resource []Attr
+	client   *http.Client
+
+	mux     sync.Mutex
+	spans   []*Span
+	dropped int
+	flush   chan struct{}
+}
+
+// NewExporter returns an exporter sending to the collector at endpoint
+// (e.g. http://otel-collector:4318), with the resource attributes
+// identifying this process. The spans are sent once Run is called.
+func NewExporter(endpoint string, resource ...Attr) *Exporter {
+	return &Exporter{
+		url:      strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		resource: resource,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		flush:    make(chan struct{}, 1),
+	}
+}
+
+func (e *Exporter) add(s *Span) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if len(e.spans) >= maxQueued {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, s)
+	if len(e.spans) == batchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run sends the queued spans periodically until ctx is done, when it sends
+// the remaining ones.
+func (e *Exporter) Run(ctx context.Context) {
+	t := time.NewTicker(exportInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-e.flush:
+		case <-ctx.Done():
+			e.send()
+			return
+		}
+		e.send()
+	}
+}
+
+func (e *Exporter) send() {
+	e.mux.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	e.mux.Unlock()
+
+	if dropped > 0 {
+		log.Warningf("Dropped %v spans as the OTLP endpoint could not keep up", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := e.post(spans); err != nil {
+		log.Errorf("Failed to export %v spans to %v: %v", len(spans), e.url, err)
+	}
+}
+
+func (e *Exporter) post(spans []*Span) error {
+	data, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding of an ExportTraceServiceRequest, limited to what
+// is recorded here.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+const (
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+func (e *Exporter) request(spans []*Span) *otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mux.Lock()
+		out[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			out[i].ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			out[i].Status = otlpStatus{Code: statusCodeError, Message: s.err}
+		}
+		s.mux.Unlock()
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: otlpAttrs(e.resource)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/coreos/flannel"},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+func otlpAttrs(attrs []Attr) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, len(attrs))
+	for i, a := range attrs {
+		kvs[i].Key = a.Key
+		v := &kvs[i].Value
+		switch val := a.Value.(type) {
+		case string:
+			v.StringValue = &val
+		case bool:
+			v.BoolValue = &val
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records spans of control plane operations, like lease
+// acquisition, watches and backend programming, and exports them to an
+// OpenTelemetry collector with OTLP over HTTP in its JSON encoding. Until an
+// exporter is set, no spans are recorded and all of this is a no-op.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Attr is an attribute of a span, with a string, bool, integer or float
+// value. Other values are recorded as their string representation.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// KV returns the attribute key with value.
+func KV(key string, value interface{}) Attr {
+	return Attr{key, value}
+}
+
+// spanContext identifies a span, possibly in another process.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+type spanKey struct{}
+
+func fromContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(spanContext)
+	return sc, ok
+}
+
+// Span is an operation being traced. A nil Span, as returned by Start
+// without an exporter, ignores all calls.
+type Span struct {
+	spanContext
+	parent [8]byte
+	name   string
+	start  time.Time
+	end    time.Time
+
+	mux   sync.Mutex
+	attrs []Attr
+	err   string
+}
+
+var (
+	expMux sync.Mutex
+	exp    *Exporter
+)
+
+// SetExporter sets the exporter spans are handed to when they end.
+func SetExporter(e *Exporter) {
+	expMux.Lock()
+	defer expMux.Unlock()
+	exp = e
+}
+
+func exporter() *Exporter {
+	expMux.Lock()
+	defer expMux.Unlock()
+	return exp
+}
+
+// Start starts a span which is a child of the span in ctx, if any, and
+// returns a context carrying the new span for the operations it is made
+// of.
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	if exporter() == nil {
+		return ctx, nil
+	}
+
+	s := &Span{name: name, start: time.Now(), attrs: attrs}
+	if p, ok := fromContext(ctx); ok {
+		s.traceID = p.traceID
+		s.parent = p.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s.spanContext), s
+}
+
+// SetAttr adds an attribute to the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.attrs = append(s.attrs, Attr{key, value})
+}
+
+// End ends the span, marking it as failed if err is not nil, and hands it
+// to the exporter.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mux.Unlock()
+
+	if e := exporter(); e != nil {
+		e.add(s)
+	}
+}
+
+const traceparentHeader = "Traceparent"
+
+// Inject propagates the span in ctx to the receiver of the request in the
+// W3C traceparent header.
+func Inject(ctx context.Context, h http.Header) {
+	sc, ok := fromContext(ctx)
+	if !ok {
+		return
+	}
+	h.Set(traceparentHeader, fmt.Sprintf("00-%x-%x-01", sc.traceID, sc.spanID))
+}
+
+// Extract returns a context carrying the remote span of the traceparent
+// header, so that the spans started with it belong to the caller's trace.
+// Without a valid header ctx is returned as is.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	parts := strings.Split(h.Get(traceparentHeader), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+
+	var sc spanContext
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, sc)
+}
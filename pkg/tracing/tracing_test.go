@@ -0,0 +1,117 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestNoExporter(t *testing.T) {
+	SetExporter(nil)
+
+	ctx, s := Start(context.Background(), "noop")
+	if s != nil {
+		t.Fatalf("Start without an exporter returned a span")
+	}
+	// must not panic
+	s.SetAttr("key", "value")
+	s.End(nil)
+
+	if _, ok := fromContext(ctx); ok {
+		t.Errorf("context carries a span")
+	}
+}
+
+func TestExport(t *testing.T) {
+	reqs := make(chan *otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path %v", r.URL.Path)
+		}
+		req := &otlpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		reqs <- req
+	}))
+	defer srv.Close()
+
+	e := NewExporter(srv.URL, Attr{"service.name", "flanneld"})
+	SetExporter(e)
+	defer SetExporter(nil)
+
+	ctx, parent := Start(context.Background(), "parent", Attr{"network", "_"})
+	_, child := Start(ctx, "child")
+	child.SetAttr("events", 3)
+	child.End(errors.New("boom"))
+	parent.End(nil)
+
+	e.send()
+	req := <-reqs
+
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request layout: %+v", req)
+	}
+	res := req.ResourceSpans[0].Resource.Attributes
+	if len(res) != 1 || res[0].Key != "service.name" || *res[0].Value.StringValue != "flanneld" {
+		t.Errorf("unexpected resource attributes: %+v", res)
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %v", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "child" || p.Name != "parent" {
+		t.Fatalf("unexpected span order: %v, %v", c.Name, p.Name)
+	}
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("child is not linked to its parent: %+v %+v", c, p)
+	}
+	if c.Status.Code != statusCodeError || c.Status.Message != "boom" || p.Status.Code != 0 {
+		t.Errorf("unexpected status: %+v %+v", c.Status, p.Status)
+	}
+	if len(c.Attributes) != 1 || *c.Attributes[0].Value.IntValue != "3" {
+		t.Errorf("unexpected child attributes: %+v", c.Attributes)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	SetExporter(NewExporter("http://127.0.0.1:0"))
+	defer SetExporter(nil)
+
+	ctx, s := Start(context.Background(), "client")
+	h := http.Header{}
+	Inject(ctx, h)
+
+	sc, ok := fromContext(Extract(context.Background(), h))
+	if !ok {
+		t.Fatalf("Extract did not find the span in %v", h)
+	}
+	if sc != s.spanContext {
+		t.Errorf("span mismatch: expected %x, got %x", s.spanContext, sc)
+	}
+
+	h.Set(traceparentHeader, "00-bogus-01")
+	if _, ok := fromContext(Extract(context.Background(), h)); ok {
+		t.Errorf("Extract accepted an invalid header")
+	}
+}
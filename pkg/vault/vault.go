@@ -0,0 +1,208 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vault reads secrets from HashiCorp Vault, for the options that
+// take a vault:<path>#<field> reference instead of the secret itself.
+package vault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const refPrefix = "vault:"
+
+// IsRef tells whether s is a reference to a Vault secret.
+func IsRef(s string) bool {
+	return strings.HasPrefix(s, refPrefix)
+}
+
+// ParseRef splits a vault:<path>#<field> reference.
+func ParseRef(ref string) (path, field string, err error) {
+	if !IsRef(ref) {
+		return "", "", fmt.Errorf("%q is not a vault reference", ref)
+	}
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return "", "", fmt.Errorf("vault reference %q has no #field", ref)
+	}
+	path, field = strings.Trim(ref[len(refPrefix):i], "/"), ref[i+1:]
+	if path == "" || field == "" {
+		return "", "", fmt.Errorf("vault reference %q needs both a path and a field", ref)
+	}
+	return path, field, nil
+}
+
+// Client reads secrets with a Vault token.
+type Client struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+// NewClient returns a client of the Vault server at addr (e.g.
+// https://vault:8200), trusting the CA certificates in caFile if given.
+func NewClient(addr, token, caFile string) (*Client, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("no Vault address")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no Vault token")
+	}
+
+	t := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{},
+	}
+	fips.ConfigureTLS(t.TLSClientConfig)
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", caFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+
+	return &Client{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		client: &http.Client{Transport: t, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Secret is a secret read from Vault.
+type Secret struct {
+	Data map[string]interface{}
+	// LeaseDuration is how long the secret is valid for, 0 for static
+	// secrets like those of the KV engines
+	LeaseDuration time.Duration
+}
+
+// Read reads the secret at path, e.g. secret/data/flannel. The data of KV
+// version 2 secrets is unwrapped.
+func (c *Client) Read(path string) (*Secret, error) {
+	req, err := http.NewRequest("GET", c.addr+"/v1/"+strings.Trim(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data          map[string]interface{} `json:"data"`
+		LeaseDuration int64                  `json:"lease_duration"`
+		Errors        []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("failed to decode secret %v: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to read secret %v: %v %v", path, resp.Status, strings.Join(body.Errors, ", "))
+	}
+
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	return &Secret{Data: data, LeaseDuration: time.Duration(body.LeaseDuration) * time.Second}, nil
+}
+
+// ReadRef reads the field of the secret a vault:<path>#<field> reference
+// points to.
+func (c *Client) ReadRef(ref string) (string, *Secret, error) {
+	path, field, err := ParseRef(ref)
+	if err != nil {
+		return "", nil, err
+	}
+	s, err := c.Read(path)
+	if err != nil {
+		return "", nil, err
+	}
+	v, ok := s.Data[field]
+	if !ok {
+		return "", nil, fmt.Errorf("secret %v has no field %q", path, field)
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", nil, fmt.Errorf("field %q of secret %v is not a string", field, path)
+	}
+	return str, s, nil
+}
+
+// Value is a secret which is read again once its lease expires, e.g. a
+// dynamic etcd password.
+type Value struct {
+	c   *Client
+	ref string
+
+	mux     sync.Mutex
+	val     string
+	expires time.Time
+}
+
+// NewValue reads the secret ref points to.
+func NewValue(c *Client, ref string) (*Value, error) {
+	v := &Value{c: c, ref: ref}
+	if err := v.read(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *Value) read() error {
+	val, s, err := v.c.ReadRef(v.ref)
+	if err != nil {
+		return err
+	}
+	v.val = val
+	if s.LeaseDuration > 0 {
+		v.expires = time.Now().Add(s.LeaseDuration)
+	}
+	return nil
+}
+
+// Get returns the secret, reading it again if its lease has expired. If
+// that fails the expired value is returned, as it may still work.
+func (v *Value) Get() string {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if !v.expires.IsZero() && time.Now().After(v.expires) {
+		if err := v.read(); err != nil {
+			log.Errorf("Failed to refresh %v: %v", v.ref, err)
+		}
+	}
+	return v.val
+}
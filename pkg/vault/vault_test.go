@@ -0,0 +1,97 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRef(t *testing.T) {
+	path, field, err := ParseRef("vault:secret/data/flannel#etcd-password")
+	if err != nil || path != "secret/data/flannel" || field != "etcd-password" {
+		t.Errorf("unexpected result: %q %q %v", path, field, err)
+	}
+
+	for _, ref := range []string{"secret/flannel#x", "vault:secret/flannel", "vault:#x", "vault:secret/flannel#"} {
+		if _, _, err := ParseRef(ref); err == nil {
+			t.Errorf("ParseRef(%q) did not fail", ref)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	reads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/flannel":
+			fmt.Fprint(w, `{"data": {"data": {"etcd-password": "kv2"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/flannel":
+			fmt.Fprint(w, `{"data": {"etcd-password": "kv1", "port": 1}}`)
+		case "/v1/etcd/creds/flannel":
+			reads++
+			fmt.Fprintf(w, `{"lease_duration": 1, "data": {"password": "dynamic%v"}}`, reads)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": []}`)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL, "s3cr3t", "")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	for ref, expected := range map[string]string{
+		"vault:secret/data/flannel#etcd-password": "kv2",
+		"vault:kv/flannel#etcd-password":          "kv1",
+	} {
+		if v, _, err := c.ReadRef(ref); err != nil || v != expected {
+			t.Errorf("ReadRef(%q): expected %q, got %q, %v", ref, expected, v, err)
+		}
+	}
+
+	for _, ref := range []string{"vault:kv/flannel#port", "vault:kv/flannel#missing", "vault:kv/missing#x"} {
+		if _, _, err := c.ReadRef(ref); err == nil {
+			t.Errorf("ReadRef(%q) did not fail", ref)
+		}
+	}
+
+	v, err := NewValue(c, "vault:etcd/creds/flannel#password")
+	if err != nil {
+		t.Fatalf("NewValue failed: %v", err)
+	}
+	if s := v.Get(); s != "dynamic1" {
+		t.Errorf("expected dynamic1, got %q", s)
+	}
+	v.expires = time.Now().Add(-time.Second)
+	if s := v.Get(); s != "dynamic2" {
+		t.Errorf("expired secret was not read again: got %q", s)
+	}
+
+	bad, _ := NewClient(srv.URL, "wrong", "")
+	if _, err := bad.Read("kv/flannel"); err == nil {
+		t.Errorf("Read with a wrong token did not fail")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// capabilities needed to program the dataplane, see capabilities(7)
+var requiredCaps = []struct {
+	bit  uint
+	name string
+}{
+	{12, "CAP_NET_ADMIN"},
+	{13, "CAP_NET_RAW"},
+}
+
+// readCaps returns the effective and ambient capability sets of this process.
+func readCaps() (eff, amb uint64, err error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "CapEff:":
+			eff, err = strconv.ParseUint(fields[1], 16, 64)
+		case "CapAmb:":
+			amb, err = strconv.ParseUint(fields[1], 16, 64)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to parse /proc/self/status: %v", err)
+		}
+	}
+
+	return eff, amb, scanner.Err()
+}
+
+// checkPrivileges verifies that a non-root flanneld holds the capabilities
+// needed to manage devices, routes and iptables rules, so that it can run
+// as another user with ambient capabilities (e.g. AmbientCapabilities= in
+// its unit). Unless it is a --remote client, e.g. the agent of
+// --privsep-user, the same process also holds the registry credentials.
+func checkPrivileges() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	eff, amb, err := readCaps()
+	if err != nil {
+		return fmt.Errorf("failed to read capabilities: %v", err)
+	}
+
+	var missing, notAmbient []string
+	for _, c := range requiredCaps {
+		if eff&(1<<c.bit) == 0 {
+			missing = append(missing, c.name)
+		} else if amb&(1<<c.bit) == 0 {
+			notAmbient = append(notAmbient, c.name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("running as uid %v without %v; run as root or grant these capabilities", os.Geteuid(), strings.Join(missing, ", "))
+	}
+
+	// iptables is run as a child process which only inherits ambient capabilities
+	if f := flag.Lookup("ip-masq"); len(notAmbient) > 0 && f != nil && f.Value.String() == "true" {
+		log.Warningf("%v not in the ambient set; iptables will not be able to set up IP masquerading", strings.Join(notAmbient, ", "))
+	}
+
+	if opts.remote == "" {
+		log.Infof("Running as uid %v with CAP_NET_ADMIN and the registry credentials in the same process; use --privsep-user to split them", os.Geteuid())
+	} else {
+		log.Infof("Running as uid %v", os.Geteuid())
+	}
+	return nil
+}
+
+// startController separates the privileges of flanneld for --privsep-user.
+// It starts flanneld again as that user, without any capabilities, as the
+// controller: it holds the registry credentials and serves the leases on a
+// unix socket, as with --listen. This process becomes the agent, which
+// programs the dataplane as a --remote client of the controller and drops
+// the registry credentials. The controller is stopped when the agent exits,
+// and the agent shuts down when the controller exits.
+func startController() error {
+	switch {
+	case os.Geteuid() != 0:
+		return fmt.Errorf("--privsep-user requires flanneld to be started as root")
+	case opts.listen != "" || opts.remote != "":
+		return fmt.Errorf("--privsep-user is mutually exclusive with --listen and --remote")
+	case opts.remoteCAFile != "" || opts.remoteCertfile != "" || opts.remoteKeyfile != "" || opts.remoteToken != "":
+		return fmt.Errorf("--privsep-user does not support TLS or bearer tokens between the controller and the agent")
+	}
+
+	u, err := user.Lookup(opts.privsepUser)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("bad uid %q of user %v", u.Uid, u.Username)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("bad gid %q of user %v", u.Gid, u.Username)
+	}
+
+	// a directory only the controller (and root) can reach, as anybody who
+	// can connect to the socket is trusted like a client. One left behind
+	// by a previous run is replaced.
+	if err := os.MkdirAll(opts.privsepDir, 0755); err != nil {
+		return err
+	}
+	dir := filepath.Join(opts.privsepDir, "privsep")
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chown(dir, int(uid), int(gid)); err != nil {
+		return err
+	}
+	socket := filepath.Join(dir, "control.sock")
+
+	exe, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	// the last occurrence of a flag wins; the agent serves the metrics and
+	// writes the log file
+	args := append(os.Args[1:], "--listen=unix://"+socket, "--privsep-user=", "--metrics-listen=", "--log-file=")
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		Pdeathsig:  syscall.SIGTERM,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the controller: %v", err)
+	}
+	log.Infof("Started the controller as %v (pid %v), serving on %v", u.Username, cmd.Process.Pid, socket)
+
+	go func() {
+		err := cmd.Wait()
+		log.Errorf("The controller exited: %v", err)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+
+	opts.remote = "unix://" + socket
+	opts.driver, opts.driverCAFile, opts.driverCertfile, opts.driverKeyfile = "", "", "", ""
+	opts.etcdUsername, opts.etcdPassword = "", ""
+	opts.etcdCAFile, opts.etcdCertfile, opts.etcdKeyfile = "", "", ""
+	if opts.remoteNetwork == "" {
+		log.Warning("Without --remote-network the agent applies whatever network config the controller hands it")
+	}
+	return nil
+}
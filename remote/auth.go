@@ -0,0 +1,234 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/gorilla/context"
+)
+
+// Role is what a client authenticated by a bearer token may do.
+type Role string
+
+const (
+	// RoleAdmin may make any request, as flannel clients need to hold
+	// their leases; it is the default of the tokens in the token file
+	RoleAdmin Role = "admin"
+	// RoleReadOnly may only read the config, leases and reservations,
+	// e.g. for dashboards
+	RoleReadOnly Role = "read-only"
+)
+
+func parseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleAdmin, RoleReadOnly:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %q, expected %v or %v", s, RoleAdmin, RoleReadOnly)
+}
+
+// identity is the client a bearer token was issued to.
+type identity struct {
+	name string
+	role Role
+}
+
+type staticToken struct {
+	token string
+	identity
+}
+
+// loadStaticTokens reads the bearer tokens from path, one per line and
+// each optionally followed by its role and a name to log requests with,
+// which defaults to the line number. Empty lines and lines starting with #
+// are skipped.
+func loadStaticTokens(path string) ([]staticToken, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []staticToken{}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%v:%v: expected a token, optionally followed by a role and a name", path, i+1)
+		}
+
+		t := staticToken{fields[0], identity{fmt.Sprintf("token at %v:%v", filepath.Base(path), i+1), RoleAdmin}}
+		if len(fields) > 1 {
+			if t.role, err = parseRole(fields[1]); err != nil {
+				return nil, fmt.Errorf("%v:%v: %v", path, i+1, err)
+			}
+		}
+		if len(fields) > 2 {
+			t.name = fields[2]
+		}
+		tokens = append(tokens, t)
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%v: no tokens", path)
+	}
+	return tokens, nil
+}
+
+// LoadTokens reads the bearer tokens from path, one per line. Empty lines
+// and lines starting with # are skipped, as are the roles and names of the
+// tokens.
+func LoadTokens(path string) ([]string, error) {
+	st, err := loadStaticTokens(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]string, len(st))
+	for i, t := range st {
+		tokens[i] = t.token
+	}
+	return tokens, nil
+}
+
+type identityKey struct{}
+
+// requestIdentity returns the identity the bearer token of the request
+// was issued to, if any.
+func requestIdentity(r *http.Request) *identity {
+	id, _ := context.Get(r, identityKey{}).(*identity)
+	return id
+}
+
+type tokenAuthHandler struct {
+	tokens []staticToken
+	oidc   *oidcVerifier
+	h      http.Handler
+}
+
+// authenticate returns the identity of the bearer token of the request.
+func (th tokenAuthHandler) authenticate(r *http.Request) (*identity, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	var id *identity
+	for i, t := range th.tokens {
+		// compare all of them in constant time so as not to leak which
+		// prefix matched
+		if subtle.ConstantTimeCompare(token, []byte(t.token)) == 1 {
+			id = &th.tokens[i].identity
+		}
+	}
+	if id != nil {
+		return id, nil
+	}
+
+	if th.oidc != nil && strings.Count(string(token), ".") == 2 {
+		return th.oidc.verify(string(token))
+	}
+	return nil, fmt.Errorf("invalid bearer token")
+}
+
+// readOnly tells whether the request only reads.
+func readOnly(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD"
+}
+
+func (th tokenAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := th.authenticate(r)
+	if err != nil {
+		log.Warningf("Rejecting unauthenticated request from %v: %v %v: %v", r.RemoteAddr, r.Method, r.RequestURI, err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="flannel"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "missing or invalid bearer token")
+		return
+	}
+
+	if id.role != RoleAdmin && !readOnly(r) {
+		log.Warningf("Rejecting request of %v (%v) from %v: %v %v", id.name, id.role, r.RemoteAddr, r.Method, r.RequestURI)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%v may only read", id.name)
+		return
+	}
+
+	context.Set(r, identityKey{}, id)
+	defer context.Clear(r)
+	th.h.ServeHTTP(w, r)
+}
+
+// tokenAuth wraps h to require one of tokens, or an ID token accepted by
+// oidc if not nil, as the bearer token, and to restrict read-only clients
+// to reading.
+func tokenAuth(tokens []staticToken, oidc *oidcVerifier, h http.Handler) http.Handler {
+	return tokenAuthHandler{tokens, oidc, h}
+}
+
+type clientNameAuthHandler struct {
+	allowed []string
+	h       http.Handler
+}
+
+// clientNames returns the common name and the DNS names of the verified
+// client certificate.
+func clientNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
+
+func (ch clientNameAuthHandler) authorized(names []string) bool {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		for _, pattern := range ch.allowed {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ch clientNameAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	names := clientNames(r)
+	if !ch.authorized(names) {
+		log.Warningf("Rejecting request from %v with certificate names %v: %v %v", r.RemoteAddr, names, r.Method, r.RequestURI)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "client certificate not allowed")
+		return
+	}
+	ch.h.ServeHTTP(w, r)
+}
+
+// clientNameAuth wraps h to require a client certificate with a name
+// matching one of the allowed patterns.
+func clientNameAuth(allowed []string, h http.Handler) http.Handler {
+	return clientNameAuthHandler{allowed, h}
+}
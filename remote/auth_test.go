@@ -0,0 +1,166 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newRequest returns a request for path as a server receives it.
+func newRequest(t *testing.T, method, path string) *http.Request {
+	req, err := http.NewRequest(method, "http://example.com"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	return req
+}
+
+func TestLoadTokens(t *testing.T) {
+	f, err := ioutil.TempFile("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# operators\nabc\n\n  def  \n")
+	f.Close()
+
+	tokens, err := LoadTokens(f.Name())
+	if err != nil {
+		t.Fatalf("LoadTokens failed: %v", err)
+	}
+	if !reflect.DeepEqual(tokens, []string{"abc", "def"}) {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("# none\n"), 0600)
+	if _, err := LoadTokens(f.Name()); err == nil {
+		t.Errorf("LoadTokens accepted a file without tokens")
+	}
+}
+
+func TestLoadStaticTokens(t *testing.T) {
+	f, err := ioutil.TempFile("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("abc\ndef read-only dashboard\nghi admin\n")
+	f.Close()
+
+	tokens, err := loadStaticTokens(f.Name())
+	if err != nil {
+		t.Fatalf("loadStaticTokens failed: %v", err)
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("expected 3 tokens, got %v", len(tokens))
+	}
+	if tokens[0].role != RoleAdmin || tokens[1].role != RoleReadOnly || tokens[1].name != "dashboard" || tokens[2].role != RoleAdmin {
+		t.Errorf("unexpected tokens: %+v", tokens)
+	}
+
+	plain, err := LoadTokens(f.Name())
+	if err != nil || !reflect.DeepEqual(plain, []string{"abc", "def", "ghi"}) {
+		t.Errorf("unexpected tokens: %v, %v", plain, err)
+	}
+
+	for _, s := range []string{"abc root\n", "abc admin name extra\n"} {
+		ioutil.WriteFile(f.Name(), []byte(s), 0600)
+		if _, err := loadStaticTokens(f.Name()); err == nil {
+			t.Errorf("loadStaticTokens accepted %q", s)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	var actor string
+	h := tokenAuth([]staticToken{
+		{"abc", identity{"node", RoleAdmin}},
+		{"def", identity{"dashboard", RoleReadOnly}},
+	}, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor = requestActor(r)
+	}))
+
+	for _, c := range []struct {
+		method string
+		auth   string
+		code   int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", "Bearer abc", http.StatusOK},
+		{"GET", "Bearer def", http.StatusOK},
+		{"GET", "Bearer ab", http.StatusUnauthorized},
+		{"GET", "Basic abc", http.StatusUnauthorized},
+		{"DELETE", "Bearer abc", http.StatusOK},
+		{"DELETE", "Bearer def", http.StatusForbidden},
+		{"POST", "Bearer def", http.StatusForbidden},
+	} {
+		req := newRequest(t, c.method, "/v1/")
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%v with Authorization %q: expected %v, got %v", c.method, c.auth, c.code, w.Code)
+		}
+	}
+
+	if !strings.HasPrefix(actor, "node ") {
+		t.Errorf("expected the token name as actor, got %q", actor)
+	}
+}
+
+func TestClientNameAuth(t *testing.T) {
+	h := clientNameAuth([]string{"node-*.example.com", "admin"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, c := range []struct {
+		cn       string
+		dnsNames []string
+		code     int
+	}{
+		{"admin", nil, http.StatusOK},
+		{"node-1.example.com", nil, http.StatusOK},
+		{"other", []string{"node-2.example.com"}, http.StatusOK},
+		{"other", []string{"node-2.example.org"}, http.StatusForbidden},
+		{"", nil, http.StatusForbidden},
+	} {
+		req := newRequest(t, "GET", "/v1/")
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{
+			Subject:  pkix.Name{CommonName: c.cn},
+			DNSNames: c.dnsNames,
+		}}}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("CN %q, DNS names %v: expected %v, got %v", c.cn, c.dnsNames, c.code, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(t, "GET", "/v1/"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("request without TLS: expected %v, got %v", http.StatusForbidden, w.Code)
+	}
+}
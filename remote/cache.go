@@ -0,0 +1,277 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	configCacheTTL = 10 * time.Second
+	// defaultCachedEvents is how many lease events are kept for clients
+	// to resume from unless configured; older cursors get a snapshot
+	defaultCachedEvents = 1000
+)
+
+// cachingManager sits between the server and the registry. It caches the
+// network configs for a few seconds and serves all watches of the leases of
+// a network from a single upstream watch, so that the number of clients
+// does not multiply the load on etcd. The cursors are those of the upstream
+// manager, so clients can move to another server or to etcd directly.
+type cachingManager struct {
+	subnet.Manager
+	ctx context.Context
+	// maxEvents is how many lease events are kept per network
+	maxEvents int
+
+	mux     sync.Mutex
+	configs map[string]*cachedConfig
+	leases  map[string]*leaseCache
+}
+
+func newCachingManager(ctx context.Context, sm subnet.Manager, maxEvents int) *cachingManager {
+	if maxEvents <= 0 {
+		maxEvents = defaultCachedEvents
+	}
+	return &cachingManager{
+		Manager:   sm,
+		ctx:       ctx,
+		maxEvents: maxEvents,
+		configs:   make(map[string]*cachedConfig),
+		leases:    make(map[string]*leaseCache),
+	}
+}
+
+type cachedConfig struct {
+	// mux is held while fetching so that concurrent misses cause a single
+	// upstream request
+	mux     sync.Mutex
+	config  *subnet.Config
+	fetched time.Time
+}
+
+func (m *cachingManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	m.mux.Lock()
+	cc, ok := m.configs[network]
+	if !ok {
+		cc = &cachedConfig{}
+		m.configs[network] = cc
+	}
+	m.mux.Unlock()
+
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+
+	if cc.config != nil && time.Since(cc.fetched) < configCacheTTL {
+		return cc.config, nil
+	}
+
+	config, err := m.Manager.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	cc.config, cc.fetched = config, time.Now()
+	return config, nil
+}
+
+type cachedEvent struct {
+	evt subnet.Event
+	// cursor is the upstream cursor after evt
+	cursor uint64
+}
+
+// leaseCache mirrors the leases of a network.
+type leaseCache struct {
+	mux   sync.Mutex
+	ready bool
+	// passthrough is set if the upstream cursors are not indexes
+	passthrough bool
+	leases      []subnet.Lease
+	// events after base, the cursor of the oldest event kept, up to cursor
+	events    []cachedEvent
+	maxEvents int
+	base      uint64
+	cursor    uint64
+	// changed is closed and replaced whenever the cache was updated
+	changed chan struct{}
+}
+
+func (m *cachingManager) leaseCache(network string) *leaseCache {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	lc, ok := m.leases[network]
+	if !ok {
+		lc = &leaseCache{maxEvents: m.maxEvents, changed: make(chan struct{})}
+		m.leases[network] = lc
+		go lc.run(m.ctx, m.Manager, network)
+	}
+	return lc
+}
+
+func parseCursor(cursor interface{}) (uint64, error) {
+	switch c := cursor.(type) {
+	case string:
+		return strconv.ParseUint(c, 10, 64)
+	case fmt.Stringer:
+		return strconv.ParseUint(c.String(), 10, 64)
+	}
+	return 0, fmt.Errorf("watch cursor is of unknown type")
+}
+
+// run follows the leases of the network upstream until ctx is done.
+func (lc *leaseCache) run(ctx context.Context, sm subnet.Manager, network string) {
+	var cursor interface{}
+
+	for {
+		res, err := sm.WatchLeases(ctx, network, cursor)
+		if err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return
+			}
+
+			log.Errorf("Watch subnets of network %q for the cache: %v", network, err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		cursor = res.Cursor
+		next, err := parseCursor(res.Cursor)
+		if err != nil {
+			log.Warningf("Not caching the leases of network %q: %v", network, err)
+			lc.mux.Lock()
+			lc.passthrough = true
+			lc.update()
+			lc.mux.Unlock()
+			return
+		}
+
+		lc.mux.Lock()
+		if len(res.Events) > 0 {
+			lc.apply(res.Events, next)
+		} else {
+			lc.leases = res.Snapshot
+			lc.events = nil
+			lc.base = next
+		}
+		lc.cursor = next
+		lc.ready = true
+		lc.update()
+		lc.mux.Unlock()
+	}
+}
+
+// apply adds the events to the history and the leases, lc.mux must be
+// held.
+func (lc *leaseCache) apply(events []subnet.Event, next uint64) {
+	for _, evt := range events {
+		for i, l := range lc.leases {
+			if l.Subnet.Equal(evt.Lease.Subnet) {
+				lc.leases = append(lc.leases[:i:i], lc.leases[i+1:]...)
+				break
+			}
+		}
+		if evt.Type == subnet.EventAdded {
+			lc.leases = append(lc.leases, evt.Lease)
+		}
+
+		lc.events = append(lc.events, cachedEvent{evt, next})
+	}
+
+	if n := len(lc.events) - lc.maxEvents; n > 0 {
+		lc.base = lc.events[n-1].cursor
+		lc.events = append([]cachedEvent(nil), lc.events[n:]...)
+	}
+}
+
+// update wakes up the waiting watches, lc.mux must be held.
+func (lc *leaseCache) update() {
+	close(lc.changed)
+	lc.changed = make(chan struct{})
+}
+
+func (lc *leaseCache) snapshot() subnet.LeaseWatchResult {
+	return subnet.LeaseWatchResult{
+		Snapshot: append([]subnet.Lease{}, lc.leases...),
+		Cursor:   strconv.FormatUint(lc.cursor, 10),
+	}
+}
+
+// watch returns the events after cursor, waiting for one if there are
+// none yet, or a snapshot if cursor is nil or older than the history.
+func (lc *leaseCache) watch(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, bool, error) {
+	var since uint64
+	var err error
+	if cursor != nil {
+		if since, err = parseCursor(cursor); err != nil {
+			// not one of ours, start over
+			cursor = nil
+		}
+	}
+
+	for {
+		lc.mux.Lock()
+		switch {
+		case lc.passthrough:
+			lc.mux.Unlock()
+			return subnet.LeaseWatchResult{}, false, nil
+
+		case !lc.ready:
+
+		case cursor == nil || since < lc.base:
+			res := lc.snapshot()
+			lc.mux.Unlock()
+			return res, true, nil
+
+		case since < lc.cursor:
+			res := subnet.LeaseWatchResult{Cursor: strconv.FormatUint(lc.cursor, 10)}
+			for _, e := range lc.events {
+				if e.cursor > since {
+					res.Events = append(res.Events, e.evt)
+				}
+			}
+			lc.mux.Unlock()
+			return res, true, nil
+		}
+		changed := lc.changed
+		lc.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return subnet.LeaseWatchResult{}, true, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (m *cachingManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	res, ok, err := m.leaseCache(network).watch(ctx, cursor)
+	if !ok {
+		return m.Manager.WatchLeases(ctx, network, cursor)
+	}
+	return res, err
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestCachingManagerConfig(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	registry := subnet.NewMockRegistry("", config, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm := newCachingManager(ctx, subnet.NewMockManager(registry), 0)
+
+	c1, err := cm.GetNetworkConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	c2, err := cm.GetNetworkConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	if c1 != c2 {
+		t.Errorf("config was not cached")
+	}
+}
+
+func TestCachingManagerWatchLeases(t *testing.T) {
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	registry := subnet.NewMockRegistry("", config, nil)
+	sm := subnet.NewMockManager(registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm := newCachingManager(ctx, sm, 0)
+
+	res, err := cm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Snapshot) != 0 || len(res.Events) != 0 {
+		t.Fatalf("expected an empty snapshot, got %v", res)
+	}
+
+	// two watchers waiting on the same cursor
+	results := make(chan subnet.LeaseWatchResult, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r, err := cm.WatchLeases(ctx, "", res.Cursor)
+			if err != nil {
+				t.Errorf("WatchLeases failed: %v", err)
+			}
+			results <- r
+		}()
+	}
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1")}
+	l, err := sm.AcquireLease(ctx, "", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if len(r.Events) != 1 || r.Events[0].Type != subnet.EventAdded || !r.Events[0].Lease.Subnet.Equal(l.Subnet) {
+				t.Errorf("expected an added event for %v, got %v", l.Subnet, r)
+			}
+			if r.Cursor == res.Cursor {
+				t.Errorf("cursor did not advance")
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the lease event")
+		}
+	}
+
+	// a new client gets the lease in the snapshot
+	res, err = cm.WatchLeases(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Snapshot) != 1 || !res.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Errorf("expected a snapshot with %v, got %v", l.Subnet, res.Snapshot)
+	}
+
+	// as does one with a cursor older than the history
+	lc := cm.leaseCache("")
+	lc.mux.Lock()
+	lc.base = 10
+	lc.mux.Unlock()
+	if res, err = cm.WatchLeases(ctx, "", "3"); err != nil || len(res.Snapshot) != 1 {
+		t.Errorf("expected a snapshot for an old cursor, got %v, %v", res, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(1, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("a", now); !ok {
+			t.Fatalf("request %v within the burst was limited", i)
+		}
+	}
+	ok, wait := rl.allow("a", now)
+	if ok {
+		t.Fatalf("request beyond the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("unexpected wait %v", wait)
+	}
+
+	if ok, _ := rl.allow("b", now); !ok {
+		t.Errorf("another client was limited")
+	}
+	if ok, _ := rl.allow("a", now.Add(time.Second)); !ok {
+		t.Errorf("request after refilling was limited")
+	}
+}
@@ -23,12 +23,18 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/pkg/transport"
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/fips"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/qos"
+	"github.com/coreos/flannel/pkg/tracing"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -36,6 +42,13 @@ import (
 type RemoteManager struct {
 	base      string // includes scheme, host, and port, and version
 	transport *Transport
+	token     string
+
+	// hosts are the servers to fail over between, the current one first
+	hosts []string
+
+	mux     sync.Mutex
+	streams map[string][]*leaseStream
 }
 
 func NewTransport(info transport.TLSInfo) (*Transport, error) {
@@ -43,13 +56,10 @@ func NewTransport(info transport.TLSInfo) (*Transport, error) {
 	if err != nil {
 		return nil, err
 	}
+	fips.ConfigureTLS(cfg)
 
 	t := &Transport{
-		// timeouts taken from http.DefaultTransport
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
+		Dial:                qos.Dialer().Dial,
 		TLSHandshakeTimeout: 10 * time.Second,
 		TLSClientConfig:     cfg,
 	}
@@ -57,7 +67,22 @@ func NewTransport(info transport.TLSInfo) (*Transport, error) {
 	return t, nil
 }
 
-func NewRemoteManager(listenAddr, cafile, certfile, keyfile string) (subnet.Manager, error) {
+// NewRemoteManager returns a subnet.Manager talking to the server at
+// listenAddr, which may also be a comma separated list of servers to fail
+// over between, or unix:///path for a server on a unix socket. With tokenFile,
+// the first token in it is sent as the bearer token, which requires TLS
+// (cafile).
+func NewRemoteManager(listenAddr, cafile, certfile, keyfile, tokenFile string) (subnet.Manager, error) {
+	hosts := []string{}
+	for _, h := range strings.Split(listenAddr, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no server address given")
+	}
+
 	tls := transport.TLSInfo{
 		CAFile:   cafile,
 		CertFile: certfile,
@@ -69,6 +94,38 @@ func NewRemoteManager(listenAddr, cafile, certfile, keyfile string) (subnet.Mana
 		return nil, err
 	}
 
+	// servers on unix sockets get a host name of their own to dial them by
+	sockets := map[string]string{}
+	for i, h := range hosts {
+		if strings.HasPrefix(h, "unix://") {
+			name := fmt.Sprintf("unix-%d", i)
+			sockets[name] = strings.TrimPrefix(h, "unix://")
+			hosts[i] = name
+		}
+	}
+	if len(sockets) > 0 {
+		if !tls.Empty() || tls.CAFile != "" {
+			return nil, fmt.Errorf("TLS is not supported with servers on unix sockets")
+		}
+		dial := t.Dial
+		t.Dial = func(network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if path, ok := sockets[host]; ok && err == nil {
+				return net.Dial("unix", path)
+			}
+			return dial(network, addr)
+		}
+	}
+
+	if certfile != "" {
+		// present the current client certificate on every connection
+		r, err := newCertReloader(certfile, keyfile, "")
+		if err != nil {
+			return nil, err
+		}
+		t.DialTLS = r.dialTLS(t.Dial, t.TLSClientConfig)
+	}
+
 	var scheme string
 	if tls.Empty() && tls.CAFile == "" {
 		scheme = "http://"
@@ -76,10 +133,26 @@ func NewRemoteManager(listenAddr, cafile, certfile, keyfile string) (subnet.Mana
 		scheme = "https://"
 	}
 
-	return &RemoteManager{
-		base:      scheme + listenAddr + "/v1",
+	m := &RemoteManager{
+		base:      scheme + hosts[0] + "/v1",
 		transport: t,
-	}, nil
+		hosts:     hosts,
+		streams:   make(map[string][]*leaseStream),
+	}
+
+	if tokenFile != "" {
+		if scheme != "https://" {
+			return nil, fmt.Errorf("bearer tokens require TLS, set the CA file")
+		}
+
+		tokens, err := LoadTokens(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		m.token = tokens[0]
+	}
+
+	return m, nil
 }
 
 func (m *RemoteManager) mkurl(network string, parts ...string) string {
@@ -229,19 +302,10 @@ func (m *RemoteManager) WatchLease(ctx context.Context, network string, sn ip.IP
 	return wr, nil
 }
 
+// WatchLeases reads the results from a lease stream kept open between
+// calls, instead of polling the server for each of them.
 func (m *RemoteManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
-	url := m.mkurl(network, "leases")
-
-	wr := subnet.LeaseWatchResult{}
-	err := m.watch(ctx, url, cursor, &wr)
-	if err != nil {
-		return subnet.LeaseWatchResult{}, err
-	}
-	if _, ok := wr.Cursor.(string); !ok {
-		return subnet.LeaseWatchResult{}, fmt.Errorf("watch returned non-string cursor")
-	}
-
-	return wr, nil
+	return m.watchLeasesStream(ctx, network, cursor)
 }
 
 func (m *RemoteManager) WatchNetworks(ctx context.Context, cursor interface{}) (subnet.NetworkWatchResult, error) {
@@ -328,7 +392,51 @@ type httpRespErr struct {
 	err  error
 }
 
-func (m *RemoteManager) httpDo(ctx context.Context, req *http.Request) (*http.Response, error) {
+// currentHost returns the server requests go to.
+func (m *RemoteManager) currentHost() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.hosts[0]
+}
+
+// failover moves on to the next server after host failed, unless another
+// request already did.
+func (m *RemoteManager) failover(host string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.hosts[0] == host {
+		m.hosts = append(m.hosts[1:], host)
+	}
+}
+
+// httpDo sends req with body to the current server, failing over to the
+// others in turn if it cannot be reached.
+func (m *RemoteManager) httpDo(ctx context.Context, req *http.Request, body []byte) (*http.Response, error) {
+	tracing.Inject(ctx, req.Header)
+	for i := 0; ; i++ {
+		host := m.currentHost()
+		req.URL.Host = host
+		req.Host = host
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := m.httpDoOnce(ctx, req)
+		if err == nil && resp.StatusCode == http.StatusServiceUnavailable && i < len(m.hosts)-1 {
+			// a follower without a leader to forward to
+			resp.Body.Close()
+			err = fmt.Errorf("server unavailable")
+		}
+		if err == nil || ctx.Err() != nil || i == len(m.hosts)-1 {
+			return resp, err
+		}
+
+		log.Warningf("Failed to reach flannel server %v, failing over: %v", host, err)
+		m.failover(host)
+	}
+}
+
+func (m *RemoteManager) httpDoOnce(ctx context.Context, req *http.Request) (*http.Response, error) {
 	// Run the HTTP request in a goroutine (so it can be canceled) and pass
 	// the result via the channel c
 	client := &http.Client{Transport: m.transport}
@@ -351,7 +459,7 @@ func (m *RemoteManager) httpDo(ctx context.Context, req *http.Request) (*http.Re
 func (m *RemoteManager) httpVerb(ctx context.Context, method, url, contentType string, body []byte) (*http.Response, error) {
 	var r io.Reader
 	if body != nil {
-		r = bytes.NewBuffer(body)
+		r = bytes.NewReader(body)
 	}
 
 	req, err := http.NewRequest(method, url, r)
@@ -362,5 +470,8 @@ func (m *RemoteManager) httpVerb(ctx context.Context, method, url, contentType s
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
 	}
-	return m.httpDo(ctx, req)
+	if m.token != "" {
+		req.Header.Set("Authorization", "Bearer "+m.token)
+	}
+	return m.httpDo(ctx, req, body)
 }
@@ -0,0 +1,284 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// LeaderElection configures electing one of several servers as the leader,
+// which serves the API while the others proxy the requests of their clients
+// to it.
+type LeaderElection struct {
+	Etcd *subnet.EtcdConfig
+	// Key is the etcd key holding the URL of the leader
+	Key string
+	// Advertise is the URL under which the other servers reach this one,
+	// e.g. https://10.0.0.3:8888
+	Advertise string
+	// TTL is how long the leader key lives without being refreshed, i.e.
+	// how long a failed leader takes to replace
+	TTL time.Duration
+}
+
+// elector takes part in the election of the leader and proxies to it while
+// another server leads.
+type elector struct {
+	cli etcd.KeysAPI
+	key string
+	id  string
+	ttl time.Duration
+
+	mux    sync.Mutex
+	leader string
+	proxy  *httputil.ReverseProxy
+	// transport is used to proxy to the leader
+	transport http.RoundTripper
+}
+
+func newElector(cli etcd.KeysAPI, le *LeaderElection, transport http.RoundTripper) (*elector, error) {
+	if _, err := url.Parse(le.Advertise); err != nil || le.Advertise == "" {
+		return nil, fmt.Errorf("invalid advertise URL %q", le.Advertise)
+	}
+	if le.TTL < 3*time.Second {
+		return nil, fmt.Errorf("leader TTL %v is too short, it must be at least 3s", le.TTL)
+	}
+
+	return &elector{
+		cli:       cli,
+		key:       le.Key,
+		id:        le.Advertise,
+		ttl:       le.TTL,
+		transport: transport,
+	}, nil
+}
+
+// setLeader records the current leader, "" while there is none.
+func (e *elector) setLeader(leader string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if leader == e.leader {
+		return
+	}
+
+	switch {
+	case leader == e.id:
+		log.Infof("Became the leader of the flannel servers")
+	case leader == "":
+		log.Infof("No leader of the flannel servers")
+	default:
+		log.Infof("Following the flannel server at %v", leader)
+	}
+
+	e.leader = leader
+	e.proxy = nil
+	if leader != "" && leader != e.id {
+		if u, err := url.Parse(leader); err == nil {
+			e.proxy = httputil.NewSingleHostReverseProxy(u)
+			e.proxy.Transport = e.transport
+			// lease watches are streamed; before Go 1.12 the interval must be
+			// positive, a negative one panics
+			e.proxy.FlushInterval = 100 * time.Millisecond
+		} else {
+			log.Errorf("Invalid leader URL %q: %v", leader, err)
+		}
+	}
+}
+
+func (e *elector) current() (string, *httputil.ReverseProxy) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.leader, e.proxy
+}
+
+// run takes part in the election until ctx is done, then steps down if it
+// leads.
+func (e *elector) run(ctx context.Context) {
+	for {
+		_, err := e.cli.Set(ctx, e.key, e.id, &etcd.SetOptions{PrevExist: etcd.PrevNoExist, TTL: e.ttl})
+		switch {
+		case err == nil:
+			e.setLeader(e.id)
+			e.lead(ctx)
+
+		case isErrNodeExist(err):
+			e.follow(ctx)
+
+		case ctx.Err() != nil:
+
+		default:
+			log.Errorf("Leader election failed: %v", err)
+			e.setLeader("")
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+
+		if ctx.Err() != nil {
+			e.stepDown()
+			return
+		}
+	}
+}
+
+// lead refreshes the leader key until that fails or ctx is done.
+func (e *elector) lead(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.ttl / 3):
+		}
+
+		_, err := e.cli.Set(ctx, e.key, e.id, &etcd.SetOptions{PrevValue: e.id, TTL: e.ttl})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("Lost the leadership of the flannel servers: %v", err)
+				e.setLeader("")
+			}
+			return
+		}
+	}
+}
+
+// follow tracks the current leader until its key goes away.
+func (e *elector) follow(ctx context.Context) {
+	resp, err := e.cli.Get(ctx, e.key, nil)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("Failed to get the leader: %v", err)
+			e.setLeader("")
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+		return
+	}
+	if resp.Node.Value == e.id {
+		// left over from an earlier term of ours, take it back
+		e.setLeader(e.id)
+		e.lead(ctx)
+		return
+	}
+	e.setLeader(resp.Node.Value)
+
+	w := e.cli.Watcher(e.key, &etcd.WatcherOptions{AfterIndex: resp.Index})
+	for {
+		resp, err := w.Next(ctx)
+		if err != nil {
+			switch {
+			case ctx.Err() != nil:
+			case isErrIndexCleared(err):
+				// fell behind the history of etcd, get the leader again
+				log.Infof("Watch of the leader fell behind, getting it again")
+			default:
+				log.Errorf("Failed to watch the leader: %v", err)
+			}
+			return
+		}
+
+		switch resp.Action {
+		case "delete", "expire", "compareAndDelete":
+			// run for leader
+			e.setLeader("")
+			return
+		default:
+			e.setLeader(resp.Node.Value)
+		}
+	}
+}
+
+// stepDown deletes the leader key if it is ours, so that another server
+// takes over without waiting for it to expire.
+func (e *elector) stepDown() {
+	leader, _ := e.current()
+	if leader != e.id {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := e.cli.Delete(ctx, e.key, &etcd.DeleteOptions{PrevValue: e.id}); err != nil {
+		log.Warningf("Failed to step down as the leader: %v", err)
+	}
+}
+
+func isErrNodeExist(err error) bool {
+	etcdErr, ok := err.(etcd.Error)
+	return ok && etcdErr.Code == etcd.ErrorCodeNodeExist
+}
+
+func isErrIndexCleared(err error) bool {
+	etcdErr, ok := err.(etcd.Error)
+	return ok && etcdErr.Code == etcd.ErrorCodeEventIndexCleared
+}
+
+type electionHandler struct {
+	e *elector
+	h http.Handler
+}
+
+func (eh electionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	leader, proxy := eh.e.current()
+	switch {
+	case leader == eh.e.id:
+		eh.h.ServeHTTP(w, r)
+
+	case proxy != nil:
+		proxy.ServeHTTP(w, r)
+
+	default:
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "no leader elected")
+	}
+}
+
+// proxyTransport returns the transport for proxying to the leader, which
+// presents our certificate from certfile and keyfile as the client
+// certificate and verifies the leader's against the CA in cafile.
+func proxyTransport(certfile, keyfile, cafile string) (http.RoundTripper, error) {
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if certfile == "" {
+		return t, nil
+	}
+
+	r, err := newCertReloader(certfile, keyfile, cafile)
+	if err != nil {
+		return nil, err
+	}
+	// without a CA file the system roots are used
+	t.DialTLS = r.dialTLS(net.Dial, &tls.Config{MinVersion: tls.VersionTLS12})
+	return t, nil
+}
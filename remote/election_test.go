@@ -0,0 +1,60 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestElectionHandler(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "leader")
+	}))
+	defer leader.Close()
+
+	e := &elector{id: "http://follower", transport: http.DefaultTransport}
+	follower := httptest.NewServer(electionHandler{e, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "follower")
+	})})
+	defer follower.Close()
+
+	get := func() (int, string) {
+		resp, err := http.Get(follower.URL + "/v1/_/config")
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("without a leader: expected %v, got %v", http.StatusServiceUnavailable, code)
+	}
+
+	e.setLeader(leader.URL)
+	if code, body := get(); code != http.StatusOK || body != "leader" {
+		t.Errorf("following: expected the leader to answer, got %v %q", code, body)
+	}
+
+	e.setLeader(e.id)
+	if code, body := get(); code != http.StatusOK || body != "follower" {
+		t.Errorf("leading: expected to answer ourselves, got %v %q", code, body)
+	}
+}
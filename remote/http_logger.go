@@ -15,8 +15,9 @@
 package remote
 
 import (
-	log "github.com/golang/glog"
 	"net/http"
+
+	"github.com/coreos/flannel/pkg/log"
 )
 
 type httpResp struct {
@@ -37,6 +38,21 @@ func (r *httpResp) WriteHeader(status int) {
 	r.writer.WriteHeader(status)
 }
 
+// Flush and CloseNotify pass through to the writer for streaming
+// responses.
+func (r *httpResp) Flush() {
+	if f, ok := r.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *httpResp) CloseNotify() <-chan bool {
+	if cn, ok := r.writer.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
 type httpLoggerHandler struct {
 	h http.Handler
 }
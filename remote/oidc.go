@@ -0,0 +1,313 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/fips"
+)
+
+// OIDCConfig configures the validation of the ID tokens of an OpenID
+// Connect provider as bearer tokens.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, from which its keys are
+	// discovered
+	Issuer string
+	// Audience must be among the audiences of the tokens, usually the
+	// client ID
+	Audience string
+	// AdminGroups are the groups, in the groups claim, whose members are
+	// admins; everybody else is read-only
+	AdminGroups []string
+}
+
+const (
+	// how much the clocks of the provider and ours may differ
+	oidcClockSkew = time.Minute
+	// how often the keys may be fetched for a token signed by an unknown
+	// key, e.g. after the provider rotated its keys
+	oidcRefetchInterval = time.Minute
+)
+
+type oidcVerifier struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mux     sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newOIDCVerifier(cfg OIDCConfig) *oidcVerifier {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	t := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{},
+	}
+	fips.ConfigureTLS(t.TLSClientConfig)
+	return &oidcVerifier{
+		cfg:    cfg,
+		client: &http.Client{Transport: t, Timeout: 10 * time.Second},
+	}
+}
+
+func (v *oidcVerifier) getJSON(url string, dst interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
+
+// fetchKeys fetches the signing keys of the provider, discovering them
+// from its configuration.
+func (v *oidcVerifier) fetchKeys() error {
+	var disc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(v.cfg.Issuer+"/.well-known/openid-configuration", &disc); err != nil {
+		return fmt.Errorf("failed to discover the OIDC provider: %v", err)
+	}
+	if strings.TrimSuffix(disc.Issuer, "/") != v.cfg.Issuer {
+		return fmt.Errorf("the OIDC provider claims to be %q", disc.Issuer)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(disc.JWKSURI, &set); err != nil {
+		return fmt.Errorf("failed to fetch the OIDC keys: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	v.keys = keys
+	return nil
+}
+
+// key returns the key with the ID kid, fetching the keys if it is unknown.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(v.fetched) < oidcRefetchInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	v.fetched = time.Now()
+	if err := v.fetchKeys(); err != nil {
+		return nil, err
+	}
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// audience is the aud claim, which is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+type idTokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Email     string   `json:"email"`
+	Groups    []string `json:"groups"`
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verify checks the signature and the claims of the ID token and returns
+// the identity of its subject.
+func (v *oidcVerifier) verify(token string) (*identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %v", err)
+	}
+
+	key, err := v.key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if hdr.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected algorithm %v for an RSA key", hdr.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if hdr.Alg != "ES256" {
+			return nil, fmt.Errorf("unexpected algorithm %v for an EC key", hdr.Alg)
+		}
+		if len(sig) != 64 || !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("invalid ID token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %v", err)
+	}
+	return v.identity(&claims, time.Now())
+}
+
+// identity checks the claims of a validly signed ID token.
+func (v *oidcVerifier) identity(c *idTokenClaims, now time.Time) (*identity, error) {
+	if strings.TrimSuffix(c.Issuer, "/") != v.cfg.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", c.Issuer)
+	}
+	if !contains(c.Audience, v.cfg.Audience) {
+		return nil, fmt.Errorf("ID token is not for %q", v.cfg.Audience)
+	}
+	if now.After(time.Unix(c.Expiry, 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if c.NotBefore != 0 && now.Add(oidcClockSkew).Before(time.Unix(c.NotBefore, 0)) {
+		return nil, fmt.Errorf("ID token is not valid yet")
+	}
+
+	id := &identity{name: c.Subject, role: RoleReadOnly}
+	if c.Email != "" {
+		id.name = c.Email
+	}
+	for _, g := range v.cfg.AdminGroups {
+		if contains(c.Groups, g) {
+			id.role = RoleAdmin
+		}
+	}
+	return id, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testIssuer struct {
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": %q, "jwks_uri": %q}`, ti.srv.URL, ti.srv.URL+"/keys")
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		}})
+	})
+	ti.srv = httptest.NewServer(mux)
+	return ti
+}
+
+func (ti *testIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	alg := map[string]string{"rsa": "RS256", "ec": "ES256"}[kid]
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	body, _ := json.Marshal(claims)
+	signed := b64(hdr) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	if kid == "rsa" {
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, ti.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		r, s, err := ecdsa.Sign(rand.Reader, ti.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// r and s left-padded to 32 bytes each
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.srv.Close()
+
+	v := newOIDCVerifier(OIDCConfig{Issuer: ti.srv.URL, Audience: "flannel", AdminGroups: []string{"netops"}})
+	exp := time.Now().Add(time.Hour).Unix()
+
+	id, err := v.verify(ti.sign(t, "rsa", map[string]interface{}{
+		"iss": ti.srv.URL, "aud": "flannel", "exp": exp, "sub": "1234", "email": "ops@example.com", "groups": []string{"netops"},
+	}))
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if id.name != "ops@example.com" || id.role != RoleAdmin {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	id, err = v.verify(ti.sign(t, "ec", map[string]interface{}{
+		"iss": ti.srv.URL, "aud": []string{"other", "flannel"}, "exp": exp, "sub": "dashboard",
+	}))
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if id.name != "dashboard" || id.role != RoleReadOnly {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"wrong issuer":   {"iss": "https://evil.example.com", "aud": "flannel", "exp": exp},
+		"wrong audience": {"iss": ti.srv.URL, "aud": "other", "exp": exp},
+		"expired":        {"iss": ti.srv.URL, "aud": "flannel", "exp": time.Now().Add(-time.Hour).Unix()},
+		"not yet valid":  {"iss": ti.srv.URL, "aud": "flannel", "exp": exp, "nbf": time.Now().Add(time.Hour).Unix()},
+	} {
+		if _, err := v.verify(ti.sign(t, "rsa", claims)); err == nil {
+			t.Errorf("%v: verify did not fail", name)
+		}
+	}
+
+	token := ti.sign(t, "rsa", map[string]interface{}{"iss": ti.srv.URL, "aud": "flannel", "exp": exp})
+	if _, err := v.verify(token[:len(token)-4] + "AAAA"); err == nil {
+		t.Errorf("verify accepted a bad signature")
+	}
+	if _, err := v.verify(ti.sign(t, "unknown", map[string]interface{}{"iss": ti.srv.URL, "aud": "flannel", "exp": exp})); err == nil {
+		t.Errorf("verify accepted an unknown key")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// rateLimiter is a token bucket per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mux     sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket of client, returning how long to wait
+// for one if it is empty.
+func (rl *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		rl.prune(now)
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets the clients whose buckets have filled up again, as they
+// behave the same as new ones, rl.mux must be held.
+func (rl *rateLimiter) prune(now time.Time) {
+	full := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for c, b := range rl.buckets {
+		if now.Sub(b.last) > full {
+			delete(rl.buckets, c)
+		}
+	}
+}
+
+// clientKey identifies the client for rate limiting: by the name in its
+// certificate, or else its IP address, so that opening more connections
+// does not help.
+func clientKey(r *http.Request) string {
+	if names := clientNames(r); len(names) > 0 && names[0] != "" {
+		return names[0]
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+type rateLimitHandler struct {
+	rl *rateLimiter
+	h  http.Handler
+}
+
+func (rh rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := clientKey(r)
+	if ok, wait := rh.rl.allow(client, time.Now()); !ok {
+		log.V(1).Infof("Rate limiting %v: %v %v", client, r.Method, r.RequestURI)
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		// http.StatusTooManyRequests, which Go 1.5 does not have
+		w.WriteHeader(429)
+		fmt.Fprint(w, "rate limit exceeded")
+		return
+	}
+	rh.h.ServeHTTP(w, r)
+}
+
+// rateLimit wraps h to allow each client rate requests per second, with
+// bursts of up to burst requests.
+func rateLimit(rate float64, burst int, h http.Handler) http.Handler {
+	return rateLimitHandler{newRateLimiter(rate, burst), h}
+}
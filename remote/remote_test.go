@@ -16,6 +16,7 @@ package remote
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
@@ -53,12 +54,12 @@ func newFixture(t *testing.T) *fixture {
 	f.ctx, f.cancel = context.WithCancel(context.Background())
 	f.wg.Add(1)
 	go func() {
-		RunServer(f.ctx, sm, f.srvAddr, "", "", "")
+		RunServer(f.ctx, sm, f.srvAddr, ServerConfig{})
 		f.wg.Done()
 	}()
 
 	var err error
-	f.sm, err = NewRemoteManager(f.srvAddr, "", "", "")
+	f.sm, err = NewRemoteManager(f.srvAddr, "", "", "", "")
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create remote mananager: %v", err))
 	}
@@ -193,6 +194,57 @@ func TestWatchLeases(t *testing.T) {
 	}
 }
 
+func TestWatchLeasesStream(t *testing.T) {
+	f := newFixture(t)
+	defer f.Close()
+
+	rm := f.sm.(*RemoteManager)
+	wr, err := rm.WatchLeases(f.ctx, "_", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	acquire := func(pubIP string) *subnet.Lease {
+		l, err := f.sm.AcquireLease(f.ctx, "_", &subnet.LeaseAttrs{PublicIP: mustParseIP4(pubIP)})
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		return l
+	}
+
+	// the next result comes from the stream opened by the first call
+	l := acquire("1.1.1.3")
+	wr, err = rm.WatchLeases(f.ctx, "_", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Lease.Key() != l.Key() {
+		t.Fatalf("unexpected watch result: %+v", wr)
+	}
+	if len(rm.streams["_"]) != 1 {
+		t.Errorf("expected one idle stream, got %v", len(rm.streams["_"]))
+	}
+
+	// a lease acquired while the stream is down is not lost: the mock
+	// registry keeps no history, so it comes back in a snapshot
+	rm.streams["_"][0].body.Close()
+	l = acquire("1.1.1.4")
+	wr, err = rm.WatchLeases(f.ctx, "_", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed after the stream ended: %v", err)
+	}
+	found := false
+	for _, sl := range wr.Snapshot {
+		found = found || sl.Key() == l.Key()
+	}
+	for _, e := range wr.Events {
+		found = found || e.Lease.Key() == l.Key()
+	}
+	if !found {
+		t.Fatalf("lease missing from the watch result after reopening: %+v", wr)
+	}
+}
+
 func TestRevokeLease(t *testing.T) {
 	f := newFixture(t)
 	defer f.Close()
@@ -272,3 +324,69 @@ func TestWatchNetworks(t *testing.T) {
 		t.Errorf("WatchNetwork delete produced wrong network: expected %s, got %s", expectedNetname, evt.Network)
 	}
 }
+
+func TestFailover(t *testing.T) {
+	f := newFixture(t)
+	defer f.Close()
+
+	// nothing listens on the first address
+	sm, err := NewRemoteManager("127.0.0.1:1,"+f.srvAddr, "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create remote mananager: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := sm.GetNetworkConfig(f.ctx, "_"); err != nil {
+			t.Fatalf("GetNetworkConfig failed: %v", err)
+		}
+	}
+
+	if h := sm.(*RemoteManager).currentHost(); h != f.srvAddr {
+		t.Errorf("expected to have failed over to %v, still at %v", f.srvAddr, h)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-remote")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addr := "unix://" + dir + "/control.sock"
+
+	config := fmt.Sprintf(`{"Network": %q}`, expectedNetwork)
+	sm := subnet.NewMockManager(subnet.NewMockRegistry("", config, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		RunServer(ctx, sm, addr, ServerConfig{})
+		wg.Done()
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	rsm, err := NewRemoteManager(addr, "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create remote mananager: %v", err)
+	}
+
+	for i := 0; ; i++ {
+		cfg, err := rsm.GetNetworkConfig(ctx, "_")
+		if err == nil {
+			if cfg.Network.String() != expectedNetwork {
+				t.Errorf("GetNetworkConfig returned bad network: %v vs %v", cfg.Network, expectedNetwork)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("GetNetworkConfig failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := NewRemoteManager(addr, "ca.pem", "", "", ""); err == nil {
+		t.Errorf("expected TLS with a unix socket to be refused")
+	}
+}
@@ -15,22 +15,22 @@
 package remote
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 
-	"github.com/coreos/etcd/pkg/transport"
 	"github.com/coreos/go-systemd/activation"
 	"github.com/coreos/go-systemd/daemon"
-	log "github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/tracing"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -40,7 +40,7 @@ func jsonResponse(w http.ResponseWriter, code int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
-		log.Error("Error JSON encoding response: %v", err)
+		log.Errorf("Error JSON encoding response: %v", err)
 	}
 }
 
@@ -180,6 +180,10 @@ func handleWatchLeases(ctx context.Context, sm subnet.Manager, w http.ResponseWr
 	}
 
 	cursor := getCursor(r.URL)
+	if r.URL.Query().Get("stream") != "" {
+		streamLeases(ctx, sm, w, network, cursor)
+		return
+	}
 
 	wr, err := sm.WatchLeases(ctx, network, cursor)
 	if err != nil {
@@ -286,9 +290,22 @@ func handleListReservations(ctx context.Context, sm subnet.Manager, w http.Respo
 	jsonResponse(w, http.StatusOK, leases)
 }
 
+// requestActor names the client for the audit log: by the name in its
+// certificate, if any, and its address.
+func requestActor(r *http.Request) string {
+	if id := requestIdentity(r); id != nil {
+		return fmt.Sprintf("%v (%v)", id.name, r.RemoteAddr)
+	}
+	if names := clientNames(r); len(names) > 0 && names[0] != "" {
+		return fmt.Sprintf("%v (%v)", names[0], r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
+
 func bindHandler(h handler, ctx context.Context, sm subnet.Manager) http.HandlerFunc {
 	return func(resp http.ResponseWriter, req *http.Request) {
-		h(ctx, sm, resp, req)
+		ctx := tracing.Extract(ctx, req.Header)
+		h(subnet.WithActor(ctx, requestActor(req)), sm, resp, req)
 	}
 }
 
@@ -318,7 +335,7 @@ func fdListener(addr string) (net.Listener, error) {
 	return listeners[fdOffset], nil
 }
 
-func listener(addr, cafile, certfile, keyfile string) (net.Listener, error) {
+func listener(addr string, cfg ServerConfig) (net.Listener, error) {
 	rex := regexp.MustCompile("(?:([a-z]+)://)?(.*)")
 	groups := rex.FindStringSubmatch(addr)
 
@@ -339,29 +356,81 @@ func listener(addr, cafile, certfile, keyfile string) (net.Listener, error) {
 			return nil, err
 		}
 
+	case groups[1] == "unix":
+		// a socket left behind by a previous run
+		os.Remove(groups[2])
+		if l, err = net.Listen("unix", groups[2]); err != nil {
+			return nil, err
+		}
+
 	default:
 		return nil, fmt.Errorf("bad listener scheme")
 	}
 
-	tlsinfo := transport.TLSInfo{
-		CAFile:   cafile,
-		CertFile: certfile,
-		KeyFile:  keyfile,
-	}
-
-	if !tlsinfo.Empty() {
-		cfg, err := tlsinfo.ServerConfig()
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		r, err := newCertReloader(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
 		if err != nil {
+			l.Close()
 			return nil, err
 		}
 
-		l = tls.NewListener(l, cfg)
+		l = r.listener(l)
 	}
 
 	return l, nil
 }
 
-func RunServer(ctx context.Context, sm subnet.Manager, listenAddr, cafile, certfile, keyfile string) {
+func newServerElector(cfg ServerConfig) (*elector, error) {
+	cli, err := subnet.NewEtcdClient(cfg.Election.Etcd)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := proxyTransport(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return newElector(cli, cfg.Election, t)
+}
+
+// ServerConfig configures TLS, the authentication of clients and the load
+// they may put on the registry.
+type ServerConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// TokenFile lists the accepted bearer tokens
+	TokenFile string
+	// OIDC, if set, accepts the ID tokens of an OpenID Connect provider
+	// as bearer tokens
+	OIDC *OIDCConfig
+	// AllowedClients are patterns (as in path.Match) of which the common
+	// name or a DNS name of the client certificate must match one
+	AllowedClients []string
+	// Cache enables caching of network configs and coalescing of lease
+	// watches into a single upstream watch per network
+	Cache bool
+	// CacheEvents is how many lease events the cache keeps per network
+	// for watches to resume from, 0 for the default of 1000
+	CacheEvents int
+	// RateLimit is the number of requests per second allowed per client,
+	// with bursts of RateBurst; 0 disables rate limiting
+	RateLimit float64
+	RateBurst int
+	// Election, if set, elects a leader among the servers sharing its key
+	Election *LeaderElection
+}
+
+// RunServer serves the subnet manager API. With a CA file clients must
+// present a certificate signed by it, with a token file or OIDC a bearer
+// token listed in it or issued by the provider. Tokens are only accepted
+// over TLS so that they cannot be sniffed. The certificates are reloaded when their files change.
+func RunServer(ctx context.Context, sm subnet.Manager, listenAddr string, cfg ServerConfig) {
+	if cfg.Cache {
+		sm = newCachingManager(ctx, sm, cfg.CacheEvents)
+	}
+
 	// {network} is always required a the API level but to
 	// keep backward compat, special "_" network is allowed
 	// that means "no network"
@@ -380,7 +449,56 @@ func RunServer(ctx context.Context, sm subnet.Manager, listenAddr, cafile, certf
 	r.HandleFunc("/v1/{network}/reservations", bindHandler(handleAddReservation, ctx, sm)).Methods("POST")
 	r.HandleFunc("/v1/{network}/reservations/{subnet}", bindHandler(handleRemoveReservation, ctx, sm)).Methods("DELETE")
 
-	l, err := listener(listenAddr, cafile, certfile, keyfile)
+	var h http.Handler = r
+	if cfg.Election != nil {
+		e, err := newServerElector(cfg)
+		if err != nil {
+			log.Errorf("Failed to set up leader election: %v", err)
+			return
+		}
+
+		// step down before returning
+		electorDone := make(chan struct{})
+		go func() {
+			e.run(ctx)
+			close(electorDone)
+		}()
+		defer func() { <-electorDone }()
+		h = electionHandler{e, h}
+	}
+	if cfg.TokenFile != "" || cfg.OIDC != nil {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			log.Errorf("Bearer tokens require TLS, set the server certificate and key")
+			return
+		}
+
+		var tokens []staticToken
+		if cfg.TokenFile != "" {
+			var err error
+			tokens, err = loadStaticTokens(cfg.TokenFile)
+			if err != nil {
+				log.Errorf("Failed to load bearer tokens: %v", err)
+				return
+			}
+		}
+		var oidc *oidcVerifier
+		if cfg.OIDC != nil {
+			oidc = newOIDCVerifier(*cfg.OIDC)
+		}
+		h = tokenAuth(tokens, oidc, h)
+	}
+	if len(cfg.AllowedClients) > 0 {
+		if cfg.CAFile == "" {
+			log.Errorf("Allowed clients require client certificates, set the CA file")
+			return
+		}
+		h = clientNameAuth(cfg.AllowedClients, h)
+	}
+	if cfg.RateLimit > 0 {
+		h = rateLimit(cfg.RateLimit, cfg.RateBurst, h)
+	}
+
+	l, err := listener(listenAddr, cfg)
 	if err != nil {
 		log.Errorf("Error listening on %v: %v", listenAddr, err)
 		return
@@ -388,7 +506,7 @@ func RunServer(ctx context.Context, sm subnet.Manager, listenAddr, cafile, certf
 
 	c := make(chan error, 1)
 	go func() {
-		c <- http.Serve(l, httpLogger(r))
+		c <- http.Serve(l, httpLogger(h))
 	}()
 
 	daemon.SdNotify("READY=1")
@@ -0,0 +1,225 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// maxIdleStreams limits the streams kept open per network for callers which
+// may come back for the next result.
+const maxIdleStreams = 4
+
+// streamResult is one line of a lease stream. A stream ends after a result
+// with an Error.
+type streamResult struct {
+	subnet.LeaseWatchResult
+	Error string `json:"error,omitempty"`
+}
+
+// GET /{network}/leases?stream=1&next=cursor
+//
+// streamLeases writes a watch result, with the cursor to resume from, on a
+// line of its own whenever the leases change, until the client goes away.
+func streamLeases(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, network string, cursor interface{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "streaming is not supported")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		wr, err := sm.WatchLeases(ctx, network, cursor)
+		if err != nil {
+			if ctx.Err() == nil {
+				enc.Encode(streamResult{Error: err.Error()})
+			}
+			return
+		}
+
+		// keep the cursor as is for the next round, the client gets the
+		// string form
+		cursor = wr.Cursor
+		if s, ok := wr.Cursor.(fmt.Stringer); ok {
+			wr.Cursor = s.String()
+		}
+		if _, ok := wr.Cursor.(string); !ok {
+			enc.Encode(streamResult{Error: "internal error: watch cursor is of unknown type"})
+			return
+		}
+
+		if err := enc.Encode(streamResult{LeaseWatchResult: wr}); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// leaseStream is the client side of a lease stream, positioned after the
+// result with cursor.
+type leaseStream struct {
+	network string
+	cursor  interface{}
+	body    io.ReadCloser
+	dec     *json.Decoder
+}
+
+func (m *RemoteManager) openStream(network string, cursor interface{}) (*leaseStream, error) {
+	u := m.mkurl(network, "leases") + "?stream=1"
+	if cursor != nil {
+		u += "&next=" + url.QueryEscape(cursor.(string))
+	}
+
+	// the stream outlives the context of the call opening it and is closed
+	// explicitly instead
+	resp, err := m.httpVerb(context.Background(), "GET", u, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, httpError(resp)
+	}
+
+	return &leaseStream{
+		network: network,
+		cursor:  cursor,
+		body:    resp.Body,
+		dec:     json.NewDecoder(resp.Body),
+	}, nil
+}
+
+func (s *leaseStream) next(ctx context.Context) (subnet.LeaseWatchResult, error) {
+	res := streamResult{}
+	c := make(chan error, 1)
+	go func() {
+		c <- s.dec.Decode(&res)
+	}()
+
+	select {
+	case <-ctx.Done():
+		s.body.Close()
+		<-c
+		return subnet.LeaseWatchResult{}, ctx.Err()
+
+	case err := <-c:
+		if err != nil {
+			return subnet.LeaseWatchResult{}, err
+		}
+	}
+
+	if res.Error != "" {
+		return subnet.LeaseWatchResult{}, fmt.Errorf("watch failed: %v", res.Error)
+	}
+	if _, ok := res.Cursor.(string); !ok {
+		return subnet.LeaseWatchResult{}, fmt.Errorf("watch returned non-string cursor")
+	}
+
+	s.cursor = res.Cursor
+	return res.LeaseWatchResult, nil
+}
+
+// takeStream returns an idle stream of network positioned at cursor, or
+// nil.
+func (m *RemoteManager) takeStream(network string, cursor interface{}) *leaseStream {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	idle := m.streams[network]
+	for i, s := range idle {
+		if s.cursor == cursor {
+			m.streams[network] = append(idle[:i], idle[i+1:]...)
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *RemoteManager) putStream(s *leaseStream) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	idle := append(m.streams[s.network], s)
+	if len(idle) > maxIdleStreams {
+		idle[0].body.Close()
+		idle = idle[1:]
+	}
+	m.streams[s.network] = idle
+}
+
+// watchLeasesStream returns the next watch result from a stream positioned
+// at cursor, opening one if there is none. An idle stream may have ended in
+// the meantime, e.g. because the server restarted, or because it does not
+// support streaming and answered with a single result. It is then reopened
+// from cursor, so no events are lost.
+func (m *RemoteManager) watchLeasesStream(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if cursor != nil {
+		if _, ok := cursor.(string); !ok {
+			return subnet.LeaseWatchResult{}, fmt.Errorf("internal error: RemoteManager.watch received non-string cursor")
+		}
+	}
+
+	if s := m.takeStream(network, cursor); s != nil {
+		wr, err := s.next(ctx)
+		if err == nil {
+			m.putStream(s)
+			return wr, nil
+		}
+		s.body.Close()
+		if ctx.Err() != nil {
+			return subnet.LeaseWatchResult{}, err
+		}
+	}
+
+	s, err := m.openStream(network, cursor)
+	if err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+
+	wr, err := s.next(ctx)
+	if err != nil {
+		s.body.Close()
+		return subnet.LeaseWatchResult{}, err
+	}
+	m.putStream(s)
+	return wr, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// certReloader keeps a certificate, and optionally a CA pool, up to date
+// with their files: whenever one of the files has changed at the time of a
+// handshake, they are loaded again. If that fails, e.g. because only the
+// certificate has been replaced yet, the previous ones stay in use.
+type certReloader struct {
+	certfile string
+	keyfile  string
+	cafile   string
+
+	mux    sync.Mutex
+	mtimes map[string]time.Time
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+}
+
+func newCertReloader(certfile, keyfile, cafile string) (*certReloader, error) {
+	r := &certReloader{
+		certfile: certfile,
+		keyfile:  keyfile,
+		cafile:   cafile,
+		mtimes:   map[string]time.Time{},
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{}
+	for _, f := range []string{r.certfile, r.keyfile, r.cafile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (r *certReloader) load() error {
+	mtimes := map[string]time.Time{}
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		mtimes[f] = fi.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.certfile != "" {
+		c, err := tls.LoadX509KeyPair(r.certfile, r.keyfile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate: %v", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.cafile != "" {
+		pem, err := ioutil.ReadFile(r.cafile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %v", r.cafile)
+		}
+	}
+
+	r.mtimes, r.cert, r.pool = mtimes, cert, pool
+	return nil
+}
+
+func (r *certReloader) changed() bool {
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil || !fi.ModTime().Equal(r.mtimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the certificate and CA pool, reloading them first if
+// their files have changed.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.changed() {
+		if err := r.load(); err != nil {
+			log.Warningf("Failed to reload TLS certificates, keeping the old ones: %v", err)
+		} else {
+			log.Infof("Reloaded TLS certificates from %v", r.files())
+		}
+	}
+	return r.cert, r.pool
+}
+
+// GetCertificate returns the current certificate to present in a handshake.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	return cert, nil
+}
+
+// serverConfig returns a server config presenting the current certificate
+// and, with a CA file, requiring client certificates signed by it.
+func (r *certReloader) serverConfig() *tls.Config {
+	_, pool := r.current()
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if pool != nil {
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	fips.ConfigureTLS(cfg)
+	return cfg
+}
+
+// reloadingListener accepts TLS connections with a config built for each
+// of them, so that they see the current CA pool as well as the current
+// certificate.
+type reloadingListener struct {
+	net.Listener
+	r *certReloader
+}
+
+func (l *reloadingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(c, l.r.serverConfig()), nil
+}
+
+// listener returns l serving TLS with the current certificate and CA pool.
+func (r *certReloader) listener(l net.Listener) net.Listener {
+	return &reloadingListener{Listener: l, r: r}
+}
+
+// dialTLS returns a DialTLS for transports, which dials with dial and
+// handshakes presenting the current certificate. The server's certificate
+// is verified against the current CA pool, or the RootCAs of base without
+// a CA file.
+func (r *certReloader) dialTLS(dial func(network, addr string) (net.Conn, error), base *tls.Config) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, pool := r.current()
+		cfg := &tls.Config{
+			MinVersion: base.MinVersion,
+			RootCAs:    base.RootCAs,
+			ServerName: host,
+		}
+		if pool != nil {
+			cfg.RootCAs = pool
+		}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		fips.ConfigureTLS(cfg)
+
+		c, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		tc := tls.Client(c, cfg)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		return tc, nil
+	}
+}
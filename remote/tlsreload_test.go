@@ -0,0 +1,97 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for cn and its key.
+func writeCert(t *testing.T, certfile, keyfile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func commonName(t *testing.T, r *certReloader) string {
+	cert, _ := r.current()
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certfile, keyfile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCert(t, certfile, keyfile, "first")
+
+	r, err := newCertReloader(certfile, keyfile, certfile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	if cn := commonName(t, r); cn != "first" {
+		t.Fatalf("expected the first certificate, got %q", cn)
+	}
+
+	writeCert(t, certfile, keyfile, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certfile, future, future)
+	if cn := commonName(t, r); cn != "second" {
+		t.Errorf("certificate was not reloaded, got %q", cn)
+	}
+
+	// a broken key keeps the previous certificate in use
+	ioutil.WriteFile(keyfile, []byte("garbage"), 0600)
+	if cn := commonName(t, r); cn != "second" {
+		t.Errorf("broken files replaced the certificate, got %q", cn)
+	}
+}
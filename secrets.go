@@ -0,0 +1,140 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/vault"
+)
+
+// etcdAuth returns the etcd credentials when either is read from Vault,
+// which are then read again once their lease expires.
+var etcdAuth func() (username, password string)
+
+// secretRefs are the Vault references the options read from Vault were
+// given as, so that a config reload does not see them as changed.
+var secretRefs = map[string]string{}
+
+// secretFileOpts are the options naming files which may instead be Vault
+// references. The secret is written to a file in --secrets-dir.
+func secretFileOpts() map[string]*string {
+	return map[string]*string{
+		"etcd-keyfile":          &opts.etcdKeyfile,
+		"etcd-certfile":         &opts.etcdCertfile,
+		"etcd-cafile":           &opts.etcdCAFile,
+		"remote-keyfile":        &opts.remoteKeyfile,
+		"remote-certfile":       &opts.remoteCertfile,
+		"remote-cafile":         &opts.remoteCAFile,
+		"remote-token-file":     &opts.remoteToken,
+		"backend-data-kek-file": &opts.backendKEK,
+	}
+}
+
+func newVaultClient() (*vault.Client, error) {
+	addr := opts.vaultAddr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	cafile := opts.vaultCAFile
+	if cafile == "" {
+		cafile = os.Getenv("VAULT_CACERT")
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if opts.vaultTokenFile != "" {
+		data, err := ioutil.ReadFile(opts.vaultTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	return vault.NewClient(addr, token, cafile)
+}
+
+// resolveSecrets reads the options given as vault:<path>#<field> references
+// from Vault, so that the secrets need not be stored in plaintext in the
+// config file or the environment.
+func resolveSecrets() error {
+	fileOpts := secretFileOpts()
+	refs := false
+	for _, p := range fileOpts {
+		refs = refs || vault.IsRef(*p)
+	}
+	if !refs && !vault.IsRef(opts.etcdUsername) && !vault.IsRef(opts.etcdPassword) {
+		return nil
+	}
+
+	c, err := newVaultClient()
+	if err != nil {
+		return err
+	}
+
+	for name, p := range fileOpts {
+		if !vault.IsRef(*p) {
+			continue
+		}
+		s, _, err := c.ReadRef(*p)
+		if err != nil {
+			return fmt.Errorf("failed to read --%v: %v", name, err)
+		}
+		if err := os.MkdirAll(opts.secretsDir, 0700); err != nil {
+			return err
+		}
+		path := filepath.Join(opts.secretsDir, name)
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			return fmt.Errorf("failed to write --%v: %v", name, err)
+		}
+		log.Infof("Read --%v from %v", name, *p)
+		secretRefs[name] = *p
+		*p = path
+	}
+
+	if !vault.IsRef(opts.etcdUsername) && !vault.IsRef(opts.etcdPassword) {
+		return nil
+	}
+	username, err := secretValue(c, "etcd-username", opts.etcdUsername)
+	if err != nil {
+		return err
+	}
+	password, err := secretValue(c, "etcd-password", opts.etcdPassword)
+	if err != nil {
+		return err
+	}
+	etcdAuth = func() (string, string) {
+		return username(), password()
+	}
+	return nil
+}
+
+// secretValue returns a function returning s, or the secret it references
+// if it is a Vault reference.
+func secretValue(c *vault.Client, name, s string) (func() string, error) {
+	if !vault.IsRef(s) {
+		return func() string { return s }, nil
+	}
+	v, err := vault.NewValue(c, s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --%v: %v", name, err)
+	}
+	log.Infof("Read --%v from %v", name, s)
+	return v.Get, nil
+}
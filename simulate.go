@@ -0,0 +1,140 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/flannel/e2e"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// runSimulateCluster implements the simulate-cluster subcommand, which runs
+// a cluster of network namespaces with this flanneld on a single host and
+// checks that the nodes reach each other through the overlay.
+func runSimulateCluster(args []string) int {
+	fs := flag.NewFlagSet("simulate-cluster", flag.ContinueOnError)
+	nodes := fs.Int("nodes", 3, "number of nodes")
+	backend := fs.String("backend", "vxlan", fmt.Sprintf("backend type of the network, one of %v, or all to check each of them", strings.Join(e2e.Backends, ", ")))
+	network := fs.String("network", "10.42.0.0/16", "flannel network")
+	underlay := fs.String("underlay", "192.168.213.0/24", "network of the bridge connecting the nodes")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the leases and for the nodes to reach each other")
+	keep := fs.Bool("keep", false, "keep the cluster running after the check until interrupted, to inspect it with ip netns exec")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s simulate-cluster [OPTION]... [-- FLANNELD OPTION...]\n\nSimulate a flannel cluster in network namespaces and check its connectivity; requires root\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	backends := []string{*backend}
+	if *backend == "all" {
+		if *keep {
+			fmt.Fprintln(os.Stderr, "-keep requires a single backend")
+			return 1
+		}
+		backends = e2e.Backends
+	}
+
+	flanneld, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to find the flanneld binary: %v\n", err)
+		return 1
+	}
+
+	dir, err := ioutil.TempDir("", "flannel-simulate")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("The logs are in %v\n", dir)
+
+	status := 0
+	for _, be := range backends {
+		cfg := e2e.Config{
+			Flanneld: flanneld,
+			Nodes:    *nodes,
+			Backend:  be,
+			Network:  *network,
+			Underlay: *underlay,
+			Dir:      filepath.Join(dir, be),
+			Args:     fs.Args(),
+		}
+		if !simulate(cfg, *timeout, *keep) {
+			status = 1
+		}
+	}
+	return status
+}
+
+// simulate runs the cluster of cfg and reports whether its nodes reach each
+// other.
+func simulate(cfg e2e.Config, timeout time.Duration, keep bool) bool {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+
+	// keep the requests of the nodes to the flannel server out of the output
+	serverLog, err := os.Create(filepath.Join(cfg.Dir, "server.log"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer serverLog.Close()
+	log.SetLogger(log.NewTextLogger(serverLog, logVerbosity))
+
+	fmt.Printf("%v: starting %d nodes\n", cfg.Backend, cfg.Nodes)
+	c, err := e2e.Start(cfg)
+	if err != nil {
+		fmt.Printf("%v: FAIL: %v\n", cfg.Backend, err)
+		return false
+	}
+	defer c.Close()
+
+	err = c.WaitForLeases(timeout)
+	if err == nil {
+		err = c.CheckConnectivity(timeout)
+	}
+	if err != nil {
+		fmt.Printf("%v: FAIL: %v\n", cfg.Backend, err)
+	} else {
+		fmt.Printf("%v: ok, every node reaches every other one\n", cfg.Backend)
+	}
+
+	if keep {
+		for _, n := range c.Nodes {
+			gw, _ := n.Gateway()
+			fmt.Printf("  %v: public IP %v, gateway %v, log %v\n", n.Name, n.PublicIP, gw, n.LogFile())
+		}
+		fmt.Println("Running until interrupted")
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		signal.Stop(sigs)
+	}
+	return err == nil
+}
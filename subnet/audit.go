@@ -0,0 +1,257 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+const (
+	AuditLeaseAcquired      = "lease-acquired"
+	AuditLeaseRenewed       = "lease-renewed"
+	AuditLeaseRevoked       = "lease-revoked"
+	AuditReservationAdded   = "reservation-added"
+	AuditReservationRemoved = "reservation-removed"
+	AuditConfigChanged      = "config-changed"
+	AuditStateImported      = "state-imported"
+)
+
+// AuditRecord is an entry of the audit log. Failed changes are recorded as
+// well, with Error set.
+type AuditRecord struct {
+	Time    time.Time
+	Event   string
+	Network string     `json:",omitempty"`
+	Subnet  *ip.IP4Net `json:",omitempty"`
+	// PublicIP is that of the lease or reservation
+	PublicIP *ip.IP4 `json:",omitempty"`
+	// Config is the new network config of a config-changed record
+	Config *Config `json:",omitempty"`
+	// Actor is who asked for the change, see WithActor
+	Actor string
+	// Host is the host running the flanneld (or flannelctl) that made the
+	// change
+	Host  string
+	Error string `json:",omitempty"`
+}
+
+// Auditor stores audit records.
+type Auditor interface {
+	Audit(ctx context.Context, r *AuditRecord) error
+}
+
+type actorKey struct{}
+
+// WithActor returns a context which attributes the changes made with it to
+// actor, e.g. the remote client on whose behalf the server acts.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	if a, ok := ctx.Value(actorKey{}).(string); ok {
+		return a
+	}
+	return ""
+}
+
+type auditManager struct {
+	Manager
+	auditor Auditor
+	host    string
+
+	mux     sync.Mutex
+	configs map[string]string
+}
+
+// NewAuditManager wraps sm to record the changes made through it to the
+// auditor. Changes to the network config are recorded when GetNetworkConfig
+// first sees them. Records the auditor fails to store are logged, but do
+// not fail the change itself.
+func NewAuditManager(sm Manager, auditor Auditor) Manager {
+	host, _ := os.Hostname()
+	return &auditManager{
+		Manager: sm,
+		auditor: auditor,
+		host:    host,
+		configs: make(map[string]string),
+	}
+}
+
+func (m *auditManager) audit(ctx context.Context, r *AuditRecord, err error) {
+	r.Time = time.Now()
+	r.Host = m.host
+	if r.Actor = actorFrom(ctx); r.Actor == "" {
+		r.Actor = m.host
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if err := m.auditor.Audit(ctx, r); err != nil {
+		log.Errorf("Failed to write audit record %v: %v", r.Event, err)
+	}
+}
+
+func (m *auditManager) GetNetworkConfig(ctx context.Context, network string) (*Config, error) {
+	cfg, err := m.Manager.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return cfg, nil
+	}
+
+	m.mux.Lock()
+	prev, seen := m.configs[network]
+	m.configs[network] = string(data)
+	m.mux.Unlock()
+
+	if seen && prev != string(data) {
+		m.audit(ctx, &AuditRecord{Event: AuditConfigChanged, Network: network, Config: cfg}, nil)
+	}
+	return cfg, nil
+}
+
+func (m *auditManager) AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error) {
+	l, err := m.Manager.AcquireLease(ctx, network, attrs)
+
+	r := &AuditRecord{Event: AuditLeaseAcquired, Network: network, PublicIP: &attrs.PublicIP}
+	if l != nil {
+		r.Subnet = &l.Subnet
+	}
+	m.audit(ctx, r, err)
+	return l, err
+}
+
+func (m *auditManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
+	err := m.Manager.RenewLease(ctx, network, lease)
+	m.audit(ctx, &AuditRecord{Event: AuditLeaseRenewed, Network: network, Subnet: &lease.Subnet, PublicIP: &lease.Attrs.PublicIP}, err)
+	return err
+}
+
+func (m *auditManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	err := m.Manager.RevokeLease(ctx, network, sn)
+	m.audit(ctx, &AuditRecord{Event: AuditLeaseRevoked, Network: network, Subnet: &sn}, err)
+	return err
+}
+
+func (m *auditManager) AddReservation(ctx context.Context, network string, r *Reservation) error {
+	err := m.Manager.AddReservation(ctx, network, r)
+	m.audit(ctx, &AuditRecord{Event: AuditReservationAdded, Network: network, Subnet: &r.Subnet, PublicIP: &r.PublicIP}, err)
+	return err
+}
+
+func (m *auditManager) RemoveReservation(ctx context.Context, network string, sn ip.IP4Net) error {
+	err := m.Manager.RemoveReservation(ctx, network, sn)
+	m.audit(ctx, &AuditRecord{Event: AuditReservationRemoved, Network: network, Subnet: &sn}, err)
+	return err
+}
+
+// ImportState records an import per network, with the config.
+func (m *auditManager) ImportState(ctx context.Context, s *State) error {
+	si, ok := m.Manager.(StateImporter)
+	if !ok {
+		return fmt.Errorf("the registry does not support importing a state")
+	}
+
+	err := si.ImportState(ctx, s)
+	for _, n := range s.Networks {
+		r := &AuditRecord{Event: AuditStateImported, Network: n.Name}
+		if cfg, perr := ParseConfig(string(n.Config)); perr == nil {
+			r.Config = cfg
+		}
+		m.audit(ctx, r, err)
+	}
+	return err
+}
+
+type fileAuditor struct {
+	mux sync.Mutex
+	f   *os.File
+}
+
+// NewFileAuditor appends the records to the file at path as one JSON
+// object per line.
+func NewFileAuditor(path string) (Auditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditor{f: f}, nil
+}
+
+func (a *fileAuditor) Audit(ctx context.Context, r *AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	// a single write per record so that concurrent writers never
+	// interleave
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+type etcdAuditor struct {
+	cli etcd.KeysAPI
+	dir string
+	ttl time.Duration
+}
+
+// NewEtcdAuditor stores the records in etcd as in-order keys of the
+// directory prefix, which must not be below the network prefix. Records
+// expire after ttl unless it is 0.
+func NewEtcdAuditor(config *EtcdConfig, prefix string, ttl time.Duration) (Auditor, error) {
+	// flanneld would take the directory for a network
+	if strings.HasPrefix(path.Clean(prefix)+"/", path.Clean(config.Prefix)+"/") {
+		return nil, fmt.Errorf("audit prefix %v must not be below the network prefix %v", prefix, config.Prefix)
+	}
+
+	cli, err := newEtcdClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdAuditor{cli: cli, dir: prefix, ttl: ttl}, nil
+}
+
+func (a *etcdAuditor) Audit(ctx context.Context, r *AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.cli.CreateInOrder(ctx, a.dir, string(data), &etcd.CreateInOrderOptions{TTL: a.ttl})
+	return err
+}
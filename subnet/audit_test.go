@@ -0,0 +1,149 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+type recordingAuditor struct {
+	records []*AuditRecord
+}
+
+func (a *recordingAuditor) Audit(ctx context.Context, r *AuditRecord) error {
+	a.records = append(a.records, r)
+	return nil
+}
+
+func TestAuditManager(t *testing.T) {
+	msr := newDummyRegistry()
+	a := &recordingAuditor{}
+	sm := NewAuditManager(NewMockManager(msr), a)
+	ctx := WithActor(context.Background(), "node1")
+
+	attrs := LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := sm.AcquireLease(ctx, "_", &attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if err := sm.RenewLease(ctx, "_", l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if err := sm.RevokeLease(context.Background(), "_", l.Subnet); err != nil {
+		t.Fatalf("RevokeLease failed: %v", err)
+	}
+
+	expected := []string{AuditLeaseAcquired, AuditLeaseRenewed, AuditLeaseRevoked}
+	if len(a.records) != len(expected) {
+		t.Fatalf("expected %v records, got %v", len(expected), len(a.records))
+	}
+	for i, r := range a.records {
+		if r.Event != expected[i] {
+			t.Errorf("record %v: expected event %v, got %v", i, expected[i], r.Event)
+		}
+		if r.Subnet == nil || !r.Subnet.Equal(l.Subnet) {
+			t.Errorf("record %v: expected subnet %v, got %v", i, l.Subnet, r.Subnet)
+		}
+		if r.Error != "" {
+			t.Errorf("record %v: unexpected error %v", i, r.Error)
+		}
+	}
+	if a.records[0].Actor != "node1" {
+		t.Errorf("expected actor node1, got %q", a.records[0].Actor)
+	}
+	if a.records[2].Actor != a.records[2].Host {
+		t.Errorf("expected the host as actor without WithActor, got %q", a.records[2].Actor)
+	}
+}
+
+func TestAuditConfigChange(t *testing.T) {
+	msr := newDummyRegistry()
+	a := &recordingAuditor{}
+	sm := NewAuditManager(NewMockManager(msr), a)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := sm.GetNetworkConfig(ctx, "_"); err != nil {
+			t.Fatalf("GetNetworkConfig failed: %v", err)
+		}
+	}
+	if len(a.records) != 0 {
+		t.Fatalf("unchanged config was recorded: %v", a.records)
+	}
+
+	if err := msr.setConfig("_", `{ "Network": "10.4.0.0/16" }`); err != nil {
+		t.Fatalf("setConfig failed: %v", err)
+	}
+	if _, err := sm.GetNetworkConfig(ctx, "_"); err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	if len(a.records) != 1 || a.records[0].Event != AuditConfigChanged || a.records[0].Config.Network.String() != "10.4.0.0/16" {
+		t.Errorf("config change was not recorded: %v", a.records)
+	}
+}
+
+func TestFileAuditor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		a, err := NewFileAuditor(path)
+		if err != nil {
+			t.Fatalf("NewFileAuditor failed: %v", err)
+		}
+		if err := a.Audit(context.Background(), &AuditRecord{Event: AuditLeaseRevoked, Actor: "node1"}); err != nil {
+			t.Fatalf("Audit failed: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	for s := bufio.NewScanner(f); s.Scan(); n++ {
+		r := AuditRecord{}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil || r.Event != AuditLeaseRevoked {
+			t.Errorf("bad record %q: %v", s.Text(), err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 records appended, got %v", n)
+	}
+}
+
+func TestEtcdAuditorPrefix(t *testing.T) {
+	cfg := &EtcdConfig{Prefix: "/coreos.com/network"}
+	for _, p := range []string{"/coreos.com/network", "/coreos.com/network/audit"} {
+		if _, err := NewEtcdAuditor(cfg, p, 0); err == nil {
+			t.Errorf("NewEtcdAuditor accepted prefix %v", p)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// CapacityParams describe how the number of nodes of a network evolves, for
+// SimulateCapacity.
+type CapacityParams struct {
+	// Nodes join at the start, in addition to the hosts of the leases
+	Nodes int
+	// Growth is the number of nodes added per day
+	Growth float64
+	// Churn is the number of nodes replaced per day: one goes away and
+	// a new one joins
+	Churn float64
+	// Release is set if the nodes going away revoke their leases, as
+	// with --release-lease-on-exit; otherwise the leases remain until
+	// they expire
+	Release bool
+	Days    int
+	// TTL is that of the leases, 0 for the one of flanneld
+	TTL  time.Duration
+	Seed int64
+}
+
+// CapacityDay is the state of the pool at the end of a simulated day.
+type CapacityDay struct {
+	Day int
+	// Nodes is the number of nodes holding a lease
+	Nodes int
+	// Leases includes reservations and the leases of the nodes which
+	// went away, until they expire
+	Leases int
+	Free   int
+	// FreeRuns is the number of runs of consecutive free subnets, and
+	// LargestRun the length of the longest one
+	FreeRuns   int
+	LargestRun int
+	// Waiting is the number of nodes which found no free subnet
+	Waiting int
+}
+
+// CapacityReport is the result of SimulateCapacity.
+type CapacityReport struct {
+	// Capacity is the number of subnets between SubnetMin and SubnetMax
+	Capacity int
+	Days     []CapacityDay
+	// Exhausted is the first day on which a node found no free subnet,
+	// or -1
+	Exhausted int
+}
+
+// SimulateCapacity runs the allocator of AcquireLease hour by hour over
+// p.Days, starting from leases, to tell when the pool of config runs out.
+// The hosts of the leases which expire count as nodes; reservations stay
+// taken.
+func SimulateCapacity(config *Config, leases []Lease, p CapacityParams) *CapacityReport {
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = subnetTTL
+	}
+	rnd := rand.New(rand.NewSource(p.Seed))
+	randInt := func(lo, hi int) int { return lo + rnd.Intn(hi-lo) }
+
+	// the leases of SubnetLen, and among them those of the nodes which
+	// went away with their expiration
+	taken := map[ip.IP4Net]bool{}
+	expiring := map[ip.IP4Net]time.Time{}
+	// leases of another length, from an earlier config
+	others := []ip.IP4Net{}
+	nodes := []ip.IP4Net{}
+	for _, l := range leases {
+		if l.Subnet.PrefixLen != config.SubnetLen {
+			others = append(others, l.Subnet)
+			continue
+		}
+		taken[l.Subnet] = true
+		if !l.Expiration.IsZero() {
+			nodes = append(nodes, l.Subnet)
+		}
+	}
+
+	isTaken := func(sn ip.IP4Net) bool {
+		if taken[sn] {
+			return true
+		}
+		for _, o := range others {
+			if sn.Overlaps(o) {
+				return true
+			}
+		}
+		return false
+	}
+
+	r := &CapacityReport{Exhausted: -1}
+	for sn := (ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}); sn.IP <= config.SubnetMax; sn = sn.Next() {
+		r.Capacity++
+	}
+
+	// the number of nodes which joined and left by the end of each hour,
+	// computed from the start so that no fraction is lost
+	var joined, left int
+	count := func(hours int, perDay float64) int {
+		return int(float64(hours)*perDay/24 + 1e-9)
+	}
+
+	var now time.Time
+	waiting := p.Nodes
+	for day := 1; day <= p.Days; day++ {
+		exhausted := false
+		for h := 0; h < 24; h++ {
+			now = now.Add(time.Hour)
+			hours := (day-1)*24 + h + 1
+			for sn, exp := range expiring {
+				if !exp.After(now) {
+					delete(taken, sn)
+					delete(expiring, sn)
+				}
+			}
+
+			for n := count(hours, p.Churn); left < n && len(nodes) > 0; left++ {
+				i := rnd.Intn(len(nodes))
+				if p.Release {
+					delete(taken, nodes[i])
+				} else {
+					expiring[nodes[i]] = now.Add(ttl)
+				}
+				nodes[i] = nodes[len(nodes)-1]
+				nodes = nodes[:len(nodes)-1]
+			}
+
+			n := count(hours, p.Growth+p.Churn)
+			waiting += n - joined
+			joined = n
+			for ; waiting > 0; waiting-- {
+				sn, err := pickSubnet(config, isTaken, randInt)
+				if err != nil {
+					exhausted = true
+					break
+				}
+				taken[sn] = true
+				nodes = append(nodes, sn)
+			}
+		}
+
+		d := CapacityDay{Day: day, Nodes: len(nodes), Leases: len(taken) + len(others), Waiting: waiting}
+		run := 0
+		for sn := (ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}); sn.IP <= config.SubnetMax; sn = sn.Next() {
+			if isTaken(sn) {
+				run = 0
+				continue
+			}
+			d.Free++
+			if run++; run == 1 {
+				d.FreeRuns++
+			}
+			if run > d.LargestRun {
+				d.LargestRun = run
+			}
+		}
+		r.Days = append(r.Days, d)
+
+		if exhausted && r.Exhausted < 0 {
+			r.Exhausted = day
+		}
+	}
+	return r
+}
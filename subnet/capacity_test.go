@@ -0,0 +1,72 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func TestSimulateCapacity(t *testing.T) {
+	// 10.5.1.0 ... 10.5.15.0, 15 subnets
+	config, err := ParseConfig(`{ "Network": "10.5.0.0/20" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := []Lease{
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.5.3.0"), PrefixLen: 24}, Expiration: time.Now()},
+		// a reservation
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.5.4.0"), PrefixLen: 24}},
+	}
+
+	r := SimulateCapacity(config, leases, CapacityParams{Nodes: 5, Growth: 1, Days: 10, Seed: 1})
+	if r.Capacity != 15 || len(r.Days) != 10 {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+	// 6 nodes and the reservation on day 1, then one more node a day
+	if d := r.Days[0]; d.Nodes != 7 || d.Leases != 8 || d.Free != 7 {
+		t.Errorf("unexpected day 1: %+v", d)
+	}
+	if r.Exhausted != 9 {
+		t.Errorf("expected the pool to run out on day 9, got %v", r.Exhausted)
+	}
+	if d := r.Days[9]; d.Nodes != 14 || d.Free != 0 || d.Waiting != 2 {
+		t.Errorf("unexpected day 10: %+v", d)
+	}
+}
+
+func TestSimulateCapacityChurn(t *testing.T) {
+	config, err := ParseConfig(`{ "Network": "10.5.0.0/20" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each node replaced every day keeps two leases taken until the old
+	// one expires
+	p := CapacityParams{Nodes: 5, Churn: 5, Days: 5, Seed: 1}
+	r := SimulateCapacity(config, nil, p)
+	if d := r.Days[4]; d.Nodes != 5 || d.Leases != 10 || r.Exhausted != -1 {
+		t.Errorf("unexpected day 5: %+v", d)
+	}
+
+	// unless the leases are released
+	p.Release = true
+	r = SimulateCapacity(config, nil, p)
+	if d := r.Days[4]; d.Nodes != 5 || d.Leases != 5 {
+		t.Errorf("unexpected day 5 with released leases: %+v", d)
+	}
+}
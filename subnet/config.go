@@ -18,17 +18,31 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/coreos/flannel/pkg/ip"
 )
 
+// minMTU is the smallest packet every IPv4 host has to take.
+const minMTU = 576
+
 type Config struct {
 	Network     ip.IP4Net
 	SubnetMin   ip.IP4
 	SubnetMax   ip.IP4
 	SubnetLen   uint
+	NoMasqCIDRs []ip.IP4Net     `json:",omitempty"`
+	IPv6Network *ip.IP6Net      `json:",omitempty"`
 	BackendType string          `json:"-"`
 	Backend     json.RawMessage `json:",omitempty"`
+
+	// EgressBandwidth limits the traffic to each other subnet, see
+	// ParseBandwidth
+	EgressBandwidth string `json:",omitempty"`
+	// MTU overrides the MTU derived from the external interface, when the
+	// path between the hosts takes less
+	MTU int `json:",omitempty"`
 }
 
 func parseBackendType(be json.RawMessage) (string, error) {
@@ -85,6 +99,22 @@ func ParseConfig(s string) (*Config, error) {
 		return nil, errors.New("SubnetMax is not in the range of the Network")
 	}
 
+	for _, n := range cfg.NoMasqCIDRs {
+		if n.Overlaps(cfg.Network) {
+			return nil, fmt.Errorf("NoMasqCIDRs entry %v overlaps the Network", n)
+		}
+	}
+
+	if cfg.MTU != 0 && cfg.MTU < minMTU {
+		return nil, fmt.Errorf("invalid MTU %v, expected %v at least", cfg.MTU, minMTU)
+	}
+
+	if cfg.EgressBandwidth != "" {
+		if _, err := ParseBandwidth(cfg.EgressBandwidth); err != nil {
+			return nil, fmt.Errorf("invalid EgressBandwidth: %v", err)
+		}
+	}
+
 	bt, err := parseBackendType(cfg.Backend)
 	if err != nil {
 		return nil, err
@@ -93,3 +123,29 @@ func ParseConfig(s string) (*Config, error) {
 
 	return cfg, nil
 }
+
+var bandwidthUnits = []struct {
+	suffix string
+	bits   uint64
+}{
+	// the longest suffixes first, as they end with the shorter ones
+	{"kbit", 1e3}, {"mbit", 1e6}, {"gbit", 1e9}, {"tbit", 1e12}, {"bit", 1},
+}
+
+// ParseBandwidth parses a bandwidth in bits per second as tc(8) writes
+// them, e.g. "100mbit": a number followed by bit, kbit, mbit, gbit or tbit,
+// the multiples being powers of 1000.
+func ParseBandwidth(s string) (uint64, error) {
+	ls := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range bandwidthUnits {
+		if !strings.HasSuffix(ls, u.suffix) {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSuffix(ls, u.suffix), 64)
+		if err != nil || v <= 0 || v*float64(u.bits) < 1 {
+			break
+		}
+		return uint64(v * float64(u.bits)), nil
+	}
+	return 0, fmt.Errorf("invalid bandwidth %q, expected e.g. 100mbit", s)
+}
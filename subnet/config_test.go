@@ -15,6 +15,7 @@
 package subnet
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -69,3 +70,63 @@ func TestConfigOverrides(t *testing.T) {
 		t.Errorf("SubnetLen mismatch: expected 28, got %d", cfg.SubnetLen)
 	}
 }
+
+func TestConfigNoMasqCIDRs(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "NoMasqCIDRs": ["192.168.0.0/16", "172.16.1.0/24"] }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if len(cfg.NoMasqCIDRs) != 2 || cfg.NoMasqCIDRs[1].String() != "172.16.1.0/24" {
+		t.Errorf("NoMasqCIDRs mismatch: got %v", cfg.NoMasqCIDRs)
+	}
+
+	s = `{ "Network": "10.3.0.0/16", "NoMasqCIDRs": ["10.0.0.0/8"] }`
+	if _, err := ParseConfig(s); err == nil {
+		t.Errorf("ParseConfig accepted NoMasqCIDRs overlapping the Network")
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want uint64
+	}{
+		{"100mbit", 100e6},
+		{"1.5Gbit", 15e8},
+		{"800kbit", 800e3},
+		{"9600bit", 9600},
+	} {
+		if got, err := ParseBandwidth(tc.s); err != nil || got != tc.want {
+			t.Errorf("ParseBandwidth(%q) = %v, %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "100", "mbit", "-1mbit", "100mb", "0.5bit"} {
+		if _, err := ParseBandwidth(s); err == nil {
+			t.Errorf("ParseBandwidth(%q) succeeded", s)
+		}
+	}
+
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "EgressBandwidth": "fast" }`); err == nil {
+		t.Errorf("ParseConfig accepted an invalid EgressBandwidth")
+	}
+}
+
+func TestConfigMTU(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16", "MTU": 1400 }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.MTU != 1400 {
+		t.Errorf("expected MTU 1400, got %v", cfg.MTU)
+	}
+
+	for _, mtu := range []int{-1, 100, 575} {
+		if _, err := ParseConfig(fmt.Sprintf(`{ "Network": "10.3.0.0/16", "MTU": %d }`, mtu)); err == nil {
+			t.Errorf("ParseConfig accepted MTU %v", mtu)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+type confiningManager struct {
+	Manager
+	within ip.IP4Net
+}
+
+// NewConfiningManager wraps sm, e.g. the flannel server of a privileged
+// client, to refuse the network configs whose Network is not within within
+// and drop the leases outside it, so that sm cannot have us route anything
+// else.
+func NewConfiningManager(sm Manager, within ip.IP4Net) Manager {
+	return &confiningManager{sm, within}
+}
+
+func (m *confiningManager) contains(sn ip.IP4Net) bool {
+	return sn.PrefixLen >= m.within.PrefixLen && m.within.Contains(sn.IP)
+}
+
+func (m *confiningManager) GetNetworkConfig(ctx context.Context, network string) (*Config, error) {
+	config, err := m.Manager.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	if !m.contains(config.Network) {
+		return nil, fmt.Errorf("network %v of the config is not within %v", config.Network, m.within)
+	}
+	return config, nil
+}
+
+func (m *confiningManager) AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error) {
+	l, err := m.Manager.AcquireLease(ctx, network, attrs)
+	if err != nil {
+		return nil, err
+	}
+	if !m.contains(l.Subnet) {
+		return nil, fmt.Errorf("acquired subnet %v is not within %v", l.Subnet, m.within)
+	}
+	return l, nil
+}
+
+// RenewLease renews a copy of lease, which only replaces lease if the
+// wrapped manager kept its subnet, so that sm cannot move us elsewhere.
+func (m *confiningManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
+	renewed := *lease
+	if err := m.Manager.RenewLease(ctx, network, &renewed); err != nil {
+		return err
+	}
+	if !renewed.Subnet.Equal(lease.Subnet) || !m.contains(renewed.Subnet) {
+		return fmt.Errorf("renewed subnet %v is not the lease of %v within %v", renewed.Subnet, lease.Subnet, m.within)
+	}
+	*lease = renewed
+	return nil
+}
+
+// confine returns wr without the leases outside of the network. It copies
+// them rather than filter in place, as the slices of wr may be shared with
+// other holders of the result of the wrapped manager.
+func (m *confiningManager) confine(wr LeaseWatchResult) LeaseWatchResult {
+	if wr.Events != nil {
+		events := make([]Event, 0, len(wr.Events))
+		for _, evt := range wr.Events {
+			if !m.contains(evt.Lease.Subnet) {
+				log.Warningf("Ignoring lease of %v, which is not within %v", evt.Lease.Subnet, m.within)
+				continue
+			}
+			events = append(events, evt)
+		}
+		wr.Events = events
+	}
+
+	if wr.Snapshot != nil {
+		snapshot := make([]Lease, 0, len(wr.Snapshot))
+		for _, l := range wr.Snapshot {
+			if !m.contains(l.Subnet) {
+				log.Warningf("Ignoring lease of %v, which is not within %v", l.Subnet, m.within)
+				continue
+			}
+			snapshot = append(snapshot, l)
+		}
+		wr.Snapshot = snapshot
+	}
+	return wr
+}
+
+func (m *confiningManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	wr, err := m.Manager.WatchLease(ctx, network, sn, cursor)
+	return m.confine(wr), err
+}
+
+func (m *confiningManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error) {
+	wr, err := m.Manager.WatchLeases(ctx, network, cursor)
+	return m.confine(wr), err
+}
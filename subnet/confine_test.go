@@ -0,0 +1,99 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// movingManager renews every lease with another subnet.
+type movingManager struct {
+	Manager
+	to ip.IP4Net
+}
+
+func (m *movingManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
+	lease.Subnet = m.to
+	return nil
+}
+
+func TestConfiningManager(t *testing.T) {
+	attrs := LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1")}
+	subnets := []Lease{
+		{ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}, attrs, time.Time{}, 10},
+		// a lease the server should not have handed out
+		{ip.IP4Net{IP: ip.MustParseIP4("192.168.0.0"), PrefixLen: 16}, attrs, time.Time{}, 11},
+	}
+	msr := NewMockRegistry("_", `{ "Network": "10.3.0.0/16" }`, subnets)
+	ctx := context.Background()
+
+	sm := NewConfiningManager(NewMockManager(msr), ip.IP4Net{IP: ip.MustParseIP4("10.0.0.0"), PrefixLen: 8})
+	if _, err := sm.GetNetworkConfig(ctx, "_"); err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "_", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Snapshot) != 1 || wr.Snapshot[0].Subnet.String() != "10.3.1.0/24" {
+		t.Errorf("expected only the lease of 10.3.1.0/24, got %v", wr.Snapshot)
+	}
+
+	// the slices of the wrapped manager's result are left alone
+	shared := []Lease{subnets[1], subnets[0]}
+	sm.(*confiningManager).confine(LeaseWatchResult{Snapshot: shared})
+	if shared[0].Subnet != subnets[1].Subnet || shared[1].Subnet != subnets[0].Subnet {
+		t.Errorf("confine changed the leases of the wrapped manager to %v", shared)
+	}
+
+	narrow := NewConfiningManager(NewMockManager(msr), ip.IP4Net{IP: ip.MustParseIP4("10.3.0.0"), PrefixLen: 20})
+	if _, err := narrow.GetNetworkConfig(ctx, "_"); err == nil {
+		t.Errorf("a network config beyond the confinement was accepted")
+	}
+}
+
+func TestConfiningManagerRenewLease(t *testing.T) {
+	within := ip.IP4Net{IP: ip.MustParseIP4("10.3.0.0"), PrefixLen: 16}
+	own := ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}
+	ctx := context.Background()
+
+	for _, to := range []ip.IP4Net{
+		// outside of the confinement
+		{IP: ip.MustParseIP4("192.168.0.0"), PrefixLen: 24},
+		// within it, but not our subnet
+		{IP: ip.MustParseIP4("10.3.2.0"), PrefixLen: 24},
+	} {
+		sm := NewConfiningManager(&movingManager{to: to}, within)
+		l := &Lease{Subnet: own}
+		if err := sm.RenewLease(ctx, "_", l); err == nil {
+			t.Errorf("a renewal to %v was accepted", to)
+		}
+		if !l.Subnet.Equal(own) {
+			t.Errorf("a rejected renewal moved the lease to %v", l.Subnet)
+		}
+	}
+
+	sm := NewConfiningManager(&movingManager{to: own}, within)
+	l := &Lease{Subnet: own}
+	if err := sm.RenewLease(ctx, "_", l); err != nil {
+		t.Errorf("RenewLease failed: %v", err)
+	}
+}
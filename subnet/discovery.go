@@ -0,0 +1,162 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// DefaultDiscoveryInterval is how often the SRV records of
+// EtcdConfig.DiscoverySRV are resolved again unless configured.
+const DefaultDiscoveryInterval = time.Minute
+
+var (
+	// indirection for testing
+	lookupSRV = net.LookupSRV
+
+	// the discoveries by domain, shared by the etcd clients of the process
+	discoveryMux sync.Mutex
+	discoveries  = map[string]*etcdDiscovery{}
+)
+
+// etcdDiscovery resolves the client URLs of an etcd cluster from the SRV
+// records of its domain, as etcd does, and keeps them up to date.
+type etcdDiscovery struct {
+	domain   string
+	interval time.Duration
+
+	mux       sync.Mutex
+	endpoints []string
+	resolved  time.Time
+	resolving bool
+}
+
+func discoveryOf(domain string, interval time.Duration) *etcdDiscovery {
+	discoveryMux.Lock()
+	defer discoveryMux.Unlock()
+
+	d, ok := discoveries[domain]
+	if !ok {
+		if interval <= 0 {
+			interval = DefaultDiscoveryInterval
+		}
+		d = &etcdDiscovery{domain: domain, interval: interval}
+		discoveries[domain] = d
+	}
+	return d
+}
+
+// Endpoints returns the endpoints last resolved, resolving them first if
+// they never were. Once they are older than the interval they are resolved
+// again in the background; a failed resolution keeps the previous ones.
+func (d *etcdDiscovery) Endpoints() ([]string, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.endpoints == nil {
+		eps, err := resolveEtcdSRV(d.domain)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Discovered the etcd endpoints %v from the SRV records of %v", strings.Join(eps, ","), d.domain)
+		d.endpoints, d.resolved = eps, time.Now()
+	}
+
+	if time.Since(d.resolved) >= d.interval && !d.resolving {
+		d.resolving = true
+		go d.refresh()
+	}
+	return d.endpoints, nil
+}
+
+func (d *etcdDiscovery) refresh() {
+	eps, err := resolveEtcdSRV(d.domain)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.resolving = false
+	d.resolved = time.Now()
+	switch {
+	case err != nil:
+		log.Warningf("Failed to resolve the etcd endpoints of %v again, keeping %v: %v", d.domain, strings.Join(d.endpoints, ","), err)
+	case !sameEndpoints(eps, d.endpoints):
+		log.Infof("etcd endpoints of %v changed from %v to %v", d.domain, strings.Join(d.endpoints, ","), strings.Join(eps, ","))
+		d.endpoints = eps
+	}
+}
+
+// resolveEtcdSRV looks up the _etcd-client-ssl._tcp and _etcd-client._tcp
+// SRV records of domain for the https and http client URLs of its etcd
+// cluster.
+func resolveEtcdSRV(domain string) ([]string, error) {
+	eps := []string{}
+	errs := []string{}
+	for _, s := range []struct{ service, scheme string }{
+		{"etcd-client-ssl", "https"},
+		{"etcd-client", "http"},
+	} {
+		_, addrs, err := lookupSRV(s.service, "tcp", domain)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, srv := range addrs {
+			u := url.URL{
+				Scheme: s.scheme,
+				Host:   net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port)),
+			}
+			eps = append(eps, u.String())
+		}
+	}
+
+	if len(eps) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("failed to discover the etcd endpoints of %v: %v", domain, strings.Join(errs, "; "))
+		}
+		return nil, fmt.Errorf("failed to discover the etcd endpoints of %v: no SRV records", domain)
+	}
+	sort.Strings(eps)
+	return eps, nil
+}
+
+func sameEndpoints(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// endpoints returns the endpoints of the etcd cluster, discovered if
+// DiscoverySRV is set.
+func (c *EtcdConfig) endpoints() ([]string, error) {
+	if c.DiscoverySRV == "" {
+		return c.Endpoints, nil
+	}
+	return discoveryOf(c.DiscoverySRV, c.DiscoveryInterval).Endpoints()
+}
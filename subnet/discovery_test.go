@@ -0,0 +1,104 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSRV serves the SRV records of example.com from records, by service.
+type fakeSRV struct {
+	mux     sync.Mutex
+	records map[string][]*net.SRV
+}
+
+func (f *fakeSRV) lookup(service, proto, name string) (string, []*net.SRV, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	addrs, ok := f.records[service]
+	if !ok || name != "example.com" {
+		return "", nil, fmt.Errorf("no such host")
+	}
+	return fmt.Sprintf("_%v._%v.%v.", service, proto, name), addrs, nil
+}
+
+func (f *fakeSRV) set(service string, addrs ...*net.SRV) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.records[service] = addrs
+}
+
+func TestEtcdDiscovery(t *testing.T) {
+	f := &fakeSRV{records: map[string][]*net.SRV{}}
+	lookupSRV = f.lookup
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	cfg := &EtcdConfig{Endpoints: []string{"http://127.0.0.1:2379"}, DiscoverySRV: "example.com", DiscoveryInterval: time.Hour}
+	if _, err := cfg.endpoints(); err == nil {
+		t.Fatalf("expected discovery without any SRV records to fail")
+	}
+
+	f.set("etcd-client-ssl", &net.SRV{Target: "etcd2.example.com.", Port: 2379}, &net.SRV{Target: "etcd1.example.com.", Port: 2379})
+	f.set("etcd-client", &net.SRV{Target: "etcd3.example.com.", Port: 4001})
+	eps, err := cfg.endpoints()
+	if err != nil {
+		t.Fatalf("endpoints failed: %v", err)
+	}
+	expected := "http://etcd3.example.com:4001,https://etcd1.example.com:2379,https://etcd2.example.com:2379"
+	if got := strings.Join(eps, ","); got != expected {
+		t.Errorf("expected endpoints %v, got %v", expected, got)
+	}
+
+	// once the interval has passed, the records are resolved again in
+	// the background while the previous endpoints are still returned
+	d := discoveryOf("example.com", 0)
+	f.set("etcd-client-ssl")
+	f.set("etcd-client", &net.SRV{Target: "etcd4.example.com.", Port: 2379})
+	d.mux.Lock()
+	d.resolved = time.Now().Add(-2 * time.Hour)
+	d.mux.Unlock()
+	if eps, _ := cfg.endpoints(); strings.Join(eps, ",") != expected {
+		t.Errorf("expected the previous endpoints until resolved again, got %v", eps)
+	}
+
+	expected = "http://etcd4.example.com:2379"
+	for i := 0; ; i++ {
+		eps, _ := cfg.endpoints()
+		if strings.Join(eps, ",") == expected {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected endpoints %v, got %v", expected, eps)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// failures keep the endpoints
+	f.set("etcd-client")
+	d.mux.Lock()
+	d.resolved = time.Now().Add(-2 * time.Hour)
+	d.mux.Unlock()
+	cfg.endpoints()
+	time.Sleep(50 * time.Millisecond)
+	if eps, _ := cfg.endpoints(); strings.Join(eps, ",") != expected {
+		t.Errorf("expected a failed resolution to keep %v, got %v", expected, eps)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subnet allocates the subnets of the hosts of flannel networks and
+// keeps track of them as leases in a registry, etcd or a flannel server.
+//
+// It is meant to be used by other programs too. A program embedding it
+// creates a Manager with NewLocalManager, over etcd, or
+// remote.NewRemoteManager, over a flannel server, acquires a lease for the
+// host with AcquireLease, renews it before it expires and follows the leases
+// of the other hosts with WatchLeases:
+//
+//	sm, err := subnet.NewLocalManager(&subnet.EtcdConfig{
+//		Endpoints: []string{"http://127.0.0.1:2379"},
+//		Prefix:    "/coreos.com/network",
+//	})
+//	...
+//	l, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: ip.FromIP(addr)})
+//	...
+//	events := make(chan []subnet.Event)
+//	go subnet.WatchLeases(ctx, sm, "", l, events)
+//
+// The network name is "" unless the registry holds several networks. All
+// calls take a context and return once it is done; the package registers no
+// flags and logs through pkg/log.
+//
+// Package subnettest provides an in-memory Manager for the tests of such
+// programs.
+package subnet
@@ -0,0 +1,163 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/qos"
+	"github.com/coreos/flannel/subnet"
+)
+
+// client implements Driver with requests to the API of Handler.
+type client struct {
+	base   string
+	client *http.Client
+}
+
+// NewClient returns the Driver served at addr, an http:// or https:// URL
+// or unix:///path for a driver on a unix socket. The TLS files are used
+// with https.
+func NewClient(addr, cafile, certfile, keyfile string) (Driver, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the driver address: %v", err)
+	}
+
+	t := &http.Transport{
+		Dial: qos.Dialer().Dial,
+	}
+	switch u.Scheme {
+	case "http":
+	case "https":
+		info := transport.TLSInfo{CAFile: cafile, CertFile: certfile, KeyFile: keyfile}
+		if t.TLSClientConfig, err = info.ClientConfig(); err != nil {
+			return nil, err
+		}
+		fips.ConfigureTLS(t.TLSClientConfig)
+	case "unix":
+		socket := u.Path
+		t.Dial = func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
+		u = &url.URL{Scheme: "http", Host: "driver"}
+	default:
+		return nil, fmt.Errorf("unsupported driver address %q, expected http://, https:// or unix://", addr)
+	}
+
+	return &client{
+		base:   strings.TrimSuffix(u.String(), "/") + "/v1",
+		client: &http.Client{Transport: t},
+	}, nil
+}
+
+func (c *client) mkurl(network string, parts ...string) string {
+	if network == "" {
+		network = "_"
+	}
+	return c.base + "/" + path.Join(append([]string{network}, parts...)...)
+}
+
+// do sends the request and decodes the JSON response into v.
+func (c *client) do(ctx context.Context, method, url string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := ctxhttp.Do(ctx, c.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v %v: %v: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(b))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *client) GetNetworkConfig(ctx context.Context, network string) (string, error) {
+	cfg := json.RawMessage{}
+	if err := c.do(ctx, "GET", c.mkurl(network, "config"), nil, &cfg); err != nil {
+		return "", err
+	}
+	return string(cfg), nil
+}
+
+func (c *client) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	l := &subnet.Lease{}
+	if err := c.do(ctx, "POST", c.mkurl(network, "leases"), attrs, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (c *client) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	l := &subnet.Lease{}
+	if err := c.do(ctx, "PUT", c.mkurl(network, "leases", lease.Key()), lease, l); err != nil {
+		return err
+	}
+	*lease = *l
+	return nil
+}
+
+func (c *client) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	return c.do(ctx, "DELETE", c.mkurl(network, "leases", subnet.MakeSubnetKey(sn)), nil, nil)
+}
+
+func (c *client) WatchLeases(ctx context.Context, network, version string) ([]subnet.Lease, string, error) {
+	u := c.mkurl(network, "leases")
+	if version != "" {
+		u += "?version=" + url.QueryEscape(version)
+	}
+
+	wr := leasesResponse{}
+	if err := c.do(ctx, "GET", u, nil, &wr); err != nil {
+		return nil, "", err
+	}
+	return wr.Leases, wr.Version, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package driver lets flannel use an external store, such as the IPAM or
+// inventory system of an organization, as its registry. The store is
+// reached through a registry driver: a process serving the small HTTP API
+// of Handler, which is all it has to implement. flanneld talks to it with
+// NewClient and NewManager in place of etcd.
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// Driver is the registry driver. The network is "" in single network mode.
+type Driver interface {
+	// GetNetworkConfig returns the config of the network, in the JSON
+	// flannel keeps in etcd.
+	GetNetworkConfig(ctx context.Context, network string) (string, error)
+	// AcquireLease returns the lease of the host with attrs.PublicIP,
+	// updated with attrs, or else a new one.
+	AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error)
+	// RenewLease stores the attributes of lease and extends it, updating
+	// its Expiration.
+	RenewLease(ctx context.Context, network string, lease *subnet.Lease) error
+	RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error
+	// WatchLeases waits until the version of the leases of the network
+	// is no longer version and returns them with their new version. It
+	// returns them straight away if version is "".
+	WatchLeases(ctx context.Context, network, version string) ([]subnet.Lease, string, error)
+}
+
+var (
+	errNoNetworks    = errors.New("registry drivers do not list networks, run in single network mode")
+	errNoReservation = errors.New("registry drivers do not support reservations, make them in the store of the driver")
+)
+
+// manager implements subnet.Manager with a Driver. The leases are always
+// watched as snapshots, which the helpers of package subnet compare with
+// the ones before, so the driver only has to version them.
+type manager struct {
+	d Driver
+}
+
+// NewManager returns a subnet.Manager using d as the registry.
+func NewManager(d Driver) subnet.Manager {
+	return &manager{d}
+}
+
+// leaseCursor is the cursor of a watch of a single lease: the version of
+// the leases last seen and a hash of the lease then, "" if it did not
+// exist. It is a string, like the cursors the server of package remote
+// hands to its clients.
+func leaseCursor(version string, l *subnet.Lease) string {
+	if l == nil {
+		return version + ":"
+	}
+	b, _ := json.Marshal(l)
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf("%v:%x", version, h.Sum64())
+}
+
+func parseLeaseCursor(cursor interface{}) (version, hash string, err error) {
+	s, ok := cursor.(string)
+	i := strings.LastIndex(s, ":")
+	if !ok || i < 0 {
+		return "", "", fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+	return s[:i], s[i+1:], nil
+}
+
+func (m *manager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	cfg, err := m.d.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	return subnet.ParseConfig(cfg)
+}
+
+func (m *manager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	return m.d.AcquireLease(ctx, network, attrs)
+}
+
+func (m *manager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	return m.d.RenewLease(ctx, network, lease)
+}
+
+func (m *manager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	return m.d.RevokeLease(ctx, network, sn)
+}
+
+func (m *manager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if cursor == nil {
+		leases, version, err := m.d.WatchLeases(ctx, network, "")
+		if err != nil {
+			return subnet.LeaseWatchResult{}, err
+		}
+		l := findLease(leases, sn)
+		if l == nil {
+			return subnet.LeaseWatchResult{}, fmt.Errorf("lease %v not found", sn)
+		}
+		return subnet.LeaseWatchResult{
+			Snapshot: []subnet.Lease{*l},
+			Cursor:   leaseCursor(version, l),
+		}, nil
+	}
+
+	version, hash, err := parseLeaseCursor(cursor)
+	if err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+
+	// wait for a version in which the lease changed
+	for {
+		leases, next, err := m.d.WatchLeases(ctx, network, version)
+		if err != nil {
+			return subnet.LeaseWatchResult{}, err
+		}
+		l := findLease(leases, sn)
+		c := leaseCursor(next, l)
+		switch {
+		case l == nil && hash != "":
+			return subnet.LeaseWatchResult{
+				Events: []subnet.Event{{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: sn}}},
+				Cursor: c,
+			}, nil
+
+		case l != nil && !strings.HasSuffix(c, ":"+hash):
+			return subnet.LeaseWatchResult{
+				Events: []subnet.Event{{Type: subnet.EventAdded, Lease: *l}},
+				Cursor: c,
+			}, nil
+		}
+		version = next
+	}
+}
+
+func (m *manager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	version := ""
+	if cursor != nil {
+		var ok bool
+		if version, ok = cursor.(string); !ok {
+			return subnet.LeaseWatchResult{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+		}
+	}
+
+	leases, version, err := m.d.WatchLeases(ctx, network, version)
+	if err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+	if leases == nil {
+		leases = []subnet.Lease{}
+	}
+	return subnet.LeaseWatchResult{
+		Snapshot: leases,
+		Cursor:   version,
+	}, nil
+}
+
+func (m *manager) WatchNetworks(ctx context.Context, cursor interface{}) (subnet.NetworkWatchResult, error) {
+	return subnet.NetworkWatchResult{}, errNoNetworks
+}
+
+func (m *manager) AddReservation(ctx context.Context, network string, r *subnet.Reservation) error {
+	return errNoReservation
+}
+
+func (m *manager) RemoveReservation(ctx context.Context, network string, sn ip.IP4Net) error {
+	return errNoReservation
+}
+
+func (m *manager) ListReservations(ctx context.Context, network string) ([]subnet.Reservation, error) {
+	return nil, errNoReservation
+}
+
+func findLease(leases []subnet.Lease, sn ip.IP4Net) *subnet.Lease {
+	for i := range leases {
+		if leases[i].Subnet.Equal(sn) {
+			return &leases[i]
+		}
+	}
+	return nil
+}
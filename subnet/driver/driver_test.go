@@ -0,0 +1,224 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// memDriver keeps the leases of a single network in memory.
+type memDriver struct {
+	mux     sync.Mutex
+	leases  []subnet.Lease
+	version int
+	changed chan struct{}
+}
+
+func newMemDriver() *memDriver {
+	return &memDriver{changed: make(chan struct{}), version: 1}
+}
+
+func (d *memDriver) update(f func()) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	f()
+	d.version++
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *memDriver) GetNetworkConfig(ctx context.Context, network string) (string, error) {
+	if network != "" {
+		return "", fmt.Errorf("network %q not found", network)
+	}
+	return `{"Network": "10.5.0.0/16", "Backend": {"Type": "host-gw"}}`, nil
+}
+
+func (d *memDriver) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	var l subnet.Lease
+	d.update(func() {
+		l = subnet.Lease{
+			Subnet:     ip.IP4Net{IP: ip.MustParseIP4(fmt.Sprintf("10.5.%d.0", len(d.leases)+1)), PrefixLen: 24},
+			Attrs:      *attrs,
+			Expiration: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		}
+		d.leases = append(d.leases, l)
+	})
+	return &l, nil
+}
+
+func (d *memDriver) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	err := fmt.Errorf("lease %v not found", lease.Subnet)
+	d.update(func() {
+		for i := range d.leases {
+			if d.leases[i].Subnet.Equal(lease.Subnet) {
+				lease.Expiration = d.leases[i].Expiration.Add(time.Hour)
+				d.leases[i] = *lease
+				err = nil
+			}
+		}
+	})
+	return err
+}
+
+func (d *memDriver) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	d.update(func() {
+		for i := range d.leases {
+			if d.leases[i].Subnet.Equal(sn) {
+				d.leases = append(d.leases[:i], d.leases[i+1:]...)
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (d *memDriver) WatchLeases(ctx context.Context, network, version string) ([]subnet.Lease, string, error) {
+	for {
+		d.mux.Lock()
+		current, changed := strconv.Itoa(d.version), d.changed
+		leases := append([]subnet.Lease{}, d.leases...)
+		d.mux.Unlock()
+
+		if version != current {
+			return leases, current, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+}
+
+func testManager(t *testing.T, sm subnet.Manager) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg, err := sm.GetNetworkConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	if cfg.BackendType != "host-gw" || cfg.SubnetLen != 24 {
+		t.Errorf("GetNetworkConfig returned %+v", cfg)
+	}
+	if _, err := sm.GetNetworkConfig(ctx, "other"); err == nil {
+		t.Errorf("GetNetworkConfig of an unknown network succeeded")
+	}
+
+	own, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.0.2.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	events := make(chan []subnet.Event)
+	// only our own lease so far, which is left out
+	ownCopy := *own
+	go subnet.WatchLeases(ctx, sm, "", &ownCopy, events)
+
+	peer, err := sm.AcquireLease(ctx, "", &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.0.2.2")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if batch := <-events; len(batch) != 1 || batch[0].Type != subnet.EventAdded || !batch[0].Lease.Subnet.Equal(peer.Subnet) {
+		t.Errorf("WatchLeases returned %v, expected %v to be added", batch, peer.Subnet)
+	}
+
+	lease := make(chan subnet.Event)
+	go subnet.WatchLease(ctx, sm, "", own.Subnet, lease)
+	<-lease
+
+	exp := own.Expiration
+	if err := sm.RenewLease(ctx, "", own); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if !own.Expiration.After(exp) {
+		t.Errorf("RenewLease did not extend the lease: %v", own.Expiration)
+	}
+	if e := <-lease; e.Type != subnet.EventAdded || !e.Lease.Expiration.Equal(own.Expiration) {
+		t.Errorf("WatchLease returned %v, expected the renewed lease", e)
+	}
+
+	if err := sm.RevokeLease(ctx, "", peer.Subnet); err != nil {
+		t.Fatalf("RevokeLease failed: %v", err)
+	}
+	if batch := <-events; len(batch) != 1 || batch[0].Type != subnet.EventRemoved || !batch[0].Lease.Subnet.Equal(peer.Subnet) {
+		t.Errorf("WatchLeases returned %v, expected %v to be removed", batch, peer.Subnet)
+	}
+
+	if err := sm.RevokeLease(ctx, "", own.Subnet); err != nil {
+		t.Fatalf("RevokeLease failed: %v", err)
+	}
+	if e := <-lease; e.Type != subnet.EventRemoved || !e.Lease.Subnet.Equal(own.Subnet) {
+		t.Errorf("WatchLease returned %v, expected the lease to be removed", e)
+	}
+
+	if _, err := sm.ListReservations(ctx, ""); err == nil {
+		t.Errorf("ListReservations succeeded")
+	}
+}
+
+func TestManager(t *testing.T) {
+	testManager(t, NewManager(newMemDriver()))
+}
+
+func TestClient(t *testing.T) {
+	s := httptest.NewServer(Handler(context.Background(), newMemDriver()))
+	defer s.Close()
+
+	d, err := NewClient(s.URL, "", "", "")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	testManager(t, NewManager(d))
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "driver.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: Handler(context.Background(), newMemDriver())}
+	go s.Serve(l)
+	defer l.Close()
+
+	d, err := NewClient("unix://"+socket, "", "", "")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	testManager(t, NewManager(d))
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/subnet"
+)
+
+// leasesResponse is the response of GET /v1/{network}/leases.
+type leasesResponse struct {
+	Leases  []subnet.Lease
+	Version string
+}
+
+// Handler serves d with the API the clients of NewClient use, for writing a
+// registry driver in Go. Drivers in other languages implement it directly;
+// all requests and responses are JSON and errors are any other status than
+// 200 with a message as the body. The network is "_" in single network mode.
+//
+//	GET    /v1/{network}/config                the network config
+//	POST   /v1/{network}/leases                acquire a lease, for LeaseAttrs
+//	PUT    /v1/{network}/leases/{subnet}       renew a Lease
+//	DELETE /v1/{network}/leases/{subnet}       revoke a lease
+//	GET    /v1/{network}/leases?version=...    {"Leases": [...], "Version": "..."}
+//
+// The subnets in the paths are like 10.1.2.0-24. The leases are returned
+// once their version differs from the one given, or straight away without
+// one, so a watch is held open until they change. The requests are passed
+// to d with contexts derived from ctx, which end when the client goes away.
+func Handler(ctx context.Context, d Driver) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/{network}/config", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(ctx, w)
+		defer cancel()
+		cfg, err := d.GetNetworkConfig(ctx, network(r))
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, cfg)
+	}).Methods("GET")
+
+	r.HandleFunc("/v1/{network}/leases", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(ctx, w)
+		defer cancel()
+		attrs := &subnet.LeaseAttrs{}
+		if err := json.NewDecoder(r.Body).Decode(attrs); err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("JSON decoding error: %v", err))
+			return
+		}
+		l, err := d.AcquireLease(ctx, network(r), attrs)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		jsonResponse(w, l)
+	}).Methods("POST")
+
+	r.HandleFunc("/v1/{network}/leases/{subnet}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(ctx, w)
+		defer cancel()
+		l := &subnet.Lease{}
+		if err := json.NewDecoder(r.Body).Decode(l); err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("JSON decoding error: %v", err))
+			return
+		}
+		if sn := subnet.ParseSubnetKey(mux.Vars(r)["subnet"]); sn == nil || !sn.Equal(l.Subnet) {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("subnet of the lease does not match the path"))
+			return
+		}
+		if err := d.RenewLease(ctx, network(r), l); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		jsonResponse(w, l)
+	}).Methods("PUT")
+
+	r.HandleFunc("/v1/{network}/leases/{subnet}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(ctx, w)
+		defer cancel()
+		sn := subnet.ParseSubnetKey(mux.Vars(r)["subnet"])
+		if sn == nil {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("bad subnet"))
+			return
+		}
+		if err := d.RevokeLease(ctx, network(r), *sn); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/v1/{network}/leases", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := requestContext(ctx, w)
+		defer cancel()
+		leases, version, err := d.WatchLeases(ctx, network(r), r.URL.Query().Get("version"))
+		if err != nil {
+			if ctx.Err() == nil {
+				httpError(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		if leases == nil {
+			leases = []subnet.Lease{}
+		}
+		jsonResponse(w, leasesResponse{leases, version})
+	}).Methods("GET")
+
+	return r
+}
+
+// requestContext returns a context derived from ctx which is canceled once
+// the client of w goes away.
+func requestContext(ctx context.Context, w http.ResponseWriter) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+func network(r *http.Request) string {
+	if n := mux.Vars(r)["network"]; n != "_" {
+		return n
+	}
+	return ""
+}
+
+func jsonResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error JSON encoding response: %v", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	fmt.Fprint(w, err)
+}
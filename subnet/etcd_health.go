@@ -0,0 +1,295 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/coreos/flannel/pkg/fips"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/metrics"
+	"github.com/coreos/flannel/pkg/qos"
+)
+
+var (
+	etcdEndpointUp = metrics.NewGauge("flannel_etcd_endpoint_up",
+		"Whether the etcd endpoint answered the last health check.", "endpoint")
+	etcdEndpointHealthy = metrics.NewGauge("flannel_etcd_endpoint_healthy",
+		"Whether the etcd member at the endpoint reported itself healthy, in sync with the leader, at the last health check.", "endpoint")
+	etcdRaftIndex = metrics.NewGauge("flannel_etcd_raft_index",
+		"Raft index of the etcd member at the endpoint, as of the last health check.", "endpoint")
+	etcdHasLeader = metrics.NewGauge("flannel_etcd_has_leader",
+		"Whether the etcd members agreed on a leader at the last health check.")
+)
+
+// MemberHealth is the health of the etcd member at one of the endpoints.
+type MemberHealth struct {
+	Endpoint  string
+	Name      string `json:",omitempty"`
+	ID        string `json:",omitempty"`
+	Reachable bool
+	// Healthy is set when the member answers its /health endpoint with
+	// true, i.e. it is part of a cluster with a leader
+	Healthy bool
+	// Leader is the ID of the leader as seen by the member
+	Leader    string `json:",omitempty"`
+	RaftIndex uint64
+	Error     string `json:",omitempty"`
+}
+
+// ClusterHealth is the outcome of a health check of the etcd cluster.
+type ClusterHealth struct {
+	Time    time.Time
+	Members []MemberHealth
+	// Leader is the ID of the leader the members agree on, empty if
+	// there is none
+	Leader string
+	// Healthy is set when there is a leader and at least one healthy
+	// member to talk to; Problems may still list failed members
+	Healthy  bool
+	Problems []string
+}
+
+// Err returns an error listing the problems of an unhealthy cluster.
+func (h *ClusterHealth) Err() error {
+	if h.Healthy {
+		return nil
+	}
+	return fmt.Errorf("etcd cluster unhealthy: %v", strings.Join(h.Problems, "; "))
+}
+
+// EtcdHealthChecker checks the health of each configured etcd endpoint
+// like etcdctl cluster-health does: that it is reachable, that the member
+// considers itself healthy, that the members agree on a leader and that
+// their raft index keeps up with the leader's.
+type EtcdHealthChecker struct {
+	cfg    *EtcdConfig
+	client *http.Client
+
+	mux  sync.Mutex
+	last *ClusterHealth
+}
+
+// NewEtcdHealthChecker returns a checker of the endpoints of cfg, using the
+// same TLS settings and credentials as the registry.
+func NewEtcdHealthChecker(cfg *EtcdConfig) (*EtcdHealthChecker, error) {
+	t, err := transport.NewTransport(transport.TLSInfo{
+		CertFile: cfg.Certfile,
+		KeyFile:  cfg.Keyfile,
+		CAFile:   cfg.CAFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fips.ConfigureTLS(t.TLSClientConfig)
+	qos.ConfigureTransport(t)
+	return &EtcdHealthChecker{cfg: cfg, client: &http.Client{Transport: t, Timeout: 5 * time.Second}}, nil
+}
+
+// raftLagThreshold is how many raft entries a member may be behind the
+// leader before it is reported as not keeping up, allowing for the writes
+// between the requests of a single check.
+const raftLagThreshold = 1000
+
+// Check checks all endpoints and returns the result, which Last returns
+// from then on.
+func (c *EtcdHealthChecker) Check(ctx context.Context) *ClusterHealth {
+	h := &ClusterHealth{Time: time.Now()}
+
+	endpoints, err := c.cfg.endpoints()
+	if err != nil {
+		h.Problems = append(h.Problems, err.Error())
+	}
+	for _, ep := range endpoints {
+		h.Members = append(h.Members, c.checkMember(ctx, strings.TrimSuffix(ep, "/")))
+	}
+
+	leaders := map[string]bool{}
+	var leaderIndex uint64
+	healthy := 0
+	for _, m := range h.Members {
+		switch {
+		case !m.Reachable:
+			h.Problems = append(h.Problems, fmt.Sprintf("endpoint %v is unreachable: %v", m.Endpoint, m.Error))
+			continue
+		case !m.Healthy:
+			h.Problems = append(h.Problems, fmt.Sprintf("member %v at %v is unhealthy: %v", m.Name, m.Endpoint, m.Error))
+		default:
+			healthy++
+		}
+		if m.Leader != "" {
+			leaders[m.Leader] = true
+		}
+		if m.ID != "" && m.ID == m.Leader {
+			leaderIndex = m.RaftIndex
+		}
+	}
+
+	switch len(leaders) {
+	case 0:
+		h.Problems = append(h.Problems, "no member knows of a leader")
+	case 1:
+		for l := range leaders {
+			h.Leader = l
+		}
+	default:
+		h.Problems = append(h.Problems, "the members disagree on the leader, the cluster may be partitioned")
+	}
+
+	if leaderIndex > 0 {
+		for _, m := range h.Members {
+			if m.Reachable && m.RaftIndex+raftLagThreshold < leaderIndex {
+				h.Problems = append(h.Problems, fmt.Sprintf("member %v at %v is %v raft entries behind the leader", m.Name, m.Endpoint, leaderIndex-m.RaftIndex))
+			}
+		}
+	}
+
+	h.Healthy = h.Leader != "" && healthy > 0
+
+	c.mux.Lock()
+	c.last = h
+	c.mux.Unlock()
+	return h
+}
+
+// Last returns the result of the last check, nil before the first one.
+func (c *EtcdHealthChecker) Last() *ClusterHealth {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.last
+}
+
+func (c *EtcdHealthChecker) checkMember(ctx context.Context, ep string) MemberHealth {
+	m := MemberHealth{Endpoint: ep}
+
+	var health struct {
+		Health string `json:"health"`
+	}
+	if _, err := c.getJSON(ctx, ep+"/health", &health); err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	m.Reachable = true
+
+	var stats struct {
+		Name       string `json:"name"`
+		ID         string `json:"id"`
+		LeaderInfo struct {
+			Leader string `json:"leader"`
+		} `json:"leaderInfo"`
+	}
+	if _, err := c.getJSON(ctx, ep+"/v2/stats/self", &stats); err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	m.Name, m.ID, m.Leader = stats.Name, stats.ID, stats.LeaderInfo.Leader
+
+	// the keys API tells the raft index of the member in a header, even
+	// when the key does not exist
+	hdr, err := c.getJSON(ctx, ep+"/v2/keys"+path.Clean("/"+c.cfg.Prefix)+"?quorum=false", nil)
+	if err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	m.RaftIndex, _ = strconv.ParseUint(hdr.Get("X-Raft-Index"), 10, 64)
+
+	if m.Healthy = health.Health == "true"; !m.Healthy {
+		m.Error = "reports unhealthy, e.g. it lost its leader"
+	}
+	return m
+}
+
+// getJSON gets url and decodes the body into v, unless v is nil, and
+// returns the response headers. Error statuses other than 404 fail.
+func (c *EtcdHealthChecker) getJSON(ctx context.Context, url string, v interface{}) (http.Header, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if username, password := c.cfg.credentials(); username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := ctxhttp.Do(ctx, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return nil, fmt.Errorf("unexpected status %v from %v", resp.Status, url)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("failed to decode response from %v: %v", url, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// Run checks the cluster every interval until ctx is done, exporting the
+// results as metrics and logging the problems as they change.
+func (c *EtcdHealthChecker) Run(ctx context.Context, interval time.Duration) {
+	last := ""
+	for {
+		h := c.Check(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		for _, m := range h.Members {
+			etcdEndpointUp.Set(boolValue(m.Reachable), m.Endpoint)
+			etcdEndpointHealthy.Set(boolValue(m.Healthy), m.Endpoint)
+			etcdRaftIndex.Set(float64(m.RaftIndex), m.Endpoint)
+		}
+		etcdHasLeader.Set(boolValue(h.Leader != ""))
+
+		if problems := strings.Join(h.Problems, "\n"); problems != last {
+			switch {
+			case len(h.Problems) == 0:
+				log.Info("etcd cluster is healthy again")
+			case h.Healthy:
+				log.Warningf("etcd cluster is degraded but usable: %v", strings.Join(h.Problems, "; "))
+			default:
+				log.Errorf("etcd cluster is unhealthy: %v", strings.Join(h.Problems, "; "))
+			}
+			last = problems
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// fakeMember serves what the health checker asks an etcd member for.
+func fakeMember(name, id, leader string, raftIndex uint64, healthy bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/health":
+			fmt.Fprintf(w, `{"health": "%v"}`, healthy)
+		case r.URL.Path == "/v2/stats/self":
+			fmt.Fprintf(w, `{"name": %q, "id": %q, "leaderInfo": {"leader": %q}}`, name, id, leader)
+		case strings.HasPrefix(r.URL.Path, "/v2/keys/"):
+			w.Header().Set("X-Raft-Index", fmt.Sprint(raftIndex))
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestEtcdHealth(t *testing.T) {
+	leader := fakeMember("infra0", "a1", "a1", 5000, true)
+	defer leader.Close()
+	follower := fakeMember("infra1", "b2", "a1", 4990, true)
+	defer follower.Close()
+	lagging := fakeMember("infra2", "c3", "a1", 100, true)
+	defer lagging.Close()
+	dead := httptest.NewServer(nil)
+	dead.Close()
+
+	hc, err := NewEtcdHealthChecker(&EtcdConfig{
+		Endpoints: []string{leader.URL, follower.URL + "/", lagging.URL, dead.URL},
+		Prefix:    "/coreos.com/network",
+	})
+	if err != nil {
+		t.Fatalf("NewEtcdHealthChecker failed: %v", err)
+	}
+
+	h := hc.Check(context.Background())
+	if !h.Healthy || h.Err() != nil {
+		t.Fatalf("cluster with a leader reported unhealthy: %v", h.Err())
+	}
+	if h.Leader != "a1" {
+		t.Errorf("expected leader a1, got %q", h.Leader)
+	}
+	if hc.Last() != h {
+		t.Errorf("Last did not return the last check")
+	}
+
+	if len(h.Members) != 4 || !h.Members[1].Reachable || h.Members[1].RaftIndex != 4990 || h.Members[3].Reachable {
+		t.Errorf("unexpected members: %+v", h.Members)
+	}
+	if len(h.Problems) != 2 ||
+		!strings.Contains(h.Problems[0], "unreachable") ||
+		!strings.Contains(h.Problems[1], "infra2") || !strings.Contains(h.Problems[1], "4900 raft entries behind") {
+		t.Errorf("unexpected problems: %q", h.Problems)
+	}
+
+	noLeader := fakeMember("infra0", "a1", "", 5000, false)
+	defer noLeader.Close()
+	hc.cfg.Endpoints = []string{noLeader.URL, dead.URL}
+	h = hc.Check(context.Background())
+	if h.Healthy || h.Err() == nil || !strings.Contains(h.Err().Error(), "no member knows of a leader") {
+		t.Errorf("cluster without a leader not reported as such: %v", h.Err())
+	}
+}
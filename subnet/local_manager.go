@@ -22,7 +22,7 @@ import (
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/coreos/flannel/pkg/ip"
-	log "github.com/golang/glog"
+	"github.com/coreos/flannel/pkg/log"
 	"golang.org/x/net/context"
 )
 
@@ -155,7 +155,7 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, network string, conf
 	}
 
 	// no existing match, grab a new one
-	sn, err := m.allocateSubnet(config, leases)
+	sn, err := allocateSubnet(config, leases)
 	if err != nil {
 		return nil, err
 	}
@@ -175,20 +175,29 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, network string, conf
 	}
 }
 
-func (m *LocalManager) allocateSubnet(config *Config, leases []Lease) (ip.IP4Net, error) {
+func allocateSubnet(config *Config, leases []Lease) (ip.IP4Net, error) {
 	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
 
+	return pickSubnet(config, func(sn ip.IP4Net) bool {
+		for _, l := range leases {
+			if sn.Overlaps(l.Subnet) {
+				return true
+			}
+		}
+		return false
+	}, randInt)
+}
+
+// pickSubnet picks one of the first 100 subnets that are not taken at
+// random, with randInt, so that hosts racing for a subnet rarely collide.
+func pickSubnet(config *Config, taken func(sn ip.IP4Net) bool, randInt func(lo, hi int) int) (ip.IP4Net, error) {
 	var bag []ip.IP4
 	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
 
-OuterLoop:
 	for ; sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
-		for _, l := range leases {
-			if sn.Overlaps(l.Subnet) {
-				continue OuterLoop
-			}
+		if !taken(sn) {
+			bag = append(bag, sn.IP)
 		}
-		bag = append(bag, sn.IP)
 	}
 
 	if len(bag) == 0 {
@@ -253,21 +262,35 @@ func (m *LocalManager) WatchLease(ctx context.Context, network string, sn ip.IP4
 		return LeaseWatchResult{}, err
 	}
 
-	evt, index, err := m.registry.watchSubnet(ctx, network, nextIndex, sn)
+	for {
+		evt, index, err := m.registry.watchSubnet(ctx, network, nextIndex, sn)
 
-	switch {
-	case err == nil:
-		return LeaseWatchResult{
-			Events: []Event{evt},
-			Cursor: watchCursor{index},
-		}, nil
+		switch {
+		case err == nil:
+			return LeaseWatchResult{
+				Events: []Event{evt},
+				Cursor: watchCursor{index},
+			}, nil
 
-	case isIndexTooSmall(err):
-		log.Warning("Watch of subnet leases failed because etcd index outside history window")
-		return m.leaseWatchReset(ctx, network, sn)
+		case err == errTryAgain:
+			nextIndex = index
 
-	default:
-		return LeaseWatchResult{}, err
+		case isIndexTooSmall(err):
+			log.Warning("Watch of subnet lease failed because etcd index outside history window, getting it again")
+			watchResets.Inc("watch_lease")
+			wr, err := m.leaseWatchReset(ctx, network, sn)
+			if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+				// gone while we were behind, e.g. expired or revoked
+				return LeaseWatchResult{
+					Events: []Event{{EventRemoved, Lease{Subnet: sn}, ""}},
+					Cursor: watchCursor{etcdErr.Index},
+				}, nil
+			}
+			return wr, err
+
+		default:
+			return LeaseWatchResult{}, err
+		}
 	}
 }
 
@@ -281,21 +304,27 @@ func (m *LocalManager) WatchLeases(ctx context.Context, network string, cursor i
 		return LeaseWatchResult{}, err
 	}
 
-	evt, index, err := m.registry.watchSubnets(ctx, network, nextIndex)
+	for {
+		evt, index, err := m.registry.watchSubnets(ctx, network, nextIndex)
 
-	switch {
-	case err == nil:
-		return LeaseWatchResult{
-			Events: []Event{evt},
-			Cursor: watchCursor{index},
-		}, nil
+		switch {
+		case err == nil:
+			return LeaseWatchResult{
+				Events: []Event{evt},
+				Cursor: watchCursor{index},
+			}, nil
 
-	case isIndexTooSmall(err):
-		log.Warning("Watch of subnet leases failed because etcd index outside history window")
-		return m.leasesWatchReset(ctx, network)
+		case err == errTryAgain:
+			nextIndex = index
 
-	default:
-		return LeaseWatchResult{}, err
+		case isIndexTooSmall(err):
+			log.Warning("Watch of subnet leases failed because etcd index outside history window, listing them again")
+			watchResets.Inc("watch_leases")
+			return m.leasesWatchReset(ctx, network)
+
+		default:
+			return LeaseWatchResult{}, err
+		}
 	}
 }
 
@@ -323,7 +352,8 @@ func (m *LocalManager) WatchNetworks(ctx context.Context, cursor interface{}) (N
 			nextIndex = index
 
 		case isIndexTooSmall(err):
-			log.Warning("Watch of networks failed because etcd index outside history window")
+			log.Warning("Watch of networks failed because etcd index outside history window, listing them again")
+			watchResets.Inc("watch_networks")
 			return m.networkWatchReset(ctx)
 
 		default:
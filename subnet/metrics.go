@@ -0,0 +1,170 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+var (
+	registryDuration = metrics.NewHistogram("flannel_registry_request_duration_seconds",
+		"Duration of the registry calls, by operation and whether they succeeded. Watches last until there is a change.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}, "op", "result")
+	registryErrors = metrics.NewCounter("flannel_registry_request_errors_total",
+		"Number of failed registry calls, by operation and error type.", "op", "type")
+	watchResets = metrics.NewCounter("flannel_registry_watch_resets_total",
+		"Number of watches started over from a fresh read because etcd no longer had the events since their last one, by operation.", "op")
+)
+
+type metricsManager struct {
+	Manager
+}
+
+// NewMetricsManager wraps sm to export the duration of each registry call
+// made through it and the types of errors they fail with.
+func NewMetricsManager(sm Manager) Manager {
+	return &metricsManager{sm}
+}
+
+func observe(op string, start time.Time, err error) {
+	result := "success"
+	switch {
+	case err == context.Canceled:
+		// e.g. on shutdown, which says nothing about the registry
+		result = "canceled"
+	case err != nil:
+		result = "error"
+		registryErrors.Inc(op, errorType(err))
+	}
+	registryDuration.Observe(time.Since(start).Seconds(), op, result)
+}
+
+// errorType classifies registry errors for the error counter.
+func errorType(err error) string {
+	switch e := err.(type) {
+	case etcd.Error:
+		switch e.Code {
+		case etcd.ErrorCodeKeyNotFound:
+			return "not_found"
+		case etcd.ErrorCodeTestFailed, etcd.ErrorCodeNodeExist:
+			return "conflict"
+		case etcd.ErrorCodeEventIndexCleared:
+			return "index_cleared"
+		}
+		return "etcd"
+	case *etcd.ClusterError:
+		return "unavailable"
+	case net.Error:
+		if e.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+
+	switch {
+	case err == context.DeadlineExceeded || strings.Contains(err.Error(), context.DeadlineExceeded.Error()):
+		return "timeout"
+	case err == ErrLeaseTaken:
+		return "conflict"
+	}
+	return "other"
+}
+
+func (m *metricsManager) GetNetworkConfig(ctx context.Context, network string) (*Config, error) {
+	start := time.Now()
+	cfg, err := m.Manager.GetNetworkConfig(ctx, network)
+	observe("get_network_config", start, err)
+	return cfg, err
+}
+
+func (m *metricsManager) AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error) {
+	start := time.Now()
+	l, err := m.Manager.AcquireLease(ctx, network, attrs)
+	observe("acquire_lease", start, err)
+	return l, err
+}
+
+func (m *metricsManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
+	start := time.Now()
+	err := m.Manager.RenewLease(ctx, network, lease)
+	observe("renew_lease", start, err)
+	return err
+}
+
+func (m *metricsManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	start := time.Now()
+	err := m.Manager.RevokeLease(ctx, network, sn)
+	observe("revoke_lease", start, err)
+	return err
+}
+
+func (m *metricsManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	start := time.Now()
+	wr, err := m.Manager.WatchLease(ctx, network, sn, cursor)
+	observe(watchOp("watch_lease", cursor), start, err)
+	return wr, err
+}
+
+func (m *metricsManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error) {
+	start := time.Now()
+	wr, err := m.Manager.WatchLeases(ctx, network, cursor)
+	observe(watchOp("watch_leases", cursor), start, err)
+	return wr, err
+}
+
+func (m *metricsManager) WatchNetworks(ctx context.Context, cursor interface{}) (NetworkWatchResult, error) {
+	start := time.Now()
+	wr, err := m.Manager.WatchNetworks(ctx, cursor)
+	observe(watchOp("watch_networks", cursor), start, err)
+	return wr, err
+}
+
+// watchOp tells the snapshot a watch starts with, which is a plain read,
+// from waiting for changes.
+func watchOp(op string, cursor interface{}) string {
+	if cursor == nil {
+		return op + "_snapshot"
+	}
+	return op
+}
+
+func (m *metricsManager) AddReservation(ctx context.Context, network string, r *Reservation) error {
+	start := time.Now()
+	err := m.Manager.AddReservation(ctx, network, r)
+	observe("add_reservation", start, err)
+	return err
+}
+
+func (m *metricsManager) RemoveReservation(ctx context.Context, network string, sn ip.IP4Net) error {
+	start := time.Now()
+	err := m.Manager.RemoveReservation(ctx, network, sn)
+	observe("remove_reservation", start, err)
+	return err
+}
+
+func (m *metricsManager) ListReservations(ctx context.Context, network string) ([]Reservation, error) {
+	start := time.Now()
+	rs, err := m.Manager.ListReservations(ctx, network)
+	observe("list_reservations", start, err)
+	return rs, err
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestErrorType(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{etcd.Error{Code: etcd.ErrorCodeKeyNotFound}, "not_found"},
+		{etcd.Error{Code: etcd.ErrorCodeTestFailed}, "conflict"},
+		{etcd.Error{Code: etcd.ErrorCodeEventIndexCleared}, "index_cleared"},
+		{etcd.Error{Code: etcd.ErrorCodeRaftInternal}, "etcd"},
+		{&etcd.ClusterError{}, "unavailable"},
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("failed to get config: %v", context.DeadlineExceeded), "timeout"},
+		{ErrLeaseTaken, "conflict"},
+		{errors.New("boom"), "other"},
+	} {
+		if et := errorType(tc.err); et != tc.expected {
+			t.Errorf("errorType(%v): expected %v, got %v", tc.err, tc.expected, et)
+		}
+	}
+}
@@ -21,72 +21,118 @@ import (
 	"time"
 
 	etcd "github.com/coreos/etcd/client"
+	"github.com/jonboulle/clockwork"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/pkg/ip"
 )
 
 type netwk struct {
-	config        string
-	subnets       []Lease
-	subnetsEvents chan event
-
-	mux          sync.Mutex
-	subnetEvents map[ip.IP4Net]chan event
-}
-
-func (n *netwk) sendSubnetEvent(sn ip.IP4Net, e event) {
-	n.subnetsEvents <- e
-
-	n.mux.Lock()
-	c, ok := n.subnetEvents[sn]
-	if !ok {
-		c = make(chan event, 10)
-		n.subnetEvents[sn] = c
-	}
-	n.mux.Unlock()
-	c <- e
-}
-
-func (n *netwk) subnetEventsChan(sn ip.IP4Net) chan event {
-	n.mux.Lock()
-	c, ok := n.subnetEvents[sn]
-	if !ok {
-		c = make(chan event, 10)
-		n.subnetEvents[sn] = c
-	}
-	n.mux.Unlock()
-	return c
+	config  string
+	subnets []Lease
 }
 
 type event struct {
 	evt   Event
 	index uint64
+	// lease is false for the events of networks
+	lease bool
 }
 
+// maxEvents is the number of events kept for the watchers, like the event
+// history of etcd.
+const maxEvents = 1000
+
 type MockSubnetRegistry struct {
-	mux           sync.Mutex
-	networks      map[string]*netwk
-	networkEvents chan event
-	index         uint64
+	mux      sync.Mutex
+	networks map[string]*netwk
+	index    uint64
+	// events are the recent events of all networks, oldest first, and
+	// dropped is the index of the newest one no longer kept
+	events  []event
+	dropped uint64
+	// changed is closed on every event to wake up the watchers
+	changed chan struct{}
+	// clock, if set, is used instead of the package clock for the
+	// expiration of the leases
+	clock clockwork.Clock
 }
 
 func NewMockRegistry(network, config string, initialSubnets []Lease) *MockSubnetRegistry {
 	msr := &MockSubnetRegistry{
-		networkEvents: make(chan event, 1000),
-		index:         1000,
-		networks:      make(map[string]*netwk),
+		index:    1000,
+		dropped:  1000,
+		networks: make(map[string]*netwk),
+		changed:  make(chan struct{}),
 	}
 
 	msr.networks[network] = &netwk{
-		config:        config,
-		subnets:       initialSubnets,
-		subnetsEvents: make(chan event, 1000),
-		subnetEvents:  make(map[ip.IP4Net]chan event),
+		config:  config,
+		subnets: initialSubnets,
 	}
 	return msr
 }
 
+// sendEvent records e for the watchers and wakes them up. It must be called
+// with msr.mux held.
+func (msr *MockSubnetRegistry) sendEvent(e event) {
+	msr.events = append(msr.events, e)
+	if len(msr.events) > maxEvents {
+		msr.dropped = msr.events[0].index
+		msr.events = msr.events[1:]
+	}
+	close(msr.changed)
+	msr.changed = make(chan struct{})
+}
+
+// watch returns the first event after since for which match is true, waiting
+// for it if needed, or an etcd error if the events after since are no longer
+// kept.
+func (msr *MockSubnetRegistry) watch(ctx context.Context, since uint64, match func(event) bool) (event, error) {
+	for {
+		msr.mux.Lock()
+		if since < msr.dropped {
+			index := msr.index
+			msr.mux.Unlock()
+			return event{}, etcd.Error{
+				Code:    etcd.ErrorCodeEventIndexCleared,
+				Cause:   "out of date",
+				Message: "cursor is out of date",
+				Index:   index,
+			}
+		}
+		for _, e := range msr.events {
+			if e.index > since && match(e) {
+				msr.mux.Unlock()
+				return e, nil
+			}
+		}
+		changed := msr.changed
+		msr.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return event{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// SetClock makes the registry use c for the expiration of the leases, which
+// together with ExpireLeases lets tests control when leases expire.
+func (msr *MockSubnetRegistry) SetClock(c clockwork.Clock) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+	msr.clock = c
+}
+
+func (msr *MockSubnetRegistry) now() time.Time {
+	if msr.clock != nil {
+		return msr.clock.Now()
+	}
+	return clock.Now()
+}
+
 func (msr *MockSubnetRegistry) getNetworkConfig(ctx context.Context, network string) (string, error) {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
@@ -98,6 +144,15 @@ func (msr *MockSubnetRegistry) getNetworkConfig(ctx context.Context, network str
 	return n.config, nil
 }
 
+func (msr *MockSubnetRegistry) createNetworkConfig(ctx context.Context, network, config string) error {
+	return msr.CreateNetwork(ctx, network, config)
+}
+
+// SetConfig replaces the config of network.
+func (msr *MockSubnetRegistry) SetConfig(network, config string) error {
+	return msr.setConfig(network, config)
+}
+
 func (msr *MockSubnetRegistry) setConfig(network, config string) error {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
@@ -137,7 +192,11 @@ func (msr *MockSubnetRegistry) getSubnet(ctx context.Context, network string, sn
 			return &l, msr.index, nil
 		}
 	}
-	return nil, msr.index, fmt.Errorf("subnet %s not found", sn)
+	return nil, msr.index, etcd.Error{
+		Code:    etcd.ErrorCodeKeyNotFound,
+		Message: fmt.Sprintf("subnet %s not found", sn),
+		Index:   msr.index,
+	}
 }
 
 func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
@@ -161,7 +220,7 @@ func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, network string,
 
 	exp := time.Time{}
 	if ttl != 0 {
-		exp = clock.Now().Add(ttl)
+		exp = msr.now().Add(ttl)
 	}
 
 	l := Lease{
@@ -178,7 +237,7 @@ func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, network string,
 		Network: network,
 	}
 
-	n.sendSubnetEvent(sn, event{evt, msr.index})
+	msr.sendEvent(event{evt, msr.index, true})
 
 	return exp, nil
 }
@@ -196,7 +255,7 @@ func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, network string,
 
 	exp := time.Time{}
 	if ttl != 0 {
-		exp = clock.Now().Add(ttl)
+		exp = msr.now().Add(ttl)
 	}
 
 	sub, i, err := n.findSubnet(sn)
@@ -208,12 +267,12 @@ func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, network string,
 	sub.asof = msr.index
 	sub.Expiration = exp
 	n.subnets[i] = sub
-	n.sendSubnetEvent(sn, event{
+	msr.sendEvent(event{
 		Event{
 			Type:    EventAdded,
 			Lease:   sub,
 			Network: network,
-		}, msr.index,
+		}, msr.index, true,
 	})
 
 	return sub.Expiration, nil
@@ -238,12 +297,12 @@ func (msr *MockSubnetRegistry) deleteSubnet(ctx context.Context, network string,
 	n.subnets[i] = n.subnets[len(n.subnets)-1]
 	n.subnets = n.subnets[:len(n.subnets)-1]
 	sub.asof = msr.index
-	n.sendSubnetEvent(sn, event{
+	msr.sendEvent(event{
 		Event{
 			Type:    EventRemoved,
 			Lease:   sub,
 			Network: network,
-		}, msr.index,
+		}, msr.index, true,
 	})
 
 	return nil
@@ -251,72 +310,32 @@ func (msr *MockSubnetRegistry) deleteSubnet(ctx context.Context, network string,
 
 func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, network string, since uint64) (Event, uint64, error) {
 	msr.mux.Lock()
-	n, ok := msr.networks[network]
+	_, ok := msr.networks[network]
 	msr.mux.Unlock()
 
 	if !ok {
 		return Event{}, 0, fmt.Errorf("Network %s not found", network)
 	}
 
-	for {
-		msr.mux.Lock()
-		index := msr.index
-		msr.mux.Unlock()
-
-		if since < index {
-			return Event{}, 0, etcd.Error{
-				Code:    etcd.ErrorCodeEventIndexCleared,
-				Cause:   "out of date",
-				Message: "cursor is out of date",
-				Index:   index,
-			}
-		}
-
-		select {
-		case <-ctx.Done():
-			return Event{}, 0, ctx.Err()
-
-		case e := <-n.subnetsEvents:
-			if e.index > since {
-				return e.evt, e.index, nil
-			}
-		}
-	}
+	e, err := msr.watch(ctx, since, func(e event) bool {
+		return e.lease && e.evt.Network == network
+	})
+	return e.evt, e.index, err
 }
 
 func (msr *MockSubnetRegistry) watchSubnet(ctx context.Context, network string, since uint64, sn ip.IP4Net) (Event, uint64, error) {
 	msr.mux.Lock()
-	n, ok := msr.networks[network]
+	_, ok := msr.networks[network]
 	msr.mux.Unlock()
 
 	if !ok {
 		return Event{}, 0, fmt.Errorf("Network %s not found", network)
 	}
 
-	for {
-		msr.mux.Lock()
-		index := msr.index
-		msr.mux.Unlock()
-
-		if since < index {
-			return Event{}, msr.index, etcd.Error{
-				Code:    etcd.ErrorCodeEventIndexCleared,
-				Cause:   "out of date",
-				Message: "cursor is out of date",
-				Index:   index,
-			}
-		}
-
-		select {
-		case <-ctx.Done():
-			return Event{}, index, ctx.Err()
-
-		case e := <-n.subnetEventsChan(sn):
-			if e.index > since {
-				return e.evt, index, nil
-			}
-		}
-	}
+	e, err := msr.watch(ctx, since, func(e event) bool {
+		return e.lease && e.evt.Network == network && e.evt.Lease.Subnet.Equal(sn)
+	})
+	return e.evt, e.index, err
 }
 
 func (msr *MockSubnetRegistry) expireSubnet(network string, sn ip.IP4Net) {
@@ -333,15 +352,49 @@ func (msr *MockSubnetRegistry) expireSubnet(network string, sn ip.IP4Net) {
 		n.subnets[i] = n.subnets[len(n.subnets)-1]
 		n.subnets = n.subnets[:len(n.subnets)-1]
 		sub.asof = msr.index
-		n.sendSubnetEvent(sn, event{
+		msr.sendEvent(event{
 			Event{
-				Type:  EventRemoved,
-				Lease: sub,
-			}, msr.index,
+				Type:    EventRemoved,
+				Lease:   sub,
+				Network: network,
+			}, msr.index, true,
 		})
 	}
 }
 
+// ExpireLeases removes the leases whose expiration has passed, as etcd does
+// with their keys, and returns their subnets.
+func (msr *MockSubnetRegistry) ExpireLeases() []ip.IP4Net {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	now := msr.now()
+	expired := []ip.IP4Net{}
+	for name, n := range msr.networks {
+		for i := 0; i < len(n.subnets); {
+			sub := n.subnets[i]
+			if sub.Expiration.IsZero() || sub.Expiration.After(now) {
+				i++
+				continue
+			}
+
+			msr.index += 1
+			n.subnets[i] = n.subnets[len(n.subnets)-1]
+			n.subnets = n.subnets[:len(n.subnets)-1]
+			sub.asof = msr.index
+			msr.sendEvent(event{
+				Event{
+					Type:    EventRemoved,
+					Lease:   sub,
+					Network: name,
+				}, msr.index, true,
+			})
+			expired = append(expired, sub.Subnet)
+		}
+	}
+	return expired
+}
+
 func configKeyToNetworkKey(configKey string) string {
 	if !strings.HasSuffix(configKey, "/config") {
 		return ""
@@ -363,30 +416,10 @@ func (msr *MockSubnetRegistry) getNetworks(ctx context.Context) ([]string, uint6
 }
 
 func (msr *MockSubnetRegistry) watchNetworks(ctx context.Context, since uint64) (Event, uint64, error) {
-	msr.mux.Lock()
-	index := msr.index
-	msr.mux.Unlock()
-
-	for {
-		if since < index {
-			return Event{}, 0, etcd.Error{
-				Code:    etcd.ErrorCodeEventIndexCleared,
-				Cause:   "out of date",
-				Message: "cursor is out of date",
-				Index:   index,
-			}
-		}
-
-		select {
-		case <-ctx.Done():
-			return Event{}, 0, ctx.Err()
-
-		case e := <-msr.networkEvents:
-			if e.index > since {
-				return e.evt, e.index, nil
-			}
-		}
-	}
+	e, err := msr.watch(ctx, since, func(e event) bool {
+		return !e.lease
+	})
+	return e.evt, e.index, err
 }
 
 func (msr *MockSubnetRegistry) getNetwork(ctx context.Context, network string) (*netwk, error) {
@@ -412,19 +445,15 @@ func (msr *MockSubnetRegistry) CreateNetwork(ctx context.Context, network, confi
 
 	msr.index += 1
 
-	n := &netwk{
-		config:        network,
-		subnetsEvents: make(chan event, 1000),
-		subnetEvents:  make(map[ip.IP4Net]chan event),
+	msr.networks[network] = &netwk{
+		config: config,
 	}
-
-	msr.networks[network] = n
-	msr.networkEvents <- event{
+	msr.sendEvent(event{
 		Event{
 			Type:    EventAdded,
 			Network: network,
-		}, msr.index,
-	}
+		}, msr.index, false,
+	})
 
 	return nil
 }
@@ -441,12 +470,12 @@ func (msr *MockSubnetRegistry) DeleteNetwork(ctx context.Context, network string
 
 	msr.index += 1
 
-	msr.networkEvents <- event{
+	msr.sendEvent(event{
 		Event{
 			Type:    EventRemoved,
 			Network: network,
-		}, msr.index,
-	}
+		}, msr.index, false,
+	})
 
 	return nil
 }
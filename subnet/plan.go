@@ -0,0 +1,75 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// LeasePlan describes the lease AcquireLease would hand out, as computed
+// by PlanLease.
+type LeasePlan struct {
+	Lease Lease
+	// Reused is set if Lease is an existing lease for our public IP,
+	// otherwise it is one of the free subnets, picked at random.
+	Reused bool
+	// Peers are the leases of the other hosts in the network.
+	Peers []Lease
+}
+
+// PlanLease computes the lease that AcquireLease would return for attrs
+// without modifying the registry. It works against any Manager, so it
+// also validates connectivity to the registry or the remote server.
+func PlanLease(ctx context.Context, sm Manager, network string, config *Config, attrs *LeaseAttrs) (*LeasePlan, error) {
+	wr, err := sm.WatchLeases(ctx, network, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	leases := wr.Snapshot
+	plan := &LeasePlan{}
+
+	if l := findLeaseByIP(leases, attrs.PublicIP); l != nil && isSubnetConfigCompat(config, l.Subnet) {
+		plan.Lease = *l
+		plan.Reused = true
+	} else {
+		if l != nil {
+			// AcquireLease would delete it, so it does not count as taken
+			leases = withoutLease(leases, l.Subnet)
+		}
+
+		sn, err := allocateSubnet(config, leases)
+		if err != nil {
+			return nil, err
+		}
+		plan.Lease = Lease{Subnet: sn}
+	}
+	plan.Lease.Attrs = *attrs
+
+	plan.Peers = withoutLease(leases, plan.Lease.Subnet)
+	return plan, nil
+}
+
+func withoutLease(leases []Lease, sn ip.IP4Net) []Lease {
+	var others []Lease
+	for _, l := range leases {
+		if !l.Subnet.Equal(sn) {
+			others = append(others, l)
+		}
+	}
+	return others
+}
@@ -20,15 +20,18 @@ import (
 	"fmt"
 	"path"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/coreos/etcd/pkg/transport"
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/fips"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/flannel/pkg/qos"
 )
 
 var (
@@ -38,6 +41,8 @@ var (
 
 type Registry interface {
 	getNetworkConfig(ctx context.Context, network string) (string, error)
+	// createNetworkConfig fails if the network already has a config
+	createNetworkConfig(ctx context.Context, network, config string) error
 	getSubnets(ctx context.Context, network string) ([]Lease, uint64, error)
 	getSubnet(ctx context.Context, network string, sn ip.IP4Net) (*Lease, uint64, error)
 	createSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error)
@@ -57,6 +62,22 @@ type EtcdConfig struct {
 	Prefix    string
 	Username  string
 	Password  string
+	// Auth, if set, returns the username and password instead, for
+	// credentials which change over time like those read from Vault
+	Auth func() (username, password string)
+	// DiscoverySRV, if set, is the domain whose SRV records give the
+	// endpoints instead, resolved again every DiscoveryInterval
+	// (DefaultDiscoveryInterval if 0)
+	DiscoverySRV      string
+	DiscoveryInterval time.Duration
+}
+
+// credentials returns the username and password to authenticate with.
+func (c *EtcdConfig) credentials() (string, string) {
+	if c.Auth != nil {
+		return c.Auth()
+	}
+	return c.Username, c.Password
 }
 
 type etcdNewFunc func(c *EtcdConfig) (etcd.KeysAPI, error)
@@ -67,6 +88,9 @@ type etcdSubnetRegistry struct {
 	cli          etcd.KeysAPI
 	etcdCfg      *EtcdConfig
 	networkRegex *regexp.Regexp
+	// the credentials and endpoints cli was created with
+	username, password string
+	endpoints          []string
 }
 
 func newEtcdClient(c *EtcdConfig) (etcd.KeysAPI, error) {
@@ -80,12 +104,20 @@ func newEtcdClient(c *EtcdConfig) (etcd.KeysAPI, error) {
 	if err != nil {
 		return nil, err
 	}
+	fips.ConfigureTLS(t.TLSClientConfig)
+	qos.ConfigureTransport(t)
+
+	endpoints, err := c.endpoints()
+	if err != nil {
+		return nil, err
+	}
 
+	username, password := c.credentials()
 	cli, err := etcd.New(etcd.Config{
-		Endpoints: c.Endpoints,
+		Endpoints: endpoints,
 		Transport: t,
-		Username:  c.Username,
-		Password:  c.Password,
+		Username:  username,
+		Password:  password,
 	})
 	if err != nil {
 		return nil, err
@@ -94,6 +126,12 @@ func newEtcdClient(c *EtcdConfig) (etcd.KeysAPI, error) {
 	return etcd.NewKeysAPI(cli), nil
 }
 
+// NewEtcdClient returns a client of the etcd cluster in c, for users of
+// etcd other than the registry such as leader election.
+func NewEtcdClient(c *EtcdConfig) (etcd.KeysAPI, error) {
+	return newEtcdClient(c)
+}
+
 func newEtcdSubnetRegistry(config *EtcdConfig, cliNewFunc etcdNewFunc) (Registry, error) {
 	r := &etcdSubnetRegistry{
 		etcdCfg:      config,
@@ -106,6 +144,10 @@ func newEtcdSubnetRegistry(config *EtcdConfig, cliNewFunc etcdNewFunc) (Registry
 	}
 
 	var err error
+	r.username, r.password = config.credentials()
+	if r.endpoints, err = config.endpoints(); err != nil {
+		return nil, err
+	}
 	r.cli, err = r.cliNewFunc(config)
 	if err != nil {
 		return nil, err
@@ -123,6 +165,12 @@ func (esr *etcdSubnetRegistry) getNetworkConfig(ctx context.Context, network str
 	return resp.Node.Value, nil
 }
 
+func (esr *etcdSubnetRegistry) createNetworkConfig(ctx context.Context, network, config string) error {
+	key := path.Join(esr.etcdCfg.Prefix, network, "config")
+	_, err := esr.client().Set(ctx, key, config, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	return err
+}
+
 // getSubnets queries etcd to get a list of currently allocated leases for a given network.
 // It returns the leases along with the "as-of" etcd-index that can be used as the starting
 // point for etcd watch.
@@ -228,7 +276,12 @@ func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, network string,
 	}
 
 	evt, err := parseSubnetWatchResponse(e)
-	return evt, e.Node.ModifiedIndex, err
+	if err != nil {
+		// skip it rather than fail on it again on every retry
+		log.Warningf("Skipping the watch event at index %v: %v", e.Node.ModifiedIndex, err)
+		return Event{}, e.Node.ModifiedIndex, errTryAgain
+	}
+	return evt, e.Node.ModifiedIndex, nil
 }
 
 func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, network string, since uint64, sn ip.IP4Net) (Event, uint64, error) {
@@ -243,7 +296,12 @@ func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, network string,
 	}
 
 	evt, err := parseSubnetWatchResponse(e)
-	return evt, e.Node.ModifiedIndex, err
+	if err != nil {
+		// skip it rather than fail on it again on every retry
+		log.Warningf("Skipping the watch event at index %v: %v", e.Node.ModifiedIndex, err)
+		return Event{}, e.Node.ModifiedIndex, errTryAgain
+	}
+	return evt, e.Node.ModifiedIndex, nil
 }
 
 // getNetworks queries etcd to get a list of network names.  It returns the
@@ -290,9 +348,35 @@ func (esr *etcdSubnetRegistry) watchNetworks(ctx context.Context, since uint64)
 	return esr.parseNetworkWatchResponse(e)
 }
 
+// client returns the etcd client, which is recreated when the credentials
+// have changed.
 func (esr *etcdSubnetRegistry) client() etcd.KeysAPI {
 	esr.mux.Lock()
 	defer esr.mux.Unlock()
+
+	if esr.etcdCfg.Auth != nil {
+		if username, password := esr.etcdCfg.Auth(); username != esr.username || password != esr.password {
+			cli, err := esr.cliNewFunc(esr.etcdCfg)
+			if err != nil {
+				log.Errorf("Failed to recreate the etcd client with the new credentials: %v", err)
+				return esr.cli
+			}
+			log.Info("Recreated the etcd client with the new credentials")
+			esr.cli, esr.username, esr.password = cli, username, password
+		}
+	}
+
+	if esr.etcdCfg.DiscoverySRV != "" {
+		if eps, err := esr.etcdCfg.endpoints(); err == nil && !sameEndpoints(eps, esr.endpoints) {
+			cli, err := esr.cliNewFunc(esr.etcdCfg)
+			if err != nil {
+				log.Errorf("Failed to recreate the etcd client for the new endpoints: %v", err)
+				return esr.cli
+			}
+			log.Infof("Recreated the etcd client for the endpoints %v", strings.Join(eps, ","))
+			esr.cli, esr.endpoints = cli, eps
+		}
+	}
 	return esr.cli
 }
 
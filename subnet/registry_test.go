@@ -200,3 +200,37 @@ func TestEtcdRegistry(t *testing.T) {
 
 	// TODO: watchSubnet and watchNetworks
 }
+
+func TestEtcdRegistryCredentialChange(t *testing.T) {
+	password := "first"
+	created := 0
+	cfg := &EtcdConfig{
+		Endpoints: []string{"http://127.0.0.1:2379"},
+		Prefix:    "/coreos.com/network",
+		Auth: func() (string, string) {
+			return "flannel", password
+		},
+	}
+
+	r, err := newEtcdSubnetRegistry(cfg, func(c *EtcdConfig) (etcd.KeysAPI, error) {
+		created++
+		return newMockEtcd(), nil
+	})
+	if err != nil {
+		t.Fatal("Failed to create etcd subnet registry")
+	}
+	esr := r.(*etcdSubnetRegistry)
+
+	cli := esr.client()
+	if esr.client() != cli || created != 1 {
+		t.Fatalf("client was recreated with unchanged credentials")
+	}
+
+	password = "second"
+	if esr.client() == cli || created != 2 {
+		t.Fatalf("client was not recreated with the new credentials")
+	}
+	if esr.password != "second" {
+		t.Errorf("expected the new password to be recorded, got %q", esr.password)
+	}
+}
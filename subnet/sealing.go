@@ -0,0 +1,265 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
+)
+
+// SealedData is backend data encrypted with AES-256-GCM by a key generated
+// for it (the DEK), which is in turn encrypted with a key shared by the
+// cluster (the KEK).
+type SealedData struct {
+	// KEK is the ID of the KEK, so that it can be rotated
+	KEK string
+	// Key is the encrypted DEK and Data the encrypted backend data, each
+	// prefixed with its nonce
+	Key  []byte
+	Data []byte
+}
+
+// ParseKEK parses a KEK of 32 bytes, given as is or hex or base64 encoded.
+func ParseKEK(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if k, err := hex.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	return nil, fmt.Errorf("a KEK must be 32 bytes, given as is or hex or base64 encoded")
+}
+
+func kekID(k []byte) string {
+	sum := sha256.Sum256(k)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func gcmSeal(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, sealed[:n], sealed[n:], aad)
+}
+
+// Sealer envelope-encrypts the backend data of leases.
+type Sealer struct {
+	// keks by ID; the first one seals
+	keks  map[string][]byte
+	first string
+}
+
+// NewSealer returns a sealer which seals with the first of keks and unseals
+// with any of them, so that the KEK can be rotated by first adding the new
+// one on all hosts and then moving it to the front.
+func NewSealer(keks ...[]byte) (*Sealer, error) {
+	if len(keks) == 0 {
+		return nil, fmt.Errorf("no KEK")
+	}
+	s := &Sealer{keks: map[string][]byte{}}
+	for _, k := range keks {
+		if len(k) != 32 {
+			return nil, fmt.Errorf("a KEK must be 32 bytes, not %v", len(k))
+		}
+		id := kekID(k)
+		if s.first == "" {
+			s.first = id
+		}
+		s.keks[id] = k
+	}
+	return s, nil
+}
+
+// Seal replaces the backend data of attrs, and that of its previous
+// backend, with its encryption, bound to the network.
+func (s *Sealer) Seal(network string, attrs *LeaseAttrs) error {
+	if len(attrs.BackendData) > 0 {
+		sealed, err := s.seal(network, attrs.BackendData)
+		if err != nil {
+			return err
+		}
+		attrs.Sealed = sealed
+		attrs.BackendData = nil
+	}
+
+	if p := attrs.PreviousBackend; p != nil && len(p.BackendData) > 0 {
+		sealed, err := s.seal(network, p.BackendData)
+		if err != nil {
+			return err
+		}
+		attrs.PreviousBackend = &BackendAttrs{BackendType: p.BackendType, Sealed: sealed}
+	}
+	return nil
+}
+
+func (s *Sealer) seal(network string, plaintext []byte) (*SealedData, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	data, err := gcmSeal(dek, plaintext, []byte(network))
+	if err != nil {
+		return nil, err
+	}
+	key, err := gcmSeal(s.keks[s.first], dek, []byte(s.first))
+	if err != nil {
+		return nil, err
+	}
+	return &SealedData{KEK: s.first, Key: key, Data: data}, nil
+}
+
+// Unseal decrypts the sealed backend data of attrs, and that of its
+// previous backend, if any.
+func (s *Sealer) Unseal(network string, attrs *LeaseAttrs) error {
+	if attrs.Sealed != nil {
+		data, err := s.unseal(network, attrs.Sealed)
+		if err != nil {
+			return err
+		}
+		attrs.BackendData = data
+		attrs.Sealed = nil
+	}
+
+	if p := attrs.PreviousBackend; p != nil && p.Sealed != nil {
+		data, err := s.unseal(network, p.Sealed)
+		if err != nil {
+			return err
+		}
+		attrs.PreviousBackend = &BackendAttrs{BackendType: p.BackendType, BackendData: data}
+	}
+	return nil
+}
+
+func (s *Sealer) unseal(network string, sealed *SealedData) ([]byte, error) {
+	kek, ok := s.keks[sealed.KEK]
+	if !ok {
+		return nil, fmt.Errorf("backend data is sealed with unknown KEK %v", sealed.KEK)
+	}
+	dek, err := gcmOpen(kek, sealed.Key, []byte(sealed.KEK))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the key of the backend data: %v", err)
+	}
+	data, err := gcmOpen(dek, sealed.Data, []byte(network))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the backend data: %v", err)
+	}
+	return data, nil
+}
+
+type sealingManager struct {
+	Manager
+	sealer *Sealer
+}
+
+// NewSealingManager wraps sm to encrypt the backend data of our leases on
+// their way to the registry and decrypt that of all leases on their way
+// back, so that reading the registry does not reveal key material.
+func NewSealingManager(sm Manager, sealer *Sealer) Manager {
+	return &sealingManager{sm, sealer}
+}
+
+func (m *sealingManager) unseal(network string, l *Lease) {
+	if err := m.sealer.Unseal(network, &l.Attrs); err != nil {
+		log.Warningf("Lease %v: %v", l.Subnet, err)
+	}
+}
+
+func (m *sealingManager) AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error) {
+	sealed := *attrs
+	if err := m.sealer.Seal(network, &sealed); err != nil {
+		return nil, fmt.Errorf("failed to seal backend data: %v", err)
+	}
+
+	l, err := m.Manager.AcquireLease(ctx, network, &sealed)
+	if err != nil {
+		return nil, err
+	}
+	l.Attrs = *attrs
+	return l, nil
+}
+
+func (m *sealingManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
+	l := *lease
+	if err := m.sealer.Seal(network, &l.Attrs); err != nil {
+		return fmt.Errorf("failed to seal backend data: %v", err)
+	}
+
+	if err := m.Manager.RenewLease(ctx, network, &l); err != nil {
+		return err
+	}
+	l.Attrs = lease.Attrs
+	*lease = l
+	return nil
+}
+
+func (m *sealingManager) unsealResult(network string, wr LeaseWatchResult) LeaseWatchResult {
+	for i := range wr.Events {
+		m.unseal(network, &wr.Events[i].Lease)
+	}
+	for i := range wr.Snapshot {
+		m.unseal(network, &wr.Snapshot[i])
+	}
+	return wr
+}
+
+func (m *sealingManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	wr, err := m.Manager.WatchLease(ctx, network, sn, cursor)
+	return m.unsealResult(network, wr), err
+}
+
+func (m *sealingManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error) {
+	wr, err := m.Manager.WatchLeases(ctx, network, cursor)
+	return m.unsealResult(network, wr), err
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+var (
+	testKEK1 = bytes.Repeat([]byte{1}, 32)
+	testKEK2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestParseKEK(t *testing.T) {
+	for _, s := range []string{string(testKEK1), hex.EncodeToString(testKEK1) + "\n", "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="} {
+		k, err := ParseKEK([]byte(s))
+		if err != nil || !bytes.Equal(k, testKEK1) {
+			t.Errorf("ParseKEK(%q): got %x, %v", s, k, err)
+		}
+	}
+	if _, err := ParseKEK([]byte("short")); err == nil {
+		t.Errorf("ParseKEK accepted a short key")
+	}
+}
+
+func TestSealer(t *testing.T) {
+	old, _ := NewSealer(testKEK1)
+	rotated, _ := NewSealer(testKEK2, testKEK1)
+	other, _ := NewSealer(testKEK2)
+
+	data := json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`)
+	attrs := LeaseAttrs{BackendData: data}
+	if err := old.Seal("net", &attrs); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if attrs.BackendData != nil || attrs.Sealed == nil || bytes.Contains(attrs.Sealed.Data, []byte("VtepMAC")) {
+		t.Fatalf("backend data was not sealed: %+v", attrs)
+	}
+
+	wrongNet := attrs
+	if err := old.Unseal("other", &wrongNet); err == nil {
+		t.Errorf("Unseal of another network's data did not fail")
+	}
+	unknown := attrs
+	if err := other.Unseal("net", &unknown); err == nil {
+		t.Errorf("Unseal with an unknown KEK did not fail")
+	}
+
+	if err := rotated.Unseal("net", &attrs); err != nil {
+		t.Fatalf("Unseal with a former KEK failed: %v", err)
+	}
+	if !bytes.Equal(attrs.BackendData, data) || attrs.Sealed != nil {
+		t.Errorf("unexpected unsealed attrs: %+v", attrs)
+	}
+}
+
+func TestSealPreviousBackend(t *testing.T) {
+	s, _ := NewSealer(testKEK1)
+
+	data := json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`)
+	prev := &BackendAttrs{BackendType: "vxlan", BackendData: data}
+	attrs := LeaseAttrs{BackendType: "host-gw", PreviousBackend: prev}
+	if err := s.Seal("net", &attrs); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	p := attrs.PreviousBackend
+	if p.BackendType != "vxlan" || p.BackendData != nil || p.Sealed == nil || bytes.Contains(p.Sealed.Data, []byte("VtepMAC")) {
+		t.Fatalf("previous backend data was not sealed: %+v", p)
+	}
+	if prev.BackendData == nil {
+		t.Errorf("Seal changed the previous backend attrs it was given")
+	}
+
+	if err := s.Unseal("net", &attrs); err != nil {
+		t.Fatalf("Unseal failed: %v", err)
+	}
+	if p := attrs.PreviousBackend; !bytes.Equal(p.BackendData, data) || p.Sealed != nil {
+		t.Errorf("unexpected unsealed previous backend attrs: %+v", p)
+	}
+}
+
+func TestSealingManager(t *testing.T) {
+	msr := newDummyRegistry()
+	sealer, _ := NewSealer(testKEK1)
+	sm := NewSealingManager(NewMockManager(msr), sealer)
+	ctx := context.Background()
+
+	data := json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`)
+	attrs := LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), BackendData: data}
+	l, err := sm.AcquireLease(ctx, "_", &attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if !bytes.Equal(l.Attrs.BackendData, data) {
+		t.Errorf("acquired lease has unexpected backend data %s", l.Attrs.BackendData)
+	}
+	if err := sm.RenewLease(ctx, "_", l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if !bytes.Equal(l.Attrs.BackendData, data) {
+		t.Errorf("renewed lease has unexpected backend data %s", l.Attrs.BackendData)
+	}
+
+	stored, _, err := msr.getSubnet(ctx, "_", l.Subnet)
+	if err != nil {
+		t.Fatalf("getSubnet failed: %v", err)
+	}
+	if stored.Attrs.BackendData != nil || stored.Attrs.Sealed == nil {
+		t.Errorf("the registry has the backend data in plaintext: %+v", stored.Attrs)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "_", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	found := false
+	for _, sl := range wr.Snapshot {
+		if sl.Subnet.Equal(l.Subnet) {
+			found = true
+			if !bytes.Equal(sl.Attrs.BackendData, data) || sl.Attrs.Sealed != nil {
+				t.Errorf("watched lease was not unsealed: %+v", sl.Attrs)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("lease missing from the snapshot")
+	}
+}
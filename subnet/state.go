@@ -0,0 +1,116 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// State is the content of the registry as saved by ExportState, to rebuild
+// the registry after its loss without renumbering the hosts.
+type State struct {
+	Time     time.Time
+	Networks []NetworkState
+}
+
+// NetworkState is a network of a State.
+type NetworkState struct {
+	// Name is "" in single network mode
+	Name   string
+	Config json.RawMessage
+	// Leases include the reservations, which never expire
+	Leases []Lease
+}
+
+// StateImporter is implemented by the managers which can restore a State,
+// which requires writing to the registry directly.
+type StateImporter interface {
+	ImportState(ctx context.Context, s *State) error
+}
+
+// ExportState returns the config and leases of every network. Like
+// PlanLease it works against any Manager.
+func ExportState(ctx context.Context, sm Manager) (*State, error) {
+	nr, err := sm.WatchNetworks(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+	networks := nr.Snapshot
+	if len(networks) == 0 {
+		// single network mode
+		networks = []string{""}
+	}
+
+	s := &State{Time: clock.Now()}
+	for _, n := range networks {
+		cfg, err := sm.GetNetworkConfig(ctx, n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve config of network %q: %v", n, err)
+		}
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		lr, err := sm.WatchLeases(ctx, n, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list leases of network %q: %v", n, err)
+		}
+		s.Networks = append(s.Networks, NetworkState{Name: n, Config: data, Leases: lr.Snapshot})
+	}
+	return s, nil
+}
+
+// ImportState writes the networks of s to a registry which has none of
+// them, keeping every lease at its subnet. The leases keep their expiration,
+// except those which expired since the export: they get a full subnetTTL so
+// that their hosts find them when they come back. An import failing midway
+// leaves the networks written so far in the registry.
+func (m *LocalManager) ImportState(ctx context.Context, s *State) error {
+	for _, n := range s.Networks {
+		if _, err := ParseConfig(string(n.Config)); err != nil {
+			return fmt.Errorf("invalid config of network %q: %v", n.Name, err)
+		}
+		if _, err := m.registry.getNetworkConfig(ctx, n.Name); err == nil {
+			return fmt.Errorf("network %q already exists in the registry", n.Name)
+		}
+	}
+
+	now := clock.Now()
+	for _, n := range s.Networks {
+		if err := m.registry.createNetworkConfig(ctx, n.Name, string(n.Config)); err != nil {
+			return fmt.Errorf("failed to create network %q: %v", n.Name, err)
+		}
+
+		for _, l := range n.Leases {
+			var ttl time.Duration
+			if !l.Expiration.IsZero() {
+				// the registry has a resolution of a second and takes
+				// 0 for a reservation
+				if ttl = l.Expiration.Sub(now); ttl < time.Second {
+					ttl = subnetTTL
+				}
+			}
+			if _, err := m.registry.createSubnet(ctx, n.Name, l.Subnet, &l.Attrs, ttl); err != nil {
+				return fmt.Errorf("failed to import lease %v of network %q: %v", l.Subnet, n.Name, err)
+			}
+		}
+	}
+	return nil
+}
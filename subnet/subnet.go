@@ -35,6 +35,39 @@ type LeaseAttrs struct {
 	PublicIP    ip.IP4
 	BackendType string          `json:",omitempty"`
 	BackendData json.RawMessage `json:",omitempty"`
+	// Build tells which flanneld holds the lease
+	Build *BuildInfo `json:",omitempty"`
+	// Sealed replaces BackendData in the registry when it is encrypted
+	// with --backend-data-kek-file
+	Sealed *SealedData `json:",omitempty"`
+	// KeyEpochs are the epochs of the keys the backend authenticates or
+	// encrypts packets with, see pkg/keys
+	KeyEpochs []uint32 `json:",omitempty"`
+	// MTU is the largest packet the host takes on the network: the MTU of
+	// its external interface less the overhead of the backend
+	MTU int `json:",omitempty"`
+	// RateLimit is the bandwidth, e.g. 10mbit (see ParseBandwidth), the
+	// other hosts shape the traffic they send to the subnet to
+	RateLimit string `json:",omitempty"`
+	// PreviousBackend is the backend the host keeps running while the
+	// network migrates to BackendType, for the hosts yet to follow
+	PreviousBackend *BackendAttrs `json:",omitempty"`
+}
+
+// BackendAttrs are the attributes of a lease for another backend than its
+// BackendType.
+type BackendAttrs struct {
+	BackendType string
+	BackendData json.RawMessage `json:",omitempty"`
+	Sealed      *SealedData     `json:",omitempty"`
+}
+
+// BuildInfo describes a flanneld, to audit mixed-version fleets.
+type BuildInfo struct {
+	Version string
+	GitSHA  string `json:",omitempty"`
+	// Features are the options set explicitly
+	Features []string `json:",omitempty"`
 }
 
 type Lease struct {
@@ -131,11 +164,22 @@ func MakeSubnetKey(sn ip.IP4Net) string {
 	return sn.StringSep(".", "-")
 }
 
+// Manager is the registry of the networks and their leases. The network is
+// "" in single network mode.
 type Manager interface {
 	GetNetworkConfig(ctx context.Context, network string) (*Config, error)
+	// AcquireLease returns the lease of the host with attrs.PublicIP,
+	// updated with attrs, or else a new one for a free or reserved subnet.
 	AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error)
+	// RenewLease stores the attributes of lease and extends it, updating
+	// its Expiration.
 	RenewLease(ctx context.Context, network string, lease *Lease) error
 	RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error
+	// WatchLease, WatchLeases and WatchNetworks return the current state
+	// as a snapshot when cursor is nil, and otherwise wait for the events
+	// after cursor. Use the result's Cursor for the next call, or the
+	// helpers WatchLease, WatchLeases and WatchNetworks of this package,
+	// which turn them into events and handle the registry falling behind.
 	WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error)
 	WatchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error)
 	WatchNetworks(ctx context.Context, cursor interface{}) (NetworkWatchResult, error)
@@ -78,6 +78,56 @@ func TestAcquireLease(t *testing.T) {
 	}
 }
 
+func TestPlanLease(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	config, err := sm.GetNetworkConfig(context.Background(), "_")
+	if err != nil {
+		t.Fatal("GetNetworkConfig failed: ", err)
+	}
+
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+
+	plan, err := PlanLease(context.Background(), sm, "_", config, &attrs)
+	if err != nil {
+		t.Fatal("PlanLease failed: ", err)
+	}
+	if plan.Reused {
+		t.Error("PlanLease reported reuse without an existing lease")
+	}
+	if !inAllocatableRange(context.Background(), sm, plan.Lease.Subnet) {
+		t.Fatal("Planned subnet outside of valid range: ", plan.Lease.Subnet)
+	}
+	if len(plan.Peers) != 5 {
+		t.Errorf("Expected 5 peers, got %d", len(plan.Peers))
+	}
+
+	// planning must not have acquired anything
+	wr, err := sm.WatchLeases(context.Background(), "_", nil)
+	if err != nil {
+		t.Fatal("WatchLeases failed: ", err)
+	}
+	if len(wr.Snapshot) != 5 {
+		t.Fatalf("PlanLease modified the registry: %v leases", len(wr.Snapshot))
+	}
+
+	l, err := sm.AcquireLease(context.Background(), "_", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	plan, err = PlanLease(context.Background(), sm, "_", config, &attrs)
+	if err != nil {
+		t.Fatal("PlanLease failed: ", err)
+	}
+	if !plan.Reused || !plan.Lease.Subnet.Equal(l.Subnet) {
+		t.Errorf("PlanLease did not reuse subnet; expected %v, got %v", l.Subnet, plan.Lease.Subnet)
+	}
+}
+
 func TestConfigChanged(t *testing.T) {
 	msr := newDummyRegistry()
 	sm := NewMockManager(msr)
@@ -236,6 +286,82 @@ func TestWatchLeaseRemoved(t *testing.T) {
 	}
 }
 
+// fallBehind makes etcd drop the events the watchers have not seen yet.
+func fallBehind(ctx context.Context, t *testing.T, msr *MockSubnetRegistry) {
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.3.1.0"), PrefixLen: 24}
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.1.1.1")}
+	for i := 0; i <= maxEvents; i++ {
+		if _, err := msr.updateSubnet(ctx, "_", sn, attrs, 0, 0); err != nil {
+			t.Fatalf("updateSubnet failed: %v", err)
+		}
+	}
+}
+
+func TestWatchLeasesFellBehind(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wr, err := sm.WatchLeases(ctx, "_", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	removed := ip.IP4Net{IP: ip.MustParseIP4("10.3.31.0"), PrefixLen: 24}
+	if err := msr.deleteSubnet(ctx, "_", removed); err != nil {
+		t.Fatalf("deleteSubnet failed: %v", err)
+	}
+	fallBehind(ctx, t, msr)
+
+	wr, err = sm.WatchLeases(ctx, "_", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Events) != 0 || len(wr.Snapshot) != 4 {
+		t.Fatalf("WatchLeases returned %v and a snapshot of %v leases, expected a snapshot of 4", wr.Events, len(wr.Snapshot))
+	}
+
+	// and the watch goes on from there
+	created := ip.IP4Net{IP: ip.MustParseIP4("10.3.30.0"), PrefixLen: 24}
+	if _, err := msr.createSubnet(ctx, "_", created, &LeaseAttrs{}, 0); err != nil {
+		t.Fatalf("createSubnet failed: %v", err)
+	}
+	wr, err = sm.WatchLeases(ctx, "_", wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != EventAdded || !wr.Events[0].Lease.Subnet.Equal(created) {
+		t.Errorf("WatchLeases returned %v, expected %v to be added", wr.Events, created)
+	}
+}
+
+func TestWatchLeaseRevokedWhileBehind(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.3.31.0"), PrefixLen: 24}
+	wr, err := sm.WatchLease(ctx, "_", sn, nil)
+	if err != nil {
+		t.Fatalf("WatchLease failed: %v", err)
+	}
+	if err := msr.deleteSubnet(ctx, "_", sn); err != nil {
+		t.Fatalf("deleteSubnet failed: %v", err)
+	}
+	fallBehind(ctx, t, msr)
+
+	wr, err = sm.WatchLease(ctx, "_", sn, wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLease failed: %v", err)
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != EventRemoved || !wr.Events[0].Lease.Subnet.Equal(sn) {
+		t.Errorf("WatchLease returned %v, expected %v to be removed", wr.Events, sn)
+	}
+}
+
 type leaseData struct {
 	Dummy string
 }
@@ -550,3 +676,68 @@ func inAllocatableRange(ctx context.Context, sm Manager, ipn ip.IP4Net) bool {
 func resvEqual(r1, r2 Reservation) bool {
 	return r1.Subnet.Equal(r2.Subnet) && r1.PublicIP == r2.PublicIP
 }
+
+func TestExportImportState(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), BackendType: "vxlan"}
+	active := newIP4Net("10.3.10.0", 24)
+	if _, err := msr.createSubnet(ctx, "_", active, attrs, time.Hour); err != nil {
+		t.Fatalf("createSubnet failed: %v", err)
+	}
+
+	s, err := ExportState(ctx, sm)
+	if err != nil {
+		t.Fatalf("ExportState failed: %v", err)
+	}
+	if len(s.Networks) != 1 || s.Networks[0].Name != "_" || len(s.Networks[0].Leases) != 6 {
+		t.Fatalf("unexpected state: %+v", s)
+	}
+
+	// the lease of 10.3.10.0/24 expired since the export
+	for i := range s.Networks[0].Leases {
+		if l := &s.Networks[0].Leases[i]; l.Subnet.Equal(active) {
+			l.Expiration = time.Now().Add(-time.Minute)
+		}
+	}
+
+	fresh := NewMockRegistry("other", "", nil)
+	fsm := NewMockManager(fresh)
+	if err := fsm.(StateImporter).ImportState(ctx, s); err != nil {
+		t.Fatalf("ImportState failed: %v", err)
+	}
+
+	cfg, err := fsm.GetNetworkConfig(ctx, "_")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	if cfg.SubnetMax != ip.MustParseIP4("10.3.25.0") {
+		t.Errorf("config was not imported: %+v", cfg)
+	}
+
+	leases, _, err := fresh.getSubnets(ctx, "_")
+	if err != nil {
+		t.Fatalf("getSubnets failed: %v", err)
+	}
+	if len(leases) != 6 {
+		t.Fatalf("expected 6 leases, got %v", leases)
+	}
+	for _, l := range leases {
+		switch {
+		case l.Subnet.Equal(active):
+			if l.Attrs.BackendType != "vxlan" || l.Expiration.Before(time.Now().Add(subnetTTL-time.Minute)) {
+				t.Errorf("expired lease was not renewed: %+v", l)
+			}
+		case !l.Expiration.IsZero():
+			t.Errorf("reservation %v was imported as a lease", l.Subnet)
+		}
+	}
+
+	if err := fsm.(StateImporter).ImportState(ctx, s); err == nil {
+		t.Errorf("ImportState overwrote an existing network")
+	}
+}
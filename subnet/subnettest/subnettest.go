@@ -0,0 +1,225 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subnettest provides an in-memory subnet.Manager for the tests of
+// programs embedding flannel and of backends, so they run against the
+// semantics of the flannel registry without etcd: leases are allocated,
+// renewed, watched and reserved by the same code as with etcd, over the mock
+// registry of package subnet. The clock of the leases is fake and only
+// moves with Advance, which also expires the leases, and the calls of the
+// Manager can be made to fail with Fail.
+package subnettest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// ErrInjected is returned by the calls made to fail by Fail with a nil error.
+var ErrInjected = errors.New("injected failure")
+
+// The names of the calls to pass to Fail.
+const (
+	GetNetworkConfig  = "GetNetworkConfig"
+	AcquireLease      = "AcquireLease"
+	RenewLease        = "RenewLease"
+	RevokeLease       = "RevokeLease"
+	WatchLease        = "WatchLease"
+	WatchLeases       = "WatchLeases"
+	WatchNetworks     = "WatchNetworks"
+	AddReservation    = "AddReservation"
+	RemoveReservation = "RemoveReservation"
+	ListReservations  = "ListReservations"
+)
+
+type failure struct {
+	err error
+	// n is the number of calls left to fail, or negative to fail all
+	n int
+}
+
+// Manager is an in-memory subnet.Manager. It is safe for concurrent use.
+type Manager struct {
+	sm       subnet.Manager
+	registry *subnet.MockSubnetRegistry
+	clock    clockwork.FakeClock
+
+	mux      sync.Mutex
+	failures map[string]*failure
+}
+
+var _ subnet.Manager = &Manager{}
+
+// NewManager returns a Manager of a registry holding the network with config,
+// the JSON config as stored in etcd, and leases. The network of single
+// network mode is "". The fake clock starts at the current time.
+func NewManager(network, config string, leases ...subnet.Lease) *Manager {
+	clock := clockwork.NewFakeClockAt(time.Now())
+	registry := subnet.NewMockRegistry(network, config, leases)
+	registry.SetClock(clock)
+
+	return &Manager{
+		sm:       subnet.NewMockManager(registry),
+		registry: registry,
+		clock:    clock,
+		failures: make(map[string]*failure),
+	}
+}
+
+// Now returns the time of the fake clock.
+func (m *Manager) Now() time.Time {
+	return m.clock.Now()
+}
+
+// Advance moves the fake clock forward by d and expires the leases which
+// have not been renewed since, returning their subnets. The watchers get a
+// removed event for each of them.
+func (m *Manager) Advance(d time.Duration) []ip.IP4Net {
+	m.clock.Advance(d)
+	return m.registry.ExpireLeases()
+}
+
+// Fail makes the next n calls of call, one of the call names of this
+// package, fail with err, or ErrInjected if err is nil. A negative n makes
+// all of them fail until Heal is called.
+func (m *Manager) Fail(call string, n int, err error) {
+	if err == nil {
+		err = ErrInjected
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if n == 0 {
+		delete(m.failures, call)
+		return
+	}
+	m.failures[call] = &failure{err: err, n: n}
+}
+
+// Heal stops the injected failures of all calls.
+func (m *Manager) Heal() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.failures = make(map[string]*failure)
+}
+
+func (m *Manager) fail(call string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	f, ok := m.failures[call]
+	if !ok {
+		return nil
+	}
+	if f.n > 0 {
+		f.n--
+		if f.n == 0 {
+			delete(m.failures, call)
+		}
+	}
+	return f.err
+}
+
+// SetNetworkConfig replaces the config of network.
+func (m *Manager) SetNetworkConfig(network, config string) error {
+	return m.registry.SetConfig(network, config)
+}
+
+// CreateNetwork adds network with config for the multi-network mode; the
+// network watchers get an added event.
+func (m *Manager) CreateNetwork(ctx context.Context, network, config string) error {
+	return m.registry.CreateNetwork(ctx, network, config)
+}
+
+// DeleteNetwork removes network; the network watchers get a removed event.
+func (m *Manager) DeleteNetwork(ctx context.Context, network string) error {
+	return m.registry.DeleteNetwork(ctx, network)
+}
+
+func (m *Manager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	if err := m.fail(GetNetworkConfig); err != nil {
+		return nil, err
+	}
+	return m.sm.GetNetworkConfig(ctx, network)
+}
+
+func (m *Manager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if err := m.fail(AcquireLease); err != nil {
+		return nil, err
+	}
+	return m.sm.AcquireLease(ctx, network, attrs)
+}
+
+func (m *Manager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	if err := m.fail(RenewLease); err != nil {
+		return err
+	}
+	return m.sm.RenewLease(ctx, network, lease)
+}
+
+func (m *Manager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	if err := m.fail(RevokeLease); err != nil {
+		return err
+	}
+	return m.sm.RevokeLease(ctx, network, sn)
+}
+
+func (m *Manager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if err := m.fail(WatchLease); err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+	return m.sm.WatchLease(ctx, network, sn, cursor)
+}
+
+func (m *Manager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if err := m.fail(WatchLeases); err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+	return m.sm.WatchLeases(ctx, network, cursor)
+}
+
+func (m *Manager) WatchNetworks(ctx context.Context, cursor interface{}) (subnet.NetworkWatchResult, error) {
+	if err := m.fail(WatchNetworks); err != nil {
+		return subnet.NetworkWatchResult{}, err
+	}
+	return m.sm.WatchNetworks(ctx, cursor)
+}
+
+func (m *Manager) AddReservation(ctx context.Context, network string, r *subnet.Reservation) error {
+	if err := m.fail(AddReservation); err != nil {
+		return err
+	}
+	return m.sm.AddReservation(ctx, network, r)
+}
+
+func (m *Manager) RemoveReservation(ctx context.Context, network string, sn ip.IP4Net) error {
+	if err := m.fail(RemoveReservation); err != nil {
+		return err
+	}
+	return m.sm.RemoveReservation(ctx, network, sn)
+}
+
+func (m *Manager) ListReservations(ctx context.Context, network string) ([]subnet.Reservation, error) {
+	if err := m.fail(ListReservations); err != nil {
+		return nil, err
+	}
+	return m.sm.ListReservations(ctx, network)
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnettest
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const config = `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan" } }`
+
+func acquire(t *testing.T, m *Manager, pubIP string) *subnet.Lease {
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4(pubIP), BackendType: "vxlan"}
+	l, err := m.AcquireLease(context.Background(), "_", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	return l
+}
+
+func TestAdvanceExpiresLeases(t *testing.T) {
+	m := NewManager("_", config)
+	ctx := context.Background()
+
+	l1 := acquire(t, m, "1.1.1.1")
+	l2 := acquire(t, m, "2.2.2.2")
+	if !l1.Expiration.Equal(m.Now().Add(24 * time.Hour)) {
+		t.Errorf("lease expires at %v, expected a day after %v", l1.Expiration, m.Now())
+	}
+
+	if expired := m.Advance(23 * time.Hour); len(expired) != 0 {
+		t.Fatalf("leases expired early: %v", expired)
+	}
+	if err := m.RenewLease(ctx, "_", l2); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+
+	expired := m.Advance(2 * time.Hour)
+	if len(expired) != 1 || !expired[0].Equal(l1.Subnet) {
+		t.Fatalf("expected %v to expire, got %v", l1.Subnet, expired)
+	}
+
+	res, err := m.WatchLeases(ctx, "_", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Snapshot) != 1 || !res.Snapshot[0].Subnet.Equal(l2.Subnet) {
+		t.Errorf("expected only the lease of %v, got %v", l2.Subnet, res.Snapshot)
+	}
+}
+
+func TestFail(t *testing.T) {
+	m := NewManager("_", config)
+	ctx := context.Background()
+
+	m.Fail(GetNetworkConfig, 2, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := m.GetNetworkConfig(ctx, "_"); err != ErrInjected {
+			t.Fatalf("call %d returned %v, expected the injected failure", i, err)
+		}
+	}
+	if _, err := m.GetNetworkConfig(ctx, "_"); err != nil {
+		t.Fatalf("GetNetworkConfig still fails: %v", err)
+	}
+
+	l := acquire(t, m, "1.1.1.1")
+	m.Fail(RenewLease, -1, context.DeadlineExceeded)
+	for i := 0; i < 5; i++ {
+		if err := m.RenewLease(ctx, "_", l); err != context.DeadlineExceeded {
+			t.Fatalf("call %d returned %v, expected %v", i, err, context.DeadlineExceeded)
+		}
+	}
+	m.Heal()
+	if err := m.RenewLease(ctx, "_", l); err != nil {
+		t.Fatalf("RenewLease still fails: %v", err)
+	}
+}
+
+func TestWatchLeasesSeesExpiration(t *testing.T) {
+	m := NewManager("_", config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	own := acquire(t, m, "1.1.1.1")
+	other := acquire(t, m, "2.2.2.2")
+
+	events := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, m, "_", own, events)
+
+	if batch := <-events; len(batch) != 1 || batch[0].Type != subnet.EventAdded {
+		t.Fatalf("expected the lease of the other host to be added, got %v", batch)
+	}
+
+	m.RenewLease(ctx, "_", own)
+	m.Advance(25 * time.Hour)
+
+	select {
+	case batch := <-events:
+		if len(batch) != 1 || batch[0].Type != subnet.EventRemoved || !batch[0].Lease.Subnet.Equal(other.Subnet) {
+			t.Errorf("expected the lease of %v to be removed, got %v", other.Subnet, batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the expiration")
+	}
+}
+
+func TestWatchersSeeAllEvents(t *testing.T) {
+	m := NewManager("_", config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watchers := make([]chan []subnet.Event, 3)
+	for i := range watchers {
+		watchers[i] = make(chan []subnet.Event)
+		go subnet.WatchLeases(ctx, m, "_", nil, watchers[i])
+	}
+	// let the watchers take their snapshot
+	time.Sleep(100 * time.Millisecond)
+
+	l := acquire(t, m, "1.1.1.1")
+	for i, events := range watchers {
+		select {
+		case batch := <-events:
+			if len(batch) != 1 || batch[0].Type != subnet.EventAdded || !batch[0].Lease.Subnet.Equal(l.Subnet) {
+				t.Errorf("watcher %d: expected the lease of %v to be added, got %v", i, l.Subnet, batch)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watcher %d: timed out waiting for the lease", i)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/tracing"
+)
+
+type tracingManager struct {
+	Manager
+}
+
+// NewTracingManager wraps sm to record a span for each registry call made
+// through it, as a child of the span in the context of the call.
+func NewTracingManager(sm Manager) Manager {
+	return &tracingManager{sm}
+}
+
+func startSpan(ctx context.Context, op, network string, attrs ...tracing.Attr) (context.Context, *tracing.Span) {
+	return tracing.Start(ctx, "subnet."+op, append(attrs, tracing.KV("network", network))...)
+}
+
+func (m *tracingManager) GetNetworkConfig(ctx context.Context, network string) (*Config, error) {
+	ctx, span := startSpan(ctx, "GetNetworkConfig", network)
+	cfg, err := m.Manager.GetNetworkConfig(ctx, network)
+	span.End(err)
+	return cfg, err
+}
+
+func (m *tracingManager) AcquireLease(ctx context.Context, network string, attrs *LeaseAttrs) (*Lease, error) {
+	ctx, span := startSpan(ctx, "AcquireLease", network, tracing.KV("public_ip", attrs.PublicIP.String()))
+	l, err := m.Manager.AcquireLease(ctx, network, attrs)
+	if l != nil {
+		span.SetAttr("subnet", l.Subnet.String())
+	}
+	span.End(err)
+	return l, err
+}
+
+func (m *tracingManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
+	ctx, span := startSpan(ctx, "RenewLease", network, tracing.KV("subnet", lease.Subnet.String()))
+	err := m.Manager.RenewLease(ctx, network, lease)
+	span.End(err)
+	return err
+}
+
+func (m *tracingManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	ctx, span := startSpan(ctx, "RevokeLease", network, tracing.KV("subnet", sn.String()))
+	err := m.Manager.RevokeLease(ctx, network, sn)
+	span.End(err)
+	return err
+}
+
+// The watches block until there is a change, so their spans show how long
+// it took for the change to arrive rather than the registry latency, except
+// for the initial snapshot.
+
+func (m *tracingManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	ctx, span := startSpan(ctx, "WatchLease", network, tracing.KV("subnet", sn.String()), tracing.KV("snapshot", cursor == nil))
+	wr, err := m.Manager.WatchLease(ctx, network, sn, cursor)
+	span.SetAttr("events", len(wr.Events))
+	span.End(err)
+	return wr, err
+}
+
+func (m *tracingManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error) {
+	ctx, span := startSpan(ctx, "WatchLeases", network, tracing.KV("snapshot", cursor == nil))
+	wr, err := m.Manager.WatchLeases(ctx, network, cursor)
+	span.SetAttr("events", len(wr.Events))
+	span.End(err)
+	return wr, err
+}
+
+func (m *tracingManager) WatchNetworks(ctx context.Context, cursor interface{}) (NetworkWatchResult, error) {
+	ctx, span := tracing.Start(ctx, "subnet.WatchNetworks", tracing.KV("snapshot", cursor == nil))
+	wr, err := m.Manager.WatchNetworks(ctx, cursor)
+	span.SetAttr("events", len(wr.Events))
+	span.End(err)
+	return wr, err
+}
+
+func (m *tracingManager) AddReservation(ctx context.Context, network string, r *Reservation) error {
+	ctx, span := startSpan(ctx, "AddReservation", network, tracing.KV("subnet", r.Subnet.String()))
+	err := m.Manager.AddReservation(ctx, network, r)
+	span.End(err)
+	return err
+}
+
+func (m *tracingManager) RemoveReservation(ctx context.Context, network string, sn ip.IP4Net) error {
+	ctx, span := startSpan(ctx, "RemoveReservation", network, tracing.KV("subnet", sn.String()))
+	err := m.Manager.RemoveReservation(ctx, network, sn)
+	span.End(err)
+	return err
+}
+
+func (m *tracingManager) ListReservations(ctx context.Context, network string) ([]Reservation, error) {
+	ctx, span := startSpan(ctx, "ListReservations", network)
+	rs, err := m.Manager.ListReservations(ctx, network)
+	span.End(err)
+	return rs, err
+}
@@ -17,10 +17,10 @@ package subnet
 import (
 	"time"
 
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/log"
 )
 
 // WatchLeases performs a long term watch of the given network's subnet leases
@@ -41,7 +41,9 @@ func WatchLeases(ctx context.Context, sm Manager, network string, ownLease *Leas
 			}
 
 			log.Errorf("Watch subnets: %v", err)
-			time.Sleep(time.Second)
+			if !retryDelay(ctx) {
+				return
+			}
 			continue
 		}
 
@@ -56,7 +58,11 @@ func WatchLeases(ctx context.Context, sm Manager, network string, ownLease *Leas
 		}
 
 		if len(batch) > 0 {
-			receiver <- batch
+			select {
+			case receiver <- batch:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
@@ -170,7 +176,9 @@ func WatchNetworks(ctx context.Context, sm Manager, receiver chan []Event) {
 			}
 
 			log.Errorf("Watch networks: %v", err)
-			time.Sleep(time.Second)
+			if !retryDelay(ctx) {
+				return
+			}
 			continue
 		}
 		cursor = res.Cursor
@@ -184,7 +192,11 @@ func WatchNetworks(ctx context.Context, sm Manager, receiver chan []Event) {
 		}
 
 		if len(batch) > 0 {
-			receiver <- batch
+			select {
+			case receiver <- batch:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
@@ -270,19 +282,38 @@ func WatchLease(ctx context.Context, sm Manager, network string, sn ip.IP4Net, r
 			}
 
 			log.Errorf("Subnet watch failed: %v", err)
-			time.Sleep(time.Second)
+			if !retryDelay(ctx) {
+				return
+			}
 			continue
 		}
 
+		var evt Event
 		if len(wr.Snapshot) > 0 {
-			receiver <- Event{
+			evt = Event{
 				Type:  EventAdded,
 				Lease: wr.Snapshot[0],
 			}
 		} else {
-			receiver <- wr.Events[0]
+			evt = wr.Events[0]
+		}
+		select {
+		case receiver <- evt:
+		case <-ctx.Done():
+			return
 		}
 
 		cursor = wr.Cursor
 	}
 }
+
+// retryDelay waits before a failed watch is retried. It returns false if ctx
+// is done first, so that the watch stops.
+func retryDelay(ctx context.Context) bool {
+	select {
+	case <-time.After(time.Second):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
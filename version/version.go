@@ -15,3 +15,6 @@
 package version
 
 var Version = "0.5.3+git"
+
+// GitSHA is the commit flannel was built from, set by the Makefile.
+var GitSHA = ""
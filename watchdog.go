@@ -0,0 +1,68 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coreos/flannel/pkg/log"
+	"github.com/coreos/go-systemd/daemon"
+	"golang.org/x/net/context"
+)
+
+// watchdogInterval returns how often systemd expects to be pinged, or 0 if
+// the watchdog is not enabled for this process (see sd_watchdog_enabled(3)).
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half the configured interval for
+// as long as healthCheck succeeds. Once it fails, pings are withheld so that
+// systemd restarts us.
+func runWatchdog(ctx context.Context, healthCheck func() error) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	log.Infof("systemd watchdog enabled, pinging every %v", interval/2)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(interval / 2):
+			if healthCheck != nil {
+				if err := healthCheck(); err != nil {
+					log.Warningf("Health check failed, withholding watchdog ping: %v", err)
+					continue
+				}
+			}
+			daemon.SdNotify("WATCHDOG=1")
+		}
+	}
+}